@@ -4,7 +4,7 @@ go 1.14
 
 require (
 	github.com/Masterminds/goutils v1.1.0 // indirect
-	github.com/Masterminds/semver v1.5.0 // indirect
+	github.com/Masterminds/semver v1.5.0
 	github.com/Masterminds/sprig v2.22.0+incompatible // indirect
 	github.com/cruise-automation/rbacsync v1.0.0
 	github.com/cyphar/filepath-securejoin v0.2.2 // indirect
@@ -42,8 +42,10 @@ require (
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/api v0.29.0
-	google.golang.org/protobuf v1.27.1 // indirect
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	istio.io/client-go v1.9.0
 	k8s.io/api v0.22.1
 	k8s.io/apiextensions-apiserver v0.22.1
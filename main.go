@@ -16,25 +16,60 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	stdlog "log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	goruntime "runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/golang/glog"
 	vaultapi "github.com/hashicorp/vault/api"
+	"go.starlark.net/starlark"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/annotate"
 	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/cloud/incluster"
+	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/controller"
 	"github.com/cruise-automation/isopod/pkg/dep"
+	"github.com/cruise-automation/isopod/pkg/helm"
+	"github.com/cruise-automation/isopod/pkg/httpdump"
+	ipd "github.com/cruise-automation/isopod/pkg/isopod"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/lock"
+	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/notify"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	"github.com/cruise-automation/isopod/pkg/plugins"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/report"
+	"github.com/cruise-automation/isopod/pkg/result"
+	"github.com/cruise-automation/isopod/pkg/rollout"
 	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/selfupdate"
+	"github.com/cruise-automation/isopod/pkg/server"
 	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/store/envelope"
 	kubeStore "github.com/cruise-automation/isopod/pkg/store/kube"
 	"github.com/cruise-automation/isopod/pkg/util"
+	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
 var version = "<unknown>"
@@ -42,7 +77,13 @@ var version = "<unknown>"
 var (
 	// optional
 	vaultToken         = flag.String("vault_token", os.Getenv("VAULT_TOKEN"), "Vault token obtained during authentication.")
-	namespace          = flag.String("namespace", "default", "Kubernetes namespace to store metadata in.")
+	vaultMaxRetries    = flag.Int("vault_max_retries", vault.DefaultRetryPolicy.MaxRetries, "Number of retries of Vault requests failed with connection errors, 429 or 5xx responses.")
+	vaultRetryWait     = flag.Duration("vault_retry_wait", vault.DefaultRetryPolicy.MinWait, "Minimum wait before retrying a Vault request. Waits grow exponentially (with jitter) up to --vault_max_retry_wait.")
+	vaultMaxRetryWait  = flag.Duration("vault_max_retry_wait", vault.DefaultRetryPolicy.MaxWait, "Maximum wait before retrying a Vault request (also caps Retry-After of 429 responses).")
+	vaultTimeout       = flag.Duration("vault_timeout", vault.DefaultRetryPolicy.Timeout, "Timeout of each attempt of a Vault request (0 for none).")
+	vaultBreaker       = flag.Int("vault_breaker_threshold", vault.DefaultBreaker.Threshold, "Number of consecutive Vault requests failed after retries that make further requests fail fast as Vault unavailable (0 disables).")
+	vaultCoolDown      = flag.Duration("vault_breaker_cooldown", vault.DefaultBreaker.CoolDown, "How long Vault requests fail fast once --vault_breaker_threshold is reached before Vault is tried again.")
+	namespace          = flag.String("namespace", "", "Kubernetes namespace to store metadata in. Defaults to the namespace of the service account Isopod runs as for incluster() (and the controller in its cluster) and `default' for other clusters. Clusters setting `default_namespace' in clusters() use theirs.")
 	noStore            = flag.Bool("no_store", false, "If provided, do not store rollout and addon metadata.")
 	kubeconfig         = flag.String("kubeconfig", "", "Kubernetes client config path.")
 	qps                = flag.Int("qps", 100, "qps to configure the kubernetes RESTClient")
@@ -50,15 +91,87 @@ var (
 	addonRegex         = flag.String("match_addons", "", "Filters configured addons based on provided regex.")
 	isopodCtx          = flag.String("context", "", "Comma-separated list of `foo=bar' context parameters passed to the clusters Starlark function.")
 	dryRun             = flag.Bool("dry_run", false, "Print intended actions but don't mutate anything.")
-	force              = flag.Bool("force", false, "Delete and recreate immutable resources without confirmation.")
+	force              = flag.Bool("force", false, "Delete and recreate immutable resources without confirmation. Default for addons and kube.put calls that don't set `force'.")
 	svcAcctKeyFile     = flag.String("sa_key", "", "Path to the service account json file.")
 	noSpin             = flag.Bool("nospin", false, "Disables command line status spinner.")
 	kubeDiff           = flag.Bool("kube_diff", false, "Print diff against live Kubernetes objects.")
 	kubeDiffFilter     = util.StringsFlag("kube_diff_filter", []string{}, "Filter elements in diffs using JSONPath key matching.")
 	kubeDiffFilterFile = flag.String("kube_diff_filter_file", "", "Path to a file of filters delimited by new lines.")
+	diffCache          = flag.String("diff_cache", "", "Path to a cache file used by --dry_run to skip diffing objects that were unchanged in a previous run and haven't changed since.")
 	showVersion        = flag.Bool("version", false, "Print binary version/system information and exit(0).")
-	relativePath       = flag.String("rel_path", "", "The base path used to interpret double slash prefix.")
+	relativePath       = flag.String("rel_path", "", "The workspace root `//'-prefixed paths are relative to. Defaults to the nearest ancestor of the entry file directory containing isopod.deps (or the entry file directory if there is none).")
 	depsFile           = flag.String("deps", "", "Path to isopod.deps")
+	planOut            = flag.String("out", "", "Path to write the plan file produced by the plan command.")
+	rolloutStrategy    = flag.String("rollout_strategy", string(rollout.AllStrategy), "Cluster rollout strategy, one of `all' or `canary'.")
+	canaryBatches      = flag.String("canary_batches", rollout.DefaultBatches, "Comma-separated cumulative cluster counts or percents rolled out by each canary batch.")
+	canarySoak         = flag.Duration("canary_soak", 0, "Time to wait after each successful canary batch before starting the next one.")
+	serveToken         = flag.String("serve_token", os.Getenv("ISOPOD_SERVE_TOKEN"), "Bearer token clients of the serve command must authenticate with.")
+	serveTLSCert       = flag.String("serve_tls_cert", "", "Path to the TLS certificate the serve command serves with. Required (with --serve_tls_key) unless listening on a loopback address.")
+	serveTLSKey        = flag.String("serve_tls_key", "", "Path to the TLS private key of --serve_tls_cert.")
+	serveRoot          = flag.String("serve_root", ".", "Directory entry files run by the serve command must be in (relative entry files are relative to it).")
+	serveGRPCAddr      = flag.String("serve_grpc_addr", "", "Also serve the gRPC API of the serve command on this address.")
+	reconcileInterval  = flag.Duration("reconcile_interval", 5*time.Minute, "Interval between periodic reconciliations in controller mode.")
+	prReporter         = flag.String("pr_reporter", "", "Post diffs produced by --dry_run or --kube_diff as a pull request comment, one of `github' or `gitlab'.")
+	prRepo             = flag.String("pr_repo", "", "GitHub `owner/name' repository or GitLab project ID/path the pull request belongs to.")
+	prNumber           = flag.Int("pr_number", 0, "GitHub pull request number or GitLab merge request IID.")
+	prToken            = flag.String("pr_token", os.Getenv("ISOPOD_PR_TOKEN"), "GitHub or GitLab API token used by --pr_reporter.")
+	prAPIURL           = flag.String("pr_api_url", "", "GitHub or GitLab API endpoint (defaults to the public service).")
+	integration        = flag.Bool("integration", false, "Run tests of the test command against a real Kubernetes API server (of a kind cluster created with --kind or of --kubeconfig) instead of the fake kube module.")
+	kindCluster        = flag.Bool("kind", false, "With --integration, create an ephemeral kind cluster for tests and delete it afterwards (requires kind and Docker).")
+	diffReport         = flag.String("diff_report", "", "Write diffs produced by --dry_run or --kube_diff to this HTML file, grouped by cluster, addon and object.")
+	notifySlackWebhook = flag.String("notify_slack_webhook", os.Getenv("ISOPOD_NOTIFY_SLACK_WEBHOOK"), "Slack incoming webhook URL to post rollout notifications to.")
+	notifyWebhook      = flag.String("notify_webhook", "", "URL to post JSON rollout notifications to.")
+	notifyOn           = flag.String("notify_on", "failure,complete", "Comma-separated rollout events to notify on: start, success, failure, complete.")
+	lockTimeout        = flag.Duration("lock_timeout", 0, "Time to wait for the rollout lock held by another Isopod before failing. Zero fails immediately.")
+	clusterFacts       = flag.Bool("cluster_facts", false, "Populate addon ctx with cluster facts (version, API groups, nodes) discovered from the apiserver.")
+	failureEvents      = flag.Bool("failure_events", true, "Include recent Kubernetes events related to objects touched by a failed addon in its error.")
+	failurePodLogs     = flag.Bool("failure_pod_logs", false, "Also include trailing logs of unhealthy pods touched by a failed addon (requires --failure_events).")
+	impersonateUser    = flag.String("as", "", "Username to impersonate in Kubernetes API requests.")
+	impersonateGroups  = util.StringsFlag("as_group", nil, "Group to impersonate in Kubernetes API requests (requires --as, may be repeated).")
+	clientCert         = flag.String("client_cert", "", "Path to a client certificate used to authenticate to Kubernetes API (requires --client_key).")
+	clientKey          = flag.String("client_key", "", "Path to the key of --client_cert.")
+	proxyURL           = flag.String("proxy_url", "", "URL of a proxy Kubernetes API requests are sent through.")
+	execCommand        = flag.String("exec_command", "", "Exec credential plugin used to authenticate to Kubernetes API instead of cluster vendor credentials.")
+	execArgs           = util.StringsFlag("exec_arg", nil, "Argument passed to --exec_command (may be repeated).")
+	userAgent          = flag.String("user_agent", "", "User agent of Kubernetes API requests (defaults to Isopod/<version>).")
+	prune              = flag.Bool("prune", false, "Delete objects recorded for an addon by the live rollout that the addon no longer applies.")
+	snapshotDir        = flag.String("snapshot_dir", "", "If set, manifests of live objects are archived in <dir>/<rollout ID>/<addon>/ before they are updated.")
+	rollbackOnFailure  = flag.Bool("rollback_on_failure", false, "Restore objects applied by a failed addon to their previous state (deleting newly created ones) before aborting.")
+	strictRemove       = flag.Bool("strict_remove", false, "Make the remove command fail if an object deleted by an addon doesn't exist (by default missing objects are ignored).")
+	autoMigrateAPIs    = flag.Bool("auto_migrate_apis", false, "Apply objects of API versions deprecated or removed in the cluster's Kubernetes release in their equivalent replacement versions.")
+	strictOwnership    = flag.Bool("strict_ownership", false, "Fail updates that would overwrite fields of live objects managed by another manager (e.g replicas scaled by an HPA) instead of logging a warning.")
+	manageMetadata     = flag.Bool("manage_metadata", true, "Set the heritage label, addon version labels and context annotation on applied objects (unless overridden by manage_metadata of kube.put and kube.put_yaml calls).")
+	ctxAnnotation      = flag.String("context_annotation", string(kube.ContextFull), "How addon contexts are recorded on applied objects: full annotates the context JSON, hash only its hash (full contexts are kept in the rollout store).")
+	dryRunVault        = flag.String("dry_run_vault", string(vault.DryRunReadOnly), "How the vault module behaves with --dry_run: readonly reads from Vault but fakes writes, fake never calls Vault, real also writes to Vault.")
+	readOnly           = flag.Bool("read_only", false, "Fail any write to Kubernetes (including Helm charts), Vault, HTTP endpoints (other than GET) and the rollout store, as well as all gRPC calls and commands, even if addons don't handle dry run correctly. Dry run diffs still work.")
+	helmChartCache     = flag.String("helm_chart_cache", helm.ChartCache, "Directory Helm chart dependencies downloaded from chart repositories are cached in.")
+	workspaceDir       = flag.String("workspace_dir", dep.Workspace, "Directory remote modules of isopod.deps are checked out in.")
+	olderThan          = flag.String("older_than", "30d", "The clean command removes dependency checkouts and cached Helm charts not used for this long (e.g 30d or 12h).")
+	storeRetention     = flag.String("store_retention", "", "If set, a successful install and the store gc command remove rollouts (and their addon runs) from the store created longer ago than this (e.g 30d or 12h), unless kept by --store_keep_last. The live rollout is always kept.")
+	storeDecryptKeys   = flag.String("store_decryption_keys", "", "Comma-separated URIs (like --store_encryption_key) of keys the rollout store was previously encrypted with, so that addon runs recorded before --store_encryption_key was changed can still be read.")
+	storeEncryptionKey = flag.String("store_encryption_key", "", "If set, modules, objects, contexts and data of addon runs are encrypted in the rollout store with data keys wrapped by this key: vault-transit://[<mount>/]<key> (Vault transit, mount defaults to transit) or gcpkms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k> (Google Cloud KMS).")
+	storeKeepLast      = flag.Int("store_keep_last", 0, "If set, a successful install and the store gc command remove all but this many most recent rollouts from the store, unless kept by --store_retention. The live rollout is always kept.")
+	tokenCache         = flag.String("token_cache", onprem.TokenCache, "Directory tokens of OIDC logins of onprem clusters are cached in.")
+	changedOnly        = flag.Bool("changed_only", false, "Only run addons whose modules (including transitively loaded modules and data files) or Helm chart directories changed relative to --git_base. All addons run if the entry file changed.")
+	gitBase            = flag.String("git_base", "origin/main", "Git ref files are compared to by --changed_only.")
+	timings            = flag.Bool("timings", false, "Print how long each addon took, broken down into Starlark evaluation, kube, vault and helm built-ins and verification.")
+	starlarkProfile    = flag.String("starlark_profile", "", "If set, a wall-time profile of Starlark execution (in pprof format, readable with go tool pprof) is written to this file.")
+	showCtx            = flag.Bool("show_ctx", false, "Print the ctx addons of each cluster are created with (cluster attributes merged with --context parameters, cluster facts and the profile) as YAML with secrets redacted.")
+	preload            = flag.Bool("preload", false, "Load modules of all addons concurrently before running any so that all load failures (e.g. missing modules) are reported at once.")
+	profile            = flag.String("profile", "", "Profile declared with profiles() in the entry file merged into the ctx of every addon. Defaults to the default profile of profiles().")
+	liveStatus         = flag.Bool("live", false, "Make the list command show the last rollout of each addon and whether its objects still match the cluster, and the graph command show kinds and namespaces of objects each addon applies.")
+	allowNamespaces    = flag.String("allow_namespaces", "", "Comma-separated namespaces Isopod may mutate objects in. Cluster-scoped objects are denied when set.")
+	denyNamespaces     = flag.String("deny_namespaces", "", "Comma-separated namespaces Isopod must not mutate objects in.")
+	allowKinds         = flag.String("allow_kinds", "", "Comma-separated kinds (optionally `Kind.group') Isopod may mutate.")
+	denyKinds          = flag.String("deny_kinds", "", "Comma-separated kinds (optionally `Kind.group') Isopod must not mutate.")
+	allowExec          = flag.String("allow_exec", "", "Comma-separated commands (e.g. `helm') addons may run with exec.run. Running commands is disabled by default.")
+	pluginDir          = flag.String("plugin_dir", "", "Directory of Go plugins (`*.so') providing custom Starlark modules.")
+	outputFormat       = flag.String("format", "", "Output format. For the generate command, the format objects of kinds unknown to Isopod (e.g. custom resources) are built in, one of `put_yaml' (structs, the default) or `dict' (dicts). For the graph command, one of `dot' (the default) or `json'.")
+	debugHTTPDump      = flag.String("debug_http_dump", "", "Directory to write (redacted) Kubernetes, Vault and HTTP requests and responses to, one file per addon.")
+	resultJSON         = flag.String("result_json", "", "Path to write the result of the run (status, error, rollout ID and stats of each cluster and addon) to as JSON.")
+	detailedExitCode   = flag.Bool("detailed_exitcode", false, "Exit with 6 instead of 0 if --dry_run would change objects.")
+	checkIdempotency   = flag.Bool("check_idempotency", false, "With --dry_run, install each addon a second time and fail if it renders different objects (e.g with random values or timestamps).")
+	ciOutput           = flag.String("output", "", "Also report failures as CI annotations, one of github (GitHub Actions workflow commands) or buildkite (log sections and buildkite-agent annotations).")
 )
 
 func init() {
@@ -71,14 +184,38 @@ func usageAndDie() {
 By default, isopod targets all addons on all clusters. One may confine the
 selection with "--match_addons" and "--clusters_selector".
 
-Usage: %s [options] <command> <ENTRYFILE_PATH | TEST_PATH | INPUT_PATH>
+Commands install, remove, list, graph and check accept multiple ENTRYFILE_PATHs or
+glob patterns (e.g. 'clusters/*.ipd'), merging their clusters and addons.
+
+Usage: %s [options] <command> <ENTRYFILE_PATH... | TEST_PATH | INPUT_PATH | PLAN_PATH | CONFIGMAP_NAME | LISTEN_ADDR | NAME> [OBJECT]
 
 The following commands are supported:
 	install        install addons
 	remove         uninstall addons
 	list           list addons in the ENTRYFILE_PATH
-	test           run unit tests in TEST_PATH
+	test           run unit tests in TEST_PATH (with --integration, against a real API server)
 	generate       generate a Starlark addon file from yaml or json file at INPUT_PATH
+	plan           record intended changes of install into the file set by --out
+	controller     continuously reconcile addons referenced by CONFIGMAP_NAME in --namespace
+	serve          serve remote rollout API on LISTEN_ADDR
+	apply          apply changes recorded in PLAN_PATH, fails if live state drifted
+	versions       report versions of addons in the live rollout of each cluster
+	explain        report which addon and rollout manage OBJECT (<resource>/[<namespace>/]<name>), e.g. "explain main.ipd deploy/default/nginx"
+	check          validate ENTRYFILE_PATH, the addons it returns and modules they load without connecting to clusters
+	graph          print the graph of addons in the ENTRYFILE_PATH, modules they load and (with --live) kinds they apply
+	clean          remove dependency checkouts and cached charts not used for --older_than (except dependencies of the workspace of ENTRYFILE_PATH or the current directory)
+	new addon      scaffold addon NAME in the current directory, run "new addon --help" for options
+	self-update    replace this binary with the release set by --version, e.g. "self-update --version=v0.9.3"
+	store gc       remove rollouts not kept by --store_retention and --store_keep_last from the store of each cluster, e.g. "store gc main.ipd"
+
+Exit codes:
+	0  success
+	1  invalid flags or arguments, or other failure
+	2  addons failed on all clusters they ran on
+	3  addons failed on some clusters but succeeded on others
+	4  an entry file, addon or module failed to load
+	5  the rollout lock of a cluster is held by another Isopod
+	6  --dry_run would change objects (only with --detailed_exitcode)
 
 The following options are supported:
 `, os.Args[0])
@@ -93,8 +230,14 @@ func getCmdAndPath(argv []string) (cmd runtime.Command, path string) {
 	}
 
 	cmd = runtime.Command(argv[0])
+	if cmd == runtime.StoreCommand {
+		if len(argv) < 3 || argv[1] != "gc" {
+			usageAndDie()
+		}
+		return cmd, argv[2]
+	}
 	if len(argv) < 2 {
-		if cmd == runtime.TestCommand {
+		if cmd == runtime.TestCommand || cmd == runtime.CleanCommand || cmd == runtime.SelfUpdateCommand {
 			return
 		}
 		usageAndDie()
@@ -103,50 +246,336 @@ func getCmdAndPath(argv []string) (cmd runtime.Command, path string) {
 	return
 }
 
-func buildClustersRuntime(mainFile string) runtime.Runtime {
+// workspaceRoot returns --rel_path or the workspace root found from the
+// directory of the entry file (the working directory for commands without
+// one).
+func workspaceRoot(cmd runtime.Command, path string) (string, error) {
+	if *relativePath != "" {
+		return filepath.Abs(*relativePath)
+	}
+	dir := filepath.Dir(path)
+	// Entry files may be glob patterns.
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	if cmd == runtime.GenerateCommand || cmd == runtime.TestCommand {
+		dir = "."
+	}
+	return loader.FindWorkspaceRoot(dir)
+}
+
+func buildClustersRuntime(mainFile string, extraOpts ...runtime.Option) (runtime.Runtime, error) {
+	// notify() may be called by the entry file but only takes effect with
+	// the notifier passed in extraOpts.
+	opts := append([]runtime.Option{
+		runtime.WithPredeclared("notify", notify.New(mainFile, "").Builtin()),
+	}, httpDumpOptions()...)
+	opts = append(opts, pluginOptions()...)
+	opts = append(opts, extraOpts...)
 	clusters, err := runtime.New(&runtime.Config{
 		EntryFile:         mainFile,
 		GCPSvcAcctKeyFile: *svcAcctKeyFile,
 		UserAgent:         "Isopod/" + version,
+		Version:           version,
 		KubeConfigPath:    *kubeconfig,
 		DryRun:            *dryRun,
 		Force:             *force,
-	})
+	}, opts...)
 	if err != nil {
-		log.Exitf("Failed to initialize clusters runtime: %v", err)
+		return nil, fmt.Errorf("failed to initialize clusters runtime: %v", err)
 	}
-	return clusters
+	return clusters, nil
 }
 
-func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, error) {
-	vaultC, err := vaultapi.NewClient(nil)
+// newVaultClient returns Vault client configured from environment and
+// --vault_token.
+func newVaultClient() (*vaultapi.Client, error) {
+	vaultConf := vaultapi.DefaultConfig()
+	vault.DefaultRetryPolicy.Configure(vaultConf)
+	vaultC, err := vaultapi.NewClient(vaultConf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Vault client: %v", err)
 	}
 	if *vaultToken != "" {
 		vaultC.SetToken(*vaultToken)
 	}
+	// Wrapped after creating the client since it expects *http.Transport.
+	if httpDumper != nil {
+		vaultConf.HttpClient.Transport = httpDumper.Transport(vaultConf.HttpClient.Transport)
+	}
+	return vaultC, nil
+}
+
+// httpDumpOptions returns runtime options that dump requests of the http
+// module if --debug_http_dump is set.
+func httpDumpOptions() []runtime.Option {
+	if httpDumper == nil {
+		return nil
+	}
+	return []runtime.Option{runtime.WithHTTPTransport(httpDumper.Transport)}
+}
+
+// pluginOptions returns runtime options registering modules loaded from
+// --plugin_dir.
+func pluginOptions() []runtime.Option {
+	var opts []runtime.Option
+	for name, m := range pluginModules {
+		opts = append(opts, runtime.WithCustomModule(name, m))
+	}
+	return opts
+}
+
+// newKubeStore returns rollout store in namespace ns of the cluster of cs
+// encrypting addon runs with --store_encryption_key (if set).
+func newKubeStore(cs kubernetes.Interface, ns string) (*kubeStore.Store, error) {
+	st := kubeStore.New(cs, ns)
+	w, err := storeKeyWrapper()
+	if err != nil || w == nil {
+		return st, err
+	}
+	st.SetKeyWrapper(w)
+	return st, nil
+}
 
-	// configure rate limiter
+// storeKeyWrapper returns key wrapper of --store_encryption_key (nil if not
+// set) also unwrapping keys of --store_decryption_keys.
+func storeKeyWrapper() (envelope.KeyWrapper, error) {
+	if *storeEncryptionKey == "" {
+		return nil, nil
+	}
+	vaultC, err := newVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	w, err := envelope.NewKeyWrapper(context.Background(), *storeEncryptionKey, vaultC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value to --store_encryption_key: %v", err)
+	}
+	var previous []envelope.KeyWrapper
+	for _, uri := range splitList(*storeDecryptKeys) {
+		p, err := envelope.NewKeyWrapper(context.Background(), uri, vaultC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value to --store_decryption_keys: %v", err)
+		}
+		previous = append(previous, p)
+	}
+	if len(previous) > 0 {
+		w = envelope.WithPreviousKeys(w, previous...)
+	}
+	return w, nil
+}
+
+// releaseLock calls release and replaces *err with its error (if any), which
+// takes precedence as failures after losing the lock are caused by it.
+func releaseLock(release func() error, err *error) {
+	if lockErr := release(); lockErr != nil {
+		*err = lockErr
+	}
+}
+
+// metadataNamespace returns the namespace Isopod metadata (rollout store and
+// lock) of the cluster of k8sVendor is kept in: its
+// cloud.DefaultNamespaceField if set, --namespace if set and the namespace of
+// the service account Isopod runs as in its own cluster otherwise.
+func metadataNamespace(k8sVendor cloud.KubernetesVendor) (string, error) {
+	ns, err := cloud.DefaultNamespaceOf(k8sVendor)
+	if err != nil || ns != "" {
+		return ns, err
+	}
+	if *namespace != "" {
+		return *namespace, nil
+	}
+	return incluster.NamespaceOf(k8sVendor), nil
+}
+
+// clusterName returns the `cluster' field of k8sVendor (empty if not set).
+func clusterName(k8sVendor cloud.KubernetesVendor, userCtx map[string]string) string {
+	if s, ok := k8sVendor.AddonSkyCtx(userCtx).Attrs["cluster"].(starlark.String); ok {
+		return string(s)
+	}
+	return ""
+}
+
+// applyPlan executes plan read from planFile on each of its target clusters.
+// Target clusters are resolved by calling the clusters Starlark function of the
+// entry file the plan was computed from and must match the planned clusters.
+func applyPlan(ctx context.Context, planFile string) error {
+	p, err := plan.ReadFile(planFile)
+	if err != nil {
+		return err
+	}
+
+	vaultC, err := newVaultClient()
+	if err != nil {
+		return err
+	}
+
+	clusters, err := buildClustersRuntime(p.EntryFile)
+	if err != nil {
+		return err
+	}
+	if err := clusters.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load clusters runtime: %v", err)
+	}
+
+	// Clusters are applied in plan order, so remaining clusters are skipped
+	// once one failed.
+	var applied int
+	var failed bool
+	if err := clusters.ForEachCluster(ctx, p.Context, func(k8sVendor cloud.KubernetesVendor) error {
+		if failed {
+			return nil
+		}
+		err := applyCluster(ctx, p, applied, k8sVendor, vaultC)
+		applied++
+		failed = err != nil
+		return err
+	}); err != nil {
+		return err
+	}
+	if applied != len(p.Clusters) {
+		return fmt.Errorf("plan targets %d clusters but only %d were found", len(p.Clusters), applied)
+	}
+	return nil
+}
+
+// applyCluster applies the i-th cluster of plan p to the cluster of
+// k8sVendor.
+func applyCluster(ctx context.Context, p *plan.Plan, i int, k8sVendor cloud.KubernetesVendor, vaultC *vaultapi.Client) (err error) {
+	name := clusterName(k8sVendor, p.Context)
+	if i >= len(p.Clusters) {
+		return errors.New("cluster is not part of the plan")
+	}
+	c := p.Clusters[i]
+	if c.Name != name {
+		return fmt.Errorf("planned cluster `%s' does not match target cluster", c.Name)
+	}
+
+	kubeC, err := kubeConfigFor(ctx, k8sVendor)
+	if err != nil {
+		return fmt.Errorf("failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+	}
 	kubeC.QPS = float32(*qps)
 	kubeC.Burst = *burst
 
+	ns, err := metadataNamespace(k8sVendor)
+	if err != nil {
+		return err
+	}
 	cs, err := kubernetes.NewForConfig(kubeC)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
 	}
-	helmBaseDir := *relativePath
-	if helmBaseDir == "" {
-		helmBaseDir = filepath.Dir(mainFile)
+	ctx, release, err := lock.Hold(ctx, cs, ns, *lockTimeout)
+	if err != nil {
+		return err
 	}
+	defer releaseLock(release, &err)
 
-	var st store.Store
-	if *noStore {
-		st = store.NoopStore{}
-	} else {
-		st = kubeStore.New(cs, *namespace)
+	dC, err := discovery.NewDiscoveryClientForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes discovery client: %v", err)
+	}
+	dynC, err := dynamic.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes dynamic client: %v", err)
+	}
+
+	st, err := newKubeStore(cs, ns)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Applying %d planned changes...\n", len(c.Mutations))
+	a := plan.NewApplier(dC, dynC, vault.NewRefResolver(vaultC))
+	a.SetStore(st)
+	a.SetPolicy(kubePolicy())
+	return a.Apply(ctx, c)
+}
+
+// httpDumper dumps requests if --debug_http_dump is set (nil otherwise).
+var httpDumper *httpdump.Dumper
+
+// pluginModules are custom modules loaded from --plugin_dir.
+var pluginModules map[string]starlark.HasAttrs
+
+// runClusters runs cmd for addons in mainFiles on each cluster returned by the
+// clusters Starlark functions called with ctxParams, following
+// --rollout_strategy. opts are passed to the runtimes of the entry files and
+// of each cluster. Outcome of each cluster is recorded in results (if not
+// nil).
+func runClusters(ctx context.Context, cmd runtime.Command, mainFiles []string, ctxParams map[string]string, recorder *plan.Recorder, results *result.Recorder, opts ...runtime.Option) error {
+	runnerOpts, err := runnerOptions(mainFiles, ctxParams, recorder, opts)
+	if err != nil {
+		return err
 	}
+	runner, err := ipd.NewRunner(ctx, runnerOpts)
+	if err != nil {
+		return err
+	}
+
+	runCluster := func(k8sVendor cloud.KubernetesVendor) error {
+		if recorder != nil {
+			recorder.BeginCluster(clusterName(k8sVendor, ctxParams))
+		}
+		err := runner.RunCluster(ctx, cmd, k8sVendor)
+		if results != nil {
+			results.ClusterDone(clusterName(k8sVendor, ctxParams), err)
+		}
+		return err
+	}
+
+	switch rollout.Strategy(*rolloutStrategy) {
+	case rollout.AllStrategy:
+		if err := runner.RunEach(ctx, runCluster); err != nil {
+			return err
+		}
 
+	case rollout.CanaryStrategy:
+		if cmd != runtime.InstallCommand && cmd != runtime.RemoveCommand {
+			return fmt.Errorf("`%s' rollout strategy is not supported for `%s' command", *rolloutStrategy, cmd)
+		}
+		batches, err := rollout.ParseBatches(*canaryBatches)
+		if err != nil {
+			return fmt.Errorf("invalid value to --canary_batches: %v", err)
+		}
+
+		// Collect all clusters upfront so that batch sizes are known.
+		vendors, err := runner.Clusters(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to iterate through clusters: %v", err)
+		}
+
+		canary := &rollout.Canary{Batches: batches, Soak: *canarySoak}
+		if err := canary.Run(ctx, len(vendors), func(i int) error {
+			fmt.Printf("Rolling out to cluster: (%s)\n", clusterName(vendors[i], ctxParams))
+			err := runCluster(vendors[i])
+			if err != nil {
+				log.Errorf("addons run failed: %v", err)
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("%w: %v", ipd.ErrAddonsFailed, err)
+		}
+
+	default:
+		return fmt.Errorf("unknown --rollout_strategy `%s'", *rolloutStrategy)
+	}
+	return nil
+}
+
+// runnerOptions returns options of the runner of mainFiles configured by
+// flags. opts are passed to the runtimes of the entry files and of each
+// cluster.
+func runnerOptions(mainFiles []string, ctxParams map[string]string, recorder *plan.Recorder, opts []runtime.Option) (*ipd.Options, error) {
+	vaultC, err := newVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	keyWrapper, err := storeKeyWrapper()
+	if err != nil {
+		return nil, err
+	}
 	var diffFilters []string
 	if *kubeDiffFilterFile != "" {
 		diffFilters, err = util.LoadFilterFile(*kubeDiffFilterFile)
@@ -157,37 +586,627 @@ func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, e
 	if len(*kubeDiffFilter) > 0 {
 		diffFilters = append(diffFilters, (*kubeDiffFilter)...)
 	}
+	vaultMode, err := vault.ParseDryRunMode(*dryRunVault)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value to --dry_run_vault: %v", err)
+	}
 
-	opts := []runtime.Option{
-		runtime.WithVault(vaultC),
-		runtime.WithKube(kubeC, *kubeDiff, diffFilters),
-		runtime.WithHelm(helmBaseDir),
-		runtime.WithAddonRegex(regexp.MustCompile(*addonRegex)),
+	// notify() may be called by entry files and addons but only takes
+	// effect with the notifier passed in opts.
+	runtimeOpts := []runtime.Option{
+		runtime.WithPredeclared("notify", notify.New(mainFiles[0], "").Builtin()),
 	}
-	if *noSpin {
-		opts = append(opts, runtime.WithNoSpin())
+	runtimeOpts = append(runtimeOpts, httpDumpOptions()...)
+	runtimeOpts = append(runtimeOpts, pluginOptions()...)
+	runtimeOpts = append(runtimeOpts, opts...)
+
+	var addonsOpts []runtime.Option
+	if recorder != nil {
+		addonsOpts = append(addonsOpts, runtime.WithPlan(recorder))
+	}
+	addonsOpts = append(addonsOpts,
+		runtime.WithVaultDryRunMode(vaultMode),
+		runtime.WithPolicy(kubePolicy()),
+		runtime.WithExec(splitList(*allowExec)),
+	)
+	if *failureEvents {
+		addonsOpts = append(addonsOpts, runtime.WithFailureDiagnostics(*failurePodLogs))
 	}
 
-	addons, err := runtime.New(&runtime.Config{
-		EntryFile:         mainFile,
-		GCPSvcAcctKeyFile: *svcAcctKeyFile,
-		UserAgent:         "Isopod/" + version,
-		KubeConfigPath:    *kubeconfig,
-		Store:             st,
+	o := &ipd.Options{
+		EntryFile:         mainFiles[0],
+		ExtraEntryFiles:   mainFiles[1:],
+		Context:           ctxParams,
 		DryRun:            *dryRun,
+		ReadOnly:          *readOnly,
 		Force:             *force,
-	}, opts...)
+		KubeDiff:          *kubeDiff,
+		DiffFilters:       diffFilters,
+		AddonRegex:        *addonRegex,
+		StoreNamespace:    *namespace,
+		NoStore:           *noStore,
+		StoreKeyWrapper:   keyWrapper,
+		LockTimeout:       *lockTimeout,
+		ClusterFacts:      *clusterFacts,
+		WorkspaceRoot:     loader.WorkspaceRoot(),
+		GCPSvcAcctKeyFile: *svcAcctKeyFile,
+		KubeConfigPath:    *kubeconfig,
+		UserAgent:         "Isopod/" + version,
+		Version:           version,
+		Vault:             vaultC,
+		KubeConfig:        kubeConfigFor,
+		QPS:               float32(*qps),
+		Burst:             *burst,
+		Spin:              !*noSpin,
+		RuntimeOptions:    runtimeOpts,
+		AddonsOptions:     addonsOpts,
+	}
+	if httpDumper != nil {
+		o.WrapTransport = httpDumper.Transport
+	}
+	return o, nil
+}
+
+// startStarlarkProfile starts profiling Starlark execution into file at path
+// (if set) and returns function that stops it.
+func startStarlarkProfile(path string) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := starlark.StartProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		if err := starlark.StopProfile(); err != nil {
+			log.Errorf("Failed to write Starlark profile: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Errorf("Failed to close Starlark profile: %v", err)
+		}
+		log.Infof("Starlark profile written to `%s'", path)
+	}, nil
+}
+
+// clean removes dependency checkouts and cached Helm charts not used for
+// --older_than. Dependencies of the current workspace are kept.
+func clean() error {
+	age, err := util.ParseDuration(*olderThan)
+	if err != nil {
+		return fmt.Errorf("invalid value to --older_than: %v", err)
+	}
+	var keep []string
+	for _, d := range loader.Dependencies() {
+		keep = append(keep, d.LocalDir())
+	}
+	removed, err := dep.Clean(age, keep)
+	if err != nil {
+		return err
+	}
+	charts, err := helm.CleanCache(age)
+	if err != nil {
+		return err
+	}
+	for _, p := range append(removed, charts...) {
+		fmt.Printf("Removed %s\n", p)
+	}
+	fmt.Printf("Removed %d dependency checkouts and %d cached charts not used for %s.\n", len(removed), len(charts), *olderThan)
+	return nil
+}
+
+// storeRetentionFlag returns store.Retention set by --store_retention and
+// --store_keep_last.
+func storeRetentionFlag() (store.Retention, error) {
+	r := store.Retention{KeepLast: *storeKeepLast}
+	if r.KeepLast < 0 {
+		return r, fmt.Errorf("invalid value to --store_keep_last: %d", r.KeepLast)
+	}
+	if *storeRetention != "" {
+		age, err := util.ParseDuration(*storeRetention)
+		if err != nil {
+			return r, fmt.Errorf("invalid value to --store_retention: %v", err)
+		}
+		r.MaxAge = age
+	}
+	return r, nil
+}
+
+// storeGC removes rollouts not kept by r from the store in --namespace of
+// each cluster returned by the clusters Starlark function of entryFile. Only
+// prints rollouts that would be removed with --dry_run.
+func storeGC(ctx context.Context, entryFile string, userCtx map[string]string, r store.Retention) error {
+	if !r.Enabled() {
+		return errors.New("--store_retention or --store_keep_last must be set")
+	}
+	if *readOnly && !*dryRun {
+		return fmt.Errorf("cannot prune rollout store: %w", isopod.ErrReadOnly)
+	}
+	return forEachStore(ctx, entryFile, userCtx, func(cluster string, st store.Store) error {
+		p, ok := st.(store.Pruner)
+		if !ok {
+			return errors.New("store does not support pruning")
+		}
+		ids, err := p.Prune(r, *dryRun)
+		for _, id := range ids {
+			if *dryRun {
+				fmt.Printf("Would remove %s/%s\n", cluster, id)
+			} else {
+				fmt.Printf("Removed %s/%s\n", cluster, id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pruned %d rollouts on cluster `%s'.\n", len(ids), cluster)
+		return nil
+	})
+}
+
+// writeDiffReport writes diffs collected by c to HTML file at path.
+func writeDiffReport(path string, c *report.Collector, title string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := c.WriteHTML(f, title); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkEntryFiles prints problems of entry files mainFiles found by
+// runtime.Check and returns their number.
+func checkEntryFiles(ctx context.Context, mainFiles []string, ctxParams map[string]string) (int, error) {
+	opts := append([]runtime.Option{
+		runtime.WithPredeclared("notify", notify.New(mainFiles[0], "").Builtin()),
+	}, pluginOptions()...)
+	problems, err := runtime.Check(ctx, &runtime.Config{
+		EntryFile:      mainFiles[0],
+		UserAgent:      "Isopod/" + version,
+		Version:        version,
+		KubeConfigPath: *kubeconfig,
+	}, ctxParams, entryFilesOpts(mainFiles, opts)...)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	return len(problems), nil
+}
+
+// entryFilesOpts returns opts with the extra entry files of files (the
+// first one is the entry file of runtime.Config).
+func entryFilesOpts(files []string, opts []runtime.Option) []runtime.Option {
+	if len(files) < 2 {
+		return opts
+	}
+	return append(append([]runtime.Option{}, opts...), runtime.WithExtraEntryFiles(files[1:]...))
+}
+
+// runController runs in-cluster reconciler driven by the ConfigMap named
+// configMap in --namespace.
+func runController(ctx context.Context, configMap string) error {
+	kubeC, err := controllerKubeConfig()
+	if err != nil {
+		return err
+	}
+	cs, err := kubernetes.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+	}
+
+	ns := *namespace
+	if ns == "" && *kubeconfig == "" {
+		ns = incluster.Namespace()
+	} else if ns == "" {
+		ns = incluster.DefaultNamespace
+	}
+	c := controller.New(cs, ns, configMap, *reconcileInterval, func(ctx context.Context, spec *controller.Spec) error {
+		return runClusters(ctx, runtime.InstallCommand, []string{spec.EntryFile}, spec.Context, nil, nil)
+	})
+	return c.Run(ctx)
+}
+
+// runServer serves the remote rollout API as HTTP/JSON on addr and as gRPC
+// on --serve_grpc_addr (if set). Both are served with TLS unless the address
+// is a loopback one.
+func runServer(ctx context.Context, addr string) error {
+	if *serveToken == "" {
+		return errors.New("--serve_token or $ISOPOD_SERVE_TOKEN must be set")
+	}
+	if (*serveTLSCert == "") != (*serveTLSKey == "") {
+		return errors.New("--serve_tls_cert and --serve_tls_key must be set together")
+	}
+	useTLS := *serveTLSCert != ""
+	for _, a := range []string{addr, *serveGRPCAddr} {
+		if a != "" && !useTLS && !server.IsLoopback(a) {
+			return fmt.Errorf("refusing to serve without TLS on non-loopback address `%s' (set --serve_tls_cert and --serve_tls_key)", a)
+		}
+	}
+
+	run := func(ctx context.Context, req *server.RunRequest, h runtime.EventHandler) error {
+		return runClusters(ctx, req.Command, []string{req.EntryFile}, req.Context, nil, nil, runtime.WithEventHandler(h))
+	}
+	s, err := server.New(*serveToken, *serveRoot, run, forEachStore)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	if *serveGRPCAddr != "" {
+		var opts []grpc.ServerOption
+		if useTLS {
+			creds, err := credentials.NewServerTLSFromFile(*serveTLSCert, *serveTLSKey)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate: %v", err)
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+		l, err := net.Listen("tcp", *serveGRPCAddr)
+		if err != nil {
+			return err
+		}
+		gs := server.NewGRPCServer(s, opts...)
+		defer gs.Stop()
+		log.Infof("Serving gRPC on %s", *serveGRPCAddr)
+		go func() { errCh <- gs.Serve(l) }()
+	}
+
+	srv := &http.Server{Addr: addr, Handler: s}
+	log.Infof("Serving on %s", addr)
+	go func() {
+		if useTLS {
+			errCh <- srv.ListenAndServeTLS(*serveTLSCert, *serveTLSKey)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+	return <-errCh
+}
+
+// forEachStore calls fn with rollout store in --namespace of each cluster
+// returned by the clusters Starlark function of entryFile called with userCtx.
+// Errors of all clusters are returned as runtime.ClusterErrors.
+func forEachStore(ctx context.Context, entryFile string, userCtx map[string]string, fn func(string, store.Store) error) error {
+	return forEachKubeConfig(ctx, entryFile, userCtx, func(cluster, ns string, kubeC *rest.Config) error {
+		cs, err := kubernetes.NewForConfig(kubeC)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+		}
+		st, err := newKubeStore(cs, ns)
+		if err != nil {
+			return err
+		}
+		return fn(cluster, st)
+	})
+}
+
+// forEachKubeConfig calls fn with name, metadata namespace (see
+// metadataNamespace) and rest config of each cluster returned by the clusters
+// Starlark function of entryFile. Errors of all
+// clusters are returned as runtime.ClusterErrors.
+func forEachKubeConfig(ctx context.Context, entryFile string, userCtx map[string]string, fn func(string, string, *rest.Config) error) error {
+	clusters, err := buildClustersRuntime(entryFile)
+	if err != nil {
+		return err
+	}
+	if err := clusters.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load clusters runtime: %v", err)
+	}
+
+	return clusters.ForEachCluster(ctx, userCtx, func(k8sVendor cloud.KubernetesVendor) error {
+		kubeC, err := kubeConfigFor(ctx, k8sVendor)
+		if err != nil {
+			return fmt.Errorf("failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+		}
+		ns, err := metadataNamespace(k8sVendor)
+		if err != nil {
+			return err
+		}
+		return fn(clusterName(k8sVendor, userCtx), ns, kubeC)
+	})
+}
+
+// explainObject prints which addon and rollout manage object referenced by
+// objArg (see runtime.ParseObjectArg) on each cluster returned by the clusters
+// Starlark function of entryFile.
+func explainObject(ctx context.Context, entryFile, objArg string, userCtx map[string]string) error {
+	if _, _, _, err := runtime.ParseObjectArg(objArg); err != nil {
+		return err
+	}
+	return forEachKubeConfig(ctx, entryFile, userCtx, func(cluster, ns string, kubeC *rest.Config) error {
+		cs, err := kubernetes.NewForConfig(kubeC)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+		}
+		dyn, err := dynamic.NewForConfig(kubeC)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes dynamic client: %v", err)
+		}
+		obj, err := runtime.GetObject(ctx, cs.Discovery(), dyn, objArg)
+		if err != nil {
+			return fmt.Errorf("failed to get `%s': %v", objArg, err)
+		}
+		st, err := newKubeStore(cs, ns)
+		if err != nil {
+			return err
+		}
+		e, err := runtime.Explain(obj, st)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Cluster: %s\n", cluster)
+		return e.Print(os.Stdout)
+	})
+}
+
+// printVersions prints version of each addon in the live rollout of each
+// cluster returned by the clusters Starlark function of entryFile.
+func printVersions(ctx context.Context, entryFile string, userCtx map[string]string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tADDON\tVERSION\tROLLOUT")
+	if err := forEachStore(ctx, entryFile, userCtx, func(cluster string, st store.Store) error {
+		ro, found, err := st.GetLive()
+		if err != nil {
+			return err
+		}
+		if !found {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\n", cluster)
+			return nil
+		}
+		for _, a := range ro.Addons {
+			version := a.Version
+			if version == "" {
+				version = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cluster, a.Name, version, ro.ID)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// writeAnnotations reports failures of res as CI annotations in format f.
+func writeAnnotations(ctx context.Context, f annotate.Format, res *result.Result) {
+	as := annotate.FromResult(res)
+	if len(as) == 0 {
+		return
+	}
+	if err := annotate.Write(os.Stdout, f, as); err != nil {
+		log.Errorf("Failed to write annotations: %v", err)
+	}
+	if f == annotate.Buildkite {
+		if err := annotate.AnnotateBuildkite(ctx, as); err != nil {
+			log.Errorf("Failed to create Buildkite annotations: %v", err)
+		}
+	}
+}
+
+// notifyHandler returns runtime.EventHandler forwarding rollout events to n.
+func notifyHandler(ctx context.Context, n *notify.Notifier) runtime.EventHandler {
+	return func(e *runtime.Event) {
+		m := &notify.Message{Cluster: e.Cluster, RolloutID: e.RolloutID, Addons: e.Addons}
+		switch e.Type {
+		case runtime.RolloutStarted:
+			m.Trigger = notify.Start
+		case runtime.RolloutSucceeded:
+			m.Trigger = notify.Success
+		case runtime.RolloutFailed:
+			m.Trigger = notify.Failure
+			m.Error = e.Err.Error()
+		default:
+			return
+		}
+		n.Notify(ctx, m)
+	}
+}
+
+// newPRPoster returns report.Poster configured by --pr_* flags.
+func newPRPoster() (report.Poster, error) {
+	if *prRepo == "" || *prNumber == 0 || *prToken == "" {
+		return nil, errors.New("--pr_repo, --pr_number and --pr_token must be set")
+	}
+	switch *prReporter {
+	case "github":
+		return &report.GitHub{BaseURL: *prAPIURL, Repo: *prRepo, PR: *prNumber, Token: *prToken}, nil
+	case "gitlab":
+		return &report.GitLab{BaseURL: *prAPIURL, Project: *prRepo, MR: *prNumber, Token: *prToken}, nil
+	}
+	return nil, fmt.Errorf("unknown --pr_reporter `%s'", *prReporter)
+}
+
+// clientOptions returns options applied to rest config of each cluster set by
+// --as, --as_group, --client_cert, --client_key, --proxy_url, --exec_command,
+// --exec_arg and --user_agent.
+func clientOptions() *cloud.ClientOptions {
+	return &cloud.ClientOptions{
+		UserAgent:         *userAgent,
+		ImpersonateUser:   *impersonateUser,
+		ImpersonateGroups: *impersonateGroups,
+		CertFile:          *clientCert,
+		KeyFile:           *clientKey,
+		ProxyURL:          *proxyURL,
+		ExecCommand:       *execCommand,
+		ExecArgs:          *execArgs,
+	}
+}
+
+// kubePolicy returns policy restricting mutated objects set by
+// --allow_namespaces, --deny_namespaces, --allow_kinds and --deny_kinds.
+func kubePolicy() *kube.Policy {
+	return &kube.Policy{
+		AllowNamespaces: splitList(*allowNamespaces),
+		DenyNamespaces:  splitList(*denyNamespaces),
+		AllowKinds:      splitList(*allowKinds),
+		DenyKinds:       splitList(*denyKinds),
+	}
+}
+
+// splitList splits comma-separated list s skipping empty elements.
+func splitList(s string) []string {
+	var ret []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// kubeConfigFor returns rest config of k8sVendor cluster with clientOptions
+// applied.
+func kubeConfigFor(ctx context.Context, k8sVendor cloud.KubernetesVendor) (*rest.Config, error) {
+	c, err := k8sVendor.KubeConfig(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize addons runtime: %v", err)
+		return nil, err
+	}
+	if err := clientOptions().Apply(c); err != nil {
+		return nil, err
 	}
+	return c, nil
+}
 
-	return addons, nil
+// controllerKubeConfig returns config for the cluster controller runs in,
+// built from --kubeconfig if set.
+func controllerKubeConfig() (c *rest.Config, err error) {
+	if *kubeconfig != "" {
+		c, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		c, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := clientOptions().Apply(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// integrationTestOptions returns options of the test command running tests
+// against the API server of a kind cluster created with --kind (deleted by
+// cleanup) or of --kubeconfig if --integration is set.
+func integrationTestOptions(ctx context.Context) (opts []runtime.Option, cleanup func(), err error) {
+	cleanup = func() {}
+	if !*integration {
+		if *kindCluster {
+			return nil, nil, errors.New("--kind requires --integration")
+		}
+		return nil, cleanup, nil
+	}
+
+	var c *rest.Config
+	if *kindCluster {
+		k, err := runtime.NewKindCluster(ctx, fmt.Sprintf("isopod-test-%d", os.Getpid()), os.Stderr)
+		if k != nil {
+			cleanup = func() {
+				if err := k.Delete(context.Background()); err != nil {
+					log.Errorf("%v", err)
+				}
+			}
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if c, err = k.RESTConfig(); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	} else {
+		// Tests create and delete objects, so they never run against the
+		// current context of the default kubeconfig by accident.
+		if *kubeconfig == "" {
+			return nil, nil, errors.New("--integration requires --kind or --kubeconfig of a disposable cluster (e.g. an envtest API server)")
+		}
+		if c, err = clientcmd.BuildConfigFromFlags("", *kubeconfig); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := clientOptions().Apply(c); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return []runtime.Option{runtime.WithKube(c, false, nil)}, cleanup, nil
+}
+
+// newAddon scaffolds an addon as requested by args of "new" command:
+// addon <name> [--template=yaml|helm|operator] [--dir=<dir>].
+func newAddon(args []string) error {
+	fs := flag.NewFlagSet("new addon", flag.ExitOnError)
+	tmpl := fs.String("template", runtime.YAMLTemplate, "Addon template, one of `yaml', `helm' or `operator'.")
+	dir := fs.String("dir", ".", "Directory to create the addon directory in.")
+	if len(args) == 0 || args[0] != "addon" {
+		return fmt.Errorf("unknown kind `%s' (only `addon' is supported)", strings.Join(args, " "))
+	}
+
+	// Flags may follow the name.
+	var names []string
+	rest := args[1:]
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		names = append(names, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+	if len(names) != 1 {
+		return fmt.Errorf("expected exactly one addon name (got %d)", len(names))
+	}
+
+	paths, err := runtime.NewAddon(*dir, names[0], *tmpl)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fmt.Println("Created", p)
+	}
+	return nil
+}
+
+// selfUpdate replaces the running binary with the release requested by args
+// of "self-update" command: --version=<tag>.
+func selfUpdate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	v := fs.String("version", "", "Release tag to install, e.g. v0.9.3.")
+	skipVerify := fs.Bool("insecure_skip_verify", false, "Install releases without SHA256SUMS unverified instead of failing.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *v == "" || fs.NArg() > 0 {
+		return errors.New("expected --version=<release tag> and no arguments")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	u := &selfupdate.Updater{GOOS: goruntime.GOOS, GOARCH: goruntime.GOARCH, InsecureSkipVerify: *skipVerify}
+	if err := u.Update(ctx, *v, exe); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s from %s to %s\n", exe, version, *v)
+	return nil
 }
 
 type verboseGlogWriter struct{}
 
 func (w *verboseGlogWriter) Write(p []byte) (n int, err error) {
-	log.V(1).Info(string(p))
+	log.V(1).Info(redact.String(string(p)))
 	return len(p), nil
 }
 
@@ -195,6 +1214,20 @@ func main() {
 	flag.Parse()
 	ctx := context.Background()
 
+	helm.ChartCache = *helmChartCache
+	dep.Workspace = *workspaceDir
+	onprem.TokenCache = *tokenCache
+	vault.DefaultRetryPolicy = vault.RetryPolicy{
+		MaxRetries: *vaultMaxRetries,
+		MinWait:    *vaultRetryWait,
+		MaxWait:    *vaultMaxRetryWait,
+		Timeout:    *vaultTimeout,
+	}
+	vault.DefaultBreaker.Threshold, vault.DefaultBreaker.CoolDown = *vaultBreaker, *vaultCoolDown
+
+	// Credentials passed by flags must never show up in output.
+	redact.Add(*vaultToken, *serveToken, *prToken, *notifySlackWebhook)
+
 	// Redirects all output to standrad Go log to Google's log at verbose level 1.
 	stdlog.SetOutput(&verboseGlogWriter{})
 	defer log.Flush()
@@ -207,27 +1240,74 @@ func main() {
 
 	cmd, path := getCmdAndPath(flag.Args())
 
-	if *depsFile != "" {
-		log.Infof("Loading dependencies from `%s'", *depsFile)
-		if err := dep.Load(*depsFile); err != nil {
-			log.Exitf("Failed to load deps file `%s': %v", *depsFile, err)
+	if cmd == runtime.NewCommand {
+		if err := newAddon(flag.Args()[1:]); err != nil {
+			log.Exitf("Failed to create addon: %v", err)
 		}
-	} else {
-		// If depsFile unset, and if $(pwd)/isopod.deps exists, update depsFile.
-		workingDir, err := os.Getwd()
-		if err != nil {
-			log.Fatalf("Failed to get working dir: %v", err)
+		return
+	}
+
+	if cmd == runtime.SelfUpdateCommand {
+		if err := selfUpdate(ctx, flag.Args()[1:]); err != nil {
+			log.Exitf("Failed to update Isopod: %v", err)
 		}
-		defaultDepsFilePath := filepath.Join(workingDir, dep.DepsFile)
+		return
+	}
 
-		if _, err = os.Stat(defaultDepsFilePath); os.IsNotExist(err) {
+	if err := clientOptions().Validate(); err != nil {
+		log.Exitf("Invalid Kubernetes client flags: %v", err)
+	}
+
+	if *debugHTTPDump != "" {
+		var err error
+		if httpDumper, err = httpdump.New(*debugHTTPDump); err != nil {
+			log.Exitf("Failed to initialize HTTP dump: %v", err)
+		}
+		log.Infof("Dumping HTTP requests to `%s'", *debugHTTPDump)
+	}
+
+	if *pluginDir != "" {
+		var err error
+		if pluginModules, err = plugins.Load(*pluginDir); err != nil {
+			log.Exitf("Failed to load plugins: %v", err)
+		}
+	}
+
+	root, err := workspaceRoot(cmd, path)
+	if err != nil {
+		log.Exitf("Failed to find workspace root: %v", err)
+	}
+	// Tests find the workspace of each test file unless set explicitly.
+	if cmd != runtime.TestCommand || *relativePath != "" {
+		loader.SetWorkspaceRoot(root)
+	}
+
+	if *depsFile == "" {
+		// If depsFile unset, and if isopod.deps exists in the workspace
+		// root, load it.
+		*depsFile = filepath.Join(root, dep.DepsFile)
+		if _, err = os.Stat(*depsFile); os.IsNotExist(err) {
 			log.Info("Using no remote modules")
+			*depsFile = ""
+		}
+	}
+	if *depsFile != "" {
+		log.Infof("Loading dependencies from `%s'", *depsFile)
+		if err := dep.Load(*depsFile); err != nil {
+			log.Errorf("Failed to load deps file `%s': %v", *depsFile, err)
+			log.Flush()
+			os.Exit(result.ExitLoadFailed)
 		}
-		*depsFile = defaultDepsFilePath
 	}
 
 	if cmd == runtime.TestCommand {
-		ok, err := runtime.RunUnitTests(ctx, path, os.Stdout, os.Stderr)
+		testOpts, cleanup, err := integrationTestOptions(ctx)
+		if err != nil {
+			log.Exitf("Failed to set up integration tests: %v", err)
+		}
+		testOpts = append(testOpts, pluginOptions()...)
+		ok, err := runtime.RunUnitTests(ctx, path, os.Stdout, os.Stderr, testOpts...)
+		cleanup()
 		if err != nil {
 			log.Exitf("Failed to run tests: %v", err)
 		} else if !ok {
@@ -237,53 +1317,300 @@ func main() {
 		return
 	}
 
+	if cmd == runtime.CleanCommand {
+		if err := clean(); err != nil {
+			log.Exitf("Failed to clean: %v", err)
+		}
+		return
+	}
+
 	if cmd == runtime.GenerateCommand {
-		if err := runtime.Generate(path); err != nil {
+		format := *outputFormat
+		if format == "" {
+			format = runtime.FormatPutYAML
+		}
+		if err := runtime.Generate(path, format); err != nil {
 			log.Exitf("Failed to generate Starlark code: %v", err)
 		}
 		return
 	}
 
+	if cmd == runtime.ApplyCommand {
+		if *readOnly {
+			log.Exitf("Cannot apply plan `%s' in read-only mode (--read_only)", path)
+		}
+		if err := applyPlan(ctx, path); errors.Is(err, lock.ErrHeld) {
+			log.Errorf("Failed to apply plan `%s': %v", path, err)
+			log.Flush()
+			os.Exit(result.ExitLocked)
+		} else if err != nil {
+			log.Exitf("Failed to apply plan `%s': %v", path, err)
+		}
+		return
+	}
+
+	if cmd == runtime.ServeCommand {
+		if err := runServer(ctx, path); err != nil {
+			log.Exitf("Server failed: %v", err)
+		}
+		return
+	}
+
+	if cmd == runtime.ControllerCommand {
+		if err := runController(ctx, path); err != nil {
+			log.Exitf("Controller failed: %v", err)
+		}
+		return
+	}
+
 	mainFile := path
 	if mainFile == "" {
 		log.Exitf("path to main Starlark entry file must be set")
 	}
+	// Entry files of these commands may be split in multiple files or
+	// matched by glob patterns.
+	mainFiles := []string{mainFile}
+	switch cmd {
+	case runtime.InstallCommand, runtime.RemoveCommand, runtime.ListCommand, runtime.GraphCommand, runtime.CheckCommand:
+		if mainFiles, err = runtime.ExpandEntryFiles(flag.Args()[1:]); err != nil {
+			log.Exitf("Invalid entry files: %v", err)
+		}
+	}
 
 	ctxParams, err := util.ParseCommaSeparatedParams(*isopodCtx)
 	if err != nil {
 		log.Exitf("Invalid value to --context: %v", err)
 	}
 
-	clusters := buildClustersRuntime(mainFile)
-	if err := clusters.Load(ctx); err != nil {
-		log.Exitf("Failed to load clusters runtime: %v", err)
+	if cmd == runtime.VersionsCommand {
+		if err := printVersions(ctx, mainFile, ctxParams); err != nil {
+			log.Exitf("Failed to get addon versions: %v", err)
+		}
+		return
+	}
+
+	retention, err := storeRetentionFlag()
+	if err != nil {
+		log.Exitf("%v", err)
 	}
 
-	errorReturned := false
+	if cmd == runtime.StoreCommand {
+		if err := storeGC(ctx, mainFile, ctxParams, retention); err != nil {
+			log.Exitf("Failed to prune rollout store: %v", err)
+		}
+		return
+	}
 
-	if err := clusters.ForEachCluster(ctx, ctxParams, func(k8sVendor cloud.KubernetesVendor) {
-		kubeConfig, err := k8sVendor.KubeConfig(ctx)
+	if cmd == runtime.ExplainCommand {
+		if len(flag.Args()) < 3 {
+			usageAndDie()
+		}
+		if err := explainObject(ctx, mainFile, flag.Args()[2], ctxParams); err != nil {
+			log.Exitf("Failed to explain object: %v", err)
+		}
+		return
+	}
+
+	if cmd == runtime.CheckCommand {
+		n, err := checkEntryFiles(ctx, mainFiles, ctxParams)
 		if err != nil {
-			log.Exitf("Failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+			log.Exitf("Failed to check entry files: %v", err)
+		}
+		if n > 0 {
+			fmt.Printf("%d problem(s) found.\n", n)
+			os.Exit(result.ExitLoadFailed)
 		}
-		addons, err := buildAddonsRuntime(kubeConfig, mainFile)
+		fmt.Println("No problems found.")
+		return
+	}
+
+	var recorder *plan.Recorder
+	if cmd == runtime.PlanCommand {
+		if *planOut == "" {
+			log.Exitf("--out must be set for `%s' command", cmd)
+		}
+		absMainFile, err := filepath.Abs(mainFile)
 		if err != nil {
-			log.Exitf("Failed to initialize runtime: %v", err)
+			log.Exitf("Failed to resolve entry file path: %v", err)
 		}
+		recorder = plan.NewRecorder(absMainFile, ctxParams)
+	}
 
-		if err := addons.Load(ctx); err != nil {
-			log.Exitf("Failed to load addons runtime: %v", err)
+	var annotations annotate.Format
+	if *ciOutput != "" {
+		if annotations, err = annotate.ParseFormat(*ciOutput); err != nil {
+			log.Exitf("Invalid value to --output: %v", err)
 		}
+	}
 
-		if err := addons.Run(ctx, cmd, k8sVendor.AddonSkyCtx(ctxParams)); err != nil {
-			errorReturned = true
-			log.Errorf("addons run failed: %v", err)
+	var opts []runtime.Option
+	var poster report.Poster
+	collector := &report.Collector{}
+	if *prReporter != "" {
+		if !*dryRun && !*kubeDiff {
+			log.Exitf("--pr_reporter requires --dry_run or --kube_diff")
 		}
-	}); err != nil {
-		log.Exitf("Failed to iterate through clusters: %v", err)
+		if poster, err = newPRPoster(); err != nil {
+			log.Exitf("Invalid PR reporter config: %v", err)
+		}
+	}
+	if *diffReport != "" && !*dryRun && !*kubeDiff {
+		log.Exitf("--diff_report requires --dry_run or --kube_diff")
+	}
+	if *prReporter != "" || *diffReport != "" {
+		opts = append(opts,
+			runtime.WithDiffWriter(io.MultiWriter(os.Stdout, collector)),
+			runtime.WithEventHandler(collector.HandleEvent),
+		)
+	}
+
+	var cache *kube.DiffCache
+	if *diffCache != "" && *dryRun {
+		if cache, err = kube.LoadDiffCache(*diffCache); err != nil {
+			log.Exitf("Failed to load diff cache: %v", err)
+		}
+		opts = append(opts, runtime.WithDiffCache(cache))
+	}
+
+	if (cmd == runtime.ListCommand || cmd == runtime.GraphCommand) && *liveStatus {
+		opts = append(opts, runtime.WithLiveStatus())
+	}
+	if cmd == runtime.GraphCommand && *outputFormat != "" {
+		opts = append(opts, runtime.WithGraphFormat(*outputFormat))
+	}
+	if cmd == runtime.InstallCommand && *prune {
+		opts = append(opts, runtime.WithPrune())
+	}
+	if cmd == runtime.InstallCommand && retention.Enabled() {
+		opts = append(opts, runtime.WithStoreRetention(retention))
+	}
+	if cmd == runtime.InstallCommand && *rollbackOnFailure {
+		opts = append(opts, runtime.WithRollbackOnFailure())
+	}
+	if cmd == runtime.RemoveCommand && *strictRemove {
+		opts = append(opts, runtime.WithStrictRemove())
+	}
+	if cmd == runtime.InstallCommand && *snapshotDir != "" {
+		opts = append(opts, runtime.WithSnapshotDir(*snapshotDir))
+	}
+	if *checkIdempotency {
+		if cmd != runtime.InstallCommand || !*dryRun {
+			log.Exitf("--check_idempotency requires the install command with --dry_run")
+		}
+		opts = append(opts, runtime.WithIdempotencyCheck())
+	}
+	if *autoMigrateAPIs {
+		opts = append(opts, runtime.WithAutoMigrateAPIs())
+	}
+	if *strictOwnership {
+		opts = append(opts, runtime.WithStrictOwnership())
+	}
+	if *readOnly {
+		opts = append(opts, runtime.WithReadOnly())
+	}
+	if *changedOnly {
+		opts = append(opts, runtime.WithChangedOnly(*gitBase))
+	}
+	if *profile != "" {
+		opts = append(opts, runtime.WithProfile(*profile))
+	}
+	if *preload {
+		opts = append(opts, runtime.WithPreload())
+	}
+	if *timings {
+		opts = append(opts, runtime.WithTimings())
+	}
+	if *showCtx {
+		opts = append(opts, runtime.WithShowCtx())
+	}
+	if !*manageMetadata {
+		opts = append(opts, runtime.WithoutManagedMetadata())
+	}
+	ctxMode, err := kube.ParseContextMode(*ctxAnnotation)
+	if err != nil {
+		log.Exitf("Invalid value to --context_annotation: %v", err)
 	}
+	opts = append(opts, runtime.WithContextMode(ctxMode))
 
-	if errorReturned {
-		os.Exit(2)
+	var notifier *notify.Notifier
+	if cmd == runtime.InstallCommand || cmd == runtime.RemoveCommand {
+		notifier = notify.New(strings.Join(mainFiles, ", "), string(cmd))
+		triggers, err := notify.ParseTriggers(strings.Split(*notifyOn, ","))
+		if err != nil {
+			log.Exitf("Invalid value to --notify_on: %v", err)
+		}
+		if *notifySlackWebhook != "" {
+			notifier.AddTarget(&notify.Target{SlackWebhook: *notifySlackWebhook, On: triggers})
+		}
+		if *notifyWebhook != "" {
+			notifier.AddTarget(&notify.Target{Webhook: *notifyWebhook, On: triggers})
+		}
+		opts = append(opts,
+			runtime.WithPredeclared("notify", notifier.Builtin()),
+			runtime.WithEventHandler(notifyHandler(ctx, notifier)),
+		)
+	}
+
+	results := result.NewRecorder(string(cmd), *dryRun)
+	opts = append(opts, runtime.WithEventHandler(results.HandleEvent))
+
+	// Values cached by addons are shared across clusters of the run.
+	runCache := modules.NewCache()
+	opts = append(opts, runtime.WithCache(runCache))
+
+	stopProfile, err := startStarlarkProfile(*starlarkProfile)
+	if err != nil {
+		log.Exitf("Failed to start Starlark profile: %v", err)
+	}
+	err = runClusters(ctx, cmd, mainFiles, ctxParams, recorder, results, opts...)
+	stopProfile()
+	if vErr := vault.DefaultBreaker.Err(); vErr != nil {
+		log.Errorf("%v", vErr)
+	}
+	if s := runCache.Stats(); s.Hits+s.Misses > 0 {
+		log.Infof("Cache: %d hits, %d misses", s.Hits, s.Misses)
+	}
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			log.Errorf("Failed to save diff cache: %v", err)
+		}
+	}
+	if notifier != nil {
+		notifier.Complete(ctx, err)
+	}
+	if poster != nil {
+		if err := poster.Post(ctx, collector.Markdown(fmt.Sprintf("Isopod diff for `%s`", strings.Join(mainFiles, "`, `")))); err != nil {
+			log.Errorf("Failed to post PR comment: %v", err)
+		}
+	}
+	if *diffReport != "" {
+		if err := writeDiffReport(*diffReport, collector, fmt.Sprintf("Isopod diff for %s", strings.Join(mainFiles, ", "))); err != nil {
+			log.Errorf("Failed to write diff report: %v", err)
+		}
+	}
+	res := results.Result(err, *detailedExitCode)
+	if *resultJSON != "" {
+		if err := res.WriteFile(*resultJSON); err != nil {
+			log.Errorf("Failed to write result: %v", err)
+		}
+	}
+	if annotations != "" {
+		writeAnnotations(ctx, annotations, res)
+	}
+	if err != nil {
+		log.Errorf("%v", err)
+		log.Flush()
+		os.Exit(res.ExitCode)
+	}
+
+	if recorder != nil {
+		if err := recorder.Plan().WriteFile(*planOut); err != nil {
+			log.Exitf("Failed to write plan: %v", err)
+		}
+		fmt.Printf("Plan written to %s\n", *planOut)
+	}
+	if res.ExitCode != result.ExitOK {
+		log.Flush()
+		os.Exit(res.ExitCode)
 	}
 }
@@ -25,11 +25,20 @@ import (
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 
+	"github.com/cruise-automation/isopod/pkg/kpath"
 	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/redact"
 	"github.com/cruise-automation/isopod/pkg/util"
 )
 
+// Defaults of `verify_timeout' and `verify_interval' addon arguments.
+const (
+	defaultVerifyTimeout  = 5 * time.Minute
+	defaultVerifyInterval = 10 * time.Second
+)
+
 // Addon implements single addons lifecycle hooks.
 type Addon struct {
 	// TODO(dmitry.ilyevskiy): Place these inside subclassed context.
@@ -37,6 +46,16 @@ type Addon struct {
 	filepath string
 	baseDir  string
 	ctx      starlark.StringDict
+	// workspaceRoot is the root of the workspace of the runtime that
+	// declared the addon (the default workspace root if empty).
+	workspaceRoot string
+	// Overrides the global -force flag if set.
+	force *bool
+	// Diff filters (in kpath syntax) applied in addition to global ones.
+	diffFilters []string
+	// verify(ctx) is retried every verifyInterval until it succeeds or
+	// verifyTimeout expires.
+	verifyTimeout, verifyInterval time.Duration
 
 	// List of globally scopped symbols from main addon file exeution.
 	globals starlark.StringDict
@@ -47,20 +66,58 @@ type Addon struct {
 
 	// Defines "print" built-in function.
 	printFn func(t *starlark.Thread, s string)
+
+	// pos is the position of the addon() call that declared the addon.
+	pos syntax.Position
 }
 
 // NewAddonBuiltin returns new *starlark.Builtin for Addon with pre-declared
-// pkgs.
+// pkgs. Addons it returns share modules they load.
 func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict) *starlark.Builtin {
+	cache := loader.NewCache()
 	return starlark.NewBuiltin(
 		"addon",
 		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var name, path string
 			var ctxVal starlark.Value
-			if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 2, &name, &path, &ctxVal); err != nil {
+			var forceVal starlark.Value = starlark.None
+			filtersVal := &starlark.List{}
+			verifyTimeout, verifyInterval := defaultVerifyTimeout.String(), defaultVerifyInterval.String()
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "path", &path, "ctx?", &ctxVal, "force?", &forceVal, "diff_filters?", &filtersVal, "verify_timeout?", &verifyTimeout, "verify_interval?", &verifyInterval); err != nil {
 				return nil, err
 			}
 
+			vTimeout, err := time.ParseDuration(verifyTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid `verify_timeout': %v", b.Name(), err)
+			}
+			vInterval, err := time.ParseDuration(verifyInterval)
+			if err != nil || vInterval <= 0 {
+				return nil, fmt.Errorf("%s: `verify_interval' must be a positive duration (got `%s')", b.Name(), verifyInterval)
+			}
+
+			var force *bool
+			switch f := forceVal.(type) {
+			case starlark.NoneType:
+			case starlark.Bool:
+				force = new(bool)
+				*force = bool(f)
+			default:
+				return nil, fmt.Errorf("%s: `force' must be a bool (got a %s)", b.Name(), forceVal.Type())
+			}
+
+			var diffFilters []string
+			for i := 0; i < filtersVal.Len(); i++ {
+				f, ok := filtersVal.Index(i).(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `diff_filters' must be a list of strings (got a %s)", b.Name(), filtersVal.Index(i).Type())
+				}
+				if _, err := kpath.Parse(string(f)); err != nil {
+					return nil, fmt.Errorf("%s: failed to parse diff filter `%s': %v", b.Name(), f, err)
+				}
+				diffFilters = append(diffFilters, string(f))
+			}
+
 			ctx := starlark.StringDict{}
 			if ctxVal != nil {
 				switch aCtx := ctxVal.(type) {
@@ -80,16 +137,27 @@ func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict) *starlark.Builtin
 				}
 			}
 
+			var pos syntax.Position
+			if t.CallStackDepth() > 1 {
+				pos = t.CallFrame(1).Pos
+			}
+			root, _ := t.Local(WorkspaceRootKey).(string)
 			return &Addon{
-				Name:     name,
-				filepath: path,
-				baseDir:  baseDir,
-				loader:   loader.NewModulesLoaderWithPredeclaredPkgs(baseDir, pkgs),
-				ctx:      ctx,
-				pkgs:     pkgs,
-				globals:  starlark.StringDict{},
+				pos:            pos,
+				Name:           name,
+				filepath:       path,
+				baseDir:        baseDir,
+				workspaceRoot:  root,
+				loader:         loader.NewWorkspaceModulesLoader(baseDir, root, pkgs, cache),
+				ctx:            ctx,
+				force:          force,
+				diffFilters:    diffFilters,
+				verifyTimeout:  vTimeout,
+				verifyInterval: vInterval,
+				pkgs:           pkgs,
+				globals:        starlark.StringDict{},
 				printFn: func(t *starlark.Thread, msg string) {
-					fmt.Fprintf(os.Stderr, "%s: %s\n", t.CallStack().At(0).Pos, msg)
+					fmt.Fprintf(os.Stderr, "%s: %s\n", t.CallStack().At(0).Pos, redact.String(msg))
 				},
 			}, nil
 		})
@@ -98,11 +166,13 @@ func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict) *starlark.Builtin
 // NewAddonForTest returns an *Addon for testing.
 func NewAddonForTest(name, filepath string, ctx, pkgs starlark.StringDict, f loader.ModuleReaderFactory, printW io.Writer) *Addon {
 	return &Addon{
-		Name:     name,
-		filepath: filepath,
-		ctx:      ctx,
-		pkgs:     pkgs,
-		globals:  starlark.StringDict{},
+		Name:           name,
+		filepath:       filepath,
+		ctx:            ctx,
+		pkgs:           pkgs,
+		globals:        starlark.StringDict{},
+		verifyTimeout:  defaultVerifyTimeout,
+		verifyInterval: defaultVerifyInterval,
 		printFn: func(_ *starlark.Thread, msg string) {
 			if _, err := printW.Write([]byte(msg)); err != nil {
 				log.Errorf("failed to write `%s' to printFn writer: %v", msg, err)
@@ -145,6 +215,22 @@ func (a *Addon) GetModule() *loader.Module {
 	return a.loader.GetLoadedModule(a.filepath)
 }
 
+// Pos returns the position of the addon() call that declared the addon.
+func (a *Addon) Pos() syntax.Position {
+	return a.pos
+}
+
+// Ctx returns the context the addon was declared with.
+func (a *Addon) Ctx() starlark.StringDict {
+	return a.ctx
+}
+
+// Global returns global name of the addon module. Must be called after Load.
+func (a *Addon) Global(name string) (starlark.Value, bool) {
+	v, ok := a.globals[name]
+	return v, ok
+}
+
 // Match is an optional matching hook. Returns true if addon matched the
 // context and wishes to be installed.
 func (a *Addon) Match(ctx context.Context) (bool, error) {
@@ -164,8 +250,40 @@ const (
 	// GoCtxKey is same as SkyCtxKey but for context.Context passed from
 	// main runtime.
 	GoCtxKey = "go_context"
+	// BaseDirKey is a key of a thread-local value for the base directory of
+	// the addon (used by built-ins to resolve relative paths).
+	BaseDirKey = "base_dir"
+	// WorkspaceRootKey is a key of a thread-local value for the root of the
+	// workspace `//'-prefixed paths are relative to. Built-ins use the
+	// default workspace root if not set (see loader.WorkspaceRootOr).
+	WorkspaceRootKey = "workspace_root"
+	// ForceKey is a key of a thread-local bool value that is only set if the
+	// addon was declared with `force' and overrides the global -force flag.
+	ForceKey = "force"
+	// DiffFiltersKey is a key of a thread-local []string value of diff
+	// filters declared by the addon with `diff_filters'.
+	DiffFiltersKey = "diff_filters"
+	// IgnoreNotFoundKey is a key of a thread-local bool value that is only
+	// set during `remove' and makes deletes of objects that don't exist
+	// succeed (unless overridden per call).
+	IgnoreNotFoundKey = "ignore_not_found"
 )
 
+type nameCtxKey struct{}
+
+// ContextWithName returns ctx annotated with name of the addon it's passed to
+// so that it can be retrieved (e.g by HTTP transports) with NameFromContext.
+func ContextWithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameCtxKey{}, name)
+}
+
+// NameFromContext returns name of the addon ctx was passed to or empty string
+// if ctx doesn't belong to an addon.
+func NameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(nameCtxKey{}).(string)
+	return name
+}
+
 // Install is called to install an addon.
 // Callback defined by the plugin must perform all necessary work to install
 // the plugin.
@@ -176,6 +294,26 @@ const (
 //  * TODO(dmitry.ilyevskiy): `vault' - access to Vault.
 //  * TODO(dmitry.ilyevskiy): `url' - Generic HTTP client.
 func (a *Addon) Install(ctx context.Context) error {
+	thread, sCtx := a.newThread(ctx)
+
+	fn, ok := a.globals["install"]
+	if !ok {
+		return fmt.Errorf("no `install' function found in %q", a.filepath)
+	}
+	if _, ok = fn.(starlark.Callable); !ok {
+		return fmt.Errorf("%s must be a function (got a %s)", fn, fn.Type())
+	}
+
+	log.Infof("Running `install' for [%s] with context: %v", a.Name, a.ctx)
+
+	args := starlark.Tuple([]starlark.Value{sCtx})
+	_, err := starlark.Call(thread, fn, args, nil)
+	return util.HumanReadableEvalError(err)
+}
+
+// newThread returns thread for running install-like hooks of the addon and
+// ctx passed to them.
+func (a *Addon) newThread(ctx context.Context) (*starlark.Thread, *SkyCtx) {
 	sCtx := &SkyCtx{Attrs: a.ctx}
 	thread := &starlark.Thread{
 		Print: a.printFn,
@@ -185,35 +323,83 @@ func (a *Addon) Install(ctx context.Context) error {
 		sCtx.Attrs["addon_version"] = starlark.String(a.GetModule().Version())
 	}
 
-	thread.SetLocal(GoCtxKey, ctx)
+	thread.SetLocal(GoCtxKey, ContextWithName(ctx, a.Name))
 	thread.SetLocal(SkyCtxKey, sCtx)
+	thread.SetLocal(BaseDirKey, a.baseDir)
+	thread.SetLocal(WorkspaceRootKey, a.workspaceRoot)
+	setRand(ctx, thread, a.Name)
+	if a.force != nil {
+		thread.SetLocal(ForceKey, *a.force)
+	}
+	if len(a.diffFilters) > 0 {
+		thread.SetLocal(DiffFiltersKey, a.diffFilters)
+	}
+	return thread, sCtx
+}
 
-	fn, ok := a.globals["install"]
+// Verify is called after successful Install to check that the addon works
+// (e.g its Deployments are available). Executes optional `verify' addon
+// callback until it neither fails nor returns False, retrying every
+// `verify_interval' until `verify_timeout' expires. Returns the last failure.
+func (a *Addon) Verify(ctx context.Context) error {
+	fn, ok := a.globals["verify"]
 	if !ok {
-		return fmt.Errorf("no `install' function found in %q", a.filepath)
+		return nil
 	}
 	if _, ok = fn.(starlark.Callable); !ok {
 		return fmt.Errorf("%s must be a function (got a %s)", fn, fn.Type())
 	}
 
-	log.Infof("Running `install' for [%s] with context: %v", a.Name, a.ctx)
-
-	args := starlark.Tuple([]starlark.Value{sCtx})
-	_, err := starlark.Call(thread, fn, args, nil)
-	return util.HumanReadableEvalError(err)
+	log.Infof("Running `verify' for [%s]", a.Name)
+
+	deadline := time.Now().Add(a.verifyTimeout)
+	for attempt := 1; ; attempt++ {
+		thread, sCtx := a.newThread(ctx)
+		v, err := starlark.Call(thread, fn, starlark.Tuple{sCtx}, nil)
+		if err == nil && v == starlark.False {
+			err = errors.New("`verify' returned False")
+		}
+		if err == nil {
+			return nil
+		}
+		err = util.HumanReadableEvalError(err)
+
+		if time.Now().Add(a.verifyInterval).After(deadline) {
+			return fmt.Errorf("verification failed after %d attempts: %v", attempt, err)
+		}
+		log.V(1).Infof("Verification of [%s] failed (attempt %d), retrying in %v: %v", a.Name, attempt, a.verifyInterval, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("verification interrupted: %v", err)
+		case <-time.After(a.verifyInterval):
+		}
+	}
 }
 
 // Remove is called to remove the addon.
 // Executes `remove' addon callback. Returns error if it doesn't exist (or
-// if the callback returns error).
+// if the callback returns error). If ignoreNotFound is set, deletes of objects
+// that are already gone succeed so that removal is idempotent.
 // TODO(dmitry.ilyevskiy): context must contain opaque info returned by install.
-func (a *Addon) Remove(ctx context.Context) error {
+func (a *Addon) Remove(ctx context.Context, ignoreNotFound bool) error {
 	sCtx := &SkyCtx{Attrs: a.ctx}
 	thread := &starlark.Thread{
 		Print: a.printFn,
 	}
-	thread.SetLocal(GoCtxKey, ctx)
+	thread.SetLocal(GoCtxKey, ContextWithName(ctx, a.Name))
 	thread.SetLocal(SkyCtxKey, sCtx)
+	thread.SetLocal(BaseDirKey, a.baseDir)
+	thread.SetLocal(WorkspaceRootKey, a.workspaceRoot)
+	setRand(ctx, thread, a.Name)
+	if a.force != nil {
+		thread.SetLocal(ForceKey, *a.force)
+	}
+	if len(a.diffFilters) > 0 {
+		thread.SetLocal(DiffFiltersKey, a.diffFilters)
+	}
+	if ignoreNotFound {
+		thread.SetLocal(IgnoreNotFoundKey, true)
+	}
 
 	fn, ok := a.globals["remove"]
 	if !ok {
@@ -108,3 +108,186 @@ func TestAddonInstall(t *testing.T) {
 		t.Fatalf("Unexpected msg. Want: %q, got: %q", wantMsg, sc.Text())
 	}
 }
+
+func TestAddonForce(t *testing.T) {
+	var got starlark.Value = starlark.None
+	pkgs := starlark.StringDict{
+		"check_force": starlark.NewBuiltin("check_force", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if f, ok := t.Local(ForceKey).(bool); ok {
+				got = starlark.Bool(f)
+			}
+			return starlark.None, nil
+		}),
+	}
+	f := func(module string) (io.Reader, func(), error) {
+		return strings.NewReader("def install(ctx):\n  check_force()\n"), func() {}, nil
+	}
+
+	for _, tc := range []struct {
+		name    string
+		kwargs  []starlark.Tuple
+		want    starlark.Value
+		wantErr string
+	}{
+		{
+			name: "Unset",
+			want: starlark.None,
+		},
+		{
+			name:   "Enabled",
+			kwargs: []starlark.Tuple{{starlark.String("force"), starlark.True}},
+			want:   starlark.True,
+		},
+		{
+			name:   "Disabled",
+			kwargs: []starlark.Tuple{{starlark.String("force"), starlark.False}},
+			want:   starlark.False,
+		},
+		{
+			name:    "Not a bool",
+			kwargs:  []starlark.Tuple{{starlark.String("force"), starlark.String("yes")}},
+			wantErr: "addon: `force' must be a bool (got a string)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = starlark.None
+			args := starlark.Tuple{starlark.String("test"), starlark.String("addon.ipd")}
+			v, err := starlark.Call(&starlark.Thread{}, NewAddonBuiltin("", pkgs), args, tc.kwargs)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+
+			a := v.(*Addon)
+			a.loader = loader.NewFakeModulesLoader(pkgs, f)
+			ctx := context.Background()
+			if err := a.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Install(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("Unexpected force.\nWant: %v\nGot: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAddonVerify(t *testing.T) {
+	attempts := 0
+	pkgs := starlark.StringDict{
+		"attempt": starlark.NewBuiltin("attempt", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			attempts++
+			return starlark.MakeInt(attempts), nil
+		}),
+		"error": starlark.NewBuiltin("error", ErrorFn),
+	}
+	fastRetry := []starlark.Tuple{
+		{starlark.String("verify_timeout"), starlark.String("50ms")},
+		{starlark.String("verify_interval"), starlark.String("1ms")},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		src          string
+		kwargs       []starlark.Tuple
+		wantAttempts int
+		wantErr      string
+	}{
+		{
+			name: "No verify",
+			src:  "def install(ctx):\n  pass\n",
+		},
+		{
+			name:         "Succeeds",
+			src:          "def install(ctx):\n  pass\ndef verify(ctx):\n  attempt()\n",
+			wantAttempts: 1,
+		},
+		{
+			name:         "Succeeds after retries",
+			src:          "def install(ctx):\n  pass\ndef verify(ctx):\n  return attempt() >= 3\n",
+			kwargs:       fastRetry,
+			wantAttempts: 3,
+		},
+		{
+			name:    "Returns False",
+			src:     "def install(ctx):\n  pass\ndef verify(ctx):\n  return False\n",
+			kwargs:  fastRetry,
+			wantErr: "verification failed after",
+		},
+		{
+			name:    "Fails",
+			src:     "def install(ctx):\n  pass\ndef verify(ctx):\n  error(\"not ready\")\n",
+			kwargs:  fastRetry,
+			wantErr: "<error>: not ready",
+		},
+		{
+			name:    "Not a function",
+			src:     "def install(ctx):\n  pass\nverify = 1\n",
+			wantErr: "1 must be a function (got a int)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts = 0
+			args := starlark.Tuple{starlark.String("test"), starlark.String("addon.ipd")}
+			v, err := starlark.Call(&starlark.Thread{}, NewAddonBuiltin("", pkgs), args, tc.kwargs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := v.(*Addon)
+			a.loader = loader.NewFakeModulesLoader(pkgs, func(module string) (io.Reader, func(), error) {
+				return strings.NewReader(tc.src), func() {}, nil
+			})
+			ctx := context.Background()
+			if err := a.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.Verify(ctx)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr == "" && err != nil || !strings.Contains(gotErr, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr == "" && attempts != tc.wantAttempts {
+				t.Errorf("Unexpected number of attempts.\nWant: %d\nGot: %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestAddonVerifyArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		kwargs  []starlark.Tuple
+		wantErr string
+	}{
+		{
+			name:    "Invalid timeout",
+			kwargs:  []starlark.Tuple{{starlark.String("verify_timeout"), starlark.String("soon")}},
+			wantErr: "addon: invalid `verify_timeout': time: invalid duration \"soon\"",
+		},
+		{
+			name:    "Zero interval",
+			kwargs:  []starlark.Tuple{{starlark.String("verify_interval"), starlark.String("0s")}},
+			wantErr: "addon: `verify_interval' must be a positive duration (got `0s')",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := starlark.Tuple{starlark.String("test"), starlark.String("addon.ipd")}
+			_, err := starlark.Call(&starlark.Thread{}, NewAddonBuiltin("", starlark.StringDict{}), args, tc.kwargs)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
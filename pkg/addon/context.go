@@ -17,6 +17,7 @@ package addon
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"go.starlark.net/starlark"
 )
@@ -53,13 +54,129 @@ func (c *SkyCtx) Truth() starlark.Bool { return len(c.Attrs) != 0 }
 func (c *SkyCtx) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
 
 // Attr implements starlark.HasAttrs.Attr.
+// The `get' method is available unless shadowed by a field of the same name.
 func (c *SkyCtx) Attr(name string) (starlark.Value, error) {
 	if val, ok := c.Attrs[name]; ok {
 		return val, nil
 	}
+	if name == "get" {
+		return starlark.NewBuiltin("ctx.get", c.getFn), nil
+	}
 	return starlark.None, nil
 }
 
+// getFn implements ctx.get(key, default=None) method. The key may be a dotted
+// path into nested dict values, e.g `ctx.get("labels.team", "infra")'.
+func (c *SkyCtx) getFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	var dflt starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "default?", &dflt); err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(key, ".")
+	v, ok := c.Attrs[parts[0]]
+	for _, p := range parts[1:] {
+		if !ok {
+			break
+		}
+		d, isDict := v.(*starlark.Dict)
+		if !isDict {
+			ok = false
+			break
+		}
+		var err error
+		v, ok, err = d.Get(starlark.String(p))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok || v == starlark.None {
+		return dflt, nil
+	}
+	return v, nil
+}
+
+// SetPath sets v at a dotted path, e.g `labels.team' sets the `team' key of
+// the `labels' dict field (created if not set).
+func (c *SkyCtx) SetPath(path string, v starlark.Value) error {
+	parts := strings.Split(path, ".")
+	if len(parts) == 1 {
+		return c.SetField(path, v)
+	}
+
+	cur, ok := c.Attrs[parts[0]].(*starlark.Dict)
+	if !ok {
+		if existing, set := c.Attrs[parts[0]]; set && existing != starlark.None {
+			return fmt.Errorf("cannot set `%s': `%s' is not a dict (got a `%s')", path, parts[0], existing.Type())
+		}
+		cur = starlark.NewDict(1)
+		c.Attrs[parts[0]] = cur
+	}
+	for i, p := range parts[1 : len(parts)-1] {
+		next, found, err := cur.Get(starlark.String(p))
+		if err != nil {
+			return err
+		}
+		d, ok := next.(*starlark.Dict)
+		if !ok {
+			if found {
+				return fmt.Errorf("cannot set `%s': `%s' is not a dict (got a `%s')", path, strings.Join(parts[:i+2], "."), next.Type())
+			}
+			d = starlark.NewDict(1)
+			if err := cur.SetKey(starlark.String(p), d); err != nil {
+				return err
+			}
+		}
+		cur = d
+	}
+	return cur.SetKey(starlark.String(parts[len(parts)-1]), v)
+}
+
+// CheckPaths returns an error if a dotted path of paths (e.g `labels.team')
+// is under another one (e.g `labels'), which would set both a value and its
+// nested field.
+func CheckPaths(paths map[string]string) error {
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts := strings.Split(k, ".")
+		for i := 1; i < len(parts); i++ {
+			if parent := strings.Join(parts[:i], "."); hasKey(paths, parent) {
+				return fmt.Errorf("conflicting ctx values `%s' and `%s': `%s' can't be set under a non-dict value", parent, k, k)
+			}
+		}
+	}
+	return nil
+}
+
+func hasKey(m map[string]string, k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// SetPaths sets values of paths (see SetPath) in sorted order after checking
+// they don't conflict (see CheckPaths).
+func (c *SkyCtx) SetPaths(paths map[string]string) error {
+	if err := CheckPaths(paths); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := c.SetPath(k, starlark.String(paths[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AttrNames implements starlark.HasAttrs.AttrNames.
 func (c *SkyCtx) AttrNames() []string {
 	var names []string
@@ -0,0 +1,115 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addon
+
+import (
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestCtxNestedValues(t *testing.T) {
+	c := NewCtx()
+	for k, v := range map[string]string{
+		"env":              "dev",
+		"labels.team":      "infra",
+		"labels.cost.unit": "42",
+	} {
+		if err := c.SetPath(k, starlark.String(v)); err != nil {
+			t.Fatalf("SetPath(%q) failed: %v", k, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, expr, want string
+	}{
+		{name: "flat", expr: `ctx.env`, want: `"dev"`},
+		{name: "nested attr", expr: `ctx.labels["team"]`, want: `"infra"`},
+		{name: "get", expr: `ctx.get("env")`, want: `"dev"`},
+		{name: "get nested", expr: `ctx.get("labels.cost.unit")`, want: `"42"`},
+		{name: "get missing", expr: `ctx.get("region")`, want: `None`},
+		{name: "get default", expr: `ctx.get("region", "us-west1")`, want: `"us-west1"`},
+		{name: "get nested default", expr: `ctx.get("labels.owner", "nobody")`, want: `"nobody"`},
+		{name: "get through non-dict", expr: `ctx.get("env.foo", 1)`, want: `1`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.expr, starlark.StringDict{"ctx": c})
+			if err != nil {
+				t.Fatalf("Eval failed: %v", err)
+			}
+			if got := v.String(); got != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	want := errors.New("cannot set `env.foo': `env' is not a dict (got a `string')")
+	if err := c.SetPath("env.foo", starlark.String("x")); err == nil || err.Error() != want.Error() {
+		t.Errorf("Unexpected error.\nWant: %v\nGot: %v", want, err)
+	}
+}
+
+func TestCtxSetPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		paths   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "nested",
+			paths: map[string]string{"env": "dev", "labels.team": "infra", "labels.cost.unit": "42"},
+			want:  `{"env": "dev", "labels": {"cost": {"unit": "42"}, "team": "infra"}}`,
+		},
+		{
+			name:    "flat and dotted",
+			paths:   map[string]string{"labels": "none", "labels.team": "infra"},
+			wantErr: "conflicting ctx values `labels' and `labels.team': `labels.team' can't be set under a non-dict value",
+		},
+		{
+			name:    "deeply dotted",
+			paths:   map[string]string{"labels.cost": "1", "labels.cost.unit": "42"},
+			wantErr: "conflicting ctx values `labels.cost' and `labels.cost.unit': `labels.cost.unit' can't be set under a non-dict value",
+		},
+		{
+			name:  "common prefix",
+			paths: map[string]string{"label": "a", "labels.team": "infra"},
+			want:  `{"label": "a", "labels": {"team": "infra"}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCtx()
+			err := c.SetPaths(tc.paths)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+			d := starlark.NewDict(len(c.Attrs))
+			for _, k := range c.AttrNames() {
+				d.SetKey(starlark.String(k), c.Attrs[k])
+			}
+			if got := d.String(); got != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
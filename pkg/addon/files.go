@@ -0,0 +1,161 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addon
+
+import (
+	"path/filepath"
+	"sort"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/syntax"
+
+	"github.com/cruise-automation/isopod/pkg/loader"
+)
+
+// ModuleDeps are files a module (or data file) depends on.
+type ModuleDeps struct {
+	// Loads are resolved paths of modules and data files loaded with `load'
+	// and `load_data'.
+	Loads []string
+	// Charts are resolved paths of Helm chart directories installed with
+	// `helm.apply'.
+	Charts []string
+}
+
+// Path returns the resolved path of the addon module.
+func (a *Addon) Path() string {
+	p, err := loader.ResolveWorkspacePath(a.workspaceRoot, a.baseDir, a.filepath)
+	if err != nil {
+		return a.filepath
+	}
+	return p
+}
+
+// ModuleGraph returns dependencies of all modules and data files the addon
+// (transitively) loaded by their resolved paths. Must be called after Load.
+//
+// Dependencies are found in module source, so only paths passed as string
+// literals are known, e.g
+//
+//	helm.apply(release_name="foo", chart="//charts/foo")
+func (a *Addon) ModuleGraph() map[string]*ModuleDeps {
+	graph := map[string]*ModuleDeps{}
+	for path, text := range a.loader.GetLoadedFiles() {
+		deps := &ModuleDeps{}
+		if ext := filepath.Ext(path); ext == ".ipd" || ext == ".star" {
+			deps = moduleDeps(a.workspaceRoot, path, text)
+		}
+		graph[path] = deps
+	}
+	return graph
+}
+
+// Files returns sorted paths of files the addon depends on: its module, all
+// modules and data files it (transitively) loaded and directories of Helm
+// charts its modules install (see ModuleGraph). Must be called after Load.
+func (a *Addon) Files() []string {
+	seen := map[string]bool{}
+	for path, deps := range a.ModuleGraph() {
+		seen[path] = true
+		for _, c := range deps.Charts {
+			seen[c] = true
+		}
+	}
+	files := make([]string, 0, len(seen))
+	for f := range seen {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// moduleDeps returns dependencies of module at path of the workspace rooted
+// at root.
+func moduleDeps(root, path, text string) *ModuleDeps {
+	deps := &ModuleDeps{}
+	f, err := syntax.Parse(path, text, 0)
+	if err != nil {
+		log.Warningf("Failed to parse `%s' for dependencies: %v", path, err)
+		return deps
+	}
+	resolve := func(p string) (string, bool) {
+		resolved, err := loader.ResolveWorkspacePath(root, filepath.Dir(path), p)
+		if err != nil {
+			log.Warningf("Failed to resolve `%s' referenced in `%s': %v", p, path, err)
+			return "", false
+		}
+		return resolved, true
+	}
+	for _, stmt := range f.Stmts {
+		if l, ok := stmt.(*syntax.LoadStmt); ok {
+			if p, ok := resolve(l.Module.Value.(string)); ok {
+				deps.Loads = append(deps.Loads, p)
+			}
+		}
+	}
+	syntax.Walk(f, func(n syntax.Node) bool {
+		call, ok := n.(*syntax.CallExpr)
+		if !ok {
+			return true
+		}
+		switch {
+		case isIdent(call.Fn, "load_data"):
+			if len(call.Args) > 0 {
+				if lit, ok := stringArg(call.Args[0], "path"); ok {
+					if p, ok := resolve(lit); ok {
+						deps.Loads = append(deps.Loads, p)
+					}
+				}
+			}
+		case isHelmApply(call.Fn):
+			for _, arg := range call.Args {
+				kw, ok := arg.(*syntax.BinaryExpr)
+				if !ok || kw.Op != syntax.EQ || !isIdent(kw.X, "chart") {
+					continue
+				}
+				if lit, ok := stringArg(kw.Y, ""); ok {
+					if p, ok := resolve(lit); ok {
+						deps.Charts = append(deps.Charts, p)
+					}
+				}
+			}
+		}
+		return true
+	})
+	return deps
+}
+
+// stringArg returns value of string literal argument e (passed either
+// positionally or as keyword kw).
+func stringArg(e syntax.Expr, kw string) (string, bool) {
+	if b, ok := e.(*syntax.BinaryExpr); ok && b.Op == syntax.EQ && kw != "" && isIdent(b.X, kw) {
+		e = b.Y
+	}
+	lit, ok := e.(*syntax.Literal)
+	if !ok || lit.Token != syntax.STRING {
+		return "", false
+	}
+	return lit.Value.(string), true
+}
+
+func isIdent(e syntax.Expr, name string) bool {
+	id, ok := e.(*syntax.Ident)
+	return ok && id.Name == name
+}
+
+func isHelmApply(fn syntax.Expr) bool {
+	dot, ok := fn.(*syntax.DotExpr)
+	return ok && dot.Name.Name == "apply" && isIdent(dot.X, "helm")
+}
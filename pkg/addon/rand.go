@@ -0,0 +1,60 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addon
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+
+	"go.starlark.net/starlark"
+)
+
+// RandKey is a key of a thread-local *rand.Rand value that is only set in
+// test and dry run modes. Built-ins generating random values (e.g uuid.v4)
+// must read from it if set so that rendered objects are the same on every
+// run and machine.
+const RandKey = "rand"
+
+type randSeedCtxKey struct{}
+
+// ContextWithRandSeed returns ctx making addons it's passed to seed their
+// RandKey source with seed and the addon name.
+func ContextWithRandSeed(ctx context.Context, seed string) context.Context {
+	return context.WithValue(ctx, randSeedCtxKey{}, seed)
+}
+
+// NewRand returns a deterministic source of random values seeded by seed.
+func NewRand(seed string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// RandFromThread returns the RandKey source of t or nil if random values
+// are not deterministic.
+func RandFromThread(t *starlark.Thread) *rand.Rand {
+	r, _ := t.Local(RandKey).(*rand.Rand)
+	return r
+}
+
+// setRand sets RandKey of thread running addon name if ctx has a seed. Each
+// thread starts from the same state so that every run of a hook draws the
+// same values.
+func setRand(ctx context.Context, thread *starlark.Thread, name string) {
+	if seed, ok := ctx.Value(randSeedCtxKey{}).(string); ok {
+		thread.SetLocal(RandKey, NewRand(seed+"/"+name))
+	}
+}
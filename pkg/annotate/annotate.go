@@ -0,0 +1,284 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package annotate reports failures of a run as annotations of CI systems
+// (GitHub Actions workflow commands and Buildkite annotations) so that they
+// are shown inline in pull request checks.
+package annotate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cruise-automation/isopod/pkg/result"
+)
+
+// Format is a CI annotation format.
+type Format string
+
+const (
+	// GitHub emits GitHub Actions `::error' and `::warning' workflow
+	// commands grouped per addon.
+	GitHub Format = "github"
+	// Buildkite emits a log section per addon and creates annotations
+	// with buildkite-agent.
+	Buildkite Format = "buildkite"
+)
+
+// ParseFormat returns Format named s.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case GitHub, Buildkite:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown output `%s' (want one of `github' or `buildkite')", s)
+}
+
+// Level is the severity of an annotation.
+type Level string
+
+const (
+	// Error annotates failures.
+	Error Level = "error"
+	// Warning annotates addons that didn't run.
+	Warning Level = "warning"
+)
+
+// Annotation is a single error or warning.
+type Annotation struct {
+	Level Level
+	// Addon and Cluster are empty for failures outside of addons.
+	Addon, Cluster string
+	// File, Line and Col are the innermost Starlark position in Message
+	// (if any).
+	File      string
+	Line, Col int
+	Message   string
+}
+
+// Title returns short summary of a.
+func (a *Annotation) Title() string {
+	t := "Isopod failed"
+	switch {
+	case a.Addon != "" && a.Level == Warning:
+		t = fmt.Sprintf("Addon %s skipped", a.Addon)
+	case a.Addon != "":
+		t = fmt.Sprintf("Addon %s failed", a.Addon)
+	}
+	if a.Cluster != "" {
+		t += fmt.Sprintf(" on %s", a.Cluster)
+	}
+	return t
+}
+
+// posRe matches Starlark positions (e.g `addons/foo.ipd:12:5: in install'
+// frames of backtraces and `foo.ipd:3:1: undefined: bar' errors, possibly
+// wrapped by other errors).
+var posRe = regexp.MustCompile(`(?m)(?:^\s*|: )([^\s<>:][^\s:]*):(\d+):(\d+): `)
+
+// position returns the last (innermost) Starlark position in msg. Absolute
+// paths are made relative to the working directory.
+func position(msg string) (file string, line, col int) {
+	ms := posRe.FindAllStringSubmatch(msg, -1)
+	if len(ms) == 0 {
+		return "", 0, 0
+	}
+	m := ms[len(ms)-1]
+	file = m[1]
+	if filepath.IsAbs(file) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+				file = rel
+			}
+		}
+	}
+	line, _ = strconv.Atoi(m[2])
+	col, _ = strconv.Atoi(m[3])
+	return file, line, col
+}
+
+func newAnnotation(level Level, addon, cluster, msg string) *Annotation {
+	a := &Annotation{Level: level, Addon: addon, Cluster: cluster, Message: msg}
+	a.File, a.Line, a.Col = position(msg)
+	return a
+}
+
+// FromResult returns annotations of res: an error for each failed addon,
+// a warning for each addon skipped after a failure and an error for each
+// cluster (or the whole run) that failed outside of addons.
+func FromResult(res *result.Result) []*Annotation {
+	var as []*Annotation
+	var clusterFailed bool
+	for _, c := range res.Clusters {
+		var addonFailed bool
+		for _, a := range c.Addons {
+			switch a.Status {
+			case result.Failed:
+				addonFailed = true
+				as = append(as, newAnnotation(Error, a.Name, c.Name, a.Error))
+			case result.Skipped:
+				if c.Status == result.Failed {
+					as = append(as, newAnnotation(Warning, a.Name, c.Name, fmt.Sprintf("Addon %s was not run because a previous addon failed.", a.Name)))
+				}
+			}
+		}
+		if c.Status == result.Failed {
+			clusterFailed = true
+			if !addonFailed {
+				as = append(as, newAnnotation(Error, "", c.Name, c.Error))
+			}
+		}
+	}
+	if res.Status == result.Failed && !clusterFailed {
+		as = append(as, newAnnotation(Error, "", "", res.Error))
+	}
+	return as
+}
+
+// groups returns as grouped by addon in order of first appearance.
+func groups(as []*Annotation) [][]*Annotation {
+	var gs [][]*Annotation
+	idx := map[string]int{}
+	for _, a := range as {
+		i, ok := idx[a.Addon]
+		if !ok {
+			i = len(gs)
+			idx[a.Addon] = i
+			gs = append(gs, nil)
+		}
+		gs[i] = append(gs[i], a)
+	}
+	return gs
+}
+
+// groupName returns the name of the group of annotations of addon.
+func groupName(addon string) string {
+	if addon == "" {
+		return "Isopod"
+	}
+	return "Addon " + addon
+}
+
+// Write writes as to w in format f.
+func Write(w io.Writer, f Format, as []*Annotation) error {
+	switch f {
+	case GitHub:
+		return writeGitHub(w, as)
+	case Buildkite:
+		return writeBuildkite(w, as)
+	}
+	return fmt.Errorf("unknown output `%s'", f)
+}
+
+var (
+	ghDataEscaper     = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	ghPropertyEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+// writeGitHub writes annotations as GitHub Actions workflow commands.
+func writeGitHub(w io.Writer, as []*Annotation) error {
+	buf := &bytes.Buffer{}
+	for _, g := range groups(as) {
+		fmt.Fprintf(buf, "::group::%s\n", ghDataEscaper.Replace(groupName(g[0].Addon)))
+		for _, a := range g {
+			props := []string{"title=" + ghPropertyEscaper.Replace(a.Title())}
+			if a.File != "" {
+				props = append(props,
+					"file="+ghPropertyEscaper.Replace(a.File),
+					fmt.Sprintf("line=%d", a.Line),
+					fmt.Sprintf("col=%d", a.Col),
+				)
+			}
+			fmt.Fprintf(buf, "::%s %s::%s\n", a.Level, strings.Join(props, ","), ghDataEscaper.Replace(a.Message))
+		}
+		buf.WriteString("::endgroup::\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeBuildkite writes annotations as Buildkite log sections. Sections with
+// errors are expanded.
+func writeBuildkite(w io.Writer, as []*Annotation) error {
+	buf := &bytes.Buffer{}
+	for _, g := range groups(as) {
+		header := "---"
+		for _, a := range g {
+			if a.Level == Error {
+				header = "+++"
+			}
+		}
+		fmt.Fprintf(buf, "%s %s\n", header, groupName(g[0].Addon))
+		for _, a := range g {
+			buf.WriteString(a.Title())
+			if a.File != "" {
+				fmt.Fprintf(buf, " (%s:%d:%d)", a.File, a.Line, a.Col)
+			}
+			fmt.Fprintf(buf, "\n%s\n", a.Message)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Markdown renders annotations of level in as a Buildkite annotation body
+// with a section per addon.
+func Markdown(as []*Annotation, level Level) string {
+	buf := &bytes.Buffer{}
+	for _, g := range groups(as) {
+		var section []*Annotation
+		for _, a := range g {
+			if a.Level == level {
+				section = append(section, a)
+			}
+		}
+		if len(section) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "#### %s\n\n", groupName(g[0].Addon))
+		for _, a := range section {
+			fmt.Fprintf(buf, "**%s**", a.Title())
+			if a.File != "" {
+				fmt.Fprintf(buf, " in `%s:%d`", a.File, a.Line)
+			}
+			fmt.Fprintf(buf, "\n\n```\n%s\n```\n\n", strings.TrimSpace(a.Message))
+		}
+	}
+	return buf.String()
+}
+
+// AnnotateBuildkite creates a Buildkite annotation of errors and one of
+// warnings in as (if any) with buildkite-agent.
+func AnnotateBuildkite(ctx context.Context, as []*Annotation) error {
+	for _, level := range []Level{Error, Warning} {
+		body := Markdown(as, level)
+		if body == "" {
+			continue
+		}
+		cmd := exec.CommandContext(ctx, "buildkite-agent", "annotate", "--style", string(level), "--context", "isopod-"+string(level))
+		cmd.Stdin = strings.NewReader(body)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("buildkite-agent annotate failed: %v: %s", err, out)
+		}
+	}
+	return nil
+}
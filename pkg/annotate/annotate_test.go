@@ -0,0 +1,134 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/result"
+)
+
+const testAddonErr = `<addon: ingress> install failed: Traceback (most recent call last):
+  addons/ingress.ipd:12:13: in install
+  lib/helpers.ipd:4:9: in put_all
+Error in put: <kube.put>: failed to put deployment: forbidden`
+
+func testResult() *result.Result {
+	return &result.Result{
+		Command: "install",
+		Status:  result.Failed,
+		Error:   "addons run failed on 2 clusters",
+		Clusters: []*result.Cluster{
+			{
+				Name:   "minikube",
+				Status: result.Failed,
+				Error:  "`install' execution failed: " + testAddonErr,
+				Addons: []*result.Addon{
+					{Name: "ingress", Status: result.Failed, Error: testAddonErr},
+					{Name: "logging", Status: result.Skipped},
+				},
+			},
+			{
+				Name:   "gke-prod",
+				Status: result.Failed,
+				Error:  "failed to load addons runtime: main.ipd:3:1: undefined: foo",
+			},
+			{
+				Name:   "gke-dev",
+				Status: result.Succeeded,
+				Addons: []*result.Addon{
+					{Name: "ingress", Status: result.Succeeded},
+					{Name: "logging", Status: result.Succeeded},
+				},
+			},
+		},
+	}
+}
+
+func TestFromResult(t *testing.T) {
+	want := []*Annotation{
+		{Level: Error, Addon: "ingress", Cluster: "minikube", File: "lib/helpers.ipd", Line: 4, Col: 9, Message: testAddonErr},
+		{Level: Warning, Addon: "logging", Cluster: "minikube", Message: "Addon logging was not run because a previous addon failed."},
+		{Level: Error, Cluster: "gke-prod", File: "main.ipd", Line: 3, Col: 1, Message: "failed to load addons runtime: main.ipd:3:1: undefined: foo"},
+	}
+	if d := cmp.Diff(want, FromResult(testResult())); d != "" {
+		t.Errorf("Unexpected annotations (-want +got):\n%s", d)
+	}
+
+	res := &result.Result{Status: result.Failed, Error: "failed to load clusters runtime: main.ipd:7:5: got int, want string"}
+	want = []*Annotation{
+		{Level: Error, File: "main.ipd", Line: 7, Col: 5, Message: res.Error},
+	}
+	if d := cmp.Diff(want, FromResult(res)); d != "" {
+		t.Errorf("Unexpected annotations of run failure (-want +got):\n%s", d)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	as := FromResult(testResult())
+	for _, tc := range []struct {
+		format Format
+		want   string
+	}{
+		{
+			format: GitHub,
+			want: `::group::Addon ingress
+::error title=Addon ingress failed on minikube,file=lib/helpers.ipd,line=4,col=9::<addon: ingress> install failed: Traceback (most recent call last):%0A  addons/ingress.ipd:12:13: in install%0A  lib/helpers.ipd:4:9: in put_all%0AError in put: <kube.put>: failed to put deployment: forbidden
+::endgroup::
+::group::Addon logging
+::warning title=Addon logging skipped on minikube::Addon logging was not run because a previous addon failed.
+::endgroup::
+::group::Isopod
+::error title=Isopod failed on gke-prod,file=main.ipd,line=3,col=1::failed to load addons runtime: main.ipd:3:1: undefined: foo
+::endgroup::
+`,
+		},
+		{
+			format: Buildkite,
+			want: `+++ Addon ingress
+Addon ingress failed on minikube (lib/helpers.ipd:4:9)
+` + testAddonErr + `
+--- Addon logging
+Addon logging skipped on minikube
+Addon logging was not run because a previous addon failed.
++++ Isopod
+Isopod failed on gke-prod (main.ipd:3:1)
+failed to load addons runtime: main.ipd:3:1: undefined: foo
+`,
+		},
+	} {
+		t.Run(string(tc.format), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := Write(buf, tc.format, as); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, buf.String()); d != "" {
+				t.Errorf("Unexpected output (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	as := FromResult(testResult())
+	want := "#### Addon logging\n\n" +
+		"**Addon logging skipped on minikube**\n\n```\nAddon logging was not run because a previous addon failed.\n```\n\n"
+	if got := Markdown(as, Warning); got != want {
+		t.Errorf("Unexpected markdown.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// execAPIVersion is the ExecCredential version requested from exec
+// credential plugins.
+const execAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// ClientOptions customize rest.Config built by a KubernetesVendor for all
+// clusters, e.g to run Isopod under an audited break-glass identity.
+type ClientOptions struct {
+	// UserAgent overrides the user agent set by the vendor (if not empty).
+	UserAgent string
+	// ImpersonateUser and ImpersonateGroups set impersonation headers
+	// (Impersonate-User and Impersonate-Group).
+	ImpersonateUser   string
+	ImpersonateGroups []string
+	// CertFile and KeyFile are paths to a client certificate and its key
+	// used for TLS client authentication.
+	CertFile, KeyFile string
+	// ProxyURL is a URL of the proxy all apiserver requests are sent
+	// through (if not empty).
+	ProxyURL string
+	// ExecCommand (and ExecArgs) is an exec credential plugin that replaces
+	// credentials provided by the vendor (if not empty).
+	ExecCommand string
+	ExecArgs    []string
+}
+
+// Validate returns an error if options are inconsistent.
+func (o *ClientOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("client certificate and key must be set together")
+	}
+	if len(o.ImpersonateGroups) > 0 && o.ImpersonateUser == "" {
+		return errors.New("impersonated groups require impersonated user")
+	}
+	if len(o.ExecArgs) > 0 && o.ExecCommand == "" {
+		return errors.New("exec plugin arguments require exec plugin command")
+	}
+	if o.ProxyURL != "" {
+		if _, err := url.Parse(o.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL `%s': %v", o.ProxyURL, err)
+		}
+	}
+	return nil
+}
+
+// Apply applies options to c.
+func (o *ClientOptions) Apply(c *rest.Config) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if o.UserAgent != "" {
+		c.UserAgent = o.UserAgent
+	}
+	if o.ImpersonateUser != "" {
+		c.Impersonate = rest.ImpersonationConfig{
+			UserName: o.ImpersonateUser,
+			Groups:   o.ImpersonateGroups,
+		}
+	}
+	if o.CertFile != "" {
+		c.TLSClientConfig.CertFile, c.TLSClientConfig.CertData = o.CertFile, nil
+		c.TLSClientConfig.KeyFile, c.TLSClientConfig.KeyData = o.KeyFile, nil
+	}
+	if o.ProxyURL != "" {
+		u, err := url.Parse(o.ProxyURL)
+		if err != nil {
+			return err
+		}
+		c.Proxy = http.ProxyURL(u)
+	}
+	if o.ExecCommand != "" {
+		// Vendor credentials would be sent along with (or conflict with)
+		// the ones returned by the plugin.
+		c.BearerToken, c.BearerTokenFile = "", ""
+		c.Username, c.Password = "", ""
+		c.AuthProvider = nil
+		c.WrapTransport = nil
+		c.ExecProvider = &clientcmdapi.ExecConfig{
+			Command:    o.ExecCommand,
+			Args:       o.ExecArgs,
+			APIVersion: execAPIVersion,
+			// client-go refuses to run plugins without a mode.
+			InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode,
+		}
+	}
+	return nil
+}
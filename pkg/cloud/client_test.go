@@ -0,0 +1,108 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestClientOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    ClientOptions
+		wantErr string
+		check   func(t *testing.T, c *rest.Config)
+	}{
+		{
+			name: "Impersonation",
+			opts: ClientOptions{
+				UserAgent:         "Isopod/test",
+				ImpersonateUser:   "breakglass@example.com",
+				ImpersonateGroups: []string{"system:masters"},
+			},
+			check: func(t *testing.T, c *rest.Config) {
+				want := rest.ImpersonationConfig{UserName: "breakglass@example.com", Groups: []string{"system:masters"}}
+				if d := cmp.Diff(want, c.Impersonate); d != "" {
+					t.Errorf("Unexpected impersonation config (-want +got):\n%s", d)
+				}
+				if c.UserAgent != "Isopod/test" {
+					t.Errorf("Unexpected user agent: %q", c.UserAgent)
+				}
+			},
+		},
+		{
+			name: "Exec plugin replaces vendor credentials",
+			opts: ClientOptions{ExecCommand: "get-token", ExecArgs: []string{"--cluster", "foo"}},
+			check: func(t *testing.T, c *rest.Config) {
+				if c.BearerToken != "" || c.WrapTransport != nil {
+					t.Errorf("Vendor credentials were not cleared: %+v", c)
+				}
+				want := &clientcmdapi.ExecConfig{Command: "get-token", Args: []string{"--cluster", "foo"}, APIVersion: execAPIVersion, InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode}
+				if d := cmp.Diff(want, c.ExecProvider); d != "" {
+					t.Errorf("Unexpected exec config (-want +got):\n%s", d)
+				}
+			},
+		},
+		{
+			name: "Client certificate and proxy",
+			opts: ClientOptions{CertFile: "/tls.crt", KeyFile: "/tls.key", ProxyURL: "http://proxy:3128"},
+			check: func(t *testing.T, c *rest.Config) {
+				if c.CertFile != "/tls.crt" || c.KeyFile != "/tls.key" || c.CertData != nil {
+					t.Errorf("Unexpected TLS config: %+v", c.TLSClientConfig)
+				}
+				req, _ := http.NewRequest(http.MethodGet, "https://apiserver", nil)
+				if u, err := c.Proxy(req); err != nil || u.String() != "http://proxy:3128" {
+					t.Errorf("Unexpected proxy: %v (err: %v)", u, err)
+				}
+			},
+		},
+		{
+			name:    "Certificate without key",
+			opts:    ClientOptions{CertFile: "/tls.crt"},
+			wantErr: "client certificate and key must be set together",
+		},
+		{
+			name:    "Groups without user",
+			opts:    ClientOptions{ImpersonateGroups: []string{"system:masters"}},
+			wantErr: "impersonated groups require impersonated user",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &rest.Config{
+				BearerToken:   "vendor-token",
+				WrapTransport: func(rt http.RoundTripper) http.RoundTripper { return rt },
+				TLSClientConfig: rest.TLSClientConfig{
+					CertData: []byte("vendor-cert"),
+				},
+			}
+			err := tc.opts.Apply(c)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Expected error %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, c)
+		})
+	}
+}
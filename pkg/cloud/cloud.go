@@ -80,11 +80,10 @@ func (a *AbstractKubeVendor) String() string {
 func (a *AbstractKubeVendor) Type() string { return a.typeStr }
 
 // AddonSkyCtx is part of the cloud.KubernetesVendor interface.
+// Dotted keys in more set values of nested dict fields.
 func (a *AbstractKubeVendor) AddonSkyCtx(more map[string]string) *addon.SkyCtx {
-	for k, v := range more {
-		if err := a.SkyCtx.SetField(k, starlark.String(v)); err != nil {
-			log.Errorf("failed to set addon ctx `%s=%s': %v", k, v, err)
-		}
+	if err := a.SkyCtx.SetPaths(more); err != nil {
+		log.Errorf("failed to set addon ctx: %v", err)
 	}
 	return a.SkyCtx
 }
@@ -0,0 +1,151 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Ctx fields populated from ClusterFacts. Fields already set by the cluster
+// definition or --context take precedence.
+const (
+	CtxClusterVersion = "cluster_version"
+	CtxAPIGroups      = "api_groups"
+	CtxNodeCount      = "node_count"
+	CtxCloudProvider  = "cloud_provider"
+	CtxZones          = "zones"
+)
+
+// nodesPageSize is the number of nodes listed per request.
+const nodesPageSize = 500
+
+// ClusterFacts are cluster properties discovered from the apiserver.
+type ClusterFacts struct {
+	// Version is the apiserver git version, e.g `v1.21.3-gke.2001'.
+	Version string
+	// APIGroups are all served group/versions, e.g `apps/v1' (`v1' for
+	// core group).
+	APIGroups []string
+	// NodeCount, CloudProvider and Zones are only set if nodes could be
+	// listed.
+	NodeCount int
+	// CloudProvider is the scheme of node provider IDs, e.g `gce' or `aws'.
+	CloudProvider string
+	Zones         []string
+}
+
+// DiscoverClusterFacts gathers ClusterFacts of the cluster cs is connected
+// to. Failure to list nodes (e.g due to RBAC) is not fatal.
+func DiscoverClusterFacts(ctx context.Context, cs kubernetes.Interface) (*ClusterFacts, error) {
+	v, err := cs.Discovery().ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server version: %v", err)
+	}
+	groups, err := cs.Discovery().ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server API groups: %v", err)
+	}
+
+	f := &ClusterFacts{Version: v.GitVersion}
+	for _, g := range groups.Groups {
+		for _, gv := range g.Versions {
+			f.APIGroups = append(f.APIGroups, gv.GroupVersion)
+		}
+	}
+	sort.Strings(f.APIGroups)
+
+	nodes, err := listNodes(ctx, cs)
+	if err != nil {
+		log.Warningf("Failed to list nodes, node facts are not available in ctx: %v", err)
+		return f, nil
+	}
+	f.NodeCount = len(nodes)
+	zones := map[string]bool{}
+	for _, n := range nodes {
+		if f.CloudProvider == "" {
+			if i := strings.Index(n.Spec.ProviderID, "://"); i > 0 {
+				f.CloudProvider = n.Spec.ProviderID[:i]
+			}
+		}
+		z := n.Labels[corev1.LabelTopologyZone]
+		if z == "" {
+			z = n.Labels[corev1.LabelFailureDomainBetaZone]
+		}
+		if z != "" {
+			zones[z] = true
+		}
+	}
+	for z := range zones {
+		f.Zones = append(f.Zones, z)
+	}
+	sort.Strings(f.Zones)
+	return f, nil
+}
+
+// listNodes lists all nodes of the cluster cs is connected to, a page at a
+// time.
+func listNodes(ctx context.Context, cs kubernetes.Interface) ([]corev1.Node, error) {
+	var nodes []corev1.Node
+	opts := metav1.ListOptions{Limit: nodesPageSize}
+	for {
+		page, err := cs.CoreV1().Nodes().List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, page.Items...)
+		if opts.Continue = page.Continue; opts.Continue == "" {
+			return nodes, nil
+		}
+	}
+}
+
+// SetCtx populates unset fields of c with f.
+func (f *ClusterFacts) SetCtx(c starlark.HasSetField) error {
+	fields := starlark.StringDict{
+		CtxClusterVersion: starlark.String(f.Version),
+		CtxAPIGroups:      stringList(f.APIGroups),
+		CtxNodeCount:      starlark.MakeInt(f.NodeCount),
+		CtxCloudProvider:  starlark.String(f.CloudProvider),
+		CtxZones:          stringList(f.Zones),
+	}
+	for _, k := range fields.Keys() {
+		if v, err := c.Attr(k); err != nil {
+			return err
+		} else if v != nil && v != starlark.None {
+			continue
+		}
+		if err := c.SetField(k, fields[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringList(ss []string) *starlark.List {
+	vs := make([]starlark.Value, len(ss))
+	for i, s := range ss {
+		vs[i] = starlark.String(s)
+	}
+	return starlark.NewList(vs)
+}
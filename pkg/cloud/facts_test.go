@@ -0,0 +1,117 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func node(name, providerID, zone string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{corev1.LabelTopologyZone: zone},
+		},
+		Spec: corev1.NodeSpec{ProviderID: providerID},
+	}
+}
+
+func TestDiscoverClusterFacts(t *testing.T) {
+	cs := fake.NewSimpleClientset(
+		node("a", "gce://proj/us-west1-a/a", "us-west1-a"),
+		node("b", "gce://proj/us-west1-b/b", "us-west1-b"),
+		node("c", "gce://proj/us-west1-a/c", "us-west1-a"),
+	)
+	d := cs.Discovery().(*fakediscovery.FakeDiscovery)
+	d.FakedServerVersion = &version.Info{GitVersion: "v1.21.3-gke.2001"}
+	d.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1"},
+		{GroupVersion: "apps/v1"},
+	}
+
+	f, err := DiscoverClusterFacts(context.Background(), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ClusterFacts{
+		Version:       "v1.21.3-gke.2001",
+		APIGroups:     []string{"apps/v1", "v1"},
+		NodeCount:     3,
+		CloudProvider: "gce",
+		Zones:         []string{"us-west1-a", "us-west1-b"},
+	}
+	if d := cmp.Diff(want, f); d != "" {
+		t.Errorf("Unexpected facts (-want, +got):\n%s", d)
+	}
+
+	c := addon.NewCtx()
+	c.Attrs["cloud_provider"] = starlark.String("custom")
+	if err := f.SetCtx(c); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		CtxClusterVersion: `"v1.21.3-gke.2001"`,
+		CtxNodeCount:      `3`,
+		CtxCloudProvider:  `"custom"`,
+		CtxZones:          `["us-west1-a", "us-west1-b"]`,
+	} {
+		if got := c.Attrs[k].String(); got != want {
+			t.Errorf("Expected ctx.%s to be %s, got %s", k, want, got)
+		}
+	}
+}
+
+func TestListNodesPaginated(t *testing.T) {
+	// Fake clientset doesn't record list options, so pages are served in
+	// order.
+	pages := []*corev1.NodeList{
+		{
+			ListMeta: metav1.ListMeta{Continue: "b"},
+			Items:    []corev1.Node{*node("a", "", "us-west1-a")},
+		},
+		{Items: []corev1.Node{*node("b", "", "us-west1-b")}},
+	}
+	cs := fake.NewSimpleClientset()
+	cs.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		page := pages[0]
+		pages = pages[1:]
+		return true, page, nil
+	})
+
+	nodes, err := listNodes(context.Background(), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nodes {
+		got = append(got, n.Name)
+	}
+	if d := cmp.Diff([]string{"a", "b"}, got); d != "" {
+		t.Errorf("Unexpected nodes (-want, +got):\n%s", d)
+	}
+}
@@ -15,10 +15,14 @@
 package gke
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -70,6 +74,90 @@ func BuildKubeRestConfDefaultCred(
 	return buildKubeRestConf(ctx, clusterName, location, project, useInternalIP, userAgent, tokenSrc)
 }
 
+// iamCredentialsURL is the endpoint of the IAM Service Account Credentials
+// API (overridden in tests).
+var iamCredentialsURL = "https://iamcredentials.googleapis.com"
+
+// TokenSource returns the token source for auth (one of AuthDefault and
+// AuthWorkloadIdentity). With AuthDefault, the service account key file is
+// used if set, the google application default credential otherwise. With
+// AuthWorkloadIdentity, tokens are obtained from the GKE metadata server for
+// the Google service account the Kubernetes service account is bound to. If
+// impersonate is set, the token source impersonates that service account.
+func TokenSource(ctx context.Context, auth, impersonate, svcAcctKeyFile string) (oauth2.TokenSource, error) {
+	var tokenSrc oauth2.TokenSource
+	switch auth {
+	case AuthDefault, "":
+		var err error
+		if svcAcctKeyFile != "" {
+			tokenSrc, err = GoogleCredTokenSourceFromSAKey(ctx, svcAcctKeyFile)
+		} else {
+			tokenSrc, err = google.DefaultTokenSource(ctx, container.CloudPlatformScope)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case AuthWorkloadIdentity:
+		tokenSrc = google.ComputeTokenSource("", container.CloudPlatformScope)
+	default:
+		return nil, fmt.Errorf("unknown auth `%s' (want %s or %s)", auth, AuthDefault, AuthWorkloadIdentity)
+	}
+	if impersonate != "" {
+		tokenSrc = oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+			ctx:            ctx,
+			base:           tokenSrc,
+			serviceAccount: impersonate,
+		})
+	}
+	return tokenSrc, nil
+}
+
+// impersonatedTokenSource obtains access tokens of serviceAccount with the
+// IAM Service Account Credentials API authenticated by base.
+type impersonatedTokenSource struct {
+	ctx            context.Context
+	base           oauth2.TokenSource
+	serviceAccount string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"scope":    []string{container.CloudPlatformScope},
+		"lifetime": "3600s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", iamCredentialsURL, s.serviceAccount)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oauth2.NewClient(s.ctx, s.base).Do(req.WithContext(s.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate `%s': %v", s.serviceAccount, err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to impersonate `%s': %s: %s", s.serviceAccount, resp.Status, bs)
+	}
+
+	var token struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(bs, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token of `%s': %v", s.serviceAccount, err)
+	}
+	return &oauth2.Token{AccessToken: token.AccessToken, TokenType: "Bearer", Expiry: token.ExpireTime}, nil
+}
+
 func buildKubeRestConf(
 	ctx context.Context,
 	clusterName, location, project, useInternalIP, userAgent string,
@@ -18,8 +18,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 
+	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/rest"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
@@ -35,6 +41,20 @@ const (
 	LocationKey = "location"
 	// UseInternalIPKey indicates if connecting API server via private endpoint
 	UseInternalIPKey = "use_internal_ip"
+	// AuthKey is the name of the field that selects how to authenticate to
+	// Google Cloud (one of AuthDefault and AuthWorkloadIdentity).
+	AuthKey = "auth"
+	// ImpersonateKey is the name of the field that sets the Google service
+	// account to impersonate.
+	ImpersonateKey = "impersonate_service_account"
+
+	// AuthDefault authenticates with the service account key file or the
+	// google application default credential.
+	AuthDefault = "default"
+	// AuthWorkloadIdentity authenticates with GKE workload identity (the
+	// Google service account bound to the Kubernetes service account Isopod
+	// runs as).
+	AuthWorkloadIdentity = "workload_identity"
 )
 
 var (
@@ -42,6 +62,10 @@ var (
 	_ starlark.HasAttrs = (*GKE)(nil)
 	// asserts *GKE implements cloud.KubernetesVendor interface.
 	_ cloud.KubernetesVendor = (*GKE)(nil)
+	// asserts *Builtin implements starlark.Callable and starlark.HasAttrs
+	// interfaces.
+	_ starlark.Callable = (*Builtin)(nil)
+	_ starlark.HasAttrs = (*Builtin)(nil)
 
 	// RequiredFields is the list of required fields to initialize a GKE target.
 	RequiredFields = []string{ClusterKey, ProjectKey, LocationKey}
@@ -54,22 +78,155 @@ type GKE struct {
 	svcAcctKeyFile, userAgent string
 }
 
+// Builtin is the GKE built-in. Calling it returns a GKE cluster and its
+// discover method lists GKE clusters of a project.
+type Builtin struct {
+	*starlark.Builtin
+	svcAcctKeyFile, userAgent string
+}
+
 // NewGKEBuiltin creates a new GKE built-in.
-func NewGKEBuiltin(svcAcctKeyFile, userAgent string) *starlark.Builtin {
-	return starlark.NewBuiltin(
+func NewGKEBuiltin(svcAcctKeyFile, userAgent string) *Builtin {
+	b := &Builtin{svcAcctKeyFile: svcAcctKeyFile, userAgent: userAgent}
+	b.Builtin = starlark.NewBuiltin(
 		"gke",
-		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-			absKubeVendor, err := cloud.NewAbstractKubeVendor("gke", RequiredFields, kwargs)
-			if err != nil {
-				return nil, err
-			}
-			return &GKE{
-				AbstractKubeVendor: absKubeVendor,
-				svcAcctKeyFile:     svcAcctKeyFile,
-				userAgent:          userAgent,
-			}, nil
+		func(t *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return b.newGKE(kwargs)
 		},
 	)
+	return b
+}
+
+func (b *Builtin) newGKE(kwargs []starlark.Tuple) (*GKE, error) {
+	absKubeVendor, err := cloud.NewAbstractKubeVendor("gke", RequiredFields, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := absKubeVendor.SkyCtx.Attrs[AuthKey]; ok {
+		if auth, ok := v.(starlark.String); !ok || (auth != AuthDefault && auth != AuthWorkloadIdentity) {
+			return nil, fmt.Errorf("<gke> `%s' must be one of %q, %q (got %v)", AuthKey, AuthDefault, AuthWorkloadIdentity, v)
+		}
+	}
+	return &GKE{
+		AbstractKubeVendor: absKubeVendor,
+		svcAcctKeyFile:     b.svcAcctKeyFile,
+		userAgent:          b.userAgent,
+	}, nil
+}
+
+// Attr implements starlark.HasAttrs.Attr.
+func (b *Builtin) Attr(name string) (starlark.Value, error) {
+	if name == "discover" {
+		return starlark.NewBuiltin("gke.discover", b.discoverFn), nil
+	}
+	return nil, nil
+}
+
+// AttrNames implements starlark.HasAttrs.AttrNames.
+func (b *Builtin) AttrNames() []string { return []string{"discover"} }
+
+// listClusters lists GKE clusters in location of project (overridden in
+// tests).
+var listClusters = func(ctx context.Context, tokenSrc oauth2.TokenSource, project, location string) ([]*container.Cluster, error) {
+	containerSvc, err := container.NewService(ctx, option.WithTokenSource(tokenSrc))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the container service: %v", err)
+	}
+	resp, err := containerSvc.Projects.Locations.Clusters.List(fmt.Sprintf("projects/%s/locations/%s", project, location)).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.MissingZones) > 0 {
+		log.Warningf("Clusters of project `%s' in zones %v could not be listed", project, resp.MissingZones)
+	}
+	return resp.Clusters, nil
+}
+
+// discoverFn implements gke.discover(project, location="-",
+// label_selector="", **fields). It returns GKE clusters in location of
+// project (all locations by default, a region includes its zones) whose
+// resource labels match label_selector, sorted by name. Other fields are
+// set on every returned cluster; auth and impersonate_service_account are
+// used to list clusters too.
+func (b *Builtin) discoverFn(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	project, location, selector := "", "-", ""
+	var fields []starlark.Tuple
+	var auth, impersonate string
+	for _, kv := range kwargs {
+		k := string(kv[0].(starlark.String))
+		var dst *string
+		switch k {
+		case ProjectKey:
+			dst = &project
+		case LocationKey:
+			dst = &location
+		case "label_selector":
+			dst = &selector
+		case ClusterKey:
+			return nil, fmt.Errorf("<%s>: `%s' is set from discovered clusters", fn.Name(), k)
+		case AuthKey:
+			dst = &auth
+			fields = append(fields, kv)
+		case ImpersonateKey:
+			dst = &impersonate
+			fields = append(fields, kv)
+		default:
+			fields = append(fields, kv)
+			continue
+		}
+		s, ok := kv[1].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("<%s>: `%s' must be a string (got a `%s')", fn.Name(), k, kv[1].Type())
+		}
+		*dst = string(s)
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("<%s>: unexpected positional arguments", fn.Name())
+	}
+	if project == "" {
+		return nil, fmt.Errorf("<%s>: `%s' must be set", fn.Name(), ProjectKey)
+	}
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("<%s>: invalid label_selector `%s': %v", fn.Name(), selector, err)
+	}
+
+	ctx, ok := t.Local(addon.GoCtxKey).(context.Context)
+	if !ok {
+		ctx = context.Background()
+	}
+	tokenSrc, err := TokenSource(ctx, auth, impersonate, b.svcAcctKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("<%s>: %v", fn.Name(), err)
+	}
+	clusters, err := listClusters(ctx, tokenSrc, project, location)
+	if err != nil {
+		return nil, fmt.Errorf("<%s>: failed to list clusters of project `%s' in `%s': %v", fn.Name(), project, location, err)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Name != clusters[j].Name {
+			return clusters[i].Name < clusters[j].Name
+		}
+		return clusters[i].Location < clusters[j].Location
+	})
+
+	var found []starlark.Value
+	for _, c := range clusters {
+		if !sel.Matches(labels.Set(c.ResourceLabels)) {
+			continue
+		}
+		kw := append([]starlark.Tuple{
+			{starlark.String(ClusterKey), starlark.String(c.Name)},
+			{starlark.String(ProjectKey), starlark.String(project)},
+			{starlark.String(LocationKey), starlark.String(c.Location)},
+		}, fields...)
+		g, err := b.newGKE(kw)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, g)
+	}
+	return starlark.NewList(found), nil
 }
 
 // KubeConfig is part of the cloud.KubernetesVendor interface.
@@ -78,7 +235,16 @@ func (g *GKE) KubeConfig(ctx context.Context) (*rest.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract cluster info from %v: %v", g, err)
 	}
-	return BuildKubeRestConfSACred(ctx, cluster, location, project, useInternalIP, g.svcAcctKeyFile, g.userAgent)
+	auth, _ := g.SkyCtx.Attrs[AuthKey].(starlark.String)
+	impersonate, _ := g.SkyCtx.Attrs[ImpersonateKey].(starlark.String)
+	if auth == "" && impersonate == "" {
+		return BuildKubeRestConfSACred(ctx, cluster, location, project, useInternalIP, g.svcAcctKeyFile, g.userAgent)
+	}
+	tokenSrc, err := TokenSource(ctx, string(auth), string(impersonate), g.svcAcctKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token source for %v: %v", g, err)
+	}
+	return buildKubeRestConf(ctx, cluster, location, project, useInternalIP, g.userAgent, tokenSrc)
 }
 
 func stringFromValue(v starlark.Value) (string, error) {
@@ -15,10 +15,18 @@
 package gke
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/container/v1"
 
 	util "github.com/cruise-automation/isopod/pkg/testing"
 )
@@ -50,6 +58,16 @@ func TestGKEBuiltin(t *testing.T) {
 			expr:    `gke(cluster="dev", location="us-west1", project="projID", foo="bar").foo`,
 			wantVal: starlark.String("bar"),
 		},
+		{
+			name:    "workload identity",
+			expr:    `gke(cluster="dev", location="us-west1", project="projID", auth="workload_identity").auth`,
+			wantVal: starlark.String("workload_identity"),
+		},
+		{
+			name:    "unknown auth",
+			expr:    `gke(cluster="dev", location="us-west1", project="projID", auth="password")`,
+			wantErr: errors.New("<gke> `auth' must be one of \"default\", \"workload_identity\" (got \"password\")"),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			pkgs := starlark.StringDict{"gke": NewGKEBuiltin("some-sa-key", "Isopod")}
@@ -63,3 +81,111 @@ func TestGKEBuiltin(t *testing.T) {
 		})
 	}
 }
+
+func TestDiscover(t *testing.T) {
+	listClusters = func(ctx context.Context, _ oauth2.TokenSource, project, location string) ([]*container.Cluster, error) {
+		if project != "fleet" {
+			return nil, fmt.Errorf("project %s not found", project)
+		}
+		return []*container.Cluster{
+			{Name: "prod-b", Location: "us-east1", ResourceLabels: map[string]string{"env": "prod"}},
+			{Name: "dev", Location: "us-west1-a", ResourceLabels: map[string]string{"env": "dev"}},
+			{Name: "prod-a", Location: "us-west1", ResourceLabels: map[string]string{"env": "prod", "team": "infra"}},
+		}, nil
+	}
+
+	// The workload identity token source doesn't need credentials until
+	// used (unlike the default one).
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "all",
+			expr: `gke.discover(project="fleet", auth="workload_identity")`,
+			want: []string{"dev/us-west1-a", "prod-a/us-west1", "prod-b/us-east1"},
+		},
+		{
+			name: "label selector",
+			expr: `gke.discover(project="fleet", auth="workload_identity", label_selector="env=prod")`,
+			want: []string{"prod-a/us-west1", "prod-b/us-east1"},
+		},
+		{
+			name: "set-based label selector",
+			expr: `gke.discover(project="fleet", location="us-west1", auth="workload_identity", label_selector="env in (prod),team")`,
+			want: []string{"prod-a/us-west1"},
+		},
+		{
+			name:    "missing project",
+			expr:    `gke.discover(location="us-west1")`,
+			wantErr: errors.New("<gke.discover>: `project' must be set"),
+		},
+		{
+			name:    "list error",
+			expr:    `gke.discover(project="other", auth="workload_identity")`,
+			wantErr: errors.New("<gke.discover>: failed to list clusters of project `other' in `-': project other not found"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"gke": NewGKEBuiltin("", "Isopod")}
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("want error %v got %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for i := 0; i < v.(*starlark.List).Len(); i++ {
+				g := v.(*starlark.List).Index(i).(*GKE)
+				cluster, location, project, _, err := clpFromClusterCtx(g.SkyCtx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if project != "fleet" {
+					t.Errorf("want project fleet got %s", project)
+				}
+				got = append(got, cluster+"/"+location)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected clusters (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/-/serviceAccounts/deployer@fleet.iam.gserviceaccount.com:generateAccessToken" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer base-token" {
+			http.Error(w, "unexpected token "+got, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"accessToken": "impersonated", "expireTime": "2021-09-20T18:04:11Z"}`)
+	}))
+	defer s.Close()
+	iamCredentialsURL = s.URL
+
+	ts := &impersonatedTokenSource{
+		ctx:            context.Background(),
+		base:           oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base-token"}),
+		serviceAccount: "deployer@fleet.iam.gserviceaccount.com",
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "impersonated" || token.Expiry.IsZero() {
+		t.Errorf("Unexpected token: %+v", token)
+	}
+
+	ts.serviceAccount = "unknown@fleet.iam.gserviceaccount.com"
+	if _, err := ts.Token(); err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("want 404 error got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package incluster implements the cluster Isopod runs in (e.g as a Job or a
+// CronJob) authenticated with its service account.
+package incluster
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+var (
+	// asserts *InCluster implements starlark.HasAttrs interface.
+	_ starlark.HasAttrs = (*InCluster)(nil)
+	// asserts *InCluster implements cloud.KubernetesVendor interface.
+	_ cloud.KubernetesVendor = (*InCluster)(nil)
+)
+
+// namespaceFile is where the namespace of the service account is mounted.
+var namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// DefaultNamespace is used when not running in a cluster.
+const DefaultNamespace = "default"
+
+// InCluster represents the cluster Isopod runs in.
+type InCluster struct {
+	*cloud.AbstractKubeVendor
+}
+
+// NewInClusterBuiltin creates a new InCluster built-in.
+func NewInClusterBuiltin() *starlark.Builtin {
+	return starlark.NewBuiltin(
+		"incluster",
+		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			absKubeVendor, err := cloud.NewAbstractKubeVendor("incluster", nil, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return &InCluster{AbstractKubeVendor: absKubeVendor}, nil
+		},
+	)
+}
+
+// New returns the cluster Isopod runs in without any fields, which is the
+// target of entry files that don't define clusters(ctx) in a cluster.
+func New() *InCluster {
+	// Can't fail without fields.
+	absKubeVendor, _ := cloud.NewAbstractKubeVendor("incluster", nil, nil)
+	return &InCluster{AbstractKubeVendor: absKubeVendor}
+}
+
+// KubeConfig is part of the cloud.KubernetesVendor interface.
+func (i *InCluster) KubeConfig(ctx context.Context) (*rest.Config, error) {
+	c, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("<incluster>: %v", err)
+	}
+	return c, nil
+}
+
+// Detected returns true if Isopod runs in a Kubernetes Pod with a service
+// account token mounted.
+func Detected() bool {
+	_, err := rest.InClusterConfig()
+	return err == nil
+}
+
+// namespace is Namespace (overridden by tests).
+var namespace = Namespace
+
+// NamespaceOf returns Namespace() if k8sVendor is the cluster Isopod runs in
+// (possibly wrapped by a type with an Unwrap method returning it) and
+// DefaultNamespace for other clusters.
+func NamespaceOf(k8sVendor cloud.KubernetesVendor) string {
+	for {
+		switch v := k8sVendor.(type) {
+		case *InCluster:
+			return namespace()
+		case interface{ Unwrap() cloud.KubernetesVendor }:
+			k8sVendor = v.Unwrap()
+		default:
+			return DefaultNamespace
+		}
+	}
+}
+
+// Namespace returns namespace of the service account Isopod runs as if it
+// runs in a cluster and DefaultNamespace otherwise.
+func Namespace() string {
+	if !Detected() {
+		return DefaultNamespace
+	}
+	bs, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return DefaultNamespace
+	}
+	if ns := strings.TrimSpace(string(bs)); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package incluster
+
+import (
+	"context"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestInClusterBuiltin(t *testing.T) {
+	pkgs := starlark.StringDict{"incluster": NewInClusterBuiltin()}
+	v, _, err := util.Eval(t.Name(), `incluster(cluster="local", env="dev")`, nil, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := v.(*InCluster)
+	if got := i.AddonSkyCtx(nil).Attrs["cluster"]; got != starlark.String("local") {
+		t.Errorf("Unexpected cluster field: %v", got)
+	}
+	if got := i.Type(); got != "incluster" {
+		t.Errorf("Unexpected type: %s", got)
+	}
+
+	// Tests don't run in a Pod.
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := i.KubeConfig(context.Background()); err == nil {
+		t.Error("Expected error outside of a cluster")
+	}
+	if Detected() {
+		t.Error("Unexpectedly detected a cluster")
+	}
+	if got := Namespace(); got != DefaultNamespace {
+		t.Errorf("Unexpected namespace outside of a cluster: %s", got)
+	}
+}
+
+// remote is a cluster Isopod doesn't run in.
+type remote struct {
+	*cloud.AbstractKubeVendor
+}
+
+func (*remote) KubeConfig(context.Context) (*rest.Config, error) { return &rest.Config{}, nil }
+
+// wrapped is a cluster wrapping another one.
+type wrapped struct {
+	cloud.KubernetesVendor
+}
+
+func (w *wrapped) Unwrap() cloud.KubernetesVendor { return w.KubernetesVendor }
+
+func TestNamespaceOf(t *testing.T) {
+	namespace = func() string { return "platform" }
+	defer func() { namespace = Namespace }()
+
+	absKubeVendor, err := cloud.NewAbstractKubeVendor("onprem", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		k8sVendor cloud.KubernetesVendor
+		want      string
+	}{
+		{name: "In cluster", k8sVendor: New(), want: "platform"},
+		{name: "Wrapped in cluster", k8sVendor: &wrapped{New()}, want: "platform"},
+		{name: "Remote cluster", k8sVendor: &remote{absKubeVendor}, want: DefaultNamespace},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NamespaceOf(tc.k8sVendor); got != tc.want {
+				t.Errorf("Want namespace: %s, got: %s", tc.want, got)
+			}
+		})
+	}
+}
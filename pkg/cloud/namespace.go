@@ -0,0 +1,46 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultNamespaceField is the optional field of clusters() entries setting
+// the namespace Isopod metadata (rollout store and lock) of the cluster is
+// kept in and kube built-ins resolve namespaced objects without a namespace
+// in, e.g `onprem(..., default_namespace="platform")'.
+const DefaultNamespaceField = "default_namespace"
+
+// DefaultNamespaceOf returns the namespace set by DefaultNamespaceField of
+// k8sVendor (empty if unset).
+func DefaultNamespaceOf(k8sVendor KubernetesVendor) (string, error) {
+	v, ok := k8sVendor.AddonSkyCtx(nil).Attrs[DefaultNamespaceField]
+	if !ok || v == starlark.None {
+		return "", nil
+	}
+	ns, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("`%s' must be a string, got %s", DefaultNamespaceField, v.Type())
+	}
+	if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+		return "", fmt.Errorf("invalid `%s' value `%s': %s", DefaultNamespaceField, ns, strings.Join(errs, ", "))
+	}
+	return ns, nil
+}
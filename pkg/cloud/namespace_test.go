@@ -0,0 +1,58 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestDefaultNamespaceOf(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		value   starlark.Value
+		want    string
+		wantErr string
+	}{
+		{name: "Unset"},
+		{name: "None", value: starlark.None},
+		{name: "Namespace", value: starlark.String("platform"), want: "platform"},
+		{name: "Invalid", value: starlark.String("Platform"), wantErr: "invalid `default_namespace' value `Platform': a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')"},
+		{name: "Not a string", value: starlark.MakeInt(1), wantErr: "`default_namespace' must be a string, got int"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var kwargs []starlark.Tuple
+			if tc.value != nil {
+				kwargs = append(kwargs, starlark.Tuple{starlark.String(DefaultNamespaceField), tc.value})
+			}
+			v, err := NewAbstractKubeVendor("fake", nil, kwargs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DefaultNamespaceOf(fakeVendor{v})
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if got != tc.want {
+				t.Errorf("Unexpected namespace. Want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
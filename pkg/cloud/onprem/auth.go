@@ -0,0 +1,325 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onprem
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// expiryDelta is how long before expiry cached tokens are renewed.
+	expiryDelta = time.Minute
+	// deviceCodeGrantType is the grant type of the OAuth 2.0 device
+	// authorization grant (RFC 8628).
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// TokenCache is the directory tokens of OIDC logins are cached in between
+// runs.
+var TokenCache = defaultTokenCache()
+
+// defaultPollInterval is how often the OIDC token endpoint is polled during
+// device flow login unless the issuer sets the interval.
+var defaultPollInterval = 5 * time.Second
+
+func defaultTokenCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "isopod", "tokens")
+}
+
+// cachedToken is a bearer token kept in TokenCache.
+type cachedToken struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// valid returns true if t can be used (tokens without expiry are only kept
+// in memory).
+func (t *cachedToken) valid() bool {
+	return t != nil && t.Token != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > expiryDelta)
+}
+
+// cachingTokenSource returns tokens obtained by fetch, cached in memory and
+// (if they expire) in TokenCache under a key derived from key parts.
+type cachingTokenSource struct {
+	mu   sync.Mutex
+	key  string
+	tok  *cachedToken
+	read bool
+	// fetch obtains a new token (with refreshToken of the expired token if
+	// any).
+	fetch func(refreshToken string) (*cachedToken, error)
+}
+
+func newCachingTokenSource(fetch func(string) (*cachedToken, error), key ...string) *cachingTokenSource {
+	h := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	return &cachingTokenSource{key: hex.EncodeToString(h[:]), fetch: fetch}
+}
+
+func (s *cachingTokenSource) path() string { return filepath.Join(TokenCache, s.key+".json") }
+
+// Token implements oauth2.TokenSource.
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.read {
+		s.read = true
+		if bs, err := ioutil.ReadFile(s.path()); err == nil {
+			tok := &cachedToken{}
+			if err := json.Unmarshal(bs, tok); err != nil {
+				log.Warningf("Ignoring invalid cached token `%s': %v", s.path(), err)
+			} else {
+				s.tok = tok
+			}
+		}
+	}
+
+	if !s.tok.valid() {
+		var refreshToken string
+		if s.tok != nil {
+			refreshToken = s.tok.RefreshToken
+		}
+		tok, err := s.fetch(refreshToken)
+		if err != nil {
+			return nil, err
+		}
+		s.tok = tok
+		if !tok.Expiry.IsZero() {
+			if err := s.store(); err != nil {
+				log.Warningf("Failed to cache token in `%s': %v", s.path(), err)
+			}
+		}
+	}
+	return &oauth2.Token{AccessToken: s.tok.Token, TokenType: "Bearer", Expiry: s.tok.Expiry}, nil
+}
+
+func (s *cachingTokenSource) store() error {
+	if err := os.MkdirAll(TokenCache, 0700); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(s.tok)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(), bs, 0600)
+}
+
+// oidcConfig is an OIDC client logging in with the device flow.
+type oidcConfig struct {
+	ctx                    context.Context
+	issuer                 string
+	clientID, clientSecret string
+	scopes                 []string
+}
+
+// oidcTokenSource returns a token source of ID tokens issued to c.
+func oidcTokenSource(c *oidcConfig) oauth2.TokenSource {
+	return newCachingTokenSource(c.token, append([]string{"oidc", c.issuer, c.clientID}, c.scopes...)...)
+}
+
+// token returns a new ID token, refreshed with refreshToken if possible or
+// obtained by device flow login.
+func (c *oidcConfig) token(refreshToken string) (*cachedToken, error) {
+	var endpoints struct {
+		DeviceAuthorization string `json:"device_authorization_endpoint"`
+		Token               string `json:"token_endpoint"`
+	}
+	if err := c.getJSON(strings.TrimSuffix(c.issuer, "/")+"/.well-known/openid-configuration", &endpoints); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC issuer `%s': %v", c.issuer, err)
+	}
+
+	if refreshToken != "" {
+		tok, err := c.exchange(endpoints.Token, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		})
+		if err == nil {
+			if tok.RefreshToken == "" {
+				tok.RefreshToken = refreshToken
+			}
+			return tok, nil
+		}
+		log.Warningf("Failed to refresh OIDC token of `%s', logging in again: %v", c.issuer, err)
+	}
+
+	if endpoints.DeviceAuthorization == "" {
+		return nil, fmt.Errorf("OIDC issuer `%s' doesn't support device flow login", c.issuer)
+	}
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if err := c.postForm(endpoints.DeviceAuthorization, url.Values{"scope": {strings.Join(c.scopes, " ")}}, &device); err != nil {
+		return nil, fmt.Errorf("failed to start OIDC device flow login: %v", err)
+	}
+	if device.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "To log in to `%s', visit %s\n", c.issuer, device.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(os.Stderr, "To log in to `%s', visit %s and enter code %s\n", c.issuer, device.VerificationURI, device.UserCode)
+	}
+
+	interval := defaultPollInterval
+	if device.Interval > 0 {
+		interval = time.Duration(device.Interval) * time.Second
+	}
+	ctx := c.ctx
+	if device.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(device.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("OIDC device flow login timed out: %v", ctx.Err())
+		case <-time.After(interval):
+		}
+		tok, err := c.exchange(endpoints.Token, url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {device.DeviceCode},
+		})
+		switch e, _ := err.(*oauthError); {
+		case err == nil:
+			return tok, nil
+		case e != nil && e.Code == "authorization_pending":
+		case e != nil && e.Code == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("OIDC device flow login failed: %v", err)
+		}
+	}
+}
+
+// oauthError is an error response of an OAuth 2.0 endpoint.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+// exchange requests an ID token from the token endpoint.
+func (c *oidcConfig) exchange(endpoint string, form url.Values) (*cachedToken, error) {
+	var resp struct {
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := c.postForm(endpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.IDToken == "" {
+		return nil, fmt.Errorf("token response of `%s' has no id_token", endpoint)
+	}
+	tok := &cachedToken{Token: resp.IDToken, RefreshToken: resp.RefreshToken}
+	if exp, ok := jwtExpiry(resp.IDToken); ok {
+		tok.Expiry = exp
+	} else if resp.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
+
+// jwtExpiry returns the exp claim of JWT token.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+func (c *oidcConfig) postForm(endpoint string, form url.Values, v interface{}) error {
+	form.Set("client_id", c.clientID)
+	if c.clientSecret != "" {
+		form.Set("client_secret", c.clientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, v)
+}
+
+func (c *oidcConfig) getJSON(endpoint string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, v)
+}
+
+func (c *oidcConfig) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &oauthError{}
+		if json.Unmarshal(bs, e) == nil && e.Code != "" {
+			return e
+		}
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(bs))
+	}
+	return json.Unmarshal(bs, v)
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onprem
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestExecProvider(t *testing.T) {
+	dir := t.TempDir()
+	var gotAuth []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	// The plugin counts its runs in a file next to it and returns its
+	// argument as the token.
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	plugin := filepath.Join(dir, "plugin.sh")
+	script := fmt.Sprintf(`#!/bin/sh
+echo run >> %s/runs
+echo '{"apiVersion": "client.authentication.k8s.io/v1beta1", "kind": "ExecCredential", "status": {"token": "'$1'", "expirationTimestamp": "%s"}}'
+`, dir, expiry)
+	if err := ioutil.WriteFile(plugin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := starlark.StringDict{"onprem": NewOnPremBuiltin("")}
+	v, _, err := util.Eval(t.Name(), fmt.Sprintf(`onprem(cluster="test", server=%q, exec_command=%q, exec_args=["secret"])`, ts.URL, plugin), nil, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := v.(*OnPrem).KubeConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ExecProvider == nil || c.ExecProvider.Command != plugin {
+		t.Fatalf("Unexpected exec provider: %+v", c.ExecProvider)
+	}
+	rt, err := rest.TransportFor(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if want := []string{"Bearer secret", "Bearer secret"}; strings.Join(gotAuth, ",") != strings.Join(want, ",") {
+		t.Errorf("Unexpected Authorization headers. Want: %v, got: %v", want, gotAuth)
+	}
+	runs, err := ioutil.ReadFile(filepath.Join(dir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(runs), "run"); n != 1 {
+		t.Errorf("want plugin to run once got %d runs", n)
+	}
+}
+
+func TestOIDCTokenSource(t *testing.T) {
+	TokenCache = t.TempDir()
+	defer func() { TokenCache = defaultTokenCache() }()
+	defaultPollInterval = time.Millisecond
+	defer func() { defaultPollInterval = 5 * time.Second }()
+
+	idToken := func(name string, exp time.Time) string {
+		claims, _ := json.Marshal(map[string]interface{}{"sub": name, "exp": exp.Unix()})
+		return "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+	}
+	var polls, refreshes int
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path != "/.well-known/openid-configuration" && r.Form.Get("client_id") != "isopod" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"device_authorization_endpoint": "%s/device", "token_endpoint": "%s/token"}`, s.URL, s.URL)
+		case "/device":
+			if got := r.Form.Get("scope"); got != "openid offline_access" {
+				t.Errorf("Unexpected scope %q", got)
+			}
+			fmt.Fprint(w, `{"device_code": "dc", "user_code": "ABCD", "verification_uri": "https://sso/device", "expires_in": 60}`)
+		case "/token":
+			switch r.Form.Get("grant_type") {
+			case deviceCodeGrantType:
+				if polls++; polls < 3 {
+					http.Error(w, `{"error": "authorization_pending"}`, http.StatusBadRequest)
+					return
+				}
+				// Expires right away so that the next call refreshes it.
+				fmt.Fprintf(w, `{"id_token": %q, "refresh_token": "rt"}`, idToken("login", time.Now()))
+			case "refresh_token":
+				refreshes++
+				if r.Form.Get("refresh_token") != "rt" {
+					http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+					return
+				}
+				fmt.Fprintf(w, `{"id_token": %q}`, idToken("refreshed", time.Now().Add(time.Hour)))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	c := &oidcConfig{ctx: context.Background(), issuer: s.URL, clientID: "isopod", scopes: []string{"openid", "offline_access"}}
+	ts := oidcTokenSource(c)
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != idToken("login", tok.Expiry) || polls != 3 {
+		t.Errorf("Unexpected login token %s after %d polls", tok.AccessToken, polls)
+	}
+
+	for i := 0; i < 2; i++ {
+		// The second token source reads the refreshed token from the cache.
+		tok, err := oidcTokenSource(c).Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != idToken("refreshed", tok.Expiry) || time.Until(tok.Expiry) < 30*time.Minute {
+			t.Errorf("Unexpected refreshed token %+v", tok)
+		}
+	}
+	if refreshes != 1 || polls != 3 {
+		t.Errorf("want 1 refresh and no login got %d refreshes and %d polls", refreshes, polls)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"go.starlark.net/starlark"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
 
 	"github.com/cruise-automation/isopod/pkg/cloud"
 	"github.com/cruise-automation/isopod/pkg/vault"
@@ -34,10 +35,128 @@ var (
 	_ cloud.KubernetesVendor = (*OnPrem)(nil)
 )
 
+// Fields of onprem() that customize how to connect to the cluster.
+const (
+	// ServerKey is the URL of the API server. If set, the kubeconfig is not
+	// used.
+	ServerKey = "server"
+	// KubeConfigKey is the path of the kubeconfig of the cluster. Defaults
+	// to --kubeconfig, then $KUBECONFIG and ~/.kube/config.
+	KubeConfigKey = "kubeconfig"
+	// ContextKey is the kubeconfig context of the cluster. Defaults to the
+	// current context.
+	ContextKey = "context"
+	// CAFileKey and CADataKey set the CA certificate (path or PEM) the API
+	// server certificate is verified with.
+	CAFileKey = "ca_file"
+	CADataKey = "ca_data"
+	// ExecCommandKey and ExecArgsKey set the exec credential plugin
+	// bearer tokens are obtained from.
+	ExecCommandKey = "exec_command"
+	ExecArgsKey    = "exec_args"
+	// OIDCIssuerKey, OIDCClientIDKey, OIDCClientSecretKey and OIDCScopesKey
+	// set the OIDC client ID tokens are obtained with (by device flow
+	// login).
+	OIDCIssuerKey       = "oidc_issuer"
+	OIDCClientIDKey     = "oidc_client_id"
+	OIDCClientSecretKey = "oidc_client_secret"
+	OIDCScopesKey       = "oidc_scopes"
+)
+
+// authKeys are fields of onprem() holding credentials (or how to obtain
+// them). They are removed from the cluster's attributes once parsed so that
+// they don't end up in addon contexts, annotations of applied objects or
+// errors.
+var authKeys = []string{
+	CAFileKey, CADataKey,
+	ExecCommandKey, ExecArgsKey,
+	OIDCIssuerKey, OIDCClientIDKey, OIDCClientSecretKey, OIDCScopesKey,
+}
+
 // OnPrem represents a on-premise cluster.
 type OnPrem struct {
 	*cloud.AbstractKubeVendor
 	kubeConfigFile string
+	auth           *authOptions
+}
+
+// authOptions are set by onprem() fields.
+type authOptions struct {
+	server, caFile, caData               string
+	kubeConfig, context                  string
+	execCommand                          string
+	execArgs                             []string
+	oidcIssuer, oidcClientID, oidcSecret string
+	oidcScopes                           []string
+}
+
+// parseAuthOptions returns auth options set by attrs and removes authKeys
+// from attrs.
+func parseAuthOptions(attrs starlark.StringDict) (*authOptions, error) {
+	o := &authOptions{}
+	for k, dst := range map[string]*string{
+		ServerKey:           &o.server,
+		KubeConfigKey:       &o.kubeConfig,
+		ContextKey:          &o.context,
+		CAFileKey:           &o.caFile,
+		CADataKey:           &o.caData,
+		ExecCommandKey:      &o.execCommand,
+		OIDCIssuerKey:       &o.oidcIssuer,
+		OIDCClientIDKey:     &o.oidcClientID,
+		OIDCClientSecretKey: &o.oidcSecret,
+	} {
+		v, ok := attrs[k]
+		if !ok {
+			continue
+		}
+		s, ok := v.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("`%s' must be a string (got a `%s')", k, v.Type())
+		}
+		*dst = string(s)
+	}
+	for k, dst := range map[string]*[]string{
+		ExecArgsKey:   &o.execArgs,
+		OIDCScopesKey: &o.oidcScopes,
+	} {
+		v, ok := attrs[k]
+		if !ok {
+			continue
+		}
+		l, ok := v.(*starlark.List)
+		if !ok {
+			return nil, fmt.Errorf("`%s' must be a list of strings (got a `%s')", k, v.Type())
+		}
+		for i := 0; i < l.Len(); i++ {
+			s, ok := l.Index(i).(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("`%s' must be a list of strings (got a `%s' item)", k, l.Index(i).Type())
+			}
+			*dst = append(*dst, string(s))
+		}
+	}
+
+	switch {
+	case o.server != "" && (o.kubeConfig != "" || o.context != ""):
+		return nil, fmt.Errorf("`%s' and `%s' can't be set with `%s'", KubeConfigKey, ContextKey, ServerKey)
+	case o.caFile != "" && o.caData != "":
+		return nil, fmt.Errorf("only one of `%s' and `%s' may be set", CAFileKey, CADataKey)
+	case o.execCommand != "" && o.oidcIssuer != "":
+		return nil, fmt.Errorf("only one of `%s' and `%s' may be set", ExecCommandKey, OIDCIssuerKey)
+	case len(o.execArgs) > 0 && o.execCommand == "":
+		return nil, fmt.Errorf("`%s' requires `%s'", ExecArgsKey, ExecCommandKey)
+	case (o.oidcIssuer == "") != (o.oidcClientID == ""):
+		return nil, fmt.Errorf("`%s' and `%s' must be set together", OIDCIssuerKey, OIDCClientIDKey)
+	case (o.oidcSecret != "" || len(o.oidcScopes) > 0) && o.oidcIssuer == "":
+		return nil, fmt.Errorf("`%s' and `%s' require `%s'", OIDCClientSecretKey, OIDCScopesKey, OIDCIssuerKey)
+	}
+	if o.oidcIssuer != "" && len(o.oidcScopes) == 0 {
+		o.oidcScopes = []string{"openid", "offline_access"}
+	}
+	for _, k := range authKeys {
+		delete(attrs, k)
+	}
+	return o, nil
 }
 
 // NewOnPremBuiltin creates a new OnPrem built-in.
@@ -49,9 +168,14 @@ func NewOnPremBuiltin(kubeConfigFile string) *starlark.Builtin {
 			if err != nil {
 				return nil, err
 			}
+			auth, err := parseAuthOptions(absKubeVendor.SkyCtx.Attrs)
+			if err != nil {
+				return nil, fmt.Errorf("<onprem> %v", err)
+			}
 			return &OnPrem{
 				AbstractKubeVendor: absKubeVendor,
 				kubeConfigFile:     kubeConfigFile,
+				auth:               auth,
 			}, nil
 		},
 	)
@@ -59,13 +183,66 @@ func NewOnPremBuiltin(kubeConfigFile string) *starlark.Builtin {
 
 // KubeConfig is part of the cloud.KubernetesVendor interface.
 func (o *OnPrem) KubeConfig(ctx context.Context) (*rest.Config, error) {
+	auth := o.auth
+	if auth == nil {
+		auth = &authOptions{}
+	}
+	c := &rest.Config{Host: auth.server}
+	if auth.server == "" {
+		var err error
+		if c, err = o.kubeConfig(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case auth.caFile != "":
+		c.TLSClientConfig.CAFile, c.TLSClientConfig.CAData = auth.caFile, nil
+	case auth.caData != "":
+		c.TLSClientConfig.CAFile, c.TLSClientConfig.CAData = "", []byte(auth.caData)
+	}
+
+	if auth.execCommand != "" {
+		// client-go runs the plugin and keeps its credentials (tokens or
+		// client certificates) in memory until they expire. They are not
+		// cached in TokenCache: plugins (e.g kubelogin) keep their own
+		// cache between runs, which Isopod can't invalidate.
+		o := &cloud.ClientOptions{ExecCommand: auth.execCommand, ExecArgs: auth.execArgs}
+		if err := o.Apply(c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	if auth.oidcIssuer == "" {
+		return c, nil
+	}
+	// Credentials of the kubeconfig would be sent along with (or conflict
+	// with) the ones obtained here.
+	c.BearerToken, c.BearerTokenFile = "", ""
+	c.Username, c.Password = "", ""
+	c.AuthProvider, c.ExecProvider = nil, nil
+	c.WrapTransport = transport.TokenSourceWrapTransport(oidcTokenSource(&oidcConfig{
+		ctx:          ctx,
+		issuer:       auth.oidcIssuer,
+		clientID:     auth.oidcClientID,
+		clientSecret: auth.oidcSecret,
+		scopes:       auth.oidcScopes,
+	}))
+	return c, nil
+}
+
+// kubeConfig returns the config of the context set by auth (the current
+// context if unset) of the kubeconfig file or Vault path.
+func (o *OnPrem) kubeConfig(auth *authOptions) (*rest.Config, error) {
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: auth.context}
 	if vaultKubeConfig, ok := o.AbstractKubeVendor.AddonSkyCtx(
 		map[string]string{}).Attrs["vaultkubeconfig"]; ok {
 		kubeConfigVaultPath := vaultKubeConfig.(starlark.String).String()
 
-		// Should only access vault kubeconfig if the kubeConfigFile flag was not set
-		// and the vaultkubeconfig attribute is set in the star config.
-		if len(kubeConfigVaultPath) > 0 && len(o.kubeConfigFile) < 1 {
+		// Should only access vault kubeconfig if neither the kubeConfigFile
+		// flag nor the kubeconfig field was set and the vaultkubeconfig
+		// attribute is set in the star config.
+		if len(kubeConfigVaultPath) > 0 && len(o.kubeConfigFile) < 1 && auth.kubeConfig == "" {
 			// Remove the surrounding quotes from the Starlark string
 			kubeConfigVaultPath = strings.Trim(kubeConfigVaultPath, `"`)
 
@@ -74,10 +251,21 @@ func (o *OnPrem) KubeConfig(ctx context.Context) (*rest.Config, error) {
 				return nil, fmt.Errorf("failed to read kubeconfig vault path: %v", err)
 			}
 
-			kubeconfig := []byte(value)
+			kubeconfig, err := clientcmd.Load([]byte(value))
+			if err != nil {
+				return nil, err
+			}
 
-			return clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+			return clientcmd.NewNonInteractiveClientConfig(*kubeconfig, auth.context, overrides, nil).ClientConfig()
 		}
 	}
-	return clientcmd.BuildConfigFromFlags("", o.kubeConfigFile)
+
+	// Without a path, $KUBECONFIG and ~/.kube/config are loaded (and the
+	// in-cluster config used if there are none).
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeConfigFile
+	if auth.kubeConfig != "" {
+		rules.ExplicitPath = auth.kubeConfig
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 }
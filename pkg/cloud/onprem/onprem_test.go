@@ -15,6 +15,11 @@
 package onprem
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"go.starlark.net/starlark"
@@ -44,6 +49,36 @@ func TestOnPremBuiltin(t *testing.T) {
 			expr:    `onprem(cluster="test", env="dev", vaultkubeconfig="secret/test").vaultkubeconfig`,
 			wantVal: starlark.String("secret/test"),
 		},
+		{
+			name:    "reference server field",
+			expr:    `onprem(cluster="test", server="https://10.0.0.1", exec_command="kubelogin", exec_args=["get-token"]).server`,
+			wantVal: starlark.String("https://10.0.0.1"),
+		},
+		{
+			name:    "auth fields are not exposed",
+			expr:    `onprem(cluster="test", server="https://10.0.0.1", oidc_issuer="https://sso", oidc_client_id="isopod", oidc_client_secret="s3cr3t").oidc_client_secret`,
+			wantVal: starlark.None,
+		},
+		{
+			name:    "exec and oidc",
+			expr:    `onprem(cluster="test", exec_command="kubelogin", oidc_issuer="https://sso", oidc_client_id="isopod")`,
+			wantErr: errors.New("<onprem> only one of `exec_command' and `oidc_issuer' may be set"),
+		},
+		{
+			name:    "oidc without client id",
+			expr:    `onprem(cluster="test", oidc_issuer="https://sso")`,
+			wantErr: errors.New("<onprem> `oidc_issuer' and `oidc_client_id' must be set together"),
+		},
+		{
+			name:    "context with server",
+			expr:    `onprem(cluster="test", server="https://10.0.0.1", context="test")`,
+			wantErr: errors.New("<onprem> `kubeconfig' and `context' can't be set with `server'"),
+		},
+		{
+			name:    "invalid exec_args",
+			expr:    `onprem(cluster="test", exec_command="kubelogin", exec_args="get-token")`,
+			wantErr: errors.New("<onprem> `exec_args' must be a list of strings (got a `string')"),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			pkgs := starlark.StringDict{"onprem": NewOnPremBuiltin("some-kubeconfig-file")}
@@ -57,3 +92,85 @@ func TestOnPremBuiltin(t *testing.T) {
 		})
 	}
 }
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev:6443
+- name: prod
+  cluster:
+    server: https://prod:6443
+contexts:
+- name: dev
+  context:
+    cluster: dev
+- name: prod
+  context:
+    cluster: prod
+current-context: dev
+`
+
+func TestOnPremKubeConfig(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfig, []byte(testKubeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", kubeconfig)
+
+	for _, tc := range []struct {
+		name, flag, expr string
+		wantHost         string
+		wantErr          string
+	}{
+		{
+			name:     "current context of $KUBECONFIG",
+			expr:     `onprem(cluster="dev")`,
+			wantHost: "https://dev:6443",
+		},
+		{
+			name:     "context of $KUBECONFIG",
+			expr:     `onprem(cluster="prod", context="prod")`,
+			wantHost: "https://prod:6443",
+		},
+		{
+			name:     "context of kubeconfig field",
+			flag:     "missing-kubeconfig",
+			expr:     `onprem(cluster="prod", kubeconfig="` + kubeconfig + `", context="prod")`,
+			wantHost: "https://prod:6443",
+		},
+		{
+			name:     "context of --kubeconfig",
+			flag:     kubeconfig,
+			expr:     `onprem(cluster="prod", context="prod")`,
+			wantHost: "https://prod:6443",
+		},
+		{
+			name:    "missing context",
+			expr:    `onprem(cluster="staging", context="staging")`,
+			wantErr: `context "staging" does not exist`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"onprem": NewOnPremBuiltin(tc.flag)}
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := v.(*OnPrem).KubeConfig(context.Background())
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err == nil && c.Host != tc.wantHost {
+				t.Errorf("Unexpected host. Want: %s, got: %s", tc.wantHost, c.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+// ServiceAccountField is the optional field of clusters() entries naming the
+// Kubernetes service account ([<namespace>/]<name>) addons run as, e.g
+// `gke(..., service_account="isopod-addons")'.
+const ServiceAccountField = "service_account"
+
+// ServiceAccountTokenTTL is the requested lifetime of service account tokens.
+// Tokens are requested again before they expire.
+var ServiceAccountTokenTTL = time.Hour
+
+// ServiceAccount is a Kubernetes service account addons run as.
+type ServiceAccount struct {
+	Namespace, Name string
+}
+
+// String implements fmt.Stringer.
+func (s *ServiceAccount) String() string {
+	return s.Namespace + "/" + s.Name
+}
+
+// ServiceAccountOf returns the service account set by ServiceAccountField of
+// k8sVendor (nil if unset). The namespace defaults to defaultNamespace.
+func ServiceAccountOf(k8sVendor KubernetesVendor, defaultNamespace string) (*ServiceAccount, error) {
+	v, ok := k8sVendor.AddonSkyCtx(nil).Attrs[ServiceAccountField]
+	if !ok || v == starlark.None {
+		return nil, nil
+	}
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return nil, fmt.Errorf("`%s' must be a string, got %s", ServiceAccountField, v.Type())
+	}
+	sa := &ServiceAccount{Namespace: defaultNamespace, Name: s}
+	if i := strings.Index(s, "/"); i >= 0 {
+		sa.Namespace, sa.Name = s[:i], s[i+1:]
+	}
+	if sa.Namespace == "" || sa.Name == "" || strings.Contains(sa.Name, "/") {
+		return nil, fmt.Errorf("invalid `%s' value `%s' (want [<namespace>/]<name>)", ServiceAccountField, s)
+	}
+	return sa, nil
+}
+
+// Config returns config of the cluster of c authenticated as s by tokens
+// requested with the TokenRequest API using credentials of c. Only the
+// server address, TLS and client settings of c are kept. Fails if the first
+// token can't be requested.
+func (s *ServiceAccount) Config(ctx context.Context, c *rest.Config) (*rest.Config, error) {
+	cs, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	tokenSrc := oauth2.ReuseTokenSource(nil, &tokenRequestSource{ctx: ctx, cs: cs, sa: s})
+	if _, err := tokenSrc.Token(); err != nil {
+		return nil, err
+	}
+	sc := rest.AnonymousClientConfig(c)
+	sc.WrapTransport = transport.TokenSourceWrapTransport(tokenSrc)
+	return sc, nil
+}
+
+// tokenRequestSource requests tokens of a service account.
+type tokenRequestSource struct {
+	ctx context.Context
+	cs  kubernetes.Interface
+	sa  *ServiceAccount
+}
+
+// Token implements oauth2.TokenSource.
+func (s *tokenRequestSource) Token() (*oauth2.Token, error) {
+	ttl := int64(ServiceAccountTokenTTL / time.Second)
+	tr, err := s.cs.CoreV1().ServiceAccounts(s.sa.Namespace).CreateToken(s.ctx, s.sa.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &ttl},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token of service account `%s': %v", s.sa, err)
+	}
+	return &oauth2.Token{
+		AccessToken: tr.Status.Token,
+		TokenType:   "Bearer",
+		Expiry:      tr.Status.ExpirationTimestamp.Time,
+	}, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+type fakeVendor struct {
+	*AbstractKubeVendor
+}
+
+func (fakeVendor) KubeConfig(context.Context) (*rest.Config, error) { return &rest.Config{}, nil }
+
+func TestServiceAccountOf(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		value   starlark.Value
+		want    *ServiceAccount
+		wantErr string
+	}{
+		{name: "Unset"},
+		{name: "Default namespace", value: starlark.String("isopod-addons"), want: &ServiceAccount{Namespace: "isopod", Name: "isopod-addons"}},
+		{name: "Namespace", value: starlark.String("infra/addons"), want: &ServiceAccount{Namespace: "infra", Name: "addons"}},
+		{name: "Invalid", value: starlark.String("a/b/c"), wantErr: "invalid `service_account' value `a/b/c' (want [<namespace>/]<name>)"},
+		{name: "Not a string", value: starlark.MakeInt(1), wantErr: "`service_account' must be a string, got int"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var kwargs []starlark.Tuple
+			if tc.value != nil {
+				kwargs = append(kwargs, starlark.Tuple{starlark.String(ServiceAccountField), tc.value})
+			}
+			v, err := NewAbstractKubeVendor("fake", nil, kwargs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ServiceAccountOf(fakeVendor{v}, "isopod")
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected service account (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestServiceAccountConfig(t *testing.T) {
+	var gotAuth []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v1/namespaces/isopod/serviceaccounts/isopod-addons/token":
+			tr := &authenticationv1.TokenRequest{}
+			if err := json.NewDecoder(r.Body).Decode(tr); err != nil || tr.Spec.ExpirationSeconds == nil || *tr.Spec.ExpirationSeconds != 3600 {
+				http.Error(w, "bad token request", http.StatusBadRequest)
+				return
+			}
+			tr.Status = authenticationv1.TokenRequestStatus{
+				Token:               "sa-token",
+				ExpirationTimestamp: metav1.NewTime(time.Now().Add(time.Hour)),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tr)
+		case "/api/v1/namespaces/default":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "default"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	sa := &ServiceAccount{Namespace: "isopod", Name: "isopod-addons"}
+	c, err := sa.Config(context.Background(), &rest.Config{Host: s.URL, BearerToken: "operator-token", UserAgent: "Isopod/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BearerToken != "" || c.UserAgent != "Isopod/test" {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+	cs, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cs.CoreV1().Namespaces().Get(context.Background(), "default", metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"POST /api/v1/namespaces/isopod/serviceaccounts/isopod-addons/token Bearer operator-token",
+		"GET /api/v1/namespaces/default Bearer sa-token",
+		"GET /api/v1/namespaces/default Bearer sa-token",
+	}
+	if d := cmp.Diff(want, gotAuth); d != "" {
+		t.Errorf("Unexpected requests (-want +got):\n%s", d)
+	}
+
+	sa.Name = "missing"
+	if _, err := sa.Config(context.Background(), &rest.Config{Host: s.URL}); err == nil {
+		t.Error("Want error requesting token of missing service account, got nil")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package controller implements Isopod controller mode which continuously
+// reconciles addons referenced by a ConfigMap.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	log "github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+const (
+	// EntryFileKey is the ConfigMap data key holding path to the main
+	// Starlark entry file.
+	EntryFileKey = "entryfile"
+	// ContextKey is the ConfigMap data key holding comma-separated list of
+	// `foo=bar' context parameters passed to the clusters Starlark function.
+	ContextKey = "context"
+)
+
+// Spec is the desired state read from the controller ConfigMap.
+type Spec struct {
+	EntryFile string
+	Context   map[string]string
+}
+
+// ReconcileFunc brings the clusters in line with spec.
+type ReconcileFunc func(ctx context.Context, spec *Spec) error
+
+// Controller reconciles addons whenever its ConfigMap changes and
+// periodically in between.
+type Controller struct {
+	clientset       kubernetes.Interface
+	namespace, name string
+	interval        time.Duration
+	reconcile       ReconcileFunc
+}
+
+// New returns a new *Controller driven by ConfigMap namespace/name which calls
+// fn at least every interval.
+func New(c kubernetes.Interface, namespace, name string, interval time.Duration, fn ReconcileFunc) *Controller {
+	return &Controller{
+		clientset: c,
+		namespace: namespace,
+		name:      name,
+		interval:  interval,
+		reconcile: fn,
+	}
+}
+
+// specFromConfigMap parses Spec from cm.
+func specFromConfigMap(cm *corev1.ConfigMap) (*Spec, error) {
+	entryFile := cm.Data[EntryFileKey]
+	if entryFile == "" {
+		return nil, fmt.Errorf("ConfigMap `%s/%s' is missing `%s' key", cm.Namespace, cm.Name, EntryFileKey)
+	}
+	ctxParams, err := util.ParseCommaSeparatedParams(cm.Data[ContextKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid `%s' in ConfigMap `%s/%s': %v", ContextKey, cm.Namespace, cm.Name, err)
+	}
+	return &Spec{EntryFile: entryFile, Context: ctxParams}, nil
+}
+
+// Run reconciles until ctx is done. Reconciliation errors are logged and
+// retried on the next iteration.
+func (c *Controller) Run(ctx context.Context) error {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	for {
+		var spec *Spec
+		cm, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+		if err == nil {
+			spec, err = specFromConfigMap(cm)
+		}
+		if err != nil {
+			log.Errorf("Failed to read controller spec: %v", err)
+		} else {
+			log.Infof("Reconciling `%s' with context %v", spec.EntryFile, spec.Context)
+			if err := c.reconcile(ctx, spec); err != nil {
+				log.Errorf("Reconcile failed: %v", err)
+			} else {
+				log.Infof("Reconcile succeeded")
+			}
+		}
+
+		var rv string
+		if cm != nil {
+			rv = cm.ResourceVersion
+		}
+		if err := c.wait(ctx, t.C, rv, spec); err != nil {
+			return err
+		}
+	}
+}
+
+// wait blocks until the next tick or until the spec in the ConfigMap differs
+// from last. Returns error only if ctx is done.
+func (c *Controller) wait(ctx context.Context, tick <-chan time.Time, rv string, last *Spec) error {
+	for {
+		w, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", c.name).String(),
+			ResourceVersion: rv,
+		})
+		if err != nil {
+			log.Errorf("Failed to watch ConfigMap `%s/%s': %v", c.namespace, c.name, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick:
+				return nil
+			}
+		}
+
+		changed, err := c.waitEvents(ctx, tick, w, &rv, last)
+		w.Stop()
+		if err != nil || changed {
+			return err
+		}
+	}
+}
+
+// waitEvents consumes events from w until the next tick, spec change or the
+// watch is closed (changed is false in this case).
+func (c *Controller) waitEvents(ctx context.Context, tick <-chan time.Time, w watch.Interface, rv *string, last *Spec) (changed bool, err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-tick:
+			return true, nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			cm, ok := ev.Object.(*corev1.ConfigMap)
+			if !ok || cm.Name != c.name {
+				continue
+			}
+			*rv = cm.ResourceVersion
+			if ev.Type != watch.Added && ev.Type != watch.Modified {
+				continue
+			}
+
+			spec, err := specFromConfigMap(cm)
+			if err != nil {
+				log.Errorf("Ignoring invalid controller spec: %v", err)
+				continue
+			}
+			if !reflect.DeepEqual(spec, last) {
+				log.Infof("Controller spec changed")
+				return true, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSpecFromConfigMap(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    map[string]string
+		want    *Spec
+		wantErr bool
+	}{
+		{
+			name: "full",
+			data: map[string]string{EntryFileKey: "/addons/main.ipd", ContextKey: "cluster=foo,env=prod"},
+			want: &Spec{
+				EntryFile: "/addons/main.ipd",
+				Context:   map[string]string{"cluster": "foo", "env": "prod"},
+			},
+		},
+		{
+			name:    "missing entry file",
+			data:    map[string]string{ContextKey: "cluster=foo"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid context",
+			data:    map[string]string{EntryFileKey: "/addons/main.ipd", ContextKey: "cluster"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := specFromConfigMap(&corev1.ConfigMap{Data: tc.data})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error: %v (want error: %v)", err, tc.wantErr)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected spec (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestControllerReconcilesOnChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "isopod"},
+		Data:       map[string]string{EntryFileKey: "/addons/main.ipd", ContextKey: "cluster=foo"},
+	})
+
+	specs := make(chan *Spec, 10)
+	c := New(client, "default", "isopod", time.Hour, func(_ context.Context, spec *Spec) error {
+		specs <- spec
+		return nil
+	})
+	go c.Run(ctx)
+
+	select {
+	case spec := <-specs:
+		if got := spec.Context["cluster"]; got != "foo" {
+			t.Fatalf("Expected initial reconcile of cluster `foo', got `%s'", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Controller did not reconcile initial spec")
+	}
+
+	// Keep updating until the watch picks up the change since there is no
+	// way to tell when the watch has been established.
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("Controller did not reconcile changed spec")
+		}
+		cm, err := client.CoreV1().ConfigMaps("default").Get(ctx, "isopod", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm.Data[ContextKey] = "cluster=bar"
+		cm.ResourceVersion = ""
+		if _, err := client.CoreV1().ConfigMaps("default").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case spec := <-specs:
+			if got := spec.Context["cluster"]; got != "bar" {
+				t.Fatalf("Expected reconcile of cluster `bar', got `%s'", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Clean removes dependency checkouts in Workspace not used for olderThan,
+// except for those in keep (local dirs of dependencies, e.g of the current
+// workspace). Checkouts of the layout before content-based deduplication
+// (<name>/<commit>) and leftovers of interrupted fetches are removed too.
+// It returns removed paths.
+func Clean(olderThan time.Duration, keep []string) ([]string, error) {
+	kept := map[string]bool{}
+	for _, k := range keep {
+		kept[filepath.Clean(k)] = true
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	entries, err := ioutil.ReadDir(Workspace)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		// Both layouts have checkouts in subdirectories.
+		parent := filepath.Join(Workspace, e.Name())
+		checkouts, err := ioutil.ReadDir(parent)
+		if err != nil {
+			return removed, err
+		}
+		left := len(checkouts)
+		for _, c := range checkouts {
+			p := filepath.Join(parent, c.Name())
+			if kept[p] || !c.ModTime().Before(cutoff) {
+				continue
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return removed, err
+			}
+			removed = append(removed, p)
+			left--
+		}
+		if left == 0 && e.Name() != checkoutsDir {
+			if err := os.Remove(parent); err != nil {
+				return removed, err
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
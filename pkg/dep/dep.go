@@ -17,6 +17,7 @@ package dep
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"go.starlark.net/starlark"
@@ -35,7 +36,7 @@ var (
 	_ starlark.HasAttrs = (*AbstractDependency)(nil)
 
 	// Workspace is the directory that stages all Isopod-managed remote modules.
-	Workspace = "/tmp/isopod-workspace"
+	Workspace = filepath.Join(os.TempDir(), "isopod-workspace")
 )
 
 // AbstractDependency contains the common impl of all loader.Dependency.
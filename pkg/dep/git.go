@@ -17,15 +17,17 @@ package dep
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"text/template"
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
 
 	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 const (
@@ -35,6 +37,9 @@ const (
 	RemoteKey = "remote"
 	// CommitKey is the full commit SHA of the source to download.
 	CommitKey = "commit"
+
+	// checkoutsDir is the directory in Workspace checkouts are stored in.
+	checkoutsDir = "commits"
 )
 
 var (
@@ -83,23 +88,41 @@ func (g *GitRepo) Version() string {
 	return g.commit
 }
 
-// LocalDir returns the path to the directory storing the source.
+// LocalDir returns the path to the directory storing the source. Checkouts
+// are keyed by commit SHA (i.e by content) so that all repos at the same
+// commit (e.g forks or the same repo under different names) share one.
 func (g *GitRepo) LocalDir() string {
-	return filepath.Join(Workspace, g.name, g.commit)
+	return filepath.Join(Workspace, checkoutsDir, g.commit)
 }
 
 // Fetch is part of the Dependency interface.
-// It downloads the source of this dependency.
+// It downloads the source of this dependency. Source is fetched into a
+// temporary directory renamed to LocalDir once checked out so that failed
+// fetches are retried by following runs.
 func (g *GitRepo) Fetch() error {
-	script, err := gitCloneShellScript(&GitCloneParams{
-		OutputDir:    g.LocalDir(),
-		GitRemoteURL: g.remote,
-		GitCommitSHA: g.commit,
-	})
+	dir := g.LocalDir()
+	if _, err := os.Stat(dir); err == nil {
+		// dir already exists, meaning dependency version unchanged.
+		util.Touch(dir)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("failed to create workspace of git repo `%v': %v", g.name, err)
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), g.commit+".tmp")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create workspace of git repo `%v': %v", g.name, err)
 	}
-	if _, err := Shellf(script); err != nil {
+	defer os.RemoveAll(tmp)
+
+	if err := gitClone(tmp, g.remote, g.commit); err != nil {
+		return fmt.Errorf("failed to clone git repo `%v': %v", g.name, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another repo at the same commit may have been fetched meanwhile.
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return nil
+		}
 		return fmt.Errorf("failed to clone git repo `%v': %v", g.name, err)
 	}
 	return nil
@@ -129,49 +152,45 @@ func stringFromValue(v starlark.Value) (string, error) {
 	return string(s), nil
 }
 
-// Shellf execute the given shell command and wait until it finishes. Then
-// return the combined stdout and stderr, and error if any.
-func Shellf(format string, a ...interface{}) (string, error) {
-	s := fmt.Sprintf(format, a...)
-	log.V(1).Infof("Executing shell command: %v\n", s)
-	bytes, err := exec.Command("sh", "-c", s).CombinedOutput()
-	log.V(1).Infof("Shell command `%s' finished:\n%s", s, string(bytes))
-	return string(bytes), err
-}
-
-// GitCloneParams is used to templatize git clone command.
-type GitCloneParams struct {
-	OutputDir, GitRemoteURL, GitCommitSHA string
+// gitClone checks out commit of remote into empty dir.
+func gitClone(dir, remote, commit string) error {
+	if _, err := Git(dir, "init"); err != nil {
+		return err
+	}
+	if _, err := Git(dir, "remote", "add", "origin", remote); err != nil {
+		return err
+	}
+	// Try to fetch just the specified commit first, which only works if there is a ref
+	// pointing at this commit. This is true for commits that were just pushed.
+	// Otherwise, fetch the entire repo history, which supports checking out arbituary commits.
+	if _, err := Git(dir, "fetch", "origin", commit); err == nil {
+		if _, err := Git(dir, "reset", "--hard", "FETCH_HEAD"); err == nil {
+			return nil
+		}
+	}
+	if _, err := Git(dir, "fetch", "origin"); err != nil {
+		return err
+	}
+	_, err := Git(dir, "checkout", commit)
+	return err
 }
 
-// gitCloneBashScript composes a shell script to clone a repo at a given commit sha.
-func gitCloneShellScript(params *GitCloneParams) (string, error) {
-	script := `
-set -e
-if [ -d "{{.OutputDir}}" ]; then
-  # {{.OutputDir}} already exists, meaning dependency version unchanged.
-  exit 0
-fi
-
-mkdir -p "{{.OutputDir}}"
-cd "{{.OutputDir}}"
-
-git init
-git remote add origin "{{.GitRemoteURL}}"
-
-# Try to fetch just the specified commit first, which only works if there is a ref
-# pointing at this commit. This is true for commits that were just pushed.
-# Otherwise, fetch the entire repo history, which supports checking out arbituary commits.
-(git fetch origin "{{.GitCommitSHA}}" && git reset --hard FETCH_HEAD) || \
-(git fetch origin && git checkout "{{.GitCommitSHA}}")
-`
-	tpl, err := template.New("script").Parse(script)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse git-clone shell script template: %v", err)
+// Git runs git with args in dir and waits until it finishes. Then returns the
+// combined stdout and stderr, and error if any. git is run directly (rather
+// than through a shell) so that it works the same on all platforms. The git
+// command is used rather than a Go implementation of git (none is vendored)
+// so that fetches use the credential helpers and SSH config of the user.
+func Git(dir string, args ...string) (string, error) {
+	log.V(1).Infof("Executing git %s in `%s'", strings.Join(args, " "), dir)
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", fmt.Errorf("git %s: the git command must be installed and in PATH: %v", strings.Join(args, " "), err)
 	}
-	var sb strings.Builder
-	if err = tpl.Execute(&sb, params); err != nil {
-		return "", fmt.Errorf("failed to render git-clone shell script template: %v", err)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	bytes, err := cmd.CombinedOutput()
+	log.V(1).Infof("git %s finished:\n%s", strings.Join(args, " "), string(bytes))
+	if err != nil {
+		return string(bytes), fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(bytes)))
 	}
-	return sb.String(), nil
+	return string(bytes), nil
 }
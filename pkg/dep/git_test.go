@@ -0,0 +1,151 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dep
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGitRepoFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	defer func(w string) { Workspace = w }(Workspace)
+	Workspace = t.TempDir()
+
+	remote := t.TempDir()
+	for _, args := range [][]string{
+		{"init"},
+		{"-c", "user.name=isopod", "-c", "user.email=isopod@example.com", "commit", "--allow-empty", "-m", "first"},
+	} {
+		if _, err := Git(remote, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(remote, "lib.ipd"), []byte("x = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", "lib.ipd"},
+		{"-c", "user.name=isopod", "-c", "user.email=isopod@example.com", "commit", "-m", "second"},
+	} {
+		if _, err := Git(remote, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := Git(remote, "rev-parse", "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := strings.TrimSpace(out)
+
+	g := &GitRepo{name: "lib", remote: remote, commit: commit}
+	if err := g.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(g.LocalDir(), ".git")); err != nil {
+		t.Errorf("Repo not checked out: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(g.LocalDir(), "lib.ipd")); !os.IsNotExist(err) {
+		t.Errorf("Expected lib.ipd to be missing at commit %s, got: %v", commit, err)
+	}
+	// Fetched repos are reused.
+	if err := g.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	// Repos at the same commit share the checkout.
+	fork := &GitRepo{name: "fork", remote: filepath.Join(remote, "missing"), commit: commit}
+	if err := fork.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if fork.LocalDir() != g.LocalDir() {
+		t.Errorf("Expected fork to share checkout %s, got: %s", g.LocalDir(), fork.LocalDir())
+	}
+
+	bad := &GitRepo{name: "bad", remote: filepath.Join(remote, "missing"), commit: strings.Repeat("0", 40)}
+	if err := bad.Fetch(); err == nil {
+		t.Error("Expected fetching missing remote to fail")
+	}
+	if _, err := os.Stat(bad.LocalDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected no workspace left by failed fetch, got: %v", err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	defer func(w string) { Workspace = w }(Workspace)
+	Workspace = t.TempDir()
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, d := range []struct {
+		path string
+		old  bool
+	}{
+		{path: "commits/aaa", old: true},
+		{path: "commits/bbb", old: true},
+		{path: "commits/ccc"},
+		{path: "commits/ddd.tmp123", old: true},
+		{path: "legacy/eee", old: true},
+		{path: "other/fff", old: true},
+		{path: "other/ggg"},
+	} {
+		p := filepath.Join(Workspace, d.path)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if d.old {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := Clean(24*time.Hour, []string{filepath.Join(Workspace, "commits/bbb")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range removed {
+		rel, err := filepath.Rel(Workspace, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{"commits/aaa", "commits/ddd.tmp123", "legacy/eee", "other/fff"}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected removed paths (-want, +got):\n%s", d)
+	}
+	for p, wantExists := range map[string]bool{"commits/bbb": true, "commits/ccc": true, "other/ggg": true, "legacy": false} {
+		if _, err := os.Stat(filepath.Join(Workspace, p)); (err == nil) != wantExists {
+			t.Errorf("Unexpected existence of %s: %v", p, err)
+		}
+	}
+}
+
+func TestGitNotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	_, err := Git(t.TempDir(), "init")
+	if err == nil || !strings.Contains(err.Error(), "git init: the git command must be installed and in PATH") {
+		t.Errorf("Expected error about missing git, got: %v", err)
+	}
+}
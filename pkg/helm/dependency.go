@@ -0,0 +1,450 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/any"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+// ChartCache is the directory charts downloaded from repositories are cached
+// in.
+var ChartCache = filepath.Join(os.TempDir(), "isopod-charts")
+
+const requirementsFile = "requirements.yaml"
+
+// chartfile are the fields of Chart.yaml (apiVersion v2) not loaded by
+// chartutil.
+type chartfile struct {
+	Dependencies []*chartutil.Dependency `json:"dependencies"`
+}
+
+// lockfile is Chart.lock (or requirements.lock) of a chart.
+type lockfile struct {
+	Dependencies []*chartutil.Dependency `json:"dependencies"`
+}
+
+// repoIndex is index.yaml of a chart repository.
+type repoIndex struct {
+	Entries map[string][]*indexEntry `json:"entries"`
+}
+
+type indexEntry struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	URLs    []string `json:"urls"`
+	Digest  string   `json:"digest"`
+}
+
+// resolver resolves dependencies of charts (declared by Chart.yaml or
+// requirements.yaml) that are not vendored in their charts/ directory.
+type resolver struct {
+	client   *http.Client
+	cacheDir string
+
+	mu      sync.Mutex
+	indexes map[string]*repoIndex
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		client:   &http.Client{Timeout: time.Minute},
+		cacheDir: ChartCache,
+		indexes:  map[string]*repoIndex{},
+	}
+}
+
+// resolve adds missing dependencies of chart c loaded from chartPath to its
+// dependencies (recursively). Dependencies are fetched from `file://'
+// repositories relative to chartPath or downloaded from HTTP(S) repositories
+// into the cache. Versions are taken from the lock file if the chart has one.
+func (r *resolver) resolve(c *chart.Chart, chartPath string) error {
+	deps, locked, err := chartDependencies(c, chartPath)
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		if hasDependency(c, dep) {
+			continue
+		}
+		version := dep.Version
+		if v, ok := locked[dep.Name]; ok {
+			version = v
+		}
+		sub, subPath, err := r.fetch(dep, version, chartPath)
+		if err != nil {
+			return fmt.Errorf("dependency `%s': %v", dep.Name, err)
+		}
+		if err := r.resolve(sub, subPath); err != nil {
+			return fmt.Errorf("dependency `%s': %v", dep.Name, err)
+		}
+		c.Dependencies = append(c.Dependencies, sub)
+	}
+	return nil
+}
+
+// chartDependencies returns dependencies of chart c loaded from chartPath and
+// versions pinned by its lock file (by name). Dependencies declared in
+// Chart.yaml are also recorded as requirements.yaml of c (unless it has one)
+// so that their conditions, tags, aliases and imported values are processed
+// when rendering.
+func chartDependencies(c *chart.Chart, chartPath string) ([]*chartutil.Dependency, map[string]string, error) {
+	files, err := chartFiles(chartPath, "Chart.yaml", "Chart.lock")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var deps []*chartutil.Dependency
+	reqs, err := chartutil.LoadRequirements(c)
+	switch {
+	case err == nil:
+		deps = reqs.Dependencies
+	case errors.Is(err, chartutil.ErrRequirementsNotFound):
+		cf := &chartfile{}
+		if err := yaml.Unmarshal(files["Chart.yaml"], cf); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse Chart.yaml: %v", err)
+		}
+		deps = cf.Dependencies
+		if len(deps) > 0 {
+			bs, err := yaml.Marshal(&chartutil.Requirements{Dependencies: deps})
+			if err != nil {
+				return nil, nil, err
+			}
+			c.Files = append(c.Files, &any.Any{TypeUrl: requirementsFile, Value: bs})
+		}
+	default:
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", requirementsFile, err)
+	}
+
+	lock := &lockfile{}
+	l, err := chartutil.LoadRequirementsLock(c)
+	switch {
+	case err == nil:
+		lock.Dependencies = l.Dependencies
+	case !errors.Is(err, chartutil.ErrLockfileNotFound):
+		return nil, nil, fmt.Errorf("failed to parse requirements.lock: %v", err)
+	case len(files["Chart.lock"]) > 0:
+		if err := yaml.Unmarshal(files["Chart.lock"], lock); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse Chart.lock: %v", err)
+		}
+	}
+	locked := map[string]string{}
+	for _, d := range lock.Dependencies {
+		locked[d.Name] = d.Version
+	}
+	return deps, locked, nil
+}
+
+// hasDependency returns true if dep is vendored in c (which chartutil loads
+// from the charts/ directory).
+func hasDependency(c *chart.Chart, dep *chartutil.Dependency) bool {
+	for _, d := range c.Dependencies {
+		if d.Metadata.Name == dep.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns chart dep in version (range) and the path it was loaded
+// from.
+func (r *resolver) fetch(dep *chartutil.Dependency, version, chartPath string) (*chart.Chart, string, error) {
+	repo := dep.Repository
+	switch {
+	case strings.HasPrefix(repo, "file://"):
+		p := strings.TrimPrefix(repo, "file://")
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(chartDir(chartPath), p)
+		}
+		c, err := chartutil.Load(p)
+		return c, p, err
+	case strings.HasPrefix(repo, "http://"), strings.HasPrefix(repo, "https://"):
+	case repo == "":
+		return nil, "", errors.New("not found in charts/ directory and no repository set")
+	default:
+		return nil, "", fmt.Errorf("unsupported repository `%s' (must be a file://, http:// or https:// URL)", repo)
+	}
+
+	// Exact versions are looked up in the cache before fetching the
+	// repository index.
+	if _, err := semver.NewVersion(version); err == nil {
+		p := r.cachePath(repo, dep.Name, version)
+		if c, err := chartutil.Load(p); err == nil {
+			util.Touch(p)
+			return c, p, nil
+		}
+	}
+
+	e, err := r.lookup(repo, dep.Name, version)
+	if err != nil {
+		return nil, "", err
+	}
+	p := r.cachePath(repo, dep.Name, e.Version)
+	if _, err := os.Stat(p); err != nil {
+		if err := r.download(repo, e, p); err != nil {
+			return nil, "", err
+		}
+	} else {
+		util.Touch(p)
+	}
+	c, err := chartutil.Load(p)
+	return c, p, err
+}
+
+// lookup returns the index entry of the latest version of chart name in repo
+// matching version (range).
+func (r *resolver) lookup(repo, name, version string) (*indexEntry, error) {
+	idx, err := r.index(repo)
+	if err != nil {
+		return nil, err
+	}
+	constraint := version
+	if constraint == "" {
+		constraint = "*"
+	}
+	cs, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version `%s': %v", version, err)
+	}
+
+	var latest *indexEntry
+	var latestV *semver.Version
+	for _, e := range idx.Entries[name] {
+		v, err := semver.NewVersion(e.Version)
+		if err != nil || !cs.Check(v) {
+			continue
+		}
+		if latestV == nil || v.GreaterThan(latestV) {
+			latest, latestV = e, v
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no version of chart `%s' matching `%s' found in `%s'", name, constraint, repo)
+	}
+	return latest, nil
+}
+
+// index returns (cached) index of repo.
+func (r *resolver) index(repo string) (*repoIndex, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if idx, ok := r.indexes[repo]; ok {
+		return idx, nil
+	}
+
+	bs, err := r.get(strings.TrimSuffix(repo, "/") + "/index.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch index of `%s': %v", repo, err)
+	}
+	idx := &repoIndex{}
+	if err := yaml.Unmarshal(bs, idx); err != nil {
+		return nil, fmt.Errorf("failed to parse index of `%s': %v", repo, err)
+	}
+	r.indexes[repo] = idx
+	return idx, nil
+}
+
+// download downloads chart archive of e from repo to p verifying its digest
+// (if the index has one).
+func (r *resolver) download(repo string, e *indexEntry, p string) error {
+	if len(e.URLs) == 0 {
+		return fmt.Errorf("no URL of chart `%s' version %s in `%s'", e.Name, e.Version, repo)
+	}
+	base, err := url.Parse(strings.TrimSuffix(repo, "/") + "/")
+	if err != nil {
+		return err
+	}
+	u, err := base.Parse(e.URLs[0])
+	if err != nil {
+		return fmt.Errorf("invalid URL of chart `%s': %v", e.Name, err)
+	}
+
+	log.Infof("Downloading chart `%s' version %s from %s", e.Name, e.Version, u)
+	bs, err := r.get(u.String())
+	if err != nil {
+		return fmt.Errorf("failed to download chart `%s': %v", e.Name, err)
+	}
+	if e.Digest != "" {
+		sum := sha256.Sum256(bs)
+		if got := hex.EncodeToString(sum[:]); got != e.Digest {
+			return fmt.Errorf("digest of chart `%s' version %s is %s (want %s)", e.Name, e.Version, got, e.Digest)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Written atomically so that interrupted downloads aren't cached.
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (r *resolver) get(u string) ([]byte, error) {
+	resp, err := r.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return bs, nil
+}
+
+// cachePath returns path of chart archive of version of name from repo in the
+// cache.
+func (r *resolver) cachePath(repo, name, version string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(repo, "/")))
+	return filepath.Join(r.cacheDir, hex.EncodeToString(sum[:8]), fmt.Sprintf("%s-%s.tgz", name, version))
+}
+
+// CleanCache removes charts in ChartCache not used for olderThan and returns
+// their paths.
+func CleanCache(olderThan time.Duration) ([]string, error) {
+	repos, err := ioutil.ReadDir(ChartCache)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var removed []string
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		dir := filepath.Join(ChartCache, repo.Name())
+		charts, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		left := len(charts)
+		for _, c := range charts {
+			if !c.ModTime().Before(cutoff) {
+				continue
+			}
+			p := filepath.Join(dir, c.Name())
+			if err := os.RemoveAll(p); err != nil {
+				return removed, err
+			}
+			removed = append(removed, p)
+			left--
+		}
+		if left == 0 {
+			if err := os.Remove(dir); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// chartDir returns directory of chart at chartPath (a directory or an
+// archive).
+func chartDir(chartPath string) string {
+	if fi, err := os.Stat(chartPath); err == nil && fi.IsDir() {
+		return chartPath
+	}
+	return filepath.Dir(chartPath)
+}
+
+// chartFiles returns contents of top-level files names of chart at chartPath
+// (a directory or an archive). Missing files are omitted.
+func chartFiles(chartPath string, names ...string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	fi, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		for _, n := range names {
+			bs, err := ioutil.ReadFile(filepath.Join(chartPath, n))
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				return nil, err
+			default:
+				files[n] = bs
+			}
+		}
+		return files, nil
+	}
+
+	f, err := os.Open(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Archives contain a single top-level directory named after the
+		// chart.
+		parts := strings.SplitN(path.Clean(h.Name), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, n := range names {
+			if parts[1] == n {
+				bs, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				files[n] = bs
+			}
+		}
+	}
+}
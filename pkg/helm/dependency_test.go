@@ -0,0 +1,203 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/helm/pkg/chartutil"
+
+	"github.com/cruise-automation/isopod/pkg/loader"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+// renderedNames returns sorted names of objects in data rendered by helm.
+func renderedNames(data *starlark.List) []string {
+	var names []string
+	for i := 0; i < data.Len(); i++ {
+		for _, l := range strings.Split(string(data.Index(i).(starlark.String)), "\n") {
+			if strings.HasPrefix(l, "  name: ") {
+				names = append(names, strings.TrimPrefix(l, "  name: "))
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestHelmDependencies(t *testing.T) {
+	loader.SetWorkspaceRoot(".")
+	defer loader.SetWorkspaceRoot("")
+
+	for _, tc := range []struct {
+		name, expr string
+		want       []string
+	}{
+		{
+			name: "Disabled by condition",
+			expr: `helm.apply(release_name="test", chart="//../../testdata/helm-deps/app")`,
+			want: []string{"test-app", "test-common"},
+		},
+		{
+			name: "Enabled by condition",
+			expr: `helm.apply(release_name="test", chart="//../../testdata/helm-deps/app", values=[{"metrics": {"enabled": True}}])`,
+			want: []string{"test-app", "test-common", "test-metrics"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fc := &FakeDynamicClient{}
+			pkgs := starlark.StringDict{"helm": New(fc, "")}
+			if _, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, renderedNames(fc.data)); d != "" {
+				t.Errorf("Unexpected rendered objects (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestResolveRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub, err := chartutil.Load("../../testdata/helm-deps/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := chartutil.Save(sub, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(bs)
+	digest := hex.EncodeToString(sum[:])
+
+	var requests []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/index.yaml":
+			fmt.Fprintf(w, `apiVersion: v1
+entries:
+  metrics:
+  - name: metrics
+    version: 0.1.0
+    urls: [charts/metrics-0.1.0.tgz]
+  - name: metrics
+    version: 0.2.0
+    urls: [charts/metrics-0.2.0.tgz]
+    digest: %s
+  - name: metrics
+    version: 1.0.0
+    urls: [charts/metrics-1.0.0.tgz]
+`, digest)
+		case "/charts/metrics-0.2.0.tgz":
+			w.Write(bs)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	chartDir := filepath.Join(dir, "app")
+	if err := os.MkdirAll(chartDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chartfile := fmt.Sprintf(`apiVersion: v2
+name: app
+version: 1.0.0
+dependencies:
+- name: metrics
+  version: ^0.1.0
+  repository: %s
+`, s.URL)
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte(chartfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newResolver()
+	r.cacheDir = filepath.Join(dir, "cache")
+	resolve := func() string {
+		c, err := chartutil.Load(chartDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.resolve(c, chartDir); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Dependencies) != 1 {
+			t.Fatalf("Want 1 dependency, got: %v", c.Dependencies)
+		}
+		return c.Dependencies[0].Metadata.Version
+	}
+
+	if got := resolve(); got != "0.2.0" {
+		t.Errorf("Want version 0.2.0, got: %s", got)
+	}
+	want := []string{"/index.yaml", "/charts/metrics-0.2.0.tgz"}
+	if d := cmp.Diff(want, requests); d != "" {
+		t.Errorf("Unexpected requests (-want, +got):\n%s", d)
+	}
+
+	// Locked versions are loaded from the cache.
+	lock := "dependencies:\n- name: metrics\n  version: 0.2.0\n  repository: " + s.URL + "\n"
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.lock"), []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+	requests = nil
+	r.indexes = map[string]*repoIndex{}
+	if got := resolve(); got != "0.2.0" {
+		t.Errorf("Want version 0.2.0, got: %s", got)
+	}
+	if len(requests) != 0 {
+		t.Errorf("Unexpected requests with locked version in cache: %v", requests)
+	}
+
+	// Digest is verified.
+	r.indexes[s.URL] = &repoIndex{Entries: map[string][]*indexEntry{
+		"metrics": {{Name: "metrics", Version: "0.1.5", URLs: []string{"charts/metrics-0.2.0.tgz"}, Digest: "1234"}},
+	}}
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.lock"), []byte(strings.Replace(lock, "0.2.0", "0.1.5", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := chartutil.Load(chartDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErr := fmt.Sprintf("dependency `metrics': digest of chart `metrics' version 0.1.5 is %s (want 1234)", digest)
+	if err := r.resolve(c, chartDir); err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %v", wantErr, err)
+	}
+}
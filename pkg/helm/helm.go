@@ -16,19 +16,24 @@ package helm
 
 import (
 	"fmt"
-	"path/filepath"
+	"strconv"
 	"strings"
 
-	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/Masterminds/semver"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	k8sversion "k8s.io/apimachinery/pkg/version"
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/engine"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/timeconv"
-	"sigs.k8s.io/yaml"
+	"k8s.io/helm/pkg/version"
 
 	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/store"
 )
 
 const yamlSeparator = "---"
@@ -37,19 +42,25 @@ type helmPackage struct {
 	*isopod.Module
 	client  kube.DynamicClient
 	baseDir string
+	deps    *resolver
 }
 
-// New returns a new starlark.HasAttrs object for helm package.
+// New returns a new starlark.HasAttrs object for helm package. Relative chart
+// paths are resolved against directory of the addon (or baseDir outside of
+// addons).
 func New(c kube.DynamicClient, baseDir string) starlark.HasAttrs {
 	h := &helmPackage{
 		client:  c,
 		baseDir: baseDir,
+		deps:    newResolver(),
 	}
 
 	h.Module = &isopod.Module{
 		Name: "helm",
 		Attrs: starlark.StringDict{
-			"apply": starlark.NewBuiltin("helm.apply", h.helmApplyFn),
+			"apply":  starlark.NewBuiltin("helm.apply", h.helmApplyFn),
+			"delete": starlark.NewBuiltin("helm.delete", h.helmDeleteFn),
+			"status": starlark.NewBuiltin("helm.status", h.helmStatusFn),
 		},
 	}
 
@@ -57,32 +68,64 @@ func New(c kube.DynamicClient, baseDir string) starlark.HasAttrs {
 }
 
 func (h *helmPackage) helmApplyFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var name, namespace, chartSource string
+	var name, namespace, chartSource, kubeVersion string
+	var apiVersions *starlark.List
+	order := kube.OrderKind
+	merge, mergeKey := MergePatch, defaultMergeKey
 	values := &starlark.List{}
 	unpacked := []interface{}{
 		"release_name", &name,
 		"chart", &chartSource,
 		"namespace?", &namespace,
 		"values?", &values,
+		"merge?", &merge,
+		"merge_key?", &mergeKey,
+		"order?", &order,
+		"kube_version?", &kubeVersion,
+		"api_versions?", &apiVersions,
 	}
 
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(chartSource, "//") {
-		chartSource = strings.Replace(chartSource, "//", "", 1)
-		chartSource = filepath.Join(h.baseDir, chartSource)
-	} else if !filepath.IsAbs(chartSource) {
-		// TODO(jon.yucel): add remote repository support
-		return nil, fmt.Errorf("%s: remote repositories are not supported yet <%s>", b.Name(), chartSource)
+	if err := kube.CheckOrder(order); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if err := checkMerge(merge); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	// TODO(jon.yucel): add remote repository support
+	baseDir, ok := t.Local(addon.BaseDirKey).(string)
+	if !ok {
+		baseDir = h.baseDir
+	}
+	root, _ := t.Local(addon.WorkspaceRootKey).(string)
+	chartSource, err := loader.ResolveWorkspacePath(root, baseDir, chartSource)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
 
-	resources, err := h.render(name, namespace, chartSource, values)
+	caps, err := h.capabilities(kubeVersion, apiVersions)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
 
-	val, err := h.client.Apply(t, "", namespace, starlark.NewList(resources))
+	resources, err := h.render(name, namespace, chartSource, values, merge, mergeKey, caps)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+
+	data := starlark.NewList(resources)
+	if order == kube.OrderKind {
+		data = kube.SortYAML(data)
+	}
+
+	var val starlark.Value
+	if rc, ok := h.client.(kube.ReleaseClient); ok {
+		val, err = rc.ApplyRelease(t, name, namespace, data)
+	} else {
+		val, err = h.client.Apply(t, "", namespace, data)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
@@ -90,18 +133,130 @@ func (h *helmPackage) helmApplyFn(t *starlark.Thread, b *starlark.Builtin, args
 	return val, nil
 }
 
-func (h *helmPackage) render(name, namespace, chartSource string, values *starlark.List) ([]starlark.Value, error) {
+// releaseClient returns client of b that tracks releases.
+func (h *helmPackage) releaseClient(b *starlark.Builtin) (kube.ReleaseClient, error) {
+	rc, ok := h.client.(kube.ReleaseClient)
+	if !ok {
+		return nil, fmt.Errorf("%s: releases are not tracked by %T", b.Name(), h.client)
+	}
+	return rc, nil
+}
+
+func (h *helmPackage) helmDeleteFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, namespace string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "release_name", &name, "namespace?", &namespace); err != nil {
+		return nil, err
+	}
+	rc, err := h.releaseClient(b)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := rc.DeleteRelease(t, name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return objects(refs), nil
+}
+
+func (h *helmPackage) helmStatusFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, namespace string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "release_name", &name, "namespace?", &namespace); err != nil {
+		return nil, err
+	}
+	rc, err := h.releaseClient(b)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := rc.ReleaseObjects(t, name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return objects(refs), nil
+}
+
+// objects returns list of structs referencing objects of a release.
+func objects(refs []store.ObjRef) *starlark.List {
+	vs := make([]starlark.Value, 0, len(refs))
+	for _, ref := range refs {
+		vs = append(vs, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"api_version": starlark.String(ref.APIVersion),
+			"kind":        starlark.String(ref.Kind),
+			"namespace":   starlark.String(ref.Namespace),
+			"name":        starlark.String(ref.Name),
+		}))
+	}
+	return starlark.NewList(vs)
+}
+
+// capabilities returns .Capabilities of charts discovered from the cluster
+// (Helm's defaults if client can't discover them). Cluster's version and API
+// versions are overridden by kubeVersion and apiVersions if set, so charts
+// can be rendered without a cluster.
+func (h *helmPackage) capabilities(kubeVersion string, apiVersions *starlark.List) (*chartutil.Capabilities, error) {
+	caps := &chartutil.Capabilities{
+		APIVersions:   chartutil.DefaultVersionSet,
+		KubeVersion:   chartutil.DefaultKubeVersion,
+		TillerVersion: version.GetVersionProto(),
+	}
+	if d, ok := h.client.(kube.APIDiscoverer); ok && (kubeVersion == "" || apiVersions == nil) {
+		info, apis, err := d.ServerAPIs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover capabilities: %v", err)
+		}
+		caps.KubeVersion = info
+		caps.APIVersions = chartutil.NewVersionSet(apis...)
+	}
+
+	if kubeVersion != "" {
+		v, err := semver.NewVersion(kubeVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kube_version `%s': %v", kubeVersion, err)
+		}
+		caps.KubeVersion = &k8sversion.Info{
+			Major:      strconv.FormatInt(v.Major(), 10),
+			Minor:      strconv.FormatInt(v.Minor(), 10),
+			GitVersion: "v" + v.String(),
+		}
+	}
+	if apiVersions != nil {
+		apis := make([]string, apiVersions.Len())
+		for i := range apis {
+			s, ok := starlark.AsString(apiVersions.Index(i))
+			if !ok {
+				return nil, fmt.Errorf("api_versions: item %d is not a string (got: %s)", i, apiVersions.Index(i).Type())
+			}
+			apis[i] = s
+		}
+		caps.APIVersions = chartutil.NewVersionSet(apis...)
+	}
+	return caps, nil
+}
+
+func (h *helmPackage) render(name, namespace, chartSource string, values *starlark.List, merge, mergeKey string, caps *chartutil.Capabilities) ([]starlark.Value, error) {
 	chrt, err := chartutil.Load(chartSource)
 	if err != nil {
 		return nil, err
 	}
+	if err := h.deps.resolve(chrt, chartSource); err != nil {
+		return nil, fmt.Errorf("failed to resolve dependencies: %v", err)
+	}
 
-	merged, err := mergeValues(values)
+	merged, err := mergeValues(values, merge, mergeKey)
 	if err != nil {
 		return nil, err
 	}
 
 	config := &chart.Config{Raw: string(merged), Values: map[string]*chart.Value{}}
+	// Drops dependencies disabled by conditions or tags and imports
+	// values of the others.
+	if err := chartutil.ProcessRequirementsEnabled(chrt, config); err != nil {
+		return nil, err
+	}
+	if err := chartutil.ProcessRequirementsImportValues(chrt); err != nil {
+		return nil, err
+	}
 
 	options := chartutil.ReleaseOptions{
 		Name:      name,
@@ -109,7 +264,7 @@ func (h *helmPackage) render(name, namespace, chartSource string, values *starla
 		Namespace: namespace,
 	}
 
-	vals, err := chartutil.ToRenderValuesCaps(chrt, config, options, nil)
+	vals, err := chartutil.ToRenderValuesCaps(chrt, config, options, caps)
 	if err != nil {
 		return nil, err
 	}
@@ -137,28 +292,3 @@ func (h *helmPackage) render(name, namespace, chartSource string, values *starla
 
 	return l, nil
 }
-
-func mergeValues(values *starlark.List) ([]byte, error) {
-	var merged []byte
-	if values.Len() == 0 {
-		return merged, nil
-	}
-
-	merged, err := yaml.YAMLToJSON([]byte(values.Index(0).String()))
-	if err != nil {
-		return nil, err
-	}
-
-	for i := 1; i < values.Len(); i++ {
-		res, err := yaml.YAMLToJSON([]byte(values.Index(i).String()))
-		if err != nil {
-			return nil, err
-		}
-
-		merged, err = jsonpatch.MergePatch(merged, res)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return merged, nil
-}
@@ -21,7 +21,11 @@ import (
 	"testing"
 
 	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/version"
 
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
 	util "github.com/cruise-automation/isopod/pkg/testing"
 )
 
@@ -59,6 +63,9 @@ func TestHelmPackage(t *testing.T) {
 			"traceSampling": 75,
 		},
     }`
+	loader.SetWorkspaceRoot(".")
+	defer loader.SetWorkspaceRoot("")
+
 	for _, tc := range []struct {
 		name         string
 		expr         string
@@ -72,15 +79,25 @@ func TestHelmPackage(t *testing.T) {
 			wantErr: errors.New("helm.apply: missing argument for chart"),
 		},
 		{
-			name:    "Unsupported remote chart",
+			name:    "Missing relative chart",
 			expr:    `helm.apply(release_name="helm-test", chart="istio")`,
-			wantErr: errors.New("helm.apply: remote repositories are not supported yet"),
+			wantErr: errors.New("helm.apply: stat istio: no such file or directory"),
 		},
 		{
 			name:    "Invalid chart source",
 			expr:    `helm.apply(release_name="helm-test", chart="//testdata/istio/helm-test")`,
 			wantErr: errors.New("helm.apply: stat testdata/istio/helm-test: no such file or directory"),
 		},
+		{
+			name:    "Unsupported order",
+			expr:    `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", order="random")`,
+			wantErr: errors.New("helm.apply: unsupported order `random' (must be one of: kind, manifest)"),
+		},
+		{
+			name:    "Unsupported merge",
+			expr:    `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", merge="strategic")`,
+			wantErr: errors.New("helm.apply: unsupported merge strategy `strategic' (must be one of: patch, deep, append, key)"),
+		},
 		{
 			name:    "Missing required value",
 			expr:    `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test")`,
@@ -97,6 +114,28 @@ func TestHelmPackage(t *testing.T) {
 				},
 			),
 		},
+		{
+			name:    "Relative chart path",
+			expr:    `helm.apply(release_name="helm-test", chart="../../testdata/istio/helm-test", namespace="istio-system", values=[` + globalValues + `, ` + values + `, ` + overlayValues + `])`,
+			wantErr: nil,
+			wantRendered: starlark.NewList(
+				[]starlark.Value{
+					starlark.String(expectedDeployment),
+					starlark.String(expectedMesh),
+				},
+			),
+		},
+		{
+			name:    "Success in manifest order",
+			expr:    `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", order="manifest", values=[` + globalValues + `, ` + values + `, ` + overlayValues + `])`,
+			wantErr: nil,
+			wantRendered: starlark.NewList(
+				[]starlark.Value{
+					starlark.String(expectedDeployment),
+					starlark.String(expectedMesh),
+				},
+			),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			if tc.skip {
@@ -177,3 +216,147 @@ spec:
   - mtls:
       mode: PERMISSIVE`
 )
+
+func TestHelmRelease(t *testing.T) {
+	loader.SetWorkspaceRoot(".")
+	defer loader.SetWorkspaceRoot("")
+
+	k, closeFn, err := kube.NewFake(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	pkgs := starlark.StringDict{"helm": New(k.(kube.DynamicClient), "")}
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, ns := range []string{"default", "other"} {
+		apply := `helm.apply(release_name="test", chart="//../../testdata/helm-deps/app", namespace="` + ns + `", values=[{"metrics": {"enabled": True}}])`
+		if _, _, err := util.Eval("apply", apply, sCtx, pkgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, expr, want, wantErr string
+	}{
+		{
+			name: "Status",
+			expr: `[o.kind + " " + o.namespace + "/" + o.name for o in helm.status(release_name="test")]`,
+			want: `["ConfigMap default/test-app", "ConfigMap default/test-common", "Service default/test-metrics"]`,
+		},
+		{
+			name: "Status in other namespace",
+			expr: `[o.kind + " " + o.namespace + "/" + o.name for o in helm.status(release_name="test", namespace="other")]`,
+			want: `["ConfigMap other/test-app", "ConfigMap other/test-common", "Service other/test-metrics"]`,
+		},
+		{
+			name: "Status in namespace without release",
+			expr: `helm.status(release_name="test", namespace="unknown")`,
+			want: `[]`,
+		},
+		{
+			name: "Status of unknown release",
+			expr: `helm.status(release_name="unknown")`,
+			want: `[]`,
+		},
+		{
+			name:    "Invalid release name",
+			expr:    `helm.status(release_name="not valid")`,
+			wantErr: "helm.status: invalid release name `not valid'",
+		},
+		{
+			name: "Delete in reverse order",
+			expr: `[o.kind + " " + o.namespace + "/" + o.name for o in helm.delete(release_name="test")]`,
+			want: `["Service default/test-metrics", "ConfigMap default/test-common", "ConfigMap default/test-app"]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error starting with: %s\nGot: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := v.String(); got != tc.want {
+				t.Errorf("Want: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// fakeDiscoveryClient is a FakeDynamicClient that discovers a v1.21 cluster.
+type fakeDiscoveryClient struct {
+	FakeDynamicClient
+}
+
+func (*fakeDiscoveryClient) ServerAPIs() (*version.Info, []string, error) {
+	info := &version.Info{Major: "1", Minor: "21", GitVersion: "v1.21.3"}
+	return info, []string{"v1", "policy/v1", "policy/v1/PodDisruptionBudget"}, nil
+}
+
+func TestHelmCapabilities(t *testing.T) {
+	loader.SetWorkspaceRoot(".")
+	defer loader.SetWorkspaceRoot("")
+
+	for _, tc := range []struct {
+		name, expr string
+		discovery  bool
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "Defaults",
+			expr: `helm.apply(release_name="test", chart="//../../testdata/helm-caps")`,
+			want: "kubeVersion: v1.9.0\n  pdb: policy/v1beta1",
+		},
+		{
+			name:      "Discovered",
+			expr:      `helm.apply(release_name="test", chart="//../../testdata/helm-caps")`,
+			discovery: true,
+			want:      "kubeVersion: v1.21.3\n  pdb: policy/v1",
+		},
+		{
+			name:      "Overridden",
+			expr:      `helm.apply(release_name="test", chart="//../../testdata/helm-caps", kube_version="1.20.5", api_versions=["v1", "policy/v1beta1"])`,
+			discovery: true,
+			want:      "kubeVersion: v1.20.5\n  pdb: policy/v1beta1",
+		},
+		{
+			name:      "Overridden version",
+			expr:      `helm.apply(release_name="test", chart="//../../testdata/helm-caps", kube_version="v1.22.0")`,
+			discovery: true,
+			want:      "kubeVersion: v1.22.0\n  pdb: policy/v1",
+		},
+		{
+			name:    "Invalid version",
+			expr:    `helm.apply(release_name="test", chart="//../../testdata/helm-caps", kube_version="latest")`,
+			wantErr: "helm.apply: invalid kube_version `latest'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fc := &fakeDiscoveryClient{}
+			var c kube.DynamicClient = &fc.FakeDynamicClient
+			if tc.discovery {
+				c = fc
+			}
+			pkgs := starlark.StringDict{"helm": New(c, "")}
+			_, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error starting with: %s\nGot: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(fc.data.Index(0).(starlark.String)); !strings.Contains(got, tc.want) {
+				t.Errorf("Want rendered object containing:\n%s\nGot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/modules"
+)
+
+// Merge strategies of helm.apply values.
+const (
+	// MergePatch merges values as RFC 7386 JSON merge patches: maps are
+	// merged recursively, lists are replaced and null values delete keys.
+	MergePatch = "patch"
+	// MergeDeep merges maps recursively and replaces lists, but keeps null
+	// values so that they remove defaults of the chart.
+	MergeDeep = "deep"
+	// MergeAppend is MergeDeep with lists appended to.
+	MergeAppend = "append"
+	// MergeKey is MergeDeep with items of lists of maps merged by the value
+	// of a key (e.g `name' of extraEnv entries). Other items are appended.
+	MergeKey = "key"
+)
+
+// defaultMergeKey is the key list items are merged by with MergeKey unless
+// set.
+const defaultMergeKey = "name"
+
+// checkMerge returns an error if strategy is not a merge strategy.
+func checkMerge(strategy string) error {
+	switch strategy {
+	case MergePatch, MergeDeep, MergeAppend, MergeKey:
+		return nil
+	}
+	return fmt.Errorf("unsupported merge strategy `%s' (must be one of: %s, %s, %s, %s)", strategy, MergePatch, MergeDeep, MergeAppend, MergeKey)
+}
+
+// mergeValues merges values (dicts or YAML strings) in order with strategy
+// (merging lists by key with MergeKey) into JSON.
+func mergeValues(values *starlark.List, strategy, key string) ([]byte, error) {
+	var merged []byte
+	if values.Len() == 0 {
+		return merged, nil
+	}
+
+	merged, err := valuesJSON(values.Index(0))
+	if err != nil {
+		return nil, err
+	}
+	if strategy == MergePatch {
+		for i := 1; i < values.Len(); i++ {
+			res, err := valuesJSON(values.Index(i))
+			if err != nil {
+				return nil, err
+			}
+
+			merged, err = jsonpatch.MergePatch(merged, res)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return merged, nil
+	}
+
+	var dst interface{}
+	if err := json.Unmarshal(merged, &dst); err != nil {
+		return nil, err
+	}
+	for i := 1; i < values.Len(); i++ {
+		res, err := valuesJSON(values.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		var src interface{}
+		if err := json.Unmarshal(res, &src); err != nil {
+			return nil, err
+		}
+		dst = mergeValue(dst, src, strategy, key)
+	}
+	return json.Marshal(dst)
+}
+
+// valuesJSON converts v (a YAML string or a Starlark value, e.g a dict) to
+// JSON.
+func valuesJSON(v starlark.Value) ([]byte, error) {
+	if s, ok := v.(starlark.String); ok {
+		return yaml.YAMLToJSON([]byte(s))
+	}
+	buf := &bytes.Buffer{}
+	if err := modules.WriteJSON(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeValue returns src merged into dst with strategy.
+func mergeValue(dst, src interface{}, strategy, key string) interface{} {
+	switch src := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			return src
+		}
+		for k, v := range src {
+			if dv, ok := d[k]; ok {
+				d[k] = mergeValue(dv, v, strategy, key)
+			} else {
+				d[k] = v
+			}
+		}
+		return d
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			return src
+		}
+		switch strategy {
+		case MergeAppend:
+			return append(d, src...)
+		case MergeKey:
+			return mergeList(d, src, strategy, key)
+		}
+	}
+	return src
+}
+
+// mergeList merges items of src into items of dst with the same value of key
+// and appends the others.
+func mergeList(dst, src []interface{}, strategy, key string) []interface{} {
+	index := map[interface{}]int{}
+	for i, v := range dst {
+		if m, ok := v.(map[string]interface{}); ok {
+			if k, ok := m[key]; ok && isScalar(k) {
+				index[k] = i
+			}
+		}
+	}
+	for _, v := range src {
+		if m, ok := v.(map[string]interface{}); ok {
+			if k, ok := m[key]; ok && isScalar(k) {
+				if i, ok := index[k]; ok {
+					dst[i] = mergeValue(dst[i], m, strategy, key)
+					continue
+				}
+				index[k] = len(dst)
+			}
+		}
+		dst = append(dst, v)
+	}
+	return dst
+}
+
+// isScalar returns true if JSON value v can be used as a map key.
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+)
+
+func TestMergeValues(t *testing.T) {
+	base := starlark.String(`
+image: app:v1
+resources:
+  limits:
+    cpu: 1
+extraEnv:
+- name: LOG_LEVEL
+  value: info
+- name: PORT
+  value: "8080"
+`)
+
+	for _, tc := range []struct {
+		strategy, key string
+		overlay       string
+		want          string
+	}{
+		{
+			strategy: MergePatch,
+			overlay:  `{"resources": None, "extraEnv": [{"name": "LOG_LEVEL", "value": "debug"}]}`,
+			want:     `{"image": "app:v1", "extraEnv": [{"name": "LOG_LEVEL", "value": "debug"}]}`,
+		},
+		{
+			strategy: MergeDeep,
+			overlay:  `{"resources": None, "extraEnv": [{"name": "LOG_LEVEL", "value": "debug"}]}`,
+			want:     `{"image": "app:v1", "resources": null, "extraEnv": [{"name": "LOG_LEVEL", "value": "debug"}]}`,
+		},
+		{
+			strategy: MergeAppend,
+			overlay:  `{"resources": {"limits": {"memory": "1Gi"}}, "extraEnv": [{"name": "DEBUG", "value": "1"}]}`,
+			want: `{"image": "app:v1", "resources": {"limits": {"cpu": 1, "memory": "1Gi"}}, "extraEnv": [
+				{"name": "LOG_LEVEL", "value": "info"}, {"name": "PORT", "value": "8080"}, {"name": "DEBUG", "value": "1"}]}`,
+		},
+		{
+			strategy: MergeKey,
+			key:      defaultMergeKey,
+			overlay:  `{"extraEnv": [{"name": "LOG_LEVEL", "value": "debug"}, {"name": "DEBUG", "value": "1"}, "raw"]}`,
+			want: `{"image": "app:v1", "resources": {"limits": {"cpu": 1}}, "extraEnv": [
+				{"name": "LOG_LEVEL", "value": "debug"}, {"name": "PORT", "value": "8080"}, {"name": "DEBUG", "value": "1"}, "raw"]}`,
+		},
+		{
+			strategy: MergeKey,
+			key:      "value",
+			overlay:  `{"extraEnv": [{"name": "VERBOSE", "value": "info"}]}`,
+			want: `{"image": "app:v1", "resources": {"limits": {"cpu": 1}}, "extraEnv": [
+				{"name": "VERBOSE", "value": "info"}, {"name": "PORT", "value": "8080"}]}`,
+		},
+	} {
+		t.Run(tc.strategy+tc.key, func(t *testing.T) {
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.overlay, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := mergeValues(starlark.NewList([]starlark.Value{base, v}), tc.strategy, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotV, wantV interface{}
+			if err := json.Unmarshal(got, &gotV); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &wantV); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(wantV, gotV); d != "" {
+				t.Errorf("Unexpected values (-want +got):\n%s", d)
+			}
+		})
+	}
+}
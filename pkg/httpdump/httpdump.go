@@ -0,0 +1,176 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpdump writes HTTP requests and responses made on behalf of each
+// addon to a separate file for offline debugging.
+package httpdump
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// GlobalFile is the name of the file (without extension) requests made
+// outside of addons (e.g by clusters() or the rollout store) are written to.
+const GlobalFile = "_global"
+
+// credentialHeaders are never written to dumps.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "X-Vault-Token", "Cookie", "Set-Cookie"}
+
+// unsafeChars are replaced in addon names to build file names.
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Dumper writes requests and responses to <dir>/<addon>.log files. It is safe
+// for concurrent use.
+type Dumper struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// New returns a Dumper writing to dir (created if missing).
+func New(dir string) (*Dumper, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dump directory `%s': %v", dir, err)
+	}
+	return &Dumper{dir: dir}, nil
+}
+
+// Transport returns a RoundTripper that dumps requests sent by rt (or
+// http.DefaultTransport if nil) and their responses. It has signature of
+// transport.WrapperFunc so it can be passed to rest.Config.Wrap.
+func (d *Dumper) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &dumpTransport{d: d, rt: rt}
+}
+
+type dumpTransport struct {
+	d  *Dumper
+	rt http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqDump, err := dumpRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	took := time.Since(start).Round(time.Millisecond)
+
+	var respDump []byte
+	if err == nil {
+		if respDump, err = dumpResponse(req, resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	t.d.write(addon.NameFromContext(req.Context()), req, reqDump, respDump, err, took)
+	return resp, err
+}
+
+// streaming returns true if response body of req is streamed (and must not be
+// read before it's returned).
+func streaming(req *http.Request) bool {
+	q := req.URL.Query()
+	return q.Get("watch") == "true" || q.Get("follow") == "true"
+}
+
+// dumpRequest dumps req without credentials leaving its body intact.
+func dumpRequest(req *http.Request) ([]byte, error) {
+	c := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		bs, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(bs))
+		c.Body = ioutil.NopCloser(bytes.NewReader(bs))
+	}
+	for _, h := range credentialHeaders {
+		if c.Header.Get(h) != "" {
+			c.Header.Set(h, redact.Placeholder)
+		}
+	}
+	return httputil.DumpRequestOut(c, true)
+}
+
+// dumpResponse dumps resp without credentials leaving its body intact.
+func dumpResponse(req *http.Request, resp *http.Response) ([]byte, error) {
+	hdr := resp.Header
+	resp.Header = hdr.Clone()
+	for _, h := range credentialHeaders {
+		if resp.Header.Get(h) != "" {
+			resp.Header.Set(h, redact.Placeholder)
+		}
+	}
+	bs, err := httputil.DumpResponse(resp, !streaming(req))
+	resp.Header = hdr
+	return bs, err
+}
+
+// write appends a single exchange to the file of addon.
+func (d *Dumper) write(addon string, req *http.Request, reqDump, respDump []byte, rtErr error, took time.Duration) {
+	name := GlobalFile
+	if addon != "" {
+		name = unsafeChars.ReplaceAllString(addon, "_")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "### #%d %s %s %s\n\n", d.seq, time.Now().Format(time.RFC3339Nano), req.Method, req.URL)
+	buf.Write(reqDump)
+	if rtErr != nil {
+		fmt.Fprintf(buf, "\n\n### #%d error after %v: %v\n\n", d.seq, took, rtErr)
+	} else {
+		fmt.Fprintf(buf, "\n\n### #%d response after %v\n\n", d.seq, took)
+		buf.Write(respDump)
+		if streaming(req) {
+			buf.WriteString("<streamed body not dumped>")
+		}
+	}
+	buf.WriteString("\n\n")
+
+	f, err := os.OpenFile(filepath.Join(d.dir, name+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Warningf("Failed to open HTTP dump file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(redact.String(buf.String())); err != nil {
+		log.Warningf("Failed to write HTTP dump: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdump
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+func TestDumper(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=s3cr3t")
+		w.Write(append([]byte("echo: "), bs...))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "httpdump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := New(filepath.Join(dir, "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: d.Transport(nil)}
+	redact.Add("hunter2")
+
+	for _, tc := range []struct {
+		addon, body string
+	}{
+		{addon: "ingress", body: "password=hunter2"},
+		{addon: "team/dns", body: "foo"},
+		{body: "global"},
+	} {
+		ctx := context.Background()
+		if tc.addon != "" {
+			ctx = addon.ContextWithName(ctx, tc.addon)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/path", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Bodies must still be readable by the caller.
+		if got, want := string(bs), "echo: "+tc.body; got != want {
+			t.Errorf("Unexpected response body: got %q, want %q", got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		file    string
+		want    []string
+		notWant []string
+	}{
+		{
+			file:    "ingress.log",
+			want:    []string{"POST " + s.URL + "/path", "password=<redacted>", "echo: password=<redacted>", "Authorization: <redacted>", "Set-Cookie: <redacted>"},
+			notWant: []string{"hunter2", "Bearer token", "s3cr3t"},
+		},
+		{
+			file: "team_dns.log",
+			want: []string{"\r\n\r\nfoo", "echo: foo"},
+		},
+		{
+			file: GlobalFile + ".log",
+			want: []string{"echo: global"},
+		},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			bs, err := ioutil.ReadFile(filepath.Join(dir, "dump", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(string(bs), w) {
+					t.Errorf("Expected dump to contain %q, got:\n%s", w, bs)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(string(bs), w) {
+					t.Errorf("Expected dump not to contain %q, got:\n%s", w, bs)
+				}
+			}
+		})
+	}
+}
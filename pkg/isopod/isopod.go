@@ -0,0 +1,397 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package isopod is the stable Go API for embedding Isopod in other tools.
+// It runs commands of an entry file on each of its clusters the same way as
+// the isopod binary does (which is built on it) with its default flags, and
+// allows injecting custom built-ins:
+//
+//	err := isopod.Run(ctx, isopod.Install, &isopod.Options{
+//		EntryFile: "main.ipd",
+//		Context:   map[string]string{"env": "dev"},
+//		Builtins:  starlark.StringDict{"cmdb": isopod.NewModule("cmdb", attrs)},
+//	})
+package isopod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	log "github.com/golang/glog"
+	vaultapi "github.com/hashicorp/vault/api"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	ipd "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/cloud/incluster"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/lock"
+	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/store/envelope"
+	kubeStore "github.com/cruise-automation/isopod/pkg/store/kube"
+)
+
+// Command is a command run on addons of each cluster.
+type Command = runtime.Command
+
+// Commands supported by Run.
+const (
+	// Install calls install(ctx) of each addon.
+	Install = runtime.InstallCommand
+	// Remove calls remove(ctx) of each addon.
+	Remove = runtime.RemoveCommand
+	// List lists addons of each cluster.
+	List = runtime.ListCommand
+)
+
+// ErrAddonsFailed is returned (wrapped) by Run if addons failed on some
+// clusters.
+var ErrAddonsFailed = errors.New("addons run failed")
+
+// Module is a Starlark module with named attributes (usually built-in
+// functions), e.g `kube' or `vault'.
+type Module = ipd.Module
+
+// NewModule returns module name with attrs to be passed in Options.Builtins.
+func NewModule(name string, attrs starlark.StringDict) *Module {
+	return &Module{Name: name, Attrs: attrs}
+}
+
+// Options configure Run. Only EntryFile is required.
+type Options struct {
+	// EntryFile is the Starlark file defining clusters(ctx) and addons(ctx).
+	EntryFile string
+	// ExtraEntryFiles are merged with EntryFile (like passing several entry
+	// files to the isopod binary). Each cluster only runs addons of the
+	// entry files that returned it.
+	ExtraEntryFiles []string
+	// Context is passed to clusters(ctx) (like --context).
+	Context map[string]string
+	// DryRun prints diffs instead of mutating clusters (like --dry_run).
+	DryRun bool
+	// ReadOnly makes all packages fail writes (like --read_only).
+	ReadOnly bool
+	// Force deletes and recreates immutable objects (like --force).
+	Force bool
+	// KubeDiff prints diffs of mutations (like --kube_diff).
+	KubeDiff bool
+	// DiffFilters are kpaths of fields excluded from diffs.
+	DiffFilters []string
+	// AddonRegex selects addons to run (like --match_addons). Defaults to
+	// all addons.
+	AddonRegex string
+	// StoreNamespace is the namespace rollouts are recorded and the rollout
+	// lock is taken in (like --namespace, defaults to the service account
+	// namespace for the cluster Isopod runs in and `default' for other
+	// clusters). Clusters setting cloud.DefaultNamespaceField use theirs.
+	StoreNamespace string
+	// NoStore disables recording of rollouts.
+	NoStore bool
+	// StoreKeyWrapper encrypts addon runs recorded in the store (like
+	// --store_encryption_key). Not encrypted if nil.
+	StoreKeyWrapper envelope.KeyWrapper
+	// NoLock disables the rollout lock otherwise taken by Install and
+	// Remove outside of dry run and read-only mode.
+	NoLock bool
+	// LockTimeout is how long to wait for the rollout lock held by another
+	// Isopod (like --lock_timeout). Zero fails immediately.
+	LockTimeout time.Duration
+	// ClusterFacts enables populating addon ctx with cluster facts (like
+	// --cluster_facts).
+	ClusterFacts bool
+	// WorkspaceRoot is the directory `//'-prefixed paths are relative to
+	// (like --rel_path). Defaults to the nearest ancestor of the directory
+	// of EntryFile containing isopod.deps.
+	WorkspaceRoot string
+	// GCPSvcAcctKeyFile and KubeConfigPath are used to authenticate to
+	// `gke()' and `onprem()' clusters respectively.
+	GCPSvcAcctKeyFile, KubeConfigPath string
+	// UserAgent is sent to cloud APIs. Defaults to `Isopod'.
+	UserAgent string
+	// Version is checked against isopod_version() constraints of the entry
+	// file. Not checked if empty.
+	Version string
+	// Vault is the client of the `vault' package. Defaults to a client
+	// configured from the environment ($VAULT_ADDR, $VAULT_TOKEN, etc).
+	Vault *vaultapi.Client
+	// KubeConfig returns config of a cluster returned by clusters(ctx).
+	// Defaults to the credentials of the cluster vendor.
+	KubeConfig func(ctx context.Context, k8sVendor cloud.KubernetesVendor) (*rest.Config, error)
+	// QPS and Burst configure the rate limiter of Kubernetes clients (like
+	// --qps and --burst). client-go defaults are used if zero.
+	QPS   float32
+	Burst int
+	// WrapTransport wraps transports of Kubernetes clients (e.g to dump
+	// requests) if set.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+	// Spin shows the terminal spinner while addons run.
+	Spin bool
+	// Builtins are predeclared in the entry file and all addons in addition
+	// to the Isopod built-ins.
+	Builtins starlark.StringDict
+	// RuntimeOptions are passed to the runtimes of the entry file and of
+	// each cluster. They are applied before vault, kube and helm packages
+	// are initialized so they may configure them.
+	RuntimeOptions []runtime.Option
+	// AddonsOptions are passed to the runtime of each cluster only, after
+	// RuntimeOptions.
+	AddonsOptions []runtime.Option
+}
+
+// Run runs cmd for addons in opts.EntryFile on each cluster returned by the
+// clusters(ctx) Starlark function. Clusters are processed in order and a
+// failure on one cluster doesn't stop the others.
+func Run(ctx context.Context, cmd Command, opts *Options) error {
+	r, err := NewRunner(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return r.RunEach(ctx, func(k8sVendor cloud.KubernetesVendor) error {
+		return r.RunCluster(ctx, cmd, k8sVendor)
+	})
+}
+
+// Runner runs commands on clusters of an entry file one cluster at a time,
+// so that callers may choose the order clusters are rolled out in (Run
+// processes all of them in order).
+type Runner struct {
+	o        Options
+	addonRe  *regexp.Regexp
+	clusters runtime.Runtime
+}
+
+// NewRunner returns Runner for opts with the entry file loaded.
+func NewRunner(ctx context.Context, opts *Options) (*Runner, error) {
+	o := *opts
+	if o.EntryFile == "" {
+		return nil, errors.New("entry file must be set")
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = "Isopod"
+	}
+	if o.WorkspaceRoot == "" {
+		root, err := loader.FindWorkspaceRoot(filepath.Dir(o.EntryFile))
+		if err != nil {
+			return nil, err
+		}
+		o.WorkspaceRoot = root
+	}
+	if o.KubeConfig == nil {
+		o.KubeConfig = func(ctx context.Context, k8sVendor cloud.KubernetesVendor) (*rest.Config, error) {
+			return k8sVendor.KubeConfig(ctx)
+		}
+	}
+	addonRe, err := regexp.Compile(o.AddonRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addon regex `%s': %v", o.AddonRegex, err)
+	}
+	if o.Vault == nil {
+		if o.Vault, err = vaultapi.NewClient(vaultapi.DefaultConfig()); err != nil {
+			return nil, fmt.Errorf("failed to initialize Vault client: %v", err)
+		}
+	}
+
+	files := append([]string{o.EntryFile}, o.ExtraEntryFiles...)
+	clusters, err := runtime.New(o.config(files[0], nil), o.runtimeOptions(files)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize clusters runtime: %v", err)
+	}
+	if err := clusters.Load(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load clusters runtime: %w", err)
+	}
+	return &Runner{o: o, addonRe: addonRe, clusters: clusters}, nil
+}
+
+// Clusters returns clusters returned by clusters(ctx).
+func (r *Runner) Clusters(ctx context.Context) ([]cloud.KubernetesVendor, error) {
+	return r.clusters.Clusters(ctx, r.o.Context)
+}
+
+// ForEachCluster calls fn with each cluster returned by clusters(ctx) (see
+// runtime.Runtime.ForEachCluster).
+func (r *Runner) ForEachCluster(ctx context.Context, fn func(cloud.KubernetesVendor) error) error {
+	return r.clusters.ForEachCluster(ctx, r.o.Context, fn)
+}
+
+// RunEach calls run (e.g wrapping RunCluster) with each cluster returned by
+// clusters(ctx) like ForEachCluster. Fails with error wrapping
+// ErrAddonsFailed if run failed on any cluster.
+func (r *Runner) RunEach(ctx context.Context, run func(cloud.KubernetesVendor) error) error {
+	err := r.ForEachCluster(ctx, run)
+	var errs runtime.ClusterErrors
+	if errors.As(err, &errs) {
+		return fmt.Errorf("%w on %d clusters:\n%v", ErrAddonsFailed, len(errs), errs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to iterate through clusters: %v", err)
+	}
+	return nil
+}
+
+func (o *Options) config(entryFile string, st store.Store) *runtime.Config {
+	return &runtime.Config{
+		EntryFile:         entryFile,
+		GCPSvcAcctKeyFile: o.GCPSvcAcctKeyFile,
+		UserAgent:         o.UserAgent,
+		Version:           o.Version,
+		KubeConfigPath:    o.KubeConfigPath,
+		Store:             st,
+		DryRun:            o.DryRun,
+		Force:             o.Force,
+	}
+}
+
+// runtimeOptions returns options shared by the runtimes of entry files.
+func (o *Options) runtimeOptions(files []string) []runtime.Option {
+	opts := []runtime.Option{runtime.WithWorkspaceRoot(o.WorkspaceRoot)}
+	for name, v := range o.Builtins {
+		opts = append(opts, runtime.WithPredeclared(name, v))
+	}
+	opts = append(opts, o.RuntimeOptions...)
+	if o.ReadOnly {
+		opts = append(opts, runtime.WithReadOnly())
+	}
+	if len(files) > 1 {
+		opts = append(opts, runtime.WithExtraEntryFiles(files[1:]...))
+	}
+	return opts
+}
+
+// RunCluster runs cmd for addons on the cluster of k8sVendor. Install and
+// Remove hold the rollout lock of the cluster while addons run (unless
+// disabled) and fail with error wrapping lock.ErrHeld if it is lost.
+func (r *Runner) RunCluster(ctx context.Context, cmd Command, k8sVendor cloud.KubernetesVendor) (err error) {
+	o := &r.o
+	kubeC, err := o.KubeConfig(ctx, k8sVendor)
+	if err != nil {
+		return fmt.Errorf("failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+	}
+	if o.QPS != 0 {
+		kubeC.QPS = o.QPS
+	}
+	if o.Burst != 0 {
+		kubeC.Burst = o.Burst
+	}
+
+	defaultNs, err := cloud.DefaultNamespaceOf(k8sVendor)
+	if err != nil {
+		return err
+	}
+	// Isopod metadata (rollout store and lock) is kept in the default
+	// namespace of the cluster if set.
+	ns := o.StoreNamespace
+	if defaultNs != "" {
+		ns = defaultNs
+	} else if ns == "" {
+		ns = incluster.NamespaceOf(k8sVendor)
+	}
+
+	// Addons mutate the cluster as the service account (if set) while the
+	// rollout store and lock are written with the operator's credentials.
+	addonsC := kubeC
+	sa, err := cloud.ServiceAccountOf(k8sVendor, ns)
+	if err != nil {
+		return err
+	}
+	if sa != nil {
+		if addonsC, err = sa.Config(ctx, kubeC); err != nil {
+			return err
+		}
+		log.Infof("Running addons as service account `%s'", sa)
+	}
+	if o.WrapTransport != nil {
+		kubeC.Wrap(o.WrapTransport)
+		if addonsC != kubeC {
+			addonsC.Wrap(o.WrapTransport)
+		}
+	}
+	cs, err := kubernetes.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+	}
+
+	if (cmd == Install || cmd == Remove) && !o.DryRun && !o.ReadOnly && !o.NoLock {
+		var release func() error
+		if ctx, release, err = lock.Hold(ctx, cs, ns, o.LockTimeout); err != nil {
+			return err
+		}
+		defer func() {
+			// Failures after losing the lock are caused by it.
+			if lockErr := release(); lockErr != nil {
+				err = lockErr
+			}
+		}()
+	}
+
+	var st store.Store = store.NoopStore{}
+	if !o.NoStore {
+		kst := kubeStore.New(cs, ns)
+		if o.StoreKeyWrapper != nil {
+			kst.SetKeyWrapper(o.StoreKeyWrapper)
+		}
+		st = kst
+	}
+
+	// Only entry files that returned the cluster run their addons on it.
+	files := runtime.EntryFilesOf(k8sVendor)
+	if files == nil {
+		files = append([]string{o.EntryFile}, o.ExtraEntryFiles...)
+	}
+	opts := append(o.runtimeOptions(files), runtime.WithDefaultNamespace(defaultNs))
+	opts = append(opts, o.AddonsOptions...)
+	opts = append(opts,
+		runtime.WithVault(o.Vault),
+		runtime.WithKube(addonsC, o.KubeDiff, o.DiffFilters),
+		runtime.WithHelm(filepath.Dir(files[0])),
+		runtime.WithAddonRegex(r.addonRe),
+	)
+	if !o.Spin {
+		opts = append(opts, runtime.WithNoSpin())
+	}
+	addons, err := runtime.New(o.config(files[0], st), opts...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize addons runtime: %v", err)
+	}
+	if err := addons.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load addons runtime: %w", err)
+	}
+
+	skyCtx := k8sVendor.AddonSkyCtx(o.Context)
+	if o.ClusterFacts {
+		if err := setClusterFacts(ctx, cs, skyCtx); err != nil {
+			return err
+		}
+	}
+	return addons.Run(ctx, cmd, skyCtx)
+}
+
+// setClusterFacts populates skyCtx with facts of the cluster of cs. Failure
+// to discover them only leaves them unset.
+func setClusterFacts(ctx context.Context, cs kubernetes.Interface, skyCtx *addon.SkyCtx) error {
+	facts, err := cloud.DiscoverClusterFacts(ctx, cs)
+	if err != nil {
+		log.Warningf("Failed to discover cluster facts, they are not available in ctx: %v", err)
+		return nil
+	}
+	return facts.SetCtx(skyCtx)
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isopod
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+const entryFile = `
+def clusters(ctx):
+    return [onprem(env=ctx.env, cluster=c) for c in inventory.clusters()]
+
+def addons(ctx):
+    return [addon("recorder", "recorder.ipd", ctx)]
+`
+
+const addonFile = `
+def install(ctx):
+    inventory.record(ctx.env + "/" + ctx.cluster)
+
+def remove(ctx):
+    if ctx.cluster == "b":
+        error("cannot remove")
+`
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"main.ipd": entryFile, "recorder.ipd": addonFile} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	var recorded []string
+	inventory := NewModule("inventory", starlark.StringDict{
+		"clusters": starlark.NewBuiltin("inventory.clusters", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.NewList([]starlark.Value{starlark.String("a"), starlark.String("b")}), nil
+		}),
+		"record": starlark.NewBuiltin("inventory.record", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var s string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+				return nil, err
+			}
+			recorded = append(recorded, s)
+			return starlark.None, nil
+		}),
+	})
+	opts := &Options{
+		EntryFile: filepath.Join(dir, "main.ipd"),
+		Context:   map[string]string{"env": "dev"},
+		DryRun:    true,
+		NoStore:   true,
+		KubeConfig: func(context.Context, cloud.KubernetesVendor) (*rest.Config, error) {
+			return &rest.Config{Host: ts.URL}, nil
+		},
+		Builtins: starlark.StringDict{"inventory": inventory},
+	}
+
+	if err := Run(context.Background(), Install, opts); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+	if d := cmp.Diff([]string{"dev/a", "dev/b"}, recorded); d != "" {
+		t.Errorf("Unexpected clusters installed. (-want +got)\n%s", d)
+	}
+
+	if err := Run(context.Background(), Remove, opts); !errors.Is(err, ErrAddonsFailed) {
+		t.Errorf("Expected remove to fail with %v, got: %v", ErrAddonsFailed, err)
+	}
+}
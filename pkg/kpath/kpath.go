@@ -20,9 +20,10 @@ import (
 )
 
 type kpath struct {
-	Part string // current key part
-	Path string // remaining path
-	More bool   // there is more path to parse
+	Part string   // current key part
+	Path string   // remaining path
+	More bool     // there is more path to parse
+	Sel  *Segment // non-exact selector (wildcard, regex or condition) if set
 }
 
 // Split parses a kpath string into an array of parts.
@@ -60,7 +61,20 @@ func parse(path string) (kpath, error) {
 		if len(path) < 2 {
 			return r, errors.New("unclosed array index in path")
 		}
-		if path[1] == '"' {
+		switch path[1] {
+		case '*', '/', '?':
+			// wildcard, regex or conditional selector
+			end := selectorEnd(path)
+			if end < 0 {
+				return r, errors.New("unclosed selector in path")
+			}
+			sel, err := parseSelector(path[1:end])
+			if err != nil {
+				return r, err
+			}
+			r.Part, r.Sel = path[:end+1], sel
+			i = end + 1
+		case '"':
 			// explicit string map index
 			i = strings.Index(path, "\"]")
 			if i < 0 {
@@ -68,7 +82,7 @@ func parse(path string) (kpath, error) {
 			}
 			r.Part = path[2:i]
 			i += 2
-		} else {
+		default:
 			// array index
 			i = strings.IndexRune(path, ']')
 			if i < 0 {
@@ -90,23 +104,26 @@ func parse(path string) (kpath, error) {
 		return r, nil
 	}
 	// implicit string map index
+	r.Part = path
 	for i := 0; i < len(path); i++ {
 		if path[i] == '.' {
 			// exlude delimiter
 			r.Part = path[:i]
 			r.Path = path[i+1:]
 			r.More = true
-			return r, nil
+			break
 		}
 		if path[i] == '[' {
 			// include delimiter
 			r.Part = path[:i]
 			r.Path = path[i:]
 			r.More = true
-			return r, nil
+			break
 		}
 	}
-	// entire path is the last part
-	r.Part = path
+	// unquoted `*' is a wildcard
+	if r.Part == "*" {
+		r.Sel = &Segment{Any: true}
+	}
 	return r, nil
 }
@@ -19,6 +19,7 @@ import (
 
 	_ "github.com/golang/glog"
 	"github.com/google/go-cmp/cmp"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestParse(t *testing.T) {
@@ -146,3 +147,93 @@ func TestSplit(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSegments(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		key     string
+		value   interface{}
+		want    []bool // whether each segment matches key and value
+		wantErr string
+	}{
+		{
+			path: `spec.containers[*].imagePullPolicy`,
+			key:  "1",
+			want: []bool{false, false, true, false},
+		},
+		{
+			path: `metadata.*`,
+			key:  "labels",
+			want: []bool{false, true},
+		},
+		{
+			path: `metadata["*"]`,
+			key:  "labels",
+			want: []bool{false, false},
+		},
+		{
+			path: `metadata.labels[/pod-template-.*/]`,
+			key:  "pod-template-hash",
+			want: []bool{false, false, true},
+		},
+		{
+			path: `metadata.annotations[?key matches "autoscaling\..*"]`,
+			key:  "autoscaling.alpha.kubernetes.io/conditions",
+			want: []bool{false, false, true},
+		},
+		{
+			path:  `spec.containers[?.name == "sidecar"].image`,
+			key:   "0",
+			value: yaml.MapSlice{{Key: "name", Value: "sidecar"}},
+			want:  []bool{false, false, true, false},
+		},
+		{
+			path:  `data[?value != "a]b"]`,
+			key:   "x",
+			value: "a]b",
+			want:  []bool{false, false},
+		},
+		{
+			path:    `data[?name == "x"]`,
+			wantErr: "invalid condition `?name == \"x\"': unsupported field `name' (must be one of: key, value, .<name>)",
+		},
+		{
+			path:    `data[?key is "x"]`,
+			wantErr: "invalid condition `?key is \"x\"': unsupported operator `is' (must be one of: ==, !=, matches)",
+		},
+		{
+			path:    `data[?key == x]`,
+			wantErr: "invalid condition `?key == x': value must be a quoted string",
+		},
+		{
+			path:    `data[/[a-z/]`,
+			wantErr: "invalid key regexp `/[a-z/': error parsing regexp: missing closing ]: `[a-z)$`",
+		},
+		{
+			path:    `data[?key == "x"`,
+			wantErr: "unclosed selector in path",
+		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			segs, err := Parse(tc.path)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+
+			var got []bool
+			for _, s := range segs {
+				got = append(got, s.Match(tc.key, tc.value))
+			}
+			if !cmp.Equal(tc.want, got) {
+				t.Errorf("Unexpected matches: \nWant: %v\nGot: %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kpath
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Segment is a single parsed part of a kpath that matches map keys or array
+// elements. Exactly one of Key, Any, KeyRegexp or Cond is set.
+type Segment struct {
+	// Key matches a map key or an array index exactly.
+	Key string
+	// Any matches all keys or elements (`*' or `[*]').
+	Any bool
+	// KeyRegexp matches keys (or array indices) by a regular expression
+	// anchored at both ends (`[/regexp/]').
+	KeyRegexp *regexp.Regexp
+	// Cond matches entries satisfying a condition (`[?key matches "re"]').
+	Cond *Cond
+}
+
+// Cond is a condition of a conditional selector.
+// Field is one of `key' (map key or array index), `value' (scalar value) or
+// `.name' (field `name' of a map value, e.g a container in a list).
+// Op is one of `==', `!=' or `matches'.
+type Cond struct {
+	Field string
+	Op    string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// Parse parses a kpath string into an array of segments. In addition to the
+// syntax supported by Split, segments can be wildcards (ex: partA[*].partB or
+// partA.*.partB), regular expressions matching keys (ex: partA[/part.*/]) or
+// conditions (ex: partA[?key matches "part.*"], partA[?.name == "partB"]).
+func Parse(path string) ([]Segment, error) {
+	var s []Segment
+	for {
+		r, err := parse(path)
+		if err != nil {
+			return s, err
+		}
+		if r.Sel != nil {
+			s = append(s, *r.Sel)
+		} else {
+			s = append(s, Segment{Key: r.Part})
+		}
+		path = r.Path
+		if !r.More {
+			break
+		}
+	}
+	return s, nil
+}
+
+// Match returns true if the map entry (or array element) with key and value
+// is selected by the segment.
+func (s *Segment) Match(key string, value interface{}) bool {
+	switch {
+	case s.Any:
+		return true
+	case s.KeyRegexp != nil:
+		return s.KeyRegexp.MatchString(key)
+	case s.Cond != nil:
+		return s.Cond.match(key, value)
+	}
+	return s.Key == key
+}
+
+func (c *Cond) match(key string, value interface{}) bool {
+	var got string
+	switch {
+	case c.Field == "key":
+		got = key
+	case c.Field == "value":
+		v, ok := scalar(value)
+		if !ok {
+			return false
+		}
+		got = v
+	default:
+		v, ok := scalar(child(value, strings.TrimPrefix(c.Field, ".")))
+		if !ok {
+			return false
+		}
+		got = v
+	}
+
+	switch c.Op {
+	case "==":
+		return got == c.Value
+	case "!=":
+		return got != c.Value
+	}
+	return c.re.MatchString(got)
+}
+
+// selectorEnd returns index of `]' closing the selector at the start of path
+// or -1 if it's not closed. Brackets inside regular expressions and quoted
+// strings are skipped.
+func selectorEnd(path string) int {
+	if path[1] == '/' {
+		i := strings.Index(path[2:], "/]")
+		if i < 0 {
+			return -1
+		}
+		return i + 3
+	}
+	quoted := false
+	for i := 1; i < len(path); i++ {
+		switch {
+		case quoted && path[i] == '\\':
+			i++
+		case path[i] == '"':
+			quoted = !quoted
+		case !quoted && path[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseSelector parses selector s (without the enclosing brackets).
+func parseSelector(s string) (*Segment, error) {
+	switch {
+	case s == "*":
+		return &Segment{Any: true}, nil
+	case strings.HasPrefix(s, "/"):
+		re, err := regexp.Compile("^(?:" + strings.TrimSuffix(s[1:], "/") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid key regexp `%s': %v", s, err)
+		}
+		return &Segment{KeyRegexp: re}, nil
+	case strings.HasPrefix(s, "?"):
+		c, err := parseCond(strings.TrimSpace(s[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition `%s': %v", s, err)
+		}
+		return &Segment{Cond: c}, nil
+	}
+	return nil, fmt.Errorf("invalid selector `%s'", s)
+}
+
+func parseCond(s string) (*Cond, error) {
+	fs := strings.SplitN(s, " ", 2)
+	if len(fs) != 2 {
+		return nil, errors.New("expected <field> <op> \"<value>\"")
+	}
+	c := &Cond{Field: fs[0]}
+	if c.Field != "key" && c.Field != "value" && (!strings.HasPrefix(c.Field, ".") || len(c.Field) < 2) {
+		return nil, fmt.Errorf("unsupported field `%s' (must be one of: key, value, .<name>)", c.Field)
+	}
+
+	fs = strings.SplitN(strings.TrimSpace(fs[1]), " ", 2)
+	if len(fs) != 2 {
+		return nil, errors.New("expected <field> <op> \"<value>\"")
+	}
+	c.Op = fs[0]
+	v := strings.TrimSpace(fs[1])
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return nil, errors.New("value must be a quoted string")
+	}
+	// Only quotes are escaped so that regular expressions can be used as is.
+	c.Value = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+
+	switch c.Op {
+	case "==", "!=":
+	case "matches":
+		re, err := regexp.Compile("^(?:" + c.Value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	default:
+		return nil, fmt.Errorf("unsupported operator `%s' (must be one of: ==, !=, matches)", c.Op)
+	}
+	return c, nil
+}
+
+// scalar returns string representation of scalar value v.
+func scalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// child returns field name of map v or nil if v is not a map.
+func child(v interface{}, name string) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for _, item := range v {
+			if k, ok := item.Key.(string); ok && k == name {
+				return item.Value
+			}
+		}
+	case map[string]interface{}:
+		return v[name]
+	case map[interface{}]interface{}:
+		return v[name]
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/discovery"
+
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// apiServiceWaitTimeout is how long puts of APIServices wait for them to
+// become available.
+var apiServiceWaitTimeout = 2 * time.Minute
+
+// apiServiceAvailable is met by APIServices whose API can be served.
+var apiServiceAvailable *condition
+
+func init() {
+	var err error
+	if apiServiceAvailable, err = parseCondition("status.conditions[?type=='Available'].status == 'True'"); err != nil {
+		panic(err)
+	}
+}
+
+type apiServiceWaitCtxKey struct{}
+
+// withAPIServiceWait returns ctx in which put APIServices are waited for per
+// wait argument of a call.
+func withAPIServiceWait(ctx context.Context, wait bool) context.Context {
+	return context.WithValue(ctx, apiServiceWaitCtxKey{}, wait)
+}
+
+// waitAPIService blocks until r (if it's an APIService) is available so that
+// the aggregated API it registers can be discovered (and used) by following
+// calls. Nothing is waited for in dry run as nothing is applied, nor if the
+// call putting r passed `wait=False'.
+func (m *kubePackage) waitAPIService(ctx context.Context, r *apiResource) error {
+	if wait, ok := ctx.Value(apiServiceWaitCtxKey{}).(bool); ok && !wait {
+		return nil
+	}
+	if m.dryRun || m.skipAPIServiceWait || r.GVK.Group != apiregistrationv1.GroupName || r.GVK.Kind != "APIService" || r.Subresource != "" {
+		return nil
+	}
+	log.Infof("Waiting for %v to become available...", r)
+	if _, err := m.kubeGet(ctx, r, apiServiceWaitTimeout, apiServiceAvailable); err != nil {
+		return fmt.Errorf("%v is not available: %v", r, err)
+	}
+	m.invalidateDiscovery()
+	return nil
+}
+
+// invalidateDiscovery drops discovery results cached by the discovery client
+// (if it caches them) so that newly registered APIs are discovered.
+func (m *kubePackage) invalidateDiscovery() {
+	if c, ok := m.dClient.(discovery.CachedDiscoveryInterface); ok {
+		c.Invalidate()
+	}
+}
+
+// kubeWaitAPIFn is an entry point for `kube.wait_api` built-in. Blocks until
+// the cluster serves API group version (e.g one registered by an APIService or
+// a CRD) or timeout expires:
+//
+//	kube.wait_api(group="metrics.k8s.io", version="v1beta1", timeout="2m")
+//
+// Empty group is the core API group. Only checks once in dry run (without
+// failing) as APIs installed by the addon are not applied.
+func (m *kubePackage) kubeWaitAPIFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var group, version string
+	timeout := "2m"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "group", &group, "version", &version, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse duration value: %v", b.Name(), err)
+	}
+	gv := version
+	if group != "" {
+		gv = group + "/" + version
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	deadline := time.After(wait)
+	for {
+		m.invalidateDiscovery()
+		_, err := m.dClient.ServerResourcesForGroupVersion(gv)
+		if err == nil {
+			return starlark.None, nil
+		}
+		if m.dryRun {
+			log.Infof("API `%s' is not available (ignored in dry run): %v", gv, err)
+			return starlark.None, nil
+		}
+		log.V(1).Infof("API `%s' is not available yet: %v", gv, err)
+
+		select {
+		case <-time.After(waitRetryInterval):
+		case <-deadline:
+			return nil, fmt.Errorf("<%v>: API `%s' is not available after %v: %v", b.Name(), gv, wait, err)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const testAPIServiceYaml = `apiVersion: apiregistration.k8s.io/v1
+kind: APIService
+spec:
+  group: metrics.k8s.io
+  version: v1beta1
+`
+
+func TestKubeAPIService(t *testing.T) {
+	defer func(d time.Duration) { apiServiceWaitTimeout = d }(apiServiceWaitTimeout)
+	apiServiceWaitTimeout = 0
+
+	for _, tc := range []struct {
+		name, expr string
+		dryRun     bool
+		wantErr    string
+	}{
+		{
+			name: "APIService available",
+			expr: `kube.put_yaml(name="v1beta1.metrics.k8s.io", data=["""` + testAPIServiceYaml + `status:
+  conditions:
+  - type: Available
+    status: "True"
+"""])`,
+		},
+		{
+			name:    "APIService not available",
+			expr:    `kube.put_yaml(name="v1beta1.metrics.k8s.io", data=["""` + testAPIServiceYaml + `"""])`,
+			wantErr: "<kube.put_yaml>: item 0 (apiservice.apiregistration.k8s.io `v1beta1.metrics.k8s.io'): apiservice.apiregistration.k8s.io/v1 `v1beta1.metrics.k8s.io' is not available: condition `status.conditions[?type=='Available'].status == 'True'' not met",
+		},
+		{
+			name: "APIService not waited for",
+			expr: `kube.put_yaml(name="v1beta1.metrics.k8s.io", data=["""` + testAPIServiceYaml + `"""], wait=False)`,
+		},
+		{
+			name:   "APIService not available in dry run",
+			expr:   `kube.put_yaml(name="v1beta1.metrics.k8s.io", data=["""` + testAPIServiceYaml + `"""])`,
+			dryRun: true,
+		},
+		{
+			name: "API available",
+			expr: `kube.wait_api(group="apps", version="v1")`,
+		},
+		{
+			name: "Core API available",
+			expr: `kube.wait_api(group="", version="v1")`,
+		},
+		{
+			name:    "API not available",
+			expr:    `kube.wait_api(group="metrics.k8s.io", version="v1beta1", timeout="0s")`,
+			wantErr: "<kube.wait_api>: API `metrics.k8s.io/v1beta1' is not available after 0s: GroupVersion \"metrics.k8s.io/v1beta1\" not found",
+		},
+		{
+			name:   "API not available in dry run",
+			expr:   `kube.wait_api(group="metrics.k8s.io", version="v1beta1")`,
+			dryRun: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(&fakeKube{m: map[string][]byte{}})
+			defer s.Close()
+			pkg := newTestPackage(s, nil, Options{
+				DryRun: tc.dryRun,
+			})
+
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			_, _, err := util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg})
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+		})
+	}
+}
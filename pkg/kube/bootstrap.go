@@ -0,0 +1,350 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// Bootstrapper is implemented by kube packages providing the `bootstrap'
+// module.
+type Bootstrapper interface {
+	// Bootstrap returns the `bootstrap' module downloading manifests with c.
+	Bootstrap(c *http.Client) *isopod.Module
+}
+
+var (
+	// crdEstablished is met by CRDs whose resources can be served.
+	crdEstablished *condition
+	// deploymentAvailable is met by Deployments with minimum available
+	// replicas.
+	deploymentAvailable *condition
+	// endpointsReady is met by Endpoints with at least one ready address.
+	endpointsReady *condition
+)
+
+func init() {
+	for c, expr := range map[**condition]string{
+		&crdEstablished:      "status.conditions[?type=='Established'].status == 'True'",
+		&deploymentAvailable: "status.conditions[?type=='Available'].status == 'True'",
+		&endpointsReady:      "subsets[*].addresses[*].ip",
+	} {
+		var err error
+		if *c, err = parseCondition(expr); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// bootstrapPackage implements `bootstrap' module of helpers for the sequence
+// at the top of most operator addons: applying CRDs and waiting for them and
+// the operator (including its admission webhooks) to become ready.
+type bootstrapPackage struct {
+	*kubePackage
+	client *http.Client
+}
+
+// Bootstrap implements Bootstrapper.
+func (m *kubePackage) Bootstrap(c *http.Client) *isopod.Module {
+	p := &bootstrapPackage{kubePackage: m, client: c}
+	return &isopod.Module{
+		Name: "bootstrap",
+		Attrs: starlark.StringDict{
+			"crds_from_url":  starlark.NewBuiltin("bootstrap.crds_from_url", p.crdsFromURLFn),
+			"operator_ready": starlark.NewBuiltin("bootstrap.operator_ready", p.operatorReadyFn),
+		},
+	}
+}
+
+// crdsFromURLFn is entry point for `bootstrap.crds_from_url' callable.
+// Downloads CustomResourceDefinitions (a multi-document YAML file), applies
+// them and waits for them to be established unless wait is False. Returns
+// names of the CRDs:
+//
+//	bootstrap.crds_from_url("https://github.com/jetstack/cert-manager/releases/download/v1.5.3/cert-manager.crds.yaml", timeout="2m")
+//
+// Nothing is waited for in dry run as nothing is applied.
+func (p *bootstrapPackage) crdsFromURLFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var url string
+	wait := true
+	timeout := "2m"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &url, "wait?", &wait, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse duration value: %v", b.Name(), err)
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	data, err := p.download(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	var docs, names []starlark.Value
+	var crds []string
+	for _, doc := range docSeparatorRe.Split(string(data), -1) {
+		if emptyDoc(doc) {
+			continue
+		}
+		obj, gvk, err := decode([]byte(doc))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to decode document %d of `%s': %v", b.Name(), len(docs), url, err)
+		}
+		if gvk.Group != apiextensionsGroup || gvk.Kind != "CustomResourceDefinition" {
+			return nil, fmt.Errorf("<%v>: document %d of `%s' is a %s, not a CustomResourceDefinition", b.Name(), len(docs), url, gvk.Kind)
+		}
+		name, err := meta.NewAccessor().Name(obj)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: document %d of `%s': %v", b.Name(), len(docs), url, err)
+		}
+		docs = append(docs, starlark.String(doc))
+		names = append(names, starlark.String(name))
+		crds = append(crds, name)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("<%v>: no CustomResourceDefinitions in `%s'", b.Name(), url)
+	}
+
+	if _, err := p.Apply(t, "", "", starlark.NewList(docs)); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if wait {
+		deadline := time.Now().Add(d)
+		if err := p.waitCRDs(ctx, crds, deadline); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	return starlark.NewList(names), nil
+}
+
+// operatorReadyFn is entry point for `bootstrap.operator_ready' callable.
+// Waits (up to timeout for all of them) for CRDs to be established, the
+// operator Deployment to become available and services of admission webhook
+// configurations to have ready endpoints so that custom resources can be
+// applied right after:
+//
+//	bootstrap.operator_ready(
+//	    deployment="cert-manager/cert-manager-webhook",
+//	    crds=["certificates.cert-manager.io", "issuers.cert-manager.io"],
+//	    webhooks=["cert-manager-webhook"],
+//	    timeout="5m",
+//	)
+//
+// Nothing is waited for in dry run as nothing is applied.
+func (p *bootstrapPackage) operatorReadyFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var deployment string
+	crdList, webhookList := &starlark.List{}, &starlark.List{}
+	timeout := "5m"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"deployment?", &deployment,
+		"crds?", &crdList,
+		"webhooks?", &webhookList,
+		"timeout?", &timeout,
+	); err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse duration value: %v", b.Name(), err)
+	}
+	crds, err := stringList(crdList)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: `crds' %v", b.Name(), err)
+	}
+	webhooks, err := stringList(webhookList)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: `webhooks' %v", b.Name(), err)
+	}
+	var namespace, name string
+	if deployment != "" {
+		if namespace, name, err = splitNamespaced(deployment); err != nil {
+			return nil, fmt.Errorf("<%v>: `deployment' %v", b.Name(), err)
+		}
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	deadline := time.Now().Add(d)
+	if err := p.waitCRDs(ctx, crds, deadline); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if deployment != "" {
+		if err := p.waitFor(ctx, name, namespace, "apps", "deployments", deploymentAvailable, deadline); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	for _, w := range webhooks {
+		if err := p.waitWebhook(ctx, w, deadline); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	return starlark.None, nil
+}
+
+// download returns body of GET url.
+func (p *bootstrapPackage) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Downloading %s", url)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download `%s': %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download `%s': %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download `%s': %v", url, err)
+	}
+	return data, nil
+}
+
+// waitCRDs blocks until CRDs named names are established or deadline.
+func (p *bootstrapPackage) waitCRDs(ctx context.Context, names []string, deadline time.Time) error {
+	for _, name := range names {
+		if err := p.waitFor(ctx, name, "", apiextensionsGroup, "customresourcedefinitions", crdEstablished, deadline); err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		// Resources of established CRDs must be discovered by following
+		// calls.
+		p.invalidateDiscovery()
+	}
+	return nil
+}
+
+// waitWebhook blocks until all services of admission webhook configurations
+// named name have ready endpoints or deadline.
+func (p *bootstrapPackage) waitWebhook(ctx context.Context, name string, deadline time.Time) error {
+	if p.dryRun {
+		log.Infof("Not waiting for webhook configuration `%s' in dry run", name)
+		return nil
+	}
+	var found bool
+	services := map[string]bool{}
+	for _, resource := range webhookResources {
+		r, err := newResource(p.dClient, name, "", admissionGroup, resource, "")
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to map resource: %v", err)
+		}
+		un, ok, err := p.peekUnstructured(ctx, r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		found = true
+
+		webhooks, _, err := unstructured.NestedSlice(un.Object, "webhooks")
+		if err != nil {
+			return fmt.Errorf("%v: %v", r, err)
+		}
+		for _, w := range webhooks {
+			w, ok := w.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%v: unexpected webhook entry: %v", r, w)
+			}
+			// Webhooks called by URL are not backed by a service.
+			ns, _, _ := unstructured.NestedString(w, "clientConfig", "service", "namespace")
+			svc, _, _ := unstructured.NestedString(w, "clientConfig", "service", "name")
+			if svc != "" {
+				services[ns+"/"+svc] = true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no webhook configuration `%s' found", name)
+	}
+
+	keys := make([]string, 0, len(services))
+	for s := range services {
+		keys = append(keys, s)
+	}
+	sort.Strings(keys)
+	for _, s := range keys {
+		ns, svc, _ := splitNamespaced(s)
+		if err := p.waitFor(ctx, svc, ns, "", "endpoints", endpointsReady, deadline); err != nil {
+			return fmt.Errorf("service of webhook configuration `%s' is not ready: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// waitFor blocks until object name of resource meets until or deadline.
+func (p *bootstrapPackage) waitFor(ctx context.Context, name, namespace, group, resource string, until *condition, deadline time.Time) error {
+	r, err := newResource(p.dClient, name, namespace, group, resource, "")
+	if err != nil {
+		return fmt.Errorf("failed to map resource: %v", err)
+	}
+	if p.dryRun {
+		log.Infof("Not waiting for %v in dry run", r)
+		return nil
+	}
+	log.Infof("Waiting for %v to become ready...", r)
+	// Remaining time of zero still checks once.
+	wait := time.Until(deadline)
+	if wait < 0 {
+		wait = 0
+	}
+	if _, err := p.kubeGet(ctx, r, wait, until); err != nil {
+		return fmt.Errorf("%v is not ready: %v", r, err)
+	}
+	return nil
+}
+
+// stringList returns strings of l.
+func stringList(l *starlark.List) ([]string, error) {
+	ss := make([]string, l.Len())
+	for i := 0; i < l.Len(); i++ {
+		s, ok := l.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("must be a list of strings (got a `%s')", l.Index(i).Type())
+		}
+		ss[i] = string(s)
+	}
+	return ss, nil
+}
+
+// splitNamespaced splits `namespace/name' reference s.
+func splitNamespaced(s string) (string, string, error) {
+	ss := strings.Split(s, "/")
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+		return "", "", fmt.Errorf("must be `namespace/name' (got `%s')", s)
+	}
+	return ss[0], ss[1], nil
+}
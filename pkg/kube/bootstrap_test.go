@@ -0,0 +1,189 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const testCRDYaml = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: certificates.cert-manager.io
+spec:
+  group: cert-manager.io
+  names:
+    kind: Certificate
+    plural: certificates
+  scope: Namespaced
+`
+
+const testEstablished = `status:
+  conditions:
+  - type: Established
+    status: "True"
+`
+
+const testWebhookYaml = `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: cert-manager-webhook
+webhooks:
+- name: webhook.cert-manager.io
+  clientConfig:
+    service:
+      namespace: cert-manager
+      name: cert-manager-webhook
+`
+
+const testDeploymentYaml = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: cert-manager-webhook
+  namespace: cert-manager
+`
+
+func TestBootstrap(t *testing.T) {
+	files := map[string]string{
+		"/established.yaml": "# CRDs\n---\n" + testCRDYaml + testEstablished + "---\n" + strings.Replace(testCRDYaml, "certificates", "issuers", -1) + testEstablished,
+		"/pending.yaml":     testCRDYaml,
+		"/mixed.yaml":       testCRDYaml + "---\n" + testDeploymentYaml,
+	}
+	fs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer fs.Close()
+
+	for _, tc := range []struct {
+		name, expr string
+		dryRun     bool
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "CRDs established",
+			expr: `bootstrap.crds_from_url("` + fs.URL + `/established.yaml")`,
+			want: `["certificates.cert-manager.io", "issuers.cert-manager.io"]`,
+		},
+		{
+			name:    "CRDs not established",
+			expr:    `bootstrap.crds_from_url("` + fs.URL + `/pending.yaml", timeout="0s")`,
+			wantErr: "<bootstrap.crds_from_url>: customresourcedefinition.apiextensions.k8s.io/v1 `certificates.cert-manager.io' is not ready: condition `status.conditions[?type=='Established'].status == 'True'' not met: <nil> is not array or slice and cannot be filtered",
+		},
+		{
+			name: "CRDs not waited for",
+			expr: `bootstrap.crds_from_url("` + fs.URL + `/pending.yaml", wait=False)`,
+			want: `["certificates.cert-manager.io"]`,
+		},
+		{
+			name:   "CRDs not established in dry run",
+			expr:   `bootstrap.crds_from_url("` + fs.URL + `/pending.yaml")`,
+			dryRun: true,
+			want:   `["certificates.cert-manager.io"]`,
+		},
+		{
+			name:    "Not only CRDs",
+			expr:    `bootstrap.crds_from_url("` + fs.URL + `/mixed.yaml")`,
+			wantErr: "<bootstrap.crds_from_url>: document 1 of `" + fs.URL + "/mixed.yaml' is a Deployment, not a CustomResourceDefinition",
+		},
+		{
+			name:    "Not found",
+			expr:    `bootstrap.crds_from_url("` + fs.URL + `/missing.yaml")`,
+			wantErr: "<bootstrap.crds_from_url>: failed to download `" + fs.URL + "/missing.yaml': 404 Not Found",
+		},
+		{
+			name: "Operator ready",
+			expr: `[kube.put_yaml(name="crd", data=["""` + testCRDYaml + testEstablished + `"""]),
+kube.put_yaml(name="webhook", data=["""` + testWebhookYaml + `"""]),
+kube.put_yaml(name="deployment", data=["""` + testDeploymentYaml + `status:
+  conditions:
+  - type: Available
+    status: "True"
+"""]),
+kube.put_yaml(name="endpoints", data=["""apiVersion: v1
+kind: Endpoints
+metadata:
+  name: cert-manager-webhook
+  namespace: cert-manager
+subsets:
+- addresses:
+  - ip: 10.0.0.1
+"""]),
+bootstrap.operator_ready(
+    deployment="cert-manager/cert-manager-webhook",
+    crds=["certificates.cert-manager.io"],
+    webhooks=["cert-manager-webhook"],
+)][-1]`,
+			want: "None",
+		},
+		{
+			name: "Deployment not available",
+			expr: `[kube.put_yaml(name="deployment", data=["""` + testDeploymentYaml + `"""]),
+bootstrap.operator_ready(deployment="cert-manager/cert-manager-webhook", timeout="0s")]`,
+			wantErr: "<bootstrap.operator_ready>: deployment.apps/v1 `cert-manager/cert-manager-webhook' is not ready: condition `status.conditions[?type=='Available'].status == 'True'' not met",
+		},
+		{
+			name: "Webhook service not ready",
+			expr: `[kube.put_yaml(name="webhook", data=["""` + testWebhookYaml + `"""]),
+bootstrap.operator_ready(webhooks=["cert-manager-webhook"], timeout="0s")]`,
+			wantErr: "<bootstrap.operator_ready>: service of webhook configuration `cert-manager-webhook' is not ready: endpoints.v1 `cert-manager/cert-manager-webhook' is not ready: not found",
+		},
+		{
+			name:    "Webhook not found",
+			expr:    `bootstrap.operator_ready(webhooks=["cert-manager-webhook"])`,
+			wantErr: "<bootstrap.operator_ready>: no webhook configuration `cert-manager-webhook' found",
+		},
+		{
+			name:    "Bad deployment",
+			expr:    `bootstrap.operator_ready(deployment="cert-manager-webhook")`,
+			wantErr: "<bootstrap.operator_ready>: `deployment' must be `namespace/name' (got `cert-manager-webhook')",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(&fakeKube{m: map[string][]byte{}})
+			defer s.Close()
+			pkg := newTestPackage(s, nil, Options{
+				DryRun: tc.dryRun,
+			})
+
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			pkgs := starlark.StringDict{"kube": pkg, "bootstrap": pkg.(Bootstrapper).Bootstrap(fs.Client())}
+			got, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err == nil && got.String() != tc.want {
+				t.Errorf("Unexpected result.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	admissionGroup     = "admissionregistration.k8s.io"
+	apiextensionsGroup = "apiextensions.k8s.io"
+
+	defaultCAKey = "ca.crt"
+)
+
+// webhookResources are resources of admission webhook configurations CA
+// bundle is injected into.
+var webhookResources = []string{
+	"validatingwebhookconfigurations",
+	"mutatingwebhookconfigurations",
+}
+
+// kubeInjectCABundleFn is entry point for `kube.inject_ca_bundle' callable.
+// Sets `caBundle' of all webhooks of Validating/MutatingWebhookConfiguration
+// by `webhook' name or of conversion webhook of CustomResourceDefinition by
+// `crd' name to PEM encoded CA read from `key' of `from_secret' Secret or
+// passed in directly via `ca' (e.g read from Vault):
+//
+//	kube.inject_ca_bundle(webhook="cert-manager-webhook", from_secret="cert-manager/webhook-ca")
+//	kube.inject_ca_bundle(crd="certificates.cert-manager.io", ca=vault.read("secret/ca")["crt"])
+func (m *kubePackage) kubeInjectCABundleFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var webhook, crd, fromSecret, ca string
+	key := defaultCAKey
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"webhook?", &webhook,
+		"crd?", &crd,
+		"from_secret?", &fromSecret,
+		"key?", &key,
+		"ca?", &ca,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if (webhook == "") == (crd == "") {
+		return nil, fmt.Errorf("<%v>: exactly one of `webhook' or `crd' must be set", b.Name())
+	}
+	if (fromSecret == "") == (ca == "") {
+		return nil, fmt.Errorf("<%v>: exactly one of `from_secret' or `ca' must be set", b.Name())
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	if fromSecret != "" {
+		var err error
+		if ca, err = m.readSecretKey(ctx, fromSecret, key); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	if blk, _ := pem.Decode([]byte(ca)); blk == nil {
+		return nil, fmt.Errorf("<%v>: CA bundle is not PEM encoded", b.Name())
+	}
+	bundle := base64.StdEncoding.EncodeToString([]byte(ca))
+
+	var err error
+	if webhook != "" {
+		err = m.injectWebhookCABundle(ctx, webhook, bundle)
+	} else {
+		err = m.injectCRDCABundle(ctx, crd, bundle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// readSecretKey returns value of key in Secret referenced by `namespace/name'
+// ref.
+func (m *kubePackage) readSecretKey(ctx context.Context, ref, key string) (string, error) {
+	ss := strings.Split(ref, "/")
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+		return "", fmt.Errorf("secret must be referenced as `namespace/name' (got `%s')", ref)
+	}
+
+	r, err := newResource(m.dClient, ss[1], ss[0], "", "secrets", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to map resource: %v", err)
+	}
+	obj, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("secret `%s' not found", ref)
+	}
+	s, ok := obj.(*corev1.Secret)
+	if !ok {
+		return "", fmt.Errorf("unexpected object for secret `%s': %T", ref, obj)
+	}
+	v, ok := s.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key `%s' not found in secret `%s'", key, ref)
+	}
+	return string(v), nil
+}
+
+// injectWebhookCABundle sets bundle for all webhooks of admission webhook
+// configurations named name.
+func (m *kubePackage) injectWebhookCABundle(ctx context.Context, name, bundle string) error {
+	var injected bool
+	for _, resource := range webhookResources {
+		r, err := newResource(m.dClient, name, "", admissionGroup, resource, "")
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to map resource: %v", err)
+		}
+
+		un, found, err := m.peekUnstructured(ctx, r)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		webhooks, _, err := unstructured.NestedSlice(un.Object, "webhooks")
+		if err != nil {
+			return fmt.Errorf("%v: %v", r, err)
+		}
+		for _, w := range webhooks {
+			w, ok := w.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%v: unexpected webhook entry: %v", r, w)
+			}
+			if err := unstructured.SetNestedField(w, bundle, "clientConfig", "caBundle"); err != nil {
+				return fmt.Errorf("%v: %v", r, err)
+			}
+		}
+		if err := unstructured.SetNestedSlice(un.Object, webhooks, "webhooks"); err != nil {
+			return fmt.Errorf("%v: %v", r, err)
+		}
+
+		if err := m.kubeUpdateYaml(ctx, r, un); err != nil {
+			return err
+		}
+		injected = true
+	}
+	if !injected {
+		return fmt.Errorf("no webhook configuration `%s' found", name)
+	}
+	return nil
+}
+
+// injectCRDCABundle sets bundle for conversion webhook of CRD named name.
+func (m *kubePackage) injectCRDCABundle(ctx context.Context, name, bundle string) error {
+	r, err := newResource(m.dClient, name, "", apiextensionsGroup, "customresourcedefinitions", "")
+	if err != nil {
+		return fmt.Errorf("failed to map resource: %v", err)
+	}
+
+	un, found, err := m.peekUnstructured(ctx, r)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%v not found", r)
+	}
+
+	if s, _, _ := unstructured.NestedString(un.Object, "spec", "conversion", "strategy"); s != "Webhook" {
+		return fmt.Errorf("%v doesn't use conversion webhook", r)
+	}
+	// Client config was moved under `webhook' in v1.
+	path := []string{"spec", "conversion", "webhook", "clientConfig", "caBundle"}
+	if r.GVK.Version == "v1beta1" {
+		path = []string{"spec", "conversion", "webhookClientConfig", "caBundle"}
+	}
+	if err := unstructured.SetNestedField(un.Object, bundle, path...); err != nil {
+		return fmt.Errorf("%v: %v", r, err)
+	}
+
+	return m.kubeUpdateYaml(ctx, r, un)
+}
+
+// peekUnstructured returns live object of r converted to unstructured.
+func (m *kubePackage) peekUnstructured(ctx context.Context, r *apiResource) (*unstructured.Unstructured, bool, error) {
+	live, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+	if err != nil || !found {
+		return nil, found, err
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to convert %v to unstructured: %v", r, err)
+	}
+	un := &unstructured.Unstructured{Object: obj}
+	un.SetGroupVersionKind(r.GVK)
+	return un, true, nil
+}
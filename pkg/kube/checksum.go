@@ -0,0 +1,131 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	kubeChecksumAnnotationMethod = "checksum_annotation"
+
+	// defaultChecksumAnnotation is the annotation key returned by
+	// kube.checksum_annotation unless set.
+	defaultChecksumAnnotation = "checksum/config"
+)
+
+// checksumAnnotationFn is entry point for `kube.checksum_annotation'
+// callable. Returns a dict with a single annotation set to a stable hash of
+// contents of ConfigMaps and Secrets in objs (protos or YAML strings) to be
+// merged into annotations of a pod template so that the workload rolls when
+// its config changes:
+//
+//	cm = corev1.ConfigMap(metadata=metav1.ObjectMeta(name="app"), data={"app.yaml": cfg})
+//	tmpl.metadata.annotations.update(kube.checksum_annotation([cm, secret]))
+//
+// The hash only depends on kinds, names, namespaces and data of objects, not
+// on their order or other metadata.
+func checksumAnnotationFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var objs starlark.Iterable
+	key := defaultChecksumAnnotation
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "objs", &objs, "key?", &key); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	it := objs.Iterate()
+	defer it.Done()
+	var v starlark.Value
+	for i := 0; it.Next(&v); i++ {
+		e, err := checksumEntry(v)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: item %d: %v", b.Name(), i, err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write([]byte(e))
+	}
+	d := starlark.NewDict(1)
+	if err := d.SetKey(starlark.String(key), starlark.String(hex.EncodeToString(h.Sum(nil)))); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// checksumEntry returns a canonical serialization of ConfigMap or Secret v
+// (a proto or YAML string).
+func checksumEntry(v starlark.Value) (string, error) {
+	var obj runtime.Object
+	got := v.Type()
+	if s, ok := v.(starlark.String); ok {
+		o, gvk, err := decode([]byte(s))
+		if err != nil {
+			return "", fmt.Errorf("not a YAML string: %v", err)
+		}
+		obj, got = o, gvk.Kind
+	} else if msg, ok := skycfg.AsProtoMessage(v); ok {
+		obj, _ = msg.(runtime.Object)
+	}
+
+	var kind, namespace, name string
+	data := map[string][]byte{}
+	switch o := obj.(type) {
+	case *corev1.ConfigMap:
+		kind, namespace, name = "ConfigMap", o.Namespace, o.Name
+		for k, v := range o.Data {
+			data[k] = []byte(v)
+		}
+		for k, v := range o.BinaryData {
+			data[k] = v
+		}
+	case *corev1.Secret:
+		kind, namespace, name = "Secret", o.Namespace, o.Name
+		for k, v := range o.Data {
+			data[k] = v
+		}
+		// Same as the API server, string data overrides data.
+		for k, v := range o.StringData {
+			data[k] = []byte(v)
+		}
+	default:
+		return "", fmt.Errorf("want a ConfigMap or Secret (got: %s)", got)
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Lengths are included so that no two different objects serialize the
+	// same.
+	e := fmt.Sprintf("%d:%s%d:%s%d:%s%d:", len(kind), kind, len(namespace), namespace, len(name), name, len(keys))
+	for _, k := range keys {
+		e += fmt.Sprintf("%d:%s%d:%s", len(k), k, len(data[k]), data[k])
+	}
+	return e, nil
+}
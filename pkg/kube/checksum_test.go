@@ -0,0 +1,90 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const testChecksumCMYaml = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: default
+  labels:
+    heritage: isopod
+data:
+  app.yaml: "port: 8080"
+`
+
+func TestChecksumAnnotation(t *testing.T) {
+	pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+	addImports(t, pkgs)
+	pkgs["kube"] = &kubePackage{}
+	pkgs["cm"] = starlark.String(testChecksumCMYaml)
+
+	const (
+		cm       = `corev1.ConfigMap(metadata=metav1.ObjectMeta(name="app", namespace="default"), data={"app.yaml": "port: 8080"})`
+		cmPort   = `corev1.ConfigMap(metadata=metav1.ObjectMeta(name="app", namespace="default"), data={"app.yaml": "port: 9090"})`
+		secret   = `corev1.Secret(metadata=metav1.ObjectMeta(name="app", namespace="default"), data={"token": "s3cr3t"})`
+		secretSD = `corev1.Secret(metadata=metav1.ObjectMeta(name="app", namespace="default"), stringData={"token": "s3cr3t"})`
+	)
+	checksum := func(t *testing.T, expr string) string {
+		v, _, err := util.Eval(t.Name(), expr, nil, pkgs)
+		if err != nil {
+			t.Fatalf("Failed to evaluate `%s': %v", expr, err)
+		}
+		d := v.(*starlark.Dict)
+		if d.Len() != 1 {
+			t.Fatalf("Expected a single annotation, got: %v", d)
+		}
+		kv := d.Items()[0]
+		return string(kv[0].(starlark.String)) + "=" + string(kv[1].(starlark.String))
+	}
+
+	want := checksum(t, `kube.checksum_annotation([`+cm+`, `+secret+`])`)
+	for _, tc := range []struct {
+		name, expr string
+		same       bool
+	}{
+		{name: "Order", expr: `kube.checksum_annotation([` + secret + `, ` + cm + `])`, same: true},
+		{name: "YAML", expr: `kube.checksum_annotation([cm, ` + secret + `])`, same: true},
+		{name: "String data", expr: `kube.checksum_annotation([` + cm + `, ` + secretSD + `])`, same: true},
+		{name: "Data changed", expr: `kube.checksum_annotation([` + cmPort + `, ` + secret + `])`},
+		{name: "Object removed", expr: `kube.checksum_annotation([` + cm + `])`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := checksum(t, tc.expr); (got == want) != tc.same {
+				t.Errorf("Unexpected checksum (same: %v).\nFirst: %s\nGot: %s", tc.same, want, got)
+			}
+		})
+	}
+
+	if got := checksum(t, `kube.checksum_annotation([], key="example.com/config")`); got != "example.com/config=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Unexpected checksum of no objects: %s", got)
+	}
+
+	_, _, err := util.Eval(t.Name(), `kube.checksum_annotation([corev1.ConfigMap(), corev1.Pod()])`, nil, pkgs)
+	wantErr := errors.New("<kube.checksum_annotation>: item 1: want a ConfigMap or Secret (got: k8s.io.api.core.v1.Pod)")
+	if !util.ErrsEqual(err, wantErr) {
+		t.Errorf("Unexpected error.\nWant: %v\nGot: %v", wantErr, err)
+	}
+}
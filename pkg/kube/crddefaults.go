@@ -0,0 +1,143 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// diffObject returns obj of r as it is diffed against live and recorded in
+// plans: with CRD defaults applied (see withCRDDefaults) unless obj is
+// created.
+func (m *kubePackage) diffObject(ctx context.Context, r *apiResource, live, obj runtime.Object) runtime.Object {
+	if live == nil {
+		return obj
+	}
+	return m.withCRDDefaults(ctx, r, obj)
+}
+
+// withCRDDefaults returns a copy of custom resource obj of r with defaults of
+// the structural schema of its CRD applied, as the API server would when
+// obj is applied, so that diffs against live objects don't show defaulted
+// fields as removed. Returns obj if it isn't a custom resource or the schema
+// can't be fetched.
+func (m *kubePackage) withCRDDefaults(ctx context.Context, r *apiResource, obj runtime.Object) runtime.Object {
+	un, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj
+	}
+	s := m.crdSchema(ctx, r)
+	if s == nil {
+		return obj
+	}
+	un = un.DeepCopy()
+	applySchemaDefaults(un.Object, s)
+	return un
+}
+
+// crdSchema returns OpenAPI v3 schema of version of r served by its CRD (nil
+// if r isn't served by a CRD or the schema can't be fetched). Schemas are
+// fetched once per kind; kinds without one are looked up again each time as
+// their CRD may be created later in the run.
+func (m *kubePackage) crdSchema(ctx context.Context, r *apiResource) map[string]interface{} {
+	if Scheme.Recognizes(r.GVK) {
+		// Built-in kinds are never served by CRDs.
+		return nil
+	}
+	m.crdSchemaMu.Lock()
+	defer m.crdSchemaMu.Unlock()
+	if s, ok := m.crdSchemas[r.GVK]; ok {
+		return s
+	}
+	if m.crdSchemas == nil {
+		m.crdSchemas = map[schema.GroupVersionKind]map[string]interface{}{}
+	}
+
+	var s map[string]interface{}
+	name := r.GroupVersionResource().Resource + "." + r.GVK.Group
+	crd, err := newResource(m.dClient, name, "", apiextensionsGroup, "customresourcedefinitions", "")
+	if err == nil {
+		var un *unstructured.Unstructured
+		var found bool
+		un, found, err = m.peekUnstructured(ctx, crd)
+		if found {
+			s = versionSchema(un.Object, r.GVK.Version)
+		}
+	}
+	if err != nil {
+		log.V(1).Infof("Failed to fetch CRD of %v, diffs don't include its defaults: %v", r, err)
+	}
+	if s != nil {
+		m.crdSchemas[r.GVK] = s
+	}
+	return s
+}
+
+// versionSchema returns OpenAPI v3 schema of version in CRD (of v1 or
+// v1beta1 API version, where the schema may be shared by all versions).
+func versionSchema(crd map[string]interface{}, version string) map[string]interface{} {
+	versions, _, _ := unstructured.NestedSlice(crd, "spec", "versions")
+	for _, v := range versions {
+		v, ok := v.(map[string]interface{})
+		if !ok || v["name"] != version {
+			continue
+		}
+		if s, found, _ := unstructured.NestedMap(v, "schema", "openAPIV3Schema"); found {
+			return s
+		}
+	}
+	s, _, _ := unstructured.NestedMap(crd, "spec", "validation", "openAPIV3Schema")
+	return s
+}
+
+// applySchemaDefaults sets missing fields of x that have a default in
+// OpenAPI v3 schema s, recursing into objects, maps and arrays like
+// structural defaulting of the API server.
+func applySchemaDefaults(x interface{}, s map[string]interface{}) {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		for k, p := range props {
+			p, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, found := x[k]; !found && p["default"] != nil {
+				x[k] = runtime.DeepCopyJSONValue(p["default"])
+			}
+		}
+		additional, _ := s["additionalProperties"].(map[string]interface{})
+		for k, v := range x {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				applySchemaDefaults(v, p)
+			} else if additional != nil {
+				applySchemaDefaults(v, additional)
+			}
+		}
+	case []interface{}:
+		items, ok := s["items"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, v := range x {
+			applySchemaDefaults(v, items)
+		}
+	}
+}
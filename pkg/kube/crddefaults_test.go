@@ -0,0 +1,180 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const testWidgetCRDYaml = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              replicas:
+                type: integer
+                default: 1
+              ports:
+                type: array
+                items:
+                  type: object
+                  properties:
+                    protocol:
+                      type: string
+                      default: TCP
+              labels:
+                type: object
+                additionalProperties:
+                  type: object
+                  properties:
+                    managed:
+                      type: boolean
+                      default: true
+`
+
+func TestCRDDefaults(t *testing.T) {
+	const head = `apiVersion: example.com/v1
+kind: Widget
+spec:
+  size: large
+  ports:
+  - port: 80
+  labels:
+    app: {}
+`
+	const live = `apiVersion: example.com/v1
+kind: Widget
+spec:
+  size: large
+  replicas: 1
+  ports:
+  - port: 80
+    protocol: TCP
+  labels:
+    app:
+      managed: true
+`
+
+	for _, tc := range []struct {
+		name     string
+		crd      bool
+		wantDiff bool
+	}{
+		{name: "Defaults applied", crd: true},
+		{name: "CRD not found", wantDiff: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(&fakeKube{m: map[string][]byte{}})
+			defer s.Close()
+			d := fakeDiscovery()
+			registerFakeCRD(d, schema.GroupVersion{Group: "example.com", Version: "v1"}, "Widget", true)
+			newKube := func(dryRun bool, out *bytes.Buffer) starlark.StringDict {
+				return starlark.StringDict{"kube": newTestPackage(s, d, Options{
+					DryRun:  dryRun,
+					DiffOut: out,
+				})}
+			}
+			put := func(dryRun bool, data string) string {
+				out := &bytes.Buffer{}
+				expr := `kube.put_yaml(name="foo", namespace="default", data=["""` + data + `"""])`
+				sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+				if _, _, err := util.Eval(t.Name(), expr, sCtx, newKube(dryRun, out)); err != nil {
+					t.Fatal(err)
+				}
+				return out.String()
+			}
+
+			if tc.crd {
+				put(false, testWidgetCRDYaml)
+			}
+			put(false, live)
+			out := put(true, head)
+			if got := strings.Contains(out, "\n--- live\n"); got != tc.wantDiff {
+				t.Errorf("Unexpected diff (want diff: %v):\n%s", tc.wantDiff, out)
+			}
+		})
+	}
+}
+
+func TestCRDDefaultsAfterMiss(t *testing.T) {
+	s := httptest.NewServer(&fakeKube{m: map[string][]byte{}})
+	defer s.Close()
+	d := fakeDiscovery()
+	registerFakeCRD(d, schema.GroupVersion{Group: "example.com", Version: "v1"}, "Widget", true)
+
+	rec := plan.NewRecorder("main.ipd", nil)
+	rec.BeginCluster("test")
+	out := &bytes.Buffer{}
+	planned := starlark.StringDict{"kube": newTestPackage(s, d, Options{DryRun: true, Recorder: rec, DiffOut: out})}
+	applied := starlark.StringDict{"kube": newTestPackage(s, d, Options{})}
+	put := func(env starlark.StringDict, data string) {
+		out.Reset()
+		expr := `kube.put_yaml(name="foo", namespace="default", data=["""` + data + `"""])`
+		sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+		if _, _, err := util.Eval(t.Name(), expr, sCtx, env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const obj = `apiVersion: example.com/v1
+kind: Widget
+spec:
+  size: large
+`
+
+	put(applied, obj+"  replicas: 1\n")
+	put(planned, obj)
+	if !strings.Contains(out.String(), "\n--- live\n") {
+		t.Errorf("Expected diff without CRD, got:\n%s", out)
+	}
+
+	// CRD created later in the run is used by the same package.
+	put(applied, testWidgetCRDYaml)
+	put(planned, obj)
+	if strings.Contains(out.String(), "\n--- live\n") {
+		t.Errorf("Unexpected diff with CRD:\n%s", out)
+	}
+	muts := rec.Plan().Clusters[0].Mutations
+	got, _, _ := unstructured.NestedInt64(muts[len(muts)-1].Object, "spec", "replicas")
+	if got != 1 {
+		t.Errorf("Expected planned object to be defaulted (spec.replicas: 1), got: %v", muts[len(muts)-1].Object)
+	}
+}
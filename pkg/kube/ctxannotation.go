@@ -0,0 +1,108 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/golang/glog"
+)
+
+// ContextMode is how the addon context is recorded on applied objects.
+type ContextMode string
+
+const (
+	// ContextFull annotates objects with the full context JSON (unless it's
+	// larger than maxContextAnnotationSize).
+	ContextFull ContextMode = "full"
+	// ContextHash annotates objects with a hash of the context only. Full
+	// contexts are kept in the rollout store (see ContextRecorder).
+	ContextHash ContextMode = "hash"
+)
+
+// ctxHashAnnotationKey is the key of the annotation set instead of
+// ctxAnnotationKey to the hash of the context.
+const ctxHashAnnotationKey = "isopod.getcruise.com/context-hash"
+
+// maxContextAnnotationSize is the size of context JSON above which only its
+// hash is annotated even in ContextFull mode. All annotations of an object
+// are limited to 256KiB in total.
+var maxContextAnnotationSize = 64 * 1024
+
+// ParseContextMode parses --context_annotation flag value.
+func ParseContextMode(s string) (ContextMode, error) {
+	switch m := ContextMode(s); m {
+	case ContextFull, ContextHash:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown context annotation mode `%s' (want one of %s, %s)", s, ContextFull, ContextHash)
+}
+
+// ContextRecorder is implemented by kube packages that can annotate objects
+// with a reference to the addon context instead of the context itself.
+type ContextRecorder interface {
+	// SetContextMode sets how contexts are recorded on objects.
+	SetContextMode(mode ContextMode)
+	// TakeContexts returns contexts (JSON) only referenced by hash since
+	// the last call keyed by their hash and forgets them.
+	TakeContexts() map[string]string
+}
+
+// SetContextMode implements ContextRecorder.SetContextMode.
+func (m *kubePackage) SetContextMode(mode ContextMode) {
+	m.ctxMode = mode
+}
+
+// TakeContexts implements ContextRecorder.TakeContexts.
+func (m *kubePackage) TakeContexts() map[string]string {
+	m.ctxMu.Lock()
+	defer m.ctxMu.Unlock()
+	ctxs := m.ctxs
+	m.ctxs = nil
+	return ctxs
+}
+
+// ObjectContext returns the addon context (JSON) an object with annotations
+// was applied with, or only the hash of the context if the context itself is
+// kept in the rollout store (see ContextRecorder).
+func ObjectContext(annotations map[string]string) (ctxJSON, hash string) {
+	return annotations[ctxAnnotationKey], annotations[ctxHashAnnotationKey]
+}
+
+// setCtxAnnotation annotates (in as) an object with context JSON bs or its
+// hash depending on the context mode and size of bs.
+func (m *kubePackage) setCtxAnnotation(as map[string]string, bs []byte) {
+	if m.ctxMode != ContextHash && len(bs) <= maxContextAnnotationSize {
+		as[ctxAnnotationKey] = string(bs)
+		return
+	}
+	if m.ctxMode != ContextHash {
+		log.Warningf("Context is larger than %d bytes, only its hash is annotated", maxContextAnnotationSize)
+	}
+
+	sum := sha256.Sum256(bs)
+	hash := "sha256:" + hex.EncodeToString(sum[:])
+	as[ctxHashAnnotationKey] = hash
+	delete(as, ctxAnnotationKey)
+
+	m.ctxMu.Lock()
+	defer m.ctxMu.Unlock()
+	if m.ctxs == nil {
+		m.ctxs = map[string]string{}
+	}
+	m.ctxs[hash] = string(bs)
+}
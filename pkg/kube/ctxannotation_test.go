@@ -0,0 +1,72 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestSetCtxAnnotation(t *testing.T) {
+	large := strings.Repeat("x", maxContextAnnotationSize)
+	for _, tc := range []struct {
+		name, cluster string
+		mode          ContextMode
+		wantHash      bool
+	}{
+		{name: "Default", cluster: "dev"},
+		{name: "Full", cluster: "dev", mode: ContextFull},
+		{name: "Hash", cluster: "dev", mode: ContextHash, wantHash: true},
+		{name: "Full too large", cluster: large, mode: ContextFull, wantHash: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &kubePackage{}
+			m.SetContextMode(tc.mode)
+			cm := &corev1.ConfigMap{}
+			tCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"cluster": starlark.String(tc.cluster)}}
+			if err := m.setMetadata(context.Background(), tCtx, "foo", "default", cm); err != nil {
+				t.Fatal(err)
+			}
+
+			ctxJSON := `{"cluster":"` + tc.cluster + `"}`
+			want := map[string]string{ctxAnnotationKey: ctxJSON}
+			var wantCtxs map[string]string
+			if tc.wantHash {
+				sum := sha256.Sum256([]byte(ctxJSON))
+				hash := "sha256:" + hex.EncodeToString(sum[:])
+				want = map[string]string{ctxHashAnnotationKey: hash}
+				wantCtxs = map[string]string{hash: ctxJSON}
+			}
+			if d := cmp.Diff(want, cm.Annotations); d != "" {
+				t.Errorf("Unexpected annotations (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(wantCtxs, m.TakeContexts()); d != "" {
+				t.Errorf("Unexpected contexts (-want +got):\n%s", d)
+			}
+			if ctxs := m.TakeContexts(); len(ctxs) != 0 {
+				t.Errorf("Want contexts forgotten, got: %v", ctxs)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto" //nolint:staticcheck
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// ErrRemovedAPI is returned (wrapped) when an object is applied in API
+// version the cluster no longer serves.
+var ErrRemovedAPI = errors.New("API version is removed")
+
+// kubeVersion is a major.minor Kubernetes release.
+type kubeVersion struct {
+	major, minor int
+}
+
+func (v kubeVersion) String() string { return fmt.Sprintf("%d.%d", v.major, v.minor) }
+
+func (v kubeVersion) atLeast(o kubeVersion) bool {
+	return v.major > o.major || v.major == o.major && v.minor >= o.minor
+}
+
+// apiDeprecation describes API version of kind deprecated and removed by
+// Kubernetes releases.
+type apiDeprecation struct {
+	deprecatedIn, removedIn kubeVersion
+	// replacement is API version to use instead (empty if there is none).
+	replacement schema.GroupVersion
+	// equivalent is true if objects can be migrated to replacement by
+	// changing their API version alone.
+	equivalent bool
+}
+
+var (
+	v1_9  = kubeVersion{1, 9}
+	v1_14 = kubeVersion{1, 14}
+	v1_16 = kubeVersion{1, 16}
+	v1_17 = kubeVersion{1, 17}
+	v1_19 = kubeVersion{1, 19}
+	v1_21 = kubeVersion{1, 21}
+	v1_22 = kubeVersion{1, 22}
+	v1_23 = kubeVersion{1, 23}
+	v1_25 = kubeVersion{1, 25}
+	v1_26 = kubeVersion{1, 26}
+)
+
+// deprecatedAPIs is the deprecation table of built-in kinds (see
+// https://kubernetes.io/docs/reference/using-api/deprecation-guide/).
+var deprecatedAPIs = map[schema.GroupVersionKind]apiDeprecation{}
+
+func init() {
+	add := func(gv schema.GroupVersion, kinds []string, deprecatedIn, removedIn kubeVersion, replacement schema.GroupVersion, equivalent bool) {
+		for _, k := range kinds {
+			deprecatedAPIs[gv.WithKind(k)] = apiDeprecation{
+				deprecatedIn: deprecatedIn,
+				removedIn:    removedIn,
+				replacement:  replacement,
+				equivalent:   equivalent,
+			}
+		}
+	}
+	gv := func(group, version string) schema.GroupVersion {
+		return schema.GroupVersion{Group: group, Version: version}
+	}
+	workloads := []string{"DaemonSet", "Deployment", "ReplicaSet", "StatefulSet", "ControllerRevision"}
+	rbac := []string{"ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"}
+	storage := []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}
+
+	// Removed in 1.16.
+	add(gv("extensions", "v1beta1"), []string{"DaemonSet", "Deployment", "ReplicaSet"}, v1_9, v1_16, gv("apps", "v1"), false)
+	add(gv("extensions", "v1beta1"), []string{"NetworkPolicy"}, v1_9, v1_16, gv("networking.k8s.io", "v1"), true)
+	add(gv("extensions", "v1beta1"), []string{"PodSecurityPolicy"}, v1_9, v1_16, gv("policy", "v1beta1"), true)
+	add(gv("apps", "v1beta1"), workloads, v1_9, v1_16, gv("apps", "v1"), false)
+	add(gv("apps", "v1beta2"), workloads, v1_9, v1_16, gv("apps", "v1"), true)
+
+	// Removed in 1.22.
+	add(gv("extensions", "v1beta1"), []string{"Ingress"}, v1_14, v1_22, gv("networking.k8s.io", "v1"), false)
+	add(gv("networking.k8s.io", "v1beta1"), []string{"Ingress", "IngressClass"}, v1_19, v1_22, gv("networking.k8s.io", "v1"), false)
+	add(gv("apiextensions.k8s.io", "v1beta1"), []string{"CustomResourceDefinition"}, v1_16, v1_22, gv("apiextensions.k8s.io", "v1"), false)
+	add(gv("admissionregistration.k8s.io", "v1beta1"), []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"}, v1_16, v1_22, gv("admissionregistration.k8s.io", "v1"), false)
+	add(gv("apiregistration.k8s.io", "v1beta1"), []string{"APIService"}, v1_19, v1_22, gv("apiregistration.k8s.io", "v1"), true)
+	add(gv("authentication.k8s.io", "v1beta1"), []string{"TokenReview"}, v1_19, v1_22, gv("authentication.k8s.io", "v1"), true)
+	add(gv("authorization.k8s.io", "v1beta1"), []string{"LocalSubjectAccessReview", "SelfSubjectAccessReview", "SelfSubjectRulesReview", "SubjectAccessReview"}, v1_19, v1_22, gv("authorization.k8s.io", "v1"), true)
+	add(gv("certificates.k8s.io", "v1beta1"), []string{"CertificateSigningRequest"}, v1_19, v1_22, gv("certificates.k8s.io", "v1"), false)
+	add(gv("coordination.k8s.io", "v1beta1"), []string{"Lease"}, v1_19, v1_22, gv("coordination.k8s.io", "v1"), true)
+	add(gv("rbac.authorization.k8s.io", "v1alpha1"), rbac, v1_17, v1_22, gv("rbac.authorization.k8s.io", "v1"), true)
+	add(gv("rbac.authorization.k8s.io", "v1beta1"), rbac, v1_17, v1_22, gv("rbac.authorization.k8s.io", "v1"), true)
+	add(gv("scheduling.k8s.io", "v1alpha1"), []string{"PriorityClass"}, v1_14, v1_22, gv("scheduling.k8s.io", "v1"), true)
+	add(gv("scheduling.k8s.io", "v1beta1"), []string{"PriorityClass"}, v1_14, v1_22, gv("scheduling.k8s.io", "v1"), true)
+	add(gv("storage.k8s.io", "v1beta1"), storage, v1_19, v1_22, gv("storage.k8s.io", "v1"), true)
+
+	// Removed in 1.25 and later.
+	add(gv("batch", "v1beta1"), []string{"CronJob"}, v1_21, v1_25, gv("batch", "v1"), true)
+	add(gv("events.k8s.io", "v1beta1"), []string{"Event"}, v1_19, v1_25, gv("events.k8s.io", "v1"), false)
+	add(gv("policy", "v1beta1"), []string{"PodDisruptionBudget"}, v1_21, v1_25, gv("policy", "v1"), false)
+	add(gv("policy", "v1beta1"), []string{"PodSecurityPolicy"}, v1_21, v1_25, schema.GroupVersion{}, false)
+	add(gv("autoscaling", "v2beta1"), []string{"HorizontalPodAutoscaler"}, v1_22, v1_25, gv("autoscaling", "v2"), false)
+	add(gv("autoscaling", "v2beta2"), []string{"HorizontalPodAutoscaler"}, v1_23, v1_26, gv("autoscaling", "v2"), false)
+}
+
+// parseServerVersion returns major.minor release of server version v. Some
+// vendors report versions like `21+'.
+func parseServerVersion(v *version.Info) (kubeVersion, error) {
+	major, err := strconv.Atoi(strings.TrimSuffix(v.Major, "+"))
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("unexpected major version `%s'", v.Major)
+	}
+	minor, err := strconv.Atoi(strings.TrimSuffix(v.Minor, "+"))
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("unexpected minor version `%s'", v.Minor)
+	}
+	return kubeVersion{major, minor}, nil
+}
+
+// APIMigrator is implemented by kube packages that can apply objects of
+// deprecated API versions in their replacement versions.
+type APIMigrator interface {
+	// SetAutoMigrateAPIs enables migration of objects whose API version
+	// is deprecated or removed in the cluster's release to an equivalent
+	// replacement version.
+	SetAutoMigrateAPIs(migrate bool)
+}
+
+// SetAutoMigrateAPIs implements APIMigrator.SetAutoMigrateAPIs.
+func (m *kubePackage) SetAutoMigrateAPIs(migrate bool) {
+	m.autoMigrateAPIs = migrate
+}
+
+// serverRelease returns (cached) release of the cluster. ok is false if it
+// couldn't be discovered.
+func (m *kubePackage) serverRelease() (v kubeVersion, ok bool) {
+	m.releaseOnce.Do(func() {
+		info, err := m.dClient.ServerVersion()
+		if err == nil {
+			m.release, err = parseServerVersion(info)
+		}
+		if err != nil {
+			log.Warningf("Failed to discover server version, deprecated APIs are not detected: %v", err)
+			return
+		}
+		m.releaseKnown = true
+	})
+	return m.release, m.releaseKnown
+}
+
+// checkDeprecatedAPI checks obj of gvk against the deprecation table for the
+// release of the cluster. Objects of deprecated API versions are applied
+// with a warning and those of removed versions fail. If auto-migration is
+// enabled (see SetAutoMigrateAPIs), both are converted to their replacement
+// API version when it's equivalent, in which case converted object and its
+// kind are returned (obj and gvk are returned otherwise).
+func (m *kubePackage) checkDeprecatedAPI(obj runtime.Object, gvk *schema.GroupVersionKind) (runtime.Object, *schema.GroupVersionKind, error) {
+	d, ok := deprecatedAPIs[*gvk]
+	if !ok {
+		return obj, gvk, nil
+	}
+	release, ok := m.serverRelease()
+	if !ok || !release.atLeast(d.deprecatedIn) {
+		return obj, gvk, nil
+	}
+	removed := release.atLeast(d.removedIn)
+
+	if m.autoMigrateAPIs && d.equivalent {
+		to := d.replacement.WithKind(gvk.Kind)
+		migrated, err := convertAPIVersion(obj, to)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to migrate %s to %s: %v", gvk.GroupVersion(), d.replacement, err)
+		}
+		m.warnDeprecatedOnce(*gvk, "%s %s is migrated to %s", gvk.Kind, gvk.GroupVersion(), d.replacement)
+		return migrated, &to, nil
+	}
+
+	hint := "there is no replacement"
+	if !d.replacement.Empty() {
+		hint = fmt.Sprintf("use %s instead", d.replacement)
+		if d.equivalent {
+			hint += " (or migrate automatically with --auto_migrate_apis)"
+		}
+	}
+	if removed {
+		return nil, nil, fmt.Errorf("%s %s: %w in Kubernetes %s, %s", gvk.Kind, gvk.GroupVersion(), ErrRemovedAPI, d.removedIn, hint)
+	}
+	m.warnDeprecatedOnce(*gvk, "%s %s is deprecated since Kubernetes %s and removed in %s, %s", gvk.Kind, gvk.GroupVersion(), d.deprecatedIn, d.removedIn, hint)
+	return obj, gvk, nil
+}
+
+// checkDeprecatedMsg is checkDeprecatedAPI for protobuf messages of
+// `kube.put'. Returns (possibly migrated) msg and API group to map it with
+// (apiGroup unless msg is migrated).
+func (m *kubePackage) checkDeprecatedMsg(msg proto.Message, apiGroup string) (proto.Message, string, error) {
+	obj, ok := msg.(runtime.Object)
+	if !ok {
+		return msg, apiGroup, nil
+	}
+	gvks, _, err := Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return msg, apiGroup, nil
+	}
+	gvk := gvks[0]
+	migrated, to, err := m.checkDeprecatedAPI(obj, &gvk)
+	if err != nil {
+		return nil, "", err
+	}
+	if *to == gvk {
+		return msg, apiGroup, nil
+	}
+	migratedMsg, ok := migrated.(proto.Message)
+	if !ok {
+		return nil, "", fmt.Errorf("%s is not a protobuf message", to)
+	}
+	return migratedMsg, to.Group, nil
+}
+
+// warnDeprecatedOnce logs warning about gvk once per kube package.
+func (m *kubePackage) warnDeprecatedOnce(gvk schema.GroupVersionKind, format string, args ...interface{}) {
+	m.deprecationMu.Lock()
+	defer m.deprecationMu.Unlock()
+	if m.deprecationWarned == nil {
+		m.deprecationWarned = map[schema.GroupVersionKind]bool{}
+	}
+	if m.deprecationWarned[gvk] {
+		return
+	}
+	m.deprecationWarned[gvk] = true
+	log.Warningf(format, args...)
+}
+
+// convertAPIVersion converts obj to equivalent object of gvk. Typed objects
+// are converted to the type registered for gvk in Scheme.
+func convertAPIVersion(obj runtime.Object, gvk schema.GroupVersionKind) (runtime.Object, error) {
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: un}
+	u.SetGroupVersionKind(gvk)
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		return u, nil
+	}
+
+	out, err := Scheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/version"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const testCronJobYaml = `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: backup
+  namespace: default
+spec:
+  schedule: "0 * * * *"
+`
+
+const testIngressYaml = `apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+  namespace: default
+`
+
+func TestKubeDeprecatedAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name, minor, expr string
+		migrate           bool
+		wantErr, wantObj  string
+	}{
+		{
+			name:    "Not deprecated yet",
+			minor:   "20",
+			expr:    `kube.put_yaml(name="backup", data=["""` + testCronJobYaml + `"""])`,
+			wantObj: "/apis/batch/v1beta1/namespaces/default/cronjobs/backup",
+		},
+		{
+			name:    "Deprecated",
+			minor:   "21",
+			expr:    `kube.put_yaml(name="backup", data=["""` + testCronJobYaml + `"""])`,
+			wantObj: "/apis/batch/v1beta1/namespaces/default/cronjobs/backup",
+		},
+		{
+			name:    "Removed",
+			minor:   "25+",
+			expr:    `kube.put_yaml(name="backup", data=["""` + testCronJobYaml + `"""])`,
+			wantErr: "<kube.put_yaml>: item 0 (cronjob.batch `default/backup'): CronJob batch/v1beta1: API version is removed in Kubernetes 1.25, use batch/v1 instead (or migrate automatically with --auto_migrate_apis)",
+		},
+		{
+			name:    "Removed migrated",
+			minor:   "25",
+			expr:    `kube.put_yaml(name="backup", data=["""` + testCronJobYaml + `"""])`,
+			migrate: true,
+			wantObj: "/apis/batch/v1/namespaces/default/cronjobs/backup",
+		},
+		{
+			name:    "Removed not equivalent",
+			minor:   "22",
+			expr:    `kube.put_yaml(name="web", data=["""` + testIngressYaml + `"""])`,
+			migrate: true,
+			wantErr: "<kube.put_yaml>: item 0 (ingress.extensions `default/web'): Ingress extensions/v1beta1: API version is removed in Kubernetes 1.22, use networking.k8s.io/v1 instead",
+		},
+		{
+			name:    "Proto removed",
+			minor:   "22",
+			expr:    `kube.put(name="reader", namespace="default", api_group="rbac.authorization.k8s.io", data=[proto.package("k8s.io.api.rbac.v1beta1").Role()])`,
+			wantErr: "<kube.put>: item 0 (role.rbac `default/reader'): Role rbac.authorization.k8s.io/v1beta1: API version is removed in Kubernetes 1.22, use rbac.authorization.k8s.io/v1 instead (or migrate automatically with --auto_migrate_apis)",
+		},
+		{
+			name:    "Proto removed migrated",
+			minor:   "22",
+			expr:    `kube.put(name="reader", namespace="default", api_group="rbac.authorization.k8s.io", data=[proto.package("k8s.io.api.rbac.v1beta1").Role()])`,
+			migrate: true,
+			wantObj: "/apis/rbac.authorization.k8s.io/v1/namespaces/default/roles/reader",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fk := &fakeKube{m: map[string][]byte{}}
+			s := httptest.NewServer(fk)
+			defer s.Close()
+			d := fakeDiscovery()
+			d.FakedServerVersion = &version.Info{Major: "1", Minor: tc.minor}
+			pkg := newTestPackage(s, d, Options{})
+			pkg.(APIMigrator).SetAutoMigrateAPIs(tc.migrate)
+
+			pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+			pkgs["kube"] = pkg
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			_, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if _, ok := fk.m[tc.wantObj]; tc.wantObj != "" && !ok {
+				t.Errorf("Object `%s' is not applied (applied: %v)", tc.wantObj, fk.m)
+			}
+		})
+	}
+}
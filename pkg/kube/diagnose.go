@@ -0,0 +1,263 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var eventsGVR = schema.GroupVersionResource{Version: "v1", Resource: "events"}
+
+const (
+	// maxDiagEvents is the maximum number of events included in diagnostics.
+	maxDiagEvents = 30
+	// diagLogLines is the number of trailing log lines fetched per container.
+	diagLogLines = 20
+	// diagClockSkew is subtracted from the time objects started being
+	// tracked to account for apiserver clock skew.
+	diagClockSkew = time.Minute
+)
+
+// Diagnoser collects diagnostics of Kubernetes objects touched by an addon
+// to make its failures debuggable without a separate kubectl session.
+type Diagnoser interface {
+	// ResetTouched forgets objects touched so far.
+	ResetTouched()
+	// Diagnose returns recent Events (and trailing logs of unhealthy pods
+	// if podLogs is set) related to objects touched since the last
+	// ResetTouched. Returns empty string if there is nothing to report.
+	Diagnose(ctx context.Context, podLogs bool) (string, error)
+}
+
+// touchedObj is an object created, updated or deleted by an addon.
+type touchedObj struct {
+	kind, name, namespace string
+}
+
+// touch records that object referenced by r was touched.
+func (m *kubePackage) touch(r *apiResource) {
+	m.touchedMu.Lock()
+	defer m.touchedMu.Unlock()
+	o := touchedObj{kind: r.GVK.Kind, name: r.Name, namespace: r.Namespace}
+	if r.ClusterScoped {
+		o.namespace = ""
+	}
+	for _, t := range m.touched {
+		if t == o {
+			return
+		}
+	}
+	m.touched = append(m.touched, o)
+}
+
+// ResetTouched implements Diagnoser.ResetTouched.
+func (m *kubePackage) ResetTouched() {
+	m.touchedMu.Lock()
+	defer m.touchedMu.Unlock()
+	m.touched = nil
+	m.touchedSince = time.Now()
+}
+
+// Diagnose implements Diagnoser.Diagnose.
+func (m *kubePackage) Diagnose(ctx context.Context, podLogs bool) (string, error) {
+	m.touchedMu.Lock()
+	touched := append([]touchedObj(nil), m.touched...)
+	since := m.touchedSince.Add(-diagClockSkew)
+	m.touchedMu.Unlock()
+
+	// Events are namespaced so only namespaces of touched objects (and
+	// touched namespaces themselves) are inspected.
+	namespaces := map[string][]touchedObj{}
+	for _, o := range touched {
+		switch {
+		case o.kind == "Namespace":
+			namespaces[o.name] = append(namespaces[o.name], o)
+		case o.namespace != "":
+			namespaces[o.namespace] = append(namespaces[o.namespace], o)
+		}
+	}
+	if len(namespaces) == 0 {
+		return "", nil
+	}
+
+	var events []corev1.Event
+	var pods []corev1.Pod
+	for ns, objs := range namespaces {
+		es, err := m.listEvents(ctx, ns)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range es {
+			if eventTime(&e).Before(since) || !related(&e.InvolvedObject, objs) {
+				continue
+			}
+			events = append(events, e)
+		}
+
+		if podLogs {
+			ps, err := m.listPods(ctx, ns)
+			if err != nil {
+				return "", err
+			}
+			for _, p := range ps {
+				if podUnhealthy(&p) && related(&corev1.ObjectReference{Kind: "Pod", Name: p.Name, Namespace: p.Namespace}, objs) {
+					pods = append(pods, p)
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	if len(events) > 0 {
+		sort.SliceStable(events, func(i, j int) bool { return eventTime(&events[i]).Before(eventTime(&events[j])) })
+		if len(events) > maxDiagEvents {
+			events = events[len(events)-maxDiagEvents:]
+		}
+		b.WriteString("Recent events:\n")
+		for _, e := range events {
+			fmt.Fprintf(&b, "  %s\t%s\t%s `%s'\t%s: %s\n",
+				eventTime(&e).Format(time.RFC3339), e.Type, strings.ToLower(e.InvolvedObject.Kind),
+				maybeNamespaced(e.InvolvedObject.Name, e.InvolvedObject.Namespace), e.Reason, strings.TrimSpace(e.Message))
+		}
+	}
+	for _, p := range pods {
+		for _, c := range p.Spec.Containers {
+			logs, err := m.podLogs(ctx, &p, c.Name)
+			if err != nil {
+				fmt.Fprintf(&b, "Failed to fetch logs of pod `%s' container `%s': %v\n", maybeNamespaced(p.Name, p.Namespace), c.Name, err)
+				continue
+			}
+			if logs == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "Logs of pod `%s' container `%s':\n", maybeNamespaced(p.Name, p.Namespace), c.Name)
+			for _, l := range strings.Split(strings.TrimRight(logs, "\n"), "\n") {
+				fmt.Fprintf(&b, "  %s\n", l)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// related returns true if ref is one of objs or looks like an object
+// created for one of objs by a controller (e.g Pod `nginx-6d4cf56db6-xb2kd'
+// of Deployment `nginx').
+func related(ref *corev1.ObjectReference, objs []touchedObj) bool {
+	for _, o := range objs {
+		if o.kind == "Namespace" {
+			return true
+		}
+		if ref.Name == o.name || strings.HasPrefix(ref.Name, o.name+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// eventTime returns the time event was last observed.
+func eventTime(e *corev1.Event) time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+// podUnhealthy returns true if any container of p is not ready or restarted.
+func podUnhealthy(p *corev1.Pod) bool {
+	if p.Status.Phase == corev1.PodSucceeded {
+		return false
+	}
+	for _, s := range p.Status.ContainerStatuses {
+		if !s.Ready || s.RestartCount > 0 {
+			return true
+		}
+	}
+	return p.Status.Phase != corev1.PodRunning
+}
+
+func (m *kubePackage) listEvents(ctx context.Context, namespace string) ([]corev1.Event, error) {
+	ul, err := m.dynClient.Resource(eventsGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events in namespace `%s': %v", namespace, err)
+	}
+	ret := make([]corev1.Event, len(ul.Items))
+	for i, un := range ul.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (m *kubePackage) listPods(ctx context.Context, namespace string) ([]corev1.Pod, error) {
+	ul, err := m.dynClient.Resource(podsGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods in namespace `%s': %v", namespace, err)
+	}
+	ret := make([]corev1.Pod, len(ul.Items))
+	for i, un := range ul.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// podLogs returns trailing log lines of container of pod p.
+func (m *kubePackage) podLogs(ctx context.Context, p *corev1.Pod, container string) (string, error) {
+	q := url.Values{}
+	q.Set("container", container)
+	q.Set("tailLines", fmt.Sprint(diagLogLines))
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/log?%s", m.Master, p.Namespace, p.Name, q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	// Logs of containers that haven't started yet are not available.
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, bs)
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDiagnose(t *testing.T) {
+	now := metav1.Now()
+	old := metav1.NewTime(now.Add(-time.Hour))
+	event := func(name, reason string, ts metav1.Time) corev1.Event {
+		return corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name + "." + reason, Namespace: "app"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: name, Namespace: "app"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         reason,
+			Message:        reason + " happened",
+			LastTimestamp:  ts,
+		}
+	}
+	events := &corev1.EventList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "EventList"},
+		Items: []corev1.Event{
+			event("nginx-6d4cf56db6-xb2kd", "BackOff", now),
+			event("nginx-6d4cf56db6-xb2kd", "Stale", old),
+			event("unrelated", "Failed", now),
+		},
+	}
+	pods := &corev1.PodList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"},
+		Items: []corev1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "nginx-6d4cf56db6-xb2kd", Namespace: "app"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx"}}},
+				Status: corev1.PodStatus{
+					Phase:             corev1.PodRunning,
+					ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx", RestartCount: 3}},
+				},
+			},
+		},
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/app/events":
+			json.NewEncoder(w).Encode(events)
+		case "/api/v1/namespaces/app/pods":
+			json.NewEncoder(w).Encode(pods)
+		case "/api/v1/namespaces/app/pods/nginx-6d4cf56db6-xb2kd/log":
+			w.Write([]byte("starting\nboom\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	m := &kubePackage{
+		dynClient:  dynamic.NewForConfigOrDie(&rest.Config{Host: s.URL}),
+		httpClient: s.Client(),
+		Master:     s.URL,
+	}
+	m.ResetTouched()
+
+	ctx := context.Background()
+	if got, err := m.Diagnose(ctx, true); err != nil || got != "" {
+		t.Fatalf("Expected empty report without touched objects, got: %q, %v", got, err)
+	}
+
+	m.touch(&apiResource{GVK: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Name: "nginx", Namespace: "app"})
+	got, err := m.Diagnose(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Recent events:",
+		"Warning\tpod `app/nginx-6d4cf56db6-xb2kd'\tBackOff: BackOff happened",
+		"Logs of pod `app/nginx-6d4cf56db6-xb2kd' container `nginx':\n  starting\n  boom\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"Stale", "unrelated"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("Expected report to not contain %q, got:\n%s", notWant, got)
+		}
+	}
+}
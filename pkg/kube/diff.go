@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
 	"strings"
 
 	"github.com/pmezard/go-difflib/difflib"
@@ -29,8 +30,26 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/cruise-automation/isopod/pkg/kpath"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/secretref"
 )
 
+// trackSecret registers data of obj with redact package if obj is a Secret
+// so that it's scrubbed from output (e.g diffs of CRDs embedding the same
+// data).
+func trackSecret(obj runtime.Object) {
+	s, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	for _, v := range s.Data {
+		redact.Add(string(v))
+	}
+	for _, v := range s.StringData {
+		redact.Add(v)
+	}
+}
+
 // renderObj renders obj into JSON or YAML (if renderYaml is true).
 // Secrets are redacted. Scheme defaults are applied.
 // Fields set by built-in Kubernetes controllers (SelfLink, UID, etc) are filtered.
@@ -88,11 +107,11 @@ func renderObj(obj runtime.Object, gvk *schema.GroupVersionKind, renderYaml bool
 
 	// apply custom diff filters
 	for i := 0; i < len(diffFilters); i++ {
-		path, err := kpath.Split(diffFilters[i])
+		path, err := kpath.Parse(diffFilters[i])
 		if err != nil {
 			return "", fmt.Errorf("failed to parse diff filter (\"%s\"): %v", diffFilters[i], err)
 		}
-		yamlMap = filterYaml(yamlMap, path...)
+		yamlMap = filterPath(yamlMap, path).(yaml.MapSlice)
 	}
 
 	// reduce result (empty map/array => nil)
@@ -209,6 +228,11 @@ func maybeCore(group string) string {
 	return "." + group
 }
 
+// diffName returns name of object of gvk used in diffs.
+func diffName(gvk schema.GroupVersionKind, name string) string {
+	return fmt.Sprintf("%s%s `%s'", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), name)
+}
+
 // printUnifiedDiff prints unified diff of live against head.
 // Uses gvk and name to prettify the diff.
 // If live is nil, just prints the right side.
@@ -222,11 +246,14 @@ func printUnifiedDiff(
 ) error {
 	live, head = removeSpuriousDiff(live, head)
 
-	fullName := fmt.Sprintf("%s%s `%s'", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), name)
+	fullName := diffName(gvk, name)
 
 	var left string
 	if live != nil {
 		var err error
+		if live, err = maskExpandedRefs(live, head); err != nil {
+			return fmt.Errorf("failed to mask secrets of :live object for %s: %v", fullName, err)
+		}
 		left, err = renderObj(live, nil, true, diffFilters)
 		if err != nil {
 			return fmt.Errorf("failed to render :live object for %s: %v", fullName, err)
@@ -234,6 +261,8 @@ func printUnifiedDiff(
 	}
 
 	right, _ := renderObj(head, &gvk, true, diffFilters)
+	// Secret references are shown as redacted values on both sides.
+	left, right = secretref.Mask(left), secretref.Mask(right)
 
 	fmt.Fprintf(w, "\n*** %s ***\n", fullName)
 
@@ -250,3 +279,60 @@ func printUnifiedDiff(
 	}
 	return nil
 }
+
+// maskExpandedRefs returns copy of live with values secret references of
+// head were expanded to masked (see secretref.MaskExpanded).
+func maskExpandedRefs(live, head runtime.Object) (runtime.Object, error) {
+	if head == nil {
+		return live, nil
+	}
+	hu, err := runtime.DefaultUnstructuredConverter.ToUnstructured(head)
+	if err != nil {
+		return nil, err
+	}
+	live = live.DeepCopyObject()
+	lu, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	secretref.MaskExpanded(lu, hu)
+	if _, ok := live.(runtime.Unstructured); ok {
+		// lu is the content of live.
+		return live, nil
+	}
+	masked := reflect.New(reflect.TypeOf(live).Elem()).Interface().(runtime.Object)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(lu, masked); err != nil {
+		return nil, err
+	}
+	return masked, nil
+}
+
+// printDeleteDiff prints unified diff of deleting live (nil if it doesn't
+// exist). Uses gvk and name to prettify the diff and applies diffFilters as
+// printUnifiedDiff does.
+func printDeleteDiff(w io.Writer, live runtime.Object, gvk schema.GroupVersionKind, name string, diffFilters []string) error {
+	fullName := diffName(gvk, name)
+	if live == nil {
+		fmt.Fprintf(w, "\n*** %s not found ***\n", fullName)
+		return nil
+	}
+
+	left, err := renderObj(live, &gvk, true, diffFilters)
+	if err != nil {
+		return fmt.Errorf("failed to render :live object for %s: %v", fullName, err)
+	}
+
+	fmt.Fprintf(w, "\n*** %s will be deleted ***\n", fullName)
+
+	err = difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+		A:        difflib.SplitLines(left),
+		FromFile: "live",
+		ToFile:   "head",
+		Context:  5,
+		Eol:      "\n",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to print diff for %s: %v", fullName, err)
+	}
+	return nil
+}
@@ -17,14 +17,20 @@ package kube
 import (
 	"bytes"
 	"io/ioutil"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/secretref"
+	util "github.com/cruise-automation/isopod/pkg/testing"
 )
 
 func multiline(s ...string) string {
@@ -152,6 +158,123 @@ func TestDiff(t *testing.T) {
 				" ",
 				""),
 		},
+		{
+			name: "Secret reference",
+			live: &corev1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "ConfigMap",
+					APIVersion: "v1",
+				},
+				Data: map[string]string{"dsn": "postgres://app:hunter2@db", "user": "admin"},
+			},
+			head: &corev1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "ConfigMap",
+					APIVersion: "v1",
+				},
+				Data: map[string]string{
+					"dsn":  "postgres://app:" + (&secretref.Ref{Backend: "vault", Path: "secret/db", Key: "password"}).Token() + "@db",
+					"user": "app",
+				},
+			},
+			wantDiff: multiline(
+				"",
+				"*** configmap.v1 `foobar' ***",
+				"--- live",
+				"+++ head",
+				"@@ -1,6 +1,6 @@",
+				" kind: ConfigMap",
+				" apiVersion: v1",
+				" data:",
+				"   dsn: postgres://app:<redacted>@db",
+				"-  user: admin",
+				"+  user: app",
+				" ",
+				""),
+		},
+		{
+			name: "Changed secret reference",
+			live: &corev1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "ConfigMap",
+					APIVersion: "v1",
+				},
+				Data: map[string]string{"dsn": "postgres://root:hunter2@db"},
+			},
+			head: &corev1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "ConfigMap",
+					APIVersion: "v1",
+				},
+				Data: map[string]string{
+					"dsn": "postgres://app:" + (&secretref.Ref{Backend: "vault", Path: "secret/db", Key: "password"}).Token() + "@db",
+				},
+			},
+			wantDiff: multiline(
+				"",
+				"*** configmap.v1 `foobar' ***",
+				"--- live",
+				"+++ head",
+				"@@ -1,5 +1,5 @@",
+				" kind: ConfigMap",
+				" apiVersion: v1",
+				" data:",
+				"-  dsn: <redacted>",
+				"+  dsn: postgres://app:<redacted>@db",
+				" ",
+				""),
+		},
+		{
+			name: "Wildcard, regexp and conditional filters",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"pod-template-hash": "6d4cf56db6",
+					},
+					Annotations: map[string]string{
+						"autoscaling.alpha.kubernetes.io/current-metrics": "[]",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:            "nginx",
+							Image:           "nginx:latest",
+							ImagePullPolicy: corev1.PullAlways,
+						},
+						{
+							Name:            "sidecar",
+							Image:           "sidecar:v1",
+							ImagePullPolicy: corev1.PullAlways,
+						},
+					},
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:            "nginx",
+							Image:           "nginx:latest",
+							ImagePullPolicy: corev1.PullIfNotPresent,
+						},
+						{
+							Name:  "sidecar",
+							Image: "sidecar:v2",
+						},
+					},
+				},
+			},
+			wantDiff: "\n*** pod.v1 `foobar' ***\n",
+		},
 	} {
 		var rw bytes.Buffer
 
@@ -162,6 +285,10 @@ func TestDiff(t *testing.T) {
 				`metadata.annotations["autoscaling.alpha.kubernetes.io/conditions"]`,
 				`metadata.annotations["cloud.google.com/neg-status"]`,
 				`spec.template.spec.serviceAccount`,
+				`spec.containers[*].imagePullPolicy`,
+				`spec.containers[?.name == "sidecar"].image`,
+				`metadata.labels[/pod-template-.*/]`,
+				`metadata.annotations[?key matches "autoscaling\..*"]`,
 			}
 			err := printUnifiedDiff(&rw, tc.live, tc.head, tc.live.GetObjectKind().GroupVersionKind(), "foobar", diffFilters)
 			if err != nil {
@@ -184,3 +311,60 @@ func TestDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestDryRunDeleteDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name, expr string
+		wantDiff   string
+	}{
+		{
+			name: "Live object",
+			expr: `kube.delete(configmap="default/foo")`,
+			wantDiff: multiline(
+				"",
+				"*** configmap.v1 `default/foo' will be deleted ***",
+				"--- live",
+				"+++ head",
+				"@@ -1,8 +0,0 @@",
+				"-kind: ConfigMap",
+				"-apiVersion: v1",
+				"-metadata:",
+				"-  name: foo",
+				"-  namespace: default",
+				"-data:",
+				"-  a: b",
+				"-",
+				""),
+		},
+		{
+			name:     "Not found",
+			expr:     `kube.delete(configmap="default/bar")`,
+			wantDiff: "\n*** configmap.v1 `default/bar' not found ***\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &fakeKube{m: map[string][]byte{
+				"/api/v1/namespaces/default/configmaps/foo": []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo","namespace":"default","uid":"1234","annotations":{"isopod.getcruise.com/context":"{}"}},"data":{"a":"b"}}`),
+			}}
+			s := httptest.NewServer(h)
+			defer s.Close()
+
+			out := &bytes.Buffer{}
+			pkg := newTestPackage(s, nil, Options{
+				DryRun:      true,
+				DiffFilters: []string{`metadata.annotations["isopod.getcruise.com/context"]`},
+				DiffOut:     out,
+			})
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			if _, _, err := util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg}); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.wantDiff, out.String()); d != "" {
+				t.Errorf("Unexpected diff (-want, +got):\n%s", d)
+			}
+			if _, ok := h.m["/api/v1/namespaces/default/configmaps/foo"]; !ok {
+				t.Errorf("Object was deleted in dry run")
+			}
+		})
+	}
+}
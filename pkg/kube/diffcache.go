@@ -0,0 +1,219 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// partialMetadataAccept requests only metadata of an object from apiserver.
+const partialMetadataAccept = "application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1,application/json"
+
+// DiffCache remembers objects whose dry run diff was empty so that following
+// dry runs can skip fetching and diffing them if neither the object nor its
+// live version (as indicated by resourceVersion) changed. It is safe for
+// concurrent use by multiple kube packages (e.g one per cluster).
+type DiffCache struct {
+	path string
+
+	mu      sync.Mutex
+	Entries map[string]diffCacheEntry `json:"entries"`
+}
+
+type diffCacheEntry struct {
+	// Hash of the object as specified by the addon (and diff filters).
+	Hash string `json:"hash"`
+	// ResourceVersion of the live object the object was diffed against.
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// LoadDiffCache loads diff cache from path. Returns an empty cache if path
+// doesn't exist yet.
+func LoadDiffCache(path string) (*DiffCache, error) {
+	c := &DiffCache{path: path, Entries: map[string]diffCacheEntry{}}
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, fmt.Errorf("failed to parse diff cache `%s': %v", path, err)
+	}
+	if c.Entries == nil {
+		c.Entries = map[string]diffCacheEntry{}
+	}
+	return c, nil
+}
+
+// Save writes the cache to the path it was loaded from.
+func (c *DiffCache) Save() error {
+	c.mu.Lock()
+	bs, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that interrupted runs don't leave
+	// a corrupted cache behind.
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *DiffCache) get(key string) (diffCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.Entries[key]
+	return e, ok
+}
+
+func (c *DiffCache) set(key string, e diffCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Entries[key] = e
+}
+
+func (c *DiffCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.Entries, key)
+}
+
+// diffCacheKey returns cache key of r and hash of obj to be compared with
+// the cached one. Returns empty key if r must not be cached.
+func (m *kubePackage) diffCacheKey(ctx context.Context, r *apiResource, obj runtime.Object) (key, hash string) {
+	// Hashes of low entropy secret values could be brute forced.
+	if !m.dryRun || m.diffCache == nil || m.recorder != nil || r.Subresource != "" || r.GVK.Kind == "Secret" {
+		return "", ""
+	}
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return "", ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", r.GVK, strings.Join(m.filters(ctx), "\n"))
+	h.Write(bs)
+	return m.Master + r.PathWithName(), hex.EncodeToString(h.Sum(nil))
+}
+
+// diffCached returns true (and prints that the object is unchanged) if
+// object with key and hash had an empty diff against the current live
+// version of the object before. Only metadata of the live object is fetched.
+func (m *kubePackage) diffCached(ctx context.Context, r *apiResource, key, hash string) bool {
+	if key == "" {
+		return false
+	}
+	e, ok := m.diffCache.get(key)
+	if !ok || e.Hash != hash {
+		return false
+	}
+
+	rv, err := m.peekResourceVersion(ctx, key)
+	if err != nil {
+		log.V(1).Infof("Failed to fetch resourceVersion of %v, ignoring diff cache: %v", r, err)
+		return false
+	}
+	if rv == "" || rv != e.ResourceVersion {
+		return false
+	}
+	fmt.Fprintf(m.diffOut, "\n*** %s unchanged (cached) ***\n", diffName(r.GVK, maybeNamespaced(r.Name, r.Namespace)))
+	return true
+}
+
+// printDryRunDiff prints diff of live against obj (see diffObject) like
+// printUnifiedDiff and records in the cache (if key is set) whether the diff
+// was empty. Returns true if the diff is not empty.
+func (m *kubePackage) printDryRunDiff(ctx context.Context, r *apiResource, live, obj runtime.Object, key, hash string) (bool, error) {
+	buf := &bytes.Buffer{}
+	if err := printUnifiedDiff(buf, live, obj, r.GVK, maybeNamespaced(r.Name, r.Namespace), m.filters(ctx)); err != nil {
+		return false, err
+	}
+	if _, err := m.diffOut.Write(buf.Bytes()); err != nil {
+		return false, err
+	}
+	changed := strings.Contains(buf.String(), "\n--- live\n")
+	if key == "" {
+		return changed, nil
+	}
+
+	var rv string
+	if live != nil {
+		rv = live.(metav1.Object).GetResourceVersion()
+	}
+	if rv != "" && !changed {
+		m.diffCache.set(key, diffCacheEntry{Hash: hash, ResourceVersion: rv})
+	} else {
+		m.diffCache.remove(key)
+	}
+	return changed, nil
+}
+
+// peekResourceVersion returns resourceVersion of object at url or empty
+// string if it doesn't exist.
+func (m *kubePackage) peekResourceVersion(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", partialMetadataAccept)
+
+	log.V(1).Infof("GET (metadata) to %s", url)
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, bs)
+	}
+
+	var meta metav1.PartialObjectMetadata
+	if err := json.Unmarshal(bs, &meta); err != nil {
+		return "", err
+	}
+	return meta.ResourceVersion, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestDiffCache(t *testing.T) {
+	const (
+		key  = "/api/v1/namespaces/default/configmaps/foo"
+		expr = `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`
+	)
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+	newKube := func(dryRun bool, out *bytes.Buffer, c *DiffCache) starlark.StringDict {
+		return starlark.StringDict{"kube": newTestPackage(s, nil, Options{
+			DryRun:    dryRun,
+			DiffOut:   out,
+			DiffCache: c,
+		})}
+	}
+	setResourceVersion := func(rv string) {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(h.m[key], &obj); err != nil {
+			t.Fatal(err)
+		}
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = rv
+		bs, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.m[key] = bs
+	}
+
+	if _, _, err := util.Eval(t.Name(), expr, sCtx, newKube(false, &bytes.Buffer{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	setResourceVersion("1")
+
+	path := filepath.Join(t.TempDir(), "cache", "diff.json")
+	c, err := LoadDiffCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		resourceVersion string
+		want            string
+	}{
+		{
+			name: "Not cached",
+			want: "\n*** configmap.v1 `default/foo' ***\n",
+		},
+		{
+			name: "Cached",
+			want: "\n*** configmap.v1 `default/foo' unchanged (cached) ***\n",
+		},
+		{
+			name:            "Live object changed",
+			resourceVersion: "2",
+			want:            "\n*** configmap.v1 `default/foo' ***\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.resourceVersion != "" {
+				setResourceVersion(tc.resourceVersion)
+			}
+			out := &bytes.Buffer{}
+			if _, _, err := util.Eval(t.Name(), expr, sCtx, newKube(true, out, c)); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.want {
+				t.Errorf("Unexpected output.\nWant: %q\nGot: %q", tc.want, out.String())
+			}
+		})
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDiffCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := loaded.Entries[s.URL+key]; e.ResourceVersion != "2" || e != c.Entries[s.URL+key] {
+		t.Errorf("Unexpected cache entry after reload: %+v", e)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/loader"
+)
+
+// manifest is a single YAML/JSON document read from file.
+type manifest struct {
+	file, data string
+}
+
+var docSeparatorRe = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// kubeApplyDirFn is entry point for `kube.apply_dir' callable:
+//
+//	kube.apply_dir("//manifests/", recursive=True, exclude=["*.md"], namespace="default")
+//
+// Paths starting with `//' or relative are resolved against the addon base
+// directory.
+func (m *kubePackage) kubeApplyDirFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var dir, namespace string
+	var recursive bool
+	exclude := &starlark.List{}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"path", &dir,
+		"recursive?", &recursive,
+		"exclude?", &exclude,
+		"namespace?", &namespace,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	var patterns []string
+	for i := 0; i < exclude.Len(); i++ {
+		p, ok := exclude.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: `exclude' must be a list of strings (got a `%s')", b.Name(), exclude.Index(i).Type())
+		}
+		if _, err := filepath.Match(string(p), ""); err != nil {
+			return nil, fmt.Errorf("<%v>: bad exclude pattern `%s': %v", b.Name(), p, err)
+		}
+		patterns = append(patterns, string(p))
+	}
+
+	baseDir, _ := t.Local(addon.BaseDirKey).(string)
+	root, _ := t.Local(addon.WorkspaceRootKey).(string)
+	path, err := loader.ResolveWorkspacePath(root, baseDir, dir)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	ms, err := readManifests(path, recursive, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	kinds := make([]string, len(ms))
+	for i, mf := range ms {
+		_, gvk, err := decode([]byte(mf.data))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to decode document in `%s': %v", b.Name(), mf.file, err)
+		}
+		kinds[i] = gvk.Kind
+	}
+	data := make([]starlark.Value, 0, len(ms))
+	for _, i := range applyOrder(kinds) {
+		data = append(data, starlark.String(ms[i].data))
+	}
+
+	val, err := m.Apply(t, "", namespace, starlark.NewList(data))
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return val, nil
+}
+
+// readManifests reads all YAML (.yaml, .yml) and JSON (.json) files in dir
+// (and its subdirectories if recursive) in lexical order, skipping files
+// whose name or path relative to dir matches any of exclude patterns.
+// Multi-document YAML files are split into separate manifests.
+func readManifests(dir string, recursive bool, exclude []string) ([]manifest, error) {
+	var ms []manifest
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && (!recursive || excluded(rel, exclude)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if excluded(rel, exclude) {
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			return nil
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if ext == ".json" {
+			ms = append(ms, manifest{file: path, data: string(bs)})
+			return nil
+		}
+		for _, doc := range docSeparatorRe.Split(string(bs), -1) {
+			if !emptyDoc(doc) {
+				ms = append(ms, manifest{file: path, data: strings.TrimSpace(doc)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func excluded(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, filepath.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyDoc returns true if YAML doc only contains comments and whitespace.
+func emptyDoc(doc string) bool {
+	for _, l := range strings.Split(doc, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "#") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestReadManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"a.yaml":         "# Leading comment.\n---\nkind: ConfigMap\n---\nkind: Service\n---\n",
+		"b.json":         `{"kind": "Namespace"}`,
+		"README.md":      "kind: Pod",
+		"skip.yaml":      "kind: Secret",
+		"sub/c.yml":      "kind: Deployment",
+		"vendor/d.yaml":  "kind: Role",
+		"sub/notes.txt":  "kind: Pod",
+		"sub/e.yaml.bak": "kind: Pod",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		recursive bool
+		want      []manifest
+	}{
+		{
+			name: "flat",
+			want: []manifest{
+				{file: "a.yaml", data: "kind: ConfigMap"},
+				{file: "a.yaml", data: "kind: Service"},
+				{file: "b.json", data: `{"kind": "Namespace"}`},
+			},
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			want: []manifest{
+				{file: "a.yaml", data: "kind: ConfigMap"},
+				{file: "a.yaml", data: "kind: Service"},
+				{file: "b.json", data: `{"kind": "Namespace"}`},
+				{file: "sub/c.yml", data: "kind: Deployment"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readManifests(dir, tc.recursive, []string{"skip.*", "vendor"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range got {
+				got[i].file, _ = filepath.Rel(dir, got[i].file)
+			}
+			if d := cmp.Diff(tc.want, got, cmp.AllowUnexported(manifest{})); d != "" {
+				t.Errorf("Unexpected manifests (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	kinds := []string{"ValidatingWebhookConfiguration", "Deployment", "MyCustomResource", "Service", "Namespace", "CustomResourceDefinition", "ConfigMap", "RoleBinding", "ClusterRole"}
+	var got []string
+	for _, i := range applyOrder(kinds) {
+		got = append(got, kinds[i])
+	}
+	want := []string{"Namespace", "CustomResourceDefinition", "ClusterRole", "RoleBinding", "ConfigMap", "Service", "Deployment", "MyCustomResource", "ValidatingWebhookConfiguration"}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected order (-want, +got):\n%s", d)
+	}
+}
+
+func TestSortYAML(t *testing.T) {
+	deploy := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: foo\n"
+	ns := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: foo\n"
+	cm := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"
+
+	got := SortYAML(starlark.NewList([]starlark.Value{starlark.String(deploy), starlark.String(ns), starlark.String(cm)}))
+	want := starlark.NewList([]starlark.Value{starlark.String(ns), starlark.String(cm), starlark.String(deploy)})
+	if eq, err := starlark.Equal(want, got); err != nil || !eq {
+		t.Errorf("Unexpected order.\nWant: %v\nGot: %v", want, got)
+	}
+
+	// Lists with undecodable items are left as is.
+	bad := starlark.NewList([]starlark.Value{starlark.String(deploy), starlark.MakeInt(42), starlark.String(ns)})
+	if got := SortYAML(bad); got != bad {
+		t.Errorf("Expected list with bad item to be unchanged, got: %v", got)
+	}
+}
+
+func TestSortProtos(t *testing.T) {
+	data := starlark.NewList([]starlark.Value{
+		skycfg.NewProtoMessage(&corev1.Pod{}),
+		skycfg.NewProtoMessage(&rbacv1.RoleBinding{}),
+		skycfg.NewProtoMessage(&corev1.Namespace{}),
+	})
+	sorted := sortProtos(data)
+	var got []string
+	for i := 0; i < sorted.Len(); i++ {
+		msg, _ := skycfg.AsProtoMessage(sorted.Index(i))
+		_, _, k, err := guessGVKFromMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, k)
+	}
+	want := []string{"Namespace", "RoleBinding", "Pod"}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected order (-want, +got):\n%s", d)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+)
+
+// kubeHasAPIFn is an entry point for `kube.has_api` built-in. Returns True
+// if cluster serves the API group (optionally restricted to version and
+// kind):
+//
+//	kube.has_api(group="autoscaling.k8s.io", version="v1", kind="VerticalPodAutoscaler")
+//
+// Empty group is the core API group.
+func (m *kubePackage) kubeHasAPIFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var group, version, kind string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "group", &group, "version?", &version, "kind?", &kind); err != nil {
+		return nil, err
+	}
+
+	groups, err := m.dClient.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to discover API groups: %v", b.Name(), err)
+	}
+
+	var versions []string
+	for _, g := range groups.Groups {
+		if g.Name != group {
+			continue
+		}
+		for _, v := range g.Versions {
+			if version == "" || v.Version == version {
+				versions = append(versions, v.GroupVersion)
+			}
+		}
+	}
+	if len(versions) == 0 || kind == "" {
+		return starlark.Bool(len(versions) != 0), nil
+	}
+
+	for _, gv := range versions {
+		rs, err := m.dClient.ServerResourcesForGroupVersion(gv)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to discover resources of `%s': %v", b.Name(), gv, err)
+		}
+		for _, r := range rs.APIResources {
+			// Skip subresources (e.g `deployments/scale') that may have
+			// different kind.
+			if r.Kind == kind && !strings.Contains(r.Name, "/") {
+				return starlark.True, nil
+			}
+		}
+	}
+	return starlark.False, nil
+}
+
+// kubeServerVersionFn is an entry point for `kube.server_version` built-in.
+// Returns struct with `git_version' string and `major', `minor' int fields
+// (e.g "v1.21.3-gke.2001", 1 and 21).
+func (m *kubePackage) kubeServerVersionFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+
+	v, err := m.dClient.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to get server version: %v", b.Name(), err)
+	}
+
+	// Some vendors report minor version like `21+'.
+	major, err := strconv.Atoi(strings.TrimSuffix(v.Major, "+"))
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: unexpected major version `%s'", b.Name(), v.Major)
+	}
+	minor, err := strconv.Atoi(strings.TrimSuffix(v.Minor, "+"))
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: unexpected minor version `%s'", b.Name(), v.Minor)
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"git_version": starlark.String(v.GitVersion),
+		"major":       starlark.MakeInt(major),
+		"minor":       starlark.MakeInt(minor),
+	}), nil
+}
+
+// APIDiscoverer is implemented by kube packages that discover what the
+// cluster serves (e.g for .Capabilities of Helm charts).
+type APIDiscoverer interface {
+	// ServerAPIs returns version of the cluster and API versions it serves,
+	// both as group versions (e.g `apps/v1') and group versions with kinds
+	// (e.g `apps/v1/Deployment').
+	ServerAPIs() (*version.Info, []string, error)
+}
+
+// ServerAPIs implements APIDiscoverer.ServerAPIs.
+func (m *kubePackage) ServerAPIs() (*version.Info, []string, error) {
+	info, err := m.dClient.ServerVersion()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get server version: %v", err)
+	}
+
+	_, lists, err := m.dClient.ServerGroupsAndResources()
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return nil, nil, fmt.Errorf("failed to discover API resources: %v", err)
+		}
+		log.Warningf("Some API groups were not discovered: %v", err)
+	}
+
+	var apis []string
+	for _, l := range lists {
+		apis = append(apis, l.GroupVersion)
+		for _, r := range l.APIResources {
+			if !strings.Contains(r.Name, "/") {
+				apis = append(apis, l.GroupVersion+"/"+r.Kind)
+			}
+		}
+	}
+	return info, apis, nil
+}
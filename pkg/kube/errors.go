@@ -0,0 +1,77 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// maxSnippetLines is the number of lines of an offending object included in
+// errors.
+const maxSnippetLines = 15
+
+// itemError annotates err returned for data item i of a kube builtin called
+// from t with the object it failed on (gvk and name, if known, and a snippet
+// of src) and the Starlark call stack so that the item can be found in long
+// lists.
+func itemError(t *starlark.Thread, i int, gvk *schema.GroupVersionKind, name string, src []byte, err error) error {
+	desc := fmt.Sprintf("item %d", i)
+	if gvk != nil {
+		desc += " (" + diffName(*gvk, name) + ")"
+	}
+	var extra string
+	// Values of secrets must not end up in errors.
+	if s := snippet(src); s != "" && (gvk == nil || gvk.Kind != "Secret") {
+		extra += "\n\n" + s
+	}
+	if t != nil {
+		extra += fmt.Sprintf("\n\n%s", t.CallStack())
+	}
+	return fmt.Errorf("%s: %w%s", desc, err, extra)
+}
+
+// snippet returns at most maxSnippetLines of src indented for readability.
+func snippet(src []byte) string {
+	lines := strings.Split(strings.Trim(string(src), "\n"), "\n")
+	if len(lines) == 1 && strings.TrimSpace(lines[0]) == "" {
+		return ""
+	}
+	var more string
+	if len(lines) > maxSnippetLines {
+		more = fmt.Sprintf("\n    ... (%d more lines)", len(lines)-maxSnippetLines)
+		lines = lines[:maxSnippetLines]
+	}
+	return "    " + strings.Join(lines, "\n    ") + more
+}
+
+// yamlSnippetSource returns YAML rendering of obj for use with itemError
+// (nil if it can't be rendered).
+func yamlSnippetSource(obj interface{}) []byte {
+	js, err := json.Marshal(obj)
+	if err != nil {
+		return nil
+	}
+	bs, err := yaml.JSONToYAML(js)
+	if err != nil {
+		return nil
+	}
+	return bs
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestItemError(t *testing.T) {
+	errFailed := errors.New("failed")
+	cm := &schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secret := &schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+
+	var long []string
+	for i := 0; i < maxSnippetLines+5; i++ {
+		long = append(long, fmt.Sprintf("k%d: v", i))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		gvk     *schema.GroupVersionKind
+		src     string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "Unknown kind",
+			src:  "foo: bar\n",
+			want: []string{"item 3: failed\n\n    foo: bar"},
+		},
+		{
+			name: "Kind and name",
+			gvk:  cm,
+			src:  "kind: ConfigMap\n",
+			want: []string{"item 3 (configmap.v1 `default/foo'): failed\n\n    kind: ConfigMap"},
+		},
+		{
+			name:    "Truncated snippet",
+			gvk:     cm,
+			src:     strings.Join(long, "\n"),
+			want:    []string{fmt.Sprintf("    k%d: v\n    ... (5 more lines)", maxSnippetLines-1)},
+			notWant: []string{fmt.Sprintf("k%d: v", maxSnippetLines)},
+		},
+		{
+			name:    "Secret",
+			gvk:     secret,
+			src:     "kind: Secret\ndata:\n  password: aHVudGVyMg==\n",
+			want:    []string{"item 3 (secret.v1 `default/foo'): failed"},
+			notWant: []string{"aHVudGVyMg=="},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := itemError(nil, 3, tc.gvk, "default/foo", []byte(tc.src), errFailed)
+			if !errors.Is(err, errFailed) {
+				t.Errorf("Expected error to wrap the original error, got: %v", err)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("Expected error to contain:\n%s\ngot:\n%s", w, err)
+				}
+			}
+			for _, w := range tc.notWant {
+				if strings.Contains(err.Error(), w) {
+					t.Errorf("Expected error not to contain `%s', got:\n%s", w, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPutYamlItemError(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{
+		Policy: &Policy{DenyNamespaces: []string{"kube-system"}},
+	})
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+	expr := `kube.put_yaml(name="foo", namespace="default", data=[
+		"apiVersion: v1\nkind: ConfigMap\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: bar\n  namespace: kube-system\n",
+	])`
+	_, _, err := util.Eval("kube", expr, sCtx, starlark.StringDict{"kube": pkg})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, w := range []string{
+		"<kube.put_yaml>: item 1 (configmap.v1 `kube-system/bar'): ",
+		"\n    metadata:\n      name: bar\n",
+		"Traceback (most recent call last):",
+		"in kube.put_yaml",
+	} {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Expected error to contain:\n%s\ngot:\n%s", w, err)
+		}
+	}
+}
@@ -15,31 +15,59 @@
 package kube
 
 import (
+	"strconv"
+
 	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cruise-automation/isopod/pkg/kpath"
 )
 
 // filterYaml will deep copy m and remove the element at the yamlPath.
 func filterYaml(m yaml.MapSlice, yamlPath ...string) yaml.MapSlice {
-	var out yaml.MapSlice
-	for _, item := range m {
-		if f, ok := item.Key.(string); ok && f == yamlPath[0] {
-			// path match found, skip element
-			if len(yamlPath) == 1 {
-				continue
-			}
+	path := make([]kpath.Segment, len(yamlPath))
+	for i, p := range yamlPath {
+		path[i] = kpath.Segment{Key: p}
+	}
+	return filterPath(m, path).(yaml.MapSlice)
+}
 
-			// path match found, recurse into children
-			if mm, ok := item.Value.(yaml.MapSlice); ok && len(yamlPath) > 1 {
+// filterPath will deep copy v and remove all elements matching path. Array
+// elements are matched by their index.
+func filterPath(v interface{}, path []kpath.Segment) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		var out yaml.MapSlice
+		for _, item := range v {
+			if f, ok := item.Key.(string); ok && path[0].Match(f, item.Value) {
+				// path match found, skip element
+				if len(path) == 1 {
+					continue
+				}
+
+				// path match found, recurse into children
 				item = yaml.MapItem{
 					Key:   item.Key,
-					Value: filterYaml(mm, yamlPath[1:]...),
+					Value: filterPath(item.Value, path[1:]),
 				}
 			}
-		}
 
-		out = append(out, item)
+			out = append(out, item)
+		}
+		return out
+	case []interface{}:
+		var out []interface{}
+		for i, e := range v {
+			if path[0].Match(strconv.Itoa(i), e) {
+				if len(path) == 1 {
+					continue
+				}
+				e = filterPath(e, path[1:])
+			}
+			out = append(out, e)
+		}
+		return out
 	}
-	return out
+	return v
 }
 
 func filterEmpty(m yaml.MapSlice) yaml.MapSlice {
@@ -0,0 +1,150 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto" //nolint:staticcheck
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+const (
+	kubeForEachMethod = "for_each"
+
+	// defaultPageSize is the number of objects kube.for_each requests per
+	// page by default.
+	defaultPageSize = 500
+)
+
+// kubeForEachFn is an entry point for `kube.for_each' built-in:
+//
+//	kube.for_each(pod="kube-system/", fn=check, label_selector="app=dns")
+//
+// It lists objects of the resource in the namespace (or in all namespaces if
+// the namespace is empty) a page at a time and calls fn with each object so
+// that only a page of objects is in memory at once. Iteration stops early if
+// fn returns False.
+func (m *kubePackage) kubeForEachFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("<%v>: positional args not supported: %v", b.Name(), args)
+	}
+	if len(kwargs) < 1 {
+		return nil, fmt.Errorf("<%v>: expected <resource>=<namespace>/", b.Name())
+	}
+
+	resource, namespace, err := getResourceAndName(kwargs[0])
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %s", b.Name(), err.Error())
+	}
+	if namespace != "" && (!strings.HasSuffix(namespace, "/") || strings.Count(namespace, "/") != 1) {
+		return nil, fmt.Errorf("<%v>: expected <resource>=<namespace>/ (got `%s')", b.Name(), namespace)
+	}
+	namespace = strings.TrimSuffix(namespace, "/")
+
+	var fn starlark.Callable
+	var apiGroup, labelSelector, fieldSelector string
+	var wantJSON bool
+	pageSize := defaultPageSize
+	if err := starlark.UnpackArgs(b.Name(), nil, kwargs[1:],
+		"fn", &fn,
+		apiGroupKW+"?", &apiGroup,
+		"label_selector?", &labelSelector,
+		"field_selector?", &fieldSelector,
+		"page_size?", &pageSize,
+		"json?", &wantJSON,
+	); err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("<%v>: `page_size' must be positive (got %d)", b.Name(), pageSize)
+	}
+
+	r, err := newResource(m.dClient, "", namespace, apiGroup, resource, "")
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(namespace)
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	opts := metav1.ListOptions{
+		LabelSelector: labelSelector,
+		FieldSelector: fieldSelector,
+		Limit:         int64(pageSize),
+	}
+	for {
+		log.V(1).Infof("LIST %s (continue: %q)", r.Path(), opts.Continue)
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to list %s%s: %v", b.Name(), resource, maybeCore(apiGroup), err)
+		}
+		for i := range page.Items {
+			item, err := forEachItem(&page.Items[i], wantJSON)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			ret, err := starlark.Call(t, fn, starlark.Tuple{item}, nil)
+			if err != nil {
+				return nil, err
+			}
+			if ret == starlark.False {
+				return starlark.None, nil
+			}
+		}
+		if opts.Continue = page.GetContinue(); opts.Continue == "" {
+			return starlark.None, nil
+		}
+	}
+}
+
+// forEachItem converts un into the value kube.for_each passes to its
+// callback: a proto message (same as kube.get) or a dict if wantJSON is set.
+func forEachItem(un *unstructured.Unstructured, wantJSON bool) (starlark.Value, error) {
+	gvk := un.GroupVersionKind()
+	obj, err := Scheme.New(gvk)
+	if err != nil {
+		if !wantJSON {
+			return nil, fmt.Errorf("kind `%s' is unknown, use json=True to get objects as dicts", gvk.Kind)
+		}
+		return util.ValueFromNestedMap(un.Object)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, obj); err != nil {
+		return nil, fmt.Errorf("failed to convert %s `%s': %v", strings.ToLower(gvk.Kind), maybeNamespaced(un.GetName(), un.GetNamespace()), err)
+	}
+	trackSecret(obj)
+	if wantJSON {
+		return util.ValueFromNestedMap(un.Object)
+	}
+	p, ok := obj.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("could not convert object to proto: %v", obj)
+	}
+	return skycfg.NewProtoMessage(p), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestKubeForEach(t *testing.T) {
+	const numPods = 5
+	var gotReqs []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		gotReqs = append(gotReqs, r.URL.Path+"?"+q.Encode())
+
+		// Continue token is the index of the first pod of the page.
+		start, _ := strconv.Atoi(q.Get("continue"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		l := &corev1.PodList{TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"}}
+		for i := start; i < numPods && i < start+limit; i++ {
+			l.Items = append(l.Items, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i), Namespace: "bar"}})
+		}
+		if next := start + limit; next < numPods {
+			l.Continue = strconv.Itoa(next)
+		}
+		if err := json.NewEncoder(w).Encode(l); err != nil {
+			t.Errorf("Failed to encode list: %v", err)
+		}
+	}))
+	defer s.Close()
+
+	kube := &kubePackage{
+		dClient:   fakeDiscovery(),
+		dynClient: dynamic.NewForConfigOrDie(&rest.Config{Host: s.URL}),
+	}
+	const callbacks = `
+def collect(p):
+    names.append(p.metadata.name)
+
+def collect_json(p):
+    names.append(p["metadata"]["name"])
+
+def collect_three(p):
+    names.append(p.metadata.name)
+    return len(names) < 3
+`
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, tc := range []struct {
+		name     string
+		expr     string
+		want     string
+		wantReqs []string
+		wantErr  string
+	}{
+		{
+			name: "Pages",
+			expr: `kube.for_each(pod="bar/", fn=collect, page_size=2, label_selector="app=x")`,
+			want: `["pod-0", "pod-1", "pod-2", "pod-3", "pod-4"]`,
+			wantReqs: []string{
+				"/api/v1/namespaces/bar/pods?labelSelector=app%3Dx&limit=2",
+				"/api/v1/namespaces/bar/pods?continue=2&labelSelector=app%3Dx&limit=2",
+				"/api/v1/namespaces/bar/pods?continue=4&labelSelector=app%3Dx&limit=2",
+			},
+		},
+		{
+			name:     "All namespaces as JSON",
+			expr:     `kube.for_each(pod="", fn=collect_json, json=True)`,
+			want:     `["pod-0", "pod-1", "pod-2", "pod-3", "pod-4"]`,
+			wantReqs: []string{"/api/v1/pods?limit=500"},
+		},
+		{
+			name:     "Stop early",
+			expr:     `kube.for_each(pod="bar/", fn=collect_three, page_size=2)`,
+			want:     `["pod-0", "pod-1", "pod-2"]`,
+			wantReqs: []string{"/api/v1/namespaces/bar/pods?limit=2", "/api/v1/namespaces/bar/pods?continue=2&limit=2"},
+		},
+		{
+			name:    "Object name",
+			expr:    `kube.for_each(pod="bar/foo", fn=print)`,
+			wantErr: "<kube.for_each>: expected <resource>=<namespace>/ (got `bar/foo')",
+		},
+		{
+			name:    "Bad page size",
+			expr:    `kube.for_each(pod="bar/", fn=print, page_size=0)`,
+			wantErr: "<kube.for_each>: `page_size' must be positive (got 0)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotReqs = nil
+			names := &starlark.List{}
+			pkgs := starlark.StringDict{"kube": kube, "names": names}
+			fns, err := starlark.ExecFile(&starlark.Thread{}, "callbacks.star", callbacks, pkgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n, fn := range fns {
+				pkgs[n] = fn
+			}
+			_, _, err = util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := names.String(); got != tc.want {
+				t.Errorf("Unexpected objects.\nWant: %s\nGot: %s", tc.want, got)
+			}
+			if d := cmp.Diff(tc.wantReqs, gotReqs); d != "" {
+				t.Errorf("Unexpected requests (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -22,10 +22,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
@@ -36,6 +38,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"sigs.k8s.io/yaml"
@@ -46,6 +49,10 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/secretref"
+	"github.com/cruise-automation/isopod/pkg/store"
 	"github.com/cruise-automation/isopod/pkg/util"
 )
 
@@ -64,29 +71,133 @@ type kubePackage struct {
 	force       bool
 	diff        bool
 	diffFilters []string
+	// recorder records intended mutations when computing a plan (nil
+	// otherwise).
+	recorder *plan.Recorder
+	// diffOut is where diffs are written to.
+	diffOut io.Writer
+	// secretResolver resolves secret references when applying objects.
+	secretResolver secretref.Resolver
+	// diffCache skips diffs of unchanged objects in dry run (nil if
+	// disabled).
+	diffCache *DiffCache
+	// policy restricts objects that may be mutated (nil if unrestricted).
+	policy *Policy
+	// skipAPIServiceWait disables waiting for put APIServices to become
+	// available (set by the fake which has no aggregator).
+	skipAPIServiceWait bool
+	// autoMigrateAPIs applies objects of deprecated API versions in their
+	// equivalent replacement versions (see checkDeprecatedAPI).
+	autoMigrateAPIs bool
+	// strictOwnership fails updates overwriting fields managed by other
+	// managers instead of warning (see checkOwnership).
+	strictOwnership bool
+	// skipMetadata disables the heritage label, addon version labels and
+	// context annotation unless a call sets manage_metadata=True.
+	skipMetadata bool
+	// readOnly fails all mutations outside of dry run (see
+	// checkWritable).
+	readOnly bool
+	// defaultNs is the namespace of namespaced objects without one (see
+	// inDefaultNamespace).
+	defaultNs string
+
+	// ctxMode is how addon contexts are annotated and ctxs are contexts
+	// annotated by hash since the last TakeContexts.
+	ctxMode ContextMode
+	ctxMu   sync.Mutex
+	ctxs    map[string]string
+
+	// release is the cluster's Kubernetes release (discovered once).
+	releaseOnce  sync.Once
+	release      kubeVersion
+	releaseKnown bool
+	// deprecationWarned are kinds of deprecated API versions already warned
+	// about.
+	deprecationMu     sync.Mutex
+	deprecationWarned map[schema.GroupVersionKind]bool
+	// crdSchemas are OpenAPI schemas of custom resource kinds used to
+	// default objects before diffing them.
+	crdSchemaMu sync.Mutex
+	crdSchemas  map[schema.GroupVersionKind]map[string]interface{}
+
+	// stats counts mutated objects since the last TakeStats.
+	statsMu sync.Mutex
+	stats   Stats
+
+	// appliedRefs are objects applied since the last TakeApplied and
+	// snapshots are their states before they were applied.
+	appliedMu   sync.Mutex
+	appliedRefs []store.ObjRef
+	snapshots   []snapshot
+	// snapshotFn persists objects before they are mutated (nil if
+	// disabled).
+	snapshotFn SnapshotFunc
+
+	// touched are objects mutated since touchedSince (see Diagnoser).
+	touchedMu    sync.Mutex
+	touched      []touchedObj
+	touchedSince time.Time
+
 	// host:port of the master endpoint.
 	Master string
 }
 
+// Options configure kube package returned by New.
+type Options struct {
+	// DryRun prints diffs of mutations instead of making them.
+	DryRun bool
+	// Force recreates immutable objects that can't be updated (may be
+	// overridden by addons and calls).
+	Force bool
+	// Diff prints diffs of objects before updating them.
+	Diff bool
+	// DiffFilters are paths of fields ignored by diffs.
+	DiffFilters []string
+	// Recorder records intended mutations instead of making them when
+	// computing a plan (nil otherwise).
+	Recorder *plan.Recorder
+	// DiffOut is where diffs are written to (stdout if nil).
+	DiffOut io.Writer
+	// SecretResolver resolves secret references when applying objects (nil
+	// if not supported).
+	SecretResolver secretref.Resolver
+	// DiffCache skips diffs of unchanged objects in dry run (nil if
+	// disabled).
+	DiffCache *DiffCache
+	// Policy restricts objects that may be mutated (nil if unrestricted).
+	Policy *Policy
+}
+
 // New returns a new skaylark.HasAttrs object for kube package.
 func New(
 	addr string,
 	d discovery.DiscoveryInterface,
 	dynC dynamic.Interface,
 	c *http.Client,
-	dryRun, force, diff bool,
-	diffFilters []string,
+	o Options,
 ) starlark.HasAttrs {
+	diffOut := o.DiffOut
+	if diffOut == nil {
+		diffOut = os.Stdout
+	}
+	// Diffs may include values of secrets embedded in non-Secret objects.
+	diffOut = redact.Writer(diffOut)
 
 	return &kubePackage{
-		dClient:     d,
-		dynClient:   dynC,
-		httpClient:  c,
-		Master:      addr,
-		dryRun:      dryRun,
-		force:       force,
-		diff:        diff,
-		diffFilters: diffFilters,
+		dClient:        d,
+		dynClient:      dynC,
+		httpClient:     c,
+		Master:         addr,
+		dryRun:         o.DryRun,
+		force:          o.Force,
+		diff:           o.Diff,
+		diffFilters:    o.DiffFilters,
+		recorder:       o.Recorder,
+		diffOut:        diffOut,
+		secretResolver: o.SecretResolver,
+		diffCache:      o.DiffCache,
+		policy:         o.Policy,
 	}
 }
 
@@ -112,11 +223,39 @@ const (
 	kubeFromStrMethod          = "from_str"
 	kubeGetMethod              = "get"
 	kubeExistsMethod           = "exists"
+	kubeApplyDirMethod         = "apply_dir"
+	kubeHasAPIMethod           = "has_api"
+	kubeWaitAPIMethod          = "wait_api"
+	kubeInjectCABundleMethod   = "inject_ca_bundle"
+	kubeCordonMethod           = "cordon"
+	kubeUncordonMethod         = "uncordon"
+	kubeDrainMethod            = "drain"
+	kubeServerVersionMethod    = "server_version"
 	kubePutMethod              = "put"
 	kubePutYamlMethod          = "put_yaml"
 	kubeResourceQuantityMethod = "resource_quantity"
+	kubeQuantityAddMethod      = "quantity_add"
+	kubeQuantitySubMethod      = "quantity_sub"
+	kubeQuantityMulMethod      = "quantity_mul"
+	kubeQuantityPercentMethod  = "quantity_percent"
+	kubeQuantityCmpMethod      = "quantity_cmp"
+	kubeQuantityMinMethod      = "quantity_min"
+	kubeQuantityMaxMethod      = "quantity_max"
+	kubeQuantityValueMethod    = "quantity_value"
 )
 
+// quantityBuiltins are quantity arithmetic built-ins by method name.
+var quantityBuiltins = map[string]func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error){
+	kubeQuantityAddMethod:     quantityAddFn,
+	kubeQuantitySubMethod:     quantitySubFn,
+	kubeQuantityMulMethod:     quantityMulFn,
+	kubeQuantityPercentMethod: quantityPercentFn,
+	kubeQuantityCmpMethod:     quantityCmpFn,
+	kubeQuantityMinMethod:     quantityMinFn,
+	kubeQuantityMaxMethod:     quantityMaxFn,
+	kubeQuantityValueMethod:   quantityValueFn,
+}
+
 // Attr implement starlark.HasAttrs.Attr.
 func (m *kubePackage) Attr(name string) (starlark.Value, error) {
 	switch name {
@@ -130,12 +269,47 @@ func (m *kubePackage) Attr(name string) (starlark.Value, error) {
 		return starlark.NewBuiltin("kube."+kubeGetMethod, m.kubeGetFn), nil
 	case kubeExistsMethod:
 		return starlark.NewBuiltin("kube."+kubeExistsMethod, m.kubeExistsFn), nil
+	case kubeForEachMethod:
+		return starlark.NewBuiltin("kube."+kubeForEachMethod, m.kubeForEachFn), nil
+	case kubeScaleMethod:
+		return starlark.NewBuiltin("kube."+kubeScaleMethod, m.kubeScaleFn), nil
+	case kubeMetricsMethod:
+		return starlark.NewBuiltin("kube."+kubeMetricsMethod, m.kubeMetricsFn), nil
+	case kubeAnnotateMethod:
+		return starlark.NewBuiltin("kube."+kubeAnnotateMethod, m.kubeAnnotateFn), nil
+	case kubeLabelMethod:
+		return starlark.NewBuiltin("kube."+kubeLabelMethod, m.kubeLabelFn), nil
+	case kubeHasAPIMethod:
+		return starlark.NewBuiltin("kube."+kubeHasAPIMethod, m.kubeHasAPIFn), nil
+	case kubeWaitAPIMethod:
+		return starlark.NewBuiltin("kube."+kubeWaitAPIMethod, m.kubeWaitAPIFn), nil
+	case kubeInjectCABundleMethod:
+		return starlark.NewBuiltin("kube."+kubeInjectCABundleMethod, m.kubeInjectCABundleFn), nil
+	case kubeCordonMethod:
+		return starlark.NewBuiltin("kube."+kubeCordonMethod, m.kubeCordonFn), nil
+	case kubeUncordonMethod:
+		return starlark.NewBuiltin("kube."+kubeUncordonMethod, m.kubeUncordonFn), nil
+	case kubeDrainMethod:
+		return starlark.NewBuiltin("kube."+kubeDrainMethod, m.kubeDrainFn), nil
+	case kubeServerVersionMethod:
+		return starlark.NewBuiltin("kube."+kubeServerVersionMethod, m.kubeServerVersionFn), nil
 	case kubePutMethod:
 		return starlark.NewBuiltin("kube."+kubePutMethod, m.kubePutFn), nil
+	case kubePutForEachMethod:
+		return starlark.NewBuiltin("kube."+kubePutForEachMethod, m.kubePutForEachFn), nil
+	case kubeTryGetMethod:
+		return starlark.NewBuiltin("kube."+kubeTryGetMethod, m.kubeTryGetFn), nil
 	case kubePutYamlMethod:
 		return starlark.NewBuiltin("kube."+kubePutYamlMethod, m.kubePutYamlFn), nil
+	case kubeApplyDirMethod:
+		return starlark.NewBuiltin("kube."+kubeApplyDirMethod, m.kubeApplyDirFn), nil
 	case kubeResourceQuantityMethod:
 		return starlark.NewBuiltin("kube."+kubeResourceQuantityMethod, resourceQuantityFn), nil
+	case kubeChecksumAnnotationMethod:
+		return starlark.NewBuiltin("kube."+kubeChecksumAnnotationMethod, checksumAnnotationFn), nil
+	}
+	if fn, ok := quantityBuiltins[name]; ok {
+		return starlark.NewBuiltin("kube."+name, fn), nil
 	}
 	return nil, fmt.Errorf("unexpected attr: %s", name)
 }
@@ -144,11 +318,35 @@ func (m *kubePackage) Attr(name string) (starlark.Value, error) {
 func (m *kubePackage) AttrNames() []string {
 	return []string{
 		kubeGetMethod,
+		kubeTryGetMethod,
 		kubeExistsMethod,
+		kubeForEachMethod,
+		kubeMetricsMethod,
+		kubeHasAPIMethod,
+		kubeWaitAPIMethod,
+		kubeServerVersionMethod,
 		kubePutMethod,
+		kubePutForEachMethod,
 		kubeDeleteMethod,
+		kubeAnnotateMethod,
+		kubeLabelMethod,
+		kubeScaleMethod,
 		kubeResourceQuantityMethod,
+		kubeQuantityAddMethod,
+		kubeQuantitySubMethod,
+		kubeQuantityMulMethod,
+		kubeQuantityPercentMethod,
+		kubeQuantityCmpMethod,
+		kubeQuantityMinMethod,
+		kubeQuantityMaxMethod,
+		kubeQuantityValueMethod,
 		kubePutYamlMethod,
+		kubeApplyDirMethod,
+		kubeInjectCABundleMethod,
+		kubeCordonMethod,
+		kubeUncordonMethod,
+		kubeDrainMethod,
+		kubeChecksumAnnotationMethod,
 	}
 }
 
@@ -156,8 +354,28 @@ func (m *kubePackage) AttrNames() []string {
 // Isopod-provisioned objects.
 const ctxAnnotationKey = "isopod.getcruise.com/context"
 
-// setMetadata sets metadata fields on the obj.
-func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, obj runtime.Object) error {
+// AddonVersionLabelKey is the key of a label set to the version of the remote
+// module the addon was loaded from (if any).
+const AddonVersionLabelKey = "isopod.getcruise.com/addon-version"
+
+// MetadataManager is implemented by kube packages that label and annotate
+// the objects they apply.
+type MetadataManager interface {
+	// SetManageMetadata enables (default) or disables the heritage label,
+	// addon version labels and context annotation for calls that don't
+	// set manage_metadata.
+	SetManageMetadata(manage bool)
+}
+
+// SetManageMetadata implements MetadataManager.SetManageMetadata.
+func (m *kubePackage) SetManageMetadata(manage bool) {
+	m.skipMetadata = !manage
+}
+
+// setMetadata sets metadata fields on the obj. Isopod's labels and context
+// annotation are only set if metadata is managed in ctx (see
+// withManageMetadata), the Helm release label is always set.
+func (m *kubePackage) setMetadata(ctx context.Context, tCtx *addon.SkyCtx, name, namespace string, obj runtime.Object) error {
 	a := meta.NewAccessor()
 
 	objName, err := a.Name(obj)
@@ -184,6 +402,12 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 			return err
 		}
 	}
+	if err := setReleaseLabel(ctx, obj); err != nil {
+		return err
+	}
+	if !m.managesMetadata(ctx) {
+		return nil
+	}
 
 	ls, err := a.Labels(obj)
 	if err != nil {
@@ -200,7 +424,10 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 			return err
 		}
 		if len(version) >= 2 && version[0] == '"' && version[len(version)-1] == '"' {
+			// addon_version is kept for selectors predating
+			// AddonVersionLabelKey.
 			ls["addon_version"] = string(version[1 : len(version)-1])
+			ls[AddonVersionLabelKey] = string(version[1 : len(version)-1])
 		}
 	}
 	if err := a.SetLabels(obj, ls); err != nil {
@@ -219,7 +446,7 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 	if err != nil {
 		return err
 	}
-	as[ctxAnnotationKey] = string(bs)
+	m.setCtxAnnotation(as, bs)
 	return a.SetAnnotations(obj, as)
 }
 
@@ -243,7 +470,10 @@ func getResourceAndName(resArg starlark.Tuple) (resource, name string, err error
 // TODO(dmitry-ilyevskiy): Return Status object from the response as Starlark dict.
 func (m *kubePackage) kubePutFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var name, namespace, apiGroup, subresource string
+	order := OrderKind
 	data := &starlark.List{}
+	var force, manageMetadata starlark.Value = starlark.None, starlark.None
+	wait := true
 	unpacked := []interface{}{
 		"name", &name,
 		"data", &data,
@@ -252,35 +482,95 @@ func (m *kubePackage) kubePutFn(t *starlark.Thread, b *starlark.Builtin, args st
 		// is resolved upstream.
 		"api_group?", &apiGroup,
 		"subresource?", &subresource,
+		"order?", &order,
+		"force?", &force,
+		"manage_metadata?", &manageMetadata,
+		"wait?", &wait,
 	}
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
+	if err := CheckOrder(order); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if order == OrderKind {
+		data = sortProtos(data)
+	}
 
+	a := &putArgs{
+		name:           name,
+		namespace:      namespace,
+		apiGroup:       apiGroup,
+		subresource:    subresource,
+		force:          force,
+		manageMetadata: manageMetadata,
+		skipWait:       !wait,
+	}
 	for i := 0; i < data.Len(); i++ {
 		maybeMsg := data.Index(i)
 		msg, ok := skycfg.AsProtoMessage(maybeMsg)
 		if !ok {
 			return nil, fmt.Errorf("<%v>: item %d is not a protobuf type. got: %s", b.Name(), i, maybeMsg.Type())
 		}
-
-		sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
-		if err := m.setMetadata(sCtx, name, namespace, msg.(runtime.Object)); err != nil {
-			return nil, fmt.Errorf("<%v>: failed to validate/apply metadata for object %d => %v: %v", b.Name(), i, maybeMsg.Type(), err)
+		if err := m.putItem(t, i, maybeMsg.Type(), msg, a); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 		}
+	}
 
-		r, err := newResourceForMsg(m.dClient, name, namespace, apiGroup, subresource, msg)
-		if err != nil {
-			return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	return starlark.None, nil
+}
+
+// putArgs are arguments of `kube.put' applied to each of its objects.
+type putArgs struct {
+	name, namespace, apiGroup, subresource string
+	force, manageMetadata                  starlark.Value
+	// skipWait disables waiting for put APIServices to become available.
+	skipWait bool
+}
+
+// putItem applies msg (item i of type typ) as set by a.
+func (m *kubePackage) putItem(t *starlark.Thread, i int, typ string, msg proto.Message, a *putArgs) error {
+	fail := func(r *apiResource, err error) error {
+		var gvk *schema.GroupVersionKind
+		objName := maybeNamespaced(a.name, a.namespace)
+		if r != nil {
+			gvk, objName = &r.GVK, maybeNamespaced(r.Name, r.Namespace)
+		} else if g, v, k, gErr := guessGVKFromMsg(msg); gErr == nil {
+			gvk = &schema.GroupVersionKind{Group: g, Version: v, Kind: k}
 		}
+		return itemError(t, i, gvk, objName, yamlSnippetSource(msg), err)
+	}
 
-		ctx := t.Local(addon.GoCtxKey).(context.Context)
-		if err := m.kubeUpdate(ctx, r, msg); err != nil {
-			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	ctx := withAPIServiceWait(m.withManageMetadata(m.updateCtx(t, a.force), a.manageMetadata), !a.skipWait)
+	sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
+	if err := m.setMetadata(ctx, sCtx, a.name, a.namespace, msg.(runtime.Object)); err != nil {
+		return fail(nil, fmt.Errorf("failed to validate/apply metadata => %v: %v", typ, err))
+	}
+	migrated, group, err := m.checkDeprecatedMsg(msg, a.apiGroup)
+	if err != nil {
+		return fail(nil, err)
+	}
+	msg = migrated
+
+	r, err := newResourceForMsg(m.dClient, a.name, a.namespace, group, a.subresource, msg)
+	if err != nil {
+		return fail(nil, fmt.Errorf("failed to map resource: %v", err))
+	}
+	if ok, err := m.inDefaultNamespace(r); err != nil {
+		return fail(nil, fmt.Errorf("failed to map resource: %v", err))
+	} else if ok {
+		if err := meta.NewAccessor().SetNamespace(msg.(runtime.Object), r.Namespace); err != nil {
+			return fail(r, err)
 		}
 	}
 
-	return starlark.None, nil
+	if err := m.kubeUpdate(ctx, r, msg); err != nil {
+		return fail(r, err)
+	}
+	if err := m.waitAPIService(ctx, r); err != nil {
+		return fail(r, err)
+	}
+	return nil
 }
 
 // kubeDeleteFn is entry point for `kube.delete' callable.
@@ -313,6 +603,10 @@ func (m *kubePackage) kubeDeleteFn(t *starlark.Thread, b *starlark.Builtin, args
 	// Optional api_group argument.
 	var apiGroup starlark.String
 	var foreground starlark.Bool
+	// Deletes during `remove' ignore missing objects by default.
+	ignoreNotFound, _ := t.Local(addon.IgnoreNotFoundKey).(bool)
+	var propagation string
+	opts := metav1.DeleteOptions{}
 	for _, kv := range kwargs[1:] {
 		switch string(kv[0].(starlark.String)) {
 		case apiGroupKW:
@@ -325,26 +619,124 @@ func (m *kubePackage) kubeDeleteFn(t *starlark.Thread, b *starlark.Builtin, args
 			if foreground, ok = kv[1].(starlark.Bool); !ok {
 				return nil, fmt.Errorf("<%v>: expected string value for `foreground' arg, got: %s", b.Name(), kv[1].Type())
 			}
+		case "propagation":
+			s, ok := kv[1].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: expected string value for `propagation' arg, got: %s", b.Name(), kv[1].Type())
+			}
+			propagation = string(s)
+		case "grace_period":
+			i, ok := kv[1].(starlark.Int)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: expected int value for `grace_period' arg, got: %s", b.Name(), kv[1].Type())
+			}
+			secs, ok := i.Int64()
+			if !ok || secs < 0 {
+				return nil, fmt.Errorf("<%v>: `grace_period' must be a non-negative number of seconds (got `%v')", b.Name(), i)
+			}
+			opts.GracePeriodSeconds = &secs
+		case "resource_version", "uid":
+			s, ok := kv[1].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: expected string value for `%s' arg, got: %s", b.Name(), kv[0], kv[1].Type())
+			}
+			if opts.Preconditions == nil {
+				opts.Preconditions = &metav1.Preconditions{}
+			}
+			v := string(s)
+			if kv[0] == starlark.String("uid") {
+				uid := types.UID(v)
+				opts.Preconditions.UID = &uid
+			} else {
+				opts.Preconditions.ResourceVersion = &v
+			}
+		case "ignore_not_found":
+			bv, ok := kv[1].(starlark.Bool)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: expected boolean value for `ignore_not_found' arg, got: %s", b.Name(), kv[1].Type())
+			}
+			ignoreNotFound = bool(bv)
 		default:
-			return nil, fmt.Errorf("<%v>: expected `api_group' or `foreground', got: %v=%v", b.Name(), kv[0], kv[1])
+			return nil, fmt.Errorf("<%v>: expected one of [ api_group | foreground | propagation | grace_period | resource_version | uid | ignore_not_found ] args, got: %v=%v", b.Name(), kv[0], kv[1])
 		}
 	}
 
+	policy := metav1.DeletePropagationBackground
+	switch propagation {
+	case "":
+		if foreground {
+			policy = metav1.DeletePropagationForeground
+		}
+	case "background", "foreground", "orphan":
+		if foreground {
+			return nil, fmt.Errorf("<%v>: `foreground' and `propagation' are mutually exclusive", b.Name())
+		}
+		policy = map[string]metav1.DeletionPropagation{
+			"background": metav1.DeletePropagationBackground,
+			"foreground": metav1.DeletePropagationForeground,
+			"orphan":     metav1.DeletePropagationOrphan,
+		}[propagation]
+	default:
+		return nil, fmt.Errorf("<%v>: `propagation' must be one of `background', `foreground' or `orphan' (got `%s')", b.Name(), propagation)
+	}
+	opts.PropagationPolicy = &policy
+
 	r, err := newResource(m.dClient, name, namespace, string(apiGroup), resource, "")
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 	}
+	if _, err := m.inDefaultNamespace(r); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	if err := m.kubeDelete(ctx, r, bool(foreground)); err != nil {
+	if err := m.kubeDelete(ctx, r, opts); err != nil {
+		if ignoreNotFound && apierrors.IsNotFound(err) {
+			log.Infof("%v not found, ignoring", r)
+			m.deleted(r)
+			return starlark.None, nil
+		}
+		m.count(outcomeFailed)
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
+	m.count(outcomeDeleted)
+	m.deleted(r)
 
 	return starlark.None, nil
 }
 
 // kubeGetFn is an entry point for `kube.get` built-in.
 func (m *kubePackage) kubeGetFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	req, err := m.parseGetArgs(b, args, kwargs, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	obj, err := m.kubeGet(ctx, req.r, req.wait, req.until)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to get %s: %v", b.Name(), req, err)
+	}
+	return req.value(b, obj)
+}
+
+// getRequest is an object requested by `kube.get' (or `kube.try_get').
+type getRequest struct {
+	resource, name, apiGroup string
+	r                        *apiResource
+	wait                     time.Duration
+	json                     bool
+	until                    *condition
+}
+
+// String returns the object name used in errors.
+func (req *getRequest) String() string {
+	return fmt.Sprintf("%s%s `%s'", req.resource, maybeCore(req.apiGroup), req.name)
+}
+
+// parseGetArgs parses <resource>=<name> and optional args of `kube.get'.
+// defaultWait is used if `wait' is not set.
+func (m *kubePackage) parseGetArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, defaultWait time.Duration) (*getRequest, error) {
 	if len(args) != 0 {
 		return nil, fmt.Errorf("<%v>: positional args not supported: %v", b.Name(), args)
 	}
@@ -369,17 +761,15 @@ func (m *kubePackage) kubeGetFn(t *starlark.Thread, b *starlark.Builtin, args st
 		}
 	}
 
-	// Optional api_group argument.
-	var apiGroup starlark.String
-	var wait = 30 * time.Second
-	var wantJSON bool
+	req := &getRequest{resource: resource, name: name, wait: defaultWait}
 	for _, kv := range kwargs[1:] {
 		switch string(kv[0].(starlark.String)) {
 		case apiGroupKW:
-			var ok bool
-			if apiGroup, ok = kv[1].(starlark.String); !ok {
+			apiGroup, ok := kv[1].(starlark.String)
+			if !ok {
 				return nil, fmt.Errorf("<%v>: expected string value for `%s' arg, got: %s", b.Name(), apiGroupKW, kv[1].Type())
 			}
+			req.apiGroup = string(apiGroup)
 		case "wait":
 			durStr, ok := kv[1].(starlark.String)
 			if !ok {
@@ -387,7 +777,7 @@ func (m *kubePackage) kubeGetFn(t *starlark.Thread, b *starlark.Builtin, args st
 			}
 
 			var err error
-			if wait, err = time.ParseDuration(string(durStr)); err != nil {
+			if req.wait, err = time.ParseDuration(string(durStr)); err != nil {
 				return nil, fmt.Errorf("<%v>: failed to parse duration value: %v", b.Name(), err)
 			}
 		case "json":
@@ -395,27 +785,38 @@ func (m *kubePackage) kubeGetFn(t *starlark.Thread, b *starlark.Builtin, args st
 			if !ok {
 				return nil, fmt.Errorf("<%v>: expected boolean value for `json' arg, got: %s", b.Name(), kv[1].Type())
 			}
-			wantJSON = bool(bv)
+			req.json = bool(bv)
+		case "until":
+			expr, ok := kv[1].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: expected string value for `until' arg, got: %s", b.Name(), kv[1].Type())
+			}
+			var err error
+			if req.until, err = parseCondition(string(expr)); err != nil {
+				return nil, fmt.Errorf("<%v>: invalid `until' condition: %v", b.Name(), err)
+			}
 		default:
-			return nil, fmt.Errorf("<%v>: expected one of [ api_group | wait | json ] args, got: %v=%v", b.Name(), kv[0], kv[1])
+			return nil, fmt.Errorf("<%v>: expected one of [ api_group | wait | json | until ] args, got: %v=%v", b.Name(), kv[0], kv[1])
 		}
 	}
 
-	r, err := newResource(m.dClient, name, namespace, string(apiGroup), resource, "")
-	if err != nil {
+	if req.r, err = newResource(m.dClient, name, namespace, req.apiGroup, resource, ""); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 	}
-
-	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	obj, err := m.kubeGet(ctx, r, wait)
-	if err != nil {
-		return nil, fmt.Errorf("<%v>: failed to get %s%s `%s': %v", b.Name(), resource, maybeCore(string(apiGroup)), name, err)
+	if _, err := m.inDefaultNamespace(req.r); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 	}
+	return req, nil
+}
+
+// value converts obj got for req to a proto message (or a dict with `json').
+func (req *getRequest) value(b *starlark.Builtin, obj runtime.Object) (starlark.Value, error) {
+	trackSecret(obj)
 
-	if wantJSON {
+	if req.json {
 		un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 		if err != nil {
-			return nil, fmt.Errorf("<%v>: failed to convert %s%s `%s' to unstructured JSON: %v", b.Name(), resource, maybeCore(string(apiGroup)), name, err)
+			return nil, fmt.Errorf("<%v>: failed to convert %s to unstructured JSON: %v", b.Name(), req, err)
 		}
 		return util.ValueFromNestedMap(un)
 	}
@@ -483,9 +884,12 @@ func (m *kubePackage) kubeExistsFn(t *starlark.Thread, b *starlark.Builtin, args
 	if err != nil {
 		return starlark.False, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 	}
+	if _, err := m.inDefaultNamespace(r); err != nil {
+		return starlark.False, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	_, err = m.kubeGet(ctx, r, wait)
+	_, err = m.kubeGet(ctx, r, wait, nil)
 	if err == ErrNotFound {
 		return starlark.False, nil
 	} else if err != nil {
@@ -549,14 +953,13 @@ func parseHTTPResponse(r *http.Response) (obj runtime.Object, details string, er
 		return nil, "", fmt.Errorf("failed to read body (response code: %d): %v", r.StatusCode, err)
 	}
 
-	log.V(2).Infof("Response raw data: %s", raw)
 	obj, gvk, err := decode(raw)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to parse json object (response code: %d): %v", r.StatusCode, err)
 	}
 
 	if r.StatusCode < 200 || r.StatusCode >= 300 {
-		return nil, "", fmt.Errorf("%s (response code: %d)", apierrors.FromObject(obj).Error(), r.StatusCode)
+		return nil, "", fmt.Errorf("%w (response code: %d)", apierrors.FromObject(obj), r.StatusCode)
 	}
 
 	if s, ok := obj.(*metav1.Status); ok {
@@ -645,43 +1048,135 @@ func mergeObjects(live, obj runtime.Object) error {
 	return nil
 }
 
+type (
+	forceCtxKey          struct{}
+	diffFiltersCtxKey    struct{}
+	manageMetadataCtxKey struct{}
+)
+
+// updateCtx returns context for updates made by a call from thread t. It
+// carries diff filters declared by the addon and whether immutable resources
+// may be recreated: per-call force (unless None) takes precedence over
+// addon-level force, which takes precedence over the global -force flag.
+func (m *kubePackage) updateCtx(t *starlark.Thread, call starlark.Value) context.Context {
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	force := m.force
+	if f, ok := t.Local(addon.ForceKey).(bool); ok {
+		force = f
+	}
+	if f, ok := call.(starlark.Bool); ok {
+		force = bool(f)
+	}
+	ctx = context.WithValue(ctx, forceCtxKey{}, force)
+	if fs, ok := t.Local(addon.DiffFiltersKey).([]string); ok {
+		ctx = context.WithValue(ctx, diffFiltersCtxKey{}, fs)
+	}
+	return ctx
+}
+
+// forced returns true if immutable resources may be recreated in ctx.
+func (m *kubePackage) forced(ctx context.Context) bool {
+	if f, ok := ctx.Value(forceCtxKey{}).(bool); ok {
+		return f
+	}
+	return m.force
+}
+
+// withManageMetadata returns ctx in which Isopod's labels and context
+// annotation are set per manage_metadata argument of a call (unless None,
+// which defers to SetManageMetadata).
+func (m *kubePackage) withManageMetadata(ctx context.Context, call starlark.Value) context.Context {
+	manage := !m.skipMetadata
+	if b, ok := call.(starlark.Bool); ok {
+		manage = bool(b)
+	}
+	return context.WithValue(ctx, manageMetadataCtxKey{}, manage)
+}
+
+// managesMetadata returns true if Isopod's labels and context annotation are
+// set on objects updated in ctx.
+func (m *kubePackage) managesMetadata(ctx context.Context) bool {
+	if b, ok := ctx.Value(manageMetadataCtxKey{}).(bool); ok {
+		return b
+	}
+	return !m.skipMetadata
+}
+
+// filters returns global diff filters followed by diff filters of the addon
+// making the update in ctx.
+func (m *kubePackage) filters(ctx context.Context) []string {
+	fs, _ := ctx.Value(diffFiltersCtxKey{}).([]string)
+	if len(fs) == 0 {
+		return m.diffFilters
+	}
+	return append(append([]string(nil), m.diffFilters...), fs...)
+}
+
 // maybeRecreate can be called to check if a resource can be updated or
 // is immutable and needs recreation.
 // It evaluates if resource should be forcefully recreated. In that case
-// the resource will be deleted and recreated. If the -force flag is not
-// enabled and an immutable resource should be updated, an error is thrown
-// and no resources will get deleted.
-func maybeRecreate(ctx context.Context, live, obj runtime.Object, m *kubePackage, r *apiResource) error {
+// the resource will be deleted and recreated. If force is not enabled (see
+// updateCtx) and an immutable resource should be updated, an error is thrown
+// and no resources will get deleted. Returns true if the resource was deleted.
+func maybeRecreate(ctx context.Context, live, obj runtime.Object, m *kubePackage, r *apiResource) (bool, error) {
 	err := mergeObjects(live, obj)
-	if errors.Is(errors.Unwrap(err), ErrUpdateImmutable) && m.force {
+	if errors.Is(errors.Unwrap(err), ErrUpdateImmutable) && m.forced(ctx) {
 		if m.dryRun {
-			fmt.Fprintf(os.Stdout, "\n\n**WARNING** %s %s is immutable and will be deleted and recreated.\n", strings.ToLower(r.GVK.Kind), maybeNamespaced(r.Name, r.Namespace))
+			fmt.Fprintf(m.diffOut, "\n\n**WARNING** %s %s is immutable and will be deleted and recreated.\n", strings.ToLower(r.GVK.Kind), maybeNamespaced(r.Name, r.Namespace))
 		}
 		// kubeDelete() already properly handles a dry run, so the resource won't be deleted if -force is set, but in dry run mode
-		if err := m.kubeDelete(ctx, r, true); err != nil {
-			return err
+		if err := m.kubeDelete(ctx, r, deleteOptions(metav1.DeletePropagationForeground)); err != nil {
+			return false, err
 		}
+		return true, nil
 	} else if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	return false, nil
 }
 
 // kubeUpdate creates or overwrites object in Kubernetes.
 // Path is computed based on msg type, name and (optional) namespace (these must
 // not conflict with name and namespace set in object metadata).
-func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.Message) error {
+func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.Message) (err error) {
+	m.touch(r)
+	defer func() {
+		if err != nil {
+			m.count(outcomeFailed)
+		}
+	}()
+	if err := m.checkPolicy(r); err != nil {
+		return err
+	}
+	if err := m.checkWritable("update", r); err != nil {
+		return err
+	}
+	cacheKey, hash := m.diffCacheKey(ctx, r, msg.(runtime.Object))
+	if m.diffCached(ctx, r, cacheKey, hash) {
+		m.count(outcomeUnchanged)
+		m.applied(r, nil)
+		return nil
+	}
 	uri := r.PathWithName()
 	live, found, err := m.kubePeek(ctx, m.Master+uri)
 	if err != nil {
 		return err
 	}
+	if err := m.snapshot(ctx, r, live); err != nil {
+		return err
+	}
+	trackSecret(live)
+	trackSecret(msg.(runtime.Object))
 
 	method := http.MethodPut
+	var recreated bool
 	if found {
 		// Reset uri in case subresource update is requested.
 		uri = r.PathWithSubresource()
-		if err := maybeRecreate(ctx, live, msg.(runtime.Object), m, r); err != nil {
+		if err := m.checkOwnership(r, live, msg.(runtime.Object)); err != nil {
+			return err
+		}
+		if recreated, err = maybeRecreate(ctx, live, msg.(runtime.Object), m, r); err != nil {
 			return err
 		}
 	} else { // Object doesn't exist so create it.
@@ -697,8 +1192,11 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 	if err != nil {
 		return err
 	}
+	if secretref.Contains(string(bs)) {
+		return fmt.Errorf("%v: secret references are only supported by kube.put_yaml and helm.apply", r)
+	}
 
-	url := m.Master + uri
+	url := m.Master + uri + "?fieldManager=" + FieldManager
 	// Set body type as marshaled Protobuf.
 	// TODO(dmitry-ilyevskiy): Will not work for CRDs (only json encoding
 	// is supported) so the user will have to indicate this is a
@@ -713,22 +1211,35 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 	log.V(1).Infof("%s to %s", method, url)
 
 	if log.V(2) {
-		s, err := renderObj(msg.(runtime.Object), &r.GVK, bool(log.V(3)) /* If --v=3, only return JSON. */, m.diffFilters)
+		s, err := renderObj(msg.(runtime.Object), &r.GVK, bool(log.V(3)) /* If --v=3, only return JSON. */, m.filters(ctx))
 		if err != nil {
 			return fmt.Errorf("failed to render :live object for %s: %v", r.String(), err)
 		}
 
-		log.Infof("%s:\n%s", r.String(), s)
+		log.Infof("%s:\n%s", r.String(), redact.String(secretref.Mask(s)))
 	}
 
+	diffObj := m.diffObject(ctx, r, live, msg.(runtime.Object))
 	if m.diff {
-		if err := printUnifiedDiff(os.Stdout, live, msg.(runtime.Object), r.GVK, maybeNamespaced(r.Name, r.Namespace), m.diffFilters); err != nil {
+		if err := printUnifiedDiff(m.diffOut, live, diffObj, r.GVK, maybeNamespaced(r.Name, r.Namespace), m.filters(ctx)); err != nil {
+			return err
+		}
+	}
+
+	if m.recorder != nil {
+		if err := m.recordPut(r, live, diffObj); err != nil {
 			return err
 		}
 	}
 
 	if m.dryRun {
-		return printUnifiedDiff(os.Stdout, live, msg.(runtime.Object), r.GVK, maybeNamespaced(r.Name, r.Namespace), m.diffFilters)
+		changed, err := m.printDryRunDiff(ctx, r, live, diffObj, cacheKey, hash)
+		if err != nil {
+			return err
+		}
+		m.count(updateOutcome(live, recreated, changed))
+		m.applied(r, live)
+		return nil
 	}
 
 	resp, err := m.httpClient.Do(req.WithContext(ctx))
@@ -736,10 +1247,12 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 		return err
 	}
 
-	_, rMsg, err := parseHTTPResponse(resp)
+	updated, rMsg, err := parseHTTPResponse(resp)
 	if err != nil {
 		return err
 	}
+	m.count(updateOutcome(live, recreated, resourceVersionChanged(live, updated)))
+	m.applied(r, updated)
 
 	actionMsg := "created"
 	if method == http.MethodPut {
@@ -753,26 +1266,43 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 // kubeDelete deletes namespace/name resource in Kubernetes.
 // Attempts to deduce GroupVersionResource from apiGroup (optional) and resource
 // strings. Fails if multiple matches found.
-func (m *kubePackage) kubeDelete(_ context.Context, r *apiResource, foreground bool) error {
+func (m *kubePackage) kubeDelete(ctx context.Context, r *apiResource, opts metav1.DeleteOptions) error {
+	if err := m.checkPolicy(r); err != nil {
+		return err
+	}
+	if err := m.checkWritable("delete", r); err != nil {
+		return err
+	}
+	m.touch(r)
 	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
 	if r.Namespace != "" {
 		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
 	}
 
-	delPolicy := metav1.DeletePropagationBackground
-	if foreground {
-		delPolicy = metav1.DeletePropagationForeground
+	log.V(1).Infof("DELETE to %s", m.Master+r.PathWithName())
+
+	if m.recorder != nil {
+		if err := m.recordDelete(ctx, r, opts); err != nil {
+			return err
+		}
 	}
 
-	log.V(1).Infof("DELETE to %s", m.Master+r.PathWithName())
+	if m.dryRun || m.diff {
+		live, _, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+		if err != nil {
+			return err
+		}
+		trackSecret(live)
+		if err := printDeleteDiff(m.diffOut, live, r.GVK, maybeNamespaced(r.Name, r.Namespace), m.filters(ctx)); err != nil {
+			return err
+		}
+	}
 
 	if m.dryRun {
 		return nil
 	}
 
-	if err := c.Delete(context.TODO(), r.Name, metav1.DeleteOptions{
-		PropagationPolicy: &delPolicy,
-	}); err != nil {
+	if err := c.Delete(context.TODO(), r.Name, opts); err != nil {
 		return err
 	}
 
@@ -781,6 +1311,11 @@ func (m *kubePackage) kubeDelete(_ context.Context, r *apiResource, foreground b
 	return nil
 }
 
+// deleteOptions returns metav1.DeleteOptions with propagation policy.
+func deleteOptions(policy metav1.DeletionPropagation) metav1.DeleteOptions {
+	return metav1.DeleteOptions{PropagationPolicy: &policy}
+}
+
 // waitRetryInterval is a duration between consecutive get retries.
 const waitRetryInterval = 500 * time.Millisecond
 
@@ -788,15 +1323,17 @@ var ErrNotFound = errors.New("not found")
 
 // kubeGet attempts to read namespace/name resource from an apiGroup from API
 // Server.
-// If object is not present will retry every waitRetryInterval up to wait (only
-// tries once if wait is zero).
-func (m *kubePackage) kubeGet(ctx context.Context, r *apiResource, wait time.Duration) (runtime.Object, error) {
+// If object is not present (or doesn't satisfy until condition if set) will
+// retry every waitRetryInterval up to wait (only tries once if wait is zero).
+func (m *kubePackage) kubeGet(ctx context.Context, r *apiResource, wait time.Duration, until *condition) (runtime.Object, error) {
 	url := m.Master + r.PathWithName()
 	var waitDone <-chan time.Time
 	if wait != 0 {
 		waitDone = time.After(wait)
 	}
 
+	// notFoundErr is returned once wait expires.
+	notFoundErr := ErrNotFound
 	// retryInterval is zero so no delay before the first poll.
 	var retryInterval time.Duration
 	for {
@@ -807,15 +1344,25 @@ func (m *kubePackage) kubeGet(ctx context.Context, r *apiResource, wait time.Dur
 			if err != nil {
 				return nil, err
 			}
+			if ok && until != nil {
+				met, err := until.met(obj)
+				switch {
+				case err != nil:
+					notFoundErr = fmt.Errorf("condition `%s' not met: %v", until.expr, err)
+				case !met:
+					notFoundErr = fmt.Errorf("condition `%s' not met", until.expr)
+				}
+				ok = met
+			}
 			if ok {
 				return obj, nil
 			}
 			if waitDone == nil {
-				return nil, ErrNotFound
+				return nil, notFoundErr
 			}
 
 		case <-waitDone:
-			return nil, ErrNotFound
+			return nil, notFoundErr
 
 		case <-ctx.Done():
 			return nil, ctx.Err()
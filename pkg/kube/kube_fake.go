@@ -24,34 +24,29 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/discovery"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
 	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	coretesting "k8s.io/client-go/testing"
 
 	rbacsyncv1alpha "github.com/cruise-automation/rbacsync/pkg/apis/rbacsync/v1alpha"
-	arkv1 "github.com/heptio/ark/pkg/apis/ark/v1"
-	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
-	istiov1b1 "istio.io/client-go/pkg/apis/networking/v1beta1"
-	istiosecurityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
-	admissionregistrationv1b1 "k8s.io/api/admissionregistration/v1beta1"
-	appsv1 "k8s.io/api/apps/v1"
-	appsv1beta1 "k8s.io/api/apps/v1beta1"
-	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	authenticationv1 "k8s.io/api/authentication/v1"
-	autoscalingv1 "k8s.io/api/autoscaling/v1"
-	autoscalingv2beta1 "k8s.io/api/autoscaling/v2beta1"
-	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
-	batchv1 "k8s.io/api/batch/v1"
-	batchv1b1 "k8s.io/api/batch/v1beta1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	csr "k8s.io/api/certificates/v1"
 	csrv1b1 "k8s.io/api/certificates/v1beta1"
 	corev1 "k8s.io/api/core/v1"
@@ -60,25 +55,26 @@ import (
 	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	schedulingv1 "k8s.io/api/scheduling/v1"
-	schedulingv1beta1 "k8s.io/api/scheduling/v1beta1"
 	storagev1 "k8s.io/api/storage/v1"
-	storagev1beta1 "k8s.io/api/storage/v1beta1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	vpav1 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1"
-	vpav1beta2 "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1beta2"
 	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
-	apiregistrationv1b1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1beta1"
 
 	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/store"
 )
 
+// kubeFakeRegisterCRDMethod is only available in the fake kube module.
+const kubeFakeRegisterCRDMethod = "fake_register_crd"
+
 type fakeKube struct {
 	m map[string][]byte
 }
 
 func nameFromObj(obj apiruntime.Object) (string, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.GetName(), nil
+	}
 	metaVal := reflect.ValueOf(obj).Elem().FieldByName("ObjectMeta")
 	if !metaVal.IsValid() {
 		return "", errors.New("could not extract .ObjectMeta")
@@ -105,7 +101,7 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		obj, _, err := decodeFn(data, nil, nil)
+		obj, _, err := decode(data)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("failed to deserialize: %v", err), http.StatusBadRequest)
 			return
@@ -181,6 +177,15 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.m[r.URL.Path] = data
 
 	case http.MethodGet:
+		if isCollection(r.URL.Path) {
+			bs, err := h.list(r.URL.Path, r.URL.Query().Get("labelSelector"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			write(w, bs)
+			return
+		}
 		res, ok := h.m[r.URL.Path]
 		if !ok {
 			http.Error(w, "not found", http.StatusNotFound)
@@ -189,6 +194,28 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		write(w, res)
 		return
 
+	case http.MethodPatch:
+		res, ok := h.m[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		patch, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Strategic merge patches are applied as JSON merge patches, which
+		// is the same for maps (e.g labels).
+		patched, err := jsonpatch.MergePatch(res, patch)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to apply patch: %v", err), http.StatusBadRequest)
+			return
+		}
+		h.m[r.URL.Path] = patched
+		write(w, patched)
+		return
+
 	case http.MethodDelete:
 		res, ok := h.m[r.URL.Path]
 		if !ok {
@@ -196,7 +223,7 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		obj, gvk, err := decodeFn(res, nil, nil)
+		obj, gvk, err := decode(res)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("failed to deserialize: %v", err), http.StatusBadRequest)
 			return
@@ -237,277 +264,281 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	write(w, bs)
 }
 
-func newFakeModule(k *kubePackage) *isopod.Module {
-	return &isopod.Module{
+// isCollection returns true if p is a path of resource collection (e.g
+// /api/v1/namespaces/foo/configmaps) rather than an object.
+func isCollection(p string) bool {
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	prefix := 2 // api/v1
+	if segs[0] == "apis" {
+		prefix = 3 // apis/group/version
+	}
+	return len(segs) == prefix+1 || len(segs) == prefix+3 && segs[prefix] == "namespaces"
+}
+
+// namespacePath matches namespace segments of object paths.
+var namespacePath = regexp.MustCompile(`/namespaces/[^/]+/`)
+
+// list returns JSON list of objects in collection p (in all namespaces unless
+// p is namespaced) matching label selector.
+func (h *fakeKube) list(p, selector string) ([]byte, error) {
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(h.m))
+	for k := range h.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	l := &unstructured.UnstructuredList{Object: map[string]interface{}{"apiVersion": "v1", "kind": "List"}}
+	for _, k := range keys {
+		if path.Dir(k) != p && path.Dir(namespacePath.ReplaceAllString(k, "/")) != p {
+			continue
+		}
+		obj, gvk, err := decode(h.m[k])
+		if err != nil {
+			return nil, err
+		}
+		u, err := apiruntime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		item := unstructured.Unstructured{Object: u}
+		item.SetGroupVersionKind(*gvk)
+		if !sel.Matches(labels.Set(item.GetLabels())) {
+			continue
+		}
+		l.Items = append(l.Items, item)
+	}
+	return l.MarshalJSON()
+}
+
+// fakeModule is a fake kube module. Implements DynamicClient so that it can
+// back helm package in tests.
+type fakeModule struct {
+	*isopod.Module
+	k *kubePackage
+}
+
+// Apply implements DynamicClient.Apply.
+func (m *fakeModule) Apply(t *starlark.Thread, name, namespace string, data *starlark.List) (starlark.Value, error) {
+	return m.k.Apply(t, name, namespace, data)
+}
+
+// ApplyRelease implements ReleaseClient.ApplyRelease.
+func (m *fakeModule) ApplyRelease(t *starlark.Thread, release, namespace string, data *starlark.List) (starlark.Value, error) {
+	return m.k.ApplyRelease(t, release, namespace, data)
+}
+
+// ReleaseObjects implements ReleaseClient.ReleaseObjects.
+func (m *fakeModule) ReleaseObjects(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error) {
+	return m.k.ReleaseObjects(t, release, namespace)
+}
+
+// DeleteRelease implements ReleaseClient.DeleteRelease.
+func (m *fakeModule) DeleteRelease(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error) {
+	return m.k.DeleteRelease(t, release, namespace)
+}
+
+// ServerAPIs implements APIDiscoverer.ServerAPIs.
+func (m *fakeModule) ServerAPIs() (*version.Info, []string, error) {
+	return m.k.ServerAPIs()
+}
+
+func newFakeModule(k *kubePackage) *fakeModule {
+	m := &fakeModule{k: k, Module: &isopod.Module{
 		Name: "kube",
 		Attrs: starlark.StringDict{
 			kubePutMethod:              starlark.NewBuiltin("kube."+kubePutMethod, k.kubePutFn),
 			kubeDeleteMethod:           starlark.NewBuiltin("kube."+kubeDeleteMethod, k.kubeDeleteFn),
 			kubeResourceQuantityMethod: starlark.NewBuiltin("kube."+kubeResourceQuantityMethod, resourceQuantityFn),
+			kubePutForEachMethod:       starlark.NewBuiltin("kube."+kubePutForEachMethod, k.kubePutForEachFn),
+			kubeTryGetMethod:           starlark.NewBuiltin("kube."+kubeTryGetMethod, k.kubeTryGetFn),
 			kubePutYamlMethod:          starlark.NewBuiltin("kube."+kubePutYamlMethod, k.kubePutYamlFn),
+			kubeApplyDirMethod:         starlark.NewBuiltin("kube."+kubeApplyDirMethod, k.kubeApplyDirFn),
 			kubeGetMethod:              starlark.NewBuiltin("kube."+kubeGetMethod, k.kubeGetFn),
 			kubeExistsMethod:           starlark.NewBuiltin("kube."+kubeExistsMethod, k.kubeExistsFn),
+			kubeForEachMethod:          starlark.NewBuiltin("kube."+kubeForEachMethod, k.kubeForEachFn),
+			kubeMetricsMethod:          starlark.NewBuiltin("kube."+kubeMetricsMethod, k.kubeMetricsFn),
+			kubeAnnotateMethod:         starlark.NewBuiltin("kube."+kubeAnnotateMethod, k.kubeAnnotateFn),
+			kubeLabelMethod:            starlark.NewBuiltin("kube."+kubeLabelMethod, k.kubeLabelFn),
+			kubeScaleMethod:            starlark.NewBuiltin("kube."+kubeScaleMethod, k.kubeScaleFn),
+			kubeHasAPIMethod:           starlark.NewBuiltin("kube."+kubeHasAPIMethod, k.kubeHasAPIFn),
+			kubeWaitAPIMethod:          starlark.NewBuiltin("kube."+kubeWaitAPIMethod, k.kubeWaitAPIFn),
+			kubeServerVersionMethod:    starlark.NewBuiltin("kube."+kubeServerVersionMethod, k.kubeServerVersionFn),
+			kubeInjectCABundleMethod:   starlark.NewBuiltin("kube."+kubeInjectCABundleMethod, k.kubeInjectCABundleFn),
+			kubeCordonMethod:           starlark.NewBuiltin("kube."+kubeCordonMethod, k.kubeCordonFn),
+			kubeUncordonMethod:         starlark.NewBuiltin("kube."+kubeUncordonMethod, k.kubeUncordonFn),
+			kubeDrainMethod:            starlark.NewBuiltin("kube."+kubeDrainMethod, k.kubeDrainFn),
 			kubeFromIntMethod:          starlark.NewBuiltin("kube."+kubeFromIntMethod, fromIntFn),
 			kubeFromStrMethod:          starlark.NewBuiltin("kube."+kubeFromStrMethod, fromStringFn),
 		},
+	}}
+	for name, fn := range quantityBuiltins {
+		m.Attrs[name] = starlark.NewBuiltin("kube."+name, fn)
+	}
+	if d, ok := k.dClient.(*fakediscovery.FakeDiscovery); ok {
+		m.Attrs[kubeFakeRegisterCRDMethod] = kubeFakeRegisterCRDFn(d)
 	}
+	return m
+}
+
+// subresourceKinds are kinds registered in Scheme that are only served as
+// subresources (or not served at all).
+var subresourceKinds = map[string]bool{
+	"Eviction":         true,
+	"JobTemplate":      true,
+	"PodStatusResult":  true,
+	"RangeAllocation":  true,
+	"Scale":            true,
+	"TokenRequest":     true,
+	"DeleteOptions":    true,
+	"PodExecOptions":   true,
+	"PodAttachOptions": true,
 }
 
-// fakeDiscovery return fake discovery client that supports
-// pods API resource.
-func fakeDiscovery() discovery.DiscoveryInterface {
-	fake := &fakediscovery.FakeDiscovery{Fake: &coretesting.Fake{}}
-	apps := []metav1.APIResource{
-		{Name: "deployments", Namespaced: true, Kind: "Deployment"},
-		{Name: "controllerrevisions", Namespaced: true, Kind: "ControllerRevision"},
-		{Name: "daemonsets", Namespaced: true, Kind: "DaemonSet"},
-		{Name: "replicasets", Namespaced: true, Kind: "ReplicaSet"},
-		{Name: "statefulsets", Namespaced: true, Kind: "StatefulSet"},
+// clusterScopedKinds are kinds registered in Scheme that are not namespaced.
+var clusterScopedKinds = map[schema.GroupKind]bool{
+	{Kind: "ComponentStatus"}:  true,
+	{Kind: "Namespace"}:        true,
+	{Kind: "Node"}:             true,
+	{Kind: "PersistentVolume"}: true,
+	{Group: admissionregistrationv1.GroupName, Kind: "MutatingWebhookConfiguration"}:   true,
+	{Group: admissionregistrationv1.GroupName, Kind: "ValidatingWebhookConfiguration"}: true,
+	{Group: apiextensionsv1.GroupName, Kind: "CustomResourceDefinition"}:               true,
+	{Group: apiregistrationv1.GroupName, Kind: "APIService"}:                           true,
+	{Group: authenticationv1.GroupName, Kind: "TokenReview"}:                           true,
+	{Group: authorizationv1.GroupName, Kind: "SelfSubjectAccessReview"}:                true,
+	{Group: authorizationv1.GroupName, Kind: "SelfSubjectRulesReview"}:                 true,
+	{Group: authorizationv1.GroupName, Kind: "SubjectAccessReview"}:                    true,
+	{Group: csr.GroupName, Kind: "CertificateSigningRequest"}:                          true,
+	{Group: extensionsv1beta1.GroupName, Kind: "PodSecurityPolicy"}:                    true,
+	{Group: networkingv1.GroupName, Kind: "IngressClass"}:                              true,
+	{Group: policyv1beta1.GroupName, Kind: "PodSecurityPolicy"}:                        true,
+	{Group: rbacv1.GroupName, Kind: "ClusterRole"}:                                     true,
+	{Group: rbacv1.GroupName, Kind: "ClusterRoleBinding"}:                              true,
+	{Group: rbacsyncv1alpha.SchemeGroupVersion.Group, Kind: "ClusterRBACSyncConfig"}:   true,
+	{Group: schedulingv1.GroupName, Kind: "PriorityClass"}:                             true,
+	{Group: storagev1.GroupName, Kind: "CSIDriver"}:                                    true,
+	{Group: storagev1.GroupName, Kind: "CSINode"}:                                      true,
+	{Group: storagev1.GroupName, Kind: "StorageClass"}:                                 true,
+	{Group: storagev1.GroupName, Kind: "VolumeAttachment"}:                             true,
+}
+
+// fakeVerbs are verbs supported by all fake API resources.
+var fakeVerbs = metav1.Verbs{"create", "delete", "get", "list", "patch", "update", "watch"}
+
+var (
+	schemeResourcesOnce sync.Once
+	// schemeResources caches API resources generated from Scheme.
+	schemeResources []*metav1.APIResourceList
+)
+
+// resourcesFromScheme returns API resources of all object kinds registered
+// in Scheme grouped by group version (sorted for determinism). Resources are
+// generated once and copied so that callers may extend them.
+func resourcesFromScheme() []*metav1.APIResourceList {
+	schemeResourcesOnce.Do(func() {
+		objectMeta := reflect.TypeOf(metav1.ObjectMeta{})
+		byGV := map[schema.GroupVersion][]metav1.APIResource{}
+		for gvk, t := range Scheme.AllKnownTypes() {
+			if gvk.Version == apiruntime.APIVersionInternal || subresourceKinds[gvk.Kind] || strings.HasSuffix(gvk.Kind, "List") {
+				continue
+			}
+			// Only objects (rather than options, events, etc) are resources.
+			if f, ok := t.FieldByName("ObjectMeta"); !ok || f.Type != objectMeta {
+				continue
+			}
+			plural, _ := meta.UnsafeGuessKindToResource(gvk)
+			byGV[gvk.GroupVersion()] = append(byGV[gvk.GroupVersion()], metav1.APIResource{
+				Name:       plural.Resource,
+				Namespaced: !clusterScopedKinds[gvk.GroupKind()],
+				Kind:       gvk.Kind,
+				Verbs:      fakeVerbs,
+			})
+		}
+		for gv, resources := range byGV {
+			sort.Slice(resources, func(i, j int) bool { return resources[i].Name < resources[j].Name })
+			schemeResources = append(schemeResources, &metav1.APIResourceList{
+				GroupVersion: gv.String(),
+				APIResources: resources,
+			})
+		}
+		sort.Slice(schemeResources, func(i, j int) bool {
+			return schemeResources[i].GroupVersion < schemeResources[j].GroupVersion
+		})
+	})
+
+	lists := make([]*metav1.APIResourceList, len(schemeResources))
+	for i, l := range schemeResources {
+		lists[i] = l.DeepCopy()
 	}
-	fake.Resources = []*metav1.APIResourceList{
-		{
-			GroupVersion: corev1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "bindings", Namespaced: true, Kind: "Binding"},
-				{Name: "componentstatuses", Kind: "ComponentStatus"},
-				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
-				{Name: "endpoints", Namespaced: true, Kind: "Endpoints"},
-				{Name: "events", Namespaced: true, Kind: "Event"},
-				{Name: "limitranges", Namespaced: true, Kind: "LimitRange"},
-				{Name: "namespaces", Kind: "Namespace"},
-				{Name: "nodes", Kind: "Node"},
-				{Name: "persistentvolumeclaims", Namespaced: true, Kind: "PersistentVolumeClaim"},
-				{Name: "persistentvolumes", Kind: "PersistentVolume"},
-				{Name: "pods", Namespaced: true, Kind: "Pod"},
-				{Name: "podtemplates", Namespaced: true, Kind: "PodTemplate"},
-				{Name: "replicationcontrollers", Namespaced: true, Kind: "ReplicationController"},
-				{Name: "resourcequotas", Namespaced: true, Kind: "ResourceQuota"},
-				{Name: "secrets", Namespaced: true, Kind: "Secret"},
-				{Name: "serviceaccounts", Namespaced: true, Kind: "ServiceAccount"},
-				{Name: "services", Namespaced: true, Kind: "Service"},
-			},
-		},
-		{
-			GroupVersion: rbacv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "clusterroles", Kind: "ClusterRole"},
-				{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"},
-				{Name: "clusterroles", Kind: "ClusterRole"},
-				{Name: "rolebindings", Namespaced: true, Kind: "RoleBinding"},
-				{Name: "roles", Namespaced: true, Kind: "Role"},
-			},
-		},
-		{
-			GroupVersion: appsv1.SchemeGroupVersion.String(),
-			APIResources: apps,
-		},
-		{
-			GroupVersion: appsv1beta1.SchemeGroupVersion.String(),
-			APIResources: apps,
-		},
-		{
-			GroupVersion: appsv1beta2.SchemeGroupVersion.String(),
-			APIResources: apps,
-		},
-		{
-			GroupVersion: apiextensionsv1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"},
-			},
-		},
-		{
-			GroupVersion: apiextensionsv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"},
-			},
-		},
-		{
-			GroupVersion: storagev1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "storageclasses", Kind: "StorageClass"},
-				{Name: "volumeattachments", Kind: "VolumeAttachment"},
-			},
-		},
-		{
-			GroupVersion: storagev1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "storageclasses", Kind: "StorageClass"},
-				{Name: "volumeattachments", Kind: "VolumeAttachment"},
-			},
-		},
-		{
-			GroupVersion: extensionsv1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "ingresses", Namespaced: true, Kind: "Ingress"},
-				{Name: "networkpolicies", Namespaced: true, Kind: "NetworkPolicy"},
-				{Name: "podsecuritypolicies", Kind: "PodSecurityPolicy"},
-			},
-		},
-		{
-			GroupVersion: networkingv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "networkpolicies", Namespaced: true, Kind: "NetworkPolicy"},
-				{Name: "ingresses", Namespaced: true, Kind: "Ingress"},
-			},
-		},
-		{
-			GroupVersion: authenticationv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "tokenreviews", Kind: "TokenReview"},
-			},
-		},
-		{
-			GroupVersion: autoscalingv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler"},
-			},
-		},
-		{
-			GroupVersion: autoscalingv2beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler"},
-			},
-		},
-		{
-			GroupVersion: autoscalingv2beta2.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler"},
-			},
-		},
-		{
-			GroupVersion: policyv1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "poddisruptionbudgets", Namespaced: true, Kind: "PodDisruptionBudget"},
-				{Name: "podsecuritypolicies", Kind: "PodSecurityPolicy"},
-			},
-		},
-		{
-			GroupVersion: rbacsyncv1alpha.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "clusterrbacsyncconfigs", Kind: "ClusterRBACSyncConfig"},
-				{Name: "rbacsyncconfigs", Namespaced: true, Kind: "RBACSyncConfig"},
-			},
-		},
-		{
-			GroupVersion: batchv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "jobs", Namespaced: true, Kind: "Job"},
-			},
-		},
-		{
-			GroupVersion: batchv1b1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "cronjobs", Namespaced: true, Kind: "CronJob"},
-			},
-		},
-		{
-			GroupVersion: arkv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "backups", Namespaced: true, Kind: "Backup"},
-				{Name: "backupstoragelocations", Namespaced: true, Kind: "BackupStorageLocation"},
-				{Name: "configs", Namespaced: true, Kind: "Config"},
-				{Name: "deletebackuprequests", Namespaced: true, Kind: "DeleteBackupRequest"},
-				{Name: "downloadrequests", Namespaced: true, Kind: "DownloadRequest"},
-				{Name: "podvolumebackups", Namespaced: true, Kind: "PodVolumeBackup"},
-				{Name: "podvolumerestores", Namespaced: true, Kind: "PodVolumeRestore"},
-				{Name: "resticrepositories", Namespaced: true, Kind: "ResticRepository"},
-				{Name: "restores", Namespaced: true, Kind: "Restore"},
-				{Name: "schedules", Namespaced: true, Kind: "Schedule"},
-			},
-		},
-		{
-			GroupVersion: istio.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "sidecar", Namespaced: true, Kind: "Sidecar"},
-				{Name: "virtualservice", Namespaced: true, Kind: "VirtualService"},
-				{Name: "destinationrule", Namespaced: true, Kind: "DestinationRule"},
-				{Name: "gateway", Namespaced: true, Kind: "Gateway"},
-				{Name: "serviceentry", Kind: "ServiceEntry"},
-				{Name: "envoyfilter", Namespaced: true, Kind: "EnvoyFilter"},
-			},
-		},
-		{
-			GroupVersion: istiov1b1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "sidecar", Namespaced: true, Kind: "Sidecar"},
-				{Name: "virtualservice", Namespaced: true, Kind: "VirtualService"},
-				{Name: "destinationrule", Namespaced: true, Kind: "DestinationRule"},
-				{Name: "gateway", Namespaced: true, Kind: "Gateway"},
-				{Name: "serviceentry", Kind: "ServiceEntry"},
-				{Name: "envoyfilter", Namespaced: true, Kind: "EnvoyFilter"},
-			},
-		},
-		{
-			GroupVersion: istiosecurityv1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "authorizationpolicy", Namespaced: true, Kind: "AuthorizationPolicy"},
-				{Name: "peerauthentication", Namespaced: true, Kind: "PeerAuthentication"},
-			},
-		},
-		{
-			GroupVersion: csr.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "certificatesigningrequests", Kind: "CertificateSigningRequest"},
-			},
-		},
-		{
-			GroupVersion: csrv1b1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "certificatesigningrequests", Kind: "CertificateSigningRequest"},
-			},
-		},
-		{
-			GroupVersion: admissionregistrationv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration"},
-				{Name: "mutatingwebhookconfigurations", Kind: "MutatingWebhookConfiguration"},
-			},
-		},
-		{
-			GroupVersion: admissionregistrationv1b1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration"},
-				{Name: "mutatingwebhookconfigurations", Kind: "MutatingWebhookConfiguration"},
-			},
-		},
-		{
-			GroupVersion: schedulingv1beta1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "priorityclass", Kind: "PriorityClass"},
-			},
-		},
-		{
-			GroupVersion: schedulingv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "priorityclass", Kind: "PriorityClass"},
-			},
-		},
-		{
-			GroupVersion: apiregistrationv1b1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "apiservice", Kind: "APIService"},
-			},
-		},
-		{
-			GroupVersion: apiregistrationv1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "apiservice", Kind: "APIService"},
-			},
-		},
-		{
-			GroupVersion: vpav1.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "verticalpodautoscalers", Kind: "VerticalPodAutoscaler"},
-			},
-		},
-		{
-			GroupVersion: vpav1beta2.SchemeGroupVersion.String(),
-			APIResources: []metav1.APIResource{
-				{Name: "verticalpodautoscalers", Kind: "VerticalPodAutoscaler"},
-			},
+	return lists
+}
+
+// fakeDiscovery return fake discovery client that supports API resources of
+// all kinds registered in Scheme and reports v1.21.0 server version.
+func fakeDiscovery() *fakediscovery.FakeDiscovery {
+	return &fakediscovery.FakeDiscovery{
+		Fake: &coretesting.Fake{
+			Resources: resourcesFromScheme(),
+		},
+		FakedServerVersion: &version.Info{
+			Major:      "1",
+			Minor:      "21",
+			GitVersion: "v1.21.0",
 		},
 	}
-	return fake
+}
+
+// registerFakeCRD adds namespaced or cluster-scoped kind in group version to
+// API resources of fake discovery client d.
+func registerFakeCRD(d *fakediscovery.FakeDiscovery, gv schema.GroupVersion, kind string, namespaced bool) {
+	plural, _ := meta.UnsafeGuessKindToResource(gv.WithKind(kind))
+	resource := metav1.APIResource{
+		Name:       plural.Resource,
+		Namespaced: namespaced,
+		Kind:       kind,
+		Verbs:      fakeVerbs,
+	}
+	for _, l := range d.Resources {
+		if l.GroupVersion != gv.String() {
+			continue
+		}
+		for i, r := range l.APIResources {
+			if r.Kind == kind {
+				l.APIResources[i] = resource
+				return
+			}
+		}
+		l.APIResources = append(l.APIResources, resource)
+		return
+	}
+	d.Resources = append(d.Resources, &metav1.APIResourceList{
+		GroupVersion: gv.String(),
+		APIResources: []metav1.APIResource{resource},
+	})
+}
+
+// kubeFakeRegisterCRDFn is an entry point for `kube.fake_register_crd'
+// built-in of the fake kube module. Makes kind of a custom resource known to
+// the fake cluster so that addon tests can put, get and delete its objects:
+//
+//	kube.fake_register_crd(group="stable.example.com", version="v1", kind="CronTab", namespaced=True)
+func kubeFakeRegisterCRDFn(d *fakediscovery.FakeDiscovery) starlark.Callable {
+	return starlark.NewBuiltin("kube."+kubeFakeRegisterCRDMethod, func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var group, version, kind string
+		namespaced := true
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "group", &group, "version", &version, "kind", &kind, "namespaced?", &namespaced); err != nil {
+			return nil, err
+		}
+		if version == "" || kind == "" {
+			return nil, fmt.Errorf("<%v>: `version' and `kind' must be set", b.Name())
+		}
+		registerFakeCRD(d, schema.GroupVersion{Group: group, Version: version}, kind, namespaced)
+		return starlark.None, nil
+	})
 }
 
 // NewFake returns a new fake kube module for testing.
@@ -542,7 +573,8 @@ func NewFake(force bool) (m starlark.HasAttrs, closeFn func(), err error) {
 	tlsConfig := rest.TLSClientConfig{
 		Insecure: true,
 	}
-	rConf := &rest.Config{Host: h, TLSClientConfig: tlsConfig}
+	// Fake apiserver doesn't need client-side rate limiting.
+	rConf := &rest.Config{Host: h, TLSClientConfig: tlsConfig, QPS: -1}
 
 	t, err := rest.TransportFor(rConf)
 	if err != nil {
@@ -554,11 +586,10 @@ func NewFake(force bool) (m starlark.HasAttrs, closeFn func(), err error) {
 		fakeDiscovery(),
 		dynamic.NewForConfigOrDie(rConf),
 		&http.Client{Transport: t},
-		false, /* dryRun */
-		force,
-		false, /* diff */
-		nil,   /* diffFilters */
+		Options{Force: force},
 	)
 
-	return newFakeModule(k.(*kubePackage)), s.Close, nil
+	kp := k.(*kubePackage)
+	kp.skipAPIServiceWait = true
+	return newFakeModule(kp), s.Close, nil
 }
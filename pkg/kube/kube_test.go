@@ -16,6 +16,9 @@ package kube
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -33,6 +36,8 @@ import (
 	"go.starlark.net/starlark"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -48,6 +53,19 @@ import (
 
 const noneValue = "None"
 
+// newTestPackage returns kube package configured with o that talks to fake
+// apiserver s using d (fakeDiscovery if nil) for discovery. Diffs are
+// discarded unless o.DiffOut is set.
+func newTestPackage(s *httptest.Server, d discovery.DiscoveryInterface, o Options) starlark.HasAttrs {
+	if d == nil {
+		d = fakeDiscovery()
+	}
+	if o.DiffOut == nil {
+		o.DiffOut = ioutil.Discard
+	}
+	return New(s.URL, d, dynamic.NewForConfigOrDie(&rest.Config{Host: s.URL}), s.Client(), o)
+}
+
 func statusWithDetails(group, kind, name, msg string) *metav1.Status {
 	return &metav1.Status{
 		TypeMeta: metav1.TypeMeta{
@@ -284,6 +302,58 @@ var isopodLabels = map[string]string{
 	"heritage": "isopod",
 }
 
+func TestSetMetadataAddonVersion(t *testing.T) {
+	m := &kubePackage{}
+	tCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"addon_version": starlark.String("v1.2.3")}}
+	cm := &corev1.ConfigMap{}
+	if err := m.setMetadata(context.Background(), tCtx, "foo", "default", cm); err != nil {
+		t.Fatal(err)
+	}
+
+	want := withNewLabels(isopodLabels, map[string]string{
+		"addon_version":      "v1.2.3",
+		AddonVersionLabelKey: "v1.2.3",
+	})
+	if d := cmp.Diff(want, cm.Labels); d != "" {
+		t.Errorf("Unexpected labels (-want +got):\n%s", d)
+	}
+}
+
+func TestSetMetadataManaged(t *testing.T) {
+	tCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"cluster": starlark.String("dev")}}
+	for _, tc := range []struct {
+		name       string
+		skipGlobal bool
+		call       starlark.Value
+		wantLabels map[string]string
+	}{
+		{name: "Default", call: starlark.None, wantLabels: isopodLabels},
+		{name: "Call opt-out", call: starlark.False},
+		{name: "Global opt-out", skipGlobal: true, call: starlark.None},
+		{name: "Call overrides global opt-out", skipGlobal: true, call: starlark.True, wantLabels: isopodLabels},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &kubePackage{}
+			m.SetManageMetadata(!tc.skipGlobal)
+			cm := &corev1.ConfigMap{}
+			ctx := m.withManageMetadata(context.Background(), tc.call)
+			if err := m.setMetadata(ctx, tCtx, "foo", "default", cm); err != nil {
+				t.Fatal(err)
+			}
+
+			if cm.Name != "foo" || cm.Namespace != "default" {
+				t.Errorf("Want name and namespace set, got: %s/%s", cm.Namespace, cm.Name)
+			}
+			if d := cmp.Diff(tc.wantLabels, cm.Labels); d != "" {
+				t.Errorf("Unexpected labels (-want +got):\n%s", d)
+			}
+			if _, got := cm.Annotations[ctxAnnotationKey]; got != (tc.wantLabels != nil) {
+				t.Errorf("Want context annotation: %v, got: %v", tc.wantLabels != nil, got)
+			}
+		})
+	}
+}
+
 func withNewLabels(old, add map[string]string) map[string]string {
 	new := map[string]string{}
 	for k, v := range old {
@@ -321,6 +391,7 @@ func TestKubePackage(t *testing.T) {
 	urls := func(url ...string) []string {
 		return url
 	}
+	three := int32(3)
 	for _, tc := range []struct {
 		name         string
 		expr         string
@@ -533,7 +604,7 @@ func TestKubePackage(t *testing.T) {
 				},
 			},
 			wantURLs: urls("/api/v1/namespaces/foo"),
-			wantErr:  "<kube.put>: failed to map resource: specified namespace `bar' doesn't match Namespace name: namespace.v1 `bar/foo'",
+			wantErr:  "<kube.put>: item 0 (namespace.v1 `bar/foo'): failed to map resource: specified namespace `bar' doesn't match Namespace name: namespace.v1 `bar/foo'",
 		},
 		{
 			name: "Delete Namespace",
@@ -593,6 +664,37 @@ func TestKubePackage(t *testing.T) {
 			wantURLs:   urls("/apis/apps/v1/namespaces/default/deployments/test"),
 			wantResult: `<k8s.io.api.apps.v1.Deployment metadata:<name:"test" > >`,
 		},
+		{
+			name: "Get Deployment until condition met",
+			expr: "kube.get(deployment='default/test', api_group='apps', until='spec.replicas == 3')",
+			gotObj: &appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Deployment",
+					APIVersion: "apps/v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: appsv1.DeploymentSpec{Replicas: &three},
+			},
+			wantURLs:   urls("/apis/apps/v1/namespaces/default/deployments/test"),
+			wantResult: `<k8s.io.api.apps.v1.Deployment metadata:<name:"test" > spec:<replicas:3 > >`,
+		},
+		{
+			name: "Get Deployment until condition not met",
+			expr: "kube.get(deployment='default/test', api_group='apps', wait='0s', until='status.readyReplicas == 3')",
+			gotObj: &appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Deployment",
+					APIVersion: "apps/v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+			},
+			wantURLs: urls("/apis/apps/v1/namespaces/default/deployments/test"),
+			wantErr:  "<kube.get>: failed to get deployment.apps `test': condition `status.readyReplicas == 3' not met",
+		},
 		{
 			name: "Delete Deployment",
 			expr: "kube.delete(deployment='default/test', api_group='apps')",
@@ -621,7 +723,7 @@ func TestKubePackage(t *testing.T) {
 		{
 			name:    "Override Namespace (Failure)",
 			expr:    `kube.put(name='test', namespace='default', data=[corev1.Pod(metadata=metav1.ObjectMeta(namespace='foobar'))])`,
-			wantErr: "<kube.put>: failed to validate/apply metadata for object 0 => k8s.io.api.core.v1.Pod: namespace=`default' argument does not match object's .metadata.namespace=`foobar'",
+			wantErr: "<kube.put>: item 0 (pod.v1 `default/test'): failed to validate/apply metadata => k8s.io.api.core.v1.Pod: namespace=`default' argument does not match object's .metadata.namespace=`foobar'",
 		},
 		{
 			name:     "Create CRD definition - extv1b1",
@@ -736,7 +838,9 @@ func TestKubePackage(t *testing.T) {
 
 			gotErr := ""
 			if err != nil {
-				gotErr = err.Error()
+				// Only the message is compared, object snippet and call
+				// stack follow it (see TestItemError).
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
 			}
 			if tc.wantErr != gotErr {
 				t.Errorf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
@@ -798,6 +902,401 @@ func TestKubeExists(t *testing.T) {
 	}
 }
 
+func TestKubeFakeRegisterCRD(t *testing.T) {
+	pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+	addImports(t, pkgs)
+
+	k, kClose, err := NewFake(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kClose()
+
+	pkgs["kube"] = k
+
+	cronTab := `kube.put_yaml(name="foo", namespace="default", data=["""
+apiVersion: stable.example.com/v1
+kind: CronTab
+metadata:
+  name: foo
+  namespace: default
+spec:
+  cronSpec: "* * * * */5"
+"""])`
+	// Cases share the fake cluster and run in order.
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		wantErr    string
+		wantResult string
+	}{
+		{
+			name:       "Kind from Scheme",
+			expr:       `kube.has_api(group="coordination.k8s.io", version="v1", kind="Lease")`,
+			wantResult: `True`,
+		},
+		{
+			name:       "Unknown CRD",
+			expr:       `kube.has_api(group="stable.example.com", version="v1", kind="CronTab")`,
+			wantResult: `False`,
+		},
+		{
+			name:    "Put unknown CRD",
+			expr:    cronTab,
+			wantErr: "<kube.put_yaml>: item 0 (crontab.stable.example.com `default/foo'): failed to map resource: no matches for kind \"CronTab\" in version \"stable.example.com/v1\"",
+		},
+		{
+			name: "Register CRD",
+			expr: `kube.fake_register_crd(group="stable.example.com", version="v1", kind="CronTab")`,
+		},
+		{
+			name:       "Registered CRD",
+			expr:       `kube.has_api(group="stable.example.com", version="v1", kind="CronTab")`,
+			wantResult: `True`,
+		},
+		{
+			name: "Put registered CRD",
+			expr: cronTab,
+		},
+		{
+			name:       "Registered CRD object exists",
+			expr:       `kube.exists(crontab="default/foo", api_group="stable.example.com")`,
+			wantResult: `True`,
+		},
+		{
+			name:    "Missing kind",
+			expr:    `kube.fake_register_crd(group="stable.example.com", version="v1", kind="")`,
+			wantErr: "<kube.fake_register_crd>: `version' and `kind' must be set",
+		},
+	} {
+		sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"env": starlark.String("test")}}
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval("kube", tc.expr, sCtx, pkgs)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if tc.wantErr != gotErr {
+				t.Errorf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
+			}
+			gotV := ""
+			if v != nil && v.String() != noneValue {
+				gotV = v.String()
+			}
+			if tc.wantResult != gotV {
+				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, gotV)
+			}
+		})
+	}
+}
+
+func TestKubeDeleteOptions(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	var gotOpts *metav1.DeleteOptions
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			gotOpts = &metav1.DeleteOptions{}
+			if err := json.NewDecoder(r.Body).Decode(gotOpts); err != nil {
+				t.Errorf("Failed to decode delete options: %v", err)
+			}
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{})
+	pkgs := starlark.StringDict{"kube": pkg}
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+	if _, _, err := util.Eval(t.Name(), `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\n"])`, sCtx, pkgs); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := func(p metav1.DeletionPropagation) *metav1.DeletionPropagation { return &p }
+	thirty, rv, uid := int64(30), "42", types.UID("abc")
+	for _, tc := range []struct {
+		name, expr string
+		// remove runs expr like `remove' does.
+		remove    bool
+		wantOpts  *metav1.DeleteOptions
+		wantErr   string
+		wantStats Stats
+	}{
+		{
+			name:      "Default",
+			expr:      `kube.delete(configmap="default/foo")`,
+			wantOpts:  &metav1.DeleteOptions{PropagationPolicy: policy(metav1.DeletePropagationBackground)},
+			wantStats: Stats{Deleted: 1},
+		},
+		{
+			name: "All options",
+			expr: `kube.delete(configmap="default/foo", propagation="orphan", grace_period=30, resource_version="42", uid="abc")`,
+			wantOpts: &metav1.DeleteOptions{
+				PropagationPolicy:  policy(metav1.DeletePropagationOrphan),
+				GracePeriodSeconds: &thirty,
+				Preconditions:      &metav1.Preconditions{ResourceVersion: &rv, UID: &uid},
+			},
+			wantStats: Stats{Deleted: 1},
+		},
+		{
+			name:      "Ignore not found",
+			expr:      `kube.delete(configmap="default/bar", ignore_not_found=True)`,
+			wantOpts:  &metav1.DeleteOptions{PropagationPolicy: policy(metav1.DeletePropagationBackground)},
+			wantStats: Stats{},
+		},
+		{
+			name:      "Not found",
+			expr:      `kube.delete(configmap="default/bar")`,
+			wantOpts:  &metav1.DeleteOptions{PropagationPolicy: policy(metav1.DeletePropagationBackground)},
+			wantErr:   "<kube.delete>: the server could not find the requested resource",
+			wantStats: Stats{Failed: 1},
+		},
+		{
+			name:      "Not found in remove",
+			expr:      `kube.delete(configmap="default/bar")`,
+			remove:    true,
+			wantOpts:  &metav1.DeleteOptions{PropagationPolicy: policy(metav1.DeletePropagationBackground)},
+			wantStats: Stats{},
+		},
+		{
+			name:      "Not found in remove not ignored",
+			expr:      `kube.delete(configmap="default/bar", ignore_not_found=False)`,
+			remove:    true,
+			wantOpts:  &metav1.DeleteOptions{PropagationPolicy: policy(metav1.DeletePropagationBackground)},
+			wantErr:   "<kube.delete>: the server could not find the requested resource",
+			wantStats: Stats{Failed: 1},
+		},
+		{
+			name:    "Bad propagation",
+			expr:    `kube.delete(configmap="default/foo", propagation="now")`,
+			wantErr: "<kube.delete>: `propagation' must be one of `background', `foreground' or `orphan' (got `now')",
+		},
+		{
+			name:    "Foreground and propagation",
+			expr:    `kube.delete(configmap="default/foo", foreground=True, propagation="orphan")`,
+			wantErr: "<kube.delete>: `foreground' and `propagation' are mutually exclusive",
+		},
+		{
+			name:    "Negative grace period",
+			expr:    `kube.delete(configmap="default/foo", grace_period=-1)`,
+			wantErr: "<kube.delete>: `grace_period' must be a non-negative number of seconds (got `-1')",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotOpts = nil
+			pkg.(StatsCollector).TakeStats()
+			var err error
+			if tc.remove {
+				thread := &starlark.Thread{}
+				thread.SetLocal(addon.GoCtxKey, context.Background())
+				thread.SetLocal(addon.SkyCtxKey, sCtx)
+				thread.SetLocal(addon.IgnoreNotFoundKey, true)
+				_, err = starlark.Eval(thread, t.Name(), tc.expr, pkgs)
+			} else {
+				_, _, err = util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantOpts != nil {
+				tc.wantOpts.TypeMeta = gotOpts.TypeMeta
+			}
+			if d := cmp.Diff(tc.wantOpts, gotOpts); d != "" {
+				t.Errorf("Unexpected delete options (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantStats, pkg.(StatsCollector).TakeStats()); d != "" {
+				t.Errorf("Unexpected stats (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestKubeDiscovery(t *testing.T) {
+	k, kClose, err := NewFake(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kClose()
+
+	pkgs := starlark.StringDict{"kube": k}
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		wantErr    string
+		wantResult string
+	}{
+		{
+			name:       "group",
+			expr:       `kube.has_api(group="autoscaling.k8s.io")`,
+			wantResult: `True`,
+		},
+		{
+			name:       "core kind",
+			expr:       `kube.has_api(group="", version="v1", kind="ConfigMap")`,
+			wantResult: `True`,
+		},
+		{
+			name:       "kind",
+			expr:       `kube.has_api(group="autoscaling.k8s.io", version="v1", kind="VerticalPodAutoscaler")`,
+			wantResult: `True`,
+		},
+		{
+			name:       "missing version",
+			expr:       `kube.has_api(group="autoscaling.k8s.io", version="v2")`,
+			wantResult: `False`,
+		},
+		{
+			name:       "missing kind",
+			expr:       `kube.has_api(group="apps", kind="CronJob")`,
+			wantResult: `False`,
+		},
+		{
+			name:       "missing group",
+			expr:       `kube.has_api(group="cert-manager.io")`,
+			wantResult: `False`,
+		},
+		{
+			name:       "server version",
+			expr:       `kube.server_version()`,
+			wantResult: `struct(git_version = "v1.21.0", major = 1, minor = 21)`,
+		},
+		{
+			name:    "server version args",
+			expr:    `kube.server_version("v1")`,
+			wantErr: `kube.server_version: got 1 arguments, want at most 0`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval("kube", tc.expr, nil, pkgs)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr != gotErr {
+				t.Errorf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
+			}
+			gotV := ""
+			if v != nil {
+				gotV = v.String()
+			}
+			if tc.wantResult != gotV {
+				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, gotV)
+			}
+		})
+	}
+}
+
+const testCA = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func TestKubeInjectCABundle(t *testing.T) {
+	pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+	addImports(t, pkgs)
+
+	k, kClose, err := NewFake(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kClose()
+	pkgs["kube"] = k
+
+	secret := fmt.Sprintf(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: webhook-ca
+  namespace: example
+data:
+  ca.crt: %s
+  bad.crt: Zm9v
+`, base64.StdEncoding.EncodeToString([]byte(testCA)))
+	webhook := `
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: example
+webhooks:
+- name: a.example.com
+  clientConfig:
+    service: {name: a, namespace: example}
+- name: b.example.com
+  clientConfig:
+    service: {name: b, namespace: example}
+`
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"env": starlark.String("test")}}
+	for _, expr := range []string{
+		fmt.Sprintf(`kube.put_yaml(name="webhook-ca", data=["""%s"""])`, secret),
+		fmt.Sprintf(`kube.put_yaml(name="example", data=["""%s"""])`, webhook),
+	} {
+		if _, _, err := util.Eval("kube", expr, sCtx, pkgs); err != nil {
+			t.Fatalf("Failed to create test objects: %v", err)
+		}
+	}
+
+	bundle := base64.StdEncoding.EncodeToString([]byte(testCA))
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		wantErr string
+	}{
+		{
+			name: "From secret",
+			expr: `kube.inject_ca_bundle(webhook="example", from_secret="example/webhook-ca")`,
+		},
+		{
+			name: "From value",
+			expr: fmt.Sprintf(`kube.inject_ca_bundle(webhook="example", ca=%q)`, testCA),
+		},
+		{
+			name:    "Missing target",
+			expr:    `kube.inject_ca_bundle(from_secret="example/webhook-ca")`,
+			wantErr: "<kube.inject_ca_bundle>: exactly one of `webhook' or `crd' must be set",
+		},
+		{
+			name:    "Missing webhook configuration",
+			expr:    `kube.inject_ca_bundle(webhook="missing", from_secret="example/webhook-ca")`,
+			wantErr: "<kube.inject_ca_bundle>: no webhook configuration `missing' found",
+		},
+		{
+			name:    "Missing key",
+			expr:    `kube.inject_ca_bundle(webhook="example", from_secret="example/webhook-ca", key="tls.crt")`,
+			wantErr: "<kube.inject_ca_bundle>: key `tls.crt' not found in secret `example/webhook-ca'",
+		},
+		{
+			name:    "Not PEM",
+			expr:    `kube.inject_ca_bundle(webhook="example", from_secret="example/webhook-ca", key="bad.crt")`,
+			wantErr: "<kube.inject_ca_bundle>: CA bundle is not PEM encoded",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := util.Eval("kube", tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr != gotErr {
+				t.Fatalf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+
+			v, _, err := util.Eval("kube", `[w["clientConfig"]["caBundle"] for w in kube.get(validatingwebhookconfiguration="example", api_group="admissionregistration.k8s.io", json=True)["webhooks"]]`, sCtx, pkgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("[%q, %q]", bundle, bundle)
+			if v.String() != want {
+				t.Errorf("Unexpected CA bundles.\nWant: %s\nGot: %s", want, v)
+			}
+		})
+	}
+}
+
 func TestErrImmutableRessource(t *testing.T) {
 	got := ErrImmutableRessource("roleRef", &corev1.Pod{
 		TypeMeta: metav1.TypeMeta{
@@ -830,7 +1329,7 @@ func TestUpdateImmutableResources(t *testing.T) {
 			name:       "Update ClusterRoleBinding",
 			exprCreate: `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="foo",kind="ClusterRole"))])`,
 			exprUpdate: `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="bar",kind="ClusterRole"))])`,
-			wantErr:    fmt.Sprintf("<kube.put>: %s", ErrImmutableRessource("roleRef", &corev1.ObjectReference{})),
+			wantErr:    fmt.Sprintf("<kube.put>: item 0 (clusterrolebinding.rbac.authorization.k8s.io `bar/foo'): %s", ErrImmutableRessource("roleRef", &corev1.ObjectReference{})),
 		},
 		{
 			name:         "Update ClusterRoleBinding force",
@@ -842,7 +1341,7 @@ func TestUpdateImmutableResources(t *testing.T) {
 			name:       "Update ClusterRoleBinding",
 			exprCreate: `kube.put(name='foo', namespace='bar', data=[corev1.Service(spec = corev1.ServiceSpec(healthCheckNodePort=41))])`,
 			exprUpdate: `kube.put(name='foo', namespace='bar', data=[corev1.Service(spec = corev1.ServiceSpec(healthCheckNodePort=42))])`,
-			wantErr:    fmt.Sprintf("<kube.put>: %s", ErrImmutableRessource(".spec.healthCheckNodePort", &corev1.ObjectReference{})),
+			wantErr:    fmt.Sprintf("<kube.put>: item 0 (service.v1 `bar/foo'): %s", ErrImmutableRessource(".spec.healthCheckNodePort", &corev1.ObjectReference{})),
 		},
 		{
 			name:         "Update ClusterRoleBinding force",
@@ -850,6 +1349,18 @@ func TestUpdateImmutableResources(t *testing.T) {
 			exprUpdate:   `kube.put(name='foo', namespace='bar', data=[corev1.Service(spec = corev1.ServiceSpec(healthCheckNodePort=42))])`,
 			forceEnabled: true,
 		},
+		{
+			name:       "Update ClusterRoleBinding per-call force",
+			exprCreate: `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="foo",kind="ClusterRole"))])`,
+			exprUpdate: `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="bar",kind="ClusterRole"))], force=True)`,
+		},
+		{
+			name:         "Update ClusterRoleBinding per-call force disabled",
+			exprCreate:   `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="foo",kind="ClusterRole"))])`,
+			exprUpdate:   `kube.put(name='foo', namespace='bar', api_group='rbac.authorization.k8s.io', data=[rbacv1.ClusterRoleBinding(roleRef=rbacv1.RoleRef(name="bar",kind="ClusterRole"))], force=False)`,
+			forceEnabled: true,
+			wantErr:      fmt.Sprintf("<kube.put>: item 0 (clusterrolebinding.rbac.authorization.k8s.io `bar/foo'): %s", ErrImmutableRessource("roleRef", &corev1.ObjectReference{})),
+		},
 	} {
 		sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"env": starlark.String("test")}}
 		t.Run(tc.name, func(t *testing.T) {
@@ -870,7 +1381,9 @@ func TestUpdateImmutableResources(t *testing.T) {
 
 			gotErr := ""
 			if err != nil {
-				gotErr = err.Error()
+				// Only the message is compared, object snippet and call
+				// stack follow it (see TestItemError).
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
 			}
 			if tc.wantErr != gotErr {
 				t.Errorf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
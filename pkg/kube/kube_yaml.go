@@ -17,7 +17,6 @@ package kube
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
 
 	log "github.com/golang/glog"
@@ -30,6 +29,8 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/secretref"
 )
 
 // DynamicClient used for applying dynamic resource manifests with no
@@ -41,17 +42,31 @@ type DynamicClient interface {
 // kubePutYamlFn is entry point for `kube.put_yaml' callable.
 func (m *kubePackage) kubePutYamlFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var name, namespace string
+	order := OrderKind
 	data := &starlark.List{}
+	var force, manageMetadata starlark.Value = starlark.None, starlark.None
+	wait := true
 	unpacked := []interface{}{
 		"name", &name,
 		"data", &data,
 		"namespace?", &namespace,
+		"order?", &order,
+		"force?", &force,
+		"manage_metadata?", &manageMetadata,
+		"wait?", &wait,
 	}
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
+	if err := CheckOrder(order); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if order == OrderKind {
+		data = SortYAML(data)
+	}
 
-	val, err := m.Apply(t, name, namespace, data)
+	ctx := withAPIServiceWait(m.withManageMetadata(m.updateCtx(t, force), manageMetadata), wait)
+	val, err := m.apply(ctx, t, name, namespace, data)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
@@ -83,42 +98,74 @@ func nameAndNamespace(name, namespace string, obj runtime.Object) (string, strin
 }
 
 func (m *kubePackage) Apply(t *starlark.Thread, name, namespace string, data *starlark.List) (starlark.Value, error) {
+	return m.apply(m.updateCtx(t, starlark.None), t, name, namespace, data)
+}
+
+func (m *kubePackage) apply(ctx context.Context, t *starlark.Thread, name, namespace string, data *starlark.List) (starlark.Value, error) {
 	for i := 0; i < data.Len(); i++ {
 		maybeObj := data.Index(i)
+		src, ok := maybeObj.(starlark.String)
+		if !ok {
+			return nil, itemError(t, i, nil, "", nil, fmt.Errorf("not a YAML string (got: %s)", maybeObj.Type()))
+		}
 
-		obj, gvk, err := decode([]byte(maybeObj.(starlark.String)))
+		obj, gvk, err := decode([]byte(src))
 		if err != nil {
-			return nil, fmt.Errorf("item %d is not a YAML string (got: %s): %v", i, maybeObj.Type(), err)
+			return nil, itemError(t, i, nil, "", []byte(src), fmt.Errorf("not a YAML string: %v", err))
 		}
 
 		sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
-		// Override name and namespace if runtime.Object already set these.
-		name, namespace, err = nameAndNamespace(name, namespace, obj)
+		// Override name and namespace if runtime.Object already set these
+		// (only for this object).
+		name, namespace, err := nameAndNamespace(name, namespace, obj)
+		if err != nil {
+			return nil, itemError(t, i, gvk, name, []byte(src), fmt.Errorf("failed to retrieve name and namespace => %v", err))
+		}
+		fail := func(err error) error {
+			return itemError(t, i, gvk, maybeNamespaced(name, namespace), []byte(src), err)
+		}
+
+		migrated, migratedGVK, err := m.checkDeprecatedAPI(obj, gvk)
 		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve name and namespace for object %v/%s => %v", gvk.Kind, name, err)
+			return nil, fail(err)
 		}
+		obj, gvk = migrated, migratedGVK
 
 		r, err := newResourceForKind(m.dClient, name, namespace, "", *gvk)
 		if err != nil {
 			if _, ok := err.(*meta.NoKindMatchError); ok && m.dryRun {
-				if err := printUnifiedDiff(os.Stdout, nil, obj, *gvk, maybeNamespaced(name, namespace), m.diffFilters); err != nil {
-					return nil, err
+				// Kind is not served yet (e.g its CRD is created by the same
+				// addon) so resource can only be resolved when applying.
+				if m.recorder != nil {
+					r := &apiResource{GVK: *gvk, Name: name, Namespace: namespace}
+					if err := m.recordPut(r, nil, obj); err != nil {
+						return nil, fail(err)
+					}
+				}
+				if err := printUnifiedDiff(m.diffOut, nil, obj, *gvk, maybeNamespaced(name, namespace), m.filters(ctx)); err != nil {
+					return nil, fail(err)
 				}
 				return starlark.None, nil
 			}
-			return nil, fmt.Errorf("failed to map resource: %v", err)
+			return nil, fail(fmt.Errorf("failed to map resource: %v", err))
 		}
-		if r.ClusterScoped {
-			namespace = ""
+		if _, err := m.inDefaultNamespace(r); err != nil {
+			return nil, fail(fmt.Errorf("failed to map resource: %v", err))
 		}
+		// Namespace is dropped for cluster-scoped kinds and may be set to
+		// the default one.
+		namespace = r.Namespace
+		addReleaseKind(ctx, r.GVK)
 
-		if err := m.setMetadata(sCtx, name, namespace, obj); err != nil {
-			return nil, fmt.Errorf("failed to validate/apply metadata for object %v/%s => %v", gvk.Kind, name, err)
+		if err := m.setMetadata(ctx, sCtx, name, namespace, obj); err != nil {
+			return nil, fail(fmt.Errorf("failed to validate/apply metadata => %v", err))
 		}
 
-		ctx := t.Local(addon.GoCtxKey).(context.Context)
 		if err := m.kubeUpdateYaml(ctx, r, obj); err != nil {
-			return nil, err
+			return nil, fail(err)
+		}
+		if err := m.waitAPIService(ctx, r); err != nil {
+			return nil, fail(err)
 		}
 	}
 
@@ -142,19 +189,57 @@ func parseUnstructuredStatus(un *unstructured.Unstructured) (details string, err
 	return fmt.Sprintf("%s%s `%s'", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), maybeNamespaced(un.GetName(), un.GetNamespace())), nil
 }
 
-func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj runtime.Object) error {
+func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj runtime.Object) (err error) {
+	m.touch(r)
+	defer func() {
+		if err != nil {
+			m.count(outcomeFailed)
+		}
+	}()
+	if err := m.checkPolicy(r); err != nil {
+		return err
+	}
+	if err := m.checkWritable("update", r); err != nil {
+		return err
+	}
+	cacheKey, hash := m.diffCacheKey(ctx, r, obj)
+	if m.diffCached(ctx, r, cacheKey, hash) {
+		m.count(outcomeUnchanged)
+		m.applied(r, nil)
+		return nil
+	}
 	live, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
 	if err != nil {
 		return err
 	}
+	if err := m.snapshot(ctx, r, live); err != nil {
+		return err
+	}
+	var recreated bool
 	if found {
-		if err := maybeRecreate(ctx, live, obj, m, r); err != nil {
+		if err := m.checkOwnership(r, live, obj); err != nil {
+			return err
+		}
+		if recreated, err = maybeRecreate(ctx, live, obj, m, r); err != nil {
+			return err
+		}
+	}
+
+	diffObj := m.diffObject(ctx, r, live, obj)
+	if m.recorder != nil {
+		if err := m.recordPut(r, live, diffObj); err != nil {
 			return err
 		}
 	}
 
 	if m.dryRun {
-		return printUnifiedDiff(os.Stdout, live, obj, r.GVK, maybeNamespaced(r.Name, r.Namespace), m.diffFilters)
+		changed, err := m.printDryRunDiff(ctx, r, live, diffObj, cacheKey, hash)
+		if err != nil {
+			return err
+		}
+		m.count(updateOutcome(live, recreated, changed))
+		m.applied(r, live)
+		return nil
 	}
 
 	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
@@ -163,28 +248,34 @@ func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj ru
 	}
 
 	if log.V(2) {
-		s, err := renderObj(obj, &r.GVK, bool(log.V(3)) /* If --v=3, only return JSON. */, m.diffFilters)
+		s, err := renderObj(obj, &r.GVK, bool(log.V(3)) /* If --v=3, only return JSON. */, m.filters(ctx))
 		if err != nil {
 			return fmt.Errorf("failed to render :live object for %v: %v", r, err)
 		}
 
-		log.Infof("%v:\n%s", r, s)
+		log.Infof("%v:\n%s", r, redact.String(secretref.Mask(s)))
 	}
 
 	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
 		return err
 	}
+	// Secret references are only resolved right before sending the object.
+	if err := secretref.ExpandObject(ctx, m.secretResolver, un); err != nil {
+		return fmt.Errorf("%v: %v", r, err)
+	}
 
 	var resp *unstructured.Unstructured
 	if found {
-		resp, err = c.Update(context.TODO(), &unstructured.Unstructured{Object: un}, metav1.UpdateOptions{})
+		resp, err = c.Update(context.TODO(), &unstructured.Unstructured{Object: un}, metav1.UpdateOptions{FieldManager: FieldManager})
 	} else {
-		resp, err = c.Create(context.TODO(), &unstructured.Unstructured{Object: un}, metav1.CreateOptions{})
+		resp, err = c.Create(context.TODO(), &unstructured.Unstructured{Object: un}, metav1.CreateOptions{FieldManager: FieldManager})
 	}
 	if err != nil {
 		return err
 	}
+	m.count(updateOutcome(live, recreated, resourceVersionChanged(live, resp)))
+	m.applied(r, resp)
 
 	rMsg, err := parseUnstructuredStatus(resp)
 	if err != nil {
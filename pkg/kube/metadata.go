@@ -0,0 +1,192 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	kubeAnnotateMethod = "annotate"
+	kubeLabelMethod    = "label"
+)
+
+// kubeAnnotateFn is entry point for `kube.annotate' callable. Sets
+// annotations of an existing object with a patch of its metadata, without
+// fetching and re-putting the whole object:
+//
+//	kube.annotate(deployment="default/nginx", annotations={"restarted-at": now})
+//
+// Annotations set to None are removed.
+func (m *kubePackage) kubeAnnotateFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return m.patchMetadataFn(t, b, args, kwargs, "annotations")
+}
+
+// kubeLabelFn is entry point for `kube.label' callable. Same as
+// `kube.annotate' but for labels:
+//
+//	kube.label(namespace="monitoring", labels={"team": "observability"})
+func (m *kubePackage) kubeLabelFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return m.patchMetadataFn(t, b, args, kwargs, "labels")
+}
+
+func (m *kubePackage) patchMetadataFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, field string) (starlark.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("<%v>: positional args not supported: %v", b.Name(), args)
+	}
+	if len(kwargs) < 1 {
+		return nil, fmt.Errorf("<%v>: expected <resource>=<name>", b.Name())
+	}
+
+	resource, name, err := getResourceAndName(kwargs[0])
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %s", b.Name(), err.Error())
+	}
+	// If resource is not namespace itself (special case), attempt to parse
+	// namespace out of the arg value.
+	var namespace string
+	if resource != namespaceResrc {
+		ss := strings.Split(name, "/")
+		if len(ss) > 1 {
+			namespace = ss[0]
+			name = ss[1]
+		}
+	}
+
+	var values *starlark.Dict
+	var apiGroup string
+	if err := starlark.UnpackArgs(b.Name(), nil, kwargs[1:],
+		field, &values,
+		apiGroupKW+"?", &apiGroup,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	patch := make(map[string]*string, values.Len())
+	for _, kv := range values.Items() {
+		k, ok := starlark.AsString(kv[0])
+		if !ok {
+			return nil, fmt.Errorf("<%v>: expected string keys in `%s', got: %s", b.Name(), field, kv[0].Type())
+		}
+		if kv[1] == starlark.None {
+			patch[k] = nil
+			continue
+		}
+		v, ok := starlark.AsString(kv[1])
+		if !ok {
+			return nil, fmt.Errorf("<%v>: expected string or None value of `%s' in `%s', got: %s", b.Name(), k, field, kv[1].Type())
+		}
+		patch[k] = &v
+	}
+
+	r, err := newResource(m.dClient, name, namespace, apiGroup, resource, "")
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	if err := m.patchMetadata(ctx, r, field, patch); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// patchMetadata sets (or removes if nil) values of metadata field (labels or
+// annotations) of existing object r.
+func (m *kubePackage) patchMetadata(ctx context.Context, r *apiResource, field string, values map[string]*string) (err error) {
+	m.touch(r)
+	defer func() {
+		if err != nil {
+			m.count(outcomeFailed)
+		}
+	}()
+	if err := m.checkPolicy(r); err != nil {
+		return err
+	}
+	if err := m.checkWritable("patch "+field+" of", r); err != nil {
+		return err
+	}
+
+	un, found, err := m.peekUnstructured(ctx, r)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%v not found", r)
+	}
+	live, _, err := unstructured.NestedStringMap(un.Object, "metadata", field)
+	if err != nil {
+		return fmt.Errorf("%v: %v", r, err)
+	}
+	changes := metadataChanges(live, values)
+	if len(changes) == 0 {
+		m.count(outcomeUnchanged)
+		return nil
+	}
+
+	if m.dryRun {
+		fmt.Fprintf(m.diffOut, "\n*** %v %s will be changed: %s ***\n", r, field, strings.Join(changes, ", "))
+		m.count(outcomeUpdated)
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{field: values},
+	})
+	if err != nil {
+		return err
+	}
+	// Custom resources don't support strategic merge patches. Both patch
+	// types merge maps such as labels and annotations the same way.
+	pt := types.MergePatchType
+	if Scheme.Recognizes(r.GVK) {
+		pt = types.StrategicMergePatchType
+	}
+	if _, err := m.resourceClient(r).Patch(ctx, r.Name, pt, data, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch %v: %v", r, err)
+	}
+	m.count(outcomeUpdated)
+
+	log.Infof("%v %s changed: %s", r, field, strings.Join(changes, ", "))
+	return nil
+}
+
+// metadataChanges returns sorted descriptions of changes values make to live
+// labels or annotations (`key=value' for set and `key-' for removed keys).
+func metadataChanges(live map[string]string, values map[string]*string) []string {
+	var changes []string
+	for k, v := range values {
+		old, ok := live[k]
+		switch {
+		case v == nil && ok:
+			changes = append(changes, k+"-")
+		case v != nil && (!ok || old != *v):
+			changes = append(changes, k+"="+*v)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
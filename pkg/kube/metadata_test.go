@@ -0,0 +1,145 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestPatchMetadata(t *testing.T) {
+	const path = "/apis/apps/v1/namespaces/default/deployments/nginx"
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, tc := range []struct {
+		name            string
+		dryRun          bool
+		expr            string
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+		wantStats       Stats
+		wantOut         string
+		wantErr         string
+	}{
+		{
+			name:            "Label",
+			expr:            `kube.label(deployment="default/nginx", api_group="apps", labels={"team": "infra", "app": None})`,
+			wantLabels:      map[string]string{"team": "infra"},
+			wantAnnotations: map[string]string{"note": "keep"},
+			wantStats:       Stats{Updated: 1},
+		},
+		{
+			name:            "Annotate",
+			expr:            `kube.annotate(deployment="default/nginx", api_group="apps", annotations={"restarted-at": "now"})`,
+			wantLabels:      map[string]string{"app": "nginx"},
+			wantAnnotations: map[string]string{"note": "keep", "restarted-at": "now"},
+			wantStats:       Stats{Updated: 1},
+		},
+		{
+			name:            "Unchanged",
+			expr:            `kube.label(deployment="default/nginx", api_group="apps", labels={"app": "nginx", "gone": None})`,
+			wantLabels:      map[string]string{"app": "nginx"},
+			wantAnnotations: map[string]string{"note": "keep"},
+			wantStats:       Stats{Unchanged: 1},
+		},
+		{
+			name:            "Dry run",
+			dryRun:          true,
+			expr:            `kube.label(deployment="default/nginx", api_group="apps", labels={"team": "infra", "app": None})`,
+			wantLabels:      map[string]string{"app": "nginx"},
+			wantAnnotations: map[string]string{"note": "keep"},
+			wantStats:       Stats{Updated: 1},
+			wantOut:         "\n*** deployment.apps/v1 `default/nginx' labels will be changed: app-, team=infra ***\n",
+		},
+		{
+			name:      "Not found",
+			expr:      `kube.label(deployment="default/missing", api_group="apps", labels={"team": "infra"})`,
+			wantStats: Stats{Failed: 1},
+			wantErr:   "<kube.label>: deployment.apps/v1 `default/missing' not found",
+		},
+		{
+			name:    "Bad value",
+			expr:    `kube.annotate(deployment="default/nginx", api_group="apps", annotations={"replicas": 3})`,
+			wantErr: "<kube.annotate>: expected string or None value of `replicas' in `annotations', got: int",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "nginx",
+					Namespace:   "default",
+					Labels:      map[string]string{"app": "nginx"},
+					Annotations: map[string]string{"note": "keep"},
+				},
+			}
+			data, err := apiruntime.Encode(unstructured.UnstructuredJSONScheme, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &fakeKube{m: map[string][]byte{path: data}}
+			s := httptest.NewServer(h)
+			defer s.Close()
+
+			out := &bytes.Buffer{}
+			pkg := newTestPackage(s, nil, Options{
+				DryRun:  tc.dryRun,
+				DiffOut: out,
+			})
+			_, _, err = util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg})
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.wantStats, pkg.(StatsCollector).TakeStats()); d != "" {
+				t.Errorf("Unexpected stats (-want +got):\n%s", d)
+			}
+			if err != nil {
+				return
+			}
+			if got := out.String(); got != tc.wantOut {
+				t.Errorf("Unexpected output.\nWant: %q\nGot: %q", tc.wantOut, got)
+			}
+
+			obj, _, err := decode(h.m[path])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := obj.(*appsv1.Deployment)
+			if d := cmp.Diff(tc.wantLabels, got.Labels); d != "" {
+				t.Errorf("Unexpected labels (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantAnnotations, got.Annotations); d != "" {
+				t.Errorf("Unexpected annotations (-want +got):\n%s", d)
+			}
+		})
+	}
+}
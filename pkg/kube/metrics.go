@@ -0,0 +1,191 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const kubeMetricsMethod = "metrics"
+
+var (
+	podMetricsGVR  = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+	nodeMetricsGVR = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "nodes"}
+)
+
+// usageMetrics is the part of PodMetrics and NodeMetrics of the
+// metrics.k8s.io API (served by metrics-server) used here.
+type usageMetrics struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Timestamp         metav1.Time         `json:"timestamp"`
+	Window            metav1.Duration     `json:"window"`
+	Usage             corev1.ResourceList `json:"usage,omitempty"`
+	Containers        []struct {
+		Name  string              `json:"name"`
+		Usage corev1.ResourceList `json:"usage"`
+	} `json:"containers,omitempty"`
+}
+
+// kubeMetricsFn is entry point for `kube.metrics' callable. Returns current
+// CPU and memory usage of a pod or node from the metrics.k8s.io API:
+//
+//	m = kube.metrics(pod="kube-system/webhook-abcd")
+//	kube.quantity_value(m.memory, "Mi")
+//
+// Usage of all pods in a namespace (`ns/'), of all pods (empty pod) or of
+// all nodes (empty node) is returned as a list. A single pod or node without
+// metrics (yet) is None.
+func (m *kubePackage) kubeMetricsFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pod, node starlark.Value
+	var labelSelector string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"pod?", &pod,
+		"node?", &node,
+		"label_selector?", &labelSelector,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if (pod == nil) == (node == nil) {
+		return nil, fmt.Errorf("<%v>: expected either `pod' or `node'", b.Name())
+	}
+
+	var gvr schema.GroupVersionResource
+	var namespace, name string
+	if pod != nil {
+		s, ok := starlark.AsString(pod)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: expected string value for `pod' arg, got: %s", b.Name(), pod.Type())
+		}
+		gvr = podMetricsGVR
+		if s != "" {
+			ss := strings.SplitN(s, "/", 2)
+			if len(ss) != 2 || ss[0] == "" {
+				return nil, fmt.Errorf("<%v>: expected pod=<namespace>/[<name>] (got `%s')", b.Name(), s)
+			}
+			namespace, name = ss[0], ss[1]
+		}
+	} else {
+		s, ok := starlark.AsString(node)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: expected string value for `node' arg, got: %s", b.Name(), node.Type())
+		}
+		gvr = nodeMetricsGVR
+		name = s
+	}
+
+	var c dynamic.ResourceInterface = m.dynClient.Resource(gvr)
+	if namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(namespace)
+	}
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+
+	if name != "" {
+		log.V(1).Infof("GET %s metrics `%s'", gvr.Resource, name)
+		un, err := c.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return starlark.None, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to get metrics of %s `%s': %v", b.Name(), strings.TrimSuffix(gvr.Resource, "s"), name, err)
+		}
+		v, err := metricsValue(un, pod != nil)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		return v, nil
+	}
+
+	log.V(1).Infof("LIST %s metrics", gvr.Resource)
+	l, err := c.List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to list %s metrics: %v", b.Name(), strings.TrimSuffix(gvr.Resource, "s"), err)
+	}
+	vs := make([]starlark.Value, 0, len(l.Items))
+	for i := range l.Items {
+		v, err := metricsValue(&l.Items[i], pod != nil)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		vs = append(vs, v)
+	}
+	return starlark.NewList(vs), nil
+}
+
+// metricsValue converts PodMetrics (if isPod) or NodeMetrics un to a struct
+// with name, namespace (empty for nodes), timestamp and window, and cpu and
+// memory usage as quantities. For pods, usage is the sum of usage of all
+// containers, which are listed in containers.
+func metricsValue(un *unstructured.Unstructured, isPod bool) (starlark.Value, error) {
+	data, err := un.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var um usageMetrics
+	if err := json.Unmarshal(data, &um); err != nil {
+		return nil, fmt.Errorf("failed to parse metrics of `%s': %v", un.GetName(), err)
+	}
+
+	fields := starlark.StringDict{
+		"name":      starlark.String(um.Name),
+		"namespace": starlark.String(um.Namespace),
+		"timestamp": starlark.String(um.Timestamp.UTC().Format("2006-01-02T15:04:05Z")),
+		"window":    starlark.String(um.Window.Duration.String()),
+	}
+	usage := um.Usage
+	if isPod {
+		usage = corev1.ResourceList{}
+		cs := make([]starlark.Value, 0, len(um.Containers))
+		for _, c := range um.Containers {
+			cs = append(cs, usageValue(starlark.StringDict{"name": starlark.String(c.Name)}, c.Usage))
+			for k, q := range c.Usage {
+				sum := usage[k]
+				sum.Add(q)
+				usage[k] = sum
+			}
+		}
+		fields["containers"] = starlark.NewList(cs)
+	}
+	return usageValue(fields, usage), nil
+}
+
+// usageValue returns struct of fields with cpu and memory usage added (zero
+// if missing).
+func usageValue(fields starlark.StringDict, usage corev1.ResourceList) starlark.Value {
+	for k, n := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    "cpu",
+		corev1.ResourceMemory: "memory",
+	} {
+		q := usage[k].DeepCopy()
+		fields[n] = skycfg.NewProtoMessage(&q)
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
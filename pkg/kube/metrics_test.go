@@ -0,0 +1,148 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const (
+	testPodMetrics = `{
+  "kind": "PodMetrics",
+  "apiVersion": "metrics.k8s.io/v1beta1",
+  "metadata": {"name": "webhook", "namespace": "default"},
+  "timestamp": "2021-06-01T00:00:00Z",
+  "window": "30s",
+  "containers": [
+    {"name": "webhook", "usage": {"cpu": "250m", "memory": "100Mi"}},
+    {"name": "proxy", "usage": {"cpu": "5m", "memory": "28Mi"}}
+  ]
+}`
+	testNodeMetrics = `{
+  "kind": "NodeMetrics",
+  "apiVersion": "metrics.k8s.io/v1beta1",
+  "metadata": {"name": "node-1"},
+  "timestamp": "2021-06-01T00:00:00Z",
+  "window": "30s",
+  "usage": {"cpu": "1500m", "memory": "2Gi"}
+}`
+)
+
+// fakeMetrics serves metrics of pod `default/webhook' and node `node-1'.
+func fakeMetrics(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/apis/metrics.k8s.io/v1beta1"
+	var body string
+	switch r.URL.Path {
+	case prefix + "/namespaces/default/pods/webhook":
+		body = testPodMetrics
+	case prefix + "/namespaces/default/pods", prefix + "/pods":
+		body = `{"kind": "PodMetricsList", "apiVersion": "metrics.k8s.io/v1beta1", "metadata": {}, "items": [` + testPodMetrics + `]}`
+	case prefix + "/nodes/node-1":
+		body = testNodeMetrics
+	case prefix + "/nodes":
+		body = `{"kind": "NodeMetricsList", "apiVersion": "metrics.k8s.io/v1beta1", "metadata": {}, "items": [` + testNodeMetrics + `]}`
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(body))
+}
+
+func TestMetrics(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(fakeMetrics))
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{
+		DiffOut: &bytes.Buffer{},
+	})
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, tc := range []struct {
+		name, expr, want, wantErr string
+	}{
+		{
+			name: "Pod",
+			expr: `[(m.namespace, m.name, m.window, m.timestamp, kube.quantity_value(m.cpu, "m"), kube.quantity_value(m.memory, "Mi")) for m in [kube.metrics(pod="default/webhook")]]`,
+			want: `[("default", "webhook", "30s", "2021-06-01T00:00:00Z", 255, 128)]`,
+		},
+		{
+			name: "Pod containers",
+			expr: `[(c.name, kube.quantity_value(c.cpu, "m")) for c in kube.metrics(pod="default/webhook").containers]`,
+			want: `[("webhook", 250), ("proxy", 5)]`,
+		},
+		{
+			name: "Pods in namespace",
+			expr: `[m.name for m in kube.metrics(pod="default/", label_selector="app=webhook")]`,
+			want: `["webhook"]`,
+		},
+		{
+			name: "All pods",
+			expr: `[m.name for m in kube.metrics(pod="")]`,
+			want: `["webhook"]`,
+		},
+		{
+			name: "Pod without metrics",
+			expr: `kube.metrics(pod="default/starting")`,
+			want: `None`,
+		},
+		{
+			name: "Node",
+			expr: `[(m.name, m.namespace, kube.quantity_value(m.cpu), kube.quantity_value(m.memory, "Gi")) for m in [kube.metrics(node="node-1")]]`,
+			want: `[("node-1", "", 1.5, 2)]`,
+		},
+		{
+			name: "All nodes",
+			expr: `[m.name for m in kube.metrics(node="")]`,
+			want: `["node-1"]`,
+		},
+		{
+			name:    "Pod and node",
+			expr:    `kube.metrics(pod="default/webhook", node="node-1")`,
+			wantErr: "<kube.metrics>: expected either `pod' or `node'",
+		},
+		{
+			name:    "Pod without namespace",
+			expr:    `kube.metrics(pod="webhook")`,
+			wantErr: "<kube.metrics>: expected pod=<namespace>/[<name>] (got `webhook')",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, err := util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg})
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tc.want {
+				t.Errorf("Unexpected metrics.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
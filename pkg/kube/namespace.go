@@ -0,0 +1,57 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/restmapper"
+)
+
+// NamespaceDefaulter is implemented by kube packages that can resolve
+// namespaced objects given without a namespace in a default namespace (like
+// kubectl does with the namespace of the current context).
+type NamespaceDefaulter interface {
+	// SetDefaultNamespace sets the namespace `kube.put', `kube.put_yaml',
+	// `kube.delete', `kube.get', `kube.try_get' and `kube.exists' use for
+	// namespaced objects without one. Empty keeps them unresolved.
+	SetDefaultNamespace(namespace string)
+}
+
+// SetDefaultNamespace implements NamespaceDefaulter.SetDefaultNamespace.
+func (m *kubePackage) SetDefaultNamespace(namespace string) {
+	m.defaultNs = namespace
+}
+
+// inDefaultNamespace sets namespace of r to the default namespace if it is
+// set and r is a namespaced resource without a namespace. Returns whether
+// the namespace of r was set.
+func (m *kubePackage) inDefaultNamespace(r *apiResource) (bool, error) {
+	if m.defaultNs == "" || r.Namespace != "" || r.ClusterScoped {
+		return false, nil
+	}
+	gr, err := restmapper.GetAPIGroupResources(m.dClient)
+	if err != nil {
+		return false, err
+	}
+	mapping, err := restmapper.NewDiscoveryRESTMapper(gr).RESTMapping(r.GVK.GroupKind(), r.GVK.Version)
+	if err != nil {
+		return false, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return false, nil
+	}
+	r.Namespace = m.defaultNs
+	return true, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestDefaultNamespace(t *testing.T) {
+	var gotPaths []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name, defaultNs, expr string
+		wantPaths             []string
+	}{
+		{
+			name:      "Namespaced",
+			defaultNs: "platform",
+			expr:      `kube.exists(configmap="foo")`,
+			wantPaths: []string{"GET /api/v1/namespaces/platform/configmaps/foo"},
+		},
+		{
+			name:      "Explicit namespace",
+			defaultNs: "platform",
+			expr:      `kube.exists(configmap="infra/foo")`,
+			wantPaths: []string{"GET /api/v1/namespaces/infra/configmaps/foo"},
+		},
+		{
+			name:      "Cluster-scoped",
+			defaultNs: "platform",
+			expr:      `kube.exists(clusterrole="foo")`,
+			wantPaths: []string{"GET /apis/rbac.authorization.k8s.io/v1/clusterroles/foo"},
+		},
+		{
+			name:      "Unset",
+			expr:      `kube.exists(configmap="foo")`,
+			wantPaths: []string{"GET /api/v1/configmaps/foo"},
+		},
+		{
+			name:      "Get",
+			defaultNs: "platform",
+			expr:      `kube.try_get(configmap="foo")`,
+			wantPaths: []string{"GET /api/v1/namespaces/platform/configmaps/foo"},
+		},
+		{
+			name:      "Delete",
+			defaultNs: "platform",
+			expr:      `kube.delete(configmap="foo", ignore_not_found=True)`,
+			wantPaths: []string{"GET /api/v1/namespaces/platform/configmaps/foo"},
+		},
+		{
+			name:      "Put YAML",
+			defaultNs: "platform",
+			expr:      `kube.put_yaml(name="foo", data=["apiVersion: v1\nkind: ConfigMap\n"])`,
+			wantPaths: []string{"GET /api/v1/namespaces/platform/configmaps/foo"},
+		},
+		{
+			name:      "Put",
+			defaultNs: "platform",
+			expr:      `kube.put(name="foo", data=[corev1.ConfigMap()])`,
+			wantPaths: []string{"GET /api/v1/namespaces/platform/configmaps/foo"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPaths = nil
+			pkg := newTestPackage(s, nil, Options{
+				DryRun: true,
+			})
+			pkg.(NamespaceDefaulter).SetDefaultNamespace(tc.defaultNs)
+
+			pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+			addImports(t, pkgs)
+			pkgs["kube"] = pkg
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			if _, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs); err != nil {
+				t.Fatal(strings.SplitN(err.Error(), "\n", 2)[0])
+			}
+			if d := cmp.Diff(tc.wantPaths, gotPaths); d != "" {
+				t.Errorf("Unexpected requests (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+var (
+	nodesGVR = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	podsGVR  = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+// evictRetryInterval is a duration between eviction retries of pods
+// protected by PodDisruptionBudget.
+const evictRetryInterval = 5 * time.Second
+
+// defaultDrainTimeout is how long drain waits for pods to be evicted by
+// default.
+const defaultDrainTimeout = 5 * time.Minute
+
+// kubeCordonFn is entry point for `kube.cordon' callable. Marks node as
+// unschedulable:
+//
+//	kube.cordon(node="gke-pool-1-abcd")
+func (m *kubePackage) kubeCordonFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return m.setUnschedulableFn(t, b, args, kwargs, true)
+}
+
+// kubeUncordonFn is entry point for `kube.uncordon' callable. Marks node as
+// schedulable again.
+func (m *kubePackage) kubeUncordonFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return m.setUnschedulableFn(t, b, args, kwargs, false)
+}
+
+func (m *kubePackage) setUnschedulableFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, unschedulable bool) (starlark.Value, error) {
+	var node string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "node", &node); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	if err := m.setUnschedulable(ctx, node, unschedulable); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// kubeDrainFn is entry point for `kube.drain' callable. Cordons node and
+// evicts all pods running on it (respecting PodDisruptionBudgets), then
+// waits until evicted pods are gone:
+//
+//	kube.drain(node="gke-pool-1-abcd", grace="60s", timeout="10m", ignore_daemonsets=True)
+//
+// Mirror (static) pods and pods that already completed are skipped.
+func (m *kubePackage) kubeDrainFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var node, grace string
+	timeout := defaultDrainTimeout.String()
+	var ignoreDaemonSets bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"node", &node,
+		"grace?", &grace,
+		"timeout?", &timeout,
+		"ignore_daemonsets?", &ignoreDaemonSets,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	var gracePeriod *int64
+	if grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to parse `grace' duration: %v", b.Name(), err)
+		}
+		s := int64(d.Seconds())
+		gracePeriod = &s
+	}
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse `timeout' duration: %v", b.Name(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Local(addon.GoCtxKey).(context.Context), wait)
+	defer cancel()
+	if err := m.drain(ctx, node, gracePeriod, ignoreDaemonSets); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+func (m *kubePackage) setUnschedulable(ctx context.Context, node string, unschedulable bool) error {
+	if err := m.policy.Check(corev1.SchemeGroupVersion.WithKind("Node"), node, ""); err != nil {
+		return err
+	}
+	action := "cordoned"
+	if !unschedulable {
+		action = "uncordoned"
+	}
+	if err := m.checkWritable(strings.TrimSuffix(action, "ed"), fmt.Sprintf("node `%s'", node)); err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		fmt.Fprintf(m.diffOut, "\n*** node `%s' will be %s ***\n", node, action)
+		return nil
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable)
+	if _, err := m.dynClient.Resource(nodesGVR).Patch(ctx, node, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch node `%s': %v", node, err)
+	}
+
+	log.Infof("node `%s' %s", node, action)
+	return nil
+}
+
+func (m *kubePackage) drain(ctx context.Context, node string, gracePeriod *int64, ignoreDaemonSets bool) error {
+	if err := m.setUnschedulable(ctx, node, true); err != nil {
+		return err
+	}
+
+	ul, err := m.dynClient.Resource(podsGVR).List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + node})
+	if err != nil {
+		return fmt.Errorf("failed to list pods on node `%s': %v", node, err)
+	}
+	pods := make([]corev1.Pod, len(ul.Items))
+	for i, un := range ul.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, &pods[i]); err != nil {
+			return fmt.Errorf("failed to convert pod `%s': %v", maybeNamespaced(un.GetName(), un.GetNamespace()), err)
+		}
+	}
+
+	evict, err := podsToEvict(pods, ignoreDaemonSets)
+	if err != nil {
+		return fmt.Errorf("cannot drain node `%s': %v", node, err)
+	}
+	// Fail before evicting anything if any of the pods can't be evicted.
+	for _, p := range evict {
+		if err := m.policy.Check(corev1.SchemeGroupVersion.WithKind("Pod"), p.Name, p.Namespace); err != nil {
+			return err
+		}
+	}
+
+	if m.dryRun {
+		for _, p := range evict {
+			fmt.Fprintf(m.diffOut, "\n*** pod `%s' will be evicted ***\n", maybeNamespaced(p.Name, p.Namespace))
+		}
+		return nil
+	}
+
+	for _, p := range evict {
+		if err := m.evict(ctx, &p, gracePeriod); err != nil {
+			return err
+		}
+	}
+	for _, p := range evict {
+		if err := m.waitPodGone(ctx, &p); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("node `%s' drained (%d pods evicted)", node, len(evict))
+	return nil
+}
+
+// podsToEvict returns pods that must be evicted to drain a node. Returns an
+// error if DaemonSet pods are found and ignoreDaemonSets is not set since
+// these would be immediately rescheduled.
+func podsToEvict(pods []corev1.Pod, ignoreDaemonSets bool) ([]corev1.Pod, error) {
+	var ret []corev1.Pod
+	var dsPods []string
+	for _, p := range pods {
+		if _, ok := p.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+			continue
+		}
+		if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if c := metav1.GetControllerOf(&p); c != nil && c.Kind == "DaemonSet" {
+			if !ignoreDaemonSets {
+				dsPods = append(dsPods, maybeNamespaced(p.Name, p.Namespace))
+			}
+			continue
+		}
+		ret = append(ret, p)
+	}
+	if len(dsPods) > 0 {
+		return nil, fmt.Errorf("pods managed by DaemonSets found (set `ignore_daemonsets' to skip them): %s", strings.Join(dsPods, ", "))
+	}
+	return ret, nil
+}
+
+// evict evicts pod retrying while eviction is blocked by a
+// PodDisruptionBudget.
+func (m *kubePackage) evict(ctx context.Context, pod *corev1.Pod, gracePeriod *int64) error {
+	e := &policyv1beta1.Eviction{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: policyv1beta1.SchemeGroupVersion.String(),
+			Kind:       "Eviction",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &metav1.DeleteOptions{GracePeriodSeconds: gracePeriod},
+	}
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(e)
+	if err != nil {
+		return err
+	}
+
+	name := maybeNamespaced(pod.Name, pod.Namespace)
+	c := m.dynClient.Resource(podsGVR).Namespace(pod.Namespace)
+	for {
+		_, err := c.Create(ctx, &unstructured.Unstructured{Object: un}, metav1.CreateOptions{}, "eviction")
+		switch {
+		case err == nil, apierrors.IsNotFound(err):
+			log.Infof("pod `%s' evicted", name)
+			return nil
+		case !apierrors.IsTooManyRequests(err):
+			return fmt.Errorf("failed to evict pod `%s': %v", name, err)
+		}
+
+		log.V(1).Infof("Eviction of pod `%s' blocked by disruption budget, retrying: %v", name, err)
+		select {
+		case <-time.After(evictRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("timed out evicting pod `%s': %v", name, err)
+		}
+	}
+}
+
+// waitPodGone waits until pod is deleted (or replaced by a pod with the same
+// name).
+func (m *kubePackage) waitPodGone(ctx context.Context, pod *corev1.Pod) error {
+	c := m.dynClient.Resource(podsGVR).Namespace(pod.Namespace)
+	for {
+		un, err := c.Get(ctx, pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && un.GetUID() != pod.UID) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get pod `%s': %v", maybeNamespaced(pod.Name, pod.Namespace), err)
+		}
+
+		select {
+		case <-time.After(waitRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for pod `%s' to be deleted", maybeNamespaced(pod.Name, pod.Namespace))
+		}
+	}
+}
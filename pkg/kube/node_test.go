@@ -0,0 +1,94 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func testPod(name string, mod func(p *corev1.Pod)) corev1.Pod {
+	p := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	if mod != nil {
+		mod(&p)
+	}
+	return p
+}
+
+func TestPodsToEvict(t *testing.T) {
+	isController := true
+	dsPod := testPod("ds", func(p *corev1.Pod) {
+		p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "ds", Controller: &isController}}
+	})
+	pods := []corev1.Pod{
+		testPod("app", nil),
+		testPod("static", func(p *corev1.Pod) {
+			p.Annotations = map[string]string{corev1.MirrorPodAnnotationKey: "x"}
+		}),
+		testPod("done", func(p *corev1.Pod) { p.Status.Phase = corev1.PodSucceeded }),
+		dsPod,
+	}
+
+	for _, tc := range []struct {
+		name             string
+		ignoreDaemonSets bool
+		want             []string
+		wantErr          error
+	}{
+		{
+			name:             "ignore DaemonSets",
+			ignoreDaemonSets: true,
+			want:             []string{"app"},
+		},
+		{
+			name:    "DaemonSet pods",
+			wantErr: errors.New("pods managed by DaemonSets found (set `ignore_daemonsets' to skip them): default/ds"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := podsToEvict(pods, tc.ignoreDaemonSets)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			var names []string
+			for _, p := range got {
+				names = append(names, p.Name)
+			}
+			if d := cmp.Diff(tc.want, names); d != "" {
+				t.Errorf("Unexpected pods (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestCordonDryRun(t *testing.T) {
+	out := &bytes.Buffer{}
+	pkgs := starlark.StringDict{"kube": &kubePackage{dryRun: true, diffOut: out}}
+	if _, _, err := util.Eval(t.Name(), `kube.cordon(node="node-1")`, nil, pkgs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\n*** node `node-1' will be cordoned ***\n"; out.String() != want {
+		t.Errorf("Unexpected output.\nWant: %q\nGot: %q", want, out.String())
+	}
+}
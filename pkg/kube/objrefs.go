@@ -0,0 +1,127 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// ObjectTracker tracks objects applied by an addon so that they can be
+// recorded in the rollout store and pruned once the addon no longer applies
+// them.
+type ObjectTracker interface {
+	// TakeApplied returns references to objects applied since the last
+	// call and forgets them.
+	TakeApplied() []store.ObjRef
+	// Prune deletes objects referenced by refs. Objects that no longer
+	// exist are skipped.
+	Prune(ctx context.Context, refs []store.ObjRef) error
+	// Rollback restores objects applied since the last TakeApplied to their
+	// state before they were applied. Objects that didn't exist before are
+	// deleted.
+	Rollback(ctx context.Context) error
+}
+
+// applied records that object referenced by r was applied. obj is the object
+// returned by apiserver (or the live object in dry run, may be nil).
+func (m *kubePackage) applied(r *apiResource, obj interface{}) {
+	if r.Subresource != "" {
+		return
+	}
+	ref := objRef(r, obj)
+
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	for i, a := range m.appliedRefs {
+		if a.SameObject(ref) {
+			m.appliedRefs[i] = ref
+			return
+		}
+	}
+	m.appliedRefs = append(m.appliedRefs, ref)
+}
+
+// objRef returns reference to object r with resourceVersion of obj (if set).
+func objRef(r *apiResource, obj interface{}) store.ObjRef {
+	ref := store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	}
+	if r.ClusterScoped {
+		ref.Namespace = ""
+	}
+	if o, ok := obj.(metav1.Object); ok {
+		ref.ResourceVersion = o.GetResourceVersion()
+	}
+	return ref
+}
+
+// deleted forgets object referenced by r if it was applied before.
+func (m *kubePackage) deleted(r *apiResource) {
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	ref := store.ObjRef{Kind: r.GVK.Kind, Namespace: r.Namespace, Name: r.Name}
+	if r.ClusterScoped {
+		ref.Namespace = ""
+	}
+	for i, a := range m.appliedRefs {
+		if a.SameObject(ref) {
+			m.appliedRefs = append(m.appliedRefs[:i], m.appliedRefs[i+1:]...)
+			return
+		}
+	}
+}
+
+// TakeApplied implements ObjectTracker.TakeApplied.
+func (m *kubePackage) TakeApplied() []store.ObjRef {
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	refs := m.appliedRefs
+	m.appliedRefs = nil
+	m.snapshots = nil
+	return refs
+}
+
+// Prune implements ObjectTracker.Prune.
+func (m *kubePackage) Prune(ctx context.Context, refs []store.ObjRef) error {
+	for _, ref := range refs {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return fmt.Errorf("invalid apiVersion of %v: %v", ref, err)
+		}
+		r, err := newResourceForKind(m.dClient, ref.Name, ref.Namespace, "", gv.WithKind(ref.Kind))
+		if err != nil {
+			return fmt.Errorf("failed to map %v: %v", ref, err)
+		}
+		if err := m.kubeDelete(ctx, r, deleteOptions(metav1.DeletePropagationBackground)); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			m.count(outcomeFailed)
+			return fmt.Errorf("failed to prune %v: %v", ref, err)
+		}
+		m.count(outcomeDeleted)
+	}
+	return nil
+}
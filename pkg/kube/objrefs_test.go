@@ -0,0 +1,176 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestObjectTracker(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{})
+	tracker := pkg.(ObjectTracker)
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, expr := range []string{
+		`kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`,
+		`kube.put_yaml(name="bar", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`,
+		`kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: c\n"])`,
+		`kube.delete(configmap="default/bar")`,
+	} {
+		if _, _, err := util.Eval(t.Name(), expr, sCtx, starlark.StringDict{"kube": pkg}); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	want := []store.ObjRef{{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "foo"}}
+	if d := cmp.Diff(want, tracker.TakeApplied()); d != "" {
+		t.Errorf("Unexpected applied objects (-want +got):\n%s", d)
+	}
+	if got := tracker.TakeApplied(); len(got) != 0 {
+		t.Errorf("Applied objects were not reset: %v", got)
+	}
+
+	pkg.(StatsCollector).TakeStats()
+	if err := tracker.Prune(context.Background(), []store.ObjRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "foo"},
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "missing"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := pkg.(StatsCollector).TakeStats(); got.Deleted != 1 {
+		t.Errorf("Expected 1 pruned object, got stats: %+v", got)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	var deleted []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{})
+	tracker := pkg.(ObjectTracker)
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+	put := func(name, value string) {
+		expr := `kube.put_yaml(name="` + name + `", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: ` + value + `\n"])`
+		if _, _, err := util.Eval(t.Name(), expr, sCtx, starlark.StringDict{"kube": pkg}); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	// Previous run.
+	put("foo", "b")
+	tracker.TakeApplied()
+
+	// Failed run.
+	put("foo", "c")
+	put("foo", "d")
+	put("bar", "b")
+	if err := tracker.Rollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if err := json.Unmarshal(h.m["/api/v1/namespaces/default/configmaps/foo"], &cm); err != nil {
+		t.Fatal(err)
+	}
+	if got := cm.Data["a"]; got != "b" {
+		t.Errorf("Expected updated object to be restored, got data: %v", cm.Data)
+	}
+	wantDeleted := []string{"/api/v1/namespaces/default/configmaps/bar"}
+	if d := cmp.Diff(wantDeleted, deleted); d != "" {
+		t.Errorf("Unexpected deleted objects (-want +got):\n%s", d)
+	}
+
+	// Nothing is left to roll back.
+	deleted = nil
+	if err := tracker.Rollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Unexpected deletes on second rollback: %v", deleted)
+	}
+}
+
+func TestSnapshotFunc(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{})
+	var got []string
+	pkg.(Snapshotter).SetSnapshotFunc(func(ctx context.Context, ref store.ObjRef, manifest []byte) error {
+		got = append(got, ref.String()+"\n"+string(manifest))
+		return nil
+	})
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	// Objects that don't exist yet are not snapshotted.
+	expr := `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`
+	if _, _, err := util.Eval(t.Name(), expr, sCtx, starlark.StringDict{"kube": pkg}); err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	pkg.(ObjectTracker).TakeApplied()
+
+	for _, expr := range []string{
+		// Only the first live state of an object is snapshotted.
+		`kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: c\n"])`,
+		`kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: d\n"])`,
+	} {
+		if _, _, err := util.Eval(t.Name(), expr, sCtx, starlark.StringDict{"kube": pkg}); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	want := []string{`configmap.v1 ` + "`default/foo'" + `
+apiVersion: v1
+data:
+  a: b
+kind: ConfigMap
+metadata:
+  annotations:
+    isopod.getcruise.com/context: '{}'
+  creationTimestamp: null
+  labels:
+    heritage: isopod
+  name: foo
+  namespace: default
+`}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected snapshots (-want +got):\n%s", d)
+	}
+}
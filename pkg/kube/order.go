@@ -0,0 +1,158 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+)
+
+const (
+	// OrderKind applies objects in kind priority order (see kindOrder).
+	OrderKind = "kind"
+	// OrderManifest applies objects in the order they are listed.
+	OrderManifest = "manifest"
+)
+
+// CheckOrder returns an error if order is not a supported `order' argument
+// value.
+func CheckOrder(order string) error {
+	switch order {
+	case OrderKind, OrderManifest:
+		return nil
+	}
+	return fmt.Errorf("unsupported order `%s' (must be one of: %s, %s)", order, OrderKind, OrderManifest)
+}
+
+// kindOrder lists kinds in the order they must be applied so that objects
+// are created after objects they depend on (e.g namespaced objects after
+// their Namespace, custom resources after their CRD). Kinds not listed are
+// applied after listed ones except webhooks, which go last so that they
+// don't intercept creation of their own backends.
+var kindOrder = []string{
+	"Namespace",
+	"CustomResourceDefinition",
+	"PriorityClass",
+	"StorageClass",
+	"ServiceAccount",
+	"PodSecurityPolicy",
+	"ClusterRole",
+	"Role",
+	"ClusterRoleBinding",
+	"RoleBinding",
+	"ConfigMap",
+	"Secret",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"Service",
+	"DaemonSet",
+	"Deployment",
+	"StatefulSet",
+	"ReplicaSet",
+	"Pod",
+	"Job",
+	"CronJob",
+}
+
+// lastKinds are applied after all other kinds.
+var lastKinds = []string{
+	"APIService",
+	"ValidatingWebhookConfiguration",
+	"MutatingWebhookConfiguration",
+}
+
+var kindPriorities = func() map[string]int {
+	m := map[string]int{}
+	for i, k := range kindOrder {
+		m[k] = i
+	}
+	for i, k := range lastKinds {
+		m[k] = len(kindOrder) + 1 + i
+	}
+	return m
+}()
+
+// kindPriority returns the apply priority of kind (lower is applied first).
+func kindPriority(kind string) int {
+	if p, ok := kindPriorities[kind]; ok {
+		return p
+	}
+	return len(kindOrder)
+}
+
+// applyOrder returns indices of kinds in the order objects of these kinds
+// must be applied. Order of objects of the same priority is preserved.
+func applyOrder(kinds []string) []int {
+	idx := make([]int, len(kinds))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return kindPriority(kinds[idx[a]]) < kindPriority(kinds[idx[b]])
+	})
+	return idx
+}
+
+// sortList returns items of data in apply order using kindFn to extract kind
+// of each item. If kind of any item can't be determined data is returned as
+// is so that the error is reported when the item is applied.
+func sortList(data *starlark.List, kindFn func(starlark.Value) (string, bool)) *starlark.List {
+	kinds := make([]string, data.Len())
+	for i := range kinds {
+		k, ok := kindFn(data.Index(i))
+		if !ok {
+			return data
+		}
+		kinds[i] = k
+	}
+	vs := make([]starlark.Value, 0, len(kinds))
+	for _, i := range applyOrder(kinds) {
+		vs = append(vs, data.Index(i))
+	}
+	return starlark.NewList(vs)
+}
+
+// SortYAML returns YAML manifests in data in apply order.
+func SortYAML(data *starlark.List) *starlark.List {
+	return sortList(data, func(v starlark.Value) (string, bool) {
+		s, ok := v.(starlark.String)
+		if !ok {
+			return "", false
+		}
+		_, gvk, err := decode([]byte(s))
+		if err != nil {
+			return "", false
+		}
+		return gvk.Kind, true
+	})
+}
+
+// sortProtos returns protobuf messages in data in apply order.
+func sortProtos(data *starlark.List) *starlark.List {
+	return sortList(data, func(v starlark.Value) (string, bool) {
+		msg, ok := skycfg.AsProtoMessage(v)
+		if !ok {
+			return "", false
+		}
+		_, _, k, err := guessGVKFromMsg(msg)
+		if err != nil {
+			return "", false
+		}
+		return k, true
+	})
+}
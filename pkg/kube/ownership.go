@@ -0,0 +1,244 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// FieldManager is the manager name Isopod updates objects as (recorded in
+// their metadata.managedFields).
+const FieldManager = "isopod"
+
+// ErrFieldConflict is returned (wrapped) when an update would overwrite
+// fields managed by another manager and ownership is strict.
+var ErrFieldConflict = errors.New("fields are managed by another manager")
+
+// OwnershipChecker is implemented by kube packages that detect updates
+// overwriting fields managed by other controllers.
+type OwnershipChecker interface {
+	// SetStrictOwnership makes such updates fail instead of logging a
+	// warning.
+	SetStrictOwnership(strict bool)
+}
+
+// SetStrictOwnership implements OwnershipChecker.SetStrictOwnership.
+func (m *kubePackage) SetStrictOwnership(strict bool) {
+	m.strictOwnership = strict
+}
+
+// fieldConflict is a field of the live object owned by manager that an
+// update would change.
+type fieldConflict struct {
+	path, manager string
+}
+
+func (c fieldConflict) String() string { return fmt.Sprintf("`%s' (%s)", c.path, c.manager) }
+
+// checkOwnership warns about (or fails with --strict_ownership) fields set by
+// obj to values other than those of live object r when the fields are
+// managed by another manager (e.g replicas scaled by an HPA), which would
+// otherwise keep flipping them back. Fields obj doesn't set are not checked.
+func (m *kubePackage) checkOwnership(r *apiResource, live, obj runtime.Object) error {
+	conflicts, err := fieldConflicts(live, obj)
+	if err != nil {
+		log.Warningf("Failed to check field ownership of %v: %v", r, err)
+		return nil
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	cs := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		cs[i] = c.String()
+	}
+	if m.strictOwnership {
+		return fmt.Errorf("%v: %w: %s", r, ErrFieldConflict, strings.Join(cs, ", "))
+	}
+	log.Warningf("%v: overwriting fields managed by another manager: %s (use --strict_ownership to fail instead)", r, strings.Join(cs, ", "))
+	return nil
+}
+
+// fieldConflicts returns fields of live owned by managers other than Isopod
+// that obj sets to a different value, sorted by path.
+func fieldConflicts(live, obj runtime.Object) ([]fieldConflict, error) {
+	liveMeta, ok := live.(metav1.Object)
+	if !ok {
+		return nil, nil
+	}
+	var managed []metav1.ManagedFieldsEntry
+	for _, e := range liveMeta.GetManagedFields() {
+		// Status is never updated by Isopod (and only reported in 1.22+).
+		if strings.EqualFold(e.Manager, FieldManager) || e.Subresource != "" || e.FieldsV1 == nil {
+			continue
+		}
+		managed = append(managed, e)
+	}
+	if len(managed) == 0 {
+		return nil, nil
+	}
+
+	liveU, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	objU, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []fieldConflict
+	seen := map[string]bool{}
+	for _, e := range managed {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(e.FieldsV1.Raw, &fields); err != nil {
+			return nil, fmt.Errorf("failed to parse managed fields of `%s': %v", e.Manager, err)
+		}
+		walkManagedFields(fields, "", liveU, objU, func(path string) {
+			if !seen[path] {
+				seen[path] = true
+				conflicts = append(conflicts, fieldConflict{path: path, manager: e.Manager})
+			}
+		})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].path < conflicts[j].path })
+	return conflicts, nil
+}
+
+// walkManagedFields walks fields (a FieldsV1 set) along live and obj values
+// at path and calls conflict with paths of owned leaf fields whose value in
+// obj is set and differs from live.
+func walkManagedFields(fields map[string]interface{}, path string, live, obj interface{}, conflict func(path string)) {
+	for _, k := range sortedFieldKeys(fields) {
+		if k == "." {
+			continue
+		}
+		children, _ := fields[k].(map[string]interface{})
+		p, liveV, objV, ok := managedChild(k, path, live, obj)
+		if !ok || objV == nil {
+			continue
+		}
+		if len(children) > 0 {
+			walkManagedFields(children, p, liveV, objV, conflict)
+			continue
+		}
+		if !reflect.DeepEqual(normalizeJSON(liveV), normalizeJSON(objV)) {
+			conflict(p)
+		}
+	}
+}
+
+// managedChild resolves FieldsV1 key k (`f:<field>', `k:<keys>' or
+// `i:<index>') under path in live and obj. Set members (`v:<value>') are not
+// resolved as they can't change value.
+func managedChild(k, path string, live, obj interface{}) (childPath string, liveV, objV interface{}, ok bool) {
+	if len(k) < 2 || k[1] != ':' {
+		return "", nil, nil, false
+	}
+	switch arg := k[2:]; k[0] {
+	case 'f':
+		lm, _ := live.(map[string]interface{})
+		om, ok := obj.(map[string]interface{})
+		if !ok {
+			return "", nil, nil, false
+		}
+		childPath = arg
+		if path != "" {
+			childPath = path + "." + arg
+		}
+		return childPath, lm[arg], om[arg], true
+	case 'k':
+		var keys map[string]interface{}
+		if err := json.Unmarshal([]byte(arg), &keys); err != nil {
+			return "", nil, nil, false
+		}
+		ol, ok := obj.([]interface{})
+		if !ok {
+			return "", nil, nil, false
+		}
+		ll, _ := live.([]interface{})
+		var sel []string
+		for _, kk := range sortedFieldKeys(keys) {
+			sel = append(sel, fmt.Sprintf("%s=%v", kk, keys[kk]))
+		}
+		return fmt.Sprintf("%s[%s]", path, strings.Join(sel, ",")), listItem(ll, keys), listItem(ol, keys), true
+	case 'i':
+		i, err := strconv.Atoi(arg)
+		ol, ok := obj.([]interface{})
+		if err != nil || !ok || i >= len(ol) {
+			return "", nil, nil, false
+		}
+		var liveV interface{}
+		if ll, _ := live.([]interface{}); i < len(ll) {
+			liveV = ll[i]
+		}
+		return fmt.Sprintf("%s[%d]", path, i), liveV, ol[i], true
+	}
+	return "", nil, nil, false
+}
+
+// listItem returns the first map item of l whose fields match keys.
+func listItem(l []interface{}, keys map[string]interface{}) interface{} {
+	for _, item := range l {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		match := true
+		for k, v := range keys {
+			if !reflect.DeepEqual(normalizeJSON(m[k]), normalizeJSON(v)) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return item
+		}
+	}
+	return nil
+}
+
+// normalizeJSON returns v as decoded from its JSON form so that numbers of
+// different Go types compare equal.
+func normalizeJSON(v interface{}) interface{} {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(bs, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+func sortedFieldKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
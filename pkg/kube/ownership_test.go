@@ -0,0 +1,140 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func testDeployment(replicas int32, image string, annotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "web", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+func TestFieldConflicts(t *testing.T) {
+	live := testDeployment(5, "web:v1", map[string]string{"cert-manager.io/issuer": "ca"})
+	live.ManagedFields = []metav1.ManagedFieldsEntry{
+		{
+			Manager:  "isopod",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"web\"}":{".":{},"f:image":{},"f:name":{}}}}}}}`)},
+		},
+		{
+			Manager:  "kube-controller-manager",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+		},
+		{
+			Manager:  "cert-manager",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{".":{},"f:cert-manager.io/issuer":{}}}}`)},
+		},
+		{
+			Manager:     "kube-controller-manager",
+			Subresource: "status",
+			FieldsV1:    &metav1.FieldsV1{Raw: []byte(`{"f:status":{"f:replicas":{}}}`)},
+		},
+	}
+	kubectlOwned := live.DeepCopy()
+	kubectlOwned.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:  "kubectl-edit",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"web\"}":{"f:image":{}}}}}}}`)},
+	}}
+
+	for _, tc := range []struct {
+		name      string
+		live, obj *appsv1.Deployment
+		want      []fieldConflict
+	}{
+		{
+			name: "Unchanged",
+			live: live,
+			obj:  testDeployment(5, "web:v2", map[string]string{"cert-manager.io/issuer": "ca"}),
+		},
+		{
+			name: "Managed fields changed",
+			live: live,
+			obj:  testDeployment(1, "web:v2", map[string]string{"cert-manager.io/issuer": "other"}),
+			want: []fieldConflict{
+				{path: "metadata.annotations.cert-manager.io/issuer", manager: "cert-manager"},
+				{path: "spec.replicas", manager: "kube-controller-manager"},
+			},
+		},
+		{
+			name: "Managed fields not set",
+			live: live,
+			obj: func() *appsv1.Deployment {
+				d := testDeployment(0, "web:v2", nil)
+				d.Spec.Replicas = nil
+				return d
+			}(),
+		},
+		{
+			name: "List item field changed",
+			live: kubectlOwned,
+			obj:  testDeployment(5, "web:v2", nil),
+			want: []fieldConflict{
+				{path: "spec.template.spec.containers[name=web].image", manager: "kubectl-edit"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := fieldConflicts(tc.live, tc.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got, cmp.AllowUnexported(fieldConflict{})); d != "" {
+				t.Errorf("Unexpected conflicts (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestCheckOwnershipStrict(t *testing.T) {
+	live := testDeployment(5, "web:v1", nil)
+	live.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:  "kube-controller-manager",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+	}}
+	r := &apiResource{GVK: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Name: "web", Namespace: "default"}
+	obj := testDeployment(1, "web:v1", nil)
+
+	m := &kubePackage{}
+	if err := m.checkOwnership(r, live, obj); err != nil {
+		t.Errorf("Unexpected error without strict ownership: %v", err)
+	}
+	m.SetStrictOwnership(true)
+	err := m.checkOwnership(r, live, obj)
+	if !errors.Is(err, ErrFieldConflict) {
+		t.Fatalf("Want %v, got: %v", ErrFieldConflict, err)
+	}
+	want := "deployment.apps/v1 `default/web': fields are managed by another manager: `spec.replicas' (kube-controller-manager)"
+	if err.Error() != want {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %s", want, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/plan"
+)
+
+// newMutation returns *plan.Mutation for resource r with resource version of
+// the live object (may be nil).
+func newMutation(action plan.Action, r *apiResource, live runtime.Object) (*plan.Mutation, error) {
+	m := &plan.Mutation{
+		Action:      action,
+		Group:       r.GVK.Group,
+		Version:     r.GVK.Version,
+		Kind:        r.GVK.Kind,
+		Resource:    r.Resource,
+		Subresource: r.Subresource,
+		Name:        r.Name,
+	}
+	if !r.ClusterScoped {
+		m.Namespace = r.Namespace
+	}
+	if live != nil {
+		a, err := meta.Accessor(live)
+		if err != nil {
+			return nil, err
+		}
+		m.LiveResourceVersion = a.GetResourceVersion()
+	}
+	return m, nil
+}
+
+// recordPut records creation (or update if live is not nil) of obj.
+func (m *kubePackage) recordPut(r *apiResource, live, obj runtime.Object) error {
+	mut, err := newMutation(plan.PutAction, r, live)
+	if err != nil {
+		return err
+	}
+
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return fmt.Errorf("failed to convert %v to unstructured: %v", r, err)
+	}
+	// Copy since unstructured objects are returned as-is.
+	un = runtime.DeepCopyJSON(un)
+
+	apiVersion, kind := r.GVK.ToAPIVersionAndKind()
+	un["apiVersion"], un["kind"] = apiVersion, kind
+	// Resource version is taken from the live object at apply time.
+	unstructured.RemoveNestedField(un, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(un, "metadata", "creationTimestamp")
+	mut.Object = un
+
+	return m.recorder.Record(mut)
+}
+
+// recordDelete records deletion of the object referenced by r.
+func (m *kubePackage) recordDelete(ctx context.Context, r *apiResource, opts metav1.DeleteOptions) error {
+	live, _, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+	if err != nil {
+		return err
+	}
+
+	mut, err := newMutation(plan.DeleteAction, r, live)
+	if err != nil {
+		return err
+	}
+	if opts.PropagationPolicy != nil {
+		mut.PropagationPolicy = string(*opts.PropagationPolicy)
+	}
+	mut.GracePeriodSeconds = opts.GracePeriodSeconds
+	if p := opts.Preconditions; p != nil {
+		// Resource version precondition is checked against the live object
+		// at plan time as the plan is applied with the live resource
+		// version as precondition anyway.
+		if p.ResourceVersion != nil && *p.ResourceVersion != mut.LiveResourceVersion {
+			return fmt.Errorf("precondition failed: resourceVersion of %v is `%s' (want `%s')", r, mut.LiveResourceVersion, *p.ResourceVersion)
+		}
+		if p.UID != nil {
+			mut.UID = string(*p.UID)
+		}
+	}
+
+	return m.recorder.Record(mut)
+}
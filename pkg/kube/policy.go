@@ -0,0 +1,113 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ErrForbiddenByPolicy is returned (wrapped) when Policy doesn't allow a
+// mutation.
+var ErrForbiddenByPolicy = errors.New("forbidden by policy")
+
+// Policy restricts objects the kube package may mutate so that
+// namespace-scoped teams can share Isopod without risking cluster-scoped
+// changes. Empty lists don't restrict anything. Kinds match either the kind
+// (e.g `ClusterRole') or the kind qualified with its API group (e.g
+// `ClusterRole.rbac.authorization.k8s.io'), case-insensitively.
+type Policy struct {
+	// AllowNamespaces are the only namespaces objects may be mutated in.
+	// Cluster-scoped objects other than the allowed Namespaces themselves
+	// are denied when set.
+	AllowNamespaces []string
+	DenyNamespaces  []string
+	AllowKinds      []string
+	DenyKinds       []string
+}
+
+// Empty returns true if p doesn't restrict anything.
+func (p *Policy) Empty() bool {
+	return p == nil || len(p.AllowNamespaces)+len(p.DenyNamespaces)+len(p.AllowKinds)+len(p.DenyKinds) == 0
+}
+
+// Check returns an error wrapping ErrForbiddenByPolicy if p doesn't allow
+// mutating object of gvk named name in namespace (empty for cluster-scoped
+// objects).
+func (p *Policy) Check(gvk schema.GroupVersionKind, name, namespace string) error {
+	if p.Empty() {
+		return nil
+	}
+	forbidden := func(reason string, args ...interface{}) error {
+		return fmt.Errorf("%s is %w: %s", diffName(gvk, maybeNamespaced(name, namespace)), ErrForbiddenByPolicy, fmt.Sprintf(reason, args...))
+	}
+
+	if len(p.AllowKinds) > 0 && !matchKind(p.AllowKinds, gvk) {
+		return forbidden("kind is not in allowed kinds (%s)", strings.Join(p.AllowKinds, ", "))
+	}
+	if matchKind(p.DenyKinds, gvk) {
+		return forbidden("kind is denied")
+	}
+
+	// Namespaces are checked as if they were in themselves.
+	ns := namespace
+	if gvk.Group == "" && gvk.Kind == "Namespace" {
+		ns = name
+	}
+	if ns == "" {
+		if len(p.AllowNamespaces) > 0 {
+			return forbidden("cluster-scoped objects are not allowed when namespaces are restricted")
+		}
+		return nil
+	}
+	if len(p.AllowNamespaces) > 0 && !contains(p.AllowNamespaces, ns) {
+		return forbidden("namespace `%s' is not in allowed namespaces (%s)", ns, strings.Join(p.AllowNamespaces, ", "))
+	}
+	if contains(p.DenyNamespaces, ns) {
+		return forbidden("namespace `%s' is denied", ns)
+	}
+	return nil
+}
+
+// checkPolicy returns an error if policy of m doesn't allow mutating r.
+func (m *kubePackage) checkPolicy(r *apiResource) error {
+	ns := r.Namespace
+	if r.ClusterScoped {
+		ns = ""
+	}
+	return m.policy.Check(r.GVK, r.Name, ns)
+}
+
+func matchKind(kinds []string, gvk schema.GroupVersionKind) bool {
+	qualified := gvk.GroupKind().String()
+	for _, k := range kinds {
+		if strings.EqualFold(k, gvk.Kind) || strings.EqualFold(k, qualified) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	cm := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ns := schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+	cr := schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}
+
+	for _, tc := range []struct {
+		name           string
+		policy         *Policy
+		gvk            schema.GroupVersionKind
+		objName, objNs string
+		wantErr        string
+	}{
+		{
+			name:    "No policy",
+			gvk:     cr,
+			objName: "admin",
+		},
+		{
+			name:    "Allowed namespace",
+			policy:  &Policy{AllowNamespaces: []string{"team-a"}},
+			gvk:     cm,
+			objName: "foo",
+			objNs:   "team-a",
+		},
+		{
+			name:    "Namespace not allowed",
+			policy:  &Policy{AllowNamespaces: []string{"team-a"}},
+			gvk:     cm,
+			objName: "foo",
+			objNs:   "team-b",
+			wantErr: "namespace `team-b' is not in allowed namespaces (team-a)",
+		},
+		{
+			name:    "Cluster-scoped with allowed namespaces",
+			policy:  &Policy{AllowNamespaces: []string{"team-a"}},
+			gvk:     cr,
+			objName: "admin",
+			wantErr: "cluster-scoped objects are not allowed",
+		},
+		{
+			name:    "Allowed Namespace object",
+			policy:  &Policy{AllowNamespaces: []string{"team-a"}},
+			gvk:     ns,
+			objName: "team-a",
+		},
+		{
+			name:    "Denied namespace",
+			policy:  &Policy{DenyNamespaces: []string{"kube-system"}},
+			gvk:     cm,
+			objName: "foo",
+			objNs:   "kube-system",
+			wantErr: "namespace `kube-system' is denied",
+		},
+		{
+			name:    "Denied kind",
+			policy:  &Policy{DenyKinds: []string{"clusterrole"}},
+			gvk:     cr,
+			objName: "admin",
+			wantErr: "kind is denied",
+		},
+		{
+			name:    "Denied qualified kind",
+			policy:  &Policy{DenyKinds: []string{"ClusterRole.rbac.authorization.k8s.io"}},
+			gvk:     cr,
+			objName: "admin",
+			wantErr: "kind is denied",
+		},
+		{
+			name:    "Kind not allowed",
+			policy:  &Policy{AllowKinds: []string{"ConfigMap", "Secret"}},
+			gvk:     cr,
+			objName: "admin",
+			wantErr: "kind is not in allowed kinds (ConfigMap, Secret)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Check(tc.gvk, tc.objName, tc.objNs)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Expected error containing `%s', got: %v", tc.wantErr, err)
+			}
+			if !errors.Is(err, ErrForbiddenByPolicy) {
+				t.Errorf("Expected error to wrap ErrForbiddenByPolicy, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestPolicyEnforced(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	pkg := newTestPackage(s, nil, Options{
+		Policy: &Policy{AllowNamespaces: []string{"default"}},
+	})
+	env := starlark.StringDict{"kube": pkg}
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	if _, _, err := util.Eval(t.Name(), `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\n"])`, sCtx, env); err != nil {
+		t.Fatalf("Expected put to allowed namespace to succeed, got: %v", err)
+	}
+
+	for _, expr := range []string{
+		`kube.put_yaml(name="foo", namespace="other", data=["apiVersion: v1\nkind: ConfigMap\n"])`,
+		`kube.delete(configmap="other/foo")`,
+	} {
+		_, _, err := util.Eval(t.Name(), expr, sCtx, env)
+		if err == nil || !strings.Contains(err.Error(), ErrForbiddenByPolicy.Error()) {
+			t.Errorf("Expected %s to be forbidden, got: %v", expr, err)
+		}
+	}
+	if _, ok := h.m["/api/v1/namespaces/other/configmaps/foo"]; ok {
+		t.Errorf("Forbidden object was created")
+	}
+}
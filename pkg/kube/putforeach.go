@@ -0,0 +1,135 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto" //nolint:staticcheck
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const kubePutForEachMethod = "put_for_each"
+
+// kubePutForEachFn is entry point for `kube.put_for_each' callable. Applies a
+// copy of each object in data to each namespace in namespaces, so that
+// per-namespace objects (e.g quotas, network policies or role bindings) of a
+// fleet are declared once:
+//
+//	kube.put_for_each(namespaces=["team-a", "team-b"], data=[quota, policy])
+//
+// Objects must set .metadata.name but not .metadata.namespace, which is set
+// to each namespace in turn. Objects are applied namespace by namespace as by
+// `kube.put' and data is left unmodified.
+func (m *kubePackage) kubePutForEachFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var apiGroup string
+	order := OrderKind
+	namespaces, data := &starlark.List{}, &starlark.List{}
+	var force, manageMetadata starlark.Value = starlark.None, starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"namespaces", &namespaces,
+		"data", &data,
+		apiGroupKW+"?", &apiGroup,
+		"order?", &order,
+		"force?", &force,
+		"manage_metadata?", &manageMetadata,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if err := CheckOrder(order); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	nss, err := namespaceList(namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if order == OrderKind {
+		data = sortProtos(data)
+	}
+
+	a := meta.NewAccessor()
+	msgs := make([]proto.Message, data.Len())
+	names := make([]string, data.Len())
+	for i := range msgs {
+		maybeMsg := data.Index(i)
+		msg, ok := skycfg.AsProtoMessage(maybeMsg)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: item %d is not a protobuf type. got: %s", b.Name(), i, maybeMsg.Type())
+		}
+		obj, ok := msg.(runtime.Object)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: item %d is not a Kubernetes object. got: %s", b.Name(), i, maybeMsg.Type())
+		}
+		if names[i], err = a.Name(obj); err != nil {
+			return nil, fmt.Errorf("<%v>: item %d: %v", b.Name(), i, err)
+		}
+		if names[i] == "" {
+			return nil, fmt.Errorf("<%v>: item %d: .metadata.name must be set", b.Name(), i)
+		}
+		ns, err := a.Namespace(obj)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: item %d: %v", b.Name(), i, err)
+		}
+		if ns != "" {
+			return nil, fmt.Errorf("<%v>: item %d: .metadata.namespace must not be set (got `%s'), objects are put to each of `namespaces'", b.Name(), i, ns)
+		}
+		msgs[i] = msg
+	}
+
+	for _, ns := range nss {
+		for i, msg := range msgs {
+			clone, ok := msg.(runtime.Object).DeepCopyObject().(proto.Message)
+			if !ok {
+				return nil, fmt.Errorf("<%v>: item %d can't be copied", b.Name(), i)
+			}
+			pa := &putArgs{
+				name:           names[i],
+				namespace:      ns,
+				apiGroup:       apiGroup,
+				force:          force,
+				manageMetadata: manageMetadata,
+			}
+			if err := m.putItem(t, i, data.Index(i).Type(), clone, pa); err != nil {
+				return nil, fmt.Errorf("<%v>: namespace `%s': %v", b.Name(), ns, err)
+			}
+		}
+	}
+	return starlark.None, nil
+}
+
+// namespaceList returns namespaces in l, which must be unique non-empty
+// strings.
+func namespaceList(l *starlark.List) ([]string, error) {
+	if l.Len() == 0 {
+		return nil, fmt.Errorf("`namespaces' must not be empty")
+	}
+	seen := map[string]bool{}
+	nss := make([]string, l.Len())
+	for i := range nss {
+		s, ok := l.Index(i).(starlark.String)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("`namespaces' must be a list of non-empty strings (got `%v')", l.Index(i))
+		}
+		if seen[string(s)] {
+			return nil, fmt.Errorf("duplicate namespace `%s' in `namespaces'", string(s))
+		}
+		seen[string(s)] = true
+		nss[i] = string(s)
+	}
+	return nss, nil
+}
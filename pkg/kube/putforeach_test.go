@@ -0,0 +1,115 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestPutForEach(t *testing.T) {
+	const (
+		cm    = `corev1.ConfigMap(metadata=metav1.ObjectMeta(name="settings"), data={"a": "b"})`
+		quota = `corev1.ResourceQuota(metadata=metav1.ObjectMeta(name="quota"))`
+	)
+	for _, tc := range []struct {
+		name     string
+		expr     string
+		want     string
+		wantObjs []string
+		wantErr  string
+	}{
+		{
+			name: "Put to each namespace",
+			expr: `kube.put_for_each(namespaces=["team-a", "team-b"], data=[` + cm + `, ` + quota + `])`,
+			want: "None",
+			wantObjs: []string{
+				"/api/v1/namespaces/team-a/configmaps/settings",
+				"/api/v1/namespaces/team-a/resourcequotas/quota",
+				"/api/v1/namespaces/team-b/configmaps/settings",
+				"/api/v1/namespaces/team-b/resourcequotas/quota",
+			},
+		},
+		{
+			name:     "Data unmodified",
+			expr:     `[[kube.put_for_each(namespaces=["team-a"], data=[o]), o.metadata.namespace][-1] for o in [` + cm + `]][0]`,
+			want:     `""`,
+			wantObjs: []string{"/api/v1/namespaces/team-a/configmaps/settings"},
+		},
+		{
+			name:    "No namespaces",
+			expr:    `kube.put_for_each(namespaces=[], data=[` + cm + `])`,
+			wantErr: "<kube.put_for_each>: `namespaces' must not be empty",
+		},
+		{
+			name:    "Duplicate namespace",
+			expr:    `kube.put_for_each(namespaces=["team-a", "team-a"], data=[` + cm + `])`,
+			wantErr: "<kube.put_for_each>: duplicate namespace `team-a' in `namespaces'",
+		},
+		{
+			name:    "Namespace set",
+			expr:    `kube.put_for_each(namespaces=["team-a"], data=[corev1.ConfigMap(metadata=metav1.ObjectMeta(name="settings", namespace="default"))])`,
+			wantErr: "<kube.put_for_each>: item 0: .metadata.namespace must not be set (got `default'), objects are put to each of `namespaces'",
+		},
+		{
+			name:    "Name missing",
+			expr:    `kube.put_for_each(namespaces=["team-a"], data=[corev1.ConfigMap()])`,
+			wantErr: "<kube.put_for_each>: item 0: .metadata.name must be set",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fk := &fakeKube{m: map[string][]byte{}}
+			s := httptest.NewServer(fk)
+			defer s.Close()
+			pkg := newTestPackage(s, nil, Options{})
+
+			pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+			addImports(t, pkgs)
+			pkgs["kube"] = pkg
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			got, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			if got.String() != tc.want {
+				t.Errorf("Unexpected result.\nWant: %s\nGot: %s", tc.want, got)
+			}
+			var objs []string
+			for k := range fk.m {
+				objs = append(objs, k)
+			}
+			sort.Strings(objs)
+			if d := cmp.Diff(tc.wantObjs, objs); d != "" {
+				t.Errorf("Unexpected objects (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// asQuantity converts v (a Quantity, quantity string or a number) to
+// resource.Quantity.
+func asQuantity(v starlark.Value) (resource.Quantity, error) {
+	switch v := v.(type) {
+	case starlark.String:
+		return resource.ParseQuantity(string(v))
+	case starlark.Int:
+		return resource.ParseQuantity(v.String())
+	case starlark.Float:
+		return resource.ParseQuantity(strconv.FormatFloat(float64(v), 'f', -1, 64))
+	}
+	if msg, ok := skycfg.AsProtoMessage(v); ok {
+		if q, ok := msg.(*resource.Quantity); ok {
+			return q.DeepCopy(), nil
+		}
+	}
+	return resource.Quantity{}, fmt.Errorf("want quantity, string or number (got: %s)", v.Type())
+}
+
+// quantityArgs converts positional args of b to quantities.
+func quantityArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, min int) ([]resource.Quantity, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	if len(args) < min {
+		return nil, fmt.Errorf("%s: got %d arguments, want at least %d", b.Name(), len(args), min)
+	}
+	qs := make([]resource.Quantity, len(args))
+	for i, a := range args {
+		q, err := asQuantity(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: for parameter %d: %v", b.Name(), i+1, err)
+		}
+		qs[i] = q
+	}
+	return qs, nil
+}
+
+// quantityRat returns exact value of q.
+func quantityRat(q resource.Quantity) *big.Rat {
+	r, _ := new(big.Rat).SetString(q.AsDec().String())
+	return r
+}
+
+// ratQuantity returns r rounded to milli-units (the precision of quantities)
+// as a quantity in format.
+func ratQuantity(r *big.Rat, format resource.Format) (*resource.Quantity, error) {
+	q, err := resource.ParseQuantity(r.FloatString(3))
+	if err != nil {
+		return nil, err
+	}
+	// Parsed string is cached so quantity is rebuilt to be formatted
+	// canonically.
+	return resource.NewDecimalQuantity(*q.AsDec(), format), nil
+}
+
+// quantityAddFn is an entry point for `kube.quantity_add' built-in. Returns
+// sum of quantities:
+//
+//	kube.quantity_add("1Gi", "512Mi")  # 1536Mi
+func quantityAddFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	qs, err := quantityArgs(b, args, kwargs, 1)
+	if err != nil {
+		return nil, err
+	}
+	sum := qs[0]
+	for _, q := range qs[1:] {
+		sum.Add(q)
+	}
+	return skycfg.NewProtoMessage(&sum), nil
+}
+
+// quantitySubFn is an entry point for `kube.quantity_sub' built-in. Returns
+// the first quantity minus the others.
+func quantitySubFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	qs, err := quantityArgs(b, args, kwargs, 2)
+	if err != nil {
+		return nil, err
+	}
+	diff := qs[0]
+	for _, q := range qs[1:] {
+		diff.Sub(q)
+	}
+	return skycfg.NewProtoMessage(&diff), nil
+}
+
+// scaleQuantity multiplies quantity arg by factor (divided by div).
+func scaleQuantity(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, factorName string, div int64) (starlark.Value, error) {
+	var qv, fv starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &qv, &fv); err != nil {
+		return nil, err
+	}
+	q, err := asQuantity(qv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: for parameter 1: %v", b.Name(), err)
+	}
+	var f *big.Rat
+	switch fv := fv.(type) {
+	case starlark.Int:
+		f, _ = new(big.Rat).SetString(fv.String())
+	case starlark.Float:
+		f, _ = new(big.Rat).SetString(strconv.FormatFloat(float64(fv), 'f', -1, 64))
+	}
+	if f == nil {
+		return nil, fmt.Errorf("%s: %s must be a number (got: %s)", b.Name(), factorName, fv.Type())
+	}
+	r := new(big.Rat).Mul(quantityRat(q), f)
+	r.Quo(r, big.NewRat(div, 1))
+	out, err := ratQuantity(r, q.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return skycfg.NewProtoMessage(out), nil
+}
+
+// quantityMulFn is an entry point for `kube.quantity_mul' built-in. Returns
+// quantity multiplied by an int or float factor (rounded to milli-units):
+//
+//	kube.quantity_mul("250m", 3)  # 750m
+func quantityMulFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return scaleQuantity(b, args, kwargs, "factor", 1)
+}
+
+// quantityPercentFn is an entry point for `kube.quantity_percent' built-in.
+// Returns percent of quantity (e.g of node's allocatable memory):
+//
+//	kube.quantity_percent(ctx.node_memory, 10)
+func quantityPercentFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return scaleQuantity(b, args, kwargs, "percent", 100)
+}
+
+// quantityCmpFn is an entry point for `kube.quantity_cmp' built-in. Returns
+// -1, 0 or 1 if the first quantity is less than, equal to or greater than
+// the second.
+func quantityCmpFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s: got %d arguments, want 2", b.Name(), len(args))
+	}
+	qs, err := quantityArgs(b, args, kwargs, 2)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(qs[0].Cmp(qs[1])), nil
+}
+
+// quantityMinFn is an entry point for `kube.quantity_min' built-in. Returns
+// the smallest of quantities.
+func quantityMinFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return extremeQuantity(b, args, kwargs, -1)
+}
+
+// quantityMaxFn is an entry point for `kube.quantity_max' built-in. Returns
+// the largest of quantities.
+func quantityMaxFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return extremeQuantity(b, args, kwargs, 1)
+}
+
+// extremeQuantity returns the quantity q of args for which q.Cmp(other) is
+// sign for all others.
+func extremeQuantity(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, sign int) (starlark.Value, error) {
+	qs, err := quantityArgs(b, args, kwargs, 1)
+	if err != nil {
+		return nil, err
+	}
+	out := qs[0]
+	for _, q := range qs[1:] {
+		if q.Cmp(out) == sign {
+			out = q
+		}
+	}
+	return skycfg.NewProtoMessage(&out), nil
+}
+
+// quantityValueFn is an entry point for `kube.quantity_value' built-in.
+// Converts quantity to a float number of units (a quantity suffix, e.g `Mi'
+// or `m', base units by default):
+//
+//	kube.quantity_value("2Gi", "Mi")  # 2048.0
+func quantityValueFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var qv starlark.Value
+	var unit string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "quantity", &qv, "unit?", &unit); err != nil {
+		return nil, err
+	}
+	q, err := asQuantity(qv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: for parameter 1: %v", b.Name(), err)
+	}
+	u, err := resource.ParseQuantity("1" + unit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid unit `%s'", b.Name(), unit)
+	}
+	f, _ := new(big.Rat).Quo(quantityRat(q), quantityRat(u)).Float64()
+	return starlark.Float(f), nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// ReadOnlyGuard is implemented by kube packages that can refuse to mutate
+// clusters regardless of what addons ask for.
+type ReadOnlyGuard interface {
+	// SetReadOnly makes every mutation fail with isopod.ErrReadOnly.
+	// Dry run diffs still work as they don't mutate anything.
+	SetReadOnly(readOnly bool)
+}
+
+// SetReadOnly implements ReadOnlyGuard.SetReadOnly.
+func (m *kubePackage) SetReadOnly(readOnly bool) {
+	m.readOnly = readOnly
+}
+
+// checkWritable returns an error wrapping isopod.ErrReadOnly if m is
+// read-only and would really mutate obj (action is e.g `update').
+func (m *kubePackage) checkWritable(action string, obj interface{}) error {
+	if !m.readOnly || m.dryRun {
+		return nil
+	}
+	return fmt.Errorf("cannot %s %v: %w", action, obj, isopod.ErrReadOnly)
+}
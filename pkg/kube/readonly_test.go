@@ -0,0 +1,88 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	const cmPath = "/api/v1/namespaces/default/configmaps/foo"
+
+	for _, tc := range []struct {
+		name, expr string
+		dryRun     bool
+		wantErr    string
+	}{
+		{
+			name:    "Put",
+			expr:    `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\n"])`,
+			wantErr: "<kube.put_yaml>: item 0 (configmap.v1 `default/foo'): cannot update configmap.v1 `default/foo': not allowed in read-only mode (--read_only)",
+		},
+		{
+			name:    "Delete",
+			expr:    `kube.delete(configmap="default/foo")`,
+			wantErr: "<kube.delete>: cannot delete configmap.v1 `default/foo': not allowed in read-only mode (--read_only)",
+		},
+		{
+			name:    "Cordon",
+			expr:    `kube.cordon(node="node-1")`,
+			wantErr: "<kube.cordon>: cannot cordon node `node-1': not allowed in read-only mode (--read_only)",
+		},
+		{
+			name: "Get",
+			expr: `kube.get(configmap="default/foo")`,
+		},
+		{
+			name:   "Dry run put",
+			expr:   `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\n"])`,
+			dryRun: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &fakeKube{m: map[string][]byte{
+				cmPath: []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo","namespace":"default"},"data":{"a":"b"}}`),
+			}}
+			s := httptest.NewServer(h)
+			defer s.Close()
+
+			pkg := newTestPackage(s, nil, Options{
+				DryRun: tc.dryRun,
+			})
+			pkg.(ReadOnlyGuard).SetReadOnly(true)
+			env := starlark.StringDict{"kube": pkg}
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+			_, _, err := util.Eval(t.Name(), tc.expr, sCtx, env)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if got := string(h.m[cmPath]); !strings.Contains(got, `"a":"b"`) {
+				t.Errorf("Object was mutated: %s", got)
+			}
+		})
+	}
+}
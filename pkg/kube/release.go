@@ -0,0 +1,340 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// HelmReleaseLabelKey is the key of a label set to the name of the Helm
+// release on objects applied by helm.apply.
+const HelmReleaseLabelKey = "isopod.getcruise.com/helm-release"
+
+// HelmReleaseNamespaceLabelKey is the key of a label set to the namespace of
+// the Helm release (the namespace passed to helm.apply or the default one) on
+// objects applied by helm.apply, so that releases of the same name in other
+// namespaces are told apart.
+const HelmReleaseNamespaceLabelKey = "isopod.getcruise.com/helm-release-namespace"
+
+// releaseRecordPrefix prefixes names of ConfigMaps recording kinds of objects
+// of a Helm release in its namespace.
+const releaseRecordPrefix = "isopod-helm-release."
+
+// ReleaseClient is a DynamicClient that tracks objects of Helm releases by
+// labeling them with HelmReleaseLabelKey and HelmReleaseNamespaceLabelKey.
+type ReleaseClient interface {
+	DynamicClient
+	// ApplyRelease is like Apply but labels objects with release and
+	// records their kinds.
+	ApplyRelease(t *starlark.Thread, release, namespace string, data *starlark.List) (starlark.Value, error)
+	// ReleaseObjects returns objects of release in namespace (the
+	// default one if empty) in apply order.
+	ReleaseObjects(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error)
+	// DeleteRelease deletes objects of release (see ReleaseObjects) in
+	// reverse apply order and returns the deleted objects.
+	DeleteRelease(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error)
+}
+
+type helmReleaseCtxKey struct{}
+
+// helmRelease is a Helm release being applied.
+type helmRelease struct {
+	name, namespace string
+	// kinds of objects applied.
+	kinds map[schema.GroupVersionKind]bool
+}
+
+// ApplyRelease implements ReleaseClient.ApplyRelease.
+func (m *kubePackage) ApplyRelease(t *starlark.Thread, release, namespace string, data *starlark.List) (starlark.Value, error) {
+	if err := checkRelease(release); err != nil {
+		return nil, err
+	}
+	rel := &helmRelease{
+		name:      release,
+		namespace: m.releaseNamespace(namespace),
+		kinds:     map[schema.GroupVersionKind]bool{},
+	}
+	ctx := context.WithValue(m.updateCtx(t, starlark.None), helmReleaseCtxKey{}, rel)
+	// Kinds no longer applied are kept so that their objects can still
+	// be found.
+	kinds, err := m.releaseKinds(ctx, rel.name, rel.namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, gvk := range kinds {
+		rel.kinds[gvk] = true
+	}
+
+	v, err := m.apply(ctx, t, "", namespace, data)
+	// Kinds of objects applied before a failure are recorded too.
+	if recErr := m.applyReleaseRecord(ctx, t, rel); recErr != nil {
+		if err != nil {
+			log.Warningf("Failed to record kinds of release `%s': %v", release, recErr)
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to record kinds of release `%s': %v", release, recErr)
+	}
+	return v, err
+}
+
+// checkRelease returns an error if release can't be used as a label value and
+// in an object name.
+func checkRelease(release string) error {
+	errs := validation.IsValidLabelValue(release)
+	errs = append(errs, validation.IsDNS1123Subdomain(release)...)
+	if release == "" || len(errs) > 0 {
+		return fmt.Errorf("invalid release name `%s': %s", release, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// releaseNamespace returns namespace of a release applied in namespace.
+func (m *kubePackage) releaseNamespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if m.defaultNs != "" {
+		return m.defaultNs
+	}
+	return metav1.NamespaceDefault
+}
+
+// releaseSelector returns label selector of objects of release in namespace.
+func releaseSelector(release, namespace string) string {
+	return labels.Set{
+		HelmReleaseLabelKey:          release,
+		HelmReleaseNamespaceLabelKey: namespace,
+	}.AsSelector().String()
+}
+
+// setReleaseLabel labels obj with the Helm release it's applied by in ctx
+// (if any). The label is set even if metadata isn't managed since releases
+// can't be deleted without it.
+func setReleaseLabel(ctx context.Context, obj runtime.Object) error {
+	rel, ok := ctx.Value(helmReleaseCtxKey{}).(*helmRelease)
+	if !ok {
+		return nil
+	}
+	a := meta.NewAccessor()
+	ls, err := a.Labels(obj)
+	if err != nil {
+		return err
+	}
+	if ls == nil {
+		ls = map[string]string{}
+	}
+	ls[HelmReleaseLabelKey] = rel.name
+	ls[HelmReleaseNamespaceLabelKey] = rel.namespace
+	return a.SetLabels(obj, ls)
+}
+
+// addReleaseKind records gvk for the Helm release applied in ctx (if any).
+func addReleaseKind(ctx context.Context, gvk schema.GroupVersionKind) {
+	if rel, ok := ctx.Value(helmReleaseCtxKey{}).(*helmRelease); ok {
+		rel.kinds[gvk] = true
+	}
+}
+
+var configMapsGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// releaseKinds returns kinds of objects recorded for release in namespace
+// (none if not recorded).
+func (m *kubePackage) releaseKinds(ctx context.Context, release, namespace string) ([]schema.GroupVersionKind, error) {
+	record, err := m.dynClient.Resource(configMapsGVR).Namespace(namespace).Get(ctx, releaseRecordPrefix+release, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kinds of release `%s': %v", release, err)
+	}
+	data, _, err := unstructured.NestedString(record.Object, "data", "kinds")
+	if err != nil {
+		return nil, fmt.Errorf("invalid kinds of release `%s': %v", release, err)
+	}
+	var kinds []schema.GroupVersionKind
+	for _, l := range strings.Split(data, "\n") {
+		fs := strings.Fields(l)
+		if len(fs) != 2 {
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(fs[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid kinds of release `%s': %v", release, err)
+		}
+		kinds = append(kinds, gv.WithKind(fs[1]))
+	}
+	return kinds, nil
+}
+
+// applyReleaseRecord applies the ConfigMap recording kinds of rel.
+func (m *kubePackage) applyReleaseRecord(ctx context.Context, t *starlark.Thread, rel *helmRelease) error {
+	var kinds []string
+	for gvk := range rel.kinds {
+		kinds = append(kinds, gvk.GroupVersion().String()+" "+gvk.Kind)
+	}
+	sort.Strings(kinds)
+	record, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      releaseRecordPrefix + rel.name,
+			"namespace": rel.namespace,
+		},
+		"data": map[string]string{"kinds": strings.Join(kinds, "\n")},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.apply(ctx, t, "", rel.namespace, starlark.NewList([]starlark.Value{starlark.String(record)}))
+	return err
+}
+
+// ReleaseObjects implements ReleaseClient.ReleaseObjects.
+func (m *kubePackage) ReleaseObjects(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error) {
+	if err := checkRelease(release); err != nil {
+		return nil, err
+	}
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	namespace = m.releaseNamespace(namespace)
+
+	kinds, err := m.releaseKinds(ctx, release, namespace)
+	if err != nil || len(kinds) == 0 {
+		return nil, err
+	}
+	gr, err := restmapper.GetAPIGroupResources(m.dClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover API resources: %v", err)
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+
+	selector := releaseSelector(release, namespace)
+	// The same object may be recorded for multiple groups (e.g Ingress).
+	seen := map[types.UID]bool{}
+	var refs []store.ObjRef
+	for _, gvk := range kinds {
+		// Kinds are listed in their preferred version as recorded ones
+		// may no longer be served.
+		mapping, err := mapper.RESTMapping(gvk.GroupKind())
+		if meta.IsNoMatchError(err) {
+			// Objects of kinds no longer served (e.g. CRDs were
+			// deleted) are gone too.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to map %s: %v", gvk, err)
+		}
+		gv := mapping.GroupVersionKind.GroupVersion()
+		objs, err := m.dynClient.Resource(mapping.Resource).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s of release `%s': %v", mapping.Resource, release, err)
+		}
+		for _, o := range objs.Items {
+			if gvk.Kind == "ConfigMap" && o.GetName() == releaseRecordPrefix+release && o.GetNamespace() == namespace {
+				continue
+			}
+			if o.GetUID() != "" {
+				if seen[o.GetUID()] {
+					continue
+				}
+				seen[o.GetUID()] = true
+			}
+			ref := store.ObjRef{
+				APIVersion: gv.String(),
+				Kind:       gvk.Kind,
+				Name:       o.GetName(),
+			}
+			if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+				ref.Namespace = o.GetNamespace()
+			}
+			refs = append(refs, ref)
+		}
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		if pi, pj := kindPriority(refs[i].Kind), kindPriority(refs[j].Kind); pi != pj {
+			return pi < pj
+		}
+		if refs[i].Namespace != refs[j].Namespace {
+			return refs[i].Namespace < refs[j].Namespace
+		}
+		return refs[i].Name < refs[j].Name
+	})
+	return refs, nil
+}
+
+// DeleteRelease implements ReleaseClient.DeleteRelease.
+func (m *kubePackage) DeleteRelease(t *starlark.Thread, release, namespace string) ([]store.ObjRef, error) {
+	refs, err := m.ReleaseObjects(t, release, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ctx := m.updateCtx(t, starlark.None)
+
+	var deleted []store.ObjRef
+	for i := len(refs) - 1; i >= 0; i-- {
+		ref := refs[i]
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return deleted, fmt.Errorf("invalid apiVersion of %v: %v", ref, err)
+		}
+		r, err := newResourceForKind(m.dClient, ref.Name, ref.Namespace, "", gv.WithKind(ref.Kind))
+		if err != nil {
+			return deleted, fmt.Errorf("failed to map %v: %v", ref, err)
+		}
+		if err := m.kubeDelete(ctx, r, deleteOptions(metav1.DeletePropagationBackground)); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			m.count(outcomeFailed)
+			return deleted, fmt.Errorf("failed to delete %v: %v", ref, err)
+		}
+		m.count(outcomeDeleted)
+		m.deleted(r)
+		deleted = append(deleted, ref)
+	}
+
+	// The record is deleted last so that objects left by a failure can
+	// still be found.
+	r := &apiResource{
+		GVK:       schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Name:      releaseRecordPrefix + release,
+		Namespace: m.releaseNamespace(namespace),
+		Resource:  configMapsGVR.Resource,
+	}
+	if err := m.kubeDelete(ctx, r, deleteOptions(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+		return deleted, fmt.Errorf("failed to delete kinds of release `%s': %v", release, err)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// snapshot is the state of an object before it was first applied since the
+// last TakeApplied.
+type snapshot struct {
+	r *apiResource
+	// live is the object before it was applied (nil if it didn't exist).
+	live runtime.Object
+}
+
+// SnapshotFunc persists manifest (YAML) of live object ref before it is
+// mutated.
+type SnapshotFunc func(ctx context.Context, ref store.ObjRef, manifest []byte) error
+
+// Snapshotter is implemented by kube packages that can hand out live objects
+// before they are mutated.
+type Snapshotter interface {
+	// SetSnapshotFunc sets fn to be called with each existing object
+	// before it is first mutated since the last ObjectTracker.TakeApplied.
+	// Mutation fails if fn returns an error.
+	SetSnapshotFunc(fn SnapshotFunc)
+}
+
+// SetSnapshotFunc implements Snapshotter.SetSnapshotFunc.
+func (m *kubePackage) SetSnapshotFunc(fn SnapshotFunc) {
+	m.snapshotFn = fn
+}
+
+// snapshot records live state of object r before it is applied. Only the
+// first state of each object is kept. Nothing is recorded in dry run as
+// nothing is mutated.
+func (m *kubePackage) snapshot(ctx context.Context, r *apiResource, live runtime.Object) error {
+	if m.dryRun || r.Subresource != "" {
+		return nil
+	}
+	m.appliedMu.Lock()
+	for _, s := range m.snapshots {
+		if s.r.GVK == r.GVK && s.r.Namespace == r.Namespace && s.r.Name == r.Name {
+			m.appliedMu.Unlock()
+			return nil
+		}
+	}
+	if live != nil {
+		live = live.DeepCopyObject()
+	}
+	m.snapshots = append(m.snapshots, snapshot{r: r, live: live})
+	m.appliedMu.Unlock()
+
+	if m.snapshotFn == nil || live == nil {
+		return nil
+	}
+	obj, err := liveObject(r, live)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	bs, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	if err := m.snapshotFn(ctx, objRef(r, live), bs); err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	return nil
+}
+
+// liveObject converts live object r to unstructured form.
+func liveObject(r *apiResource, live runtime.Object) (*unstructured.Unstructured, error) {
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{Object: un}
+	obj.SetGroupVersionKind(r.GVK)
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	return obj, nil
+}
+
+// Rollback implements ObjectTracker.Rollback.
+func (m *kubePackage) Rollback(ctx context.Context) error {
+	m.appliedMu.Lock()
+	snapshots := m.snapshots
+	m.snapshots = nil
+	m.appliedMu.Unlock()
+
+	var errs []string
+	// Restore in reverse order so that e.g Namespaces are deleted after
+	// objects in them.
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		if err := m.restore(ctx, s); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", s.r, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to roll back %d object(s):\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// restore restores object to its snapshot, deleting it if it didn't exist.
+func (m *kubePackage) restore(ctx context.Context, s snapshot) error {
+	if err := m.checkWritable("roll back", s.r); err != nil {
+		return err
+	}
+	if s.live == nil {
+		if err := m.kubeDelete(ctx, s.r, deleteOptions(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	obj, err := liveObject(s.r, s.live)
+	if err != nil {
+		return err
+	}
+	// Server populated fields are set again on create (or update).
+	for _, f := range []string{"uid", "resourceVersion", "creationTimestamp", "generation", "selfLink"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", f)
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+
+	var c dynamic.ResourceInterface = m.dynClient.Resource(s.r.GroupVersionResource())
+	if s.r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(s.r.Namespace)
+	}
+	cur, err := c.Get(ctx, s.r.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		// Object was deleted (e.g recreated by --force) but not created
+		// again.
+		_, err = c.Create(ctx, obj, metav1.CreateOptions{})
+	case err == nil:
+		obj.SetResourceVersion(cur.GetResourceVersion())
+		_, err = c.Update(ctx, obj, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("%v rolled back", s.r)
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	kubeScaleMethod = "scale"
+
+	scaleSubresource = "scale"
+)
+
+// kubeScaleFn is entry point for `kube.scale' callable. Sets replicas of a
+// workload (or any object with a scale subresource) and optionally waits up
+// to `wait' for the workload to be rolled out with that many ready replicas:
+//
+//	prev = kube.scale(deployment="default/nginx", api_group="apps", replicas=0, wait="5m")
+//
+// Returns the number of replicas before scaling.
+func (m *kubePackage) kubeScaleFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("<%v>: positional args not supported: %v", b.Name(), args)
+	}
+	if len(kwargs) < 1 {
+		return nil, fmt.Errorf("<%v>: expected <resource>=<namespace>/<name>", b.Name())
+	}
+
+	resource, name, err := getResourceAndName(kwargs[0])
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %s", b.Name(), err.Error())
+	}
+	var namespace string
+	if ss := strings.Split(name, "/"); len(ss) > 1 {
+		namespace = ss[0]
+		name = ss[1]
+	}
+
+	var replicas int
+	var apiGroup, wait string
+	if err := starlark.UnpackArgs(b.Name(), nil, kwargs[1:],
+		"replicas", &replicas,
+		apiGroupKW+"?", &apiGroup,
+		"wait?", &wait,
+	); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if replicas < 0 {
+		return nil, fmt.Errorf("<%v>: `replicas' must not be negative (got %d)", b.Name(), replicas)
+	}
+	var timeout time.Duration
+	if wait != "" {
+		if timeout, err = time.ParseDuration(wait); err != nil {
+			return nil, fmt.Errorf("<%v>: failed to parse `wait' duration: %v", b.Name(), err)
+		}
+	}
+
+	r, err := newResource(m.dClient, name, namespace, apiGroup, resource, "")
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	prev, err := m.scale(ctx, r, int64(replicas))
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if timeout != 0 && !m.dryRun {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := m.waitScaled(ctx, r, int64(replicas)); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	return starlark.MakeInt64(prev), nil
+}
+
+// resourceClient returns dynamic client of r in its namespace.
+func (m *kubePackage) resourceClient(r *apiResource) dynamic.ResourceInterface {
+	c := m.dynClient.Resource(r.GroupVersionResource())
+	if r.ClusterScoped || r.Namespace == "" {
+		return c
+	}
+	return c.Namespace(r.Namespace)
+}
+
+// scale sets replicas of r with its scale subresource and returns the number
+// of replicas before.
+func (m *kubePackage) scale(ctx context.Context, r *apiResource, replicas int64) (prev int64, err error) {
+	m.touch(r)
+	defer func() {
+		if err != nil {
+			m.count(outcomeFailed)
+		}
+	}()
+	if err := m.checkPolicy(r); err != nil {
+		return 0, err
+	}
+	if err := m.checkWritable("scale", r); err != nil {
+		return 0, err
+	}
+
+	c := m.resourceClient(r)
+	s, err := c.Get(ctx, r.Name, metav1.GetOptions{}, scaleSubresource)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get scale of %v: %v", r, err)
+	}
+	prev, _, err = unstructured.NestedInt64(s.Object, "spec", "replicas")
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", r, err)
+	}
+	if prev == replicas {
+		m.count(outcomeUnchanged)
+		return prev, nil
+	}
+
+	if m.dryRun {
+		fmt.Fprintf(m.diffOut, "\n*** %v will be scaled from %d to %d replicas ***\n", r, prev, replicas)
+		m.count(outcomeUpdated)
+		return prev, nil
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas)
+	if _, err := c.Patch(ctx, r.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}, scaleSubresource); err != nil {
+		return 0, fmt.Errorf("failed to scale %v: %v", r, err)
+	}
+	m.count(outcomeUpdated)
+
+	log.Infof("%v scaled from %d to %d replicas", r, prev, replicas)
+	return prev, nil
+}
+
+// readyReplicasFields are status fields of workload kinds that must equal the
+// desired replicas once they are rolled out. Scale of other kinds is rolled
+// out once `status.replicas' of their scale subresource matches.
+var readyReplicasFields = map[string][]string{
+	"Deployment":            {"replicas", "updatedReplicas", "availableReplicas"},
+	"StatefulSet":           {"replicas", "updatedReplicas", "readyReplicas"},
+	"ReplicaSet":            {"replicas", "readyReplicas"},
+	"ReplicationController": {"replicas", "readyReplicas"},
+}
+
+// waitScaled waits until r is rolled out with replicas ready replicas.
+func (m *kubePackage) waitScaled(ctx context.Context, r *apiResource, replicas int64) error {
+	log.Infof("Waiting for %v to have %d ready replicas...", r, replicas)
+	c := m.resourceClient(r)
+	fields, ok := readyReplicasFields[r.GVK.Kind]
+	var subresources []string
+	if !ok {
+		fields = []string{"replicas"}
+		subresources = []string{scaleSubresource}
+	}
+	for {
+		un, err := c.Get(ctx, r.Name, metav1.GetOptions{}, subresources...)
+		if err != nil {
+			return fmt.Errorf("failed to get %v: %v", r, err)
+		}
+		pending := scalePending(un, fields, replicas, ok)
+		if pending == "" {
+			return nil
+		}
+
+		select {
+		case <-time.After(waitRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %v to scale to %d replicas (%s)", r, replicas, pending)
+		}
+	}
+}
+
+// scalePending returns a description of status fields of un not yet equal
+// to replicas (empty if all are). Missing fields are zero. If
+// checkGeneration is set, the latest generation of un must also be observed.
+func scalePending(un *unstructured.Unstructured, fields []string, replicas int64, checkGeneration bool) string {
+	if g, _, _ := unstructured.NestedInt64(un.Object, "status", "observedGeneration"); checkGeneration && g < un.GetGeneration() {
+		return fmt.Sprintf("generation %d not observed yet", un.GetGeneration())
+	}
+	var pending []string
+	for _, f := range fields {
+		if n, _, _ := unstructured.NestedInt64(un.Object, "status", f); n != replicas {
+			pending = append(pending, fmt.Sprintf("%s: %d", f, n))
+		}
+	}
+	return strings.Join(pending, ", ")
+}
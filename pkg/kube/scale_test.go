@@ -0,0 +1,200 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+// fakeScaled serves a deployment and its scale subresource. The deployment
+// reports ready replicas once polled after being scaled.
+type fakeScaled struct {
+	mu                 sync.Mutex
+	replicas, ready    int64
+	generation         int64
+	observedGeneration int64
+}
+
+func (f *fakeScaled) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const path = "/apis/apps/v1/namespaces/default/deployments/nginx"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var resp map[string]interface{}
+	switch {
+	case r.URL.Path == path+"/scale" && r.Method == http.MethodPatch:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var patch struct {
+			Spec struct {
+				Replicas int64 `json:"replicas"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(data, &patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.replicas = patch.Spec.Replicas
+		f.generation++
+		fallthrough
+	case r.URL.Path == path+"/scale" && r.Method == http.MethodGet:
+		resp = map[string]interface{}{
+			"apiVersion": "autoscaling/v1",
+			"kind":       "Scale",
+			"metadata":   map[string]interface{}{"name": "nginx", "namespace": "default"},
+			"spec":       map[string]interface{}{"replicas": f.replicas},
+			"status":     map[string]interface{}{"replicas": f.ready},
+		}
+	case r.URL.Path == path && r.Method == http.MethodGet:
+		resp = map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "nginx", "namespace": "default", "generation": f.generation},
+			"spec":       map[string]interface{}{"replicas": f.replicas},
+			"status": map[string]interface{}{
+				"observedGeneration": f.observedGeneration,
+				"replicas":           f.ready,
+				"updatedReplicas":    f.ready,
+				"availableReplicas":  f.ready,
+			},
+		}
+		// Roll out on the next poll.
+		f.observedGeneration = f.generation
+		f.ready = f.replicas
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func TestScale(t *testing.T) {
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, tc := range []struct {
+		name         string
+		dryRun       bool
+		expr         string
+		want         string
+		wantReplicas int64
+		wantReady    int64
+		wantStats    Stats
+		wantOut      string
+		wantErr      string
+	}{
+		{
+			name:         "Scale",
+			expr:         `kube.scale(deployment="default/nginx", api_group="apps", replicas=5)`,
+			want:         "2",
+			wantReplicas: 5,
+			wantReady:    2,
+			wantStats:    Stats{Updated: 1},
+		},
+		{
+			name:         "Scale and wait",
+			expr:         `kube.scale(deployment="default/nginx", api_group="apps", replicas=0, wait="10s")`,
+			want:         "2",
+			wantReplicas: 0,
+			wantReady:    0,
+			wantStats:    Stats{Updated: 1},
+		},
+		{
+			name:         "Unchanged",
+			expr:         `kube.scale(deployment="default/nginx", api_group="apps", replicas=2, wait="10s")`,
+			want:         "2",
+			wantReplicas: 2,
+			wantReady:    2,
+			wantStats:    Stats{Unchanged: 1},
+		},
+		{
+			name:         "Dry run",
+			dryRun:       true,
+			expr:         `kube.scale(deployment="default/nginx", api_group="apps", replicas=5, wait="10s")`,
+			want:         "2",
+			wantReplicas: 2,
+			wantReady:    2,
+			wantStats:    Stats{Updated: 1},
+			wantOut:      "\n*** deployment.apps/v1 `default/nginx' will be scaled from 2 to 5 replicas ***\n",
+		},
+		{
+			name:    "Negative replicas",
+			expr:    `kube.scale(deployment="default/nginx", api_group="apps", replicas=-1)`,
+			wantErr: "<kube.scale>: `replicas' must not be negative (got -1)",
+		},
+		{
+			name:      "Not found",
+			expr:      `kube.scale(deployment="default/missing", api_group="apps", replicas=1)`,
+			wantStats: Stats{Failed: 1},
+			wantErr:   "<kube.scale>: failed to get scale of deployment.apps/v1 `default/missing': the server could not find the requested resource",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &fakeScaled{replicas: 2, ready: 2}
+			s := httptest.NewServer(h)
+			defer s.Close()
+
+			out := &bytes.Buffer{}
+			pkg := newTestPackage(s, nil, Options{
+				DryRun:  tc.dryRun,
+				DiffOut: out,
+			})
+			got, _, err := util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg})
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.wantStats, pkg.(StatsCollector).TakeStats()); d != "" {
+				t.Errorf("Unexpected stats (-want +got):\n%s", d)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tc.want {
+				t.Errorf("Unexpected result.\nWant: %v\nGot: %v", tc.want, got)
+			}
+			if got := out.String(); got != tc.wantOut {
+				t.Errorf("Unexpected output.\nWant: %q\nGot: %q", tc.wantOut, got)
+			}
+			if h.replicas != tc.wantReplicas {
+				t.Errorf("Unexpected replicas.\nWant: %d\nGot: %d", tc.wantReplicas, h.replicas)
+			}
+			if h.ready != tc.wantReady {
+				t.Errorf("Unexpected ready replicas.\nWant: %d\nGot: %d", tc.wantReady, h.ready)
+			}
+		})
+	}
+}
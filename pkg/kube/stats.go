@@ -0,0 +1,120 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Stats counts objects put or deleted by the kube package by outcome. In dry
+// run mode objects are counted by their intended outcome.
+type Stats struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Recreated int `json:"recreated"`
+	Deleted   int `json:"deleted"`
+	Failed    int `json:"failed"`
+}
+
+// Add adds counters of o to s.
+func (s *Stats) Add(o Stats) {
+	s.Created += o.Created
+	s.Updated += o.Updated
+	s.Unchanged += o.Unchanged
+	s.Recreated += o.Recreated
+	s.Deleted += o.Deleted
+	s.Failed += o.Failed
+}
+
+// Changed returns the number of objects created, updated, recreated or
+// deleted.
+func (s Stats) Changed() int {
+	return s.Created + s.Updated + s.Recreated + s.Deleted
+}
+
+// StatsCollector collects Stats of objects mutated by an addon.
+type StatsCollector interface {
+	// TakeStats returns Stats accumulated since the last call and resets
+	// them.
+	TakeStats() Stats
+}
+
+type outcome int
+
+const (
+	outcomeCreated outcome = iota
+	outcomeUpdated
+	outcomeUnchanged
+	outcomeRecreated
+	outcomeDeleted
+	outcomeFailed
+)
+
+// count records an object with outcome o.
+func (m *kubePackage) count(o outcome) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	switch o {
+	case outcomeCreated:
+		m.stats.Created++
+	case outcomeUpdated:
+		m.stats.Updated++
+	case outcomeUnchanged:
+		m.stats.Unchanged++
+	case outcomeRecreated:
+		m.stats.Recreated++
+	case outcomeDeleted:
+		m.stats.Deleted++
+	case outcomeFailed:
+		m.stats.Failed++
+	}
+}
+
+// TakeStats implements StatsCollector.TakeStats.
+func (m *kubePackage) TakeStats() Stats {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	s := m.stats
+	m.stats = Stats{}
+	return s
+}
+
+// updateOutcome returns outcome of a put of an object that was live before
+// (nil if it didn't exist).
+func updateOutcome(live runtime.Object, recreated, changed bool) outcome {
+	switch {
+	case live == nil:
+		return outcomeCreated
+	case recreated:
+		return outcomeRecreated
+	case changed:
+		return outcomeUpdated
+	}
+	return outcomeUnchanged
+}
+
+// resourceVersionChanged returns true if resourceVersion of updated differs
+// from live. Apiserver doesn't bump resourceVersion of no-op updates.
+func resourceVersionChanged(live, updated interface{}) bool {
+	l, ok1 := live.(metav1.Object)
+	u, ok2 := updated.(metav1.Object)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return l.GetResourceVersion() == "" || l.GetResourceVersion() != u.GetResourceVersion()
+}
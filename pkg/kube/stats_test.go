@@ -0,0 +1,88 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestStats(t *testing.T) {
+	h := &fakeKube{m: map[string][]byte{}}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+
+	for _, tc := range []struct {
+		name   string
+		dryRun bool
+		expr   string
+		want   Stats
+	}{
+		{
+			name: "Create",
+			expr: `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`,
+			want: Stats{Created: 1},
+		},
+		{
+			name:   "Dry run unchanged",
+			dryRun: true,
+			expr:   `kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n"])`,
+			want:   Stats{Unchanged: 1},
+		},
+		{
+			name:   "Dry run update and create",
+			dryRun: true,
+			expr: `[
+				kube.put_yaml(name="foo", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: c\n"]),
+				kube.put_yaml(name="bar", namespace="default", data=["apiVersion: v1\nkind: ConfigMap\ndata:\n  a: c\n"]),
+			]`,
+			want: Stats{Updated: 1, Created: 1},
+		},
+		{
+			name: "Delete",
+			expr: `kube.delete(configmap="default/foo")`,
+			want: Stats{Deleted: 1},
+		},
+		{
+			name: "Delete failed",
+			expr: `kube.delete(configmap="default/missing")`,
+			want: Stats{Failed: 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkg := newTestPackage(s, nil, Options{
+				DryRun: tc.dryRun,
+			})
+			// Errors are reflected in stats.
+			util.Eval(t.Name(), tc.expr, sCtx, starlark.StringDict{"kube": pkg})
+
+			got := pkg.(StatsCollector).TakeStats()
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected stats (-want +got):\n%s", d)
+			}
+			if got := pkg.(StatsCollector).TakeStats(); got != (Stats{}) {
+				t.Errorf("Stats were not reset: %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const kubeTryGetMethod = "try_get"
+
+// kubeTryGetFn is entry point for `kube.try_get' callable. Takes the same
+// args as `kube.get' but returns a struct instead of failing the addon on
+// errors returned by the API server, so that optional objects can be
+// handled:
+//
+//	res = kube.try_get(configmap="kube-system/cluster-info", json=True)
+//	if res.not_found or res.forbidden:
+//	    return
+//	info = res.value
+//
+// Unlike `kube.get', it doesn't wait for the object unless `wait' is set.
+// Other errors (e.g invalid args or connection failures) still fail.
+func (m *kubePackage) kubeTryGetFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	req, err := m.parseGetArgs(b, args, kwargs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	obj, err := m.kubeGet(ctx, req.r, req.wait, req.until)
+	if err == nil {
+		v, err := req.value(b, obj)
+		if err != nil {
+			return nil, err
+		}
+		return tryGetResult(v, http.StatusOK, "", nil), nil
+	}
+
+	var status apierrors.APIStatus
+	switch {
+	case errors.Is(err, ErrNotFound):
+		err = fmt.Errorf("failed to get %s: %v", req, err)
+		return tryGetResult(starlark.None, http.StatusNotFound, "NotFound", err), nil
+	case errors.As(err, &status):
+		err = fmt.Errorf("failed to get %s: %v", req, err)
+		s := status.Status()
+		return tryGetResult(starlark.None, int(s.Code), string(s.Reason), err), nil
+	}
+	return nil, fmt.Errorf("<%v>: failed to get %s: %v", b.Name(), req, err)
+}
+
+// tryGetResult returns the `kube.try_get' struct of value (None if not got),
+// HTTP code, Kubernetes status reason and err of a get.
+func tryGetResult(value starlark.Value, code int, reason string, err error) *starlarkstruct.Struct {
+	var errV starlark.Value = starlark.None
+	if err != nil {
+		errV = starlark.String(err.Error())
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"ok":           starlark.Bool(err == nil),
+		"value":        value,
+		"code":         starlark.MakeInt(code),
+		"reason":       starlark.String(reason),
+		"error":        errV,
+		"not_found":    starlark.Bool(code == http.StatusNotFound),
+		"forbidden":    starlark.Bool(code == http.StatusForbidden),
+		"unauthorized": starlark.Bool(code == http.StatusUnauthorized),
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestTryGet(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status *metav1.Status
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/configmaps/foo":
+			w.Write([]byte(`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo", "namespace": "default"}}`))
+			return
+		case "/api/v1/namespaces/secure/configmaps/foo":
+			status = &metav1.Status{Code: http.StatusForbidden, Reason: metav1.StatusReasonForbidden, Message: "access denied"}
+		case "/api/v1/namespaces/broken/configmaps/foo":
+			status = &metav1.Status{Code: http.StatusInternalServerError, Reason: metav1.StatusReasonInternalError, Message: "etcd is down"}
+		case "/api/v1/namespaces/garbled/configmaps/foo":
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		status.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Status"}
+		status.Status = metav1.StatusFailure
+		w.WriteHeader(int(status.Code))
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer s.Close()
+
+	const fields = `[r.ok, r.code, r.reason, r.not_found, r.forbidden, r.unauthorized, r.error]`
+	for _, tc := range []struct {
+		name, expr string
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "Found",
+			expr: `[[r.value.metadata.name] + ` + fields + ` for r in [kube.try_get(configmap="default/foo")]][0]`,
+			want: `["foo", True, 200, "", False, False, False, None]`,
+		},
+		{
+			name: "Found in JSON",
+			expr: `kube.try_get(configmap="default/foo", json=True).value["metadata"]["name"]`,
+			want: `"foo"`,
+		},
+		{
+			name: "Not found",
+			expr: `[[r.value] + ` + fields + ` for r in [kube.try_get(configmap="default/bar")]][0]`,
+			want: "[None, False, 404, \"NotFound\", True, False, False, \"failed to get configmap.v1 `bar': not found\"]",
+		},
+		{
+			name: "Forbidden",
+			expr: `[` + fields + ` for r in [kube.try_get(configmap="secure/foo")]][0]`,
+			want: "[False, 403, \"Forbidden\", False, True, False, \"failed to get configmap.v1 `foo': access denied (response code: 403)\"]",
+		},
+		{
+			name: "Server error",
+			expr: `[` + fields + ` for r in [kube.try_get(configmap="broken/foo")]][0]`,
+			want: "[False, 500, \"InternalError\", False, False, False, \"failed to get configmap.v1 `foo': etcd is down (response code: 500)\"]",
+		},
+		{
+			name:    "Not a status",
+			expr:    `kube.try_get(configmap="garbled/foo")`,
+			wantErr: "<kube.try_get>: failed to get configmap.v1 `foo': failed to parse json object (response code: 502)",
+		},
+		{
+			name:    "Invalid args",
+			expr:    `kube.try_get(configmap="default/foo", retries=3)`,
+			wantErr: "<kube.try_get>: expected one of [ api_group | wait | json | until ] args, got: \"retries\"=3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkg := newTestPackage(s, nil, Options{})
+
+			pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+			addImports(t, pkgs)
+			pkgs["kube"] = pkg
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+			got, _, err := util.Eval(t.Name(), tc.expr, sCtx, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = strings.SplitN(err.Error(), "\n", 2)[0]
+			}
+			if !strings.HasPrefix(gotErr, tc.wantErr) || (tc.wantErr == "") != (gotErr == "") {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			if got.String() != tc.want {
+				t.Errorf("Unexpected result.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// shortFilterRe matches filters without the `@.' current object prefix (e.g
+// `[?type=='Ready']').
+var shortFilterRe = regexp.MustCompile(`\[\?([^(\]][^\]]*)\]`)
+
+// condition is a wait condition of `kube.get' parsed from `until' expression:
+// a JSONPath optionally compared with a literal, e.g
+//
+//	status.conditions[?type=='Ready'].status == 'True'
+//	status.loadBalancer.ingress[0].ip
+//
+// Without comparison the condition is met once the path yields a non-empty
+// value.
+type condition struct {
+	expr string
+	path *jsonpath.JSONPath
+	// op is one of "", "==" or "!=".
+	op   string
+	want string
+}
+
+// parseCondition parses `until' expression.
+func parseCondition(expr string) (*condition, error) {
+	c := &condition{expr: expr}
+	path := strings.TrimSpace(expr)
+	if i := comparisonIndex(path); i >= 0 {
+		c.op = path[i : i+2]
+		c.want = strings.TrimSpace(path[i+2:])
+		path = strings.TrimSpace(path[:i])
+		if c.want == "" {
+			return nil, fmt.Errorf("missing value to compare with in `%s'", expr)
+		}
+		if q := c.want[0]; (q == '\'' || q == '"') && len(c.want) > 1 && c.want[len(c.want)-1] == q {
+			c.want = c.want[1 : len(c.want)-1]
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("missing path in `%s'", expr)
+	}
+
+	if !strings.HasPrefix(path, "{") {
+		path = strings.TrimPrefix(path, "$")
+		path = strings.TrimPrefix(path, ".")
+		path = shortFilterRe.ReplaceAllString(path, "[?(@.$1)]")
+		path = "{." + path + "}"
+	}
+	c.path = jsonpath.New("until").AllowMissingKeys(true)
+	if err := c.path.Parse(path); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s': %v", expr, err)
+	}
+	return c, nil
+}
+
+// comparisonIndex returns index of top-level `==' or `!=' operator in expr
+// (outside of brackets and quotes) or -1 if there is none.
+func comparisonIndex(expr string) int {
+	var depth int
+	var quote byte
+	for i := 0; i < len(expr)-1; i++ {
+		switch ch := expr[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '[' || ch == '(' || ch == '{':
+			depth++
+		case ch == ']' || ch == ')' || ch == '}':
+			depth--
+		case depth == 0 && (ch == '=' || ch == '!') && expr[i+1] == '=':
+			return i
+		}
+	}
+	return -1
+}
+
+// met returns true if obj satisfies the condition. Values are compared in
+// their JSON form (strings without quotes).
+func (c *condition) met(obj runtime.Object) (bool, error) {
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return false, err
+	}
+	results, err := c.path.FindResults(un)
+	if err != nil {
+		return false, err
+	}
+
+	var vals []string
+	var nonEmpty bool
+	for _, rs := range results {
+		for _, r := range rs {
+			s, empty := conditionValue(r)
+			vals = append(vals, s)
+			nonEmpty = nonEmpty || !empty
+		}
+	}
+	switch c.op {
+	case "==":
+		for _, v := range vals {
+			if v == c.want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "!=":
+		for _, v := range vals {
+			if v == c.want {
+				return false, nil
+			}
+		}
+		return len(vals) > 0, nil
+	}
+	return nonEmpty, nil
+}
+
+// conditionValue returns string form of v and whether it's empty (null,
+// false, empty string, list or map).
+func conditionValue(v reflect.Value) (s string, empty bool) {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "null", true
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), v.Len() == 0
+	case reflect.Bool:
+		return fmt.Sprint(v.Bool()), !v.Bool()
+	case reflect.Slice, reflect.Map:
+		empty = v.Len() == 0
+	}
+	bs, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface()), empty
+	}
+	return string(bs), empty
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCondition(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "lb", Generation: 2},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+				{Type: corev1.PodReady, Status: corev1.ConditionFalse},
+			},
+		},
+	}
+	readyPod := pod.DeepCopy()
+	readyPod.Status.Conditions[1].Status = corev1.ConditionTrue
+	lbSvc := svc.DeepCopy()
+	lbSvc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+
+	for _, tc := range []struct {
+		name, expr string
+		obj        apiruntime.Object
+		want       bool
+		wantErr    string
+	}{
+		{name: "Condition not ready", expr: "status.conditions[?type=='Ready'].status == 'True'", obj: pod},
+		{name: "Condition ready", expr: "status.conditions[?type=='Ready'].status == 'True'", obj: readyPod, want: true},
+		{name: "Full filter syntax", expr: `{.status.conditions[?(@.type=="Ready")].status}=="True"`, obj: readyPod, want: true},
+		{name: "Not equal", expr: "status.conditions[?type=='Ready'].status != 'False'", obj: readyPod, want: true},
+		{name: "Not equal missing", expr: "status.conditions[?type=='Missing'].status != 'False'", obj: readyPod},
+		{name: "Number", expr: "metadata.generation == 2", obj: svc, want: true},
+		{name: "Missing field", expr: "status.loadBalancer.ingress", obj: svc},
+		{name: "Field set", expr: "$.status.loadBalancer.ingress[0].ip", obj: lbSvc, want: true},
+		{name: "Missing value", expr: "metadata.name ==", wantErr: "missing value to compare with in `metadata.name =='"},
+		{name: "Missing path", expr: "== 'foo'", wantErr: "missing path in `== 'foo''"},
+		{name: "Bad path", expr: "status.conditions[", wantErr: "failed to parse `status.conditions[': unterminated array"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseCondition(tc.expr)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got, err := c.met(tc.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("Unexpected result of `%s'. Want: %v, got: %v", tc.expr, tc.want, got)
+			}
+		})
+	}
+}
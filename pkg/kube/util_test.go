@@ -20,6 +20,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stripe/skycfg"
+	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -153,3 +154,109 @@ func TestIntOrString(t *testing.T) {
 		})
 	}
 }
+
+func TestQuantityArithmetic(t *testing.T) {
+	resolve.AllowFloat = true
+	defer func() { resolve.AllowFloat = false }()
+
+	for _, tc := range []struct {
+		desc, expr, want, wantErr string
+	}{
+		{
+			desc: "Add",
+			expr: `kube.quantity_add("1Gi", kube.resource_quantity("512Mi"))`,
+			want: "1536Mi",
+		},
+		{
+			desc: "Sub",
+			expr: `kube.quantity_sub(2, "500m", "250m")`,
+			want: "1250m",
+		},
+		{
+			desc: "Mul",
+			expr: `kube.quantity_mul("250m", 3)`,
+			want: "750m",
+		},
+		{
+			desc: "Mul by float",
+			expr: `kube.quantity_mul("1Gi", 1.5)`,
+			want: "1536Mi",
+		},
+		{
+			desc: "Percent",
+			expr: `kube.quantity_percent("4", 15)`,
+			want: "600m",
+		},
+		{
+			desc: "Percent rounded to milli-units",
+			expr: `kube.quantity_percent("1", 33.33333)`,
+			want: "333m",
+		},
+		{
+			desc: "Percent of binary quantity",
+			expr: `kube.quantity_percent("16Gi", 10)`,
+			want: "1717986918400m",
+		},
+		{
+			desc: "Min",
+			expr: `kube.quantity_min("1Gi", "1G", "2Gi")`,
+			want: "1G",
+		},
+		{
+			desc: "Max",
+			expr: `kube.quantity_max("1Gi", "1G", "2Gi")`,
+			want: "2Gi",
+		},
+		{
+			desc: "Cmp",
+			expr: `[kube.quantity_cmp("1Gi", "1G"), kube.quantity_cmp("1000m", 1), kube.quantity_cmp("1", "1.5")]`,
+			want: "[1, 0, -1]",
+		},
+		{
+			desc: "Value",
+			expr: `[kube.quantity_value("2Gi", "Mi"), kube.quantity_value("1.5"), kube.quantity_value("250m", unit="m")]`,
+			want: "[2048, 1.5, 250]",
+		},
+		{
+			desc:    "Invalid quantity",
+			expr:    `kube.quantity_add("1Gi", "lots")`,
+			wantErr: "kube.quantity_add: for parameter 2: quantities must match the regular expression",
+		},
+		{
+			desc:    "Invalid type",
+			expr:    `kube.quantity_add("1Gi", [])`,
+			wantErr: "kube.quantity_add: for parameter 2: want quantity, string or number (got: list)",
+		},
+		{
+			desc:    "Invalid factor",
+			expr:    `kube.quantity_mul("1Gi", "2")`,
+			wantErr: "kube.quantity_mul: factor must be a number (got: string)",
+		},
+		{
+			desc:    "Invalid unit",
+			expr:    `kube.quantity_value("1Gi", "GB")`,
+			wantErr: "kube.quantity_value: invalid unit `GB'",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			v, _, err := util.Eval("kube", tc.expr, nil, starlark.StringDict{"kube": &kubePackage{}})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Unexpected error.\nWant fragment: %q\nGot: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := v.String()
+			if m, ok := skycfg.AsProtoMessage(v); ok {
+				got = m.(*resource.Quantity).String()
+			}
+			if got != tc.want {
+				t.Errorf("Want: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"errors"
+	"sync"
+)
+
+// Cache caches executed modules and decoded data files by their resolved
+// paths so that loaders sharing it (e.g loaders of all addons of a run) read
+// and execute each file once. It is safe for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	modules map[string]*cacheEntry
+	data    map[string]*dataFile
+}
+
+// NewCache returns a new empty Cache.
+func NewCache() *Cache {
+	return &Cache{
+		modules: map[string]*cacheEntry{},
+		data:    map[string]*dataFile{},
+	}
+}
+
+// cacheEntry is a module that is being (or has been) executed.
+type cacheEntry struct {
+	// module is set once ready is closed.
+	module *Module
+	ready  chan struct{}
+
+	// waitingOn is the module the goroutine executing this module waits for
+	// (guarded by Cache.mu). Following waitingOn links back to a module
+	// means a cycle in the load graph.
+	waitingOn *cacheEntry
+
+	// loads and data are modules (by name as written in load statements)
+	// and data files (by resolved path) loaded by this module. They are
+	// only written while the module executes.
+	loads map[string]*cacheEntry
+	data  map[string]*dataFile
+}
+
+// acquire returns cache entry of module at path loaded by parent (nil for
+// top-level loads). If owner is true, the entry is new and the caller must
+// execute the module and release the entry. Otherwise, acquire blocks until
+// the entry is ready.
+func (c *Cache) acquire(path string, parent *cacheEntry) (e *cacheEntry, owner bool, err error) {
+	c.mu.Lock()
+	e, ok := c.modules[path]
+	if !ok {
+		e = &cacheEntry{
+			ready: make(chan struct{}),
+			loads: map[string]*cacheEntry{},
+			data:  map[string]*dataFile{},
+		}
+		c.modules[path] = e
+		if parent != nil {
+			parent.waitingOn = e
+		}
+		c.mu.Unlock()
+		return e, true, nil
+	}
+
+	select {
+	case <-e.ready:
+		c.mu.Unlock()
+		return e, false, nil
+	default:
+	}
+	for w := e; w != nil; w = w.waitingOn {
+		if w == parent {
+			c.mu.Unlock()
+			return nil, false, errors.New("cycle in load graph")
+		}
+	}
+	if parent != nil {
+		parent.waitingOn = e
+	}
+	c.mu.Unlock()
+
+	<-e.ready
+
+	c.mu.Lock()
+	if parent != nil {
+		parent.waitingOn = nil
+	}
+	c.mu.Unlock()
+	return e, false, nil
+}
+
+// release marks e (acquired as owner by parent) ready.
+func (c *Cache) release(e *cacheEntry, parent *cacheEntry) {
+	c.mu.Lock()
+	if parent != nil {
+		parent.waitingOn = nil
+	}
+	c.mu.Unlock()
+	close(e.ready)
+}
+
+// dataFile returns cached data file at path (if any).
+func (c *Cache) dataFile(path string) (*dataFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.data[path]
+	return f, ok
+}
+
+// storeDataFile caches f at path unless another goroutine has cached it
+// first and returns the cached data file.
+func (c *Cache) storeDataFile(path string, f *dataFile) *dataFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.data[path]; ok {
+		return cached
+	}
+	c.data[path] = f
+	return f
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestSharedCache(t *testing.T) {
+	tmp := newWorkspace(t)
+	for path, data := range map[string]string{
+		"ws/lib.ipd":           "count()\nr = load_data(\"//defaults.yaml\")[\"replicas\"]\n",
+		"ws/defaults.yaml":     "replicas: 3\n",
+		"ws/addons/a/main.ipd": "load(\"//lib.ipd\", \"r\")\nout = r\n",
+		"ws/addons/b/main.ipd": "load(\"//lib.ipd\", \"r\")\nout = r + 1\n",
+	} {
+		writeFile(t, tmp, path, data)
+	}
+	SetWorkspaceRoot(tmp + "/ws")
+	defer SetWorkspaceRoot("")
+
+	var execs int32
+	pkgs := starlark.StringDict{
+		"count": starlark.NewBuiltin("count", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			atomic.AddInt32(&execs, 1)
+			return starlark.None, nil
+		}),
+	}
+
+	cache := NewCache()
+	var loaders []ModulesLoader
+	for i := 0; i < 8; i++ {
+		dir := tmp + "/ws/addons/a"
+		if i%2 == 1 {
+			dir = tmp + "/ws/addons/b"
+		}
+		loaders = append(loaders, NewModulesLoaderWithCache(dir, pkgs, cache))
+	}
+
+	errs := make([]error, len(loaders))
+	var wg sync.WaitGroup
+	for i, l := range loaders {
+		wg.Add(1)
+		go func(i int, l ModulesLoader) {
+			defer wg.Done()
+			_, errs[i] = l.Load(nil, "main.ipd")
+		}(i, l)
+	}
+	wg.Wait()
+
+	for i, l := range loaders {
+		if errs[i] != nil {
+			t.Fatalf("Loader %d failed: %v", i, errs[i])
+		}
+		files := l.GetLoadedFiles()
+		for _, path := range []string{tmp + "/ws/lib.ipd", tmp + "/ws/defaults.yaml"} {
+			if _, ok := files[path]; !ok {
+				t.Errorf("Loader %d: `%s' not tracked: %v", i, path, files)
+			}
+		}
+		if l.GetLoadedModule("//lib.ipd") == nil {
+			t.Errorf("Loader %d: `//lib.ipd' not loaded", i)
+		}
+	}
+	if execs != 1 {
+		t.Errorf("Want shared module executed once, got %d", execs)
+	}
+	if got := loaders[1].GetLoadedModule("main.ipd").globals["out"].String(); got != "4" {
+		t.Errorf("Unexpected value of second addon.\nWant: 4\nGot: %s", got)
+	}
+}
+
+func TestLoadCycle(t *testing.T) {
+	tmp := newWorkspace(t)
+	for path, data := range map[string]string{
+		"ws/self.ipd": "load(\"self.ipd\", \"x\")\n",
+		"ws/a.ipd":    "load(\"b.ipd\", \"x\")\n",
+		"ws/b.ipd":    "load(\"c.ipd\", \"x\")\n",
+		"ws/c.ipd":    "load(\"a.ipd\", \"x\")\n",
+	} {
+		writeFile(t, tmp, path, data)
+	}
+
+	for _, modules := range [][]string{
+		{"self.ipd"},
+		{"a.ipd"},
+		// Loaded concurrently so that each module of the cycle may be
+		// executed by a different goroutine.
+		{"a.ipd", "b.ipd", "c.ipd"},
+	} {
+		t.Run(strings.Join(modules, ","), func(t *testing.T) {
+			cache := NewCache()
+			errs := make([]error, len(modules))
+			var wg sync.WaitGroup
+			for i, m := range modules {
+				wg.Add(1)
+				go func(i int, m string) {
+					defer wg.Done()
+					_, errs[i] = NewModulesLoaderWithCache(tmp+"/ws", nil, cache).Load(nil, m)
+				}(i, m)
+			}
+			wg.Wait()
+
+			for i, err := range errs {
+				if err == nil || !strings.Contains(err.Error(), "cycle in load graph") {
+					t.Errorf("Loading `%s': want cycle error, got: %v", modules[i], err)
+				}
+			}
+		})
+	}
+}
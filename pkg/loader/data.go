@@ -0,0 +1,99 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+// loadDataBuiltin is the name of the builtin predeclared in every module for
+// loading data files.
+const loadDataBuiltin = "load_data"
+
+// dataFile is a data file loaded by load_data.
+type dataFile struct {
+	value starlark.Value
+	data  []byte
+}
+
+// loadDataFn returns load_data builtin resolving paths relative to baseDir:
+//
+//	defaults = load_data("//config/defaults.yaml")
+//
+// YAML (.yaml, .yml) and JSON (.json) files are supported. The file is
+// decoded once per loader cache and the same frozen value is returned to
+// every module loading it. parent is the cache entry of the module calling
+// load_data.
+func (l *modulesLoader) loadDataFn(baseDir string, mockReaderFn *ModuleReaderFactory, parent *cacheEntry) *starlark.Builtin {
+	return starlark.NewBuiltin(loadDataBuiltin, func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var path string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path); err != nil {
+			return nil, err
+		}
+		key, f, err := l.loadData(baseDir, path, mockReaderFn)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		parent.data[key] = f
+		l.mu.Lock()
+		l.data[key] = f
+		l.mu.Unlock()
+		return f.value, nil
+	})
+}
+
+// loadData reads and decodes data file at path (or returns the cached one)
+// and returns it with its resolved path.
+func (l *modulesLoader) loadData(baseDir, path string, mockReaderFn *ModuleReaderFactory) (string, *dataFile, error) {
+	ext := filepath.Ext(path)
+	switch ext {
+	case ".yaml", ".yml", ".json":
+	default:
+		return "", nil, fmt.Errorf("unsupported data file extension `%s' (want one of .yaml, .yml, .json)", ext)
+	}
+
+	dir, fileName, _, err := resolveModule(l.root, baseDir, path)
+	if err != nil {
+		return "", nil, err
+	}
+	key := filepath.Join(dir, fileName)
+	if f, ok := l.cache.dataFile(key); ok {
+		return key, f, nil
+	}
+
+	data, err := readModule(dir, fileName, mockReaderFn)
+	if err != nil {
+		return "", nil, err
+	}
+	bs := data
+	if ext != ".json" {
+		if bs, err = yaml.YAMLToJSON(data); err != nil {
+			return "", nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+		}
+	}
+	v, err := util.ReadJSON(bs)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+	}
+	v.Freeze()
+
+	return key, l.cache.storeDataFile(key, &dataFile{value: v, data: data}), nil
+}
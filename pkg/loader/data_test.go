@@ -0,0 +1,127 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLoadData(t *testing.T) {
+	files := map[string]string{
+		"config/defaults.yaml": "replicas: 3\nimage: nginx\nports: [80, 443]\n",
+		"config/extra.json":    `{"debug": true, "ratio": 0.5}`,
+		"config/bad.yaml":      "a: [1,\n",
+		"config/notes.txt":     "",
+	}
+	readerFn := ModuleReaderFactory(func(module string) (io.Reader, func(), error) {
+		module = strings.TrimPrefix(module, "/")
+		return bytes.NewBufferString(files[module]), func() {}, nil
+	})
+
+	for _, tc := range []struct {
+		name, src, want, wantErr string
+	}{
+		{
+			name: "YAML",
+			src:  `d = load_data("config/defaults.yaml"); out = "%s %d %s" % (d["image"], d["replicas"], d["ports"])`,
+			want: `"nginx 3 [80, 443]"`,
+		},
+		{
+			name: "JSON",
+			src:  `d = load_data("config/extra.json"); out = "%s %s" % (d["debug"], d["ratio"])`,
+			want: `"True 0.5"`,
+		},
+		{
+			name:    "Frozen",
+			src:     `d = load_data("config/defaults.yaml"); d["replicas"] = 1`,
+			wantErr: "cannot insert into frozen hash table",
+		},
+		{
+			name:    "Unsupported extension",
+			src:     `d = load_data("config/notes.txt")`,
+			wantErr: "<load_data>: unsupported data file extension `.txt' (want one of .yaml, .yml, .json)",
+		},
+		{
+			name:    "Malformed",
+			src:     `d = load_data("config/bad.yaml")`,
+			wantErr: "<load_data>: failed to parse `config/bad.yaml'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files["main.ipd"] = tc.src
+			l := NewFakeModulesLoader(nil, readerFn)
+			globals, err := l.Load(nil, "main.ipd")
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr != "" {
+				if !strings.Contains(gotErr, tc.wantErr) {
+					t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := globals["out"].String(); got != tc.want {
+				t.Errorf("Unexpected value.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadDataTracked(t *testing.T) {
+	tmp := newWorkspace(t)
+	for path, data := range map[string]string{
+		"ws/config/defaults.yaml":      "replicas: 3\n",
+		"ws/addons/nginx/values.yaml":  "replicas: 2\n",
+		"ws/addons/nginx/main.ipd":     "load(\"//lib.ipd\", \"r\")\nd = load_data(\"values.yaml\")\nout = [r, d[\"replicas\"]]\n",
+		"ws/lib.ipd":                   "r = load_data(\"//config/defaults.yaml\")[\"replicas\"]\nr2 = load_data(\"config/defaults.yaml\")[\"replicas\"]\n",
+		"ws/addons/nginx/ignored.yaml": "",
+	} {
+		writeFile(t, tmp, path, data)
+	}
+	SetWorkspaceRoot(tmp + "/ws")
+	defer SetWorkspaceRoot("")
+
+	l := NewModulesLoader(tmp + "/ws/addons/nginx")
+	globals, err := l.Load(nil, "main.ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["out"].String(), "[3, 2]"; got != want {
+		t.Errorf("Unexpected value.\nWant: %s\nGot: %s", want, got)
+	}
+
+	loaded := l.GetLoaded()
+	for _, path := range []string{
+		tmp + "/ws/config/defaults.yaml",
+		tmp + "/ws/addons/nginx/values.yaml",
+	} {
+		if _, ok := loaded[path]; !ok {
+			t.Errorf("Data file `%s' not tracked: %v", path, loaded)
+		}
+	}
+	if _, ok := loaded[tmp+"/ws/addons/nginx/ignored.yaml"]; ok {
+		t.Error("Unexpected data file tracked")
+	}
+	if n := len(l.(*modulesLoader).data); n != 2 {
+		t.Errorf("Expected 2 cached data files, got %d", n)
+	}
+}
@@ -15,13 +15,14 @@
 package loader
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
@@ -39,6 +40,16 @@ func Register(dep Dependency) {
 	dependencies[dep.Name()] = dep
 }
 
+// Dependencies returns registered dependencies sorted by name.
+func Dependencies() []Dependency {
+	var deps []Dependency
+	for _, dep := range dependencies {
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name() < deps[j].Name() })
+	return deps
+}
+
 // Dependency defines a remote Isopod module to be loaded to the local project.
 type Dependency interface {
 	// Fetch downloads the source of this dependency.
@@ -61,11 +72,16 @@ type ModulesLoader interface {
 	// returns the same module.
 	Load(t *starlark.Thread, module string) (starlark.StringDict, error)
 
-	// GetLoaded returns a mapping of loaded module paths to their text context.
+	// GetLoaded returns a mapping of loaded module (and data file) paths to
+	// their text context.
 	GetLoaded() map[string]string
 
 	// GetLoadedModule returns the module given the module name.
 	GetLoadedModule(moduleName string) *Module
+
+	// GetLoadedFiles returns a mapping of resolved paths of loaded module
+	// (and data) files to their text context.
+	GetLoadedFiles() map[string]string
 }
 
 // Module represents a starlark modules.
@@ -74,6 +90,8 @@ type Module struct {
 	data    []byte
 	version string
 	err     error
+	// path is the resolved path of the module file.
+	path string
 }
 
 // Version returns the version of a loaded module
@@ -82,10 +100,20 @@ func (m *Module) Version() string {
 }
 
 // ModulesLoader supports loading modules. In Starlark, each file is a module.
+// It is safe for concurrent use.
 type modulesLoader struct {
-	baseDir         string
-	loaded          map[string]*Module
+	baseDir string
+	// root is the workspace root `//' paths are relative to (see
+	// WorkspaceRootOr).
+	root            string
 	predeclaredPkgs starlark.StringDict
+	cache           *Cache
+
+	mu sync.Mutex
+	// loaded and data are modules and data files loaded by this loader
+	// (directly or by the modules it loaded).
+	loaded map[string]*Module
+	data   map[string]*dataFile
 }
 
 // NewModulesLoader creates a new loader for modules.
@@ -98,106 +126,200 @@ func NewModulesLoader(baseDir string) ModulesLoader {
 func NewModulesLoaderWithPredeclaredPkgs(
 	baseDir string,
 	predeclaredPkgs starlark.StringDict,
+) ModulesLoader {
+	return NewModulesLoaderWithCache(baseDir, predeclaredPkgs, NewCache())
+}
+
+// NewModulesLoaderWithCache creates a new loader for modules with predeclared
+// packages that shares executed modules and data files with other loaders
+// using cache. All loaders sharing a cache must use the same predeclared
+// packages.
+func NewModulesLoaderWithCache(
+	baseDir string,
+	predeclaredPkgs starlark.StringDict,
+	cache *Cache,
+) ModulesLoader {
+	return NewWorkspaceModulesLoader(baseDir, "", predeclaredPkgs, cache)
+}
+
+// NewWorkspaceModulesLoader is NewModulesLoaderWithCache for modules of the
+// workspace rooted at root. Uses the default workspace root if root is empty.
+func NewWorkspaceModulesLoader(
+	baseDir, root string,
+	predeclaredPkgs starlark.StringDict,
+	cache *Cache,
 ) ModulesLoader {
 	return &modulesLoader{
 		baseDir:         baseDir,
-		loaded:          map[string]*Module{},
+		root:            root,
 		predeclaredPkgs: predeclaredPkgs,
+		cache:           cache,
+		loaded:          map[string]*Module{},
+		data:            map[string]*dataFile{},
 	}
 }
 
 // Load implements module loading. Repeated calls with the same module name
 // returns the same module.
 func (l *modulesLoader) Load(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-	return l.anchoredLoadFn(l.baseDir, nil)(nil, module)
+	return l.anchoredLoadFn(l.baseDir, nil, nil)(nil, module)
 }
 
 // anchoredLoadFn loads modules relative to the baseDir. It accepts a ModuleReaderFactory
-// to allow unit testing with mocked readers.
+// to allow unit testing with mocked readers. parent is the cache entry of the
+// module executing load statements (nil for top-level loads).
 func (l *modulesLoader) anchoredLoadFn(
 	baseDir string,
 	mockReaderFn *ModuleReaderFactory,
+	parent *cacheEntry,
 ) func(t *starlark.Thread, module string) (starlark.StringDict, error) {
 	return func(t *starlark.Thread, module string) (starlark.StringDict, error) {
-		m, ok := l.loaded[module]
-		if m != nil {
-			return m.globals, m.err
-		}
-		if ok {
-			return nil, errors.New("cycle in load graph")
-		}
-
-		// Add a placeholder to indicate "load in progress".
-		l.loaded[module] = nil
-
-		var predeclared starlark.StringDict
-		var version string
 		switch ext := filepath.Ext(module); ext {
 		case ".ipd", ".star":
-			predeclared = l.predeclaredPkgs
 		default:
 			return nil, fmt.Errorf("unknown file extension: %s", ext)
 		}
 
-		fileName := module
-		if strings.HasPrefix(module, "@") {
-			idx := strings.Index(module, "//")
-			if idx < 0 {
-				return nil, fmt.Errorf("remote module must contain double slash")
-			}
-			moduleName := module[1:strings.Index(module, "//")]
-			dep, ok := dependencies[moduleName]
-			if !ok {
-				return nil, fmt.Errorf("`%s' is not registered", moduleName)
-			}
-			log.Infof("Fetching module `%s'", moduleName)
-			if err := dep.Fetch(); err != nil {
-				return nil, fmt.Errorf("failed to fetch module `%s': %v", moduleName, err)
-			}
-			baseDir = dep.LocalDir()
-			version = dep.Version()
-			fileName = module[idx+2:] // suffix after double slash
-		}
-
-		readerFn := NewFileReaderFactory(baseDir)
-		if mockReaderFn != nil {
-			readerFn = *mockReaderFn
-		}
-		r, closer, err := readerFn(fileName)
+		dir, fileName, version, err := resolveModule(l.root, baseDir, module)
 		if err != nil {
 			return nil, err
 		}
-		defer closer()
-		data, err := ioutil.ReadAll(r)
+		path := filepath.Join(dir, fileName)
+
+		e, owner, err := l.cache.acquire(path, parent)
 		if err != nil {
 			return nil, err
 		}
+		if owner {
+			e.module = l.execModule(e, dir, fileName, version, mockReaderFn)
+			l.cache.release(e, parent)
+		}
 
-		// Load and initialize the module in a new thread.
-		newBaseDir := filepath.Join(baseDir, filepath.Dir(fileName))
-		loadFn := l.anchoredLoadFn(newBaseDir, mockReaderFn)
-		thread := &starlark.Thread{Load: loadFn}
-		globals, err := starlark.ExecFile(thread, fileName, data, predeclared)
-		m = &Module{globals: globals, data: data, err: err, version: version}
+		if parent != nil {
+			parent.loads[module] = e
+		}
+		l.record(module, e)
+		return e.module.globals, e.module.err
+	}
+}
+
+// execModule reads and executes module fileName relative to dir in a new
+// thread.
+func (l *modulesLoader) execModule(
+	e *cacheEntry,
+	dir, fileName, version string,
+	mockReaderFn *ModuleReaderFactory,
+) *Module {
+	path := filepath.Join(dir, fileName)
+	data, err := readModule(dir, fileName, mockReaderFn)
+	if err != nil {
+		return &Module{err: err, version: version, path: path}
+	}
+
+	newBaseDir := filepath.Join(dir, filepath.Dir(fileName))
+	thread := &starlark.Thread{Load: l.anchoredLoadFn(newBaseDir, mockReaderFn, e)}
+	predeclared := make(starlark.StringDict, len(l.predeclaredPkgs)+1)
+	for k, v := range l.predeclaredPkgs {
+		predeclared[k] = v
+	}
+	predeclared[loadDataBuiltin] = l.loadDataFn(newBaseDir, mockReaderFn, e)
+	globals, err := starlark.ExecFile(thread, fileName, data, predeclared)
+	return &Module{globals: globals, data: data, err: err, version: version, path: path}
+}
+
+// record records module loaded by name (and modules and data files it
+// loaded) as loaded by l.
+func (l *modulesLoader) record(name string, e *cacheEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recordLocked(name, e, map[*cacheEntry]bool{})
+}
+
+func (l *modulesLoader) recordLocked(name string, e *cacheEntry, seen map[*cacheEntry]bool) {
+	if seen[e] {
+		return
+	}
+	seen[e] = true
+	if e.module.err != nil && e.module.data == nil {
+		// Modules that failed to be read are not recorded.
+		return
+	}
+	l.loaded[name] = e.module
+	for path, f := range e.data {
+		l.data[path] = f
+	}
+	for n, dep := range e.loads {
+		l.recordLocked(n, dep, seen)
+	}
+}
+
+// resolveModule returns directory module is anchored in and its path
+// relative to the directory. `//' paths are relative to root (see
+// WorkspaceRootOr). version is set for modules of remote dependencies.
+func resolveModule(root, baseDir, module string) (dir, fileName, version string, err error) {
+	depName, rel, isDep, err := splitDepPath(module)
+	if err != nil {
+		return "", "", "", err
+	}
+	switch {
+	case isDep:
+		dep, err := fetchDep(depName)
+		if err != nil {
+			return "", "", "", err
+		}
+		return dep.LocalDir(), rel, dep.Version(), nil
+	case strings.HasPrefix(module, "//"):
+		return WorkspaceRootOr(root), module[2:], "", nil
+	}
+	return baseDir, module, "", nil
+}
 
-		// Update the cache.
-		l.loaded[module] = m
-		return m.globals, m.err
+// readModule reads fileName relative to dir (or from mockReaderFn if set).
+func readModule(dir, fileName string, mockReaderFn *ModuleReaderFactory) ([]byte, error) {
+	readerFn := NewFileReaderFactory(dir)
+	if mockReaderFn != nil {
+		readerFn = *mockReaderFn
+	}
+	r, closer, err := readerFn(fileName)
+	if err != nil {
+		return nil, err
 	}
+	defer closer()
+	return ioutil.ReadAll(r)
 }
 
 func (l *modulesLoader) GetLoaded() map[string]string {
-	modules := make(map[string]string, len(l.loaded))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	modules := make(map[string]string, len(l.loaded)+len(l.data))
 	for m, v := range l.loaded {
 		modules[m] = string(v.data)
 	}
+	for path, f := range l.data {
+		modules[path] = string(f.data)
+	}
 	return modules
 }
 
 func (l *modulesLoader) GetLoadedModule(moduleName string) *Module {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.loaded[moduleName]
 }
 
+func (l *modulesLoader) GetLoadedFiles() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	files := make(map[string]string, len(l.loaded)+len(l.data))
+	for _, m := range l.loaded {
+		files[m.path] = string(m.data)
+	}
+	for path, f := range l.data {
+		files[path] = string(f.data)
+	}
+	return files
+}
+
 // fakeModulesLoader implements ModulesLoader interface.
 type fakeModulesLoader struct {
 	modReaderFn ModuleReaderFactory
@@ -217,7 +339,7 @@ func NewFakeModulesLoader(
 }
 
 func (f *fakeModulesLoader) Load(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-	return f.anchoredLoadFn(f.baseDir, &f.modReaderFn)(nil, module)
+	return f.anchoredLoadFn(f.baseDir, &f.modReaderFn, nil)(nil, module)
 }
 
 // ModuleReaderFactory is a factory function returning reader for the module.
@@ -0,0 +1,147 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// WorkspaceMarker is the file marking the root of a workspace (the directory
+// remote modules are declared in).
+const WorkspaceMarker = "isopod.deps"
+
+var (
+	workspaceMu sync.RWMutex
+	// workspaceRoot is the directory `//'-prefixed paths are relative to.
+	workspaceRoot string
+)
+
+// SetWorkspaceRoot sets the directory `//'-prefixed paths are resolved
+// against by default (see WorkspaceRootOr).
+func SetWorkspaceRoot(dir string) {
+	workspaceMu.Lock()
+	defer workspaceMu.Unlock()
+	workspaceRoot = dir
+}
+
+// WorkspaceRoot returns the directory set by SetWorkspaceRoot.
+func WorkspaceRoot() string {
+	workspaceMu.RLock()
+	defer workspaceMu.RUnlock()
+	return workspaceRoot
+}
+
+// WorkspaceRootOr returns root if set and the directory set by
+// SetWorkspaceRoot otherwise, so that a runtime may anchor `//' paths in its
+// own workspace.
+func WorkspaceRootOr(root string) string {
+	if root != "" {
+		return root
+	}
+	return WorkspaceRoot()
+}
+
+// FindWorkspaceRoot returns the nearest ancestor of dir (including dir)
+// containing WorkspaceMarker or dir itself if there is none. Symlinks in dir
+// are resolved first so that symlinked directories are anchored in the
+// workspace they point to.
+func FindWorkspaceRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, WorkspaceMarker)); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return dir, nil
+		}
+	}
+}
+
+// splitDepPath splits `@name//path' into dependency name and path. Returns
+// ok=false if path doesn't reference a dependency.
+func splitDepPath(path string) (name, rel string, ok bool, err error) {
+	if !strings.HasPrefix(path, "@") {
+		return "", "", false, nil
+	}
+	idx := strings.Index(path, "//")
+	if idx < 0 {
+		return "", "", false, fmt.Errorf("remote path `%s' must contain double slash", path)
+	}
+	return path[1:idx], path[idx+2:], true, nil
+}
+
+// fetchDep fetches registered dependency name.
+func fetchDep(name string) (Dependency, error) {
+	dep, ok := dependencies[name]
+	if !ok {
+		return nil, fmt.Errorf("`%s' is not registered", name)
+	}
+	log.Infof("Fetching module `%s'", name)
+	if err := dep.Fetch(); err != nil {
+		return nil, fmt.Errorf("failed to fetch module `%s': %v", name, err)
+	}
+	return dep, nil
+}
+
+// ResolvePath resolves path referenced by a module in baseDir of the default
+// workspace (see ResolveWorkspacePath).
+func ResolvePath(baseDir, path string) (string, error) {
+	return ResolveWorkspacePath("", baseDir, path)
+}
+
+// ResolveWorkspacePath resolves path referenced by a module in baseDir of
+// the workspace rooted at root (see WorkspaceRootOr):
+//   - `//path' is relative to the workspace root,
+//   - `@dep//path' is relative to the root of remote module `dep' (which is
+//     fetched if needed),
+//   - absolute paths are returned as is,
+//   - other paths are relative to baseDir.
+func ResolveWorkspacePath(root, baseDir, path string) (string, error) {
+	name, rel, ok, err := splitDepPath(path)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		dep, err := fetchDep(name)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dep.LocalDir(), rel), nil
+	}
+
+	switch {
+	case strings.HasPrefix(path, "//"):
+		root := WorkspaceRootOr(root)
+		if root == "" {
+			return "", fmt.Errorf("cannot resolve `%s': workspace root is not set", path)
+		}
+		return filepath.Join(root, path[2:]), nil
+	case filepath.IsAbs(path):
+		return path, nil
+	}
+	return filepath.Join(baseDir, path), nil
+}
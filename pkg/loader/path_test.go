@@ -0,0 +1,172 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeDep struct{ dir string }
+
+func (d *fakeDep) Fetch() error     { return nil }
+func (d *fakeDep) Name() string     { return "fake" }
+func (d *fakeDep) Version() string  { return "v1" }
+func (d *fakeDep) LocalDir() string { return d.dir }
+
+// newWorkspace creates the following layout in a temporary directory and
+// returns its path (with symlinks resolved):
+//
+//	ws/isopod.deps
+//	ws/lib.ipd
+//	ws/addons/nginx/main.ipd
+//	link -> ws/addons
+//	other/
+func newWorkspace(t *testing.T) string {
+	tmp, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	if tmp, err = filepath.EvalSymlinks(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, data := range map[string]string{
+		"ws/isopod.deps":           "",
+		"ws/lib.ipd":               "x = 1\n",
+		"ws/addons/nginx/main.ipd": "load(\"//lib.ipd\", \"x\")\ny = x + 1\n",
+		"other/main.ipd":           "",
+	} {
+		writeFile(t, tmp, path, data)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "ws/addons"), filepath.Join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+// writeFile writes data to path relative to dir creating parent directories.
+func writeFile(t *testing.T, dir, path, data string) {
+	path = filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindWorkspaceRoot(t *testing.T) {
+	tmp := newWorkspace(t)
+	for _, tc := range []struct {
+		name, dir, want string
+	}{
+		{name: "Root", dir: "ws", want: "ws"},
+		{name: "Nested", dir: "ws/addons/nginx", want: "ws"},
+		{name: "Symlinked", dir: "link/nginx", want: "ws"},
+		{name: "No marker", dir: "other", want: "other"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FindWorkspaceRoot(filepath.Join(tmp, tc.dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(tmp, tc.want); got != want {
+				t.Errorf("Unexpected root.\nWant: %s\nGot: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	SetWorkspaceRoot("/ws")
+	defer SetWorkspaceRoot("")
+	Register(&fakeDep{dir: "/deps/fake"})
+	defer delete(dependencies, "fake")
+
+	for _, tc := range []struct {
+		name, path, want, wantErr string
+	}{
+		{name: "Workspace", path: "//charts/nginx", want: "/ws/charts/nginx"},
+		{name: "Dependency", path: "@fake//charts/nginx", want: "/deps/fake/charts/nginx"},
+		{name: "Absolute", path: "/etc/manifests", want: "/etc/manifests"},
+		{name: "Relative", path: "manifests", want: "/ws/addons/nginx/manifests"},
+		{name: "Unknown dependency", path: "@missing//charts", wantErr: "`missing' is not registered"},
+		{name: "Dependency without path", path: "@fake", wantErr: "remote path `@fake' must contain double slash"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ResolvePath("/ws/addons/nginx", tc.path)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if got != tc.want {
+				t.Errorf("Unexpected path.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+
+	if got, err := ResolveWorkspacePath("/other", "/ws", "//charts"); err != nil || got != "/other/charts" {
+		t.Errorf("Unexpected path in other workspace: %s (error: %v)", got, err)
+	}
+
+	SetWorkspaceRoot("")
+	if _, err := ResolvePath("/ws", "//charts"); err == nil {
+		t.Error("Expected error without workspace root")
+	}
+}
+
+func TestLoadWorkspacePath(t *testing.T) {
+	tmp := newWorkspace(t)
+	// Addon is loaded through a symlink but `//' is anchored in the
+	// workspace the symlink points to.
+	dir := filepath.Join(tmp, "link/nginx")
+	root, err := FindWorkspaceRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetWorkspaceRoot(root)
+	defer SetWorkspaceRoot("")
+
+	globals, err := NewModulesLoader(dir).Load(nil, "main.ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["y"]; got == nil || got.String() != "2" {
+		t.Errorf("Unexpected value of y: %v", got)
+	}
+}
+
+func TestLoadWorkspaceRootOverride(t *testing.T) {
+	tmp := newWorkspace(t)
+	// The default root must not be used by loaders with their own root.
+	SetWorkspaceRoot(filepath.Join(tmp, "other"))
+	defer SetWorkspaceRoot("")
+
+	l := NewWorkspaceModulesLoader(filepath.Join(tmp, "ws/addons/nginx"), filepath.Join(tmp, "ws"), nil, NewCache())
+	globals, err := l.Load(nil, "main.ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["y"]; got == nil || got.String() != "2" {
+		t.Errorf("Unexpected value of y: %v", got)
+	}
+}
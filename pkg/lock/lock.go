@@ -0,0 +1,302 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lock implements a rollout lock backed by a coordination.k8s.io
+// Lease so that concurrent Isopod runs can't interleave mutations of the same
+// cluster.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/rs/xid"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LeaseName is the name of the Lease object used as the lock.
+	LeaseName = "isopod-rollout-lock"
+
+	// DefaultLeaseDuration is how long the lock is held without renewal.
+	// Lock abandoned by a crashed process expires after this long.
+	DefaultLeaseDuration = 60 * time.Second
+
+	retryInterval = time.Second
+)
+
+// ErrHeld is returned when lock could not be acquired before timeout because
+// it is held by another Isopod.
+var ErrHeld = errors.New("rollout lock is held by another Isopod")
+
+// Lease is a lock backed by coordination.k8s.io/v1 Lease object.
+type Lease struct {
+	clientset kubernetes.Interface
+	namespace string
+	holder    string
+	duration  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+	doneCh chan struct{}
+	// lostCh is closed when the lease is lost while held, with the reason
+	// in err.
+	lostCh chan struct{}
+	err    error
+}
+
+// New returns a new *Lease in namespace. Holder identity is derived from the
+// hostname and is unique per *Lease.
+func New(c kubernetes.Interface, namespace string) *Lease {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "isopod"
+	}
+	return &Lease{
+		clientset: c,
+		namespace: namespace,
+		holder:    host + "-" + xid.New().String(),
+		duration:  DefaultLeaseDuration,
+		now:       time.Now,
+	}
+}
+
+// Holder returns the holder identity recorded in the Lease.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Acquire blocks until the lock is acquired or timeout elapses, in which case
+// error wrapping ErrHeld is returned. Zero timeout makes a single attempt.
+// Once acquired, the lease is renewed in background until Release is called.
+// If the lease is taken over or can't be renewed before it expires, Lost is
+// closed.
+func (l *Lease) Acquire(ctx context.Context, timeout time.Duration) error {
+	deadline := l.now().Add(timeout)
+	for {
+		holder, err := l.tryAcquire(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lease `%s/%s': %v", l.namespace, LeaseName, err)
+		}
+		if holder == "" {
+			break
+		}
+		if !l.now().Before(deadline) {
+			return fmt.Errorf("lease `%s/%s' is held by `%s': %w", l.namespace, LeaseName, holder, ErrHeld)
+		}
+		log.Infof("Waiting for lease `%s/%s' held by `%s'...", l.namespace, LeaseName, holder)
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopCh, l.doneCh = make(chan struct{}), make(chan struct{})
+	l.lostCh, l.err = make(chan struct{}), nil
+	go l.renew(l.stopCh, l.doneCh)
+	return nil
+}
+
+// Lost returns a channel closed when the lock acquired by the last Acquire
+// is lost before it is released (nil if never acquired). Mutations must stop
+// then as another Isopod may hold the lock.
+func (l *Lease) Lost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lostCh
+}
+
+// Err returns error wrapping ErrHeld if the lock was lost (see Lost), nil
+// otherwise.
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// lose records that the lock was lost because of err.
+func (l *Lease) lose(err error) {
+	log.Errorf("%v", err)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+	close(l.lostCh)
+}
+
+// tryAcquire makes a single attempt to take the lease. Returns identity of
+// the current holder if the lease is held by someone else, empty string on
+// success.
+func (l *Lease) tryAcquire(ctx context.Context) (string, error) {
+	c := l.clientset.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(l.now())
+	seconds := int32(l.duration / time.Second)
+
+	lease, err := c.Get(ctx, LeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = c.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: LeaseName},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return "<unknown>", nil
+		}
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+
+	if holder := l.heldBy(lease); holder != "" && holder != l.holder {
+		return holder, nil
+	}
+
+	lease.Spec.HolderIdentity = &l.holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	if _, err := c.Update(ctx, lease, metav1.UpdateOptions{}); apierrors.IsConflict(err) {
+		// Someone else got there first.
+		return "<unknown>", nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// heldBy returns the holder of an unexpired lease (empty if expired or not
+// held).
+func (l *Lease) heldBy(lease *coordinationv1.Lease) string {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil {
+		return ""
+	}
+	d := l.duration
+	if spec.LeaseDurationSeconds != nil {
+		d = time.Duration(*spec.LeaseDurationSeconds) * time.Second
+	}
+	if spec.RenewTime.Add(d).Before(l.now()) {
+		return ""
+	}
+	return *spec.HolderIdentity
+}
+
+// renew renews the lease every third of its duration until stopCh is
+// closed. Failed renewals are retried until the lease expires, at which point
+// (or once taken over) the lock is lost.
+func (l *Lease) renew(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	t := time.NewTicker(l.duration / 3)
+	defer t.Stop()
+	renewed := l.now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+		}
+
+		c := l.clientset.CoordinationV1().Leases(l.namespace)
+		lease, err := c.Get(context.TODO(), LeaseName, metav1.GetOptions{})
+		if err == nil {
+			if holder := l.heldBy(lease); holder != l.holder {
+				l.lose(fmt.Errorf("lost lease `%s/%s' to `%s': %w", l.namespace, LeaseName, holder, ErrHeld))
+				return
+			}
+			now := metav1.NewMicroTime(l.now())
+			lease.Spec.RenewTime = &now
+			_, err = c.Update(context.TODO(), lease, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			renewed = l.now()
+			continue
+		}
+		if !l.now().Before(renewed.Add(l.duration)) {
+			l.lose(fmt.Errorf("lease `%s/%s' expired after failed renewals (last error: %v): %w", l.namespace, LeaseName, err, ErrHeld))
+			return
+		}
+		log.Errorf("Failed to renew lease `%s/%s': %v", l.namespace, LeaseName, err)
+	}
+}
+
+// Release stops renewal and releases the lock if it is still held by l.
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	if l.stopCh != nil {
+		close(l.stopCh)
+		<-l.doneCh
+		l.stopCh, l.doneCh = nil, nil
+	}
+	l.mu.Unlock()
+
+	c := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := c.Get(ctx, LeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to release lease `%s/%s': %v", l.namespace, LeaseName, err)
+	}
+	if l.heldBy(lease) != l.holder {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.RenewTime = nil
+	if _, err := c.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to release lease `%s/%s': %v", l.namespace, LeaseName, err)
+	}
+	return nil
+}
+
+// Hold acquires the lock in namespace of the cluster of c waiting up to
+// timeout (see Acquire). Returns ctx that is cancelled if the lock is lost
+// before it is released, which mutations must be made with, and function
+// releasing the lock that returns error wrapping ErrHeld if it was lost.
+func Hold(ctx context.Context, c kubernetes.Interface, namespace string, timeout time.Duration) (context.Context, func() error, error) {
+	l := New(c, namespace)
+	if err := l.Acquire(ctx, timeout); err != nil {
+		return nil, nil, err
+	}
+	log.Infof("Acquired rollout lock as `%s'", l.Holder())
+	lockCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-l.Lost():
+			cancel()
+		case <-lockCtx.Done():
+		}
+	}()
+	return lockCtx, func() error {
+		cancel()
+		if err := l.Release(ctx); err != nil {
+			log.Errorf("Failed to release rollout lock: %v", err)
+		}
+		return l.Err()
+	}, nil
+}
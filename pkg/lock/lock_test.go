@@ -0,0 +1,114 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	a, b := New(client, "default"), New(client, "default")
+	if err := a.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire free lock: %v", err)
+	}
+	// Re-entrant for the same holder.
+	if _, err := a.tryAcquire(ctx); err != nil {
+		t.Fatalf("Failed to re-acquire own lock: %v", err)
+	}
+
+	if err := b.Acquire(ctx, 0); !errors.Is(err, ErrHeld) {
+		t.Fatalf("Expected ErrHeld, got: %v", err)
+	}
+
+	if err := a.Release(ctx); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if err := b.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire released lock: %v", err)
+	}
+	defer b.Release(ctx)
+
+	lease, err := client.CoordinationV1().Leases("default").Get(ctx, LeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *lease.Spec.HolderIdentity; got != b.Holder() {
+		t.Errorf("Expected lease holder `%s', got `%s'", b.Holder(), got)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	a, b := New(client, "default"), New(client, "default")
+	if err := a.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire free lock: %v", err)
+	}
+	// Simulate a crashed holder that never renewed its lease.
+	a.Release(ctx)
+	a.holder = "crashed"
+	if _, err := a.tryAcquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b.now = func() time.Time { return time.Now().Add(2 * DefaultLeaseDuration) }
+	if err := b.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to take over expired lock: %v", err)
+	}
+	b.Release(ctx)
+}
+
+func TestLeaseLost(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	a := New(client, "default")
+	a.duration = 3 * time.Second
+	if err := a.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Failed to acquire free lock: %v", err)
+	}
+	defer a.Release(ctx)
+
+	// Another Isopod takes over the lease (e.g after a long GC pause).
+	leases := client.CoordinationV1().Leases("default")
+	lease, err := leases.Get(ctx, LeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, now := "other", metav1.NewMicroTime(time.Now())
+	lease.Spec.HolderIdentity, lease.Spec.RenewTime = &other, &now
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-a.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lease takeover was not detected")
+	}
+	if err := a.Err(); !errors.Is(err, ErrHeld) {
+		t.Errorf("Expected ErrHeld, got: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// Cache memoizes values computed by Starlark functions. A single Cache is
+// shared by addons of all clusters of a run so that expensive computations
+// (e.g Vault reads, HTTP fetches or rendered charts) run once.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	stats   CacheStats
+	// waiting are entries threads wait for to be computed by other threads.
+	waiting map[*starlark.Thread]*cacheEntry
+	// now returns the current time (replaced in tests).
+	now func() time.Time
+}
+
+// CacheStats are statistics of cache lookups.
+type CacheStats struct {
+	Hits, Misses int
+}
+
+type cacheEntry struct {
+	v starlark.Value
+	// expires is when v expires (zero if never).
+	expires time.Time
+	// computing is the thread computing v (nil once done) and done is
+	// closed once it is done.
+	computing *starlark.Thread
+	done      chan struct{}
+}
+
+// NewCache returns a new empty Cache.
+func NewCache() *Cache {
+	return &Cache{
+		entries: map[string]*cacheEntry{},
+		waiting: map[*starlark.Thread]*cacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// Stats returns hit/miss statistics of c.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Module returns new Isopod built-in module for c.
+// Supports these methods:
+//   - cache.get_or_set - Returns value cached under key, calling fn to compute
+//     it if missing or expired. Concurrent callers of the same key wait for
+//     the first one. Errors of fn aren't cached. Fails instead of waiting
+//     forever if keys depend on each other (e.g fn of key x gets key y
+//     whose fn gets key x), even if computed by different threads.
+//   - cache.invalidate - Removes value cached under key. Returns whether there
+//     was one.
+//   - cache.clear - Removes all cached values.
+//   - cache.stats - Returns struct with `hits', `misses' and `entries' (ints)
+//     fields.
+//
+// Args of cache.get_or_set:
+//   - key - required string key.
+//   - fn - required function called with no arguments that returns the value
+//     (frozen once cached).
+//   - ttl - optional duration the value is cached for (default: the whole
+//     run).
+func (c *Cache) Module() *isopod.Module {
+	return &isopod.Module{
+		Name: "cache",
+		Attrs: map[string]starlark.Value{
+			"get_or_set": starlark.NewBuiltin("cache.get_or_set", c.getOrSetFn),
+			"invalidate": starlark.NewBuiltin("cache.invalidate", c.invalidateFn),
+			"clear":      starlark.NewBuiltin("cache.clear", c.clearFn),
+			"stats":      starlark.NewBuiltin("cache.stats", c.statsFn),
+		},
+	}
+}
+
+func (c *Cache) getOrSetFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, ttl string
+	var fn starlark.Callable
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"key", &key,
+		"fn", &fn,
+		"ttl?", &ttl,
+	); err != nil {
+		return nil, err
+	}
+	var d time.Duration
+	if ttl != "" {
+		var err error
+		if d, err = time.ParseDuration(ttl); err != nil || d <= 0 {
+			return nil, fmt.Errorf("<%v>: invalid ttl `%s' (want a positive duration, e.g. 5m)", b.Name(), ttl)
+		}
+	}
+
+	c.mu.Lock()
+	for {
+		e, ok := c.entries[key]
+		if !ok {
+			break
+		}
+		if e.computing == nil {
+			if e.expires.IsZero() || c.now().Before(e.expires) {
+				c.stats.Hits++
+				c.mu.Unlock()
+				return e.v, nil
+			}
+			delete(c.entries, key)
+			break
+		}
+		if e.computing == t {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("<%v>: recursive call for key `%s'", b.Name(), key)
+		}
+		if c.waitsFor(e.computing, t) {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("<%v>: cyclic dependency on key `%s' computed by another thread", b.Name(), key)
+		}
+		c.waiting[t] = e
+		c.mu.Unlock()
+		<-e.done
+		c.mu.Lock()
+		delete(c.waiting, t)
+	}
+	e := &cacheEntry{computing: t, done: make(chan struct{})}
+	c.entries[key] = e
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	v, err := starlark.Call(t, fn, nil, nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.computing = nil
+	close(e.done)
+	if err != nil {
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		return nil, err
+	}
+	v.Freeze()
+	e.v = v
+	if d > 0 {
+		e.expires = c.now().Add(d)
+	}
+	return v, nil
+}
+
+// waitsFor returns whether thread t (transitively) waits for an entry
+// computed by thread other. c.mu must be held.
+func (c *Cache) waitsFor(t, other *starlark.Thread) bool {
+	for t != nil {
+		if t == other {
+			return true
+		}
+		e, ok := c.waiting[t]
+		if !ok {
+			return false
+		}
+		t = e.computing
+	}
+	return false
+}
+
+func (c *Cache) invalidateFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	delete(c.entries, key)
+	return starlark.Bool(ok), nil
+}
+
+func (c *Cache) clearFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*cacheEntry{}
+	return starlark.None, nil
+}
+
+func (c *Cache) statsFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"hits":    starlark.MakeInt(c.stats.Hits),
+		"misses":  starlark.MakeInt(c.stats.Misses),
+		"entries": starlark.MakeInt(len(c.entries)),
+	}), nil
+}
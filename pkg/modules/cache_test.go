@@ -0,0 +1,202 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestCache(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		expr string
+
+		want    string
+		wantErr string
+	}{
+		{
+			name: "hit",
+			expr: `[cache.get_or_set("k", count), cache.get_or_set("k", count), cache.get_or_set("other", count), cache.stats()]`,
+			want: `[1, 1, 2, struct(entries = 2, hits = 1, misses = 2)]`,
+		},
+		{
+			name: "ttl",
+			expr: `[cache.get_or_set("k", count, ttl="1m"), advance("30s"), cache.get_or_set("k", count, ttl="1m"), advance("30s"), cache.get_or_set("k", count, ttl="1m")]`,
+			want: `[1, None, 1, None, 2]`,
+		},
+		{
+			name: "invalidate",
+			expr: `[cache.get_or_set("k", count), cache.invalidate("k"), cache.invalidate("k"), cache.get_or_set("k", count)]`,
+			want: `[1, True, False, 2]`,
+		},
+		{
+			name: "clear",
+			expr: `[cache.get_or_set("a", count), cache.get_or_set("b", count), cache.clear(), cache.stats().entries, cache.get_or_set("a", count)]`,
+			want: `[1, 2, None, 0, 3]`,
+		},
+		{
+			name:    "frozen",
+			expr:    `cache.get_or_set("k", new_list).append(1)`,
+			wantErr: "append: cannot append to frozen list",
+		},
+		{
+			name:    "error not cached",
+			expr:    `[cache.get_or_set("k", count), cache.get_or_set("fail", fail)]`,
+			wantErr: "fail: oops",
+		},
+		{
+			name:    "invalid ttl",
+			expr:    `cache.get_or_set("k", count, ttl="-1m")`,
+			wantErr: "<cache.get_or_set>: invalid ttl `-1m' (want a positive duration, e.g. 5m)",
+		},
+		{
+			name:    "recursive",
+			expr:    `cache.get_or_set("k", recurse)`,
+			wantErr: "<cache.get_or_set>: recursive call for key `k'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCache()
+			now := time.Unix(0, 0)
+			c.now = func() time.Time { return now }
+			var n int
+			pkgs := starlark.StringDict{
+				"cache": c.Module(),
+				"count": starlark.NewBuiltin("count", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+					n++
+					return starlark.MakeInt(n), nil
+				}),
+				"advance": starlark.NewBuiltin("advance", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+					var d string
+					if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &d); err != nil {
+						return nil, err
+					}
+					dd, err := time.ParseDuration(d)
+					if err != nil {
+						return nil, err
+					}
+					now = now.Add(dd)
+					return starlark.None, nil
+				}),
+				"new_list": starlark.NewBuiltin("new_list", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+					return starlark.NewList(nil), nil
+				}),
+				"fail": starlark.NewBuiltin("fail", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+					return nil, errors.New("fail: oops")
+				}),
+			}
+			pkgs["recurse"] = starlark.NewBuiltin("recurse", func(t *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+				return starlark.Call(t, c.Module().Attrs["get_or_set"], starlark.Tuple{starlark.String("k"), pkgs["count"]}, nil)
+			})
+
+			got, _, err := util.Eval("cache", tc.expr, nil, pkgs)
+			var gotErr string
+			if err != nil {
+				gotErr = err.(*starlark.EvalError).Msg
+			}
+			if d := cmp.Diff(tc.wantErr, gotErr); d != "" {
+				t.Fatalf("Unexpected error. (-want +got)\n%s", d)
+			}
+			if tc.wantErr != "" {
+				if _, ok := c.entries["fail"]; ok {
+					t.Errorf("Failed value is cached")
+				}
+				return
+			}
+			if d := cmp.Diff(tc.want, got.String()); d != "" {
+				t.Errorf("Unexpected return value: (-want +got)\n%s", d)
+			}
+		})
+	}
+}
+
+func TestCacheShared(t *testing.T) {
+	c := NewCache()
+	var n int
+	count := starlark.NewBuiltin("count", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+		n++
+		return starlark.MakeInt(n), nil
+	})
+	// Each evaluation stands for an addon run on a different cluster.
+	for i := 0; i < 3; i++ {
+		pkgs := starlark.StringDict{"cache": c.Module(), "count": count}
+		got, _, err := util.Eval("cache", `cache.get_or_set("k", count)`, nil, pkgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != "1" {
+			t.Errorf("Unexpected value of run %d: want 1, got %v", i, got)
+		}
+	}
+	if d := cmp.Diff(CacheStats{Hits: 2, Misses: 1}, c.Stats()); d != "" {
+		t.Errorf("Unexpected stats (-want +got):\n%s", d)
+	}
+}
+
+func TestCacheCrossThreadCycle(t *testing.T) {
+	c := NewCache()
+	getOrSet := starlark.NewBuiltin("cache.get_or_set", c.getOrSetFn)
+	one := starlark.NewBuiltin("one", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+		return starlark.MakeInt(1), nil
+	})
+	// dependsOn returns fn signaling started and getting key once other
+	// started, so that both threads compute their key when getting the other.
+	dependsOn := func(key string, started, other chan struct{}) *starlark.Builtin {
+		return starlark.NewBuiltin("fn", func(t *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+			close(started)
+			<-other
+			return starlark.Call(t, getOrSet, starlark.Tuple{starlark.String(key), one}, nil)
+		})
+	}
+	xStarted, yStarted := make(chan struct{}), make(chan struct{})
+	fns := map[string]*starlark.Builtin{
+		"x": dependsOn("y", xStarted, yStarted),
+		"y": dependsOn("x", yStarted, xStarted),
+	}
+
+	errs := make(chan error, len(fns))
+	for key, fn := range fns {
+		go func(key string, fn *starlark.Builtin) {
+			_, err := starlark.Call(&starlark.Thread{Name: key}, getOrSet, starlark.Tuple{starlark.String(key), fn}, nil)
+			errs <- err
+		}(key, fn)
+	}
+	var failed int
+	for range fns {
+		select {
+		case err := <-errs:
+			if err == nil {
+				continue
+			}
+			if !strings.Contains(err.Error(), "cyclic dependency on key") {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			failed++
+		case <-time.After(10 * time.Second):
+			t.Fatal("Threads getting keys depending on each other deadlocked")
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected exactly one thread to fail, %d did", failed)
+	}
+}
@@ -23,12 +23,17 @@ import (
 //   * base64 - Base64 encode/decode operations (RFC 4648).
 //   * uuid - UUID generate operations (RFC 4122).
 //   * http - HTTP calls.
+//   * grpc - gRPC calls.
+//   * exec - Local commands (all disallowed, see NewExecModule).
 //   * struct - Starlark struct with to_json() support.
 func Predeclared() starlark.StringDict {
 	return starlark.StringDict{
 		"base64": NewBase64Module(),
 		"uuid":   NewUUIDModule(),
 		"http":   NewHTTPModule(),
+		"grpc":   NewGRPCModule(),
+		"exec":   NewExecModule(nil),
 		"struct": starlark.NewBuiltin("struct", StructFn),
+		"time":   NewTimeModule(RealClock),
 	}
 }
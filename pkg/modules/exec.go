@@ -0,0 +1,179 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/loader"
+)
+
+const defaultExecTimeout = 5 * time.Minute
+
+// NewExecModule returns new Isopod built-in module for running local
+// commands. Only commands whose name (first element of argv) is in allowed
+// may be run.
+// Supports these methods:
+//   - exec.run - Runs command and waits for it to exit
+//
+// Args:
+//   - argv - required command and its arguments as a list of strings.
+//   - cwd - working directory (relative to the addon, defaults to the
+//     addon's directory).
+//   - env - dict of environment variables added to those of Isopod.
+//   - timeout - kills the command after this duration (default: 5m).
+//   - check - fail if the command exits with non-zero code (default: True).
+//
+// Returns: struct with `stdout', `stderr' (strings) and `exit_code' (int)
+// fields.
+func NewExecModule(allowed []string) *isopod.Module {
+	allow := map[string]bool{}
+	for _, c := range allowed {
+		allow[c] = true
+	}
+	return &isopod.Module{
+		Name: "exec",
+		Attrs: map[string]starlark.Value{
+			"run": starlark.NewBuiltin("exec.run", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				return execRunFn(allow, t, b, args, kwargs)
+			}),
+		},
+	}
+}
+
+// ReadOnlyExec returns exec module m with `run' failing with
+// isopod.ErrReadOnly as commands may mutate anything.
+func ReadOnlyExec(m *isopod.Module) *isopod.Module {
+	return isopod.ReadOnly(m, "run")
+}
+
+// execArgs are arguments of `exec.run'.
+type execArgs struct {
+	argv    []string
+	cwd     string
+	env     []string
+	timeout time.Duration
+	check   bool
+}
+
+func unpackExecArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (*execArgs, error) {
+	a := &execArgs{check: true, timeout: defaultExecTimeout}
+	argv := &starlark.List{}
+	env := &starlark.Dict{}
+	var timeout string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"argv", &argv,
+		"cwd?", &a.cwd,
+		"env?", &env,
+		"timeout?", &timeout,
+		"check?", &a.check,
+	); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < argv.Len(); i++ {
+		s, ok := starlark.AsString(argv.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("`argv' must be a list of strings (got a `%s')", argv.Index(i).Type())
+		}
+		a.argv = append(a.argv, s)
+	}
+	if len(a.argv) == 0 {
+		return nil, errors.New("`argv' must not be empty")
+	}
+
+	for _, kv := range env.Items() {
+		k, ok1 := starlark.AsString(kv[0])
+		v, ok2 := starlark.AsString(kv[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("`env' must be a dict of strings (got `%v': `%v')", kv[0], kv[1])
+		}
+		a.env = append(a.env, k+"="+v)
+	}
+
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout `%s': %v", timeout, err)
+		}
+		a.timeout = d
+	}
+	return a, nil
+}
+
+func execRunFn(allowed map[string]bool, t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	a, err := unpackExecArgs(b, args, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("<%v>: running commands is disabled, allow `%s' with --allow_exec", b.Name(), a.argv[0])
+	}
+	if !allowed[a.argv[0]] {
+		return nil, fmt.Errorf("<%v>: command `%s' is not allowed by --allow_exec", b.Name(), a.argv[0])
+	}
+
+	baseDir, _ := t.Local(addon.BaseDirKey).(string)
+	root, _ := t.Local(addon.WorkspaceRootKey).(string)
+	cwd, err := loader.ResolveWorkspacePath(root, baseDir, a.cwd)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Local(addon.GoCtxKey).(context.Context), a.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, a.argv[0], a.argv[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = append(os.Environ(), a.env...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	log.V(1).Infof("Running `%s' in `%s'", strings.Join(a.argv, " "), cwd)
+
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || ctx.Err() != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %v", a.timeout)
+			}
+			return nil, fmt.Errorf("<%v>: failed to run `%s': %v", b.Name(), a.argv[0], err)
+		}
+		exitCode = exitErr.ExitCode()
+		if a.check {
+			return nil, fmt.Errorf("<%v>: `%s' exited with code %d: %s", b.Name(), strings.Join(a.argv, " "), exitCode, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"stdout":    starlark.String(stdout.String()),
+		"stderr":    starlark.String(stderr.String()),
+		"exit_code": starlark.MakeInt(exitCode),
+	}), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestExec(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		expr    string
+
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "stdout",
+			allowed: []string{"echo"},
+			expr:    `[[r.stdout, r.stderr, r.exit_code] for r in [exec.run(["echo", "foo", "bar"])]]`,
+			want:    `[["foo bar\n", "", 0]]`,
+		},
+		{
+			name:    "env and cwd",
+			allowed: []string{"sh"},
+			expr:    `[exec.run(["sh", "-c", "echo $FOO; pwd"], env={"FOO": "bar"}, cwd="/").stdout]`,
+			want:    `["bar\n/\n"]`,
+		},
+		{
+			name:    "non-zero exit code",
+			allowed: []string{"sh"},
+			expr:    `[exec.run(["sh", "-c", "echo oops >&2; exit 3"])]`,
+			wantErr: "<exec.run>: `sh -c echo oops >&2; exit 3' exited with code 3: oops",
+		},
+		{
+			name:    "non-zero exit code unchecked",
+			allowed: []string{"sh"},
+			expr:    `[[r.stderr, r.exit_code] for r in [exec.run(["sh", "-c", "echo oops >&2; exit 3"], check=False)]]`,
+			want:    `[["oops\n", 3]]`,
+		},
+		{
+			name:    "timeout",
+			allowed: []string{"sleep"},
+			expr:    `[exec.run(["sleep", "10"], timeout="10ms")]`,
+			wantErr: "<exec.run>: failed to run `sleep': timed out after 10ms",
+		},
+		{
+			name:    "disabled",
+			expr:    `[exec.run(["echo", "foo"])]`,
+			wantErr: "<exec.run>: running commands is disabled, allow `echo' with --allow_exec",
+		},
+		{
+			name:    "not allowed",
+			allowed: []string{"helm"},
+			expr:    `[exec.run(["echo", "foo"])]`,
+			wantErr: "<exec.run>: command `echo' is not allowed by --allow_exec",
+		},
+		{
+			name:    "empty argv",
+			allowed: []string{"echo"},
+			expr:    `[exec.run([])]`,
+			wantErr: "<exec.run>: `argv' must not be empty",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"exec": NewExecModule(tc.allowed)}
+			got, _, err := util.Eval("exec", tc.expr, nil, pkgs)
+			var gotErr string
+			if err != nil {
+				gotErr = err.(*starlark.EvalError).Msg
+			}
+			if d := cmp.Diff(tc.wantErr, gotErr); d != "" {
+				t.Fatalf("Unexpected error. (-want +got)\n%s", d)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			if d := cmp.Diff(tc.want, got.String()); d != "" {
+				t.Errorf("Unexpected return value: (-want +got)\n%s", d)
+			}
+		})
+	}
+}
+
+func TestReadOnlyExec(t *testing.T) {
+	pkgs := starlark.StringDict{"exec": ReadOnlyExec(NewExecModule([]string{"echo"}))}
+	_, _, err := util.Eval("exec", `exec.run(["echo", "foo"])`, nil, pkgs)
+	want := "<exec.run>: not allowed in read-only mode (--read_only)"
+	if err == nil || err.(*starlark.EvalError).Msg != want {
+		t.Errorf("Want error %q, got: %v", want, err)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+const (
+	defaultGRPCTimeout = 30 * time.Second
+	// reflectionMethod is the (v1alpha) server reflection stream.
+	reflectionMethod = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+)
+
+// NewGRPCModule returns new Isopod built-in module for gRPC calls.
+// Supports these methods:
+//   - grpc.call - Performs unary gRPC call
+//
+// Args:
+//   - target - required address of the server (e.g `svc.ns.svc:8080').
+//   - method - required full method name (e.g `grpc.health.v1.Health/Check').
+//   - request - request message as JSON string or Starlark dict (defaults to
+//     empty message).
+//   - tls - whether to use TLS (default: True).
+//   - ca - PEM encoded CA certificates used to verify the server instead of
+//     the system roots.
+//   - metadata - optional request metadata as Starlark dict of strings.
+//   - descriptors - path to a binary FileDescriptorSet (relative to the
+//     addon) describing the method. If unset, the server must support gRPC
+//     reflection.
+//   - timeout - call deadline (default: 30s).
+//
+// Returns: response message as Starlark dict in proto3 JSON mapping.
+func NewGRPCModule() *isopod.Module {
+	return &isopod.Module{
+		Name: "grpc",
+		Attrs: map[string]starlark.Value{
+			"call": starlark.NewBuiltin("grpc.call", grpcCallFn),
+		},
+	}
+}
+
+// ReadOnlyGRPC returns grpc module m with `call' failing with
+// isopod.ErrReadOnly as methods that mutate can't be told apart from reads.
+func ReadOnlyGRPC(m *isopod.Module) *isopod.Module {
+	return isopod.ReadOnly(m, "call")
+}
+
+// grpcCallArgs are arguments of `grpc.call'.
+type grpcCallArgs struct {
+	target, method, ca, descriptors string
+	request                         starlark.Value
+	useTLS                          bool
+	md                              metadata.MD
+	timeout                         time.Duration
+}
+
+func unpackGRPCCallArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (*grpcCallArgs, error) {
+	a := &grpcCallArgs{useTLS: true, timeout: defaultGRPCTimeout}
+	md := &starlark.Dict{}
+	timeout := ""
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"target", &a.target,
+		"method", &a.method,
+		"request?", &a.request,
+		"tls?", &a.useTLS,
+		"ca?", &a.ca,
+		"metadata?", &md,
+		"descriptors?", &a.descriptors,
+		"timeout?", &timeout,
+	); err != nil {
+		return nil, err
+	}
+
+	a.md = metadata.MD{}
+	for _, kv := range md.Items() {
+		k, ok1 := kv[0].(starlark.String)
+		v, ok2 := kv[1].(starlark.String)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("`metadata' must be a dict of strings (got `%s': `%s')", kv[0].Type(), kv[1].Type())
+		}
+		a.md.Append(string(k), string(v))
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout `%s': %v", timeout, err)
+		}
+		a.timeout = d
+	}
+	return a, nil
+}
+
+// requestJSON returns request of a as JSON (nil for an empty message).
+func (a *grpcCallArgs) requestJSON() ([]byte, error) {
+	switch r := a.request.(type) {
+	case nil, starlark.NoneType:
+		return nil, nil
+	case starlark.String:
+		return []byte(r), nil
+	case *starlark.Dict:
+		buf := &bytes.Buffer{}
+		if err := WriteJSON(buf, r); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("`request' must be a JSON string or a dict (got a `%s')", a.request.Type())
+}
+
+// grpcCallFn is a starlark built-in function that performs a unary gRPC call.
+// Usage:
+//
+//	resp = grpc.call("my-svc.default.svc:8080", "grpc.health.v1.Health/Check", "{}", tls=False)
+//	if resp["status"] != "SERVING": error("not serving")
+func grpcCallFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	a, err := unpackGRPCCallArgs(b, args, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	service, method, err := splitGRPCMethod(a.method)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	req, err := a.requestJSON()
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Local(addon.GoCtxKey).(context.Context), a.timeout)
+	defer cancel()
+
+	creds := grpc.WithInsecure()
+	if a.useTLS {
+		c := &tls.Config{}
+		if a.ca != "" {
+			c.RootCAs = x509.NewCertPool()
+			if !c.RootCAs.AppendCertsFromPEM([]byte(a.ca)) {
+				return nil, fmt.Errorf("<%v>: `ca' contains no PEM encoded certificates", b.Name())
+			}
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(c))
+	}
+	conn, err := grpc.DialContext(ctx, a.target, creds)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to connect to `%s': %v", b.Name(), a.target, err)
+	}
+	defer conn.Close()
+
+	var files *protoregistry.Files
+	if a.descriptors != "" {
+		baseDir, _ := t.Local(addon.BaseDirKey).(string)
+		root, _ := t.Local(addon.WorkspaceRootKey).(string)
+		path, rErr := loader.ResolveWorkspacePath(root, baseDir, a.descriptors)
+		if rErr != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), rErr)
+		}
+		files, err = loadDescriptorSet(path)
+	} else {
+		files, err = reflectService(ctx, conn, service)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to resolve `%s': %v", b.Name(), service, err)
+	}
+	md, err := findMethod(files, service, method)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	in := dynamicpb.NewMessage(md.Input())
+	if req != nil {
+		if err := protojson.Unmarshal(req, in); err != nil {
+			return nil, fmt.Errorf("<%v>: invalid request: %v", b.Name(), err)
+		}
+	}
+	out := dynamicpb.NewMessage(md.Output())
+	ctx = metadata.NewOutgoingContext(ctx, a.md)
+	fullMethod := "/" + service + "/" + method
+	if err := conn.Invoke(ctx, fullMethod, in, out); err != nil {
+		return nil, fmt.Errorf("<%v>: call to `%s' failed: %v", b.Name(), fullMethod, err)
+	}
+
+	resp, err := protojson.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to decode response: %v", b.Name(), err)
+	}
+	return util.ReadJSON(resp)
+}
+
+// splitGRPCMethod splits full method name `[/]pkg.Service/Method'.
+func splitGRPCMethod(m string) (service, method string, err error) {
+	m = strings.TrimPrefix(m, "/")
+	i := strings.LastIndex(m, "/")
+	if i <= 0 || i == len(m)-1 {
+		return "", "", fmt.Errorf("invalid method `%s' (must be <package>.<Service>/<Method>)", m)
+	}
+	return m[:i], m[i+1:], nil
+}
+
+func findMethod(files *protoregistry.Files, service, method string) (protoreflect.MethodDescriptor, error) {
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("service `%s' not found: %v", service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("`%s' is not a service", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, fmt.Errorf("method `%s' not found in service `%s'", method, service)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method `%s/%s' is streaming, only unary methods are supported", service, method)
+	}
+	return md, nil
+}
+
+// loadDescriptorSet loads binary FileDescriptorSet (as produced by `protoc
+// --include_imports --descriptor_set_out') from path.
+func loadDescriptorSet(path string) (*protoregistry.Files, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(bs, set); err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor set `%s': %v", path, err)
+	}
+	return protodesc.NewFiles(set)
+}
+
+// reflectionProto is the descriptor of the (v1alpha) server reflection
+// messages used by reflectService.
+const reflectionProto = `
+name: "grpc/reflection/v1alpha/reflection.proto"
+package: "grpc.reflection.v1alpha"
+syntax: "proto3"
+message_type {
+  name: "ServerReflectionRequest"
+  field { name: "host" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "file_by_filename" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING oneof_index: 0 }
+  field { name: "file_containing_symbol" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING oneof_index: 0 }
+  oneof_decl { name: "message_request" }
+}
+message_type {
+  name: "ServerReflectionResponse"
+  field { name: "file_descriptor_response" number: 4 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".grpc.reflection.v1alpha.FileDescriptorResponse" oneof_index: 0 }
+  field { name: "error_response" number: 7 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".grpc.reflection.v1alpha.ErrorResponse" oneof_index: 0 }
+  oneof_decl { name: "message_response" }
+}
+message_type {
+  name: "FileDescriptorResponse"
+  field { name: "file_descriptor_proto" number: 1 label: LABEL_REPEATED type: TYPE_BYTES }
+}
+message_type {
+  name: "ErrorResponse"
+  field { name: "error_code" number: 1 label: LABEL_OPTIONAL type: TYPE_INT32 }
+  field { name: "error_message" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+`
+
+// reflectionFile is the descriptor of reflectionProto.
+var reflectionFile = func() protoreflect.FileDescriptor {
+	fdp := &descriptorpb.FileDescriptorProto{}
+	if err := prototext.Unmarshal([]byte(reflectionProto), fdp); err != nil {
+		panic(err)
+	}
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fd
+}()
+
+// reflectService fetches descriptors of the file defining symbol and all of
+// its dependencies using gRPC server reflection.
+func reflectService(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, reflectionMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	reqDesc := reflectionFile.Messages().ByName("ServerReflectionRequest")
+	respDesc := reflectionFile.Messages().ByName("ServerReflectionResponse")
+	request := func(field protoreflect.Name, v string) ([]*descriptorpb.FileDescriptorProto, error) {
+		req := dynamicpb.NewMessage(reqDesc)
+		req.Set(reqDesc.Fields().ByName(field), protoreflect.ValueOfString(v))
+		if err := stream.SendMsg(req); err != nil {
+			return nil, err
+		}
+		resp := dynamicpb.NewMessage(respDesc)
+		if err := stream.RecvMsg(resp); err != nil {
+			return nil, err
+		}
+		return parseReflectionResponse(resp)
+	}
+
+	fds, err := request("file_containing_symbol", symbol)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	set := &descriptorpb.FileDescriptorSet{}
+	// Servers may only return the requested file so missing dependencies
+	// are fetched by name.
+	for len(fds) > 0 {
+		fd := fds[0]
+		fds = fds[1:]
+		if seen[fd.GetName()] {
+			continue
+		}
+		seen[fd.GetName()] = true
+		set.File = append(set.File, fd)
+		for _, dep := range fd.GetDependency() {
+			if seen[dep] || containsFile(fds, dep) {
+				continue
+			}
+			more, err := request("file_by_filename", dep)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch `%s': %v", dep, err)
+			}
+			fds = append(fds, more...)
+		}
+	}
+	stream.CloseSend()
+	return protodesc.NewFiles(set)
+}
+
+func containsFile(fds []*descriptorpb.FileDescriptorProto, name string) bool {
+	for _, fd := range fds {
+		if fd.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReflectionResponse returns file descriptors of ServerReflectionResponse
+// resp or error of its error_response.
+func parseReflectionResponse(resp *dynamicpb.Message) ([]*descriptorpb.FileDescriptorProto, error) {
+	fields := resp.Descriptor().Fields()
+	if errResp := fields.ByName("error_response"); resp.Has(errResp) {
+		msg := resp.Get(errResp).Message()
+		return nil, fmt.Errorf("reflection failed: %s", msg.Get(msg.Descriptor().Fields().ByName("error_message")).String())
+	}
+	filesResp := fields.ByName("file_descriptor_response")
+	if !resp.Has(filesResp) {
+		return nil, errors.New("reflection returned no file descriptors")
+	}
+	msg := resp.Get(filesResp).Message()
+	files := msg.Get(msg.Descriptor().Fields().ByName("file_descriptor_proto")).List()
+	var fds []*descriptorpb.FileDescriptorProto
+	for i := 0; i < files.Len(); i++ {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(files.Get(i).Bytes(), fd); err != nil {
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	if len(fds) == 0 {
+		return nil, errors.New("reflection returned no file descriptors")
+	}
+	return fds, nil
+}
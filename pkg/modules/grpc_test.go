@@ -0,0 +1,279 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// testFileDescriptor describes:
+//
+//	syntax = "proto3";
+//	package isopod.test;
+//	enum Color { RED = 0; GREEN = 1; }
+//	message Inner { string name = 1; }
+//	message Msg {
+//	  string msg = 1; int64 count = 2; repeated int32 nums = 3;
+//	  Inner inner = 4; map<string, int64> labels = 5; Color color = 6;
+//	  bool ok = 7; bytes data = 8; double ratio = 9; sint32 delta = 10;
+//	}
+//	service Echo { rpc Echo(Msg) returns (Msg); rpc Stream(Msg) returns (stream Msg); }
+func testFileDescriptor() *descriptorpb.FileDescriptorProto {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	opt := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	rep := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("isopod/test.proto"),
+		Package: proto.String("isopod.test"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Color"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("RED"), Number: proto.Int32(0)},
+				{Name: proto.String("GREEN"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name:  proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, opt, "")},
+			},
+			{
+				Name: proto.String("Msg"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("msg", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, opt, ""),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, opt, ""),
+					field("nums", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32, rep, ""),
+					field("inner", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, opt, ".isopod.test.Inner"),
+					field("labels", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, rep, ".isopod.test.Msg.LabelsEntry"),
+					field("color", 6, descriptorpb.FieldDescriptorProto_TYPE_ENUM, opt, ".isopod.test.Color"),
+					field("ok", 7, descriptorpb.FieldDescriptorProto_TYPE_BOOL, opt, ""),
+					field("data", 8, descriptorpb.FieldDescriptorProto_TYPE_BYTES, opt, ""),
+					field("ratio", 9, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, opt, ""),
+					field("delta", 10, descriptorpb.FieldDescriptorProto_TYPE_SINT32, opt, ""),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("LabelsEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, opt, ""),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, opt, ""),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Echo"), InputType: proto.String(".isopod.test.Msg"), OutputType: proto.String(".isopod.test.Msg")},
+				{Name: proto.String("Stream"), InputType: proto.String(".isopod.test.Msg"), OutputType: proto.String(".isopod.test.Msg"), ServerStreaming: proto.Bool(true)},
+			},
+		}},
+	}
+}
+
+// fakeGRPCHandler serves reflection (if enabled) and echoes requests of
+// isopod.test.Echo/Echo (described by fd) back if `x-test' metadata is set.
+func fakeGRPCHandler(fd []byte, reflection bool) grpc.StreamHandler {
+	return func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		switch {
+		case method == reflectionMethod && reflection:
+			reqDesc := reflectionFile.Messages().ByName("ServerReflectionRequest")
+			respDesc := reflectionFile.Messages().ByName("ServerReflectionResponse")
+			for {
+				req := dynamicpb.NewMessage(reqDesc)
+				if err := stream.RecvMsg(req); err != nil {
+					return nil
+				}
+				resp := dynamicpb.NewMessage(respDesc)
+				symbol := req.Get(reqDesc.Fields().ByName("file_containing_symbol")).String()
+				if symbol == "isopod.test.Echo" {
+					field := respDesc.Fields().ByName("file_descriptor_response")
+					files := resp.NewField(field)
+					l := files.Message().Mutable(field.Message().Fields().ByName("file_descriptor_proto")).List()
+					l.Append(protoreflect.ValueOfBytes(fd))
+					resp.Set(field, files)
+				} else {
+					field := respDesc.Fields().ByName("error_response")
+					errResp := resp.NewField(field)
+					errResp.Message().Set(field.Message().Fields().ByName("error_message"), protoreflect.ValueOfString("symbol not found"))
+					resp.Set(field, errResp)
+				}
+				if err := stream.SendMsg(resp); err != nil {
+					return err
+				}
+			}
+		case method == "/isopod.test.Echo/Echo":
+			md, _ := metadata.FromIncomingContext(stream.Context())
+			if v := md.Get("x-test"); len(v) != 1 || v[0] != "yes" {
+				return status.Error(codes.PermissionDenied, "missing x-test metadata")
+			}
+			file, err := protodesc.NewFile(testFileDescriptor(), nil)
+			if err != nil {
+				return err
+			}
+			req := dynamicpb.NewMessage(file.Messages().ByName("Msg"))
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return stream.SendMsg(req)
+		}
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	fd, err := proto.Marshal(testFileDescriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testFileDescriptor()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.pb"), set, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		reflection bool
+		expr       string
+		want       string
+		wantErrMsg string
+	}{
+		{
+			name:       "Reflection",
+			reflection: true,
+			expr: `grpc.call(target, "isopod.test.Echo/Echo", {
+				"msg": "hello", "count": "9007199254740993", "nums": [1, -2],
+				"inner": {"name": "foo"}, "labels": {"a": 1}, "color": "GREEN",
+				"ok": True, "data": "aGk=", "ratio": "0.5", "delta": -3,
+			}, tls=False, metadata={"x-test": "yes"})`,
+			want: `{"msg": "hello", "count": "9007199254740993", "nums": [1, -2], "inner": {"name": "foo"}, "labels": {"a": "1"}, "color": "GREEN", "ok": True, "data": "aGk=", "ratio": 0.5, "delta": -3}`,
+		},
+		{
+			name: "Descriptors",
+			expr: `grpc.call(target, "/isopod.test.Echo/Echo", '{"msg": "hi", "color": 1}', tls=False, metadata={"x-test": "yes"}, descriptors="test.pb")`,
+			want: `{"msg": "hi", "color": "GREEN"}`,
+		},
+		{
+			name:       "Empty request",
+			reflection: true,
+			expr:       `grpc.call(target, "isopod.test.Echo/Echo", tls=False, metadata={"x-test": "yes"})`,
+			want:       `{}`,
+		},
+		{
+			name:       "Unknown field",
+			reflection: true,
+			expr:       `grpc.call(target, "isopod.test.Echo/Echo", {"foo": 1}, tls=False)`,
+			wantErrMsg: `<grpc.call>: invalid request: proto: (line 1:2): unknown field "foo"`,
+		},
+		{
+			name:       "Streaming method",
+			reflection: true,
+			expr:       `grpc.call(target, "isopod.test.Echo/Stream", tls=False)`,
+			wantErrMsg: "<grpc.call>: method `isopod.test.Echo/Stream' is streaming, only unary methods are supported",
+		},
+		{
+			name:       "Invalid method",
+			expr:       `grpc.call(target, "Echo", tls=False)`,
+			wantErrMsg: "<grpc.call>: invalid method `Echo' (must be <package>.<Service>/<Method>)",
+		},
+		{
+			name:       "Call error",
+			reflection: true,
+			expr:       `grpc.call(target, "isopod.test.Echo/Echo", tls=False)`,
+			wantErrMsg: "<grpc.call>: call to `/isopod.test.Echo/Echo' failed: rpc error: code = PermissionDenied desc = missing x-test metadata",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := grpc.NewServer(grpc.UnknownServiceHandler(fakeGRPCHandler(fd, tc.reflection)))
+			go s.Serve(lis)
+			defer s.Stop()
+
+			pkgs := starlark.StringDict{
+				"grpc":   NewGRPCModule(),
+				"target": starlark.String(lis.Addr().String()),
+			}
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.GoCtxKey, context.Background())
+			thread.SetLocal(addon.BaseDirKey, dir)
+			got, err := starlark.Eval(thread, "grpc", tc.expr, pkgs)
+
+			var gotErrMsg string
+			if err != nil {
+				gotErrMsg = err.Error()
+				if evalErr, ok := err.(*starlark.EvalError); ok {
+					gotErrMsg = evalErr.Msg
+				}
+				// protobuf randomly separates parts of its errors with
+				// non-breaking spaces to keep them from being compared.
+				gotErrMsg = strings.ReplaceAll(gotErrMsg, "\u00a0", " ")
+			}
+			if d := cmp.Diff(tc.wantErrMsg, gotErrMsg); d != "" {
+				t.Fatalf("Unexpected error. (-want +got)\n%s", d)
+			}
+			if tc.wantErrMsg != "" {
+				return
+			}
+			if d := cmp.Diff(tc.want, got.String()); d != "" {
+				t.Errorf("Unexpected response (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -15,114 +15,431 @@
 package modules
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 
 	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
+// httpRetryDelay is the delay before the first retry of a failed request,
+// doubled for each following retry.
+var httpRetryDelay = 500 * time.Millisecond
+
+// tlsOptions are TLS options of a request.
+type tlsOptions struct {
+	caCert, clientCert, clientKey string
+	insecure                      bool
+}
+
+// tlsTransports are transports shared by requests with the same TLS options
+// so that their idle connections are reused instead of leaked.
+var tlsTransports = struct {
+	sync.Mutex
+	m map[tlsOptions]*http.Transport
+}{m: map[tlsOptions]*http.Transport{}}
+
 // NewHTTPModule returns new Isopod built-in module for HTTP calls.
 // Supports these methods:
-//  * http.get - Performs HTTP GET call
-//  * http.post - Performs HTTP POST call
-//  * http.put - Performs HTTP PUT call
-//  * http.patch - Performs HTTP PATCH call
-//  * http.delete - Performs HTTP DELETE call
+//   - http.get - Performs HTTP GET call
+//   - http.post - Performs HTTP POST call
+//   - http.put - Performs HTTP PUT call
+//   - http.patch - Performs HTTP PATCH call
+//   - http.delete - Performs HTTP DELETE call
+//   - http.get_json - Performs HTTP GET call and parses JSON response
 //
 // Args:
-// url - required URL to send request to.
-// headers - optional headers provided as Starlark dict. Values can be either
-//           Starlark strings (for single value headers) or lists (for multiple
-//           ones).
-// data - optional data sent in request body (take Starlark string).
+//   - url - required URL to send request to.
+//   - headers - optional headers provided as Starlark dict. Values can be
+//     either Starlark strings (for single value headers) or lists (for
+//     multiple ones).
+//   - data - optional data sent in request body (take Starlark string).
+//   - json_body - optional Starlark value sent JSON encoded in request body
+//     (sets Content-Type to application/json unless set in headers).
+//   - form - optional dict of strings (or lists of strings) sent URL encoded
+//     in request body (sets Content-Type to
+//     application/x-www-form-urlencoded unless set in headers).
+//   - timeout - optional timeout of each attempt (e.g `10s').
+//   - retries - number of times requests failing with connection errors or
+//     429/5XX response codes are retried (default: 0). Only GET, PUT and
+//     DELETE requests are retried unless idempotent is set.
+//   - idempotent - allow retrying POST and PATCH requests.
+//   - ca_cert - PEM encoded CA certificates used to verify the server
+//     instead of the system roots.
+//   - client_cert, client_key - PEM encoded client certificate and key.
+//   - insecure - skip verification of the server certificate.
+//   - basic_auth - (username, password) tuple.
+//   - full_response - return a struct instead of the body.
 //
-// Returns: Starlark string of response body. If response body is empty, returns
-// starlark.None.
+// Returns: Starlark string of response body (http.get_json returns parsed
+// value instead). If response body is empty, returns starlark.None. With
+// full_response=True, returns a struct with `status' (int), `headers' (dict
+// of strings, multiple values joined by `, ') and `body' (string) fields and
+// doesn't fail on non-2XX response codes.
 //
 // Errors out on non-2XX response codes.
 func NewHTTPModule() *isopod.Module {
+	return NewHTTPModuleWithTransport(nil)
+}
+
+// NewHTTPModuleWithTransport is like NewHTTPModule but wraps transports used
+// to send requests with wrap (if set).
+func NewHTTPModuleWithTransport(wrap func(http.RoundTripper) http.RoundTripper) *isopod.Module {
 	return &isopod.Module{
 		Name: "http",
 		Attrs: map[string]starlark.Value{
-			"get":    getHTTPFn(http.MethodGet),
-			"post":   getHTTPFn(http.MethodPost),
-			"put":    getHTTPFn(http.MethodPut),
-			"patch":  getHTTPFn(http.MethodPatch),
-			"delete": getHTTPFn(http.MethodDelete),
+			"get":      getHTTPFn(wrap, http.MethodGet, false),
+			"post":     getHTTPFn(wrap, http.MethodPost, false),
+			"put":      getHTTPFn(wrap, http.MethodPut, false),
+			"patch":    getHTTPFn(wrap, http.MethodPatch, false),
+			"delete":   getHTTPFn(wrap, http.MethodDelete, false),
+			"get_json": getHTTPFn(wrap, http.MethodGet, true),
 		},
 	}
 }
 
-func getHTTPFn(method string) *starlark.Builtin {
-	return starlark.NewBuiltin(
-		"http."+strings.ToLower(method),
-		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-			var url string
-			hdrs := &starlark.Dict{}
-			var body string
-			unpacked := []interface{}{
-				"url", &url,
-				"headers?", &hdrs,
-				"data?", &body,
+// ReadOnlyHTTP returns http module m with methods other than GET failing
+// with isopod.ErrReadOnly.
+func ReadOnlyHTTP(m *isopod.Module) *isopod.Module {
+	return isopod.ReadOnly(m, "post", "put", "patch", "delete")
+}
+
+// httpArgs are arguments of http module built-ins.
+type httpArgs struct {
+	url, body, contentType, accept string
+	hdrs                           *starlark.Dict
+	timeout                        time.Duration
+	retries                        int
+	idempotent                     bool
+	caCert, clientCert, clientKey  string
+	insecure, fullResponse         bool
+	basicAuthUser, basicAuthPasswd string
+	hasBasicAuth                   bool
+}
+
+func unpackHTTPArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (*httpArgs, error) {
+	a := &httpArgs{hdrs: &starlark.Dict{}}
+	var timeout string
+	var basicAuth, jsonBody starlark.Value
+	var form *starlark.Dict
+	unpacked := []interface{}{
+		"url", &a.url,
+		"headers?", &a.hdrs,
+		"data?", &a.body,
+		"json_body?", &jsonBody,
+		"form?", &form,
+		"timeout?", &timeout,
+		"retries?", &a.retries,
+		"idempotent?", &a.idempotent,
+		"ca_cert?", &a.caCert,
+		"client_cert?", &a.clientCert,
+		"client_key?", &a.clientKey,
+		"insecure?", &a.insecure,
+		"basic_auth?", &basicAuth,
+		"full_response?", &a.fullResponse,
+	}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
+		return nil, err
+	}
+
+	if err := a.encodeBody(jsonBody, form); err != nil {
+		return nil, err
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout `%s': %v", timeout, err)
+		}
+		a.timeout = d
+	}
+	if a.retries < 0 {
+		return nil, fmt.Errorf("`retries' must not be negative (got %d)", a.retries)
+	}
+	if (a.clientCert == "") != (a.clientKey == "") {
+		return nil, errors.New("`client_cert' and `client_key' must be set together")
+	}
+	if basicAuth != nil && basicAuth != starlark.None {
+		seq, ok := basicAuth.(starlark.Indexable)
+		if !ok || seq.Len() != 2 {
+			return nil, fmt.Errorf("`basic_auth' must be a (username, password) tuple (got a `%s')", basicAuth.Type())
+		}
+		user, ok1 := starlark.AsString(seq.Index(0))
+		passwd, ok2 := starlark.AsString(seq.Index(1))
+		if !ok1 || !ok2 {
+			return nil, errors.New("`basic_auth' username and password must be strings")
+		}
+		a.basicAuthUser, a.basicAuthPasswd, a.hasBasicAuth = user, passwd, true
+	}
+	return a, nil
+}
+
+// encodeBody sets request body (and its content type) of a to jsonBody or
+// form (if set).
+func (a *httpArgs) encodeBody(jsonBody starlark.Value, form *starlark.Dict) error {
+	set := 0
+	for _, ok := range []bool{a.body != "", jsonBody != nil, form != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of `data', `json_body' and `form' may be set")
+	}
+
+	switch {
+	case jsonBody != nil:
+		buf := &bytes.Buffer{}
+		if err := WriteJSON(buf, jsonBody); err != nil {
+			return fmt.Errorf("failed to marshal `json_body': %v", err)
+		}
+		a.body, a.contentType = buf.String(), "application/json"
+	case form != nil:
+		vs := url.Values{}
+		for _, kv := range form.Items() {
+			k, ok := starlark.AsString(kv[0])
+			if !ok {
+				return fmt.Errorf("`form' key `%v' not a string (got a `%s')", kv[0], kv[0].Type())
+			}
+			switch v := kv[1].(type) {
+			case starlark.String:
+				vs.Add(k, string(v))
+			case *starlark.List:
+				for i := 0; i < v.Len(); i++ {
+					s, ok := starlark.AsString(v.Index(i))
+					if !ok {
+						return fmt.Errorf("`form' value of `%s' not a string (got a `%s')", k, v.Index(i).Type())
+					}
+					vs.Add(k, s)
+				}
+			default:
+				return fmt.Errorf("`form' value of `%s' not a string or a list (got a `%s')", k, v.Type())
 			}
+		}
+		a.body, a.contentType = vs.Encode(), "application/x-www-form-urlencoded"
+	}
+	return nil
+}
 
-			if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
-				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+// checkRetries returns an error if a retries a request of method that is
+// not idempotent without opting in.
+func (a *httpArgs) checkRetries(method string) error {
+	switch method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+		return nil
+	}
+	if a.retries > 0 && !a.idempotent {
+		return fmt.Errorf("`retries' of %s requests requires `idempotent=True'", method)
+	}
+	return nil
+}
+
+// transport returns transport configured with TLS options of a.
+func (a *httpArgs) transport(wrap func(http.RoundTripper) http.RoundTripper) (http.RoundTripper, error) {
+	var rt http.RoundTripper = http.DefaultTransport
+	if a.caCert != "" || a.clientCert != "" || a.insecure {
+		t, err := tlsTransport(tlsOptions{
+			caCert:     a.caCert,
+			clientCert: a.clientCert,
+			clientKey:  a.clientKey,
+			insecure:   a.insecure,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rt = t
+	}
+	if wrap != nil {
+		rt = wrap(rt)
+	}
+	return rt, nil
+}
+
+// tlsTransport returns the transport shared by requests with TLS options o.
+func tlsTransport(o tlsOptions) (*http.Transport, error) {
+	tlsTransports.Lock()
+	defer tlsTransports.Unlock()
+	if t, ok := tlsTransports.m[o]; ok {
+		return t, nil
+	}
+
+	c := &tls.Config{InsecureSkipVerify: o.insecure}
+	if o.caCert != "" {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM([]byte(o.caCert)) {
+			return nil, errors.New("`ca_cert' contains no PEM encoded certificates")
+		}
+	}
+	if o.clientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(o.clientCert), []byte(o.clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = c
+	tlsTransports.m[o] = t
+	return t, nil
+}
+
+// newRequest returns a new request with method and headers of a.
+func (a *httpArgs) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.url, strings.NewReader(a.body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize request: %v", err)
+	}
+
+	for _, kv := range a.hdrs.Items() {
+		k, v := kv[0], kv[1]
+		sk, ok := k.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("'%v header key not a string (got a %s)", k, k.Type())
+		}
+
+		switch sv := v.(type) {
+		case starlark.String:
+			req.Header.Add(string(sk), string(sv))
+		case *starlark.List:
+			iter := sv.Iterate()
+			var x starlark.Value
+			for iter.Next(&x) {
+				sx, ok := x.(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("'%v` header value not a string (got a %s)", k, x.Type())
+				}
+				req.Header.Add(string(sk), string(sx))
 			}
+			iter.Done()
+		default:
+			return nil, fmt.Errorf("'%v` header value not a string or a list (got a %s)", k, v.Type())
+		}
+	}
+	if a.contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", a.contentType)
+	}
+	if a.accept != "" && req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", a.accept)
+	}
+	if a.hasBasicAuth {
+		req.SetBasicAuth(a.basicAuthUser, a.basicAuthPasswd)
+	}
+	return req, nil
+}
 
-			req, err := http.NewRequest(method, url, strings.NewReader(body))
+// retryable returns true if a request that failed with err or status code
+// may succeed when retried.
+func retryable(code int, err error) bool {
+	return err != nil || code == http.StatusTooManyRequests || code >= 500
+}
+
+// do sends request built by a, retrying as configured. Returns status code,
+// headers and body of the last response.
+func (a *httpArgs) do(ctx context.Context, client *http.Client, method string) (*http.Response, []byte, error) {
+	delay := httpRetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := a.newRequest(ctx, method)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var body []byte
+		resp, err := client.Do(req)
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
 			if err != nil {
-				return nil, fmt.Errorf("failed to initialize request: %v", err)
+				err = fmt.Errorf("failed to read response body: %v", err)
 			}
+		} else {
+			err = fmt.Errorf("failed to make an HTTP request: %v", err)
+		}
 
-			for _, kv := range hdrs.Items() {
-				k, v := kv[0], kv[1]
-				sk, ok := k.(starlark.String)
-				if !ok {
-					return nil, fmt.Errorf("'%v header key not a string (got a %s)", k, k.Type())
-				}
+		code := 0
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		if attempt >= a.retries || !retryable(code, err) {
+			return resp, body, err
+		}
 
-				switch sv := v.(type) {
-				case starlark.String:
-					req.Header.Add(string(sk), string(sv))
-				case *starlark.List:
-					iter := sv.Iterate()
-					var x starlark.Value
-					for iter.Next(&x) {
-						sx, ok := x.(starlark.String)
-						if !ok {
-							return nil, fmt.Errorf("'%v` header value not a string (got a %s)", k, x.Type())
-						}
-						req.Header.Add(string(sk), string(sx))
-					}
-					iter.Done()
-				default:
-					return nil, fmt.Errorf("'%v` header value not a string or a list (got a %s)", k, v.Type())
-				}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = errors.New(resp.Status)
 			}
+			return nil, nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// fullResponse returns struct with status, headers and body of resp.
+func fullResponse(resp *http.Response, body []byte) starlark.Value {
+	hdrs := &starlark.Dict{}
+	for k, vs := range resp.Header {
+		hdrs.SetKey(starlark.String(k), starlark.String(strings.Join(vs, ", ")))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"status":  starlark.MakeInt(resp.StatusCode),
+		"headers": hdrs,
+		"body":    starlark.String(body),
+	})
+}
+
+func getHTTPFn(wrap func(http.RoundTripper) http.RoundTripper, method string, parseJSON bool) *starlark.Builtin {
+	name := "http." + strings.ToLower(method)
+	if parseJSON {
+		name += "_json"
+	}
+	return starlark.NewBuiltin(
+		name,
+		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			a, err := unpackHTTPArgs(b, args, kwargs)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			if parseJSON && a.fullResponse {
+				return nil, fmt.Errorf("<%v>: `full_response' is not supported", b.Name())
+			}
+			if parseJSON {
+				a.accept = "application/json"
+			}
+			if err := a.checkRetries(method); err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			rt, err := a.transport(wrap)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			client := &http.Client{Transport: rt, Timeout: a.timeout}
 
-			client := &http.Client{}
 			ctx := t.Local(addon.GoCtxKey).(context.Context)
-			resp, err := client.Do(req.WithContext(ctx))
+			resp, respBody, err := a.do(ctx, client, method)
 			if err != nil {
-				return nil, fmt.Errorf("failed to make an HTTP request: %v", err)
+				return nil, err
 			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				return nil, errors.New(resp.Status)
+			if a.fullResponse {
+				return fullResponse(resp, respBody), nil
 			}
 
-			respBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read response body: %v", err)
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				return nil, errors.New(resp.Status)
 			}
 
 			// If body was empty, return None value instead of empty string.
@@ -130,6 +447,14 @@ func getHTTPFn(method string) *starlark.Builtin {
 				return starlark.None, nil
 			}
 
+			if parseJSON {
+				v, err := util.ReadJSON(respBody)
+				if err != nil {
+					return nil, fmt.Errorf("<%v>: failed to parse response: %v", b.Name(), err)
+				}
+				return v, nil
+			}
+
 			return starlark.String(respBody), nil
 		})
 }
@@ -15,11 +15,13 @@
 package modules
 
 import (
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
@@ -144,3 +146,212 @@ func TestHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPOptions(t *testing.T) {
+	defer func(d time.Duration) { httpRetryDelay = d }(httpRetryDelay)
+	httpRetryDelay = time.Millisecond
+
+	for _, tc := range []struct {
+		name string
+		expr string
+		tls  bool
+		// failures is number of requests failing with 503 before success.
+		failures int
+
+		want    string
+		wantErr string
+	}{
+		{
+			name: "full response",
+			expr: `[[r.status, r.headers["X-Test"], r.body] for r in [http.get(test_url, full_response=True)]]`,
+			want: `[[200, "a, b", "ok"]]`,
+		},
+		{
+			name:     "full response does not fail on non-2XX",
+			expr:     `[[r.status, r.body] for r in [http.get(test_url, full_response=True)]]`,
+			failures: 1,
+			want:     `[[503, "unavailable\n"]]`,
+		},
+		{
+			name:     "retries",
+			expr:     `[http.get(test_url, retries=2)]`,
+			failures: 2,
+			want:     `["ok"]`,
+		},
+		{
+			name:     "retries of POST",
+			expr:     `[http.post(test_url, retries=2, idempotent=True)]`,
+			failures: 2,
+			want:     `["ok"]`,
+		},
+		{
+			name:    "retries of POST without idempotent",
+			expr:    `[http.post(test_url, retries=2)]`,
+			wantErr: "<http.post>: `retries' of POST requests requires `idempotent=True'",
+		},
+		{
+			name:     "retries exhausted",
+			expr:     `[http.get(test_url, retries=1)]`,
+			failures: 2,
+			wantErr:  "503 Service Unavailable",
+		},
+		{
+			name: "basic auth",
+			expr: `[http.get(test_url + "/auth", basic_auth=("user", "passwd"))]`,
+			want: `["user:passwd"]`,
+		},
+		{
+			name:    "invalid basic auth",
+			expr:    `[http.get(test_url, basic_auth="user")]`,
+			wantErr: "<http.get>: `basic_auth' must be a (username, password) tuple (got a `string')",
+		},
+		{
+			name:    "invalid timeout",
+			expr:    `[http.get(test_url, timeout="soon")]`,
+			wantErr: "<http.get>: invalid timeout `soon': time: invalid duration \"soon\"",
+		},
+		{
+			name: "timeout",
+			expr: `[http.get(test_url, timeout="10s")]`,
+			want: `["ok"]`,
+		},
+		{
+			name: "TLS with CA",
+			expr: `[http.get(test_url, ca_cert=test_ca)]`,
+			tls:  true,
+			want: `["ok"]`,
+		},
+		{
+			name: "TLS insecure",
+			expr: `[http.get(test_url, insecure=True)]`,
+			tls:  true,
+			want: `["ok"]`,
+		},
+		{
+			name: "JSON body",
+			expr: `[http.post(test_url + "/echo", json_body={"a": [1, "b"], "c": None})]`,
+			want: `["application/json {\"a\": [1, \"b\"], \"c\": null}"]`,
+		},
+		{
+			name: "JSON body with explicit content type",
+			expr: `[http.post(test_url + "/echo", json_body=[], headers={"Content-Type": "application/merge-patch+json"})]`,
+			want: `["application/merge-patch+json []"]`,
+		},
+		{
+			name: "form",
+			expr: `[http.post(test_url + "/echo", form={"b": "x y", "a": ["1", "2"]})]`,
+			want: `["application/x-www-form-urlencoded a=1&a=2&b=x+y"]`,
+		},
+		{
+			name:    "data and form",
+			expr:    `[http.post(test_url, data="foo", form={})]`,
+			wantErr: "<http.post>: only one of `data', `json_body' and `form' may be set",
+		},
+		{
+			name: "get JSON",
+			expr: `[http.get_json(test_url + "/json")]`,
+			want: `[{"name": "foo", "replicas": 3, "ratio": 0.5, "ready": True, "owner": None, "ports": [80, 443]}]`,
+		},
+		{
+			name: "get JSON sends accept header",
+			expr: `[http.get_json(test_url + "/accept")]`,
+			want: `["application/json"]`,
+		},
+		{
+			name:    "get JSON invalid response",
+			expr:    `[http.get_json(test_url)]`,
+			wantErr: "<http.get_json>: failed to parse response: invalid character 'o' looking for beginning of value",
+		},
+		{
+			name:    "invalid CA",
+			expr:    `[http.get(test_url, ca_cert="foo")]`,
+			tls:     true,
+			wantErr: "<http.get>: `ca_cert' contains no PEM encoded certificates",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tc.failures {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				switch r.URL.Path {
+				case "/auth":
+					u, p, _ := r.BasicAuth()
+					fmt.Fprintf(w, "%s:%s", u, p)
+					return
+				case "/echo":
+					bs, _ := ioutil.ReadAll(r.Body)
+					fmt.Fprintf(w, "%s %s", r.Header.Get("Content-Type"), bs)
+					return
+				case "/json":
+					fmt.Fprint(w, `{"name": "foo", "replicas": 3, "ratio": 0.5, "ready": true, "owner": null, "ports": [80, 443]}`)
+					return
+				case "/accept":
+					fmt.Fprintf(w, `"%s"`, r.Header.Get("Accept"))
+					return
+				}
+				w.Header().Add("X-Test", "a")
+				w.Header().Add("X-Test", "b")
+				fmt.Fprint(w, "ok")
+			})
+			pkgs := starlark.StringDict{"http": NewHTTPModule()}
+			var ts *httptest.Server
+			if tc.tls {
+				ts = httptest.NewTLSServer(h)
+				ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+				pkgs["test_ca"] = starlark.String(ca)
+			} else {
+				ts = httptest.NewServer(h)
+			}
+			defer ts.Close()
+			pkgs["test_url"] = starlark.String(ts.URL)
+
+			got, _, err := util.Eval("http", tc.expr, nil, pkgs)
+			var gotErr string
+			if err != nil {
+				gotErr = err.(*starlark.EvalError).Msg
+			}
+			if d := cmp.Diff(tc.wantErr, gotErr); d != "" {
+				t.Fatalf("Unexpected error. (-want +got)\n%s", d)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			if d := cmp.Diff(tc.want, got.String()); d != "" {
+				t.Errorf("Unexpected return value: (-want +got)\n%s", d)
+			}
+		})
+	}
+}
+
+func TestReadOnlyHTTP(t *testing.T) {
+	var gotMethods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethods = append(gotMethods, r.Method)
+		fmt.Fprint(w, `"ok"`)
+	}))
+	defer ts.Close()
+
+	pkgs := starlark.StringDict{
+		"http":     ReadOnlyHTTP(NewHTTPModule()),
+		"test_url": starlark.String(ts.URL),
+	}
+	for _, expr := range []string{"http.get(test_url)", "http.get_json(test_url)"} {
+		if _, _, err := util.Eval("http", expr, nil, pkgs); err != nil {
+			t.Errorf("Unexpected error of %s: %v", expr, err)
+		}
+	}
+	for _, method := range []string{"post", "put", "patch", "delete"} {
+		_, _, err := util.Eval("http", fmt.Sprintf("http.%s(test_url)", method), nil, pkgs)
+		want := fmt.Sprintf("<http.%s>: not allowed in read-only mode (--read_only)", method)
+		if err == nil || err.(*starlark.EvalError).Msg != want {
+			t.Errorf("Want error %q, got: %v", want, err)
+		}
+	}
+	if d := cmp.Diff([]string{http.MethodGet, http.MethodGet}, gotMethods); d != "" {
+		t.Errorf("Unexpected requests: (-want +got)\n%s", d)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto" //nolint:staticcheck
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// ProtoRegistry looks up Go types of protobuf messages by their full names
+// (same as registry of skycfg's proto module).
+type ProtoRegistry interface {
+	UnstableProtoMessageType(name string) (reflect.Type, error)
+}
+
+var (
+	quantityType    = reflect.TypeOf(resource.Quantity{})
+	intOrStringType = reflect.TypeOf(intstr.IntOrString{})
+)
+
+// NewProtoModule returns proto module with all built-ins of skycfg's proto
+// module plus `proto.from_dict' that looks up message types in registry.
+func NewProtoModule(skyProto starlark.HasAttrs, registry ProtoRegistry) *isopod.Module {
+	attrs := starlark.StringDict{}
+	for _, n := range skyProto.AttrNames() {
+		v, err := skyProto.Attr(n)
+		if err != nil || v == nil {
+			continue
+		}
+		attrs[n] = v
+	}
+	p := &protoDict{registry: registry}
+	attrs["from_dict"] = starlark.NewBuiltin("proto.from_dict", p.fromDictFn)
+	return &isopod.Module{
+		Name:  "proto",
+		Attrs: attrs,
+	}
+}
+
+type protoDict struct {
+	registry ProtoRegistry
+}
+
+// fromDictFn is an entry point for `proto.from_dict' built-in. Converts
+// nested dict to message of type (full message name or message type):
+//
+//	proto.from_dict("k8s.io.api.apps.v1.Deployment", {"metadata": {"name": "foo"}})
+//
+// Lists and dicts are converted to repeated and map fields and ints and
+// strings to Quantity and IntOrString fields. None values are skipped.
+func (p *protoDict) fromDictFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msgType starlark.Value
+	var d *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "type", &msgType, "value", &d); err != nil {
+		return nil, err
+	}
+
+	var typ reflect.Type
+	switch v := msgType.(type) {
+	case starlark.String:
+		rt, err := p.registry.UnstableProtoMessageType(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		if rt == nil {
+			return nil, fmt.Errorf("<%v>: unknown message type `%s'", b.Name(), string(v))
+		}
+		typ = rt
+	case starlark.Callable:
+		// Message types (e.g `proto.package("k8s.io.api.apps.v1").Deployment')
+		// construct empty messages.
+		empty, err := starlark.Call(t, v, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		msg, ok := skycfg.AsProtoMessage(empty)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: `%s' is not a message type", b.Name(), v)
+		}
+		typ = reflect.TypeOf(msg)
+	default:
+		return nil, fmt.Errorf("<%v>: type must be a message name or type (got: %s)", b.Name(), msgType.Type())
+	}
+
+	msg, err := messageFromDict(typ, d, "")
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return msg, nil
+}
+
+// messageFromDict returns message of typ (pointer to generated struct) with
+// fields set from d. path is the path of d used in errors.
+func messageFromDict(typ reflect.Type, d *starlark.Dict, path string) (starlark.Value, error) {
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s: `%s' is not a message type", displayPath(path), typ)
+	}
+	msg, ok := reflect.New(typ.Elem()).Interface().(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%s: `%s' is not a message type", displayPath(path), typ)
+	}
+	sky := skycfg.NewProtoMessage(msg).(starlark.HasSetField)
+	fields, inline := messageFields(typ.Elem())
+
+	// Fields of embedded messages are inlined in JSON (e.g `httpGet' of
+	// Probe is a field of its embedded Handler), so they are set on the
+	// embedded message.
+	inlined := map[string]*starlark.Dict{}
+	var names []string
+	values := map[string]starlark.Value{}
+	for _, item := range d.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s: field names must be strings (got: %s)", displayPath(path), item[0].Type())
+		}
+		if _, ok := fields[name]; !ok {
+			if embedded, ok := inline[name]; ok {
+				if inlined[embedded] == nil {
+					inlined[embedded] = starlark.NewDict(1)
+					names = append(names, embedded)
+				}
+				if err := inlined[embedded].SetKey(item[0], item[1]); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		names = append(names, name)
+		values[name] = item[1]
+	}
+	for embedded, d := range inlined {
+		if _, ok := values[embedded]; ok {
+			return nil, fmt.Errorf("%s: fields of `%s' are set both inline and in `%s'", displayPath(path), embedded, embedded)
+		}
+		values[embedded] = d
+	}
+
+	for _, name := range names {
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		ft, ok := fields[name]
+		if !ok {
+			return nil, unknownFieldError(fieldPath, sky.Type(), name, fields)
+		}
+		if values[name] == starlark.None {
+			continue
+		}
+		v, err := convertField(ft, values[name], fieldPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := sky.SetField(name, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", fieldPath, err)
+		}
+	}
+	return sky, nil
+}
+
+// messageFields returns Go types of fields of generated message struct t by
+// their protobuf names and names of embedded messages by names of their
+// fields.
+func messageFields(t reflect.Type) (fields map[string]reflect.Type, inline map[string]string) {
+	props := proto.GetProperties(t)
+	fields, inline = map[string]reflect.Type{}, map[string]string{}
+	for _, p := range props.Prop {
+		if p.Tag == 0 {
+			continue
+		}
+		f, ok := t.FieldByName(p.Name)
+		if !ok {
+			continue
+		}
+		fields[p.OrigName] = f.Type
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			embedded, _ := messageFields(f.Type)
+			for n := range embedded {
+				inline[n] = p.OrigName
+			}
+		}
+	}
+	for _, o := range props.OneofTypes {
+		// Oneof fields are wrapped in single-field structs.
+		fields[o.Prop.OrigName] = o.Type.Elem().Field(0).Type
+	}
+	return fields, inline
+}
+
+// convertField converts Starlark value v to a value skycfg can assign to
+// field of Go type t: dicts are converted to messages (recursively, also as
+// items of lists and values of dicts).
+func convertField(t reflect.Type, v starlark.Value, path string) (starlark.Value, error) {
+	switch v := v.(type) {
+	case *starlark.Dict:
+		if mt, ok := messageType(t); ok {
+			return messageFromDict(mt, v, path)
+		}
+		if t.Kind() != reflect.Map {
+			break
+		}
+		out := starlark.NewDict(v.Len())
+		for _, item := range v.Items() {
+			k, _ := starlark.AsString(item[0])
+			elem, err := convertField(t.Elem(), item[1], fmt.Sprintf("%s[%q]", path, k))
+			if err != nil {
+				return nil, err
+			}
+			if err := out.SetKey(item[0], elem); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case *starlark.List:
+		if t.Kind() != reflect.Slice {
+			break
+		}
+		elems := make([]starlark.Value, v.Len())
+		for i := range elems {
+			elem, err := convertField(t.Elem(), v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return starlark.NewList(elems), nil
+	case starlark.String:
+		switch deref(t) {
+		case quantityType:
+			q, err := resource.ParseQuantity(string(v))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid quantity `%s': %v", path, string(v), err)
+			}
+			return skycfg.NewProtoMessage(&q), nil
+		case intOrStringType:
+			s := intstr.FromString(string(v))
+			return skycfg.NewProtoMessage(&s), nil
+		}
+	case starlark.Int:
+		switch deref(t) {
+		case quantityType:
+			i, ok := v.Int64()
+			if !ok {
+				return nil, fmt.Errorf("%s: quantity %v is out of range", path, v)
+			}
+			q := resource.NewQuantity(i, resource.DecimalSI)
+			return skycfg.NewProtoMessage(q), nil
+		case intOrStringType:
+			i, ok := v.Int64()
+			if !ok {
+				return nil, fmt.Errorf("%s: %v is out of range", path, v)
+			}
+			s := intstr.FromInt(int(i))
+			return skycfg.NewProtoMessage(&s), nil
+		}
+	}
+	return v, nil
+}
+
+// messageType returns pointer type of message if t is a (pointer to) message.
+func messageType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() == reflect.Struct {
+		t = reflect.PtrTo(t)
+	}
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	return t, t.Implements(reflect.TypeOf((*proto.Message)(nil)).Elem())
+}
+
+func deref(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "<root>"
+	}
+	return path
+}
+
+// unknownFieldError returns error for unknown field name of message msgType
+// suggesting a field whose name only differs in case or underscores (e.g
+// `image_pull_policy' vs `imagePullPolicy').
+func unknownFieldError(path, msgType, name string, fields map[string]reflect.Type) error {
+	normalize := func(s string) string { return strings.ToLower(strings.Replace(s, "_", "", -1)) }
+	for f := range fields {
+		if normalize(f) == normalize(name) {
+			return fmt.Errorf("%s: `%s' has no field `%s' (did you mean `%s'?)", path, msgType, name, f)
+		}
+	}
+	return fmt.Errorf("%s: `%s' has no field `%s'", path, msgType, name)
+}
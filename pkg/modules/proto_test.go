@@ -0,0 +1,135 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"reflect"
+	"testing"
+
+	gogo_proto "github.com/gogo/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+type gogoRegistry struct{}
+
+func (gogoRegistry) UnstableProtoMessageType(name string) (reflect.Type, error) {
+	return gogo_proto.MessageType(name), nil
+}
+
+func (gogoRegistry) UnstableEnumValueMap(name string) map[string]int32 {
+	return gogo_proto.EnumValueMap(name)
+}
+
+func TestProtoFromDict(t *testing.T) {
+	r := gogoRegistry{}
+	pkgs := starlark.StringDict{
+		"proto": NewProtoModule(skycfg.UnstablePredeclaredModules(r)["proto"].(starlark.HasAttrs), r),
+	}
+	replicas := int32(2)
+
+	for _, tc := range []struct {
+		name, expr string
+		want       interface{}
+		wantErr    string
+	}{
+		{
+			name: "Deployment",
+			expr: `proto.from_dict("k8s.io.api.apps.v1.Deployment", {
+				"metadata": {"name": "foo", "labels": {"app": "foo"}},
+				"spec": {
+					"replicas": 2,
+					"template": {"spec": {"containers": [{
+						"name": "foo",
+						"ports": [{"containerPort": 80}],
+						"resources": {"limits": {"cpu": "100m", "memory": 1024}},
+						"readinessProbe": {"httpGet": {"port": "http"}},
+						"image": None,
+					}]}},
+				},
+			})`,
+			want: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"app": "foo"}},
+				Spec: appsv1.DeploymentSpec{
+					Replicas: &replicas,
+					Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+						Name:  "foo",
+						Ports: []corev1.ContainerPort{{ContainerPort: 80}},
+						Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("100m"),
+							corev1.ResourceMemory: *resource.NewQuantity(1024, resource.DecimalSI),
+						}},
+						ReadinessProbe: &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{
+							Port: intstr.FromString("http"),
+						}}},
+					}}}},
+				},
+			},
+		},
+		{
+			name: "Message type",
+			expr: `proto.from_dict(proto.package("k8s.io.api.core.v1").ConfigMap, value={"data": {"a": "b"}})`,
+			want: &corev1.ConfigMap{Data: map[string]string{"a": "b"}},
+		},
+		{
+			name:    "Unknown field",
+			expr:    `proto.from_dict("k8s.io.api.apps.v1.Deployment", {"spec": {"template": {"spec": {"containers": [{"image_pull_policy": "Always"}]}}}})`,
+			wantErr: "<proto.from_dict>: spec.template.spec.containers[0].image_pull_policy: `k8s.io.api.core.v1.Container' has no field `image_pull_policy' (did you mean `imagePullPolicy'?)",
+		},
+		{
+			name:    "Wrong type",
+			expr:    `proto.from_dict("k8s.io.api.apps.v1.Deployment", {"spec": {"replicas": "2"}})`,
+			wantErr: "<proto.from_dict>: spec.replicas: TypeError: value \"2\" (type `string') can't be assigned to type `*int32'.",
+		},
+		{
+			name:    "Invalid quantity",
+			expr:    `proto.from_dict("k8s.io.api.core.v1.ResourceRequirements", {"requests": {"cpu": "a lot"}})`,
+			wantErr: "<proto.from_dict>: requests[\"cpu\"]: invalid quantity `a lot': quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
+		},
+		{
+			name:    "Unknown message type",
+			expr:    `proto.from_dict("k8s.io.api.apps.v1.Foo", {})`,
+			wantErr: "<proto.from_dict>: unknown message type `k8s.io.api.apps.v1.Foo'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Unexpected error.\nWant: %s\nGot: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := skycfg.AsProtoMessage(v)
+			if !ok {
+				t.Fatalf("Want proto message, got: %v", v)
+			}
+			if d := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b resource.Quantity) bool { return a.Cmp(b) == 0 })); d != "" {
+				t.Errorf("Unexpected message (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
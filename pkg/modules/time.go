@@ -0,0 +1,158 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// Clock is the source of time of the time module and of `sleep'.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// RealClock is the wall clock.
+var RealClock Clock = realClock{}
+
+// FakeClock is a virtual Clock for tests. Sleep returns immediately,
+// advancing the clock by the duration slept, which is recorded.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep implements Clock.
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+// Advance moves the clock forward by d without recording a sleep.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sleeps returns durations slept since the clock was created or reset.
+func (c *FakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// Reset sets the clock to now and forgets recorded sleeps.
+func (c *FakeClock) Reset(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	c.sleeps = nil
+}
+
+// NewTimeModule returns a time module reading time from c.
+func NewTimeModule(c Clock) *isopod.Module {
+	return &isopod.Module{
+		Name: "time",
+		Attrs: starlark.StringDict{
+			"now":            starlark.NewBuiltin("time.now", timeNowFn(c)),
+			"format":         starlark.NewBuiltin("time.format", timeFormatFn),
+			"parse_duration": starlark.NewBuiltin("time.parse_duration", timeParseDurationFn),
+		},
+	}
+}
+
+// NewSleepBuiltin returns the `sleep' built-in sleeping on c.
+func NewSleepBuiltin(c Clock) *starlark.Builtin {
+	return starlark.NewBuiltin("sleep", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var dur string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &dur); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: can not parse duration string `%s': %v", b.Name(), dur, err)
+		}
+		c.Sleep(d)
+		return starlark.None, nil
+	})
+}
+
+// timeNowFn returns the `time.now' built-in returning the current time of c
+// as seconds since the Unix epoch.
+func timeNowFn(c Clock) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+			return nil, err
+		}
+		return starlark.Float(float64(c.Now().UnixNano()) / float64(time.Second)), nil
+	}
+}
+
+// timeFormatFn is the `time.format' built-in formatting seconds since the
+// Unix epoch in UTC with a Go layout (RFC 3339 by default).
+func timeFormatFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var secs starlark.Value
+	layout := time.RFC3339
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "secs", &secs, "layout?", &layout); err != nil {
+		return nil, err
+	}
+	f, ok := starlark.AsFloat(secs)
+	if !ok {
+		return nil, fmt.Errorf("<%v>: expected int or float seconds, got: %s", b.Name(), secs.Type())
+	}
+	ts := time.Unix(0, int64(f*float64(time.Second))).UTC()
+	return starlark.String(ts.Format(layout)), nil
+}
+
+// timeParseDurationFn is the `time.parse_duration' built-in returning
+// duration string (e.g `5m') in seconds.
+func timeParseDurationFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var dur string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &dur); err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(dur)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: can not parse duration string `%s': %v", b.Name(), dur, err)
+	}
+	return starlark.Float(d.Seconds()), nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestTime(t *testing.T) {
+	start := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	for _, tc := range []struct {
+		name, expr string
+		want       string
+		wantSleeps []time.Duration
+		wantErr    string
+	}{
+		{
+			name: "Now",
+			expr: `time.format(time.now())`,
+			want: `"2021-03-04T05:06:07Z"`,
+		},
+		{
+			name:       "Sleep advances clock",
+			expr:       `[sleep("5m"), sleep("1s"), time.format(time.now(), "15:04:05")][-1]`,
+			want:       `"05:11:08"`,
+			wantSleeps: []time.Duration{5 * time.Minute, time.Second},
+		},
+		{
+			name: "Parse duration",
+			expr: `time.now() + time.parse_duration("1h30m") - time.now()`,
+			want: "5400",
+		},
+		{
+			name:    "Invalid duration",
+			expr:    `sleep("5 minutes")`,
+			wantErr: "<sleep>: can not parse duration string `5 minutes': time: unknown unit \" minutes\" in duration \"5 minutes\"",
+		},
+		{
+			name:    "Invalid time",
+			expr:    `time.format("now")`,
+			wantErr: "<time.format>: expected int or float seconds, got: string",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewFakeClock(start)
+			pkgs := starlark.StringDict{
+				"time":  NewTimeModule(c),
+				"sleep": NewSleepBuiltin(c),
+			}
+			got, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if tc.wantErr != "" {
+				return
+			}
+			if got.String() != tc.want {
+				t.Errorf("Unexpected result.\nWant: %s\nGot: %s", tc.want, got)
+			}
+			if d := cmp.Diff(tc.wantSleeps, c.Sleeps()); d != "" {
+				t.Errorf("Unexpected sleeps (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -15,11 +15,14 @@
 package modules
 
 import (
+	"fmt"
+
 	"github.com/google/uuid"
 
 	"go.starlark.net/starlark"
 
 	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
 )
 
 var (
@@ -49,8 +52,16 @@ func uuidGenerateV3Fn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 	return starlark.String(result.String()), nil
 }
 
-// uuidGenerateV4Fn is a built-in to generate type 4 UUID.
+// uuidGenerateV4Fn is a built-in to generate type 4 UUID. It is drawn from
+// the deterministic source of the thread in test and dry run modes.
 func uuidGenerateV4Fn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if r := addon.RandFromThread(t); r != nil {
+		u, err := uuid.NewRandomFromReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		return starlark.String(u.String()), nil
+	}
 	return starlark.String(uuid.New().String()), nil
 }
 
@@ -22,6 +22,7 @@ import (
 
 	"go.starlark.net/starlark"
 
+	"github.com/cruise-automation/isopod/pkg/addon"
 	util "github.com/cruise-automation/isopod/pkg/testing"
 )
 
@@ -104,3 +105,26 @@ func TestUUIDErrorCase(t *testing.T) {
 		})
 	}
 }
+
+func TestUUIDV4Seeded(t *testing.T) {
+	pkgs := starlark.StringDict{"uuid": NewUUIDModule()}
+	uuidgen := func(seed string) string {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.RandKey, addon.NewRand(seed))
+		v, err := starlark.Eval(thread, "uuid", "uuid.v4()", pkgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(v.(starlark.String))
+	}
+	first := uuidgen("minikube/ingress")
+	if match, _ := regexp.MatchString(uuidRegex, first); !match {
+		t.Errorf("Result does not match UUID regex: %s", first)
+	}
+	if second := uuidgen("minikube/ingress"); first != second {
+		t.Errorf("Expect same UUID with the same seed, got %s and %s", first, second)
+	}
+	if other := uuidgen("prod/ingress"); first == other {
+		t.Errorf("Expect different UUIDs with different seeds, got %s", other)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify implements Slack and generic webhook notifications for
+// rollout lifecycle events.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+)
+
+// Trigger is a rollout lifecycle event a target may be notified on.
+type Trigger string
+
+const (
+	// Start is triggered when rollout starts on a cluster.
+	Start Trigger = "start"
+	// Success is triggered when rollout succeeds on a cluster.
+	Success Trigger = "success"
+	// Failure is triggered when rollout fails on a cluster.
+	Failure Trigger = "failure"
+	// Complete is triggered once rollout to all clusters finished.
+	Complete Trigger = "complete"
+)
+
+// DefaultTriggers are used when target doesn't specify any.
+var DefaultTriggers = []Trigger{Failure, Complete}
+
+// maxErrorLen is the length error messages are truncated to.
+const maxErrorLen = 500
+
+// ParseTriggers parses a list of trigger names.
+func ParseTriggers(names []string) (map[Trigger]bool, error) {
+	ret := map[Trigger]bool{}
+	for _, n := range names {
+		switch t := Trigger(strings.TrimSpace(n)); t {
+		case Start, Success, Failure, Complete:
+			ret[t] = true
+		default:
+			return nil, fmt.Errorf("unknown notification trigger `%s'", n)
+		}
+	}
+	if len(ret) == 0 {
+		for _, t := range DefaultTriggers {
+			ret[t] = true
+		}
+	}
+	return ret, nil
+}
+
+// Target is a notification destination. Exactly one of SlackWebhook or
+// Webhook is set.
+type Target struct {
+	// SlackWebhook is the URL of a Slack incoming webhook.
+	SlackWebhook string
+	// Webhook is the URL generic JSON Message is posted to.
+	Webhook string
+	On      map[Trigger]bool
+}
+
+// Message describes a rollout lifecycle event.
+type Message struct {
+	Trigger   Trigger  `json:"trigger"`
+	EntryFile string   `json:"entryfile"`
+	Command   string   `json:"command"`
+	Cluster   string   `json:"cluster,omitempty"`
+	RolloutID string   `json:"rollout_id,omitempty"`
+	Addons    []string `json:"addons,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	// Succeeded and Failed are clusters that completed rollout (only set
+	// for Complete trigger).
+	Succeeded []string `json:"succeeded,omitempty"`
+	Failed    []string `json:"failed,omitempty"`
+	// Text is the human-readable summary of the message.
+	Text string `json:"text"`
+}
+
+// Notifier posts Messages to its targets.
+type Notifier struct {
+	entryFile, command string
+	client             *http.Client
+
+	mu                sync.Mutex
+	targets           []*Target
+	succeeded, failed []string
+}
+
+// New returns a new *Notifier for rollout of command for entryFile.
+func New(entryFile, command string) *Notifier {
+	return &Notifier{
+		entryFile: entryFile,
+		command:   command,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// AddTarget adds t to the notifier targets. Duplicate targets are ignored.
+func (n *Notifier) AddTarget(t *Target) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range n.targets {
+		if e.SlackWebhook == t.SlackWebhook && e.Webhook == t.Webhook {
+			for tr := range t.On {
+				e.On[tr] = true
+			}
+			return
+		}
+	}
+	n.targets = append(n.targets, t)
+}
+
+// Builtin returns `notify' Starlark built-in that adds targets to n:
+//
+//	notify(slack_webhook="https://hooks.slack.com/...", on=["failure", "complete"])
+func (n *Notifier) Builtin() *starlark.Builtin {
+	return starlark.NewBuiltin("notify", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var slack, webhook string
+		var on *starlark.List
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+			"slack_webhook?", &slack,
+			"webhook?", &webhook,
+			"on?", &on,
+		); err != nil {
+			return nil, err
+		}
+		if (slack == "") == (webhook == "") {
+			return nil, fmt.Errorf("%s: exactly one of `slack_webhook' or `webhook' must be set", b.Name())
+		}
+
+		var names []string
+		if on != nil {
+			for i := 0; i < on.Len(); i++ {
+				s, ok := on.Index(i).(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `on' must be a list of strings (got a `%s')", b.Name(), on.Index(i).Type())
+				}
+				names = append(names, string(s))
+			}
+		}
+		triggers, err := ParseTriggers(names)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+
+		n.AddTarget(&Target{SlackWebhook: slack, Webhook: webhook, On: triggers})
+		return starlark.None, nil
+	})
+}
+
+// Notify posts m to all targets subscribed to m.Trigger. Cluster outcomes are
+// recorded for the Complete message.
+func (n *Notifier) Notify(ctx context.Context, m *Message) {
+	n.mu.Lock()
+	switch m.Trigger {
+	case Success:
+		n.succeeded = append(n.succeeded, m.Cluster)
+	case Failure:
+		n.failed = append(n.failed, m.Cluster)
+	}
+	targets := append([]*Target(nil), n.targets...)
+	n.mu.Unlock()
+
+	m.EntryFile, m.Command = n.entryFile, n.command
+	if len(m.Error) > maxErrorLen {
+		m.Error = m.Error[:maxErrorLen] + "..."
+	}
+	m.Text = text(m)
+
+	for _, t := range targets {
+		if !t.On[m.Trigger] {
+			continue
+		}
+		if err := n.post(ctx, t, m); err != nil {
+			log.Errorf("Failed to send `%s' notification: %v", m.Trigger, err)
+		}
+	}
+}
+
+// Complete posts the Complete message summarizing all cluster outcomes.
+func (n *Notifier) Complete(ctx context.Context, err error) {
+	n.mu.Lock()
+	m := &Message{
+		Trigger:   Complete,
+		Succeeded: append([]string(nil), n.succeeded...),
+		Failed:    append([]string(nil), n.failed...),
+	}
+	n.mu.Unlock()
+	if err != nil {
+		m.Error = err.Error()
+	}
+	n.Notify(ctx, m)
+}
+
+func text(m *Message) string {
+	subject := fmt.Sprintf("Isopod `%s` of `%s`", m.Command, m.EntryFile)
+	if m.RolloutID != "" {
+		subject += fmt.Sprintf(" (rollout `%s`)", m.RolloutID)
+	}
+
+	var s string
+	switch m.Trigger {
+	case Start:
+		s = fmt.Sprintf(":rocket: %s started on cluster `%s`", subject, m.Cluster)
+	case Success:
+		s = fmt.Sprintf(":white_check_mark: %s succeeded on cluster `%s`", subject, m.Cluster)
+	case Failure:
+		s = fmt.Sprintf(":x: %s failed on cluster `%s`", subject, m.Cluster)
+	case Complete:
+		icon := ":checkered_flag:"
+		if len(m.Failed) > 0 || m.Error != "" {
+			icon = ":warning:"
+		}
+		s = fmt.Sprintf("%s %s complete: %d clusters succeeded, %d failed", icon, subject, len(m.Succeeded), len(m.Failed))
+		if len(m.Failed) > 0 {
+			s += fmt.Sprintf(" (%s)", strings.Join(m.Failed, ", "))
+		}
+	}
+	if len(m.Addons) > 0 {
+		s += fmt.Sprintf("\nAddons: %s", strings.Join(m.Addons, ", "))
+	}
+	if m.Error != "" {
+		s += fmt.Sprintf("\n```%s```", m.Error)
+	}
+	return s
+}
+
+func (n *Notifier) post(ctx context.Context, t *Target, m *Message) error {
+	endpoint := t.Webhook
+	var body interface{} = m
+	if t.SlackWebhook != "" {
+		endpoint = t.SlackWebhook
+		body = map[string]string{"text": m.Text}
+	}
+
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if ue, ok := err.(*url.Error); ok {
+		// Webhook URLs embed credentials so keep them out of logs.
+		return ue.Err
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestBuiltin(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		expr        string
+		wantErr     error
+		wantTargets int
+	}{
+		{
+			name:        "slack with default triggers",
+			expr:        `notify(slack_webhook="https://hooks.slack.com/x")`,
+			wantTargets: 1,
+		},
+		{
+			name:        "webhook",
+			expr:        `notify(webhook="https://example.com", on=["start", "complete"])`,
+			wantTargets: 1,
+		},
+		{
+			name:    "no target",
+			expr:    `notify(on=["failure"])`,
+			wantErr: errors.New("notify: exactly one of `slack_webhook' or `webhook' must be set"),
+		},
+		{
+			name:    "unknown trigger",
+			expr:    `notify(webhook="https://example.com", on=["never"])`,
+			wantErr: errors.New("notify: unknown notification trigger `never'"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n := New("main.ipd", "install")
+			pkgs := starlark.StringDict{"notify": n.Builtin()}
+			_, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if len(n.targets) != tc.wantTargets {
+				t.Errorf("Expected %d targets, got %d", tc.wantTargets, len(n.targets))
+			}
+		})
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var mu sync.Mutex
+	var slackTexts []string
+	var webhookMsgs []*Message
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/slack":
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			slackTexts = append(slackTexts, body["text"])
+		case "/webhook":
+			m := &Message{}
+			json.NewDecoder(r.Body).Decode(m)
+			webhookMsgs = append(webhookMsgs, m)
+		}
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	n := New("main.ipd", "install")
+	n.AddTarget(&Target{SlackWebhook: s.URL + "/slack", On: map[Trigger]bool{Failure: true, Complete: true}})
+	n.AddTarget(&Target{Webhook: s.URL + "/webhook", On: map[Trigger]bool{Start: true}})
+	// Duplicate is merged.
+	n.AddTarget(&Target{Webhook: s.URL + "/webhook", On: map[Trigger]bool{Success: true}})
+
+	n.Notify(ctx, &Message{Trigger: Start, Cluster: "minikube", Addons: []string{"ingress"}})
+	n.Notify(ctx, &Message{Trigger: Success, Cluster: "minikube", RolloutID: "rollout-1"})
+	n.Notify(ctx, &Message{Trigger: Failure, Cluster: "paas-dev", Error: strings.Repeat("x", 1000)})
+	n.Complete(ctx, nil)
+
+	if len(webhookMsgs) != 2 {
+		t.Fatalf("Expected 2 webhook messages, got %d", len(webhookMsgs))
+	}
+	if m := webhookMsgs[0]; m.Trigger != Start || m.EntryFile != "main.ipd" || m.Cluster != "minikube" {
+		t.Errorf("Unexpected start message: %+v", m)
+	}
+
+	if len(slackTexts) != 2 {
+		t.Fatalf("Expected 2 Slack messages, got %d: %v", len(slackTexts), slackTexts)
+	}
+	if got := slackTexts[0]; !strings.Contains(got, "failed on cluster `paas-dev`") || len(got) > maxErrorLen+200 {
+		t.Errorf("Unexpected failure message: %s", got)
+	}
+	if got := slackTexts[1]; !strings.Contains(got, "1 clusters succeeded, 1 failed (paas-dev)") {
+		t.Errorf("Unexpected complete message: %s", got)
+	}
+}
+
+func TestNotifyRedactsURL(t *testing.T) {
+	n := New("main.ipd", "install")
+	err := n.post(context.Background(), &Target{SlackWebhook: "http://127.0.0.1:0/secret-token"}, &Message{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("Error leaks webhook URL: %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/secretref"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// ErrDrift is returned when live state of the cluster no longer matches the
+// state observed when the plan was computed.
+var ErrDrift = errors.New("live state drifted since plan was computed")
+
+// Policy restricts objects that may be mutated (e.g *kube.Policy).
+type Policy interface {
+	// Check returns an error if mutating object of gvk named name in
+	// namespace (empty for cluster-scoped objects) is not allowed.
+	Check(gvk schema.GroupVersionKind, name, namespace string) error
+}
+
+// Applier executes planned mutations against a single cluster.
+type Applier struct {
+	dClient   discovery.DiscoveryInterface
+	dynClient dynamic.Interface
+	resolver  secretref.Resolver
+	// store records applied addons as a rollout (nil if not recorded).
+	store store.Store
+	// policy restricts mutated objects (nil if unrestricted).
+	policy Policy
+}
+
+// NewApplier returns a new *Applier talking to the cluster via d and dynC.
+// Secret references in planned objects are resolved with res.
+func NewApplier(d discovery.DiscoveryInterface, dynC dynamic.Interface, res secretref.Resolver) *Applier {
+	return &Applier{dClient: d, dynClient: dynC, resolver: res}
+}
+
+// SetStore makes Apply record addons of applied plans as a rollout in st
+// like install does.
+func (a *Applier) SetStore(st store.Store) {
+	a.store = st
+}
+
+// SetPolicy makes Apply refuse plans mutating objects p doesn't allow, as
+// plan files may be edited after they were computed.
+func (a *Applier) SetPolicy(p Policy) {
+	a.policy = p
+}
+
+// checkPolicy returns an error if policy of a doesn't allow any of
+// mutations of c.
+func (a *Applier) checkPolicy(c *Cluster) error {
+	if a.policy == nil {
+		return nil
+	}
+	for _, m := range c.Mutations {
+		if err := a.policy.Check(m.GroupVersionKind(), m.Name, m.Namespace); err != nil {
+			return fmt.Errorf("failed to %v: %w", m, err)
+		}
+	}
+	return nil
+}
+
+func objKey(m *Mutation) string {
+	return m.GroupVersionKind().GroupKind().String() + ":" + m.Namespace + "/" + m.Name
+}
+
+// resourceFor returns a client for the resource of the mutation. Returns
+// *meta.NoKindMatchError if the kind is not served by the cluster.
+func (a *Applier) resourceFor(m *Mutation) (dynamic.ResourceInterface, error) {
+	gvr := schema.GroupVersionResource{Group: m.Group, Version: m.Version, Resource: m.Resource}
+	namespace := m.Namespace
+	if m.Resource == "" {
+		gr, err := restmapper.GetAPIGroupResources(a.dClient)
+		if err != nil {
+			return nil, err
+		}
+		gvk := m.GroupVersionKind()
+		mapping, err := restmapper.NewDiscoveryRESTMapper(gr).RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, err
+		}
+		gvr = mapping.Resource
+		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+			namespace = ""
+		}
+	}
+
+	c := a.dynClient.Resource(gvr)
+	if namespace != "" {
+		return c.Namespace(namespace), nil
+	}
+	return c, nil
+}
+
+// liveResourceVersion returns resource version of the live object (empty if
+// the object doesn't exist).
+func (a *Applier) liveResourceVersion(ctx context.Context, m *Mutation) (string, error) {
+	c, err := a.resourceFor(m)
+	if meta.IsNoMatchError(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	live, err := c.Get(ctx, m.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return live.GetResourceVersion(), nil
+}
+
+// Verify checks that live state of every object mutated by the plan matches
+// the state observed when the plan was computed. Returns error wrapping
+// ErrDrift on mismatch.
+func (a *Applier) Verify(ctx context.Context, c *Cluster) error {
+	// Objects deleted by the plan are expected to be absent for any
+	// subsequent mutations.
+	deleted := map[string]bool{}
+	for _, m := range c.Mutations {
+		want := m.LiveResourceVersion
+		if deleted[objKey(m)] {
+			want = ""
+		}
+
+		got, err := a.liveResourceVersion(ctx, m)
+		if err != nil {
+			return fmt.Errorf("failed to read live state for %v: %v", m, err)
+		}
+		if m.Action == DeleteAction {
+			deleted[objKey(m)] = true
+		} else {
+			delete(deleted, objKey(m))
+		}
+
+		if got == want {
+			continue
+		}
+		switch {
+		case want == "":
+			return fmt.Errorf("%v: object was created: %w", m, ErrDrift)
+		case got == "":
+			return fmt.Errorf("%v: object was deleted: %w", m, ErrDrift)
+		default:
+			return fmt.Errorf("%v: resourceVersion changed from %s to %s: %w", m, want, got, ErrDrift)
+		}
+	}
+	return nil
+}
+
+// Apply verifies that the live state has not drifted and executes all
+// mutations planned for cluster c in order. Mutations of an object already
+// mutated by the plan are preconditioned on the resource version returned by
+// the previous one rather than the one observed at plan time.
+func (a *Applier) Apply(ctx context.Context, c *Cluster) error {
+	if err := a.checkPolicy(c); err != nil {
+		return err
+	}
+	if err := a.Verify(ctx, c); err != nil {
+		return err
+	}
+
+	var rollout *store.Rollout
+	if a.store != nil {
+		var err error
+		if rollout, err = a.store.CreateRollout(); err != nil {
+			return fmt.Errorf("failed to initilize rollout state: %v", err)
+		}
+		fmt.Printf("Beginning rollout [%v] apply...\n", rollout.ID)
+	}
+
+	// versions are resource versions of objects mutated so far (empty if
+	// deleted).
+	versions := map[string]string{}
+	var run *store.AddonRun
+	putRun := func() error {
+		if rollout == nil || run == nil {
+			return nil
+		}
+		if _, err := a.store.PutAddonRun(rollout.ID, run); err != nil {
+			return fmt.Errorf("failed to store run state for `%s' addon: %v", run.Name, err)
+		}
+		return nil
+	}
+	for _, m := range c.Mutations {
+		if run == nil || run.Name != m.Addon {
+			if err := putRun(); err != nil {
+				return err
+			}
+			run = &store.AddonRun{Name: m.Addon}
+		}
+
+		rv, ok := versions[objKey(m)]
+		if !ok {
+			rv = m.LiveResourceVersion
+		}
+		newRV, err := a.applyMutation(ctx, m, rv)
+		if err != nil {
+			return fmt.Errorf("failed to %v: %v", m, err)
+		}
+		versions[objKey(m)] = newRV
+		if m.Action == PutAction {
+			run.ObjRefs = putObjRef(run.ObjRefs, m, newRV)
+		}
+	}
+	if err := putRun(); err != nil {
+		return err
+	}
+
+	if rollout != nil {
+		if err := a.store.CompleteRollout(rollout.ID); err != nil {
+			return fmt.Errorf("failed to commit `live' rollout state: %v", err)
+		}
+		fmt.Printf("Rollout [%v] is live!\n", rollout.ID)
+	}
+	return nil
+}
+
+// putObjRef adds reference to the object put by m at resource version rv to
+// refs (or updates its resource version if already there).
+func putObjRef(refs []store.ObjRef, m *Mutation, rv string) []store.ObjRef {
+	ref := store.ObjRef{
+		APIVersion:      schema.GroupVersion{Group: m.Group, Version: m.Version}.String(),
+		Kind:            m.Kind,
+		Namespace:       m.Namespace,
+		Name:            m.Name,
+		ResourceVersion: rv,
+	}
+	for i := range refs {
+		if refs[i].SameObject(ref) {
+			refs[i] = ref
+			return refs
+		}
+	}
+	return append(refs, ref)
+}
+
+// applyMutation executes m preconditioned on resource version rv of the
+// object (empty if it doesn't exist) so that changes racing with the apply
+// are detected. Returns resource version of the object after m (empty if
+// deleted).
+func (a *Applier) applyMutation(ctx context.Context, m *Mutation, rv string) (string, error) {
+	c, err := a.resourceFor(m)
+	if err != nil {
+		return "", err
+	}
+
+	switch m.Action {
+	case PutAction:
+		// Plans only contain secret references so they're resolved last.
+		obj := (&unstructured.Unstructured{Object: m.Object}).DeepCopy()
+		if err := secretref.ExpandObject(ctx, a.resolver, obj.Object); err != nil {
+			return "", err
+		}
+		if rv == "" {
+			obj, err = c.Create(ctx, obj, metav1.CreateOptions{})
+		} else {
+			obj.SetResourceVersion(rv)
+			var subresources []string
+			if m.Subresource != "" {
+				subresources = append(subresources, m.Subresource)
+			}
+			obj, err = c.Update(ctx, obj, metav1.UpdateOptions{}, subresources...)
+		}
+		if err == nil {
+			rv = obj.GetResourceVersion()
+		}
+	case DeleteAction:
+		opts := metav1.DeleteOptions{}
+		if m.PropagationPolicy != "" {
+			p := metav1.DeletionPropagation(m.PropagationPolicy)
+			opts.PropagationPolicy = &p
+		}
+		opts.GracePeriodSeconds = m.GracePeriodSeconds
+		if rv != "" || m.UID != "" {
+			opts.Preconditions = &metav1.Preconditions{}
+		}
+		if rv != "" {
+			opts.Preconditions.ResourceVersion = &rv
+		}
+		if m.UID != "" {
+			uid := types.UID(m.UID)
+			opts.Preconditions.UID = &uid
+		}
+		err = c.Delete(ctx, m.Name, opts)
+		rv = ""
+	default:
+		return "", fmt.Errorf("unknown action `%s'", m.Action)
+	}
+	if apierrors.IsConflict(err) {
+		return "", fmt.Errorf("%v: %w", err, ErrDrift)
+	} else if err != nil {
+		return "", err
+	}
+
+	log.Infof("%v done", m)
+	return rv, nil
+}
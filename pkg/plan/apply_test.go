@@ -0,0 +1,238 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// fakeConfigMaps serves ConfigMaps in namespace default, bumping resource
+// version of each write and rejecting updates of stale versions.
+func fakeConfigMaps() *httptest.Server {
+	var mu sync.Mutex
+	objs := map[string]map[string]interface{}{}
+	var rv int
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		status := func(code int, reason string) {
+			w.WriteHeader(code)
+			fmt.Fprintf(w, `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": %q, "code": %d}`, reason, code)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/default/configmaps"), "/"), "/status")
+		var obj map[string]interface{}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&obj)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if objs[name] == nil {
+				status(http.StatusNotFound, "NotFound")
+				return
+			}
+			json.NewEncoder(w).Encode(objs[name])
+			return
+		case http.MethodPost:
+			name = obj["metadata"].(map[string]interface{})["name"].(string)
+			if objs[name] != nil {
+				status(http.StatusConflict, "AlreadyExists")
+				return
+			}
+		case http.MethodPut:
+			if objs[name] == nil {
+				status(http.StatusNotFound, "NotFound")
+				return
+			}
+			got := obj["metadata"].(map[string]interface{})["resourceVersion"]
+			if got != objs[name]["metadata"].(map[string]interface{})["resourceVersion"] {
+				status(http.StatusConflict, "Conflict")
+				return
+			}
+		}
+		rv++
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = fmt.Sprint(rv)
+		objs[name] = obj
+		json.NewEncoder(w).Encode(obj)
+	}))
+}
+
+// memStore is a store.Store keeping rollouts in memory.
+type memStore struct {
+	rollouts []*store.Rollout
+}
+
+func (s *memStore) CreateRollout() (*store.Rollout, error) {
+	r := &store.Rollout{ID: store.RolloutID(fmt.Sprint(len(s.rollouts)))}
+	s.rollouts = append(s.rollouts, r)
+	return r, nil
+}
+
+func (s *memStore) PutAddonRun(id store.RolloutID, a *store.AddonRun) (store.RunID, error) {
+	r, _, _ := s.GetRollout(id)
+	r.Addons = append(r.Addons, a)
+	return store.RunID(a.Name), nil
+}
+
+func (s *memStore) CompleteRollout(id store.RolloutID) error {
+	r, _, _ := s.GetRollout(id)
+	r.Live = true
+	return nil
+}
+
+func (s *memStore) GetLive() (*store.Rollout, bool, error) {
+	for _, r := range s.rollouts {
+		if r.Live {
+			return r, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *memStore) GetRollout(id store.RolloutID) (*store.Rollout, bool, error) {
+	for _, r := range s.rollouts {
+		if r.ID == id {
+			return r, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func configMapPut(addon, subresource, data string) *Mutation {
+	return &Mutation{
+		Action:      PutAction,
+		Addon:       addon,
+		Version:     "v1",
+		Kind:        "ConfigMap",
+		Resource:    "configmaps",
+		Subresource: subresource,
+		Namespace:   "default",
+		Name:        "cm",
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "cm", "namespace": "default"},
+			"data":       map[string]interface{}{"k": data},
+		},
+	}
+}
+
+// denyObjects is a Policy denying objects of its names.
+type denyObjects []string
+
+var errDenied = errors.New("denied")
+
+func (d denyObjects) Check(_ schema.GroupVersionKind, name, _ string) error {
+	for _, n := range d {
+		if n == name {
+			return errDenied
+		}
+	}
+	return nil
+}
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		muts     []*Mutation
+		policy   Policy
+		wantErr  error
+		wantRefs map[string][]store.ObjRef
+	}{
+		{
+			name: "Object put twice",
+			muts: []*Mutation{
+				configMapPut("a", "", "1"),
+				configMapPut("a", "status", "2"),
+				configMapPut("b", "", "3"),
+			},
+			wantRefs: map[string][]store.ObjRef{
+				"a": {{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm", ResourceVersion: "2"}},
+				"b": {{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm", ResourceVersion: "3"}},
+			},
+		},
+		{
+			name: "Drift",
+			muts: []*Mutation{
+				func() *Mutation {
+					m := configMapPut("a", "", "1")
+					m.LiveResourceVersion = "7"
+					return m
+				}(),
+			},
+			wantErr: ErrDrift,
+		},
+		{
+			name:     "Allowed by policy",
+			muts:     []*Mutation{configMapPut("a", "", "1")},
+			policy:   denyObjects{"other"},
+			wantRefs: map[string][]store.ObjRef{"a": {{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm", ResourceVersion: "1"}}},
+		},
+		{
+			name:    "Denied by policy",
+			muts:    []*Mutation{configMapPut("a", "", "1")},
+			policy:  denyObjects{"cm"},
+			wantErr: errDenied,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := fakeConfigMaps()
+			defer s.Close()
+			dynC, err := dynamic.NewForConfig(&rest.Config{Host: s.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := &memStore{}
+			a := NewApplier(nil, dynC, nil)
+			a.SetStore(st)
+			a.SetPolicy(tc.policy)
+
+			err = a.Apply(context.Background(), &Cluster{Name: "test", Mutations: tc.muts})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+
+			live, ok, _ := st.GetLive()
+			if !ok {
+				t.Fatal("No live rollout recorded")
+			}
+			gotRefs := map[string][]store.ObjRef{}
+			for _, run := range live.Addons {
+				gotRefs[run.Name] = run.ObjRefs
+			}
+			if !reflect.DeepEqual(gotRefs, tc.wantRefs) {
+				t.Errorf("Unexpected rollout objects.\nWant: %v\nGot: %v", tc.wantRefs, gotRefs)
+			}
+		})
+	}
+}
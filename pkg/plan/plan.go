@@ -0,0 +1,182 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plan implements recording of intended Kubernetes mutations into a
+// deterministic plan file and executing such plan against live clusters.
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// FormatVersion is the version of the plan file format. Plans written with a
+// different format version are rejected by ReadFile.
+const FormatVersion = 1
+
+// Action is the type of a recorded mutation.
+type Action string
+
+const (
+	// PutAction creates or updates an object.
+	PutAction Action = "put"
+	// DeleteAction deletes an object.
+	DeleteAction Action = "delete"
+)
+
+// Mutation is a single intended change to a Kubernetes object.
+type Mutation struct {
+	Action Action `json:"action"`
+	// Addon is the name of the addon that requested the mutation.
+	Addon string `json:"addon"`
+
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+	// Resource is the plural resource name. It may be empty if the kind was
+	// not served by the cluster at plan time (e.g its CRD is created by the
+	// same plan), in which case it is discovered during apply.
+	Resource    string `json:"resource,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+
+	// LiveResourceVersion is .metadata.resourceVersion of the live object
+	// observed at plan time. Empty if the object did not exist.
+	LiveResourceVersion string `json:"liveResourceVersion,omitempty"`
+
+	// Object is the fully rendered object (only set for PutAction).
+	Object map[string]interface{} `json:"object,omitempty"`
+
+	// PropagationPolicy is the deletion propagation policy (only set for
+	// DeleteAction).
+	PropagationPolicy string `json:"propagationPolicy,omitempty"`
+	// GracePeriodSeconds is the deletion grace period (only set for
+	// DeleteAction).
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
+	// UID is the UID precondition of deletion (only set for DeleteAction).
+	UID string `json:"uid,omitempty"`
+}
+
+// GroupVersionKind returns schema.GroupVersionKind of the mutated object.
+func (m *Mutation) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: m.Group, Version: m.Version, Kind: m.Kind}
+}
+
+// String returns human-readable description of the mutation.
+func (m *Mutation) String() string {
+	name := m.Name
+	if m.Namespace != "" {
+		name = m.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s `%s'", m.Action, m.GroupVersionKind().String(), name)
+}
+
+// Cluster is a set of mutations intended for a single target cluster.
+type Cluster struct {
+	// Name is the value of the `cluster' field of the target cluster.
+	Name      string      `json:"name"`
+	Mutations []*Mutation `json:"mutations"`
+}
+
+// Plan is the full set of intended mutations across all target clusters.
+type Plan struct {
+	FormatVersion int `json:"formatVersion"`
+	// EntryFile is the absolute path to the main Starlark entry file the
+	// plan was computed from.
+	EntryFile string `json:"entryFile"`
+	// Context is the set of --context parameters used to compute the plan.
+	Context  map[string]string `json:"context,omitempty"`
+	Clusters []*Cluster        `json:"clusters"`
+}
+
+// WriteFile serializes the plan to path. The output only depends on the
+// contents of the plan so the same set of intended mutations always produces
+// the same file.
+// Plan contains fully rendered objects (including Secret data) so the file is
+// only readable by its owner.
+func (p *Plan) WriteFile(path string) error {
+	bs, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %v", err)
+	}
+	return ioutil.WriteFile(path, append(bs, '\n'), 0600)
+}
+
+// ReadFile reads plan previously written by WriteFile from path.
+func ReadFile(path string) (*Plan, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{}
+	if err := json.Unmarshal(bs, p); err != nil {
+		return nil, fmt.Errorf("failed to parse plan file `%s': %v", path, err)
+	}
+	if p.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported plan format version %d (want %d)", p.FormatVersion, FormatVersion)
+	}
+	return p, nil
+}
+
+// Recorder accumulates mutations into a Plan while addons are evaluated.
+// Recorder is not safe for concurrent use.
+type Recorder struct {
+	plan    *Plan
+	cluster *Cluster
+	addon   string
+}
+
+// NewRecorder returns a new *Recorder for a plan computed from entryFile with
+// userCtx parameters.
+func NewRecorder(entryFile string, userCtx map[string]string) *Recorder {
+	return &Recorder{
+		plan: &Plan{
+			FormatVersion: FormatVersion,
+			EntryFile:     entryFile,
+			Context:       userCtx,
+		},
+	}
+}
+
+// BeginCluster starts recording mutations for the named cluster.
+func (r *Recorder) BeginCluster(name string) {
+	r.cluster = &Cluster{Name: name, Mutations: []*Mutation{}}
+	r.plan.Clusters = append(r.plan.Clusters, r.cluster)
+}
+
+// BeginAddon attributes all subsequently recorded mutations to the named
+// addon.
+func (r *Recorder) BeginAddon(name string) {
+	r.addon = name
+}
+
+// Record appends m to the mutations of the current cluster.
+func (r *Recorder) Record(m *Mutation) error {
+	if r.cluster == nil {
+		return fmt.Errorf("cannot record %v: no cluster being planned", m)
+	}
+	m.Addon = r.addon
+	r.cluster.Mutations = append(r.cluster.Mutations, m)
+	return nil
+}
+
+// Plan returns the recorded plan.
+func (r *Recorder) Plan() *Plan {
+	return r.plan
+}
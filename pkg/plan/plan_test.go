@@ -0,0 +1,120 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func recordTestPlan(t *testing.T) *Plan {
+	r := NewRecorder("/addons/main.ipd", map[string]string{"cluster": "minikube", "env": "dev"})
+	if err := r.Record(&Mutation{Action: PutAction}); err == nil {
+		t.Fatal("expected error recording outside of a cluster")
+	}
+
+	r.BeginCluster("minikube")
+	r.BeginAddon("nginx")
+	for _, m := range []*Mutation{
+		{
+			Action:              PutAction,
+			Version:             "v1",
+			Kind:                "Service",
+			Resource:            "services",
+			Namespace:           "example",
+			Name:                "nginx",
+			LiveResourceVersion: "42",
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata": map[string]interface{}{
+					"name":      "nginx",
+					"namespace": "example",
+					"labels":    map[string]interface{}{"b": "2", "a": "1"},
+				},
+			},
+		},
+		{
+			Action:            DeleteAction,
+			Group:             "apps",
+			Version:           "v1",
+			Kind:              "Deployment",
+			Resource:          "deployments",
+			Namespace:         "example",
+			Name:              "old-nginx",
+			PropagationPolicy: "Foreground",
+		},
+	} {
+		if err := r.Record(m); err != nil {
+			t.Fatalf("Record(%v) failed: %v", m, err)
+		}
+	}
+	return r.Plan()
+}
+
+func TestWriteReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := recordTestPlan(t)
+	for _, m := range want.Clusters[0].Mutations {
+		if m.Addon != "nginx" {
+			t.Errorf("%v: expected addon `nginx', got `%s'", m, m.Addon)
+		}
+	}
+
+	path1, path2 := filepath.Join(dir, "1.bin"), filepath.Join(dir, "2.bin")
+	if err := want.WriteFile(path1); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := recordTestPlan(t).WriteFile(path2); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	bs1, _ := ioutil.ReadFile(path1)
+	bs2, _ := ioutil.ReadFile(path2)
+	if !bytes.Equal(bs1, bs2) {
+		t.Errorf("plan files are not deterministic:\n%s\n---\n%s", bs1, bs2)
+	}
+	if fi, err := os.Stat(path1); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected plan file mode 0600, got %v", fi.Mode().Perm())
+	}
+
+	got, err := ReadFile(path1)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected plan read back (-want +got):\n%s", d)
+	}
+
+	want.FormatVersion = FormatVersion + 1
+	if err := want.WriteFile(path1); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := ReadFile(path1); err == nil {
+		t.Error("expected error reading plan with unsupported format version")
+	}
+}
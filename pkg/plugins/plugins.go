@@ -0,0 +1,88 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugins loads custom Starlark modules from Go plugins so that
+// organizations can ship proprietary built-ins without patching Isopod.
+//
+// A plugin is a Go package `main' built with `go build -buildmode=plugin'
+// against the same Isopod (and Starlark) version as the binary loading it.
+// It must export NewModule function of type ModuleFunc:
+//
+//	func NewModule() (string, starlark.HasAttrs, error) {
+//		return "cmdb", &isopod.Module{Name: "cmdb", Attrs: attrs}, nil
+//	}
+package plugins
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"sort"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+)
+
+// Symbol is the name of the function plugins must export.
+const Symbol = "NewModule"
+
+// ModuleFunc returns name of a custom module and the module itself.
+type ModuleFunc = func() (string, starlark.HasAttrs, error)
+
+// Load opens all plugins (`*.so' files) in dir in lexical order and returns
+// modules they provide keyed by module name.
+func Load(dir string) (map[string]starlark.HasAttrs, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	mods := map[string]starlark.HasAttrs{}
+	for _, path := range paths {
+		name, m, err := open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load plugin `%s': %v", path, err)
+		}
+		if _, ok := mods[name]; ok {
+			return nil, fmt.Errorf("failed to load plugin `%s': module `%s' already loaded", path, name)
+		}
+		log.Infof("Loaded module `%s' from plugin `%s'", name, path)
+		mods[name] = m
+	}
+	return mods, nil
+}
+
+func open(path string) (string, starlark.HasAttrs, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	sym, err := p.Lookup(Symbol)
+	if err != nil {
+		return "", nil, err
+	}
+	fn, ok := sym.(ModuleFunc)
+	if !ok {
+		return "", nil, fmt.Errorf("`%s' must be a func() (string, starlark.HasAttrs, error) (got a %T)", Symbol, sym)
+	}
+	name, m, err := fn()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" || m == nil {
+		return "", nil, fmt.Errorf("`%s' returned empty module", Symbol)
+	}
+	return name, m, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mods, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(mods) != 0 {
+		t.Errorf("Expected no modules, got: %v", mods)
+	}
+
+	bad := filepath.Join(dir, "bad.so")
+	if err := ioutil.WriteFile(bad, []byte("not a shared object"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(dir)
+	if want := "failed to load plugin `" + bad + "'"; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Expected error starting with %q, got: %v", want, err)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isopod
+
+import (
+	"errors"
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// ErrReadOnly is returned (wrapped) by operations that would mutate external
+// state in read-only mode (--read_only).
+var ErrReadOnly = errors.New("not allowed in read-only mode (--read_only)")
+
+// ReadOnly returns a copy of m whose methods fail with ErrReadOnly instead
+// of being called.
+func ReadOnly(m *Module, methods ...string) *Module {
+	ro := &Module{Name: m.Name, Attrs: starlark.StringDict{}}
+	for n, v := range m.Attrs {
+		ro.Attrs[n] = v
+	}
+	for _, n := range methods {
+		if _, ok := ro.Attrs[n]; !ok {
+			continue
+		}
+		name := m.Name + "." + n
+		ro.Attrs[n] = starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+			return nil, fmt.Errorf("<%v>: %w", b.Name(), ErrReadOnly)
+		})
+	}
+	return ro
+}
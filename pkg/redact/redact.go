@@ -0,0 +1,173 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact tracks sensitive values (e.g read from Vault) and scrubs them
+// from output.
+package redact
+
+import (
+	"encoding/base64"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Placeholder replaces redacted values.
+const Placeholder = "<redacted>"
+
+// minLen is the length of the shortest value tracked. Shorter values (e.g
+// `true' or port numbers) are too likely to appear in output by accident.
+const minLen = 6
+
+// Redactor scrubs tracked values from strings. It's safe for concurrent use.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string]struct{}
+	replacer *strings.Replacer
+}
+
+// New returns a new *Redactor with no tracked values.
+func New() *Redactor {
+	return &Redactor{values: map[string]struct{}{}}
+}
+
+// Add tracks values (and their base64 encodings) as sensitive.
+func (r *Redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		if len(v) < minLen {
+			continue
+		}
+		r.values[v] = struct{}{}
+		r.values[base64.StdEncoding.EncodeToString([]byte(v))] = struct{}{}
+	}
+	r.replacer = nil
+}
+
+// AddValue tracks all strings nested in v (e.g values of a dict) as
+// sensitive.
+func (r *Redactor) AddValue(v starlark.Value) {
+	switch v := v.(type) {
+	case starlark.String:
+		r.Add(string(v))
+	case starlark.IterableMapping:
+		for _, item := range v.Items() {
+			r.AddValue(item[1])
+		}
+	case starlark.Iterable:
+		iter := v.Iterate()
+		defer iter.Done()
+		var x starlark.Value
+		for iter.Next(&x) {
+			r.AddValue(x)
+		}
+	}
+}
+
+// String returns s with all tracked values replaced by Placeholder.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	rep := r.replacer
+	n := len(r.values)
+	r.mu.RUnlock()
+	if n == 0 {
+		return s
+	}
+	if rep == nil {
+		rep = r.buildReplacer()
+	}
+	return rep.Replace(s)
+}
+
+func (r *Redactor) buildReplacer() *strings.Replacer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replacer != nil {
+		return r.replacer
+	}
+	vs := make([]string, 0, len(r.values))
+	for v := range r.values {
+		vs = append(vs, v)
+	}
+	// Replace longer values first so that a value containing another one
+	// isn't partially revealed.
+	sort.Slice(vs, func(i, j int) bool { return len(vs[i]) > len(vs[j]) })
+	args := make([]string, 0, 2*len(vs))
+	for _, v := range vs {
+		args = append(args, v, Placeholder)
+	}
+	r.replacer = strings.NewReplacer(args...)
+	return r.replacer
+}
+
+// Error returns err with tracked values redacted from its message (nil if
+// err is nil). The original error is available via errors.Unwrap.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Writer returns io.Writer that redacts tracked values from each write
+// before passing it to w. Values split across writes aren't redacted.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Default is the process-wide Redactor used by package-level functions.
+var Default = New()
+
+// Add tracks values as sensitive in Default.
+func Add(values ...string) { Default.Add(values...) }
+
+// AddValue tracks all strings nested in v as sensitive in Default.
+func AddValue(v starlark.Value) { Default.AddValue(v) }
+
+// String redacts values tracked by Default from s.
+func String(s string) string { return Default.String(s) }
+
+// Error redacts values tracked by Default from err.
+func Error(err error) error { return Default.Error(err) }
+
+// Writer returns io.Writer redacting values tracked by Default.
+func Writer(w io.Writer) io.Writer { return Default.Writer(w) }
@@ -0,0 +1,83 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestRedactor(t *testing.T) {
+	r := New()
+	r.Add("hunter2-password", "short")
+
+	d := starlark.NewDict(2)
+	d.SetKey(starlark.String("token"), starlark.String("s3cr3t-token"))
+	d.SetKey(starlark.String("nested"), starlark.NewList([]starlark.Value{starlark.String("api-key-123"), starlark.MakeInt(42)}))
+	r.AddValue(d)
+
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{
+			name: "plain",
+			in:   "password is hunter2-password",
+			want: "password is <redacted>",
+		},
+		{
+			name: "base64",
+			in:   "data: aHVudGVyMi1wYXNzd29yZA==",
+			want: "data: <redacted>",
+		},
+		{
+			name: "nested values",
+			in:   `{"token": "s3cr3t-token", "keys": ["api-key-123"]}`,
+			want: `{"token": "<redacted>", "keys": ["<redacted>"]}`,
+		},
+		{
+			name: "short values are not tracked",
+			in:   "short 42",
+			want: "short 42",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := r.String(tc.in); got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprint(r.Writer(b), "+  token: s3cr3t-token")
+	if got, want := b.String(), "+  token: <redacted>"; got != want {
+		t.Errorf("Expected %q written, got %q", want, got)
+	}
+
+	orig := errors.New("failed to read s3cr3t-token")
+	err := r.Error(fmt.Errorf("addon failed: %w", orig))
+	if got, want := err.Error(), "addon failed: failed to read <redacted>"; got != want {
+		t.Errorf("Expected error %q, got %q", want, got)
+	}
+	if !errors.Is(err, orig) {
+		t.Errorf("Expected redacted error to wrap original error")
+	}
+	if r.Error(nil) != nil {
+		t.Errorf("Expected nil error")
+	}
+}
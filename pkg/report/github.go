@@ -0,0 +1,132 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DefaultGitHubURL is the GitHub API endpoint.
+const DefaultGitHubURL = "https://api.github.com"
+
+// GitHub posts comments on GitHub pull requests.
+type GitHub struct {
+	// BaseURL is the API endpoint (e.g DefaultGitHubURL or GitHub Enterprise
+	// `https://<host>/api/v3').
+	BaseURL string
+	// Repo is the `owner/name' of the repository.
+	Repo   string
+	PR     int
+	Token  string
+	Client *http.Client
+}
+
+type comment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// Post implements Poster.Post.
+func (g *GitHub) Post(ctx context.Context, body string) error {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = DefaultGitHubURL
+	}
+
+	var existing *comment
+	for page := 1; existing == nil; page++ {
+		var cs []*comment
+		url := fmt.Sprintf("%s/repos/%s/issues/%d/comments?per_page=100&page=%d", base, g.Repo, g.PR, page)
+		if err := g.do(ctx, http.MethodGet, url, nil, &cs); err != nil {
+			return err
+		}
+		if len(cs) == 0 {
+			break
+		}
+		for _, c := range cs {
+			if strings.Contains(c.Body, Marker) {
+				existing = c
+				break
+			}
+		}
+	}
+
+	req := map[string]string{"body": body}
+	if existing != nil {
+		return g.do(ctx, http.MethodPatch, fmt.Sprintf("%s/repos/%s/issues/comments/%d", base, g.Repo, existing.ID), req, nil)
+	}
+	return g.do(ctx, http.MethodPost, fmt.Sprintf("%s/repos/%s/issues/%d/comments", base, g.Repo, g.PR), req, nil)
+}
+
+func (g *GitHub) do(ctx context.Context, method, url string, in, out interface{}) error {
+	return doJSON(ctx, g.Client, method, url, map[string]string{
+		"Authorization": "token " + g.Token,
+		"Accept":        "application/vnd.github.v3+json",
+	}, in, out)
+}
+
+// doJSON sends in (if not nil) as JSON body and decodes JSON response into
+// out (if not nil).
+func doJSON(ctx context.Context, c *http.Client, method, url string, headers map[string]string, in, out interface{}) error {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	var body *bytes.Reader
+	if in != nil {
+		bs, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bs)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s failed with %s: %s", method, url, resp.Status, bs)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(bs, out)
+}
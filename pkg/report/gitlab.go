@@ -0,0 +1,74 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultGitLabURL is the gitlab.com API endpoint.
+const DefaultGitLabURL = "https://gitlab.com/api/v4"
+
+// GitLab posts notes on GitLab merge requests.
+type GitLab struct {
+	// BaseURL is the API endpoint (e.g DefaultGitLabURL).
+	BaseURL string
+	// Project is the numeric ID or `group/name' path of the project.
+	Project string
+	// MR is the merge request IID.
+	MR     int
+	Token  string
+	Client *http.Client
+}
+
+// Post implements Poster.Post.
+func (g *GitLab) Post(ctx context.Context, body string) error {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = DefaultGitLabURL
+	}
+	notesURL := fmt.Sprintf("%s/projects/%s/merge_requests/%d/notes", base, url.PathEscape(g.Project), g.MR)
+
+	var existing *comment
+	for page := 1; existing == nil; page++ {
+		var ns []*comment
+		if err := g.do(ctx, http.MethodGet, fmt.Sprintf("%s?per_page=100&page=%d", notesURL, page), nil, &ns); err != nil {
+			return err
+		}
+		if len(ns) == 0 {
+			break
+		}
+		for _, n := range ns {
+			if strings.Contains(n.Body, Marker) {
+				existing = n
+				break
+			}
+		}
+	}
+
+	req := map[string]string{"body": body}
+	if existing != nil {
+		return g.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesURL, existing.ID), req, nil)
+	}
+	return g.do(ctx, http.MethodPost, notesURL, req, nil)
+}
+
+func (g *GitLab) do(ctx context.Context, method, url string, in, out interface{}) error {
+	return doJSON(ctx, g.Client, method, url, map[string]string{"PRIVATE-TOKEN": g.Token}, in, out)
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// Object is the diff of a single object in a Section.
+type Object struct {
+	// Name is the object as printed in the diff header, e.g.
+	// service.v1 `example/nginx'.
+	Name  string
+	Lines []Line
+}
+
+// Line is a line of a unified diff classified for highlighting.
+type Line struct {
+	// Class is one of `add', `del', `hunk', `file', `warn' or empty for
+	// context lines.
+	Class string
+	Text  string
+}
+
+// Objects returns diffs of objects with actual changes in s.
+func (s *Section) Objects() []*Object {
+	var objs []*Object
+	for _, l := range strings.Split(changedObjects(s.Diff.String()), "\n") {
+		if strings.HasPrefix(l, "*** ") && strings.HasSuffix(l, " ***") {
+			objs = append(objs, &Object{Name: strings.TrimSuffix(strings.TrimPrefix(l, "*** "), " ***")})
+			continue
+		}
+		// Context lines of unified diffs are prefixed with a space, empty
+		// lines only separate objects and warnings.
+		if l == "" {
+			continue
+		}
+		if len(objs) == 0 {
+			// Warnings printed before the first object of the section.
+			objs = append(objs, &Object{Name: "warnings"})
+		}
+		o := objs[len(objs)-1]
+		o.Lines = append(o.Lines, Line{Class: lineClass(l), Text: l})
+	}
+	return objs
+}
+
+// lineClass returns the Line.Class of unified diff line l.
+func lineClass(l string) string {
+	switch {
+	case strings.HasPrefix(l, "**WARNING**"):
+		return "warn"
+	case strings.HasPrefix(l, "--- "), strings.HasPrefix(l, "+++ "):
+		return "file"
+	case strings.HasPrefix(l, "@@"):
+		return "hunk"
+	case strings.HasPrefix(l, "+"):
+		return "add"
+	case strings.HasPrefix(l, "-"):
+		return "del"
+	}
+	return ""
+}
+
+type htmlAddon struct {
+	ID, Name string
+	Failed   bool
+	Objects  []*Object
+}
+
+type htmlCluster struct {
+	Name      string
+	Addons    []*htmlAddon
+	Unchanged int
+}
+
+var htmlTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; display: flex; }
+nav { width: 18em; height: 100vh; overflow: auto; position: sticky; top: 0; padding: 1em; background: #f6f8fa; border-right: 1px solid #d0d7de; box-sizing: border-box; flex-shrink: 0; }
+nav ul { padding-left: 1.2em; }
+main { padding: 1em 2em; min-width: 0; flex-grow: 1; }
+details { margin: 0.5em 0; border: 1px solid #d0d7de; border-radius: 6px; }
+summary { padding: 0.4em 0.8em; background: #f6f8fa; cursor: pointer; font-family: monospace; }
+pre { margin: 0; padding: 0.5em 0; overflow-x: auto; font-size: 12px; }
+pre span { display: block; padding: 0 0.8em; white-space: pre; }
+.add { background: #e6ffec; }
+.del { background: #ffebe9; }
+.hunk { background: #ddf4ff; color: #57606a; }
+.file { color: #57606a; font-weight: bold; }
+.warn { background: #fff8c5; font-weight: bold; }
+.failed { color: #cf222e; }
+.unchanged { color: #57606a; }
+</style>
+</head>
+<body>
+<nav>
+<strong>{{.Title}}</strong>
+{{- if not .Changed}}
+<p>No changes.</p>
+{{- end}}
+<ul>
+{{- range .Clusters}}
+<li>{{.Name}}
+<ul>
+{{- range .Addons}}
+<li><a href="#{{.ID}}">{{.Name}}</a>{{if .Failed}} <span class="failed">failed</span>{{else}} ({{len .Objects}}){{end}}</li>
+{{- end}}
+</ul>
+</li>
+{{- end}}
+</ul>
+</nav>
+<main>
+<h1>{{.Title}}</h1>
+{{- if not .Changed}}
+<p>No changes.</p>
+{{- end}}
+{{- range .Clusters}}
+<h2>Cluster {{.Name}}</h2>
+{{- if .Unchanged}}
+<p class="unchanged">{{.Unchanged}} addon(s) without changes.</p>
+{{- end}}
+{{- range .Addons}}
+<h3 id="{{.ID}}">Addon {{.Name}}{{if .Failed}} <span class="failed">failed</span>{{end}}</h3>
+{{- range .Objects}}
+<details open>
+<summary>{{.Name}}</summary>
+<pre>
+{{- range .Lines}}<span{{if .Class}} class="{{.Class}}"{{end}}>{{.Text}}</span>{{end -}}
+</pre>
+</details>
+{{- end}}
+{{- end}}
+{{- end}}
+</main>
+</body>
+</html>
+`))
+
+// WriteHTML writes collected diffs to w as a standalone HTML page grouped by
+// cluster, addon and object, with a navigation pane linking to addons with
+// changes. Addons without changes are only counted.
+func (c *Collector) WriteHTML(w io.Writer, title string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var clusters []*htmlCluster
+	byName := map[string]*htmlCluster{}
+	changed := false
+	for i, s := range c.sections {
+		cl, ok := byName[s.Cluster]
+		if !ok {
+			cl = &htmlCluster{Name: s.Cluster}
+			byName[s.Cluster] = cl
+			clusters = append(clusters, cl)
+		}
+		objs := s.Objects()
+		if len(objs) == 0 && !s.Failed {
+			cl.Unchanged++
+			continue
+		}
+		changed = true
+		cl.Addons = append(cl.Addons, &htmlAddon{
+			ID:      fmt.Sprintf("addon-%d", i),
+			Name:    s.Addon,
+			Failed:  s.Failed,
+			Objects: objs,
+		})
+	}
+
+	return htmlTmpl.Execute(w, struct {
+		Title    string
+		Changed  bool
+		Clusters []*htmlCluster
+	}{
+		Title:    title,
+		Changed:  changed,
+		Clusters: clusters,
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report collects per-cluster/per-addon diffs and publishes them as
+// pull request comments or HTML reports.
+package report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cruise-automation/isopod/pkg/runtime"
+)
+
+// Marker identifies comments posted by Isopod so that they are updated
+// rather than duplicated on subsequent runs.
+const Marker = "<!-- isopod-diff-report -->"
+
+// maxCommentLen is the limit on comment body length (GitHub allows 65536
+// characters, GitLab allows 1000000).
+const maxCommentLen = 60000
+
+// Section is the diff produced by a single addon on a single cluster.
+type Section struct {
+	Cluster string
+	Addon   string
+	Diff    bytes.Buffer
+	Failed  bool
+}
+
+// Collector accumulates diffs written to it into sections delimited by
+// runtime.AddonStarted events.
+type Collector struct {
+	mu       sync.Mutex
+	sections []*Section
+}
+
+// Write implements io.Writer. Diffs written before any addon started are
+// dropped.
+func (c *Collector) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sections) == 0 {
+		return len(p), nil
+	}
+	return c.sections[len(c.sections)-1].Diff.Write(p)
+}
+
+// HandleEvent implements runtime.EventHandler.
+func (c *Collector) HandleEvent(e *runtime.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch e.Type {
+	case runtime.AddonStarted:
+		c.sections = append(c.sections, &Section{Cluster: e.Cluster, Addon: e.Addon})
+	case runtime.AddonFailed:
+		if len(c.sections) > 0 {
+			c.sections[len(c.sections)-1].Failed = true
+		}
+	}
+}
+
+// Markdown renders collected diffs as a comment body with a collapsible
+// unified diff per addon. Addons without changes are only counted.
+func (c *Collector) Markdown(title string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n### %s\n\n", Marker, title)
+
+	var changed, unchanged int
+	var truncated bool
+	for _, s := range c.sections {
+		diff := changedObjects(s.Diff.String())
+		if diff == "" && !s.Failed {
+			unchanged++
+			continue
+		}
+		changed++
+
+		status := ""
+		if s.Failed {
+			status = " :x: failed"
+		}
+		section := fmt.Sprintf("<details><summary><code>%s</code> / <code>%s</code>%s</summary>\n\n```diff\n%s\n```\n\n</details>\n", s.Cluster, s.Addon, status, diff)
+		if b.Len()+len(section) > maxCommentLen {
+			truncated = true
+			continue
+		}
+		b.WriteString(section)
+	}
+
+	if changed == 0 {
+		b.WriteString("No changes.\n")
+	}
+	if truncated {
+		b.WriteString("\n**Report truncated**, see job output for the full diff.\n")
+	}
+	if unchanged > 0 {
+		fmt.Fprintf(&b, "\n%d cluster/addon pairs without changes.\n", unchanged)
+	}
+	return b.String()
+}
+
+// changedObjects returns diffs of objects with actual changes from diff
+// output, dropping headers of unchanged objects.
+func changedObjects(diff string) string {
+	var ret []string
+	for _, obj := range strings.Split(diff, "\n*** ") {
+		obj = strings.TrimSpace(obj)
+		if !strings.Contains(obj, "\n@@") && !strings.Contains(obj, "**WARNING**") {
+			continue
+		}
+		if !strings.HasPrefix(obj, "***") && !strings.HasPrefix(obj, "**WARNING**") {
+			obj = "*** " + obj
+		}
+		ret = append(ret, obj)
+	}
+	return strings.Join(ret, "\n\n")
+}
+
+// Poster creates or updates the Isopod comment on a pull request.
+type Poster interface {
+	// Post replaces the body of the existing comment carrying Marker or
+	// creates a new comment.
+	Post(ctx context.Context, body string) error
+}
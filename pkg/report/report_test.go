@@ -0,0 +1,265 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/runtime"
+)
+
+const serviceDiff = `
+*** service.v1 ` + "`example/nginx'" + ` ***
+--- live
++++ head
+@@ -1,2 +1,2 @@
+-  type: ClusterIP
++  type: NodePort
+`
+
+const unchangedDiff = `
+*** configmap.v1 ` + "`example/nginx'" + ` ***
+`
+
+func TestCollectorMarkdown(t *testing.T) {
+	c := &Collector{}
+	fmt.Fprint(c, "dropped")
+
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "nginx"})
+	fmt.Fprint(c, unchangedDiff)
+	fmt.Fprint(c, serviceDiff)
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonSucceeded, Cluster: "minikube", Addon: "nginx"})
+
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "ingress"})
+	fmt.Fprint(c, unchangedDiff)
+
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "paas-dev", Addon: "nginx"})
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonFailed, Cluster: "paas-dev", Addon: "nginx", Err: errors.New("boom")})
+
+	got := c.Markdown("Diff")
+	for _, want := range []string{
+		Marker,
+		"<code>minikube</code> / <code>nginx</code></summary>",
+		"+  type: NodePort",
+		"<code>paas-dev</code> / <code>nginx</code> :x: failed",
+		"1 cluster/addon pairs without changes.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"dropped", "configmap.v1"} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("Expected report to not contain %q, got:\n%s", notWant, got)
+		}
+	}
+
+	if got := (&Collector{}).Markdown("Diff"); !strings.Contains(got, "No changes.") {
+		t.Errorf("Expected empty report, got:\n%s", got)
+	}
+}
+
+func TestCollectorHTML(t *testing.T) {
+	c := &Collector{}
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "nginx"})
+	fmt.Fprint(c, unchangedDiff)
+	fmt.Fprint(c, serviceDiff)
+	fmt.Fprint(c, "\n\n**WARNING** job `example/migrate' is immutable and will be deleted and recreated.\n")
+	fmt.Fprint(c, "\n*** job.batch `example/migrate' will be deleted ***\n--- live\n+++ head\n@@ -1 +0,0 @@\n-kind: Job\n")
+
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "ingress"})
+	fmt.Fprint(c, unchangedDiff)
+
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonStarted, Cluster: "paas-dev", Addon: "<nginx>"})
+	c.HandleEvent(&runtime.Event{Type: runtime.AddonFailed, Cluster: "paas-dev", Addon: "<nginx>", Err: errors.New("boom")})
+
+	want := []*Object{
+		{
+			Name: "service.v1 `example/nginx'",
+			Lines: []Line{
+				{Class: "file", Text: "--- live"},
+				{Class: "file", Text: "+++ head"},
+				{Class: "hunk", Text: "@@ -1,2 +1,2 @@"},
+				{Class: "del", Text: "-  type: ClusterIP"},
+				{Class: "add", Text: "+  type: NodePort"},
+				{Class: "warn", Text: "**WARNING** job `example/migrate' is immutable and will be deleted and recreated."},
+			},
+		},
+		{
+			Name: "job.batch `example/migrate' will be deleted",
+			Lines: []Line{
+				{Class: "file", Text: "--- live"},
+				{Class: "file", Text: "+++ head"},
+				{Class: "hunk", Text: "@@ -1 +0,0 @@"},
+				{Class: "del", Text: "-kind: Job"},
+			},
+		},
+	}
+	if d := cmp.Diff(want, c.sections[0].Objects()); d != "" {
+		t.Errorf("Unexpected objects (-want +got):\n%s", d)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.WriteHTML(buf, "Diff"); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"<title>Diff</title>",
+		`<li><a href="#addon-0">nginx</a> (2)</li>`,
+		`<h3 id="addon-0">Addon nginx</h3>`,
+		"<summary>service.v1 `example/nginx&#39;</summary>",
+		`<span class="add">&#43;  type: NodePort</span>`,
+		"1 addon(s) without changes.",
+		`<h3 id="addon-2">Addon &lt;nginx&gt; <span class="failed">failed</span></h3>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, got)
+		}
+	}
+	for _, notWant := range []string{"configmap.v1", "No changes."} {
+		if strings.Contains(got, notWant) {
+			t.Errorf("Expected report to not contain %q, got:\n%s", notWant, got)
+		}
+	}
+
+	buf.Reset()
+	if err := (&Collector{}).WriteHTML(buf, "Diff"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "No changes.") {
+		t.Errorf("Expected empty report, got:\n%s", buf.String())
+	}
+}
+
+func TestGitHubPost(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		comments   []*comment
+		wantMethod string
+		wantPath   string
+	}{
+		{
+			name:       "create",
+			comments:   []*comment{{ID: 1, Body: "LGTM"}},
+			wantMethod: http.MethodPost,
+			wantPath:   "/repos/cruise/isopod/issues/7/comments",
+		},
+		{
+			name:       "update",
+			comments:   []*comment{{ID: 1, Body: "LGTM"}, {ID: 2, Body: Marker + "\nold"}},
+			wantMethod: http.MethodPatch,
+			wantPath:   "/repos/cruise/isopod/issues/comments/2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotMethod, gotPath, gotBody string
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "token secret" {
+					t.Errorf("Unexpected Authorization header: %q", got)
+				}
+				if r.Method == http.MethodGet {
+					if r.URL.Query().Get("page") != "1" {
+						w.Write([]byte("[]"))
+						return
+					}
+					json.NewEncoder(w).Encode(tc.comments)
+					return
+				}
+				req := map[string]string{}
+				json.NewDecoder(r.Body).Decode(&req)
+				gotMethod, gotPath, gotBody = r.Method, r.URL.Path, req["body"]
+				w.Write([]byte("{}"))
+			}))
+			defer s.Close()
+
+			g := &GitHub{BaseURL: s.URL, Repo: "cruise/isopod", PR: 7, Token: "secret"}
+			if err := g.Post(context.Background(), Marker+"\nnew"); err != nil {
+				t.Fatalf("Post failed: %v", err)
+			}
+			if gotMethod != tc.wantMethod || gotPath != tc.wantPath {
+				t.Errorf("Expected %s %s, got %s %s", tc.wantMethod, tc.wantPath, gotMethod, gotPath)
+			}
+			if gotBody != Marker+"\nnew" {
+				t.Errorf("Unexpected comment body: %q", gotBody)
+			}
+		})
+	}
+}
+
+func TestGitLabPost(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		notes      []*comment
+		wantMethod string
+		wantPath   string
+	}{
+		{
+			name:       "create",
+			notes:      []*comment{{ID: 1, Body: "LGTM"}},
+			wantMethod: http.MethodPost,
+			wantPath:   "/projects/cruise%2Fisopod/merge_requests/7/notes",
+		},
+		{
+			name:       "update",
+			notes:      []*comment{{ID: 1, Body: "LGTM"}, {ID: 2, Body: Marker + "\nold"}},
+			wantMethod: http.MethodPut,
+			wantPath:   "/projects/cruise%2Fisopod/merge_requests/7/notes/2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotMethod, gotPath, gotBody string
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("PRIVATE-TOKEN"); got != "secret" {
+					t.Errorf("Unexpected PRIVATE-TOKEN header: %q", got)
+				}
+				if r.Method == http.MethodGet {
+					if r.URL.Query().Get("page") != "1" {
+						w.Write([]byte("[]"))
+						return
+					}
+					json.NewEncoder(w).Encode(tc.notes)
+					return
+				}
+				req := map[string]string{}
+				json.NewDecoder(r.Body).Decode(&req)
+				gotMethod, gotPath, gotBody = r.Method, r.URL.EscapedPath(), req["body"]
+				w.Write([]byte("{}"))
+			}))
+			defer s.Close()
+
+			g := &GitLab{BaseURL: s.URL + "/", Project: "cruise/isopod", MR: 7, Token: "secret"}
+			if err := g.Post(context.Background(), Marker+"\nnew"); err != nil {
+				t.Fatalf("Post failed: %v", err)
+			}
+			if gotMethod != tc.wantMethod || gotPath != tc.wantPath {
+				t.Errorf("Expected %s %s, got %s %s", tc.wantMethod, tc.wantPath, gotMethod, gotPath)
+			}
+			if gotBody != Marker+"\nnew" {
+				t.Errorf("Unexpected note body: %q", gotBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package result records the outcome of a run on each cluster and maps it to
+// the exit code of Isopod.
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/lock"
+	"github.com/cruise-automation/isopod/pkg/runtime"
+)
+
+// Exit codes of Isopod. When a run fails for several reasons, the first
+// matching code in order of ExitLoadFailed, ExitLocked, ExitPartialFailure and
+// ExitAddonsFailed is used.
+const (
+	// ExitOK is returned when the command succeeded.
+	ExitOK = 0
+	// ExitError is returned for invalid flags or arguments and failures
+	// not covered by other codes.
+	ExitError = 1
+	// ExitAddonsFailed is returned when addons failed on all clusters they
+	// ran on.
+	ExitAddonsFailed = 2
+	// ExitPartialFailure is returned when addons failed on some clusters
+	// but succeeded on others.
+	ExitPartialFailure = 3
+	// ExitLoadFailed is returned when an entry file, an addon or a module
+	// failed to load.
+	ExitLoadFailed = 4
+	// ExitLocked is returned when the rollout lock of a cluster is held by
+	// another Isopod.
+	ExitLocked = 5
+	// ExitDiff is returned by successful dry runs that would change objects
+	// if detailed exit codes are requested.
+	ExitDiff = 6
+)
+
+// Status is the outcome of a cluster or addon run.
+type Status string
+
+const (
+	// Succeeded means the command completed successfully.
+	Succeeded Status = "succeeded"
+	// Failed means the command failed.
+	Failed Status = "failed"
+	// Skipped means the addon didn't run because a previous addon failed.
+	Skipped Status = "skipped"
+)
+
+// Addon is the outcome of a single addon on a cluster.
+type Addon struct {
+	Name   string     `json:"name"`
+	Status Status     `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	Stats  kube.Stats `json:"stats"`
+}
+
+// Cluster is the outcome of a run on a single cluster.
+type Cluster struct {
+	// Name is the `cluster' field of the context (may be empty).
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	// RolloutID is the ID of the stored rollout (only set by install
+	// outside of dry run mode).
+	RolloutID string     `json:"rollout_id,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Addons    []*Addon   `json:"addons"`
+	Stats     kube.Stats `json:"stats"`
+
+	err error
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Command  string     `json:"command"`
+	DryRun   bool       `json:"dry_run"`
+	Status   Status     `json:"status"`
+	ExitCode int        `json:"exit_code"`
+	Error    string     `json:"error,omitempty"`
+	Clusters []*Cluster `json:"clusters"`
+	// Stats counts objects mutated on all clusters.
+	Stats kube.Stats `json:"stats"`
+}
+
+// WriteFile writes r as JSON to path.
+func (r *Result) WriteFile(path string) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	// Errors often contain `<addon: name>'.
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Recorder builds a Result from runtime events. Clusters must run one at a
+// time, each ending with a call of ClusterDone.
+type Recorder struct {
+	command string
+	dryRun  bool
+
+	mu       sync.Mutex
+	clusters []*Cluster
+	// cur is the cluster events are currently reported for.
+	cur *Cluster
+}
+
+// NewRecorder returns a new *Recorder of command runs.
+func NewRecorder(command string, dryRun bool) *Recorder {
+	return &Recorder{command: command, dryRun: dryRun}
+}
+
+// current returns the cluster currently running, adding one named name if
+// there is none.
+func (r *Recorder) current(name string) *Cluster {
+	if r.cur == nil {
+		r.cur = &Cluster{Name: name, Status: Succeeded, Addons: []*Addon{}}
+		r.clusters = append(r.clusters, r.cur)
+	}
+	return r.cur
+}
+
+// HandleEvent implements runtime.EventHandler.
+func (r *Recorder) HandleEvent(e *runtime.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.current(e.Cluster)
+	switch e.Type {
+	case runtime.RolloutStarted:
+		for _, n := range e.Addons {
+			c.Addons = append(c.Addons, &Addon{Name: n, Status: Skipped})
+		}
+	case runtime.AddonSucceeded, runtime.AddonFailed:
+		a := c.addon(e.Addon)
+		a.Status, a.Stats = Succeeded, e.Stats
+		if e.Err != nil {
+			a.Status, a.Error = Failed, e.Err.Error()
+		}
+	case runtime.RolloutSucceeded, runtime.RolloutFailed:
+		c.RolloutID, c.Stats = e.RolloutID, e.Stats
+	}
+}
+
+// addon returns addon name of c, adding it if missing.
+func (c *Cluster) addon(name string) *Addon {
+	for _, a := range c.Addons {
+		if a.Name == name {
+			return a
+		}
+	}
+	a := &Addon{Name: name}
+	c.Addons = append(c.Addons, a)
+	return a
+}
+
+// ClusterDone records that run on cluster name completed with err (nil if
+// it succeeded).
+func (r *Recorder) ClusterDone(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.current(name)
+	if err != nil {
+		c.Status, c.Error, c.err = Failed, err.Error(), err
+	}
+	r.cur = nil
+}
+
+// Result returns the outcome of the run that completed with err (nil if it
+// succeeded). If detailed is set, successful dry runs that would change
+// objects exit with ExitDiff.
+func (r *Recorder) Result(err error, detailed bool) *Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := &Result{
+		Command:  r.command,
+		DryRun:   r.dryRun,
+		Status:   Succeeded,
+		Clusters: append([]*Cluster{}, r.clusters...),
+	}
+	for _, c := range r.clusters {
+		res.Stats.Add(c.Stats)
+	}
+	if err != nil {
+		res.Status, res.Error = Failed, err.Error()
+	}
+	res.ExitCode = exitCode(err, r.clusters)
+	if res.ExitCode == ExitOK && detailed && r.dryRun && res.Stats.Changed() > 0 {
+		res.ExitCode = ExitDiff
+	}
+	return res
+}
+
+// exitCode returns the exit code of a run that completed with err on
+// clusters.
+func exitCode(err error, clusters []*Cluster) int {
+	if err == nil {
+		return ExitOK
+	}
+	errs := []error{err}
+	var failed, succeeded int
+	for _, c := range clusters {
+		if c.err != nil {
+			errs = append(errs, c.err)
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	for _, e := range errs {
+		var lErr *runtime.LoadError
+		if errors.As(e, &lErr) {
+			return ExitLoadFailed
+		}
+	}
+	for _, e := range errs {
+		if errors.Is(e, lock.ErrHeld) {
+			return ExitLocked
+		}
+	}
+	switch {
+	case failed > 0 && succeeded > 0:
+		return ExitPartialFailure
+	case failed > 0:
+		return ExitAddonsFailed
+	}
+	return ExitError
+}
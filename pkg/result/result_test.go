@@ -0,0 +1,236 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/lock"
+	"github.com/cruise-automation/isopod/pkg/runtime"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder("install", false)
+	addonErr := errors.New("<addon: logging> install failed: timed out")
+	for _, e := range []*runtime.Event{
+		{Type: runtime.RolloutStarted, Cluster: "minikube", Addons: []string{"ingress", "logging", "monitoring"}},
+		{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "ingress"},
+		{Type: runtime.AddonSucceeded, Cluster: "minikube", Addon: "ingress", Stats: kube.Stats{Created: 2}},
+		{Type: runtime.AddonStarted, Cluster: "minikube", Addon: "logging"},
+		{Type: runtime.AddonFailed, Cluster: "minikube", Addon: "logging", Err: addonErr, Stats: kube.Stats{Failed: 1}},
+		{Type: runtime.RolloutFailed, Cluster: "minikube", RolloutID: "r-1", Err: addonErr, Stats: kube.Stats{Created: 2, Failed: 1}},
+	} {
+		r.HandleEvent(e)
+	}
+	r.ClusterDone("minikube", fmt.Errorf("`install' execution failed: %v", addonErr))
+	r.ClusterDone("gke-prod", fmt.Errorf("failed to load addons runtime: %w", &runtime.LoadError{Err: errors.New("main.ipd:3:1: undefined: foo")}))
+
+	path := filepath.Join(t.TempDir(), "result.json")
+	if err := r.Result(errors.New("addons run failed on 2 clusters"), false).WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+  "command": "install",
+  "dry_run": false,
+  "status": "failed",
+  "exit_code": 4,
+  "error": "addons run failed on 2 clusters",
+  "clusters": [
+    {
+      "name": "minikube",
+      "status": "failed",
+      "rollout_id": "r-1",
+      "error": "` + "`install'" + ` execution failed: <addon: logging> install failed: timed out",
+      "addons": [
+        {
+          "name": "ingress",
+          "status": "succeeded",
+          "stats": {
+            "created": 2,
+            "updated": 0,
+            "unchanged": 0,
+            "recreated": 0,
+            "deleted": 0,
+            "failed": 0
+          }
+        },
+        {
+          "name": "logging",
+          "status": "failed",
+          "error": "<addon: logging> install failed: timed out",
+          "stats": {
+            "created": 0,
+            "updated": 0,
+            "unchanged": 0,
+            "recreated": 0,
+            "deleted": 0,
+            "failed": 1
+          }
+        },
+        {
+          "name": "monitoring",
+          "status": "skipped",
+          "stats": {
+            "created": 0,
+            "updated": 0,
+            "unchanged": 0,
+            "recreated": 0,
+            "deleted": 0,
+            "failed": 0
+          }
+        }
+      ],
+      "stats": {
+        "created": 2,
+        "updated": 0,
+        "unchanged": 0,
+        "recreated": 0,
+        "deleted": 0,
+        "failed": 1
+      }
+    },
+    {
+      "name": "gke-prod",
+      "status": "failed",
+      "error": "failed to load addons runtime: main.ipd:3:1: undefined: foo",
+      "addons": [],
+      "stats": {
+        "created": 0,
+        "updated": 0,
+        "unchanged": 0,
+        "recreated": 0,
+        "deleted": 0,
+        "failed": 0
+      }
+    }
+  ],
+  "stats": {
+    "created": 2,
+    "updated": 0,
+    "unchanged": 0,
+    "recreated": 0,
+    "deleted": 0,
+    "failed": 1
+  }
+}
+`
+	if d := cmp.Diff(want, string(got)); d != "" {
+		t.Errorf("Unexpected result (-want, +got):\n%s", d)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	changed := &runtime.Event{Type: runtime.RolloutSucceeded, Cluster: "minikube", Stats: kube.Stats{Updated: 1}}
+	lockErr := fmt.Errorf("failed to acquire lock: %w", lock.ErrHeld)
+	loadErr := &runtime.LoadError{Err: errors.New("cannot load lib.ipd")}
+	addonErr := errors.New("`install' execution failed")
+
+	for _, tc := range []struct {
+		name     string
+		dryRun   bool
+		detailed bool
+		events   []*runtime.Event
+		clusters map[string]error
+		err      error
+		want     int
+	}{
+		{
+			name:     "Success",
+			clusters: map[string]error{"a": nil, "b": nil},
+			want:     ExitOK,
+		},
+		{
+			name:     "All failed",
+			clusters: map[string]error{"a": addonErr, "b": addonErr},
+			err:      errors.New("addons run failed on 2 clusters"),
+			want:     ExitAddonsFailed,
+		},
+		{
+			name:     "Partial failure",
+			clusters: map[string]error{"a": nil, "b": addonErr},
+			err:      errors.New("addons run failed on 1 clusters"),
+			want:     ExitPartialFailure,
+		},
+		{
+			name:     "Load failed",
+			clusters: map[string]error{"a": lockErr, "b": loadErr},
+			err:      errors.New("addons run failed on 2 clusters"),
+			want:     ExitLoadFailed,
+		},
+		{
+			name: "Clusters runtime load failed",
+			err:  fmt.Errorf("failed to load clusters runtime: %w", loadErr),
+			want: ExitLoadFailed,
+		},
+		{
+			name:     "Locked",
+			clusters: map[string]error{"a": nil, "b": lockErr},
+			err:      errors.New("addons run failed on 1 clusters"),
+			want:     ExitLocked,
+		},
+		{
+			name: "Other error",
+			err:  errors.New("failed to iterate through clusters"),
+			want: ExitError,
+		},
+		{
+			name:     "Diff",
+			dryRun:   true,
+			detailed: true,
+			events:   []*runtime.Event{changed},
+			clusters: map[string]error{"minikube": nil},
+			want:     ExitDiff,
+		},
+		{
+			name:     "Diff not requested",
+			dryRun:   true,
+			events:   []*runtime.Event{changed},
+			clusters: map[string]error{"minikube": nil},
+			want:     ExitOK,
+		},
+		{
+			name:     "No diff",
+			dryRun:   true,
+			detailed: true,
+			clusters: map[string]error{"minikube": nil},
+			want:     ExitOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRecorder("install", tc.dryRun)
+			for _, e := range tc.events {
+				r.HandleEvent(e)
+			}
+			for name, err := range tc.clusters {
+				r.ClusterDone(name, err)
+			}
+			if got := r.Result(tc.err, tc.detailed).ExitCode; got != tc.want {
+				t.Errorf("Unexpected exit code. Want: %d, got: %d", tc.want, got)
+			}
+		})
+	}
+}
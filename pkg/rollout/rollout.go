@@ -0,0 +1,163 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rollout implements strategies for ordering addon rollouts across
+// multiple clusters.
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Strategy is the name of a cluster rollout strategy.
+type Strategy string
+
+const (
+	// AllStrategy rolls out to every cluster in order regardless of
+	// failures on preceding clusters.
+	AllStrategy Strategy = "all"
+	// CanaryStrategy rolls out to clusters in progressively larger batches
+	// and halts as soon as any batch fails.
+	CanaryStrategy Strategy = "canary"
+)
+
+// DefaultBatches is the default canary batch specification.
+const DefaultBatches = "1,10%,100%"
+
+// Batch is a single step of a canary rollout. It specifies the total number
+// of clusters rolled out once the step completes, either as an absolute
+// Count or as a Percent of all clusters.
+type Batch struct {
+	Count   int
+	Percent int
+}
+
+// String returns Batch in the format accepted by ParseBatches.
+func (b Batch) String() string {
+	if b.Percent > 0 {
+		return fmt.Sprintf("%d%%", b.Percent)
+	}
+	return strconv.Itoa(b.Count)
+}
+
+// total returns number of clusters covered by b out of n clusters. Percents
+// are rounded up so that every non-empty batch covers at least one cluster.
+func (b Batch) total(n int) int {
+	t := b.Count
+	if b.Percent > 0 {
+		t = (n*b.Percent + 99) / 100
+	}
+	if t > n {
+		return n
+	}
+	return t
+}
+
+// ParseBatches parses comma-separated batch specification, e.g "1,10%,100%"
+// which first rolls out to a single cluster, then to 10% of all clusters and
+// finally to all of them.
+func ParseBatches(s string) ([]Batch, error) {
+	var bs []Batch
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		var b Batch
+		if strings.HasSuffix(f, "%") {
+			p, err := strconv.Atoi(strings.TrimSuffix(f, "%"))
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("invalid batch `%s': percent must be in (0, 100]", f)
+			}
+			b.Percent = p
+		} else {
+			c, err := strconv.Atoi(f)
+			if err != nil || c <= 0 {
+				return nil, fmt.Errorf("invalid batch `%s': must be a positive integer or percent", f)
+			}
+			b.Count = c
+		}
+		bs = append(bs, b)
+	}
+	if len(bs) == 0 {
+		return nil, fmt.Errorf("no batches in `%s'", s)
+	}
+	return bs, nil
+}
+
+// Split splits n clusters into consecutive batches of indices. Batches that
+// would not add any clusters are dropped and the remaining clusters are always
+// added as the final batch.
+func Split(n int, batches []Batch) [][]int {
+	var ret [][]int
+	done := 0
+	add := func(t int) {
+		if t <= done {
+			return
+		}
+		var idx []int
+		for ; done < t; done++ {
+			idx = append(idx, done)
+		}
+		ret = append(ret, idx)
+	}
+	for _, b := range batches {
+		add(b.total(n))
+	}
+	add(n)
+	return ret
+}
+
+// Canary rolls out to clusters in batches, waiting for Soak after every
+// successful batch but the last one.
+type Canary struct {
+	Batches []Batch
+	Soak    time.Duration
+}
+
+// Run calls fn for each of n clusters (by index) in batches. All clusters in
+// a batch are rolled out even if some of them fail, but no further batches
+// are started once any cluster in a batch failed.
+func (c *Canary) Run(ctx context.Context, n int, fn func(i int) error) error {
+	batches := Split(n, c.Batches)
+	for bi, batch := range batches {
+		fmt.Printf("Rolling out canary batch %d/%d (%d clusters)\n", bi+1, len(batches), len(batch))
+
+		var failed int
+		for _, i := range batch {
+			if err := fn(i); err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("canary batch %d/%d failed on %d of %d clusters, halting rollout", bi+1, len(batches), failed, len(batch))
+		}
+
+		if bi == len(batches)-1 || c.Soak == 0 {
+			continue
+		}
+		fmt.Printf("Canary batch %d/%d succeeded, soaking for %v\n", bi+1, len(batches), c.Soak)
+		select {
+		case <-time.After(c.Soak):
+		case <-ctx.Done():
+			return fmt.Errorf("canary soak interrupted: %v", ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rollout
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseBatches(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    string
+		want    []Batch
+		wantErr bool
+	}{
+		{
+			name: "default",
+			spec: DefaultBatches,
+			want: []Batch{{Count: 1}, {Percent: 10}, {Percent: 100}},
+		},
+		{
+			name: "whitespace",
+			spec: " 2 , 50% ",
+			want: []Batch{{Count: 2}, {Percent: 50}},
+		},
+		{
+			name:    "zero count",
+			spec:    "0,100%",
+			wantErr: true,
+		},
+		{
+			name:    "percent out of range",
+			spec:    "1,101%",
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			spec:    "1,foo",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			spec:    "",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseBatches(tc.spec)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error: %v (want error: %v)", err, tc.wantErr)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected batches (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		n       int
+		batches []Batch
+		want    [][]int
+	}{
+		{
+			name:    "1, 10%, all of 20",
+			n:       20,
+			batches: []Batch{{Count: 1}, {Percent: 10}, {Percent: 100}},
+			want: [][]int{
+				{0},
+				{1},
+				{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19},
+			},
+		},
+		{
+			name:    "empty batches dropped",
+			n:       3,
+			batches: []Batch{{Count: 1}, {Percent: 10}, {Percent: 50}},
+			want:    [][]int{{0}, {1}, {2}},
+		},
+		{
+			name:    "remainder added",
+			n:       4,
+			batches: []Batch{{Count: 1}},
+			want:    [][]int{{0}, {1, 2, 3}},
+		},
+		{
+			name:    "count larger than fleet",
+			n:       2,
+			batches: []Batch{{Count: 5}},
+			want:    [][]int{{0, 1}},
+		},
+		{
+			name:    "no clusters",
+			n:       0,
+			batches: []Batch{{Count: 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, Split(tc.n, tc.batches)); d != "" {
+				t.Errorf("Unexpected split (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestCanaryHaltsOnFailure(t *testing.T) {
+	c := &Canary{Batches: []Batch{{Count: 1}, {Count: 3}, {Percent: 100}}}
+
+	var called []int
+	err := c.Run(context.Background(), 6, func(i int) error {
+		called = append(called, i)
+		if i == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected rollout to fail")
+	}
+	// Second batch is completed but third is never started.
+	if d := cmp.Diff([]int{0, 1, 2}, called); d != "" {
+		t.Errorf("Unexpected clusters rolled out (-want +got):\n%s", d)
+	}
+
+	called = nil
+	if err := c.Run(context.Background(), 6, func(i int) error {
+		called = append(called, i)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := cmp.Diff([]int{0, 1, 2, 3, 4, 5}, called); d != "" {
+		t.Errorf("Unexpected clusters rolled out (-want +got):\n%s", d)
+	}
+}
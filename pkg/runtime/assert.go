@@ -0,0 +1,269 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// testOutcomeKey is the thread local set to *assertErr or *skipErr by test
+// built-ins ending a test, as errors of built-ins reach the test runner
+// wrapped in *starlark.EvalError.
+const testOutcomeKey = "isopod_test_outcome"
+
+type assertErr struct {
+	err error
+}
+
+func (e *assertErr) Error() string {
+	return e.err.Error()
+}
+
+type skipErr struct {
+	reason string
+}
+
+func (e *skipErr) Error() string {
+	return "test skipped: " + e.reason
+}
+
+// endTest records err as the outcome of the test run by t and returns it.
+func endTest(t *starlark.Thread, err error) error {
+	t.SetLocal(testOutcomeKey, err)
+	return err
+}
+
+// assertFailed ends the test run by t with failure of assertion name (with
+// optional user msg). details are appended on new lines.
+func assertFailed(t *starlark.Thread, name, msg, details string) error {
+	res := fmt.Sprintf("%v: %s failed", t.CallFrame(1).Pos, name)
+	if msg != "" {
+		res += ": " + msg
+	}
+	if details != "" {
+		res += "\n" + details
+	}
+	return endTest(t, &assertErr{errors.New(res)})
+}
+
+// assertModule is the `assert' built-in of tests. It may be called as a
+// function, assert(cond, msg), and has methods with richer failure output:
+//
+//	assert.eq(got, want, msg?)
+//	assert.ne(got, other, msg?)
+//	assert.contains(container, item, msg?)
+//	assert.matches(s, pattern, msg?)
+type assertModule struct {
+	attrs starlark.StringDict
+}
+
+var (
+	_ starlark.Callable = (*assertModule)(nil)
+	_ starlark.HasAttrs = (*assertModule)(nil)
+)
+
+func newAssertModule() *assertModule {
+	return &assertModule{
+		attrs: starlark.StringDict{
+			"eq":       starlark.NewBuiltin("assert.eq", assertEqFn),
+			"ne":       starlark.NewBuiltin("assert.ne", assertNeFn),
+			"contains": starlark.NewBuiltin("assert.contains", assertContainsFn),
+			"matches":  starlark.NewBuiltin("assert.matches", assertMatchesFn),
+		},
+	}
+}
+
+func (m *assertModule) Name() string          { return "assert" }
+func (m *assertModule) String() string        { return "<built-in function assert>" }
+func (m *assertModule) Type() string          { return "builtin_function_or_method" }
+func (m *assertModule) Freeze()               { m.attrs.Freeze() }
+func (m *assertModule) Truth() starlark.Bool  { return starlark.True }
+func (m *assertModule) Hash() (uint32, error) { return starlark.String(m.Name()).Hash() }
+
+func (m *assertModule) Attr(name string) (starlark.Value, error) {
+	return m.attrs[name], nil
+}
+
+func (m *assertModule) AttrNames() []string {
+	return m.attrs.Keys()
+}
+
+// CallInternal implements starlark.Callable for assert(cond, msg).
+func (m *assertModule) CallInternal(t *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var cond bool
+	var msg string
+	if err := starlark.UnpackPositionalArgs(m.Name(), args, kwargs, 1, &cond, &msg); err != nil {
+		return nil, err
+	}
+	if !cond {
+		res := fmt.Sprintf("%v: assertion failed", t.CallFrame(1).Pos)
+		if msg != "" {
+			res += ": " + msg
+		}
+		return nil, endTest(t, &assertErr{errors.New(res)})
+	}
+	return starlark.None, nil
+}
+
+func assertEqFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var got, want starlark.Value
+	var msg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "got", &got, "want", &want, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	eq, err := starlark.Equal(got, want)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if !eq {
+		return nil, assertFailed(t, b.Name(), msg, wantGot(want, got))
+	}
+	return starlark.None, nil
+}
+
+func assertNeFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var got, other starlark.Value
+	var msg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "got", &got, "other", &other, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	eq, err := starlark.Equal(got, other)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if eq {
+		return nil, assertFailed(t, b.Name(), msg, "Both: "+pretty(got, ""))
+	}
+	return starlark.None, nil
+}
+
+func assertContainsFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var container, item starlark.Value
+	var msg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "container", &container, "item", &item, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	in, err := starlark.Binary(syntax.IN, item, container)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if !in.Truth() {
+		return nil, assertFailed(t, b.Name(), msg, fmt.Sprintf("Want: %s\nIn: %s", pretty(item, ""), pretty(container, "")))
+	}
+	return starlark.None, nil
+}
+
+func assertMatchesFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s, pattern, msg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "s", &s, "pattern", &pattern, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: invalid pattern `%s': %v", b.Name(), pattern, err)
+	}
+	if !re.MatchString(s) {
+		return nil, assertFailed(t, b.Name(), msg, fmt.Sprintf("Want match of: %s\nGot: %s", pattern, pretty(starlark.String(s), "")))
+	}
+	return starlark.None, nil
+}
+
+// failFn is the `fail' built-in of tests failing the test with msg.
+func failFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var msg string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0, &msg); err != nil {
+		return nil, err
+	}
+	if msg == "" {
+		msg = "test failed"
+	}
+	return nil, endTest(t, &assertErr{fmt.Errorf("%v: %s", t.CallFrame(1).Pos, msg)})
+}
+
+// skipFn is the `skip' built-in of tests skipping the rest of the test.
+func skipFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var reason string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0, &reason); err != nil {
+		return nil, err
+	}
+	return nil, endTest(t, &skipErr{reason: reason})
+}
+
+// wantGot returns want and got values side by side, or their unified diff if
+// either spans multiple lines.
+func wantGot(want, got starlark.Value) string {
+	w, g := pretty(want, ""), pretty(got, "")
+	// Multi-line strings are compared line by line.
+	ws, wok := want.(starlark.String)
+	gs, gok := got.(starlark.String)
+	if wok && gok && (strings.Contains(string(ws), "\n") || strings.Contains(string(gs), "\n")) {
+		w, g = string(ws), string(gs)
+	}
+	if !strings.Contains(w, "\n") && !strings.Contains(g, "\n") {
+		return fmt.Sprintf("Want: %s\nGot: %s", w, g)
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(strings.TrimSuffix(w, "\n")),
+		B:        difflib.SplitLines(strings.TrimSuffix(g, "\n")),
+		FromFile: "want",
+		ToFile:   "got",
+		Context:  3,
+	})
+	return strings.TrimSuffix(diff, "\n")
+}
+
+// maxPrettyLine is the length of values rendered on a single line by pretty.
+const maxPrettyLine = 60
+
+// pretty renders v with lists, tuples and dicts longer than maxPrettyLine
+// split one element per line, indented by indent.
+func pretty(v starlark.Value, indent string) string {
+	s := v.String()
+	if len(s) <= maxPrettyLine {
+		return s
+	}
+	inner := indent + "    "
+	var b strings.Builder
+	switch v := v.(type) {
+	case *starlark.List:
+		b.WriteString("[\n")
+		for i := 0; i < v.Len(); i++ {
+			fmt.Fprintf(&b, "%s%s,\n", inner, pretty(v.Index(i), inner))
+		}
+		b.WriteString(indent + "]")
+	case starlark.Tuple:
+		b.WriteString("(\n")
+		for _, e := range v {
+			fmt.Fprintf(&b, "%s%s,\n", inner, pretty(e, inner))
+		}
+		b.WriteString(indent + ")")
+	case *starlark.Dict:
+		b.WriteString("{\n")
+		for _, kv := range v.Items() {
+			fmt.Fprintf(&b, "%s%s: %s,\n", inner, kv[0], pretty(kv[1], inner))
+		}
+		b.WriteString(indent + "}")
+	default:
+		return s
+	}
+	return b.String()
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestAssert(t *testing.T) {
+	for _, tc := range []struct {
+		name, expr string
+		wantErr    string
+	}{
+		{
+			name: "Assert",
+			expr: `assert(1 + 1 == 2, "math")`,
+		},
+		{
+			name:    "Assert failed",
+			expr:    `assert(1 + 1 == 3, "math")`,
+			wantErr: "Assert_failed:1:7: assertion failed: math",
+		},
+		{
+			name: "Equal",
+			expr: `assert.eq({"a": [1, 2]}, {"a": [1, 2]})`,
+		},
+		{
+			name:    "Not equal",
+			expr:    `assert.eq(1, 2, "values")`,
+			wantErr: "Not_equal:1:10: assert.eq failed: values\nWant: 2\nGot: 1",
+		},
+		{
+			name: "Not equal multi-line string",
+			expr: `assert.eq("a\nb\nc\n", "a\nB\nc\n")`,
+			wantErr: `Not_equal_multi-line_string:1:10: assert.eq failed
+--- want
++++ got
+@@ -1,3 +1,3 @@
+ a
+-B
++b
+ c`,
+		},
+		{
+			name: "Not equal dict",
+			expr: `assert.eq({"name": "ingress", "replicas": 3, "image": "gcr.io/google-containers/nginx:1.19.10"}, {"name": "ingress", "replicas": 2, "image": "gcr.io/google-containers/nginx:1.19.10"})`,
+			wantErr: `Not_equal_dict:1:10: assert.eq failed
+--- want
++++ got
+@@ -1,5 +1,5 @@
+ {
+     "name": "ingress",
+-    "replicas": 2,
++    "replicas": 3,
+     "image": "gcr.io/google-containers/nginx:1.19.10",
+ }`,
+		},
+		{
+			name:    "Same",
+			expr:    `assert.ne([1], [1])`,
+			wantErr: "Same:1:10: assert.ne failed\nBoth: [1]",
+		},
+		{
+			name: "Contains",
+			expr: `[assert.contains([1, 2], 2), assert.contains("foobar", "oba"), assert.contains({"a": 1}, "a")]`,
+		},
+		{
+			name:    "Doesn't contain",
+			expr:    `assert.contains(["a", "b"], "c", "letters")`,
+			wantErr: "Doesn't_contain:1:16: assert.contains failed: letters\nWant: \"c\"\nIn: [\"a\", \"b\"]",
+		},
+		{
+			name:    "Not a container",
+			expr:    `assert.contains(1, 2)`,
+			wantErr: "<assert.contains>: unknown binary op: int in int",
+		},
+		{
+			name: "Matches",
+			expr: `assert.matches("nginx:1.19", "^nginx:1\\.[0-9]+$")`,
+		},
+		{
+			name:    "Doesn't match",
+			expr:    `assert.matches("nginx:latest", "^nginx:1\\.[0-9]+$")`,
+			wantErr: "Doesn't_match:1:15: assert.matches failed\nWant match of: ^nginx:1\\.[0-9]+$\nGot: \"nginx:latest\"",
+		},
+		{
+			name:    "Invalid pattern",
+			expr:    `assert.matches("nginx", "(")`,
+			wantErr: "<assert.matches>: invalid pattern `(': error parsing regexp: missing closing ): `(`",
+		},
+		{
+			name:    "Fail",
+			expr:    `fail("not implemented")`,
+			wantErr: "Fail:1:5: not implemented",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{
+				"assert": newAssertModule(),
+				"fail":   starlark.NewBuiltin("fail", failFn),
+			}
+			_, _, err := util.Eval(t.Name()[len("TestAssert/"):], tc.expr, nil, pkgs)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+		})
+	}
+}
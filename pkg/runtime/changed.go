@@ -0,0 +1,84 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/cruise-automation/isopod/pkg/dep"
+)
+
+// changedSet is a set of absolute paths of files changed in a git repo.
+type changedSet map[string]bool
+
+// gitChangedFiles returns files changed in the git repo containing dir
+// relative to base ref: files changed since the merge base of base and HEAD,
+// uncommitted changes and untracked files.
+func gitChangedFiles(dir, base string) (changedSet, error) {
+	root, err := dep.Git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root = strings.TrimSpace(root)
+
+	changed := changedSet{}
+	for _, args := range [][]string{
+		{"diff", "--name-only", base + "...HEAD"},
+		{"diff", "--name-only", "HEAD"},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		out, err := dep.Git(root, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range strings.Split(out, "\n") {
+			if f = strings.TrimSpace(f); f != "" {
+				changed[filepath.Join(root, f)] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// affects returns the first of files (or directories) that is changed or
+// contains a changed file.
+func (c changedSet) affects(files []string) (string, bool) {
+	for _, f := range files {
+		f = realPath(f)
+		if c[f] {
+			return f, true
+		}
+		prefix := f + string(filepath.Separator)
+		for p := range c {
+			if strings.HasPrefix(p, prefix) {
+				return f, true
+			}
+		}
+	}
+	return "", false
+}
+
+// realPath returns absolute path of f with symlinks evaluated (so that it
+// matches paths reported by git).
+func realPath(f string) string {
+	if abs, err := filepath.Abs(f); err == nil {
+		f = abs
+	}
+	if p, err := filepath.EvalSymlinks(f); err == nil {
+		f = p
+	}
+	return f
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/dep"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+var changedOnlyRepo = map[string]string{
+	"main.ipd": `
+def clusters(ctx):
+    return []
+
+def addons(ctx):
+    return [addon("a", "a.ipd", ctx), addon("b", "b/b.ipd", ctx)]
+`,
+	"a.ipd": `
+def install(ctx):
+    pass
+
+def chart(ctx):
+    helm.apply(release_name="a", chart="charts/a")
+`,
+	"charts/a/Chart.yaml": "name: a\nversion: 0.1.0\n",
+	"b/b.ipd": `
+load("../lib/lib.star", "X")
+
+def install(ctx):
+    pass
+`,
+	"lib/lib.star": "X = 1\n",
+}
+
+func TestChangedOnly(t *testing.T) {
+	if _, err := osexec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		changed string
+		want    []string
+	}{
+		{
+			name: "Nothing changed",
+		},
+		{
+			name:    "Loaded module",
+			changed: "lib/lib.star",
+			want:    []string{"b"},
+		},
+		{
+			name:    "New chart file",
+			changed: "charts/a/values.yaml",
+			want:    []string{"a"},
+		},
+		{
+			name:    "Entry file",
+			changed: "main.ipd",
+			want:    []string{"a", "b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for f, data := range changedOnlyRepo {
+				writeFile(t, filepath.Join(dir, f), data)
+			}
+			for _, args := range [][]string{
+				{"init"},
+				{"add", "."},
+				{"-c", "user.name=isopod", "-c", "user.email=isopod@example.com", "commit", "-m", "first"},
+			} {
+				if _, err := dep.Git(dir, args...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.changed != "" {
+				writeFile(t, filepath.Join(dir, tc.changed), changedOnlyRepo[tc.changed]+"# changed\n")
+			}
+
+			var got []string
+			r, err := New(&Config{
+				EntryFile: filepath.Join(dir, "main.ipd"),
+				UserAgent: "Isopod",
+				Store:     store.NoopStore{},
+			},
+				WithPredeclared("helm", &isopod.Module{Name: "helm"}),
+				WithChangedOnly("HEAD"),
+				WithEventHandler(func(e *Event) {
+					if e.Type == RolloutStarted {
+						got = e.Addons
+					}
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(ctx, InstallCommand, addon.NewCtx()); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected addons run (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
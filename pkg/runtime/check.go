@@ -0,0 +1,345 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/modules"
+)
+
+// Problem is a problem found by Check.
+type Problem struct {
+	// Pos is where the problem is (invalid if not known).
+	Pos syntax.Position
+	Msg string
+}
+
+// String returns the problem prefixed with its position (if known).
+func (p Problem) String() string {
+	if !p.Pos.IsValid() {
+		return p.Msg
+	}
+	return fmt.Sprintf("%s: %s", p.Pos, p.Msg)
+}
+
+// addonHooks are functions of addon modules called with ctx and whether
+// addons must define them.
+var addonHooks = []struct {
+	name     string
+	required bool
+}{
+	{name: "install", required: true},
+	{name: "remove"},
+	{name: "verify"},
+}
+
+// Check validates the entry file of c (and those set by
+// WithExtraEntryFiles) and addons they return without connecting to clusters
+// or Vault, which are faked. It checks that:
+//   - entry files and modules they load load,
+//   - ClustersStarFunc and AddonsStarFunc are functions taking ctx,
+//   - ClustersStarFunc called with userCtx returns a list of clusters,
+//   - AddonsStarFunc called with ctx of each cluster returns a list of addons
+//     with unique names,
+//   - addon modules exist and load,
+//   - install (required), remove and verify functions of addons take ctx,
+//   - fields of ctx read by them (`ctx.<field>') are set by the addon.
+//
+// Problems are returned in the order they are found. Entry files that
+// failed to load aren't checked further.
+func Check(ctx context.Context, c *Config, userCtx map[string]string, opts ...Option) ([]Problem, error) {
+	pkgs, closeFn, err := fakePkgs(filepath.Dir(c.EntryFile), modules.NewFakeClock(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+	var pkgOpts []Option
+	for n, pkg := range pkgs {
+		pkgOpts = append(pkgOpts, WithPredeclared(n, pkg))
+	}
+	rt, err := New(c, append(pkgOpts, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	r := rt.(*runtime)
+
+	ch := &checker{ctx: ctx, root: r.workspaceRoot, seen: map[string]bool{}, checked: map[*addon.Addon]bool{}}
+	if err := r.Load(ctx); err != nil {
+		ch.addErr(syntax.Position{}, err)
+		return ch.problems, nil
+	}
+	for _, e := range r.entries {
+		ch.checkEntry(e, userCtx)
+	}
+	return ch.problems, nil
+}
+
+// checker collects problems found by Check.
+type checker struct {
+	ctx      context.Context
+	problems []Problem
+	// root is the workspace root of the checked runtime.
+	root string
+	// seen are problems already found (e.g with addons of other clusters).
+	seen map[string]bool
+	// checked are addons already checked.
+	checked map[*addon.Addon]bool
+}
+
+func (ch *checker) add(pos syntax.Position, format string, args ...interface{}) {
+	p := Problem{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	if ch.seen[p.String()] {
+		return
+	}
+	ch.seen[p.String()] = true
+	ch.problems = append(ch.problems, p)
+}
+
+// addErr adds problems of Starlark err, positioned where Starlark reports
+// them or at pos otherwise.
+func (ch *checker) addErr(pos syntax.Position, err error) {
+	var loadErr *LoadError
+	if errors.As(err, &loadErr) {
+		err = loadErr.Err
+	}
+	switch e := err.(type) {
+	case resolve.ErrorList:
+		for _, re := range e {
+			ch.add(re.Pos, "%s", re.Msg)
+		}
+	case syntax.Error:
+		ch.add(e.Pos, "%s", e.Msg)
+	case *starlark.EvalError:
+		// Innermost frame that isn't a built-in.
+		for i := 0; i < len(e.CallStack); i++ {
+			if p := e.CallStack.At(i).Pos; p.IsValid() && p.Filename() != "<builtin>" {
+				pos = p
+				break
+			}
+		}
+		ch.add(pos, "%s", e.Msg)
+	default:
+		ch.add(pos, "%v", err)
+	}
+}
+
+// call calls fnName of e with ctx as runtime does but keeps positions of
+// Starlark errors. Returns false if fnName is missing or failed.
+func (ch *checker) call(e *entry, fnName string, ctx starlark.Value) (starlark.Value, bool) {
+	fn, ok := ch.hook(syntax.MakePosition(&e.file, 0, 0), e.globals[fnName], fnName, fmt.Sprintf("entry file `%s'", e.file), true)
+	if !ok {
+		return nil, false
+	}
+	thread := &starlark.Thread{Print: func(*starlark.Thread, string) {}}
+	thread.SetLocal("context", ch.ctx)
+	thread.SetLocal(addon.WorkspaceRootKey, ch.root)
+	v, err := starlark.Call(thread, fn, starlark.Tuple{ctx}, nil)
+	if err != nil {
+		ch.addErr(fnPos(fn), fmt.Errorf("%s(ctx) failed: %v", fnName, err))
+		return nil, false
+	}
+	return v, true
+}
+
+// hook returns v, the global name of owner (declared at pos, nil if not
+// defined), if it is a function taking ctx.
+func (ch *checker) hook(pos syntax.Position, v starlark.Value, name, owner string, required bool) (starlark.Callable, bool) {
+	if v == nil {
+		if required {
+			ch.add(pos, "%s doesn't define `%s(ctx)'", owner, name)
+		}
+		return nil, false
+	}
+	fn, ok := v.(starlark.Callable)
+	if !ok {
+		ch.add(pos, "`%s' of %s must be a function taking ctx (got a %s)", name, owner, v.Type())
+		return nil, false
+	}
+	if f, ok := fn.(*starlark.Function); ok && f.NumParams()-f.NumKwonlyParams() < 1 && !f.HasVarargs() {
+		ch.add(f.Position(), "`%s' of %s must take ctx (e.g `def %s(ctx):')", name, owner, name)
+		return nil, false
+	}
+	return fn, true
+}
+
+// fnPos returns position of Starlark function fn (if known).
+func fnPos(fn starlark.Callable) syntax.Position {
+	if f, ok := fn.(*starlark.Function); ok {
+		return f.Position()
+	}
+	return syntax.Position{}
+}
+
+// checkEntry checks functions of entry e and addons it returns for each
+// cluster.
+func (ch *checker) checkEntry(e *entry, userCtx map[string]string) {
+	if err := e.schema.validate(userCtx); err != nil {
+		ch.add(syntax.Position{}, "`%s': %v", e.file, err)
+		return
+	}
+	addonsFn, ok := ch.hook(syntax.MakePosition(&e.file, 0, 0), e.globals[AddonsStarFunc], AddonsStarFunc, fmt.Sprintf("entry file `%s'", e.file), true)
+	ret, clustersOK := ch.call(e, ClustersStarFunc, goMapToSkyCtx(userCtx))
+	if !ok || !clustersOK {
+		return
+	}
+	clustersPos := fnPos(e.globals[ClustersStarFunc].(starlark.Callable))
+	clusters, ok := ret.(*starlark.List)
+	if !ok {
+		ch.add(clustersPos, "%s(ctx) must return a list of clusters (got a %s)", ClustersStarFunc, ret.Type())
+		return
+	}
+
+	var vendors []cloud.KubernetesVendor
+	for i := 0; i < clusters.Len(); i++ {
+		v := clusters.Index(i)
+		vendor, ok := v.(cloud.KubernetesVendor)
+		if !ok {
+			ch.add(clustersPos, "%s(ctx) item %d must be a cluster, e.g gke() or onprem() (got a %s)", ClustersStarFunc, i, v.Type())
+			continue
+		}
+		vendors = append(vendors, vendor)
+	}
+
+	for _, vendor := range vendors {
+		ret, ok := ch.call(e, AddonsStarFunc, withProfile(vendor.AddonSkyCtx(userCtx), e.profile))
+		if !ok {
+			continue
+		}
+		addons, ok := ret.(*starlark.List)
+		if !ok {
+			ch.add(fnPos(addonsFn), "%s(ctx) must return a list of addons (got a %s)", AddonsStarFunc, ret.Type())
+			continue
+		}
+		names := map[string]bool{}
+		for j := 0; j < addons.Len(); j++ {
+			v := addons.Index(j)
+			a, ok := v.(*addon.Addon)
+			if !ok {
+				ch.add(fnPos(addonsFn), "%s(ctx) item %d must be an addon() (got a %s)", AddonsStarFunc, j, v.Type())
+				continue
+			}
+			if names[a.Name] {
+				ch.add(a.Pos(), "addon `%s' is returned more than once", a.Name)
+			}
+			names[a.Name] = true
+			ch.checkAddon(a)
+		}
+	}
+}
+
+// checkAddon checks that a loads and its hooks take ctx and only read fields
+// of ctx it sets.
+func (ch *checker) checkAddon(a *addon.Addon) {
+	if ch.checked[a] {
+		return
+	}
+	ch.checked[a] = true
+
+	owner := fmt.Sprintf("addon `%s'", a.Name)
+	if _, err := os.Stat(a.Path()); os.IsNotExist(err) {
+		ch.add(a.Pos(), "%s: module `%s' does not exist", owner, a.Path())
+		return
+	}
+	if err := a.Load(ch.ctx); err != nil {
+		ch.addErr(a.Pos(), err)
+		return
+	}
+	for _, h := range addonHooks {
+		v, _ := a.Global(h.name)
+		fn, ok := ch.hook(a.Pos(), v, h.name, owner, h.required)
+		if !ok {
+			continue
+		}
+		f, ok := fn.(*starlark.Function)
+		if !ok {
+			continue
+		}
+		for _, dot := range ctxReads(a.Path(), f) {
+			if _, ok := a.Ctx()[dot.Name.Name]; ok || dot.Name.Name == "get" || dot.Name.Name == "addon_version" {
+				continue
+			}
+			ch.add(dot.Name.NamePos, "%s doesn't set `%s' in its ctx (`%s.%s' is None)", owner, dot.Name.Name, dot.X.(*syntax.Ident).Name, dot.Name.Name)
+		}
+	}
+}
+
+// ctxReads returns reads of fields of the ctx parameter (`ctx.<field>') in
+// the body of fn defined in module at path, except of fields tested with
+// hasattr(ctx, "<field>"). Returns nil if fn isn't defined in the module.
+func ctxReads(path string, fn *starlark.Function) []*syntax.DotExpr {
+	if filepath.Base(fn.Position().Filename()) != filepath.Base(path) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	f, err := syntax.Parse(fn.Position().Filename(), data, 0)
+	if err != nil {
+		return nil
+	}
+	param, _ := fn.Param(0)
+
+	var reads []*syntax.DotExpr
+	for _, stmt := range f.Stmts {
+		def, ok := stmt.(*syntax.DefStmt)
+		if !ok || def.Name.Name != fn.Name() || def.Def.Line != fn.Position().Line {
+			continue
+		}
+		tested := map[string]bool{}
+		for _, s := range def.Body {
+			syntax.Walk(s, func(n syntax.Node) bool {
+				switch n := n.(type) {
+				case *syntax.DotExpr:
+					if id, ok := n.X.(*syntax.Ident); ok && id.Name == param {
+						reads = append(reads, n)
+					}
+				case *syntax.CallExpr:
+					if id, ok := n.Fn.(*syntax.Ident); ok && id.Name == "hasattr" && len(n.Args) == 2 {
+						x, ok := n.Args[0].(*syntax.Ident)
+						lit, isLit := n.Args[1].(*syntax.Literal)
+						if ok && isLit && x.Name == param {
+							if s, ok := lit.Value.(string); ok {
+								tested[s] = true
+							}
+						}
+					}
+				}
+				return true
+			})
+		}
+		var untested []*syntax.DotExpr
+		for _, r := range reads {
+			if !tested[r.Name.Name] {
+				untested = append(untested, r)
+			}
+		}
+		return untested
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "Valid",
+			files: map[string]string{
+				"main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev")]
+
+def addons(ctx):
+    return [addon("ok", "ok.ipd", ctx={"namespace": "default"})]
+`,
+				"ok.ipd": `
+def install(ctx):
+    print(ctx.namespace, ctx.get("replicas", 1))
+
+def remove(ctx):
+    pass
+`,
+			},
+		},
+		{
+			name: "Entry file",
+			files: map[string]string{
+				"main.ipd": `
+def clusters():
+    return []
+
+addons = []
+`,
+			},
+			want: []string{
+				"main.ipd: `addons' of entry file `main.ipd' must be a function taking ctx (got a list)",
+				"main.ipd:2:1: `clusters' of entry file `main.ipd' must take ctx (e.g `def clusters(ctx):')",
+			},
+		},
+		{
+			name: "Load failure",
+			files: map[string]string{
+				"main.ipd": `
+load("lib.star", "helper")
+
+def clusters(ctx):
+    return []
+`,
+			},
+			want: []string{
+				"main.ipd:2:1: cannot load lib.star: lstat lib.star: no such file or directory",
+			},
+		},
+		{
+			name: "Clusters and addons",
+			files: map[string]string{
+				"main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev"), "prod"]
+
+def addons(ctx):
+    return [
+        addon("ok", "ok.ipd", ctx={"namespace": "default"}),
+        addon("missing", "missing.ipd"),
+        addon("broken", "broken.ipd"),
+        addon("no-install", "no_install.ipd"),
+        addon("ok", "ok.ipd", ctx={"namespace": "default"}),
+        "nginx",
+    ]
+`,
+				"ok.ipd": `
+def install(ctx):
+    if hasattr(ctx, "replicas"):
+        print(ctx.replicas)
+    print(ctx.namespace, ctx.namepsace)
+`,
+				"broken.ipd": `
+load("lib.star", "helper")
+
+def install(ctx):
+    pass
+`,
+				"no_install.ipd": `
+def remove():
+    pass
+`,
+			},
+			want: []string{
+				"main.ipd:2:1: clusters(ctx) item 1 must be a cluster, e.g gke() or onprem() (got a string)",
+				"ok.ipd:5:30: addon `ok' doesn't set `namepsace' in its ctx (`ctx.namepsace' is None)",
+				"main.ipd:8:14: addon `missing': module `missing.ipd' does not exist",
+				"broken.ipd:2:1: cannot load lib.star: lstat lib.star: no such file or directory",
+				"main.ipd:10:14: addon `no-install' doesn't define `install(ctx)'",
+				"no_install.ipd:2:1: `remove' of addon `no-install' must take ctx (e.g `def remove(ctx):')",
+				"main.ipd:11:14: addon `ok' is returned more than once",
+				"main.ipd:5:1: addons(ctx) item 5 must be an addon() (got a string)",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for f, data := range tc.files {
+				writeFile(t, filepath.Join(dir, f), data)
+			}
+			entry := filepath.Join(dir, "main.ipd")
+			problems, err := Check(context.Background(), &Config{EntryFile: entry, UserAgent: "Isopod"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range problems {
+				s := p.String()
+				s = strings.ReplaceAll(s, dir+"/", "")
+				got = append(got, s)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected problems (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -35,6 +35,11 @@ type Config struct {
 	// Kubernetes masters.
 	UserAgent string
 
+	// Version is the version of Isopod entry files pinning versions with
+	// IsopodVersionFunc are checked against. Checks are skipped if it is
+	// empty or not a semantic version.
+	Version string
+
 	// KubeConfigPath is the path to the kubeconfig file on the local machine.
 	// It is used to authenticate with self-managed or on-premise Kubernetes.
 	KubeConfigPath string
@@ -46,7 +51,8 @@ type Config struct {
 
 	// Force is true if the -force flag is set and will delete and recreate
 	// immutable resources without confirmation. By default Force is disabled
-	// and will error in case an immutable resource is being updated.
+	// and will error in case an immutable resource is being updated. Addons
+	// and kube.put calls setting `force' override it.
 	Force bool
 
 	// Store is the storage to keep all rollout status.
@@ -0,0 +1,62 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+// WithFailureDiagnostics returns an Option that appends recent Kubernetes
+// Events related to objects touched by a failed addon to its error (and
+// trailing logs of unhealthy pods if podLogs is set).
+func WithFailureDiagnostics(podLogs bool) Option {
+	return fnOption(func(opts *options) error {
+		opts.diagnose = true
+		opts.diagPodLogs = podLogs
+		return nil
+	})
+}
+
+// diagnoser returns kube.Diagnoser of the kube package if diagnostics are
+// enabled (nil otherwise). Nothing is applied in dry run so there is nothing
+// to diagnose either.
+func (r *runtime) diagnoser() kube.Diagnoser {
+	if !r.diagnose || r.dryrun {
+		return nil
+	}
+	d, _ := r.pkgs["kube"].(kube.Diagnoser)
+	return d
+}
+
+// withDiagnostics appends diagnostics collected by d to addon error err.
+func (r *runtime) withDiagnostics(ctx context.Context, d kube.Diagnoser, err error) error {
+	if d == nil {
+		return err
+	}
+	report, dErr := d.Diagnose(ctx, r.diagPodLogs)
+	if dErr != nil {
+		log.Warningf("Failed to collect failure diagnostics: %v", dErr)
+		return err
+	}
+	if report == "" {
+		return err
+	}
+	return fmt.Errorf("%w\n%s", err, report)
+}
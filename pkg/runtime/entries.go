@@ -0,0 +1,352 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/cloud/incluster"
+)
+
+// inCluster returns true if Isopod runs in a cluster (replaced by tests).
+var inCluster = incluster.Detected
+
+// entry is an entry file of the runtime.
+type entry struct {
+	file     string
+	pkgs     starlark.StringDict
+	schema   *contextSchema
+	profiles *profiles
+	globals  starlark.StringDict
+	// profile are values of the selected profile (nil if none).
+	profile *starlark.Dict
+}
+
+// WithExtraEntryFiles returns an Option that merges entry files with the one
+// of runtime.Config: ForEachCluster iterates through clusters returned by
+// all of them (each cluster once, clusters of the same name must be defined
+// the same) and Run runs addons of all entry files that returned the cluster
+// (addon names must be unique across entry files).
+func WithExtraEntryFiles(files ...string) Option {
+	return fnOption(func(opts *options) error {
+		opts.extraEntryFiles = append(opts.extraEntryFiles, files...)
+		return nil
+	})
+}
+
+// ExpandEntryFiles returns entry files matched by args (paths or glob
+// patterns) in order, without duplicates.
+func ExpandEntryFiles(args []string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("invalid entry file pattern `%s': %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no entry file matches `%s'", arg)
+			}
+			sort.Strings(matches)
+		}
+		for _, m := range matches {
+			if !seen[filepath.Clean(m)] {
+				seen[filepath.Clean(m)] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// newEntries returns entries of entry file (with predeclared pkgs, schema and
+// profiles) and extra entry files. Each extra entry file gets its own addon
+// built-in (resolving addon paths relative to it), context schema and
+// profiles.
+func newEntries(file string, pkgs starlark.StringDict, schema *contextSchema, prof *profiles, extra []string) ([]*entry, error) {
+	entries := []*entry{{file: file, pkgs: pkgs, schema: schema, profiles: prof}}
+	seen := map[string]bool{}
+	for _, f := range append([]string{file}, extra...) {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			return nil, fmt.Errorf("entry file `%s' is given more than once", f)
+		}
+		seen[abs] = true
+	}
+
+	for _, f := range extra {
+		e := &entry{file: f, pkgs: make(starlark.StringDict, len(pkgs)), schema: &contextSchema{}, profiles: &profiles{}}
+		for n, pkg := range pkgs {
+			e.pkgs[n] = pkg
+		}
+		e.pkgs["addon"] = addon.NewAddonBuiltin(filepath.Dir(f), e.pkgs)
+		e.pkgs[ContextSchemaFunc] = e.schema.builtin()
+		e.pkgs[ProfilesFunc] = e.profiles.builtin()
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// addons returns addons returned by AddonsStarFunc of entries called with
+// skyCtx (merged with the selected profile of each entry).
+func (r *runtime) addons(ctx context.Context, entries []*entry, skyCtx starlark.Value) ([]starlark.Value, error) {
+	var addons []starlark.Value
+	names := map[string]string{}
+	for _, e := range entries {
+		eCtx := withProfile(skyCtx, e.profile)
+		if r.showCtx {
+			file := ""
+			if len(entries) > 1 {
+				file = e.file
+			}
+			if err := printCtx(os.Stdout, clusterOf(skyCtx), file, eCtx); err != nil {
+				log.Warningf("Failed to print ctx: %v", err)
+			}
+		}
+		ret, err := r.callStarlarkFunc(ctx, e, AddonsStarFunc, starlark.Tuple{eCtx})
+		if err != nil {
+			return nil, err
+		}
+		addonsList, ok := ret.(*starlark.List)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list (got a %s)", ret, ret.Type())
+		}
+		for i := 0; i < addonsList.Len(); i++ {
+			v := addonsList.Index(i)
+			if a, ok := v.(*addon.Addon); ok && len(entries) > 1 {
+				if f, ok := names[a.Name]; ok && f != e.file {
+					return nil, fmt.Errorf("addon `%s' is returned by both `%s' and `%s'", a.Name, f, e.file)
+				}
+				names[a.Name] = e.file
+			}
+			addons = append(addons, v)
+		}
+	}
+	return addons, nil
+}
+
+// target is a cluster returned by clusters functions of entry files.
+type target struct {
+	cluster starlark.Value
+	vendor  cloud.KubernetesVendor
+	files   []string
+}
+
+// entryCluster is a cluster passed to ForEachCluster callback by runtime
+// with multiple entry files.
+type entryCluster struct {
+	cloud.KubernetesVendor
+	files []string
+}
+
+// Unwrap returns the cluster returned by clusters functions.
+func (c *entryCluster) Unwrap() cloud.KubernetesVendor { return c.KubernetesVendor }
+
+// EntryFilesOf returns entry files whose clusters functions returned
+// k8sVendor passed to ForEachCluster by a runtime with extra entry files (see
+// WithExtraEntryFiles), nil for other runtimes.
+func EntryFilesOf(k8sVendor cloud.KubernetesVendor) []string {
+	if c, ok := k8sVendor.(*entryCluster); ok {
+		return c.files
+	}
+	return nil
+}
+
+// targets returns clusters returned by ClustersStarFunc of all entries called
+// with userCtx. If there are multiple entries, clusters of the same name are
+// merged (and must be defined the same).
+func (r *runtime) targets(ctx context.Context, userCtx map[string]string) ([]*target, error) {
+	if err := addon.CheckPaths(userCtx); err != nil {
+		return nil, err
+	}
+	var targets []*target
+	byName := map[string]*target{}
+	for _, e := range r.entries {
+		if err := e.schema.validate(userCtx); err != nil {
+			return nil, err
+		}
+
+		var ret starlark.Value
+		if _, ok := e.globals[ClustersStarFunc]; !ok && r.KubeConfigPath == "" && inCluster() {
+			// Isopod running in its target cluster (e.g as a Job) needs no
+			// clusters(ctx) nor kubeconfig.
+			log.Infof("`%s' doesn't define `%s(ctx)', targeting the cluster Isopod runs in", e.file, ClustersStarFunc)
+			ret = starlark.NewList([]starlark.Value{incluster.New()})
+		} else {
+			var err error
+			ret, err = r.callStarlarkFunc(ctx, e, ClustersStarFunc, starlark.Tuple{goMapToSkyCtx(userCtx)})
+			if err != nil {
+				return nil, fmt.Errorf("error when calling `clusters': %v ", err)
+			}
+		}
+
+		chosenClusters, ok := ret.(*starlark.List)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list (got a `%s')", ret, ret.Type())
+		}
+
+		for i := 0; i < chosenClusters.Len(); i++ {
+			cluster := chosenClusters.Index(i)
+			// Currently only supports GKE. Other vendors can easily be supported.
+			k8sVendor, ok := cluster.(cloud.KubernetesVendor)
+			if !ok {
+				var pos syntax.Position
+				if fn, ok := e.globals[ClustersStarFunc].(starlark.Callable); ok {
+					pos = fnPos(fn)
+				}
+				if !pos.IsValid() {
+					pos = syntax.MakePosition(&e.file, 0, 0)
+				}
+				return nil, fmt.Errorf("%v: %s(ctx) item %d must be a cluster, e.g gke() or onprem() (got a %s: %v)", pos, ClustersStarFunc, i, cluster.Type(), cluster)
+			}
+			if len(r.entries) > 1 {
+				// Clusters without a name are only merged if their
+				// definitions are the same.
+				name := cluster.String()
+				if n, ok := k8sVendor.AddonSkyCtx(userCtx).Attrs["cluster"].(starlark.String); ok {
+					name = string(n)
+				}
+				if t, ok := byName[name]; ok {
+					if t.cluster.String() != cluster.String() {
+						return nil, fmt.Errorf("cluster `%s' is defined differently by `%s' (%v) and `%s' (%v)", name, t.files[0], t.cluster, e.file, cluster)
+					}
+					if t.files[len(t.files)-1] != e.file {
+						t.files = append(t.files, e.file)
+					}
+					continue
+				}
+				byName[name] = &target{cluster: cluster, vendor: k8sVendor, files: []string{e.file}}
+				targets = append(targets, byName[name])
+				continue
+			}
+			targets = append(targets, &target{cluster: cluster, vendor: k8sVendor, files: []string{e.file}})
+		}
+	}
+	return targets, nil
+}
+
+// ClusterError is an error returned by the ForEachCluster callback for a
+// cluster.
+type ClusterError struct {
+	Cluster string
+	Err     error
+}
+
+func (e *ClusterError) Error() string {
+	return fmt.Sprintf("cluster `%s': %v", e.Cluster, e.Err)
+}
+
+func (e *ClusterError) Unwrap() error {
+	return e.Err
+}
+
+// ClusterErrors are errors of all clusters the ForEachCluster callback failed
+// on, in iteration order.
+type ClusterErrors []*ClusterError
+
+func (errs ClusterErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is lets errors.Is match errors of any cluster (errors doesn't unwrap
+// multiple errors before Go 1.20).
+func (errs ClusterErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As lets errors.As find errors of any cluster, in iteration order.
+func (errs ClusterErrors) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runtime) ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor) error) error {
+	targets, err := r.targets(ctx, userCtx)
+	if err != nil {
+		return err
+	}
+	var errs ClusterErrors
+	for _, t := range targets {
+		clusterName := t.vendor.AddonSkyCtx(userCtx).Attrs["cluster"]
+		// Printed to stderr so that output of list and graph commands can be
+		// piped.
+		fmt.Fprintf(os.Stderr, "Current cluster: (%s)\n", clusterName)
+
+		if err := fn(r.vendorOf(t)); err != nil {
+			name := t.cluster.String()
+			if n, ok := clusterName.(starlark.String); ok {
+				name = string(n)
+			}
+			errs = append(errs, &ClusterError{Cluster: name, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Clusters returns clusters of all entry files ForEachCluster iterates
+// through, in the same order and wrapped the same way (see vendorOf), without
+// printing them or calling any callback.
+func (r *runtime) Clusters(ctx context.Context, userCtx map[string]string) ([]cloud.KubernetesVendor, error) {
+	targets, err := r.targets(ctx, userCtx)
+	if err != nil {
+		return nil, err
+	}
+	vendors := make([]cloud.KubernetesVendor, len(targets))
+	for i, t := range targets {
+		vendors[i] = r.vendorOf(t)
+	}
+	return vendors, nil
+}
+
+// vendorOf returns cluster of t passed to ForEachCluster callbacks.
+func (r *runtime) vendorOf(t *target) cloud.KubernetesVendor {
+	if len(r.entries) > 1 {
+		return &entryCluster{KubernetesVendor: t.vendor, files: t.files}
+	}
+	return t.vendor
+}
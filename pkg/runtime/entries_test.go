@@ -0,0 +1,307 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestExtraEntryFiles(t *testing.T) {
+	const addon = "def install(ctx):\n    pass\n"
+	for _, tc := range []struct {
+		name         string
+		files        map[string]string
+		wantClusters map[string][]string
+		wantAddons   map[string][]string
+		wantErr      string
+	}{
+		{
+			name: "Merged",
+			files: map[string]string{
+				"team-a/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev"), onprem(cluster="prod", env="prod")]
+
+def addons(ctx):
+    return [addon("ingress", "ingress.ipd", ctx)]
+`,
+				"team-a/ingress.ipd": addon,
+				"team-b/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev")]
+
+def addons(ctx):
+    return [addon("metrics", "metrics.ipd", ctx)]
+`,
+				"team-b/metrics.ipd": addon,
+			},
+			wantClusters: map[string][]string{
+				"dev":  {"team-a/main.ipd", "team-b/main.ipd"},
+				"prod": {"team-a/main.ipd"},
+			},
+			wantAddons: map[string][]string{
+				"dev":  {"ingress", "metrics"},
+				"prod": {"ingress"},
+			},
+		},
+		{
+			name: "Cluster conflict",
+			files: map[string]string{
+				"team-a/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev")]
+`,
+				"team-b/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="staging")]
+`,
+			},
+			wantErr: "cluster `dev' is defined differently",
+		},
+		{
+			name: "Addon conflict",
+			files: map[string]string{
+				"team-a/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev")]
+
+def addons(ctx):
+    return [addon("ingress", "ingress.ipd", ctx)]
+`,
+				"team-a/ingress.ipd": addon,
+				"team-b/main.ipd": `
+def clusters(ctx):
+    return [onprem(cluster="dev", env="dev")]
+
+def addons(ctx):
+    return [addon("ingress", "ingress.ipd", ctx)]
+`,
+				"team-b/ingress.ipd": addon,
+			},
+			wantErr: "addon `ingress' is returned by both",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for f, data := range tc.files {
+				writeFile(t, filepath.Join(dir, f), data)
+			}
+			files := []string{filepath.Join(dir, "team-a/main.ipd"), filepath.Join(dir, "team-b/main.ipd")}
+			rel := func(fs []string) []string {
+				var ret []string
+				for _, f := range fs {
+					r, err := filepath.Rel(dir, f)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ret = append(ret, filepath.ToSlash(r))
+				}
+				return ret
+			}
+			newRuntime := func(files []string) Runtime {
+				r, err := New(&Config{
+					EntryFile:      files[0],
+					UserAgent:      "Isopod",
+					KubeConfigPath: "kubeconfig",
+					Store:          store.NoopStore{},
+				}, WithExtraEntryFiles(files[1:]...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := r.Load(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				return r
+			}
+
+			ctx := context.Background()
+			gotClusters := map[string][]string{}
+			gotAddons := map[string][]string{}
+			var runErr error
+			err := newRuntime(files).ForEachCluster(ctx, nil, func(k8sVendor cloud.KubernetesVendor) error {
+				skyCtx := k8sVendor.AddonSkyCtx(nil)
+				cluster := string(skyCtx.Attrs["cluster"].(starlark.String))
+				gotClusters[cluster] = rel(EntryFilesOf(k8sVendor))
+
+				var addons []string
+				r, err := New(&Config{
+					EntryFile: EntryFilesOf(k8sVendor)[0],
+					UserAgent: "Isopod",
+					Store:     store.NoopStore{},
+				}, WithExtraEntryFiles(EntryFilesOf(k8sVendor)[1:]...), WithEventHandler(func(e *Event) {
+					if e.Type == RolloutStarted {
+						addons = e.Addons
+					}
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := r.Load(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if err := r.Run(ctx, ListCommand, skyCtx); err != nil && runErr == nil {
+					runErr = err
+				}
+				gotAddons[cluster] = addons
+				return nil
+			})
+			if err == nil {
+				err = runErr
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.wantClusters, gotClusters); d != "" {
+				t.Errorf("Unexpected clusters (-want, +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantAddons, gotAddons); d != "" {
+				t.Errorf("Unexpected addons (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestExtraEntryFilesServiceAccount(t *testing.T) {
+	dir := t.TempDir()
+	const main = `
+def clusters(ctx):
+    return [onprem(cluster="dev", service_account="infra/addons")]
+`
+	files := []string{filepath.Join(dir, "team-a/main.ipd"), filepath.Join(dir, "team-b/main.ipd")}
+	for _, f := range files {
+		writeFile(t, f, main)
+	}
+	r, err := New(&Config{
+		EntryFile:      files[0],
+		UserAgent:      "Isopod",
+		KubeConfigPath: "kubeconfig",
+		Store:          store.NoopStore{},
+	}, WithExtraEntryFiles(files[1:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := r.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*cloud.ServiceAccount
+	if err := r.ForEachCluster(ctx, nil, func(k8sVendor cloud.KubernetesVendor) error {
+		sa, err := cloud.ServiceAccountOf(k8sVendor, "isopod")
+		got = append(got, sa)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []*cloud.ServiceAccount{{Namespace: "infra", Name: "addons"}}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected service accounts (-want, +got):\n%s", d)
+	}
+}
+
+func TestExpandEntryFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"clusters/b.ipd", "clusters/a.ipd", "main.ipd"} {
+		writeFile(t, filepath.Join(dir, f), "")
+	}
+	got, err := ExpandEntryFiles([]string{
+		filepath.Join(dir, "main.ipd"),
+		filepath.Join(dir, "clusters/*.ipd"),
+		filepath.Join(dir, "clusters/a.ipd"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "main.ipd"),
+		filepath.Join(dir, "clusters/a.ipd"),
+		filepath.Join(dir, "clusters/b.ipd"),
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected entry files (-want, +got):\n%s", d)
+	}
+
+	if _, err := ExpandEntryFiles([]string{filepath.Join(dir, "teams/*.ipd")}); err == nil {
+		t.Error("Want error for pattern without matches, got nil")
+	}
+}
+
+func TestInClusterDefault(t *testing.T) {
+	defer func(f func() bool) { inCluster = f }(inCluster)
+	dir := t.TempDir()
+	entryFile := filepath.Join(dir, "main.ipd")
+	writeFile(t, entryFile, "def addons(ctx):\n    return []\n")
+
+	for _, tc := range []struct {
+		name           string
+		inCluster      bool
+		kubeConfigPath string
+		wantTypes      []string
+		wantErr        string
+	}{
+		{name: "In cluster", inCluster: true, wantTypes: []string{"incluster"}},
+		{name: "Out of cluster", wantErr: "no \"clusters\" function found"},
+		{name: "Kubeconfig", inCluster: true, kubeConfigPath: "kubeconfig", wantErr: "no \"clusters\" function found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inCluster = func() bool { return tc.inCluster }
+			r, err := New(&Config{
+				EntryFile:      entryFile,
+				UserAgent:      "Isopod",
+				KubeConfigPath: tc.kubeConfigPath,
+				Store:          store.NoopStore{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var gotTypes []string
+			err = r.ForEachCluster(ctx, nil, func(k8sVendor cloud.KubernetesVendor) error {
+				gotTypes = append(gotTypes, k8sVendor.(starlark.Value).Type())
+				return nil
+			})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.wantTypes, gotTypes); d != "" {
+				t.Errorf("Unexpected clusters (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
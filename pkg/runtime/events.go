@@ -0,0 +1,94 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+// EventType is the type of a progress Event.
+type EventType string
+
+const (
+	// RolloutStarted is emitted before command is run for addons on a
+	// cluster.
+	RolloutStarted EventType = "rollout_started"
+	// RolloutSucceeded is emitted after command successfully completed for
+	// all addons on a cluster.
+	RolloutSucceeded EventType = "rollout_succeeded"
+	// RolloutFailed is emitted after command failed on a cluster.
+	RolloutFailed EventType = "rollout_failed"
+
+	// AddonStarted is emitted before command is run for an addon.
+	AddonStarted EventType = "addon_started"
+	// AddonSucceeded is emitted after command successfully completed for an
+	// addon.
+	AddonSucceeded EventType = "addon_succeeded"
+	// AddonFailed is emitted after command failed for an addon.
+	AddonFailed EventType = "addon_failed"
+)
+
+// Event reports progress of a command run.
+type Event struct {
+	Type    EventType
+	Command Command
+	// Cluster is the `cluster' field of the context the command runs with
+	// (may be empty).
+	Cluster string
+	// RolloutID is the ID of the stored rollout (only set for
+	// RolloutSucceeded and RolloutFailed events of InstallCommand when not in
+	// dry run mode).
+	RolloutID string
+	// Addons is the list of addons command runs for (only set for Rollout*
+	// events).
+	Addons []string
+	Addon  string
+	// Err is set for AddonFailed and RolloutFailed events.
+	Err error
+	// Stats counts objects mutated by the addon (for Addon{Succeeded,Failed}
+	// events) or by all addons (for Rollout{Succeeded,Failed} events).
+	Stats kube.Stats
+}
+
+// EventHandler is called synchronously for every Event.
+type EventHandler func(e *Event)
+
+// WithEventHandler returns an Option that reports command progress to h.
+func WithEventHandler(h EventHandler) Option {
+	return fnOption(func(opts *options) error {
+		opts.eventHandlers = append(opts.eventHandlers, h)
+		return nil
+	})
+}
+
+// emit sends e to all registered event handlers.
+func (r *runtime) emit(e *Event) {
+	for _, h := range r.eventHandlers {
+		h(e)
+	}
+}
+
+// clusterOf returns the `cluster' field of skyCtx (empty if not set).
+func clusterOf(skyCtx starlark.Value) string {
+	c, ok := skyCtx.(*addon.SkyCtx)
+	if !ok {
+		return ""
+	}
+	s, _ := c.Attrs["cluster"].(starlark.String)
+	return string(s)
+}
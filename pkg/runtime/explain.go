@@ -0,0 +1,201 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Explanation describes why a Kubernetes object is managed by Isopod.
+type Explanation struct {
+	Object store.ObjRef
+	// Heritage is true if the object has Isopod's heritage label.
+	Heritage bool
+	// Version is the addon version label of the object.
+	Version string
+	// HelmRelease is the Helm release the object was applied by (if any).
+	HelmRelease string
+	// Rollout is the live rollout that last applied the object and
+	// AddonRun the run of the addon that applied it (both nil if the live
+	// rollout doesn't reference the object).
+	Rollout  *store.Rollout
+	AddonRun *store.AddonRun
+	// Context is the addon context (JSON) the object was applied with and
+	// ContextHash its hash if only the hash was annotated. Context is
+	// empty if the context isn't annotated or kept in the rollout store.
+	Context, ContextHash string
+}
+
+// ParseObjectArg parses reference to an object in `resource/name' (for
+// cluster-scoped objects) or `resource/namespace/name' format. resource is a
+// kind or resource name (e.g `pod', `deployments.apps' or `deploy').
+func ParseObjectArg(arg string) (resource, namespace, name string, err error) {
+	parts := strings.Split(arg, "/")
+	for _, p := range parts {
+		if p == "" {
+			return "", "", "", fmt.Errorf("invalid object `%s' (want <resource>/[<namespace>/]<name>)", arg)
+		}
+	}
+	switch len(parts) {
+	case 2:
+		return parts[0], "", parts[1], nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	}
+	return "", "", "", fmt.Errorf("invalid object `%s' (want <resource>/[<namespace>/]<name>)", arg)
+}
+
+// GetObject gets object referenced by arg (see ParseObjectArg) from cluster.
+func GetObject(ctx context.Context, dc discovery.DiscoveryInterface, dyn dynamic.Interface, arg string) (*unstructured.Unstructured, error) {
+	resource, namespace, name, err := ParseObjectArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	gr, err := restmapper.GetAPIGroupResources(dc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover API resources: %v", err)
+	}
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDiscoveryRESTMapper(gr), dc)
+	gvk, err := mapper.KindFor(schema.ParseGroupResource(resource).WithVersion(""))
+	if err != nil {
+		// Kinds (e.g `Deployment') map to resources in lower case.
+		if gvk, err = mapper.KindFor(schema.ParseGroupResource(strings.ToLower(resource)).WithVersion("")); err != nil {
+			return nil, fmt.Errorf("unknown resource `%s': %v", resource, err)
+		}
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	switch {
+	case namespaced && namespace == "":
+		return nil, fmt.Errorf("%s is namespaced (want %s/<namespace>/<name>)", gvk.Kind, resource)
+	case !namespaced && namespace != "":
+		return nil, fmt.Errorf("%s is cluster-scoped (want %s/<name>)", gvk.Kind, resource)
+	}
+	return dyn.Resource(mapping.Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// Explain returns explanation of obj from its Isopod labels and annotations
+// and the live rollout in st.
+func Explain(obj *unstructured.Unstructured, st store.Store) (*Explanation, error) {
+	e := &Explanation{
+		Object: store.ObjRef{
+			APIVersion: obj.GetAPIVersion(),
+			Kind:       obj.GetKind(),
+			Namespace:  obj.GetNamespace(),
+			Name:       obj.GetName(),
+		},
+		Heritage:    obj.GetLabels()["heritage"] == "isopod",
+		Version:     obj.GetLabels()[kube.AddonVersionLabelKey],
+		HelmRelease: obj.GetLabels()[kube.HelmReleaseLabelKey],
+	}
+	e.Context, e.ContextHash = kube.ObjectContext(obj.GetAnnotations())
+
+	if st == nil {
+		return e, nil
+	}
+	live, found, err := st.GetLive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live rollout: %v", err)
+	}
+	if !found {
+		return e, nil
+	}
+	for _, run := range live.Addons {
+		for _, ref := range run.ObjRefs {
+			if ref.SameObject(e.Object) {
+				e.Rollout, e.AddonRun = live, run
+				break
+			}
+		}
+		if e.AddonRun != nil {
+			break
+		}
+	}
+	if e.AddonRun != nil && e.Context == "" && e.ContextHash != "" {
+		e.Context = e.AddonRun.Contexts[e.ContextHash]
+	}
+	return e, nil
+}
+
+// Print prints e to w.
+func (e *Explanation) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Object:\t%s\n", e.Object)
+	managed := "no"
+	switch {
+	case e.AddonRun != nil:
+		managed = "yes"
+	case e.Heritage:
+		managed = "yes (not referenced by the live rollout)"
+	}
+	fmt.Fprintf(tw, "Managed by Isopod:\t%s\n", managed)
+	if e.AddonRun != nil {
+		fmt.Fprintf(tw, "Addon:\t%s\n", e.AddonRun.Name)
+		created := ""
+		if !e.Rollout.Created.IsZero() {
+			created = fmt.Sprintf(" (created %s)", e.Rollout.Created.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintf(tw, "Rollout:\t%s%s\n", e.Rollout.ID, created)
+	}
+	version := e.Version
+	if e.AddonRun != nil && e.AddonRun.Version != "" {
+		version = e.AddonRun.Version
+	}
+	if version != "" {
+		fmt.Fprintf(tw, "Module version:\t%s\n", version)
+	}
+	if e.HelmRelease != "" {
+		fmt.Fprintf(tw, "Helm release:\t%s\n", e.HelmRelease)
+	}
+	if e.Context == "" && e.ContextHash != "" {
+		fmt.Fprintf(tw, "Context:\t%s (not found in the rollout store)\n", e.ContextHash)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if e.Context != "" {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(e.Context), "  ", "  "); err != nil {
+			buf.Reset()
+			buf.WriteString(e.Context)
+		}
+		if _, err := fmt.Fprintf(w, "Context:\n  %s\n", buf.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+type liveStore struct {
+	store.NoopStore
+	live *store.Rollout
+}
+
+func (s liveStore) GetLive() (*store.Rollout, bool, error) { return s.live, s.live != nil, nil }
+
+func TestParseObjectArg(t *testing.T) {
+	for _, tc := range []struct {
+		arg     string
+		want    []string
+		wantErr bool
+	}{
+		{arg: "pod/kube-system/dns", want: []string{"pod", "kube-system", "dns"}},
+		{arg: "clusterroles.rbac.authorization.k8s.io/admin", want: []string{"clusterroles.rbac.authorization.k8s.io", "", "admin"}},
+		{arg: "pod", wantErr: true},
+		{arg: "pod//dns", wantErr: true},
+		{arg: "pod/a/b/c", wantErr: true},
+	} {
+		t.Run(tc.arg, func(t *testing.T) {
+			resource, namespace, name, err := ParseObjectArg(tc.arg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, []string{resource, namespace, name}); d != "" {
+				t.Errorf("Unexpected result (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	obj := func(labels, annotations map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":        "nginx",
+				"namespace":   "web",
+				"labels":      labels,
+				"annotations": annotations,
+			},
+		}}
+	}
+	live := &store.Rollout{
+		ID:      "rollout-1",
+		Live:    true,
+		Created: time.Date(2021, 9, 20, 17, 4, 11, 0, time.UTC),
+		Addons: []*store.AddonRun{
+			{Name: "ingress", ObjRefs: []store.ObjRef{{APIVersion: "v1", Kind: "Service", Namespace: "web", Name: "nginx"}}},
+			{
+				Name:     "nginx",
+				Version:  "v1.2.0",
+				ObjRefs:  []store.ObjRef{{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "web", Name: "nginx"}},
+				Contexts: map[string]string{"sha256:abc": `{"cluster":"minikube"}`},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		obj  *unstructured.Unstructured
+		st   store.Store
+		want string
+	}{
+		{
+			name: "Context annotation",
+			obj: obj(
+				map[string]interface{}{"heritage": "isopod", "isopod.getcruise.com/addon-version": "v1.1.0"},
+				map[string]interface{}{"isopod.getcruise.com/context": `{"cluster":"minikube","env":"dev"}`},
+			),
+			st: liveStore{live: live},
+			want: "Object:             deployment.apps/v1 `web/nginx'\n" +
+				"Managed by Isopod:  yes\n" +
+				"Addon:              nginx\n" +
+				"Rollout:            rollout-1 (created 2021-09-20T17:04:11Z)\n" +
+				"Module version:     v1.2.0\n" +
+				"Context:\n" +
+				"  {\n" +
+				"    \"cluster\": \"minikube\",\n" +
+				"    \"env\": \"dev\"\n" +
+				"  }\n",
+		},
+		{
+			name: "Context in store",
+			obj: obj(
+				map[string]interface{}{"heritage": "isopod", "isopod.getcruise.com/helm-release": "web"},
+				map[string]interface{}{"isopod.getcruise.com/context-hash": "sha256:abc"},
+			),
+			st: liveStore{live: live},
+			want: "Object:             deployment.apps/v1 `web/nginx'\n" +
+				"Managed by Isopod:  yes\n" +
+				"Addon:              nginx\n" +
+				"Rollout:            rollout-1 (created 2021-09-20T17:04:11Z)\n" +
+				"Module version:     v1.2.0\n" +
+				"Helm release:       web\n" +
+				"Context:\n" +
+				"  {\n" +
+				"    \"cluster\": \"minikube\"\n" +
+				"  }\n",
+		},
+		{
+			name: "No live rollout",
+			obj: obj(
+				map[string]interface{}{"heritage": "isopod"},
+				map[string]interface{}{"isopod.getcruise.com/context-hash": "sha256:abc"},
+			),
+			st: liveStore{},
+			want: "Object:             deployment.apps/v1 `web/nginx'\n" +
+				"Managed by Isopod:  yes (not referenced by the live rollout)\n" +
+				"Context:            sha256:abc (not found in the rollout store)\n",
+		},
+		{
+			name: "Unmanaged",
+			obj:  obj(nil, nil),
+			st:   liveStore{live: &store.Rollout{ID: "rollout-1"}},
+			want: "Object:             deployment.apps/v1 `web/nginx'\n" +
+				"Managed by Isopod:  no\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Explain(tc.obj, tc.st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			if err := e.Print(buf); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, buf.String()); d != "" {
+				t.Errorf("Unexpected explanation (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -27,7 +27,10 @@ import (
 	"sort"
 	"strings"
 
+	yaml3 "gopkg.in/yaml.v3"
+
 	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -40,13 +43,35 @@ import (
 
 const indentString = "    "
 
+// Formats objects of kinds not registered with Isopod (e.g custom resources)
+// are generated in. Both are applied with kube.put_yaml.
+const (
+	// FormatPutYAML builds objects with structs (falling back to dicts for
+	// maps with keys that are not identifiers).
+	FormatPutYAML = "put_yaml"
+	// FormatDict builds objects with dicts.
+	FormatDict = "dict"
+)
+
 var out = func(format string, a ...interface{}) { fmt.Printf(format, a...) }
 
-func Generate(path string) error {
-	path, err := filepath.Abs(path)
+// Generate prints Starlark addon file creating objects in yaml or json files
+// at path. Objects of unregistered kinds are generated in format (one of
+// FormatPutYAML or FormatDict).
+func Generate(path, format string) error {
+	if format != FormatPutYAML && format != FormatDict {
+		return fmt.Errorf("unknown format `%s' (want one of %s, %s)", format, FormatPutYAML, FormatDict)
+	}
+	wd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
+	if path, err = loader.ResolvePath(wd, path); err != nil {
+		return err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return err
+	}
 	fi, err := os.Stat(path)
 	if err != nil {
 		return err
@@ -78,7 +103,7 @@ func Generate(path string) error {
 	}
 
 	yamlsOrJSONs := bytes.Split(yamlOrJSONFile, []byte(`---`))
-	a := newAddonFile()
+	a := newAddonFile(format)
 
 	decode := serializer.NewCodecFactory(kube.Scheme).UniversalDeserializer().Decode
 
@@ -98,11 +123,11 @@ func Generate(path string) error {
 		if err != nil {
 			return fmt.Errorf("couldn't extract json from input: %w", err)
 		}
-		var u unstructured.Unstructured
-		if err := u.UnmarshalJSON(j); err != nil {
+		c := &customObject{comments: yamlComments(yamlOrJSON)}
+		if err := c.UnmarshalJSON(j); err != nil {
 			return fmt.Errorf("couldn't unmarshal custom resource: %w", err)
 		}
-		a.addObject(u)
+		a.addObject(c)
 	}
 	starlark := a.gen()
 	out("%s", starlark)
@@ -122,6 +147,14 @@ type addonFile struct {
 	metaData []metaData
 	// currentIndex points to current item in metaData and can be used in generation functions to add to metaData
 	currentIndex int
+	// format is the format custom objects are generated in
+	format string
+	// kinds holds api_group and kind constants of custom objects in the order they were encountered, kindMap
+	// indexes them by apiVersion and kind
+	kinds   []kindConstants
+	kindMap map[string]int
+	// locals contains names of local variables declared in install
+	locals map[string]bool
 }
 
 type metaData struct {
@@ -129,11 +162,51 @@ type metaData struct {
 	namespace string
 	group     string
 	kind      string
+	// groupConst is the constant holding group, if any
+	groupConst string
 }
 
-func newAddonFile() *addonFile {
+// customObject is an object of a kind not registered with Isopod.
+type customObject struct {
+	unstructured.Unstructured
+	// comments holds YAML comments of the object keyed by fieldPath of the
+	// field they precede
+	comments map[string]string
+}
+
+// kindConstants names constants holding apiVersion, api_group and kind of
+// custom objects.
+type kindConstants struct {
+	prefix     string
+	apiVersion string
+	group      string
+	kind       string
+}
+
+// starlarkExpr is a Starlark expression written verbatim into builders.
+type starlarkExpr string
+
+// reservedNames can't be used for locals declared in install.
+var reservedNames = map[string]bool{
+	"ctx": true, "kube": true, "proto": true, "struct": true,
+	"and": true, "as": true, "assert": true, "break": true, "class": true, "continue": true, "def": true,
+	"del": true, "elif": true, "else": true, "except": true, "finally": true, "for": true, "from": true,
+	"global": true, "if": true, "import": true, "in": true, "is": true, "lambda": true, "load": true,
+	"nonlocal": true, "not": true, "or": true, "pass": true, "raise": true, "return": true, "try": true,
+	"while": true, "with": true, "yield": true,
+}
+
+var (
+	identifierRe  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	underscoresRe = regexp.MustCompile(`_+`)
+)
+
+func newAddonFile(format string) *addonFile {
 	return &addonFile{
-		pkgMap: map[string]string{},
+		pkgMap:  map[string]string{},
+		format:  format,
+		kindMap: map[string]int{},
+		locals:  map[string]bool{},
 	}
 }
 
@@ -154,6 +227,9 @@ func (a *addonFile) gen() []byte {
 	// imports
 	buf.Write(a.genImports())
 
+	// api_group and kind constants of custom objects
+	buf.Write(a.genKindConstants())
+
 	// install
 	buf.Write(install)
 
@@ -200,10 +276,10 @@ func (a *addonFile) genInstall() []byte {
 	buf.WriteString("def install(ctx):\n")
 	for i, object := range a.objects {
 		switch o := object.(type) {
+		case *customObject:
+			a.writeKubePutYAMLWithIndent(buf, o, 1)
 		case k8sruntime.Object:
 			a.writeKubePutWithIndent(buf, o, 1)
-		case unstructured.Unstructured:
-			a.writeKubePutYAMLWithIndent(buf, o, 1)
 		}
 		if i != len(a.objects)-1 {
 			buf.WriteString("\n")
@@ -258,7 +334,7 @@ func (a *addonFile) writeKubePutWithIndent(kubePut *bytes.Buffer, object k8srunt
 	return kubePut.Bytes()
 }
 
-func (a *addonFile) writeKubePutYAMLWithIndent(kubePutYAML *bytes.Buffer, c unstructured.Unstructured, indent int) []byte {
+func (a *addonFile) writeKubePutYAMLWithIndent(kubePutYAML *bytes.Buffer, c *customObject, indent int) []byte {
 	indent1 := bytes.Repeat([]byte(indentString), indent)
 	indent2 := bytes.Repeat([]byte(indentString), indent+1)
 	name := c.GetName()
@@ -266,17 +342,31 @@ func (a *addonFile) writeKubePutYAMLWithIndent(kubePutYAML *bytes.Buffer, c unst
 	group := c.GroupVersionKind().Group
 	kind := c.GroupVersionKind().Kind
 
+	consts := a.addKind(c.GetAPIVersion(), group, kind)
 	a.metaData[a.currentIndex] = metaData{
 		name:      name,
 		namespace: namespace,
 		group:     group,
 		kind:      kind,
 	}
+	if group != "" {
+		a.metaData[a.currentIndex].groupConst = consts.prefix + "_API_GROUP"
+	}
 
-	kubePutYAML.Write(indent1)
-	kubePutYAML.WriteString("data=")
-	kubePutYAML.Write(a.genStarlarkStructWithIndent(c.Object, indent))
-	kubePutYAML.WriteString("\n")
+	// refer to constants instead of repeating apiVersion and kind
+	object := make(map[string]interface{}, len(c.Object))
+	for k, v := range c.Object {
+		object[k] = v
+	}
+	object["apiVersion"] = starlarkExpr(consts.prefix + "_API_VERSION")
+	object["kind"] = starlarkExpr(consts.prefix + "_KIND")
+
+	local := name
+	if local == "" {
+		local = kind
+	}
+	local = a.addLocal(snakeCase(local))
+	a.writeBuilderWithIndent(kubePutYAML, local, nil, object, c.comments, indent)
 
 	kubePutYAML.Write(indent1)
 	kubePutYAML.WriteString("kube.put_yaml(\n")
@@ -293,15 +383,41 @@ func (a *addonFile) writeKubePutYAMLWithIndent(kubePutYAML *bytes.Buffer, c unst
 
 	// data
 	kubePutYAML.Write(indent2)
-	kubePutYAML.WriteString(`data=[`)
-	kubePutYAML.WriteString("data.to_json()")
-	kubePutYAML.WriteString(`]` + "\n")
+	if a.format == FormatDict {
+		kubePutYAML.WriteString("data=[struct(**" + local + ").to_json()],\n")
+	} else {
+		kubePutYAML.WriteString("data=[" + local + ".to_json()],\n")
+	}
 
 	kubePutYAML.Write(indent1)
 	kubePutYAML.WriteString(")\n")
 	return kubePutYAML.Bytes()
 }
 
+// writeBuilderWithIndent declares local holding object (found at path of a
+// custom object). Nested maps are split into their own locals (named after
+// their path) declared ahead of it so that every builder stays flat.
+func (a *addonFile) writeBuilderWithIndent(b *bytes.Buffer, local string, path []string, object map[string]interface{}, comments map[string]string, indent int) {
+	fields := make(map[string]interface{}, len(object))
+	for _, key := range sortedKeys(object) {
+		value := object[key]
+		if m, ok := value.(map[string]interface{}); ok && len(m) > 0 {
+			nested := a.addLocal(local + "_" + snakeCase(key))
+			a.writeBuilderWithIndent(b, nested, appendPath(path, key), m, comments, indent)
+			value = starlarkExpr(nested)
+		}
+		fields[key] = value
+	}
+
+	if len(path) == 0 {
+		writeComment(b, comments[fieldPathKey(path)], indent)
+	}
+	writeIndent(b, indent)
+	b.WriteString(local + " = ")
+	b.Write(a.genStarlarkValueWithIndent(fields, path, comments, indent))
+	b.WriteString("\n")
+}
+
 func (a *addonFile) genKubeDeleteWithIndent(indent int) []byte {
 	indent1 := bytes.Repeat([]byte(indentString), indent)
 	kubeDelete := bytes.NewBuffer([]byte{})
@@ -316,7 +432,9 @@ func (a *addonFile) genKubeDeleteWithIndent(indent int) []byte {
 		}
 		kubeDelete.WriteString(object.name)
 		kubeDelete.WriteString("\"")
-		if object.group != "" {
+		if object.groupConst != "" {
+			kubeDelete.WriteString(fmt.Sprintf(", api_group=%s", object.groupConst))
+		} else if object.group != "" {
 			kubeDelete.WriteString(fmt.Sprintf(", api_group=\"%s\"", object.group))
 		}
 		kubeDelete.WriteString(")\n")
@@ -450,40 +568,140 @@ func (a *addonFile) genDataWithIndent(v reflect.Value, indent int) []byte {
 	return b.Bytes()
 }
 
-func (a *addonFile) genStarlarkStructWithIndent(object interface{}, indent int) []byte {
-	indent1 := bytes.Repeat([]byte(indentString), indent)
-	indent2 := bytes.Repeat([]byte(indentString), indent+1)
+// genStarlarkValueWithIndent generates Starlark value of object found at path
+// of a custom object. Maps become structs unless any of their keys is not an
+// identifier (or format is FormatDict), in which case they become dicts.
+func (a *addonFile) genStarlarkValueWithIndent(object interface{}, path []string, comments map[string]string, indent int) []byte {
 	b := bytes.NewBuffer([]byte{})
 
-	if reflect.ValueOf(object).Kind() != reflect.Map {
-		j, _ := json.Marshal(object)
-		if bytes.Equal([]byte("true"), j) || bytes.Equal([]byte("false"), j) {
-			// because Python's boolean is capitalized
-			return bytes.Title(j)
+	switch v := object.(type) {
+	case starlarkExpr:
+		return []byte(v)
+	case nil:
+		return []byte("None")
+	case bool:
+		// because Python's boolean is capitalized
+		return bytes.Title([]byte(fmt.Sprint(v)))
+	case []interface{}:
+		if len(v) == 0 {
+			return []byte("[]")
 		}
+		b.WriteString("[\n")
+		for _, item := range v {
+			writeIndent(b, indent+1)
+			b.Write(a.genStarlarkValueWithIndent(item, nil, nil, indent+1))
+			b.WriteString(",\n")
+		}
+		writeIndent(b, indent)
+		b.WriteString("]")
+		return b.Bytes()
+	case map[string]interface{}:
+	default:
+		j, _ := json.Marshal(v)
 		return j
 	}
 
 	// order maps for reproducability
 	m := object.(map[string]interface{})
-	var keys []string
-	for key := range m {
-		keys = append(keys, key)
+	keys := sortedKeys(m)
+	asStruct := a.format == FormatPutYAML
+	for _, key := range keys {
+		if !identifierRe.MatchString(key) || reservedNames[key] {
+			asStruct = false
+		}
 	}
-	sort.Strings(keys)
 
-	b.WriteString("struct(\n")
+	if len(keys) == 0 {
+		if asStruct {
+			return []byte("struct()")
+		}
+		return []byte("{}")
+	}
+	if asStruct {
+		b.WriteString("struct(\n")
+	} else {
+		b.WriteString("{\n")
+	}
 	for _, key := range keys {
-		b.Write(indent2)
-		b.WriteString(key + "=")
-		b.Write(a.genStarlarkStructWithIndent(m[key], indent+1))
+		p := appendPath(path, key)
+		writeComment(b, comments[fieldPathKey(p)], indent+1)
+		writeIndent(b, indent+1)
+		if asStruct {
+			b.WriteString(key + "=")
+		} else {
+			j, _ := json.Marshal(key)
+			b.Write(j)
+			b.WriteString(": ")
+		}
+		b.Write(a.genStarlarkValueWithIndent(m[key], p, comments, indent+1))
 		b.WriteString(",\n")
 	}
-	b.Write(indent1)
-	b.WriteString(")")
+	writeIndent(b, indent)
+	if asStruct {
+		b.WriteString(")")
+	} else {
+		b.WriteString("}")
+	}
 	return b.Bytes()
 }
 
+// addKind returns constants of custom objects of kind in apiVersion, adding
+// them unless they already exist.
+func (a *addonFile) addKind(apiVersion, group, kind string) kindConstants {
+	key := apiVersion + "/" + kind
+	if i, ok := a.kindMap[key]; ok {
+		return a.kinds[i]
+	}
+	base := strings.ToUpper(snakeCase(kind))
+	prefix := base
+	for i := 2; a.hasKindPrefix(prefix); i++ {
+		prefix = fmt.Sprintf("%s_%d", base, i)
+	}
+	consts := kindConstants{
+		prefix:     prefix,
+		apiVersion: apiVersion,
+		group:      group,
+		kind:       kind,
+	}
+	a.kindMap[key] = len(a.kinds)
+	a.kinds = append(a.kinds, consts)
+	return consts
+}
+
+func (a *addonFile) hasKindPrefix(prefix string) bool {
+	for _, k := range a.kinds {
+		if k.prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *addonFile) genKindConstants() []byte {
+	b := bytes.NewBuffer([]byte{})
+	for _, k := range a.kinds {
+		b.WriteString(fmt.Sprintf("%s_API_VERSION = \"%s\"\n", k.prefix, k.apiVersion))
+		if k.group != "" {
+			b.WriteString(fmt.Sprintf("%s_API_GROUP = \"%s\"\n", k.prefix, k.group))
+		}
+		b.WriteString(fmt.Sprintf("%s_KIND = \"%s\"\n", k.prefix, k.kind))
+	}
+	if len(a.kinds) > 0 {
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// addLocal returns a unique local variable name based on name.
+func (a *addonFile) addLocal(name string) string {
+	local := name
+	for i := 2; a.locals[local] || reservedNames[local]; i++ {
+		local = fmt.Sprintf("%s_%d", name, i)
+	}
+	a.locals[local] = true
+	return local
+}
+
 func (a *addonFile) quantity(q resource.Quantity) []byte {
 	b := bytes.NewBuffer([]byte{})
 	b.WriteString("kube.resource_quantity(")
@@ -513,3 +731,114 @@ func (a *addonFile) intOrString(intOrString intstr.IntOrString) []byte {
 func writeIndent(b io.Writer, indent int) {
 	_, _ = b.Write(bytes.Repeat([]byte(indentString), indent))
 }
+
+// writeComment writes YAML comment lines with indent.
+func writeComment(b io.Writer, comment string, indent int) {
+	for _, line := range strings.Split(comment, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			line = "# " + line
+		}
+		writeIndent(b, indent)
+		_, _ = io.WriteString(b, line+"\n")
+	}
+}
+
+// yamlComments returns comments of YAML document keyed by fieldPathKey of the
+// field they precede (or follow on the same line). Comments of the document
+// itself are keyed by empty path. Comments are best effort: none are returned
+// for documents the YAML parser rejects.
+func yamlComments(doc []byte) map[string]string {
+	comments := map[string]string{}
+	var root yaml3.Node
+	if err := yaml3.Unmarshal(doc, &root); err != nil {
+		return comments
+	}
+	add := func(path []string, comment ...string) {
+		for _, c := range comment {
+			if c == "" {
+				continue
+			}
+			key := fieldPathKey(path)
+			if comments[key] != "" {
+				comments[key] += "\n"
+			}
+			comments[key] += c
+		}
+	}
+	var walk func(n *yaml3.Node, path []string)
+	walk = func(n *yaml3.Node, path []string) {
+		switch n.Kind {
+		case yaml3.DocumentNode:
+			add(path, n.HeadComment)
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml3.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				p := appendPath(path, k.Value)
+				if len(path) == 0 && i == 0 {
+					// leading comment describes the object rather than its first field
+					add(path, k.HeadComment)
+				} else {
+					add(p, k.HeadComment)
+				}
+				add(p, k.LineComment, v.LineComment)
+				walk(v, p)
+			}
+		}
+	}
+	walk(&root, nil)
+	return comments
+}
+
+// fieldPathKey returns key of field path in comments maps.
+func fieldPathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// appendPath returns copy of path with key appended.
+func appendPath(path []string, key string) []string {
+	return append(path[:len(path):len(path)], key)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snakeCase converts name (e.g a camelCase field or an object name with
+// dashes and dots) to a snake_case identifier.
+func snakeCase(name string) string {
+	var b strings.Builder
+	rs := []rune(name)
+	for i, r := range rs {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if i > 0 && (isLowerOrDigit(rs[i-1]) || i+1 < len(rs) && rs[i-1] >= 'A' && rs[i-1] <= 'Z' && isLowerOrDigit(rs[i+1])) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r + 'a' - 'A')
+		case isLowerOrDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	s := strings.Trim(underscoresRe.ReplaceAllString(b.String(), "_"), "_")
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+func isLowerOrDigit(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= '0' && r <= '9'
+}
@@ -28,6 +28,7 @@ func TestGenerate(t *testing.T) {
 	testcases := map[string]struct {
 		inputPath string
 		wantPath  string
+		format    string
 	}{
 		"yaml": {
 			inputPath: path.Join(testdataPath, "clusterrolebinding.yaml"),
@@ -47,7 +48,12 @@ func TestGenerate(t *testing.T) {
 		},
 		"custom resource json": {
 			inputPath: path.Join(testdataPath, "custom-resource.json"),
-			wantPath:  path.Join(testdataPath, "custom-resource.ipd"),
+			wantPath:  path.Join(testdataPath, "custom-resource-json.ipd"),
+		},
+		"custom resource dict": {
+			inputPath: path.Join(testdataPath, "custom-resource.yaml"),
+			wantPath:  path.Join(testdataPath, "custom-resource-dict.ipd"),
+			format:    FormatDict,
 		},
 		"resource containing byte array": {
 			inputPath: path.Join(testdataPath, "validating-webhook.yaml"),
@@ -67,7 +73,11 @@ func TestGenerate(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			got := ""
 			out = func(format string, a ...interface{}) { got = fmt.Sprintf(format, a...) }
-			err := Generate(test.inputPath)
+			format := test.format
+			if format == "" {
+				format = FormatPutYAML
+			}
+			err := Generate(test.inputPath, format)
 			if err != nil {
 				t.Fatal(err)
 			}
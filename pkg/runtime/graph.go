@@ -0,0 +1,207 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/loader"
+)
+
+// Formats GraphCommand prints the addon graph in.
+const (
+	// GraphFormatDot prints the graph in Graphviz dot language.
+	GraphFormatDot = "dot"
+	// GraphFormatJSON prints the graph as a JSON object.
+	GraphFormatJSON = "json"
+)
+
+// WithGraphFormat returns an Option that sets the format GraphCommand prints
+// the addon graph in (one of GraphFormatDot, the default, or
+// GraphFormatJSON).
+func WithGraphFormat(format string) Option {
+	return fnOption(func(opts *options) error {
+		if format != GraphFormatDot && format != GraphFormatJSON {
+			return fmt.Errorf("unknown graph format `%s' (want one of %s, %s)", format, GraphFormatDot, GraphFormatJSON)
+		}
+		opts.graphFormat = format
+		return nil
+	})
+}
+
+// addonGraph is the graph of addons, modules they load and objects they
+// touch printed by GraphCommand.
+type addonGraph struct {
+	Cluster string       `json:"cluster,omitempty"`
+	Addons  []graphAddon `json:"addons"`
+	// Modules are all modules and data files loaded by addons.
+	Modules []graphModule `json:"modules"`
+}
+
+type graphAddon struct {
+	Name   string `json:"name"`
+	Module string `json:"module"`
+	// Resources are kinds and namespaces of objects the addon applies
+	// (only set with live status).
+	Resources []graphResource `json:"resources,omitempty"`
+}
+
+type graphModule struct {
+	Path   string   `json:"path"`
+	Loads  []string `json:"loads,omitempty"`
+	Charts []string `json:"charts,omitempty"`
+}
+
+type graphResource struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// graph prints the graph of addons on cluster.
+func (r *runtime) graph(ctx context.Context, cluster string, addons []*addon.Addon) error {
+	g, err := r.buildGraph(ctx, cluster, addons)
+	if err != nil {
+		return err
+	}
+	if r.graphFormat == GraphFormatJSON {
+		bs, err := json.MarshalIndent(g, "", "  ")
+		if err != nil {
+			return err
+		}
+		out("%s\n", bs)
+		return nil
+	}
+	out("%s", dotGraph(g))
+	return nil
+}
+
+func (r *runtime) buildGraph(ctx context.Context, cluster string, addons []*addon.Addon) (*addonGraph, error) {
+	tracker := r.objectTracker()
+	if r.liveStatus && tracker == nil {
+		return nil, fmt.Errorf("`%s' with live status requires kube package", GraphCommand)
+	}
+
+	g := &addonGraph{Cluster: cluster}
+	modules := map[string]*graphModule{}
+	for _, a := range addons {
+		ga := graphAddon{Name: a.Name, Module: r.graphPath(a.Path())}
+		for path, deps := range a.ModuleGraph() {
+			p := r.graphPath(path)
+			if _, ok := modules[p]; ok {
+				continue
+			}
+			m := &graphModule{Path: p}
+			for _, l := range deps.Loads {
+				m.Loads = append(m.Loads, r.graphPath(l))
+			}
+			for _, c := range deps.Charts {
+				m.Charts = append(m.Charts, r.graphPath(c))
+			}
+			sort.Strings(m.Loads)
+			sort.Strings(m.Charts)
+			modules[p] = m
+		}
+
+		if r.liveStatus {
+			tracker.TakeApplied()
+			if err := a.Install(ctx); err != nil {
+				return nil, fmt.Errorf("%v dry run failed: %v", a, err)
+			}
+			seen := map[graphResource]bool{}
+			for _, ref := range tracker.TakeApplied() {
+				res := graphResource{Kind: ref.Kind, Namespace: ref.Namespace}
+				if !seen[res] {
+					seen[res] = true
+					ga.Resources = append(ga.Resources, res)
+				}
+			}
+			sort.Slice(ga.Resources, func(i, j int) bool {
+				if ga.Resources[i].Kind != ga.Resources[j].Kind {
+					return ga.Resources[i].Kind < ga.Resources[j].Kind
+				}
+				return ga.Resources[i].Namespace < ga.Resources[j].Namespace
+			})
+		}
+		g.Addons = append(g.Addons, ga)
+	}
+
+	for _, m := range modules {
+		g.Modules = append(g.Modules, *m)
+	}
+	sort.Slice(g.Modules, func(i, j int) bool { return g.Modules[i].Path < g.Modules[j].Path })
+	return g, nil
+}
+
+// graphPath returns path relative to the workspace root of r (as `//path') if
+// it is in the workspace.
+func (r *runtime) graphPath(path string) string {
+	root := loader.WorkspaceRootOr(r.workspaceRoot)
+	if root == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return "//" + filepath.ToSlash(rel)
+}
+
+// dotGraph returns g in Graphviz dot language. Addons point to their
+// modules, modules to modules and data files they load and charts they
+// install, and addons to kinds of objects they apply (dashed).
+func dotGraph(g *addonGraph) string {
+	name := g.Cluster
+	if name == "" {
+		name = "addons"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", name)
+	fmt.Fprintf(&b, "  rankdir=LR;\n")
+	fmt.Fprintf(&b, "  node [shape=box];\n")
+	for i, a := range g.Addons {
+		id := "addon:" + a.Name
+		fmt.Fprintf(&b, "  %q [label=%q, shape=ellipse, style=bold];\n", id, fmt.Sprintf("%d. %s", i+1, a.Name))
+		fmt.Fprintf(&b, "  %q -> %q;\n", id, a.Module)
+		for _, res := range a.Resources {
+			resID := res.Kind
+			if res.Namespace != "" {
+				resID += "/" + res.Namespace
+			}
+			fmt.Fprintf(&b, "  %q [label=%q, shape=note];\n", "kind:"+resID, resID)
+			fmt.Fprintf(&b, "  %q -> %q [style=dashed];\n", id, "kind:"+resID)
+		}
+	}
+	for _, m := range g.Modules {
+		for _, l := range m.Loads {
+			fmt.Fprintf(&b, "  %q -> %q;\n", m.Path, l)
+		}
+		for _, c := range m.Charts {
+			fmt.Fprintf(&b, "  %q [shape=folder];\n", c)
+			fmt.Fprintf(&b, "  %q -> %q;\n", m.Path, c)
+		}
+	}
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
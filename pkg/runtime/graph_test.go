@@ -0,0 +1,118 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestGraph(t *testing.T) {
+	dir := t.TempDir()
+	for f, data := range changedOnlyRepo {
+		writeFile(t, filepath.Join(dir, f), data)
+	}
+	loader.SetWorkspaceRoot(dir)
+	defer loader.SetWorkspaceRoot("")
+
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{
+			format: GraphFormatDot,
+			want: `digraph "addons" {
+  rankdir=LR;
+  node [shape=box];
+  "addon:a" [label="1. a", shape=ellipse, style=bold];
+  "addon:a" -> "//a.ipd";
+  "addon:b" [label="2. b", shape=ellipse, style=bold];
+  "addon:b" -> "//b/b.ipd";
+  "//charts/a" [shape=folder];
+  "//a.ipd" -> "//charts/a";
+  "//b/b.ipd" -> "//lib/lib.star";
+}
+`,
+		},
+		{
+			format: GraphFormatJSON,
+			want: `{
+  "addons": [
+    {
+      "name": "a",
+      "module": "//a.ipd"
+    },
+    {
+      "name": "b",
+      "module": "//b/b.ipd"
+    }
+  ],
+  "modules": [
+    {
+      "path": "//a.ipd",
+      "charts": [
+        "//charts/a"
+      ]
+    },
+    {
+      "path": "//b/b.ipd",
+      "loads": [
+        "//lib/lib.star"
+      ]
+    },
+    {
+      "path": "//lib/lib.star"
+    }
+  ]
+}
+`,
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var got string
+			out = func(format string, a ...interface{}) { got += fmt.Sprintf(format, a...) }
+
+			r, err := New(&Config{
+				EntryFile: filepath.Join(dir, "main.ipd"),
+				UserAgent: "Isopod",
+				Store:     store.NoopStore{},
+			},
+				WithPredeclared("helm", &isopod.Module{Name: "helm"}),
+				WithGraphFormat(tc.format),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(ctx, GraphCommand, addon.NewCtx()); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected graph (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
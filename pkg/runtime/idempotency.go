@@ -0,0 +1,163 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// WithIdempotencyCheck returns an Option that installs addons a second time
+// in dry run and fails if any of them renders objects different from the
+// first run (e.g with random UUIDs or timestamps), which would be changed on
+// every rollout. Diffs of the second run are not printed. Must be applied
+// before WithKube and can't be combined with WithPlan.
+func WithIdempotencyCheck() Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("idempotency check option must be applied before kube package is initialized")
+		}
+		opts.idempotency = &idempotencyCheck{
+			rec:   plan.NewRecorder("", nil),
+			first: map[string][]*plan.Mutation{},
+		}
+		return nil
+	})
+}
+
+// idempotencyCheck records objects rendered by each addon run with the
+// recorder of the kube package.
+type idempotencyCheck struct {
+	rec *plan.Recorder
+	// first are mutations of the first run of each addon.
+	first map[string][]*plan.Mutation
+	// out is where diffs are written to unless muted (during the second
+	// run).
+	out   io.Writer
+	muted bool
+}
+
+// diffWriter returns writer of diffs muted during the second run that
+// writes to w (stdout if nil) otherwise.
+func (c *idempotencyCheck) diffWriter(w io.Writer) io.Writer {
+	if w == nil {
+		w = os.Stdout
+	}
+	c.out = w
+	return c
+}
+
+func (c *idempotencyCheck) Write(p []byte) (int, error) {
+	if c.muted {
+		return len(p), nil
+	}
+	return c.out.Write(p)
+}
+
+// begin starts recording mutations of a run of addon name.
+func (c *idempotencyCheck) begin(name string) {
+	c.rec.BeginCluster(name)
+	c.rec.BeginAddon(name)
+}
+
+// recorded returns mutations recorded since the last begin.
+func (c *idempotencyCheck) recorded() []*plan.Mutation {
+	cs := c.rec.Plan().Clusters
+	if len(cs) == 0 {
+		return nil
+	}
+	return cs[len(cs)-1].Mutations
+}
+
+// checkIdempotency installs addons (already installed once in dry run on
+// cluster) again and returns an error with diffs of objects of addons that
+// rendered them differently.
+func (r *runtime) checkIdempotency(ctx context.Context, cluster string, addons []*addon.Addon) error {
+	// Random values are seeded differently than in the first run, which
+	// would hide them.
+	ctx = addon.ContextWithRandSeed(ctx, cluster+"#2")
+	c := r.idempotency
+	c.muted = true
+	defer func() { c.muted = false }()
+
+	var msgs []string
+	for _, a := range addons {
+		c.begin(a.Name)
+		if err := a.Install(ctx); err != nil {
+			return fmt.Errorf("%v second run failed: %v", a, err)
+		}
+		first, err := renderMutations(c.first[a.Name])
+		if err != nil {
+			return err
+		}
+		second, err := renderMutations(c.recorded())
+		if err != nil {
+			return err
+		}
+		if first == second {
+			continue
+		}
+		diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(first),
+			B:        difflib.SplitLines(second),
+			FromFile: "first run",
+			ToFile:   "second run",
+			Context:  3,
+		})
+		msgs = append(msgs, fmt.Sprintf("%v renders different objects on each run:\n%s", a, strings.TrimSuffix(diff, "\n")))
+	}
+	// Stats, applied objects and timings of the second run are dropped.
+	if collector := r.statsCollector(); collector != nil {
+		collector.TakeStats()
+	}
+	if tracker := r.objectTracker(); tracker != nil {
+		tracker.TakeApplied()
+	}
+	if r.timer != nil {
+		r.timer.take()
+	}
+
+	if len(msgs) > 0 {
+		return fmt.Errorf("%d addon(s) are not idempotent:\n%s", len(msgs), redact.String(strings.Join(msgs, "\n")))
+	}
+	return nil
+}
+
+// renderMutations renders muts as YAML documents headed by the mutation.
+func renderMutations(muts []*plan.Mutation) (string, error) {
+	var b strings.Builder
+	for _, m := range muts {
+		fmt.Fprintf(&b, "# %v\n", m)
+		if m.Object == nil {
+			continue
+		}
+		bs, err := yaml.Marshal(m.Object)
+		if err != nil {
+			return "", fmt.Errorf("failed to render %v: %v", m, err)
+		}
+		b.Write(bs)
+	}
+	return b.String(), nil
+}
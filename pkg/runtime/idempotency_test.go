@@ -0,0 +1,118 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// fakeAPIServer serves discovery of ConfigMaps and no objects.
+func fakeAPIServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"kind": "APIVersions", "versions": ["v1"]}`))
+		case "/apis":
+			w.Write([]byte(`{"kind": "APIGroupList", "apiVersion": "v1", "groups": []}`))
+		case "/api/v1":
+			w.Write([]byte(`{"kind": "APIResourceList", "groupVersion": "v1", "resources": [{"name": "configmaps", "namespaced": true, "kind": "ConfigMap", "verbs": ["get", "create", "update", "delete"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+		}
+	}))
+}
+
+func TestIdempotencyCheck(t *testing.T) {
+	s := fakeAPIServer()
+	defer s.Close()
+
+	const configMap = `"apiVersion: v1\nkind: ConfigMap\ndata:\n  id: '%s'\n"`
+	for _, tc := range []struct {
+		name, value string
+		wantErr     string
+	}{
+		{
+			name:  "Idempotent",
+			value: `uuid.v5("stable")`,
+		},
+		{
+			// Random values are seeded differently in the second run.
+			name:    "Random",
+			value:   `uuid.v4()`,
+			wantErr: "1 addon(s) are not idempotent:\n<addon: cm> renders different objects on each run:\n--- first run\n+++ second run\n@@ -1,7 +1,7 @@\n # put /v1, Kind=ConfigMap `default/cm'\n apiVersion: v1\n data:\n-  id: ",
+		},
+		{
+			name:    "Timestamp",
+			value:   `time.format(time.now(), "15:04:05.000000000")`,
+			wantErr: "1 addon(s) are not idempotent:\n<addon: cm> renders different objects on each run:\n--- first run\n+++ second run\n@@ -1,7 +1,7 @@\n # put /v1, Kind=ConfigMap `default/cm'\n apiVersion: v1\n data:\n-  id: ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "main.ipd"), `
+def clusters(ctx):
+    return [onprem(cluster="test")]
+
+def addons(ctx):
+    return [addon("cm", "cm.ipd", ctx)]
+`)
+			writeFile(t, filepath.Join(dir, "cm.ipd"), `
+def install(ctx):
+    kube.put_yaml(name="cm", namespace="default", data=[`+strings.Replace(configMap, "%s", `" + `+tc.value+` + "`, 1)+`])
+`)
+			var diffs bytes.Buffer
+			r, err := New(&Config{
+				EntryFile: filepath.Join(dir, "main.ipd"),
+				UserAgent: "Isopod",
+				Store:     store.NoopStore{},
+				DryRun:    true,
+			}, WithIdempotencyCheck(), WithDiffWriter(&diffs), WithKube(&rest.Config{Host: s.URL}, false, nil), WithNoSpin())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"cluster": starlark.String("test")}}
+			err = r.Run(ctx, InstallCommand, sCtx)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr == "" && err != nil || !strings.Contains(gotErr, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			// Diffs are only printed by the first run.
+			if got := strings.Count(diffs.String(), "kind: ConfigMap"); got != 1 {
+				t.Errorf("Want diff printed once, got %d times:\n%s", got, diffs.String())
+			}
+		})
+	}
+}
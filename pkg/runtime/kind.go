@@ -0,0 +1,78 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KindBinary is the kind (Kubernetes in Docker) CLI used by KindCluster.
+var KindBinary = "kind"
+
+// KindCluster is an ephemeral kind cluster, e.g to run integration tests
+// against.
+type KindCluster struct {
+	// Name is the name of the kind cluster.
+	Name string
+	// Kubeconfig is the path of the client config of the cluster.
+	Kubeconfig string
+
+	out io.Writer
+	dir string
+}
+
+// NewKindCluster creates kind cluster name, waiting until its control plane
+// is ready. Output of kind is written to out. Delete must be called once the
+// cluster is no longer used, even if creation failed.
+func NewKindCluster(ctx context.Context, name string, out io.Writer) (*KindCluster, error) {
+	dir, err := ioutil.TempDir("", "isopod-kind-")
+	if err != nil {
+		return nil, err
+	}
+	c := &KindCluster{Name: name, Kubeconfig: filepath.Join(dir, "kubeconfig"), out: out, dir: dir}
+	if err := c.kind(ctx, "create", "cluster", "--name", name, "--kubeconfig", c.Kubeconfig, "--wait", "5m"); err != nil {
+		return c, fmt.Errorf("failed to create kind cluster `%s': %v", name, err)
+	}
+	return c, nil
+}
+
+// RESTConfig returns the client config of c.
+func (c *KindCluster) RESTConfig() (*rest.Config, error) {
+	return clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+}
+
+// Delete deletes c.
+func (c *KindCluster) Delete(ctx context.Context) error {
+	defer os.RemoveAll(c.dir)
+	if err := c.kind(ctx, "delete", "cluster", "--name", c.Name, "--kubeconfig", c.Kubeconfig); err != nil {
+		return fmt.Errorf("failed to delete kind cluster `%s': %v", c.Name, err)
+	}
+	return nil
+}
+
+func (c *KindCluster) kind(ctx context.Context, args ...string) error {
+	cmd := osexec.CommandContext(ctx, KindBinary, args...)
+	cmd.Stdout, cmd.Stderr = c.out, c.out
+	return cmd.Run()
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeKind is a kind CLI logging its args to $KIND_LOG and writing a
+// kubeconfig on create.
+const fakeKind = `#!/bin/sh
+echo "$@" >> "$KIND_LOG"
+[ "$1" = create ] || exit 0
+[ "$4" = broken ] && { echo "docker not running" >&2; exit 1; }
+cat > "$6" <<KUBECONFIG
+apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: kind
+  context:
+    cluster: kind
+current-context: kind
+KUBECONFIG
+`
+
+func TestKindCluster(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "kind")
+	if err := ioutil.WriteFile(bin, []byte(fakeKind), 0755); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "log")
+	defer func(b string) { KindBinary = b }(KindBinary)
+	KindBinary = bin
+	os.Setenv("KIND_LOG", log)
+	defer os.Unsetenv("KIND_LOG")
+
+	ctx := context.Background()
+	c, err := NewKindCluster(ctx, "isopod-test", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.RESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Host != "https://127.0.0.1:6443" {
+		t.Errorf("Unexpected host: %s", rc.Host)
+	}
+	if err := c.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.Kubeconfig); !os.IsNotExist(err) {
+		t.Errorf("Expected kubeconfig to be removed, got: %v", err)
+	}
+
+	broken, err := NewKindCluster(ctx, "broken", ioutil.Discard)
+	if err == nil || err.Error() != "failed to create kind cluster `broken': exit status 1" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := broken.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"create cluster --name isopod-test --kubeconfig " + c.Kubeconfig + " --wait 5m",
+		"delete cluster --name isopod-test --kubeconfig " + c.Kubeconfig,
+		"create cluster --name broken --kubeconfig " + broken.Kubeconfig + " --wait 5m",
+		"delete cluster --name broken --kubeconfig " + broken.Kubeconfig,
+	}, "\n")
+	if got := strings.TrimSpace(string(data)); got != want {
+		t.Errorf("Unexpected kind invocations.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// WithLiveStatus returns an Option that makes ListCommand report the last
+// rollout of each addon and whether its objects still match the live cluster
+// state (and GraphCommand report kinds and namespaces of objects each addon
+// applies). Objects are compared by running install in dry run mode, so dry
+// run is implied. Must be applied before WithVault and WithKube.
+func WithLiveStatus() Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("live status option must be applied before kube package is initialized")
+		}
+		if _, ok := opts.pkgs["vault"]; ok {
+			return fmt.Errorf("live status option must be applied before vault package is initialized")
+		}
+		opts.liveStatus = true
+		opts.dryRun = true
+		if opts.diffOut == nil {
+			opts.diffOut = ioutil.Discard
+		}
+		return nil
+	})
+}
+
+// addonStatus is a live status of an addon reported by ListCommand.
+type addonStatus struct {
+	name string
+	// rollout is the live rollout that ran the addon (nil if none).
+	rollout *store.Rollout
+	stats   kube.Stats
+	// stale is the number of objects recorded by rollout that the addon
+	// no longer applies.
+	stale int
+	err   error
+}
+
+// listLive prints live status of addons on cluster.
+func (r *runtime) listLive(ctx context.Context, cluster string, addons []*addon.Addon) error {
+	live, err := r.liveRollout()
+	if err != nil {
+		return err
+	}
+
+	collector, tracker := r.statsCollector(), r.objectTracker()
+	if collector == nil || tracker == nil {
+		return fmt.Errorf("`%s' with live status requires kube package", ListCommand)
+	}
+
+	var statuses []addonStatus
+	// Objects applied by all addons, so that objects moved between addons
+	// are not reported as stale.
+	var applied []store.ObjRef
+	for _, a := range addons {
+		s := addonStatus{name: a.Name}
+		collector.TakeStats()
+		tracker.TakeApplied()
+		s.err = a.Install(ctx)
+		s.stats = collector.TakeStats()
+		applied = append(applied, tracker.TakeApplied()...)
+		if addonRun(live, a.Name) != nil {
+			s.rollout = live
+		}
+		statuses = append(statuses, s)
+	}
+	for i, a := range addons {
+		if run := addonRun(live, a.Name); run != nil && statuses[i].err == nil {
+			statuses[i].stale = len(staleRefs(run.ObjRefs, applied))
+		}
+	}
+	return printStatuses(os.Stdout, cluster, statuses)
+}
+
+// printStatuses prints a table of addon statuses on cluster to w.
+func printStatuses(w io.Writer, cluster string, statuses []addonStatus) error {
+	if cluster != "" {
+		fmt.Fprintf(w, "Addons on cluster `%s':\n", cluster)
+	} else {
+		fmt.Fprintf(w, "Addons:\n")
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDON\tROLLOUT\tINSTALLED\tSTATUS")
+	for _, s := range statuses {
+		id, installed := "-", "-"
+		if s.rollout != nil {
+			id = string(s.rollout.ID)
+			if !s.rollout.Created.IsZero() {
+				installed = s.rollout.Created.UTC().Format(time.RFC3339)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.name, id, installed, s.status())
+	}
+	return tw.Flush()
+}
+
+// status returns whether objects of the addon match the live cluster state.
+func (s *addonStatus) status() string {
+	if s.err != nil {
+		return fmt.Sprintf("unknown (%v)", strings.SplitN(s.err.Error(), "\n", 2)[0])
+	}
+	var drift []string
+	for _, c := range []struct {
+		n    int
+		verb string
+	}{
+		{s.stats.Created, "missing"},
+		{s.stats.Updated, "changed"},
+		{s.stats.Recreated, "to recreate"},
+		{s.stale, "stale"},
+	} {
+		if c.n > 0 {
+			drift = append(drift, fmt.Sprintf("%d %s", c.n, c.verb))
+		}
+	}
+	if len(drift) == 0 {
+		return "in sync"
+	}
+	return fmt.Sprintf("drifted (%s)", strings.Join(drift, ", "))
+}
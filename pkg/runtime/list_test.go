@@ -0,0 +1,50 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestPrintStatuses(t *testing.T) {
+	ro := &store.Rollout{
+		ID:      "rollout-1",
+		Live:    true,
+		Created: time.Date(2021, 9, 20, 17, 4, 11, 0, time.UTC),
+	}
+	buf := &bytes.Buffer{}
+	if err := printStatuses(buf, "minikube", []addonStatus{
+		{name: "ingress", rollout: ro, stats: kube.Stats{Unchanged: 3}},
+		{name: "monitoring", rollout: ro, stats: kube.Stats{Created: 1, Updated: 2, Unchanged: 1}, stale: 1},
+		{name: "logging", err: errors.New("boom\ntraceback")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Addons on cluster `minikube':\n" +
+		"ADDON       ROLLOUT    INSTALLED             STATUS\n" +
+		"ingress     rollout-1  2021-09-20T17:04:11Z  in sync\n" +
+		"monitoring  rollout-1  2021-09-20T17:04:11Z  drifted (1 missing, 2 changed, 1 stale)\n" +
+		"logging     -          -                     unknown (boom)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected statuses.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
@@ -15,7 +15,9 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
 	"regexp"
@@ -39,7 +41,12 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
 	"github.com/cruise-automation/isopod/pkg/helm"
+	"github.com/cruise-automation/isopod/pkg/kpath"
 	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	"github.com/cruise-automation/isopod/pkg/secretref"
+	"github.com/cruise-automation/isopod/pkg/store"
 	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
@@ -50,11 +57,99 @@ type Option interface {
 }
 
 type options struct {
-	dryRun  bool
-	force   bool
-	noSpin  bool
-	pkgs    starlark.StringDict
-	addonRe *regexp.Regexp
+	dryRun   bool
+	force    bool
+	noSpin   bool
+	pkgs     starlark.StringDict
+	addonRe  *regexp.Regexp
+	recorder *plan.Recorder
+	diffOut  io.Writer
+	// diffCache is passed to kube package (set by WithDiffCache).
+	diffCache *kube.DiffCache
+	// httpTransport wraps transports of the http module (set by
+	// WithHTTPTransport).
+	httpTransport func(http.RoundTripper) http.RoundTripper
+	// execAllowed are commands the exec module may run (set by
+	// WithExec).
+	execAllowed []string
+	// customModules are predeclared after built-ins (set by
+	// WithCustomModule).
+	customModules starlark.StringDict
+	// policy restricts objects kube package may mutate (set by
+	// WithPolicy).
+	policy *kube.Policy
+	// secretResolver resolves secret references (set by WithVault).
+	secretResolver secretref.Resolver
+
+	eventHandlers []EventHandler
+	// diagnose enables collection of diagnostics of failed addons
+	// (optionally including pod logs).
+	diagnose, diagPodLogs bool
+	// liveStatus enables live status in ListCommand (set by
+	// WithLiveStatus).
+	liveStatus bool
+	// prune enables pruning of objects no longer applied by addons (set
+	// by WithPrune).
+	prune bool
+	// rollbackOnFailure enables rollback of objects applied by failed
+	// addons (set by WithRollbackOnFailure).
+	rollbackOnFailure bool
+	// strictRemove makes RemoveCommand fail on deletes of objects that
+	// don't exist (set by WithStrictRemove).
+	strictRemove bool
+	// snapshotDir is where live objects are archived before they are
+	// mutated (set by WithSnapshotDir).
+	snapshotDir string
+	// autoMigrateAPIs makes the kube package migrate objects of deprecated
+	// API versions (set by WithAutoMigrateAPIs).
+	autoMigrateAPIs bool
+	// strictOwnership makes the kube package fail updates overwriting
+	// fields managed by other managers (set by WithStrictOwnership).
+	strictOwnership bool
+	// skipMetadata disables Isopod's labels and context annotation on
+	// applied objects (set by WithoutManagedMetadata).
+	skipMetadata bool
+	// ctxMode is how addon contexts are annotated on objects (set by
+	// WithContextMode).
+	ctxMode kube.ContextMode
+	// defaultNamespace is the namespace of namespaced objects without one
+	// (set by WithDefaultNamespace).
+	defaultNamespace string
+	// idempotency records objects rendered by addons to check they are
+	// the same on a second run (set by WithIdempotencyCheck).
+	idempotency *idempotencyCheck
+	// vaultDryRun is how vault package behaves in dry run (set by
+	// WithVaultDryRunMode).
+	vaultDryRun vault.DryRunMode
+	// readOnly makes all packages fail writes (set by WithReadOnly).
+	readOnly bool
+	// changedBase is the git ref addon files are compared to (set by
+	// WithChangedOnly).
+	changedBase string
+	// graphFormat is the format GraphCommand prints in (set by
+	// WithGraphFormat).
+	graphFormat string
+	// extraEntryFiles are entry files merged with the one of Config (set by
+	// WithExtraEntryFiles).
+	extraEntryFiles []string
+	// profile is the profile merged into the addon context (set by
+	// WithProfile).
+	profile string
+	// preload makes Run load all addons before running any (set by
+	// WithPreload).
+	preload bool
+	// timings enables per-addon timing reports (set by WithTimings).
+	timings bool
+	// showCtx prints the addon ctx of each cluster (set by WithShowCtx).
+	showCtx bool
+	// retention selects rollouts kept in the store after a successful
+	// install (set by WithStoreRetention).
+	retention store.Retention
+	// cache is the cache module's Cache (set by WithCache).
+	cache *modules.Cache
+	// workspaceRoot is the root `//' paths are relative to (set by
+	// WithWorkspaceRoot).
+	workspaceRoot string
 }
 
 type fnOption func(*options) error
@@ -69,13 +164,42 @@ func WithNoSpin() Option {
 	})
 }
 
-// WithVault returns an Option that enables "vault" package.
+// WithVault returns an Option that enables "vault" package and resolution of
+// secret references to Vault. Must be applied before WithKube. In dry run the
+// package behaves as set by WithVaultDryRunMode (vault.DryRunReadOnly by
+// default, so that diffs are made against real secrets). Writing to Vault
+// (vault.DryRunReal) is refused while planning (see WithPlan).
 func WithVault(c *vapi.Client) Option {
 	return fnOption(func(opts *options) error {
-		opts.pkgs["vault"] = vault.New(c)
-		if opts.dryRun {
-			opts.pkgs["vault"], _, _ = vault.NewDryRunFake()
+		opts.secretResolver = vault.NewRefResolver(c)
+		if !opts.dryRun {
+			opts.pkgs["vault"] = vault.New(c)
+			return nil
+		}
+		mode := opts.vaultDryRun
+		if mode == "" {
+			mode = vault.DryRunReadOnly
+		}
+		if opts.recorder != nil && mode == vault.DryRunReal {
+			return fmt.Errorf("vault dry run mode `%s' is not supported while planning", mode)
+		}
+		m, err := vault.NewDryRun(c, mode)
+		if err != nil {
+			return err
+		}
+		opts.pkgs["vault"] = m
+		return nil
+	})
+}
+
+// WithVaultDryRunMode returns an Option that sets how "vault" package behaves
+// in dry run. Must be applied before WithVault.
+func WithVaultDryRunMode(mode vault.DryRunMode) Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["vault"]; ok {
+			return fmt.Errorf("vault dry run mode must be set before vault package is initialized")
 		}
+		opts.vaultDryRun = mode
 		return nil
 	})
 }
@@ -108,9 +232,26 @@ func (*protoRegistry) UnstableEnumValueMap(name string) map[string]int32 {
 	return nil
 }
 
+// skycfgModules returns skycfg's predeclared modules with proto module
+// extended by `proto.from_dict'.
+func skycfgModules() starlark.StringDict {
+	r := &protoRegistry{}
+	pkgs := skycfg.UnstablePredeclaredModules(r)
+	if p, ok := pkgs["proto"].(starlark.HasAttrs); ok {
+		pkgs["proto"] = modules.NewProtoModule(p, r)
+	}
+	return pkgs
+}
+
 // WithKube returns an Option that enables "kube" package.
 func WithKube(c *rest.Config, diff bool, diffFilters []string) Option {
 	return fnOption(func(opts *options) error {
+		for _, f := range diffFilters {
+			if _, err := kpath.Parse(f); err != nil {
+				return fmt.Errorf("failed to parse diff filter `%s': %v", f, err)
+			}
+		}
+
 		dC := discovery.NewDiscoveryClientForConfigOrDie(c)
 
 		t, err := rest.TransportFor(c)
@@ -123,9 +264,25 @@ func WithKube(c *rest.Config, diff bool, diffFilters []string) Option {
 			return err
 		}
 
-		opts.pkgs["kube"] = kube.New(c.Host, dC, dynC, &http.Client{Transport: t}, opts.dryRun, opts.force, diff, diffFilters)
-		pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
-		for name, pkg := range pkgs {
+		recorder, diffOut := opts.recorder, opts.diffOut
+		if opts.idempotency != nil {
+			if !opts.dryRun || recorder != nil {
+				return fmt.Errorf("idempotency check is only supported in dry run")
+			}
+			recorder, diffOut = opts.idempotency.rec, opts.idempotency.diffWriter(diffOut)
+		}
+		opts.pkgs["kube"] = kube.New(c.Host, dC, dynC, &http.Client{Transport: t}, kube.Options{
+			DryRun:         opts.dryRun,
+			Force:          opts.force,
+			Diff:           diff,
+			DiffFilters:    diffFilters,
+			Recorder:       recorder,
+			DiffOut:        diffOut,
+			SecretResolver: opts.secretResolver,
+			DiffCache:      opts.diffCache,
+			Policy:         opts.policy,
+		})
+		for name, pkg := range skycfgModules() {
 			opts.pkgs[name] = pkg
 		}
 
@@ -133,6 +290,95 @@ func WithKube(c *rest.Config, diff bool, diffFilters []string) Option {
 	})
 }
 
+// WithPlan returns an Option that records all intended Kubernetes mutations
+// into rec instead of applying them. Dry run is implied: vault package never
+// writes and http, grpc and exec packages fail as in read-only mode (see
+// WithReadOnly). Must be applied before WithVault and WithKube.
+func WithPlan(rec *plan.Recorder) Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("plan option must be applied before kube package is initialized")
+		}
+		if _, ok := opts.pkgs["vault"]; ok {
+			return fmt.Errorf("plan option must be applied before vault package is initialized")
+		}
+		opts.recorder = rec
+		opts.dryRun = true
+		return nil
+	})
+}
+
+// WithDiffWriter returns an Option that writes Kubernetes object diffs to w
+// instead of stdout. Must be applied before WithKube.
+func WithDiffWriter(w io.Writer) Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("diff writer option must be applied before kube package is initialized")
+		}
+		opts.diffOut = w
+		return nil
+	})
+}
+
+// WithDiffCache returns an Option that skips dry run diffs of objects that
+// had no diff in a previous run and haven't changed since (see
+// kube.DiffCache). Must be applied before WithKube.
+func WithDiffCache(c *kube.DiffCache) Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("diff cache option must be applied before kube package is initialized")
+		}
+		opts.diffCache = c
+		return nil
+	})
+}
+
+// WithHTTPTransport returns an Option that makes the http module wrap
+// transports it sends requests with with wrap.
+func WithHTTPTransport(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return fnOption(func(opts *options) error {
+		opts.httpTransport = wrap
+		return nil
+	})
+}
+
+// WithCustomModule returns an Option that predeclares module m (e.g. loaded
+// from a plugin) as name in the entry file and all addons. Runtime fails to
+// initialize if name conflicts with a built-in or in read-only mode.
+func WithCustomModule(name string, m starlark.HasAttrs) Option {
+	return fnOption(func(opts *options) error {
+		if opts.customModules == nil {
+			opts.customModules = starlark.StringDict{}
+		}
+		if _, ok := opts.customModules[name]; ok {
+			return fmt.Errorf("custom module `%s' already registered", name)
+		}
+		opts.customModules[name] = m
+		return nil
+	})
+}
+
+// WithExec returns an Option that allows the exec module to run commands
+// named in allowed.
+func WithExec(allowed []string) Option {
+	return fnOption(func(opts *options) error {
+		opts.execAllowed = allowed
+		return nil
+	})
+}
+
+// WithPolicy returns an Option that makes kube package refuse to mutate
+// objects not allowed by p (see kube.Policy). Must be applied before WithKube.
+func WithPolicy(p *kube.Policy) Option {
+	return fnOption(func(opts *options) error {
+		if _, ok := opts.pkgs["kube"]; ok {
+			return fmt.Errorf("policy option must be applied before kube package is initialized")
+		}
+		opts.policy = p
+		return nil
+	})
+}
+
 func WithHelm(baseDir string) Option {
 	return fnOption(func(opts *options) error {
 		v, ok := opts.pkgs["kube"]
@@ -151,6 +397,132 @@ func WithHelm(baseDir string) Option {
 	})
 }
 
+// WithPredeclared returns an Option that makes v available to Starlark code
+// under name.
+func WithPredeclared(name string, v starlark.Value) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs[name] = v
+		return nil
+	})
+}
+
+// WithStrictRemove returns an Option that makes `kube.delete' calls of
+// RemoveCommand fail if the object doesn't exist (by default they are ignored
+// so that removal of partially removed addons can be re-run).
+func WithStrictRemove() Option {
+	return fnOption(func(opts *options) error {
+		opts.strictRemove = true
+		return nil
+	})
+}
+
+// WithAutoMigrateAPIs returns an Option that applies objects of API versions
+// deprecated or removed in the cluster's release in their equivalent
+// replacement versions (instead of warning or failing).
+func WithAutoMigrateAPIs() Option {
+	return fnOption(func(opts *options) error {
+		opts.autoMigrateAPIs = true
+		return nil
+	})
+}
+
+// WithStrictOwnership returns an Option that fails updates of objects that
+// would overwrite fields managed by other managers (e.g replicas scaled by an
+// HorizontalPodAutoscaler) instead of logging a warning.
+func WithStrictOwnership() Option {
+	return fnOption(func(opts *options) error {
+		opts.strictOwnership = true
+		return nil
+	})
+}
+
+// WithoutManagedMetadata returns an Option that doesn't set the heritage
+// label, addon version labels and context annotation on objects applied by
+// `kube.put' and `kube.put_yaml' calls that don't set manage_metadata=True.
+// Applied objects are still recorded in the rollout store.
+func WithoutManagedMetadata() Option {
+	return fnOption(func(opts *options) error {
+		opts.skipMetadata = true
+		return nil
+	})
+}
+
+// WithContextMode returns an Option that sets how addon contexts are recorded
+// on applied objects. With kube.ContextHash objects are only annotated with a
+// hash of the context and full contexts are recorded in the rollout store.
+func WithContextMode(mode kube.ContextMode) Option {
+	return fnOption(func(opts *options) error {
+		opts.ctxMode = mode
+		return nil
+	})
+}
+
+// WithDefaultNamespace returns an Option that makes the kube package resolve
+// namespaced objects given without a namespace in namespace (see
+// kube.NamespaceDefaulter).
+func WithDefaultNamespace(namespace string) Option {
+	return fnOption(func(opts *options) error {
+		opts.defaultNamespace = namespace
+		return nil
+	})
+}
+
+// WithReadOnly returns an Option that makes kube, helm, vault and http
+// packages and the rollout store fail anything that would mutate external
+// state, even if an addon doesn't handle dry run correctly. Dry run diffs
+// still work.
+func WithReadOnly() Option {
+	return fnOption(func(opts *options) error {
+		opts.readOnly = true
+		return nil
+	})
+}
+
+// WithChangedOnly returns an Option that only runs addons whose files
+// (their modules, transitively loaded modules and data files and directories
+// of Helm charts they install) changed relative to git ref base. All addons
+// run if the entry file (or a module it loads) changed.
+func WithChangedOnly(base string) Option {
+	return fnOption(func(opts *options) error {
+		if base == "" {
+			return errors.New("git base ref cannot be empty")
+		}
+		opts.changedBase = base
+		return nil
+	})
+}
+
+// WithPreload returns an Option that loads modules of all addons concurrently
+// before any addon runs so that all load failures (e.g missing modules) are
+// reported at once instead of one after another.
+func WithPreload() Option {
+	return fnOption(func(opts *options) error {
+		opts.preload = true
+		return nil
+	})
+}
+
+// WithWorkspaceRoot returns an Option that resolves `//'-prefixed paths of
+// the runtime relative to root instead of the default workspace root (see
+// loader.SetWorkspaceRoot), so that runtimes of different workspaces may run
+// in the same process.
+func WithWorkspaceRoot(root string) Option {
+	return fnOption(func(opts *options) error {
+		opts.workspaceRoot = root
+		return nil
+	})
+}
+
+// WithCache returns an Option that backs the cache module with c. Runtimes
+// sharing c (e.g addons runtimes of all clusters of a run) share cached values.
+// Each runtime has its own Cache by default.
+func WithCache(c *modules.Cache) Option {
+	return fnOption(func(opts *options) error {
+		opts.cache = c
+		return nil
+	})
+}
+
 // WithAddonRegex returns an Option that filters addons using supplied regex.
 func WithAddonRegex(r *regexp.Regexp) Option {
 	return fnOption(func(opts *options) error {
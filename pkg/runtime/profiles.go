@@ -0,0 +1,144 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// ProfilesFunc is the name of the Starlark built-in that declares profiles
+// (per-environment addon context values) in the main entry file.
+const ProfilesFunc = "profiles"
+
+// WithProfile returns an Option that selects the profile (declared with
+// ProfilesFunc) merged into the addon context instead of the default one.
+func WithProfile(name string) Option {
+	return fnOption(func(opts *options) error {
+		if name == "" {
+			return errors.New("profile name must be set")
+		}
+		opts.profile = name
+		return nil
+	})
+}
+
+// profiles are the profiles declared by an entry file.
+type profiles struct {
+	declared bool
+	dflt     string
+	values   map[string]*starlark.Dict
+}
+
+// builtin returns the ProfilesFunc built-in that sets p:
+//
+//	profiles(default="dev", dev={"replicas": 1}, prod={"replicas": 3})
+func (p *profiles) builtin() *starlark.Builtin {
+	return starlark.NewBuiltin(ProfilesFunc, func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%s: unexpected positional arguments", b.Name())
+		}
+		if p.declared {
+			return nil, fmt.Errorf("%s: profiles already declared", b.Name())
+		}
+
+		dflt := ""
+		values := map[string]*starlark.Dict{}
+		for _, kv := range kwargs {
+			k := string(kv[0].(starlark.String))
+			if k == "default" {
+				s, ok := kv[1].(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `default' must be a string (got a `%s')", b.Name(), kv[1].Type())
+				}
+				dflt = string(s)
+				continue
+			}
+			d, ok := kv[1].(*starlark.Dict)
+			if !ok {
+				return nil, fmt.Errorf("%s: profile `%s' must be a dict (got a `%s')", b.Name(), k, kv[1].Type())
+			}
+			for _, item := range d.Items() {
+				if _, ok := item[0].(starlark.String); !ok {
+					return nil, fmt.Errorf("%s: profile `%s' keys must be strings (got a `%s')", b.Name(), k, item[0].Type())
+				}
+			}
+			values[k] = d
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("%s: no profile declared", b.Name())
+		}
+		if _, ok := values[dflt]; dflt != "" && !ok {
+			return nil, fmt.Errorf("%s: default profile `%s' is not declared", b.Name(), dflt)
+		}
+
+		p.declared, p.dflt, p.values = true, dflt, values
+		return starlark.None, nil
+	})
+}
+
+// names returns sorted names of declared profiles.
+func (p *profiles) names() []string {
+	var names []string
+	for n := range p.values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve returns values of profile name (the default profile if empty) or
+// nil if no profile is selected.
+func (p *profiles) resolve(name string) (*starlark.Dict, error) {
+	if name == "" {
+		name = p.dflt
+	}
+	if !p.declared || name == "" {
+		return nil, nil
+	}
+	values, ok := p.values[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile `%s' (declared: %s)", name, strings.Join(p.names(), ", "))
+	}
+	return values, nil
+}
+
+// withProfile returns a copy of skyCtx with values of the profile set for
+// keys skyCtx doesn't have (i.e cluster fields and --context take
+// precedence).
+func withProfile(skyCtx starlark.Value, values *starlark.Dict) starlark.Value {
+	c, ok := skyCtx.(*addon.SkyCtx)
+	if !ok || values == nil {
+		return skyCtx
+	}
+	merged := addon.NewCtx()
+	for k, v := range c.Attrs {
+		merged.Attrs[k] = v
+	}
+	for _, item := range values.Items() {
+		k := string(item[0].(starlark.String))
+		if v, ok := merged.Attrs[k]; ok && v != starlark.None {
+			continue
+		}
+		merged.Attrs[k] = item[1]
+	}
+	return merged
+}
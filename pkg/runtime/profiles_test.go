@@ -0,0 +1,109 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestProfiles(t *testing.T) {
+	const profilesExpr = `profiles(default="dev", dev={"replicas": 1, "env": "dev"}, prod={"replicas": 3, "tier": "gold"})`
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		profile    string
+		wantErr    error
+		wantResErr error
+		// wantCtx is the ctx with cluster field env=staging.
+		wantCtx string
+	}{
+		{
+			name:    "default",
+			expr:    profilesExpr,
+			wantCtx: `<ctx: {env: "staging", replicas: 1}>`,
+		},
+		{
+			name:    "selected",
+			expr:    profilesExpr,
+			profile: "prod",
+			wantCtx: `<ctx: {env: "staging", replicas: 3, tier: "gold"}>`,
+		},
+		{
+			name:    "no profiles",
+			expr:    `None`,
+			wantCtx: `<ctx: {env: "staging"}>`,
+		},
+		{
+			name:    "no default",
+			expr:    `profiles(prod={"replicas": 3})`,
+			wantCtx: `<ctx: {env: "staging"}>`,
+		},
+		{
+			name:       "unknown",
+			expr:       profilesExpr,
+			profile:    "qa",
+			wantResErr: errors.New("unknown profile `qa' (declared: dev, prod)"),
+		},
+		{
+			name:    "undeclared default",
+			expr:    `profiles(default="dev", prod={})`,
+			wantErr: errors.New("profiles: default profile `dev' is not declared"),
+		},
+		{
+			name:    "not a dict",
+			expr:    `profiles(prod=["replicas"])`,
+			wantErr: errors.New("profiles: profile `prod' must be a dict (got a `list')"),
+		},
+		{
+			name:    "declared twice",
+			expr:    `[profiles(dev={}), profiles(dev={})]`,
+			wantErr: errors.New("profiles: profiles already declared"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &profiles{}
+			pkgs := starlark.StringDict{ProfilesFunc: p.builtin()}
+			_, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			values, err := p.resolve(tc.profile)
+			if !util.ErrsEqual(err, tc.wantResErr) {
+				t.Fatalf("Unexpected resolve error.\nWant: %v\nGot: %v", tc.wantResErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			skyCtx := addon.NewCtx()
+			skyCtx.Attrs["env"] = starlark.String("staging")
+			if got := withProfile(skyCtx, values).String(); got != tc.wantCtx {
+				t.Errorf("Unexpected ctx.\nWant: %s\nGot: %s", tc.wantCtx, got)
+			}
+			if len(skyCtx.Attrs) != 1 {
+				t.Errorf("Cluster ctx was modified: %v", skyCtx)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// WithPrune returns an Option that makes InstallCommand delete objects
+// recorded for addons by the live rollout that none of them applies anymore
+// once all addons ran (so that objects moved between addons are kept).
+func WithPrune() Option {
+	return fnOption(func(opts *options) error {
+		opts.prune = true
+		return nil
+	})
+}
+
+// WithRollbackOnFailure returns an Option that makes InstallCommand restore
+// objects applied by a failed addon to their state before the addon run
+// (deleting newly created ones) before aborting the rollout.
+func WithRollbackOnFailure() Option {
+	return fnOption(func(opts *options) error {
+		opts.rollbackOnFailure = true
+		return nil
+	})
+}
+
+// objectTracker returns kube.ObjectTracker of the kube package or nil if the
+// kube package is not loaded.
+func (r *runtime) objectTracker() kube.ObjectTracker {
+	t, _ := r.pkgs["kube"].(kube.ObjectTracker)
+	return t
+}
+
+// liveRollout returns the live rollout from the store (nil if there is none).
+func (r *runtime) liveRollout() (*store.Rollout, error) {
+	if r.store == nil {
+		return nil, nil
+	}
+	ro, found, err := r.store.GetLive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get live rollout: %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	return ro, nil
+}
+
+// addonRun returns run of addon name in ro (nil if ro is nil or the addon
+// didn't run).
+func addonRun(ro *store.Rollout, name string) *store.AddonRun {
+	if ro == nil {
+		return nil
+	}
+	for _, run := range ro.Addons {
+		if run.Name == name {
+			return run
+		}
+	}
+	return nil
+}
+
+// staleRefs returns objects in prev that are not in cur.
+func staleRefs(prev, cur []store.ObjRef) []store.ObjRef {
+	var stale []store.ObjRef
+	for _, p := range prev {
+		found := false
+		for _, c := range cur {
+			if p.SameObject(c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, p)
+		}
+	}
+	return stale
+}
+
+// takeApplied returns objects applied since the last call.
+func (r *runtime) takeApplied() []store.ObjRef {
+	t := r.objectTracker()
+	if t == nil {
+		return nil
+	}
+	return t.TakeApplied()
+}
+
+// pruneStale prunes objects recorded for addons by live rollout that are not
+// in applied, the objects applied by all of addons (if pruning is enabled).
+func (r *runtime) pruneStale(ctx context.Context, live *store.Rollout, addons []*addon.Addon, applied []store.ObjRef) error {
+	t := r.objectTracker()
+	if !r.prune || t == nil {
+		return nil
+	}
+	var prev []store.ObjRef
+	for _, a := range addons {
+		if run := addonRun(live, a.Name); run != nil {
+			prev = append(prev, run.ObjRefs...)
+		}
+	}
+	if err := t.Prune(ctx, staleRefs(prev, applied)); err != nil {
+		return fmt.Errorf("failed to prune objects no longer applied: %v", err)
+	}
+	return nil
+}
+
+// maybeRollback rolls back objects applied by addon a that failed with err (if
+// enabled). Returns err annotated with the rollback outcome.
+func (r *runtime) maybeRollback(ctx context.Context, a *addon.Addon, err error) error {
+	t := r.objectTracker()
+	if !r.rollbackOnFailure || r.dryrun || t == nil {
+		return err
+	}
+	log.Infof("Rolling back objects applied by [%s]", a.Name)
+	if rErr := t.Rollback(ctx); rErr != nil {
+		return fmt.Errorf("%v\n\nrollback failed: %v", err, rErr)
+	}
+	return fmt.Errorf("%v\n\n(objects applied by the addon were rolled back)", err)
+}
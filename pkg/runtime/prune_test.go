@@ -0,0 +1,57 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestStaleRefs(t *testing.T) {
+	deploy := store.ObjRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "foo", Name: "bar"}
+	svc := store.ObjRef{APIVersion: "v1", Kind: "Service", Namespace: "foo", Name: "bar"}
+	ns := store.ObjRef{APIVersion: "v1", Kind: "Namespace", Name: "foo"}
+
+	for _, tc := range []struct {
+		name      string
+		prev, cur []store.ObjRef
+		want      []store.ObjRef
+	}{
+		{
+			name: "Nothing recorded",
+			cur:  []store.ObjRef{deploy},
+		},
+		{
+			name: "Object no longer applied",
+			prev: []store.ObjRef{ns, deploy, svc},
+			cur:  []store.ObjRef{ns, deploy},
+			want: []store.ObjRef{svc},
+		},
+		{
+			name: "Object moved to another API group",
+			prev: []store.ObjRef{{APIVersion: "extensions/v1beta1", Kind: "Deployment", Namespace: "foo", Name: "bar", ResourceVersion: "1"}},
+			cur:  []store.ObjRef{deploy},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, staleRefs(tc.prev, tc.cur)); d != "" {
+				t.Errorf("Unexpected stale objects (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// WithStoreRetention returns an Option that makes a successful InstallCommand
+// remove rollouts (and their addon runs) not kept by r from the store. It has
+// no effect on stores that don't implement store.Pruner (e.g. read-only).
+func WithStoreRetention(r store.Retention) Option {
+	return fnOption(func(opts *options) error {
+		if r.MaxAge < 0 || r.KeepLast < 0 {
+			return fmt.Errorf("invalid store retention %+v", r)
+		}
+		opts.retention = r
+		return nil
+	})
+}
+
+// pruneStore removes rollouts not kept by the store retention. Failures are
+// only logged as the rollout is already live.
+func (r *runtime) pruneStore() {
+	if !r.retention.Enabled() {
+		return
+	}
+	p, ok := r.store.(store.Pruner)
+	if !ok {
+		return
+	}
+	ids, err := p.Prune(r.retention, false)
+	if err != nil {
+		log.Warningf("Failed to prune rollout store: %v", err)
+	}
+	if len(ids) > 0 {
+		fmt.Printf("Pruned %d rollouts from the store.\n", len(ids))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+type pruningStore struct {
+	store.NoopStore
+	pruned *[]store.Retention
+}
+
+func (s pruningStore) Prune(r store.Retention, dryRun bool) ([]store.RolloutID, error) {
+	*s.pruned = append(*s.pruned, r)
+	return []store.RolloutID{"rollout-1"}, nil
+}
+
+func TestPruneStore(t *testing.T) {
+	retention := store.Retention{MaxAge: time.Hour}
+	for _, tc := range []struct {
+		name      string
+		retention store.Retention
+		readOnly  bool
+		want      int
+	}{
+		{name: "Enabled", retention: retention, want: 1},
+		{name: "Disabled"},
+		{name: "Read only", retention: retention, readOnly: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var pruned []store.Retention
+			var st store.Store = pruningStore{pruned: &pruned}
+			if tc.readOnly {
+				st = store.ReadOnlyStore{Store: st}
+			}
+			r := &runtime{store: st, retention: tc.retention}
+			r.pruneStore()
+			if len(pruned) != tc.want {
+				t.Fatalf("Want %d prunes, got %d", tc.want, len(pruned))
+			}
+			if tc.want > 0 && pruned[0] != tc.retention {
+				t.Errorf("Want retention %+v, got %+v", tc.retention, pruned[0])
+			}
+		})
+	}
+}
+
+func TestWithStoreRetention(t *testing.T) {
+	opts := &options{}
+	if err := WithStoreRetention(store.Retention{KeepLast: -1}).apply(opts); err == nil {
+		t.Error("Want error of negative KeepLast, got nil")
+	}
+}
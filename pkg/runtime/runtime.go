@@ -18,9 +18,12 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
@@ -28,14 +31,21 @@ import (
 	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
 
+	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/cloud"
 	"github.com/cruise-automation/isopod/pkg/cloud/gke"
+	"github.com/cruise-automation/isopod/pkg/cloud/incluster"
 	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/kube"
 	"github.com/cruise-automation/isopod/pkg/loader"
 	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/plan"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/secretref"
 	"github.com/cruise-automation/isopod/pkg/store"
 	"github.com/cruise-automation/isopod/pkg/util"
+	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
 const (
@@ -52,6 +62,40 @@ const (
 	TestCommand Command = "test"
 	// GenerateCommand is used to generate Starlark code from yaml input
 	GenerateCommand Command = "generate"
+	// PlanCommand evaluates install(ctx) method in each addon same as
+	// InstallCommand but records all intended mutations into a plan instead
+	// of applying them.
+	PlanCommand Command = "plan"
+	// ApplyCommand executes mutations recorded in a plan file by PlanCommand.
+	ApplyCommand Command = "apply"
+	// ControllerCommand continuously reconciles addons in-cluster by running
+	// InstallCommand periodically.
+	ControllerCommand Command = "controller"
+	// ServeCommand serves remote API for triggering InstallCommand and
+	// RemoveCommand.
+	ServeCommand Command = "serve"
+	// VersionsCommand reports versions of addons in the live rollout of each
+	// cluster.
+	VersionsCommand Command = "versions"
+	// NewCommand scaffolds a new addon directory (see NewAddon).
+	NewCommand Command = "new"
+	// ExplainCommand reports which addon and rollout manage an object (see
+	// Explain).
+	ExplainCommand Command = "explain"
+	// GraphCommand prints the graph of addons, modules they load and (with
+	// live status) kinds of objects they apply.
+	GraphCommand Command = "graph"
+	// CleanCommand garbage-collects dependency checkouts and caches not
+	// used recently.
+	CleanCommand Command = "clean"
+	// SelfUpdateCommand replaces the Isopod binary with a release version.
+	SelfUpdateCommand Command = "self-update"
+	// StoreCommand manages the rollout store, e.g. "store gc" removes
+	// rollouts not kept by the store retention.
+	StoreCommand Command = "store"
+	// CheckCommand validates entry files and addons they return without
+	// connecting to clusters (see Check).
+	CheckCommand Command = "check"
 
 	// ClustersStarFunc is the name of the function in Starlark that returns
 	// a list of Starlark built-ins that implement cloud.KubernetesVendor
@@ -65,6 +109,18 @@ const (
 // Command is the type of the supported Isopod runtime command.
 type Command string
 
+// LoadError is returned by Load and Run when an entry file, an addon or a
+// module they load failed to load (e.g. missing file or Starlark error).
+type LoadError struct {
+	Err error
+}
+
+// Error implements error.
+func (e *LoadError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *LoadError) Unwrap() error { return e.Err }
+
 // Runtime describe the Isopod runtime behaviors.
 type Runtime interface {
 	// Load parses and resolves the main entry Starlark file.
@@ -77,19 +133,71 @@ type Runtime interface {
 	// ForEachCluster calls the ClustersStarFunc in the main Starlark file with
 	// userCtx as argument to get a list of Starlark built-ins that implement
 	// the cloud.KubernetesVendor interface. It then iterates through each
-	// cluster to call the user given fn.
-	ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor)) error
+	// cluster to call the user given fn. userCtx is validated against the
+	// schema declared with ContextSchemaFunc (if any) first. Values returned
+	// by ClustersStarFunc that are not clusters are an error. fn is called on
+	// all clusters even if it fails on some; its errors are returned as
+	// ClusterErrors.
+	ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor) error) error
+
+	// Clusters returns clusters ForEachCluster would iterate through, in
+	// the same order, without printing them.
+	Clusters(ctx context.Context, userCtx map[string]string) ([]cloud.KubernetesVendor, error)
 }
 
 // runtime implements Runtime with Isopod builtins and globals from entry file.
 type runtime struct {
 	Config
-	// filename string
-	globals               starlark.StringDict
+	// entries are the entry file and extra entry files (see
+	// WithExtraEntryFiles).
+	entries               []*entry
 	pkgs                  starlark.StringDict // Predeclared packages.
 	addonRe               *regexp.Regexp
 	store                 store.Store
+	recorder              *plan.Recorder
+	eventHandlers         []EventHandler
 	noSpin, dryrun, force bool
+	diagnose, diagPodLogs bool
+	liveStatus, prune     bool
+	rollbackOnFailure     bool
+	strictRemove          bool
+	// snapshotDir is where live objects are archived before they are
+	// mutated (empty if disabled).
+	snapshotDir string
+	// rolloutID is the ID of the rollout created by the current run (if any).
+	rolloutID string
+	// stats of addons run by the current run.
+	stats []addonStats
+	// changedBase is the git ref addon files are compared to (empty if all
+	// addons run).
+	changedBase string
+	// graphFormat is the format GraphCommand prints in.
+	graphFormat string
+	// profile is the profile selected by WithProfile (empty for the
+	// default one).
+	profile string
+	// preload makes Run load all addons before running any.
+	preload bool
+	// showCtx prints the addon ctx of each cluster before running addons.
+	showCtx bool
+	// retention selects rollouts kept in the store after a successful
+	// install.
+	retention store.Retention
+	// idempotency checks objects rendered by addons in dry run are the same
+	// on a second run (nil if disabled).
+	idempotency *idempotencyCheck
+	// timer accumulates time spent in built-ins (nil unless WithTimings is
+	// set) and timings are timings of addons run by the current run.
+	timer   *builtinTimer
+	timings []addonTimings
+	// entryFiles are the entry files and files they loaded.
+	entryFiles  []string
+	changedOnce sync.Once
+	changed     changedSet
+	changedErr  error
+	// workspaceRoot is the root `//' paths are relative to (the default
+	// workspace root if empty).
+	workspaceRoot string
 }
 
 func init() {
@@ -110,10 +218,12 @@ func New(c *Config, opts ...Option) (Runtime, error) {
 		dryRun: c.DryRun,
 		force:  c.Force,
 		pkgs: starlark.StringDict{
-			"error":  starlark.NewBuiltin("error", addon.ErrorFn),
-			"sleep":  starlark.NewBuiltin("sleep", addon.SleepFn),
-			"gke":    gke.NewGKEBuiltin(c.GCPSvcAcctKeyFile, c.UserAgent),
-			"onprem": onprem.NewOnPremBuiltin(c.KubeConfigPath),
+			"error":      starlark.NewBuiltin("error", addon.ErrorFn),
+			"sleep":      starlark.NewBuiltin("sleep", addon.SleepFn),
+			"secret_ref": starlark.NewBuiltin("secret_ref", secretref.Builtin),
+			"gke":        gke.NewGKEBuiltin(c.GCPSvcAcctKeyFile, c.UserAgent),
+			"onprem":     onprem.NewOnPremBuiltin(c.KubeConfigPath),
+			"incluster":  incluster.NewInClusterBuiltin(),
 		},
 	}
 	for _, o := range opts {
@@ -122,41 +232,194 @@ func New(c *Config, opts ...Option) (Runtime, error) {
 		}
 	}
 
+	schema := &contextSchema{}
+	prof := &profiles{}
 	pkgs := options.pkgs
 	pkgs["addon"] = addon.NewAddonBuiltin(filepath.Dir(c.EntryFile), options.pkgs)
+	pkgs[ContextSchemaFunc] = schema.builtin()
+	pkgs[ProfilesFunc] = prof.builtin()
+	pkgs[IsopodVersionFunc] = versionBuiltin(c.Version)
 	for n, pkg := range modules.Predeclared() {
 		pkgs[n] = pkg
 	}
+	if options.cache == nil {
+		options.cache = modules.NewCache()
+	}
+	pkgs["cache"] = options.cache.Module()
+	if options.httpTransport != nil {
+		pkgs["http"] = modules.NewHTTPModuleWithTransport(options.httpTransport)
+	}
+	if len(options.execAllowed) > 0 {
+		pkgs["exec"] = modules.NewExecModule(options.execAllowed)
+	}
+	if k, ok := pkgs["kube"].(kube.Bootstrapper); ok {
+		c := http.DefaultClient
+		if options.httpTransport != nil {
+			c = &http.Client{Transport: options.httpTransport(http.DefaultTransport)}
+		}
+		pkgs["bootstrap"] = k.Bootstrap(c)
+	}
+	for n, m := range options.customModules {
+		if _, ok := pkgs[n]; ok {
+			return nil, fmt.Errorf("custom module `%s' conflicts with a built-in", n)
+		}
+		// Reads of custom modules can't be told apart from writes.
+		if options.readOnly {
+			return nil, fmt.Errorf("custom module `%s': %w", n, isopod.ErrReadOnly)
+		}
+		pkgs[n] = m
+	}
+	// Plans must not have side effects other than reads either.
+	if options.readOnly || options.recorder != nil {
+		if h, ok := pkgs["http"].(*isopod.Module); ok {
+			pkgs["http"] = modules.ReadOnlyHTTP(h)
+		}
+		if g, ok := pkgs["grpc"].(*isopod.Module); ok {
+			pkgs["grpc"] = modules.ReadOnlyGRPC(g)
+		}
+		if e, ok := pkgs["exec"].(*isopod.Module); ok {
+			pkgs["exec"] = modules.ReadOnlyExec(e)
+		}
+	}
+	if options.readOnly {
+		// Vault writes are already faked in dry run unless real.
+		if v, ok := pkgs["vault"].(*isopod.Module); ok && (!options.dryRun || options.vaultDryRun == vault.DryRunReal) {
+			pkgs["vault"] = vault.ReadOnly(v)
+		}
+	}
+	entries, err := newEntries(c.EntryFile, pkgs, schema, prof, options.extraEntryFiles)
+	if err != nil {
+		return nil, err
+	}
 
-	return &runtime{
-		Config:  *c,
-		pkgs:    pkgs,
-		addonRe: options.addonRe,
-		store:   c.Store,
-		noSpin:  options.noSpin,
-		dryrun:  options.dryRun,
-		force:   options.force,
-	}, nil
+	r := &runtime{
+		Config:            *c,
+		entries:           entries,
+		pkgs:              pkgs,
+		addonRe:           options.addonRe,
+		store:             c.Store,
+		recorder:          options.recorder,
+		noSpin:            options.noSpin,
+		eventHandlers:     options.eventHandlers,
+		dryrun:            options.dryRun,
+		force:             options.force,
+		diagnose:          options.diagnose,
+		diagPodLogs:       options.diagPodLogs,
+		liveStatus:        options.liveStatus,
+		prune:             options.prune,
+		rollbackOnFailure: options.rollbackOnFailure,
+		strictRemove:      options.strictRemove,
+		snapshotDir:       options.snapshotDir,
+		changedBase:       options.changedBase,
+		graphFormat:       options.graphFormat,
+		profile:           options.profile,
+		preload:           options.preload,
+		showCtx:           options.showCtx,
+		retention:         options.retention,
+		idempotency:       options.idempotency,
+		workspaceRoot:     options.workspaceRoot,
+	}
+	if options.readOnly && r.store != nil {
+		r.store = store.ReadOnlyStore{Store: r.store}
+	}
+	if g, ok := pkgs["kube"].(kube.ReadOnlyGuard); ok && options.readOnly {
+		g.SetReadOnly(true)
+	}
+	if s, ok := pkgs["kube"].(kube.Snapshotter); ok && r.snapshotDir != "" {
+		s.SetSnapshotFunc(r.archiveSnapshot)
+	}
+	if m, ok := pkgs["kube"].(kube.APIMigrator); ok && options.autoMigrateAPIs {
+		m.SetAutoMigrateAPIs(true)
+	}
+	if c, ok := pkgs["kube"].(kube.OwnershipChecker); ok && options.strictOwnership {
+		c.SetStrictOwnership(true)
+	}
+	if mm, ok := pkgs["kube"].(kube.MetadataManager); ok && options.skipMetadata {
+		mm.SetManageMetadata(false)
+	}
+	if c, ok := pkgs["kube"].(kube.ContextRecorder); ok && options.ctxMode != "" {
+		c.SetContextMode(options.ctxMode)
+	}
+	if d, ok := pkgs["kube"].(kube.NamespaceDefaulter); ok && options.defaultNamespace != "" {
+		d.SetDefaultNamespace(options.defaultNamespace)
+	}
+	if options.timings {
+		// Packages are wrapped in place as addon built-ins share maps of
+		// entries. r.pkgs keeps unwrapped ones for type assertions.
+		r.pkgs = make(starlark.StringDict, len(pkgs))
+		for n, pkg := range pkgs {
+			r.pkgs[n] = pkg
+		}
+		r.timer = newBuiltinTimer()
+		for _, e := range entries {
+			timePkgs(r.timer, e.pkgs)
+		}
+	}
+	return r, nil
 }
 
-func (r *runtime) Load(ctx context.Context) error {
-	thread := &starlark.Thread{
-		Print: printFn,
-		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(r.EntryFile), r.pkgs).Load,
+// takeContexts returns addon contexts the kube package only annotated
+// objects with the hash of since the last call.
+func (r *runtime) takeContexts() map[string]string {
+	if c, ok := r.pkgs["kube"].(kube.ContextRecorder); ok {
+		return c.TakeContexts()
 	}
+	return nil
+}
 
-	data, err := ioutil.ReadFile(r.EntryFile)
-	if err != nil {
-		return err
-	}
+func (r *runtime) Load(ctx context.Context) error {
+	r.entryFiles = nil
+	var declared bool
+	for _, e := range r.entries {
+		l := loader.NewWorkspaceModulesLoader(filepath.Dir(e.file), r.workspaceRoot, e.pkgs, loader.NewCache())
+		thread := &starlark.Thread{
+			Print: printFn,
+			Load:  l.Load,
+		}
+		thread.SetLocal(addon.WorkspaceRootKey, r.workspaceRoot)
 
-	r.globals, err = starlark.ExecFile(thread, r.EntryFile, data, r.pkgs)
-	if err != nil {
-		return err
+		data, err := ioutil.ReadFile(e.file)
+		if err != nil {
+			return &LoadError{err}
+		}
+
+		e.globals, err = starlark.ExecFile(thread, e.file, data, e.pkgs)
+		if err != nil {
+			return &LoadError{err}
+		}
+		r.entryFiles = append(r.entryFiles, e.file)
+		for f := range l.GetLoadedFiles() {
+			r.entryFiles = append(r.entryFiles, f)
+		}
+
+		if e.profile, err = e.profiles.resolve(r.profile); err != nil {
+			return fmt.Errorf("`%s': %v", e.file, err)
+		}
+		declared = declared || e.profiles.declared
+	}
+	if r.profile != "" && !declared {
+		return fmt.Errorf("profile `%s' is selected but no profiles are declared with %s()", r.profile, ProfilesFunc)
 	}
 	return nil
 }
 
+// changedFiles returns files changed relative to r.changedBase or nil if all
+// addons must run because the entry file (or a module it loads) changed.
+func (r *runtime) changedFiles() (changedSet, error) {
+	r.changedOnce.Do(func() {
+		r.changed, r.changedErr = gitChangedFiles(filepath.Dir(r.EntryFile), r.changedBase)
+		if r.changedErr != nil {
+			r.changedErr = fmt.Errorf("failed to compute files changed relative to `%s': %v", r.changedBase, r.changedErr)
+			return
+		}
+		if f, ok := r.changed.affects(r.entryFiles); ok {
+			log.Infof("`%s' changed relative to `%s', running all addons", f, r.changedBase)
+			r.changed = nil
+		}
+	})
+	return r.changed, r.changedErr
+}
+
 // spinMsg prints spinner while waiting on errCh to return error, then exits.
 func spinMsg(addonName string, errCh chan error) {
 	s := spin.New()
@@ -176,41 +439,133 @@ func spinMsg(addonName string, errCh chan error) {
 	}
 }
 
-func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.Addon) error {
+func (r *runtime) runCommand(ctx context.Context, cmd Command, cluster string, addons []*addon.Addon) error {
+	// Random values of dry runs are seeded by cluster (and addon) so that
+	// diffs are stable.
+	if r.dryrun {
+		ctx = addon.ContextWithRandSeed(ctx, cluster)
+	}
+	diag := r.diagnoser()
+	collector := r.statsCollector()
+	takeStats := func() (s kube.Stats) {
+		if collector != nil {
+			s = collector.TakeStats()
+		}
+		return s
+	}
+	tracker := r.objectTracker()
 	runUntilErr := func(addons []*addon.Addon, addonFn func(a *addon.Addon) error) error {
 		for _, a := range addons {
-			if err := addonFn(a); err != nil {
+			r.emit(&Event{Type: AddonStarted, Command: cmd, Cluster: cluster, Addon: a.Name})
+			if diag != nil {
+				diag.ResetTouched()
+			}
+			// Drop objects mutated outside of addons (e.g by clusters()).
+			takeStats()
+			if tracker != nil {
+				tracker.TakeApplied()
+			}
+			if r.timer != nil {
+				r.timer.take()
+			}
+			start := time.Now()
+			err := addonFn(a)
+			if r.timer != nil {
+				r.timings = append(r.timings, addonTimings{name: a.Name, total: time.Since(start), builtins: r.timer.take()})
+			}
+			stats := takeStats()
+			r.stats = append(r.stats, addonStats{name: a.Name, stats: stats})
+			if err != nil {
+				err = redact.Error(r.withDiagnostics(ctx, diag, err))
+				r.emit(&Event{Type: AddonFailed, Command: cmd, Cluster: cluster, Addon: a.Name, Err: err, Stats: stats})
 				return fmt.Errorf("%v run failed: %v", a, err)
 			}
+			r.emit(&Event{Type: AddonSucceeded, Command: cmd, Cluster: cluster, Addon: a.Name, Stats: stats})
 		}
 		return nil
 	}
 
 	switch cmd {
 	case ListCommand:
+		if r.liveStatus {
+			return r.listLive(ctx, cluster, addons)
+		}
 		var lstMsgs []string
 		for _, a := range addons {
 			lstMsgs = append(lstMsgs, a.StringPretty())
 		}
-		// TODO(dmitry-ilyevskiy): Print "live" status.
 		fmt.Printf("Configured addons:\n\t%s\n", strings.Join(lstMsgs, "\n\t"))
 
+	case GraphCommand:
+		return r.graph(ctx, cluster, addons)
+
 	case InstallCommand:
-		installAddonFn := func(a *addon.Addon) (err error) {
+		var live *store.Rollout
+		if r.prune {
+			var err error
+			if live, err = r.liveRollout(); err != nil {
+				return err
+			}
+		}
+		// Addon is only verified against live cluster as dry run doesn't
+		// change anything.
+		install := func(a *addon.Addon) error {
+			err := a.Install(ctx)
+			if err == nil && !r.dryrun {
+				start := time.Now()
+				err = a.Verify(ctx)
+				if r.timer != nil {
+					r.timer.add(verifyTiming, time.Since(start))
+				}
+			}
+			if err != nil {
+				return r.maybeRollback(ctx, a, err)
+			}
+			return nil
+		}
+		// Objects applied by all addons, which objects recorded by the
+		// live rollout are pruned against.
+		var applied []store.ObjRef
+		installAddonFn := func(a *addon.Addon) ([]store.ObjRef, error) {
 			if r.noSpin {
-				return a.Install(ctx)
+				if err := install(a); err != nil {
+					return nil, err
+				}
+				refs := r.takeApplied()
+				applied = append(applied, refs...)
+				return refs, nil
 			}
 			errCh := make(chan error)
 			go spinMsg(a.Name, errCh)
-			err = a.Install(ctx)
+			err := install(a)
 			errCh <- err
-			return err
+			if err != nil {
+				return nil, err
+			}
+			refs := r.takeApplied()
+			applied = append(applied, refs...)
+			return refs, nil
 		}
 
 		if r.dryrun {
-			if err := runUntilErr(addons, installAddonFn); err != nil {
+			if err := runUntilErr(addons, func(a *addon.Addon) error {
+				if r.idempotency != nil {
+					r.idempotency.begin(a.Name)
+				}
+				_, err := installAddonFn(a)
+				if r.idempotency != nil {
+					r.idempotency.first[a.Name] = r.idempotency.recorded()
+				}
+				return err
+			}); err != nil {
 				return fmt.Errorf("failed addon installation: %v", err)
 			}
+			if err := r.pruneStale(ctx, live, addons, applied); err != nil {
+				return err
+			}
+			if r.idempotency != nil {
+				return r.checkIdempotency(ctx, cluster, addons)
+			}
 			return nil
 		}
 
@@ -220,16 +575,21 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 			return fmt.Errorf("failed to initilize rollout state: %v", err)
 		}
 
+		r.rolloutID = string(rollout.ID)
 		fmt.Printf("Beginning rollout [%v] installation...\n", rollout.ID)
 
 		if err := runUntilErr(addons, func(a *addon.Addon) (err error) {
-			if err := installAddonFn(a); err != nil {
+			refs, err := installAddonFn(a)
+			if err != nil {
 				return err
 			}
 			if _, err := r.store.PutAddonRun(rollout.ID, &store.AddonRun{
 				Name:    a.Name,
+				Version: a.GetModule().Version(),
 				Modules: a.LoadedModules(),
-				// TODO(dmitry-ilyevskiy): Fill in .Data and .ObjRefs.
+				ObjRefs: refs,
+				// TODO(dmitry-ilyevskiy): Fill in .Data.
+				Contexts: r.takeContexts(),
 			}); err != nil {
 				return fmt.Errorf("failed to store run state for `%s' addon: %v", a.Name, err)
 			}
@@ -237,16 +597,31 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 		}); err != nil {
 			return fmt.Errorf("failed addon installation: %v", err)
 		}
+		if err := r.pruneStale(ctx, live, addons, applied); err != nil {
+			return err
+		}
 
 		if err := r.store.CompleteRollout(rollout.ID); err != nil {
 			return fmt.Errorf("failed to commit `live' rollout state: %v", err)
 		}
 
 		fmt.Printf("Rollout [%v] is live!\n", rollout.ID)
+		r.pruneStore()
+
+	case PlanCommand:
+		if r.recorder == nil {
+			return fmt.Errorf("`%s' requires runtime to be initialized with plan recorder", cmd)
+		}
+		if err := runUntilErr(addons, func(a *addon.Addon) error {
+			r.recorder.BeginAddon(a.Name)
+			return a.Install(ctx)
+		}); err != nil {
+			return fmt.Errorf("failed addon planning: %v", err)
+		}
 
 	case RemoveCommand:
 		return runUntilErr(addons, func(a *addon.Addon) error {
-			return a.Remove(ctx)
+			return a.Remove(ctx, !r.strictRemove)
 		})
 	default:
 		return fmt.Errorf("command `%s' is not implemented", cmd)
@@ -257,20 +632,20 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) error {
 	log.Infof("runtime running with `%v' command", cmd)
 
-	ret, err := r.callStarlarkFunc(ctx, AddonsStarFunc, starlark.Tuple{skyCtx})
+	addonsList, err := r.addons(ctx, r.entries, skyCtx)
 	if err != nil {
 		return err
 	}
 
-	addonsList, ok := ret.(*starlark.List)
-	if !ok {
-		return fmt.Errorf("%v must be a list (got a %s)", ret, ret.Type())
+	var changed changedSet
+	if r.changedBase != "" {
+		if changed, err = r.changedFiles(); err != nil {
+			return err
+		}
 	}
 
-	var loaded []*addon.Addon
-	var loadedNs []string
-	for i := 0; i < addonsList.Len(); i++ {
-		addonV := addonsList.Index(i)
+	var matched []*addon.Addon
+	for _, addonV := range addonsList {
 		a, ok := addonV.(*addon.Addon)
 		if !ok {
 			return fmt.Errorf("%v is not an addon object (got a %s)", addonV, addonV.Type())
@@ -280,31 +655,99 @@ func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) e
 			log.V(1).Infof("%v doesn't match filter regexp (%v), skipping...", a, r.addonRe)
 			continue
 		}
+		matched = append(matched, a)
+	}
+
+	if r.preload {
+		if err := preloadAddons(ctx, matched); err != nil {
+			return err
+		}
+	}
 
+	var loaded []*addon.Addon
+	var loadedNs []string
+	for _, a := range matched {
 		if err := a.Load(ctx); err != nil {
-			return fmt.Errorf("%v load failed: %v", a, err)
+			return &LoadError{fmt.Errorf("%v load failed: %v", a, err)}
+		}
+		if changed != nil {
+			f, ok := changed.affects(a.Files())
+			if !ok {
+				log.Infof("%v has no files changed relative to `%s', skipping...", a, r.changedBase)
+				continue
+			}
+			log.V(1).Infof("%v runs because `%s' changed", a, f)
 		}
 		loaded = append(loaded, a)
 		loadedNs = append(loadedNs, a.Name)
 	}
 
+	if len(loaded) == 0 && changed != nil {
+		fmt.Printf("No addon files changed relative to `%s', nothing to %s.\n", r.changedBase, cmd)
+		return nil
+	}
 	if len(loaded) == 0 {
 		return fmt.Errorf("no addon matches the filter regexp")
 	}
 
 	log.Infof("Running `%s' for %v...", cmd, loadedNs)
 
-	if err := r.runCommand(ctx, cmd, loaded); err != nil {
-		return fmt.Errorf("`%v' execution failed: %v", cmd, err)
+	cluster := clusterOf(skyCtx)
+	r.rolloutID = ""
+	r.stats = nil
+	r.timings = nil
+	r.emit(&Event{Type: RolloutStarted, Command: cmd, Cluster: cluster, Addons: loadedNs})
+	err = r.runCommand(ctx, cmd, cluster, loaded)
+	if (cmd == InstallCommand || cmd == RemoveCommand) && r.statsCollector() != nil {
+		if pErr := printStats(os.Stdout, cluster, r.stats); pErr != nil {
+			log.Warningf("Failed to print summary: %v", pErr)
+		}
+	}
+	if len(r.timings) > 0 {
+		if pErr := printTimings(os.Stdout, cluster, r.timings); pErr != nil {
+			log.Warningf("Failed to print timings: %v", pErr)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("`%v' execution failed: %v", cmd, err)
+		r.emit(&Event{Type: RolloutFailed, Command: cmd, Cluster: cluster, RolloutID: r.rolloutID, Addons: loadedNs, Err: err, Stats: totalStats(r.stats)})
+		return err
 	}
+	r.emit(&Event{Type: RolloutSucceeded, Command: cmd, Cluster: cluster, RolloutID: r.rolloutID, Addons: loadedNs, Stats: totalStats(r.stats)})
 
-	return err
+	return nil
+}
+
+// preloadAddons loads addons concurrently and returns error listing all
+// addons that failed to load.
+func preloadAddons(ctx context.Context, addons []*addon.Addon) error {
+	errs := make([]error, len(addons))
+	var wg sync.WaitGroup
+	for i, a := range addons {
+		wg.Add(1)
+		go func(i int, a *addon.Addon) {
+			defer wg.Done()
+			errs[i] = a.Load(ctx)
+		}(i, a)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", addons[i], err))
+		}
+	}
+	if len(msgs) > 0 {
+		return &LoadError{fmt.Errorf("%d addon(s) failed to load:\n\t%s", len(msgs), strings.Join(msgs, "\n\t"))}
+	}
+	return nil
 }
 
-func (r *runtime) callStarlarkFunc(ctx context.Context, fnName string, args starlark.Tuple) (starlark.Value, error) {
-	entry, ok := r.globals[fnName]
+func (r *runtime) callStarlarkFunc(ctx context.Context, e *entry, fnName string, args starlark.Tuple) (starlark.Value, error) {
+	entry, ok := e.globals[fnName]
 	if !ok {
-		return nil, fmt.Errorf("no %q function found in %q", fnName, r.EntryFile)
+		return nil, fmt.Errorf("no %q function found in %q", fnName, e.file)
 	}
 
 	entryFn, ok := entry.(starlark.Callable)
@@ -317,47 +760,19 @@ func (r *runtime) callStarlarkFunc(ctx context.Context, fnName string, args star
 		Print: printFn,
 	}
 	thread.SetLocal("context", ctx)
+	// Addons declared by entryFn are anchored in the runtime's workspace.
+	thread.SetLocal(addon.WorkspaceRootKey, r.workspaceRoot)
 
 	ret, err := starlark.Call(thread, entryFn, args, nil)
-	return ret, util.HumanReadableEvalError(err)
+	return ret, redact.Error(util.HumanReadableEvalError(err))
 }
 
 func goMapToSkyCtx(m map[string]string) *addon.SkyCtx {
-	skyParams := make(starlark.StringDict, len(m))
-	for k, v := range m {
-		skyParams[k] = starlark.String(v)
-	}
-	return &addon.SkyCtx{Attrs: skyParams}
-}
-
-func (r *runtime) ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor)) error {
-	ret, err := r.callStarlarkFunc(ctx, "clusters", starlark.Tuple{goMapToSkyCtx(userCtx)})
-	if err != nil {
-		return fmt.Errorf("error when calling `clusters': %v ", err)
-	}
-
-	chosenClusters, ok := ret.(*starlark.List)
-	if !ok {
-		return fmt.Errorf("%v must be a list (got a `%s')", ret, ret.Type())
+	c := addon.NewCtx()
+	if err := c.SetPaths(m); err != nil {
+		log.Errorf("failed to set ctx: %v", err)
 	}
-
-	iter := chosenClusters.Iterate()
-	defer iter.Done()
-	var cluster starlark.Value
-	for iter.Next(&cluster) {
-		// Currently only supports GKE. Other vendors can easily be supported.
-		k8sVendor, ok := cluster.(cloud.KubernetesVendor)
-		if !ok {
-			log.Errorf("Builtin `%v' does not implement cloud.KubernetesVendor interface. Skipping...", cluster)
-			continue
-		}
-
-		clusterName := k8sVendor.AddonSkyCtx(userCtx).Attrs["cluster"]
-		fmt.Printf("Current cluster: (%s)\n", clusterName)
-
-		fn(k8sVendor)
-	}
-	return nil
+	return c
 }
 
-func printFn(_ *starlark.Thread, msg string) { fmt.Println(msg) }
+func printFn(_ *starlark.Thread, msg string) { fmt.Println(redact.String(msg)) }
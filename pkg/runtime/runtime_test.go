@@ -16,11 +16,17 @@ package runtime
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
 
+	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/cloud"
 	"github.com/cruise-automation/isopod/pkg/store"
 )
@@ -63,13 +69,14 @@ func TestForEachCluster(t *testing.T) {
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			var gotClusters []string
-			if err := runtime.ForEachCluster(ctx, tc.selector, func(k8sVendor cloud.KubernetesVendor) {
+			if err := runtime.ForEachCluster(ctx, tc.selector, func(k8sVendor cloud.KubernetesVendor) error {
 				c := k8sVendor.AddonSkyCtx(tc.selector)
 				gotClusters = append(gotClusters, string(c.Attrs["cluster"].(starlark.String)))
 
 				if err := runtime.Run(ctx, InstallCommand, c); err != nil {
 					t.Errorf("Run failed: %v", err)
 				}
+				return nil
 			}); err != nil {
 				t.Fatal(err)
 			}
@@ -77,6 +84,201 @@ func TestForEachCluster(t *testing.T) {
 			if d := cmp.Diff(tc.expectClusters, gotClusters); d != "" {
 				t.Errorf("Unexpected cluster (-want, +got):\n%s", d)
 			}
+
+			vendors, err := runtime.Clusters(ctx, tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var listed []string
+			for _, v := range vendors {
+				listed = append(listed, string(v.AddonSkyCtx(tc.selector).Attrs["cluster"].(starlark.String)))
+			}
+			if d := cmp.Diff(tc.expectClusters, listed); d != "" {
+				t.Errorf("Unexpected listed clusters (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestForEachClusterErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name, clusters string
+		fail           map[string]bool
+		wantClusters   []string
+		wantErr        string
+	}{
+		{
+			name:         "cluster errors",
+			clusters:     `[onprem(cluster="a"), onprem(cluster="b"), onprem(cluster="c")]`,
+			fail:         map[string]bool{"a": true, "c": true},
+			wantClusters: []string{"a", "b", "c"},
+			wantErr:      "cluster `a': failed\ncluster `c': failed",
+		},
+		{
+			name:     "not a cluster",
+			clusters: `[onprem(cluster="a"), "b"]`,
+			wantErr:  "main.ipd:1:1: clusters(ctx) item 1 must be a cluster, e.g gke() or onprem() (got a string: \"b\")",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := filepath.Join(t.TempDir(), "main.ipd")
+			data := "def clusters(ctx):\n    return " + tc.clusters + "\n\ndef addons(ctx):\n    return []\n"
+			if err := ioutil.WriteFile(entry, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r, err := New(&Config{EntryFile: entry, UserAgent: "Isopod", Store: store.NoopStore{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var gotClusters []string
+			err = r.ForEachCluster(ctx, nil, func(k8sVendor cloud.KubernetesVendor) error {
+				c := string(k8sVendor.AddonSkyCtx(nil).Attrs["cluster"].(starlark.String))
+				gotClusters = append(gotClusters, c)
+				if tc.fail[c] {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			if err == nil || strings.TrimPrefix(err.Error(), filepath.Dir(entry)+"/") != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %v", tc.wantErr, err)
+			}
+			if d := cmp.Diff(tc.wantClusters, gotClusters); d != "" {
+				t.Errorf("Unexpected clusters (-want, +got):\n%s", d)
+			}
+			var errs ClusterErrors
+			if errors.As(err, &errs) != (tc.fail != nil) {
+				t.Errorf("Unexpected ClusterErrors: %v", errs)
+			}
+		})
+	}
+}
+
+func TestClusterErrors(t *testing.T) {
+	errHeld := errors.New("held")
+	loadErr := &LoadError{errors.New("syntax error")}
+	errs := ClusterErrors{
+		{Cluster: "a", Err: errors.New("failed")},
+		{Cluster: "b", Err: fmt.Errorf("lost lock: %w", errHeld)},
+		{Cluster: "c", Err: fmt.Errorf("failed to load: %w", loadErr)},
+	}
+	err := fmt.Errorf("apply failed: %w", errs)
+
+	if !errors.Is(err, errHeld) {
+		t.Error("Want error of cluster b to match")
+	}
+	if errors.Is(err, errors.New("held")) {
+		t.Error("Unexpected match of another error")
+	}
+	var gotLoadErr *LoadError
+	if !errors.As(err, &gotLoadErr) || gotLoadErr != loadErr {
+		t.Errorf("Want load error of cluster c, got: %v", gotLoadErr)
+	}
+	var gotErrs ClusterErrors
+	if !errors.As(err, &gotErrs) || len(gotErrs) != 3 {
+		t.Errorf("Want ClusterErrors, got: %v", gotErrs)
+	}
+}
+
+func TestWithCustomModule(t *testing.T) {
+	entry := filepath.Join(t.TempDir(), "main.ipd")
+	if err := ioutil.WriteFile(entry, []byte("CLUSTERS = cmdb.clusters\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmdb := &isopod.Module{
+		Name:  "cmdb",
+		Attrs: starlark.StringDict{"clusters": starlark.MakeInt(3)},
+	}
+	c := &Config{EntryFile: entry, UserAgent: "Isopod", Store: store.NoopStore{}}
+
+	r, err := New(c, WithCustomModule("cmdb", cmdb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Load(context.Background()); err != nil {
+		t.Fatalf("Failed to load entry file using custom module: %v", err)
+	}
+
+	wantErr := "custom module `http' conflicts with a built-in"
+	if _, err := New(c, WithCustomModule("http", cmdb)); err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error. Want: %s, got: %v", wantErr, err)
+	}
+	wantErr = "failed to apply options: custom module `cmdb' already registered"
+	if _, err := New(c, WithCustomModule("cmdb", cmdb), WithCustomModule("cmdb", cmdb)); err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error. Want: %s, got: %v", wantErr, err)
+	}
+	if _, err := New(c, WithCustomModule("cmdb", cmdb), WithReadOnly()); !errors.Is(err, isopod.ErrReadOnly) {
+		t.Errorf("Unexpected error. Want: %v, got: %v", isopod.ErrReadOnly, err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	dir := t.TempDir()
+	for f, data := range map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [
+        addon("ingress", "ingress.ipd", ctx),
+        addon("metrics", "metrics.ipd", ctx),
+        addon("logging", "logging.ipd", ctx),
+    ]
+`,
+		"ingress.ipd":    "load(\"lib/missing.ipd\", \"x\")\n",
+		"metrics.ipd":    "load(\"lib/common.ipd\", \"y\")\n",
+		"logging.ipd":    "load(\"lib/gone.ipd\", \"z\")\n",
+		"lib/common.ipd": "y = 1\n",
+	} {
+		writeFile(t, filepath.Join(dir, f), data)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		wantErrs []string
+	}{
+		{
+			name:     "Sequential",
+			wantErrs: []string{"<addon: ingress> load failed", "missing.ipd"},
+		},
+		{
+			name: "Preload",
+			opts: []Option{WithPreload()},
+			wantErrs: []string{
+				"2 addon(s) failed to load",
+				"<addon: ingress>: cannot load lib/missing.ipd",
+				"<addon: logging>: cannot load lib/gone.ipd",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(&Config{
+				EntryFile: filepath.Join(dir, "main.ipd"),
+				UserAgent: "Isopod",
+				Store:     store.NoopStore{},
+			}, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			err = r.Run(context.Background(), ListCommand, starlark.NewDict(0))
+			if err == nil {
+				t.Fatal("Want error, got nil")
+			}
+			var lErr *LoadError
+			if !errors.As(err, &lErr) {
+				t.Errorf("Want *LoadError, got %T", err)
+			}
+			for _, want := range tc.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Want error containing %q, got: %v", want, err)
+				}
+			}
 		})
 	}
 }
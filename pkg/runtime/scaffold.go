@@ -0,0 +1,359 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Addon templates supported by NewAddon.
+const (
+	// YAMLTemplate applies plain manifests from a directory.
+	YAMLTemplate = "yaml"
+	// HelmTemplate applies a local Helm chart.
+	HelmTemplate = "helm"
+	// OperatorTemplate puts an operator Deployment and its RBAC as protos.
+	OperatorTemplate = "operator"
+)
+
+var addonNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// NewAddon scaffolds directory name in dir containing a new addon from tmpl
+// (one of YAMLTemplate, HelmTemplate or OperatorTemplate), its unit tests,
+// an entry file declaring context schema and an isopod.deps file. Fails if
+// the directory already exists. Returns paths of created files.
+func NewAddon(dir, name, tmpl string) ([]string, error) {
+	if !addonNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid addon name `%s' (must consist of lower case alphanumeric characters or `-')", name)
+	}
+	files, ok := addonTemplates[tmpl]
+	if !ok {
+		return nil, fmt.Errorf("unknown template `%s' (must be one of: %s)", tmpl, strings.Join(templateNames(), ", "))
+	}
+
+	root := filepath.Join(dir, name)
+	if _, err := os.Stat(root); err == nil {
+		return nil, fmt.Errorf("`%s' already exists", root)
+	}
+
+	params := struct{ Name, Ident, Template string }{
+		Name:     name,
+		Ident:    strings.ReplaceAll(name, "-", "_"),
+		Template: tmpl,
+	}
+	all := map[string]string{}
+	for p, s := range commonAddonFiles {
+		all[p] = s
+	}
+	for p, s := range files {
+		all[p] = s
+	}
+
+	paths := make([]string, 0, len(all))
+	for p := range all {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var created []string
+	for _, p := range paths {
+		// Go templates in Helm charts are left alone.
+		t, err := template.New(p).Delims("[[", "]]").Parse(all[p])
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, params); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(root, strings.ReplaceAll(p, "NAME", name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return nil, err
+		}
+		created = append(created, path)
+	}
+	return created, nil
+}
+
+func templateNames() []string {
+	var ns []string
+	for n := range addonTemplates {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// commonAddonFiles are created for all templates. NAME in paths is replaced
+// with the addon name.
+var commonAddonFiles = map[string]string{
+	"main.ipd": `# vim: set syntax=python:
+
+# Entry file to install the [[.Name]] addon on its own, e.g:
+#
+#     isopod --context=env=dev install main.ipd
+
+context_schema(required=["env"])
+
+CLUSTERS = [
+    onprem(env="dev", cluster="minikube"),
+]
+
+
+def clusters(ctx):
+    return [c for c in CLUSTERS if c.env == ctx.env]
+
+
+def addons(ctx):
+    return [
+        addon("[[.Name]]", "[[.Name]].ipd", ctx),
+    ]
+`,
+	"isopod.deps": `# vim: set syntax=python:
+
+# Remote modules loaded with load("@name//path/to/file", ...), e.g:
+#
+# git_repository(
+#     name="isopod_tools",
+#     commit="<commit>",
+#     remote="https://github.com/cruise-automation/isopod.git",
+# )
+`,
+	"NAME_test.ipd": `# vim: set syntax=python:
+
+load("[[.Name]].ipd", "config", "install")
+
+
+def test_config_defaults(t):
+    c = config(t.ctx)
+    assert(c.namespace == "[[.Name]]", "unexpected namespace: %s" % c.namespace)
+
+
+def test_config_namespace(t):
+    t.ctx.namespace = "foo"
+    c = config(t.ctx)
+    assert(c.namespace == "foo", "unexpected namespace: %s" % c.namespace)
+
+
+def test_install(t):
+    t.ctx.namespace = "foo"
+    install(t.ctx)
+[[- if eq .Template "operator"]]
+    d = kube.get(deployment="foo/[[.Name]]", api_group="apps")
+    assert(d.spec.template.spec.serviceAccountName == "[[.Name]]", "unexpected deployment: %s" % d)
+[[- else]]
+    cm = kube.get(configmap="foo/[[.Name]]")
+    assert(cm.data["example"] != None, "unexpected data: %s" % cm.data)
+[[- end]]
+`,
+}
+
+// addonTemplates are files of each template on top of commonAddonFiles.
+var addonTemplates = map[string]map[string]string{
+	YAMLTemplate: {
+		"NAME.ipd": `# vim: set syntax=python:
+
+corev1 = proto.package("k8s.io.api.core.v1")
+metav1 = proto.package("k8s.io.apimachinery.pkg.apis.meta.v1")
+
+
+def config(ctx):
+    """Returns settings of the addon derived from cluster ctx."""
+    return struct(
+        namespace=ctx.namespace or "[[.Name]]",
+    )
+
+
+def install(ctx):
+    c = config(ctx)
+    kube.put(
+        name=c.namespace,
+        data=[corev1.Namespace(metadata=metav1.ObjectMeta(name=c.namespace))],
+    )
+    kube.apply_dir("//manifests/", namespace=c.namespace)
+
+
+def remove(ctx):
+    c = config(ctx)
+    kube.delete(configmap=c.namespace + "/[[.Name]]")
+    kube.delete(namespace=c.namespace)
+`,
+		"manifests/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: [[.Name]]
+data:
+  example: value
+`,
+	},
+	HelmTemplate: {
+		"NAME.ipd": `# vim: set syntax=python:
+
+corev1 = proto.package("k8s.io.api.core.v1")
+metav1 = proto.package("k8s.io.apimachinery.pkg.apis.meta.v1")
+
+
+def config(ctx):
+    """Returns settings of the addon derived from cluster ctx."""
+    return struct(
+        namespace=ctx.namespace or "[[.Name]]",
+        values={
+            "example": ctx.env or "default",
+        },
+    )
+
+
+def install(ctx):
+    c = config(ctx)
+    kube.put(
+        name=c.namespace,
+        data=[corev1.Namespace(metadata=metav1.ObjectMeta(name=c.namespace))],
+    )
+    helm.apply(
+        release_name="[[.Name]]",
+        chart="//charts/[[.Name]]",
+        namespace=c.namespace,
+        values=[c.values],
+    )
+
+
+def remove(ctx):
+    c = config(ctx)
+    kube.delete(configmap=c.namespace + "/[[.Name]]")
+    kube.delete(namespace=c.namespace)
+`,
+		"charts/NAME/Chart.yaml": `apiVersion: v2
+name: [[.Name]]
+version: 0.1.0
+`,
+		"charts/NAME/values.yaml": `example: value
+`,
+		"charts/NAME/templates/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+  namespace: {{ .Release.Namespace }}
+data:
+  example: {{ .Values.example | quote }}
+`,
+	},
+	OperatorTemplate: {
+		"NAME.ipd": `# vim: set syntax=python:
+
+appsv1 = proto.package("k8s.io.api.apps.v1")
+corev1 = proto.package("k8s.io.api.core.v1")
+metav1 = proto.package("k8s.io.apimachinery.pkg.apis.meta.v1")
+rbacv1 = proto.package("k8s.io.api.rbac.v1")
+
+name = "[[.Name]]"
+
+
+def config(ctx):
+    """Returns settings of the addon derived from cluster ctx."""
+    return struct(
+        namespace=ctx.namespace or "[[.Name]]",
+        image=ctx.[[.Ident]]_image or "example.com/[[.Name]]:latest",
+    )
+
+
+def install(ctx):
+    c = config(ctx)
+    labels = {"app": name}
+
+    kube.put(
+        name=c.namespace,
+        data=[corev1.Namespace(metadata=metav1.ObjectMeta(name=c.namespace))],
+    )
+    kube.put(
+        name=name,
+        namespace=c.namespace,
+        data=[corev1.ServiceAccount(metadata=metav1.ObjectMeta(name=name))],
+    )
+    kube.put(
+        name=name,
+        api_group="rbac.authorization.k8s.io",
+        data=[
+            rbacv1.ClusterRole(
+                metadata=metav1.ObjectMeta(name=name),
+                rules=[
+                    rbacv1.PolicyRule(
+                        apiGroups=[""],
+                        resources=["configmaps"],
+                        verbs=["get", "list", "watch"],
+                    ),
+                ],
+            ),
+            rbacv1.ClusterRoleBinding(
+                metadata=metav1.ObjectMeta(name=name),
+                roleRef=rbacv1.RoleRef(
+                    apiGroup="rbac.authorization.k8s.io",
+                    kind="ClusterRole",
+                    name=name,
+                ),
+                subjects=[
+                    rbacv1.Subject(
+                        kind="ServiceAccount",
+                        name=name,
+                        namespace=c.namespace,
+                    ),
+                ],
+            ),
+        ],
+    )
+    kube.put(
+        name=name,
+        namespace=c.namespace,
+        api_group="apps",
+        data=[appsv1.Deployment(
+            metadata=metav1.ObjectMeta(name=name, labels=labels),
+            spec=appsv1.DeploymentSpec(
+                replicas=1,
+                selector=metav1.LabelSelector(matchLabels=labels),
+                template=corev1.PodTemplateSpec(
+                    metadata=metav1.ObjectMeta(labels=labels),
+                    spec=corev1.PodSpec(
+                        serviceAccountName=name,
+                        containers=[corev1.Container(
+                            name=name,
+                            image=c.image,
+                        )],
+                    ),
+                ),
+            ),
+        )],
+    )
+
+
+def remove(ctx):
+    c = config(ctx)
+    kube.delete(deployment=c.namespace + "/" + name, api_group="apps")
+    kube.delete(clusterrolebinding=name, api_group="rbac.authorization.k8s.io")
+    kube.delete(clusterrole=name, api_group="rbac.authorization.k8s.io")
+    kube.delete(serviceaccount=c.namespace + "/" + name)
+    kube.delete(namespace=c.namespace)
+`,
+	},
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAddon(t *testing.T) {
+	for _, tmpl := range []string{YAMLTemplate, HelmTemplate, OperatorTemplate} {
+		t.Run(tmpl, func(t *testing.T) {
+			dir := t.TempDir()
+			paths, err := NewAddon(dir, "my-addon", tmpl)
+			if err != nil {
+				t.Fatalf("NewAddon failed: %v", err)
+			}
+			if len(paths) == 0 {
+				t.Fatal("No files created")
+			}
+
+			// Scaffolded tests must pass out of the box.
+			out := &bytes.Buffer{}
+			ok, err := RunUnitTests(context.Background(), filepath.Join(dir, "my-addon")+"/...", out, out)
+			if err != nil || !ok {
+				t.Errorf("Scaffolded tests failed: %v\n%s", err, out)
+			}
+
+			if _, err := NewAddon(dir, "my-addon", tmpl); err == nil {
+				t.Error("Expected error scaffolding existing addon")
+			}
+		})
+	}
+}
+
+func TestNewAddonErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, addon, tmpl, wantErr string
+	}{
+		{
+			name:    "invalid name",
+			addon:   "My_Addon",
+			tmpl:    YAMLTemplate,
+			wantErr: "invalid addon name `My_Addon' (must consist of lower case alphanumeric characters or `-')",
+		},
+		{
+			name:    "unknown template",
+			addon:   "my-addon",
+			tmpl:    "kustomize",
+			wantErr: "unknown template `kustomize' (must be one of: helm, operator, yaml)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAddon(t.TempDir(), tc.addon, tc.tmpl)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("Unexpected error. Want: %s, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// ContextSchemaFunc is the name of the Starlark built-in that declares the
+// schema of the user context in the main entry file.
+const ContextSchemaFunc = "context_schema"
+
+// contextTypes maps supported schema type names to value validators.
+var contextTypes = map[string]func(string) error{
+	"string": func(string) error { return nil },
+	"int": func(s string) error {
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err
+	},
+	"float": func(s string) error {
+		_, err := strconv.ParseFloat(s, 64)
+		return err
+	},
+	"bool": func(s string) error {
+		_, err := strconv.ParseBool(s)
+		return err
+	},
+}
+
+// contextSchema describes keys and value types of the user context passed
+// with --context.
+type contextSchema struct {
+	declared bool
+	required []string
+	types    map[string]string
+}
+
+// builtin returns the ContextSchemaFunc built-in that sets s:
+//
+//	context_schema(required=["env", "region"], types={"replicas": "int"})
+func (s *contextSchema) builtin() *starlark.Builtin {
+	return starlark.NewBuiltin(ContextSchemaFunc, func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var required *starlark.List
+		var types *starlark.Dict
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "required?", &required, "types?", &types); err != nil {
+			return nil, err
+		}
+		if s.declared {
+			return nil, fmt.Errorf("%s: schema already declared", b.Name())
+		}
+
+		var req []string
+		if required != nil {
+			for i := 0; i < required.Len(); i++ {
+				k, ok := required.Index(i).(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `required' must be a list of strings (got a `%s')", b.Name(), required.Index(i).Type())
+				}
+				req = append(req, string(k))
+			}
+		}
+
+		ts := map[string]string{}
+		if types != nil {
+			for _, item := range types.Items() {
+				k, ok := item[0].(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `types' keys must be strings (got a `%s')", b.Name(), item[0].Type())
+				}
+				v, ok := item[1].(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("%s: `types' values must be strings (got a `%s')", b.Name(), item[1].Type())
+				}
+				if _, ok := contextTypes[string(v)]; !ok {
+					return nil, fmt.Errorf("%s: unsupported type `%s' for `%s' (must be one of: string, int, float, bool)", b.Name(), string(v), string(k))
+				}
+				ts[string(k)] = string(v)
+			}
+		}
+
+		s.declared, s.required, s.types = true, req, ts
+		return starlark.None, nil
+	})
+}
+
+// validate checks userCtx against s. All violations are reported at once.
+func (s *contextSchema) validate(userCtx map[string]string) error {
+	if !s.declared {
+		return nil
+	}
+
+	var errs []string
+	for _, k := range s.required {
+		if v, ok := userCtx[k]; !ok || v == "" {
+			errs = append(errs, fmt.Sprintf("missing required key `%s'", k))
+		}
+	}
+	keys := make([]string, 0, len(s.types))
+	for k := range s.types {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := userCtx[k]
+		if !ok {
+			continue
+		}
+		if err := contextTypes[s.types[k]](v); err != nil {
+			errs = append(errs, fmt.Sprintf("`%s=%s' is not a valid %s", k, v, s.types[k]))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid context: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
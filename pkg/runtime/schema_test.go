@@ -0,0 +1,77 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestContextSchema(t *testing.T) {
+	const schema = `context_schema(required=["env", "region"], types={"replicas": "int", "canary": "bool"})`
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		userCtx    map[string]string
+		wantErr    error
+		wantValErr error
+	}{
+		{
+			name:    "valid",
+			expr:    schema,
+			userCtx: map[string]string{"env": "dev", "region": "us-west1", "replicas": "3"},
+		},
+		{
+			name:    "no schema",
+			expr:    `None`,
+			userCtx: map[string]string{},
+		},
+		{
+			name:       "missing and mistyped",
+			expr:       schema,
+			userCtx:    map[string]string{"env": "dev", "replicas": "three", "canary": "maybe"},
+			wantValErr: errors.New("invalid context: missing required key `region'; `canary=maybe' is not a valid bool; `replicas=three' is not a valid int"),
+		},
+		{
+			name:    "unsupported type",
+			expr:    `context_schema(types={"replicas": "list"})`,
+			wantErr: errors.New("context_schema: unsupported type `list' for `replicas' (must be one of: string, int, float, bool)"),
+		},
+		{
+			name:    "declared twice",
+			expr:    `[context_schema(), context_schema()]`,
+			wantErr: errors.New("context_schema: schema already declared"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &contextSchema{}
+			pkgs := starlark.StringDict{ContextSchemaFunc: s.builtin()}
+			_, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if err := s.validate(tc.userCtx); !util.ErrsEqual(err, tc.wantValErr) {
+				t.Errorf("Unexpected validation error.\nWant: %v\nGot: %v", tc.wantValErr, err)
+			}
+		})
+	}
+}
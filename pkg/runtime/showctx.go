@@ -0,0 +1,99 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// WithShowCtx returns an Option that prints the ctx addons of each cluster
+// are created with (cluster attributes merged with context parameters,
+// cluster facts and the selected profile) as YAML before running them.
+// Tracked secret values and values of fields named like secrets (see
+// secretKeyRe) are redacted.
+func WithShowCtx() Option {
+	return fnOption(func(opts *options) error {
+		opts.showCtx = true
+		return nil
+	})
+}
+
+// secretKeyRe matches names of fields whose values are redacted by printCtx
+// even if not tracked (e.g. cluster auth fields or secrets not read yet).
+var secretKeyRe = regexp.MustCompile(`(?i)secret|token|password|passwd|credential|private_key|client_key|ca_data`)
+
+// redactSecretKeys replaces values of fields of x named like secrets with
+// redact.Placeholder.
+func redactSecretKeys(x interface{}) interface{} {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			if secretKeyRe.MatchString(k) {
+				x[k] = redact.Placeholder
+			} else {
+				x[k] = redactSecretKeys(v)
+			}
+		}
+	case []interface{}:
+		for i, v := range x {
+			x[i] = redactSecretKeys(v)
+		}
+	}
+	return x
+}
+
+// printCtx prints skyCtx passed to AddonsStarFunc of entryFile (empty if
+// there is a single entry file) on cluster as YAML to w.
+func printCtx(w io.Writer, cluster, entryFile string, skyCtx starlark.Value) error {
+	c, ok := skyCtx.(*addon.SkyCtx)
+	if !ok {
+		return fmt.Errorf("unexpected ctx type `%s'", skyCtx.Type())
+	}
+	attrs := make(map[string]interface{}, len(c.Attrs))
+	for k, v := range c.Attrs {
+		buf := &bytes.Buffer{}
+		var x interface{}
+		if err := modules.WriteJSON(buf, v); err != nil || json.Unmarshal(buf.Bytes(), &x) != nil {
+			// Not representable in JSON (e.g. a proto message).
+			x = v.String()
+		}
+		attrs[k] = x
+	}
+	data, err := yaml.Marshal(redactSecretKeys(attrs))
+	if err != nil {
+		return err
+	}
+
+	header := "\nCtx"
+	if cluster != "" {
+		header += fmt.Sprintf(" for cluster `%s'", cluster)
+	}
+	if entryFile != "" {
+		header += fmt.Sprintf(" (%s)", entryFile)
+	}
+	_, err = fmt.Fprintf(w, "%s:\n%s", header, redact.String(string(data)))
+	return err
+}
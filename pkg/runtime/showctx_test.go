@@ -0,0 +1,78 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+func TestPrintCtx(t *testing.T) {
+	redact.Add("show-ctx-secret")
+
+	labels := starlark.NewDict(1)
+	if err := labels.SetKey(starlark.String("team"), starlark.String("infra")); err != nil {
+		t.Fatal(err)
+	}
+	c := addon.NewCtx()
+	c.Attrs["cluster"] = starlark.String("minikube")
+	c.Attrs["replicas"] = starlark.MakeInt(3)
+	c.Attrs["labels"] = labels
+	vault := starlark.NewDict(1)
+	if err := vault.SetKey(starlark.String("db_password"), starlark.String("not-read-yet")); err != nil {
+		t.Fatal(err)
+	}
+	c.Attrs["vault"] = vault
+	c.Attrs["oidc_client_secret"] = starlark.String("not-tracked")
+	c.Attrs["zones"] = starlark.NewList([]starlark.Value{starlark.String("a"), starlark.String("b")})
+	c.Attrs["token"] = starlark.String("show-ctx-secret")
+	c.Attrs["fn"] = starlark.NewBuiltin("fn", nil)
+
+	for _, tc := range []struct {
+		name, cluster, entryFile, wantHeader string
+	}{
+		{name: "Single entry file", cluster: "minikube", wantHeader: "\nCtx for cluster `minikube':\n"},
+		{name: "Multiple entry files", cluster: "minikube", entryFile: "main.ipd", wantHeader: "\nCtx for cluster `minikube' (main.ipd):\n"},
+		{name: "No cluster", wantHeader: "\nCtx:\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := printCtx(buf, tc.cluster, tc.entryFile, c); err != nil {
+				t.Fatal(err)
+			}
+			want := tc.wantHeader + `cluster: minikube
+fn: <built-in function fn>
+labels:
+  team: infra
+oidc_client_secret: <redacted>
+replicas: 3
+token: <redacted>
+vault:
+  db_password: <redacted>
+zones:
+- a
+- b
+`
+			if got := buf.String(); got != want {
+				t.Errorf("Unexpected ctx.\nWant:\n%s\nGot:\n%s", want, got)
+			}
+		})
+	}
+}
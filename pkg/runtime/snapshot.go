@@ -0,0 +1,75 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// WithSnapshotDir returns an Option that makes InstallCommand archive
+// manifests of live objects in dir before addons mutate them. Manifests are
+// written to <dir>/<rollout ID>/<addon>/ (see snapshotFile).
+func WithSnapshotDir(dir string) Option {
+	return fnOption(func(opts *options) error {
+		opts.snapshotDir = dir
+		return nil
+	})
+}
+
+// snapshotFile returns name of the file manifest of object ref is archived in,
+// e.g `deployment.apps_default_nginx.yaml' (namespace is omitted for
+// cluster-scoped objects). Object names can't contain underscores so the name
+// is unambiguous.
+func snapshotFile(ref store.ObjRef) string {
+	kind := strings.ToLower(ref.Kind)
+	if i := strings.Index(ref.APIVersion, "/"); i > 0 {
+		kind += "." + ref.APIVersion[:i]
+	}
+	parts := []string{kind}
+	if ref.Namespace != "" {
+		parts = append(parts, ref.Namespace)
+	}
+	parts = append(parts, ref.Name)
+	return strings.Join(parts, "_") + ".yaml"
+}
+
+// archiveSnapshot implements kube.SnapshotFunc. Objects mutated outside of a
+// rollout (e.g by `remove') are not archived.
+func (r *runtime) archiveSnapshot(ctx context.Context, ref store.ObjRef, manifest []byte) error {
+	if r.rolloutID == "" {
+		return nil
+	}
+	name := strings.ReplaceAll(addon.NameFromContext(ctx), "/", "_")
+	if name == "" {
+		name = "_"
+	}
+	dir := filepath.Join(r.snapshotDir, r.rolloutID, name)
+	// Manifests may include Secrets.
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, snapshotFile(ref))
+	log.V(1).Infof("Archiving %v to %s", ref, path)
+	return ioutil.WriteFile(path, manifest, 0600)
+}
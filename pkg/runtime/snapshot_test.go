@@ -0,0 +1,66 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestArchiveSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	r := &runtime{snapshotDir: dir}
+	ctx := addon.ContextWithName(context.Background(), "nginx")
+	deploy := store.ObjRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "nginx"}
+	ns := store.ObjRef{APIVersion: "v1", Kind: "Namespace", Name: "example"}
+
+	// Nothing is archived outside of a rollout.
+	if err := r.archiveSnapshot(ctx, deploy, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if fs, _ := ioutil.ReadDir(dir); len(fs) != 0 {
+		t.Fatalf("Unexpected files archived outside of rollout: %v", fs)
+	}
+
+	r.rolloutID = "rollout-1"
+	for _, tc := range []struct {
+		ref      store.ObjRef
+		wantPath string
+	}{
+		{ref: deploy, wantPath: "rollout-1/nginx/deployment.apps_default_nginx.yaml"},
+		{ref: ns, wantPath: "rollout-1/nginx/namespace_example.yaml"},
+	} {
+		if err := r.archiveSnapshot(ctx, tc.ref, []byte("manifest")); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, tc.wantPath)
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != "manifest" {
+			t.Errorf("Unexpected manifest in %s: %q", tc.wantPath, bs)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be only readable by owner, got: %v (%v)", tc.wantPath, fi.Mode(), err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+// addonStats are kube.Stats of a single addon run.
+type addonStats struct {
+	name  string
+	stats kube.Stats
+}
+
+// statsCollector returns kube.StatsCollector of the kube package or nil if
+// the kube package is not loaded.
+func (r *runtime) statsCollector() kube.StatsCollector {
+	c, _ := r.pkgs["kube"].(kube.StatsCollector)
+	return c
+}
+
+// totalStats returns sum of all stats.
+func totalStats(stats []addonStats) kube.Stats {
+	var total kube.Stats
+	for _, s := range stats {
+		total.Add(s.stats)
+	}
+	return total
+}
+
+// printStats prints a table summarizing objects mutated by each addon on
+// cluster to w.
+func printStats(w io.Writer, cluster string, stats []addonStats) error {
+	if cluster != "" {
+		fmt.Fprintf(w, "\nSummary for cluster `%s':\n", cluster)
+	} else {
+		fmt.Fprintf(w, "\nSummary:\n")
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDON\tCREATED\tUPDATED\tUNCHANGED\tRECREATED\tDELETED\tFAILED")
+	row := func(name string, s kube.Stats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", name, s.Created, s.Updated, s.Unchanged, s.Recreated, s.Deleted, s.Failed)
+	}
+	for _, s := range stats {
+		row(s.name, s.stats)
+	}
+	row("TOTAL", totalStats(stats))
+	return tw.Flush()
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+func TestPrintStats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := printStats(buf, "minikube", []addonStats{
+		{name: "ingress", stats: kube.Stats{Created: 2, Unchanged: 3}},
+		{name: "monitoring", stats: kube.Stats{Updated: 1, Recreated: 1, Failed: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\nSummary for cluster `minikube':\n" +
+		"ADDON       CREATED  UPDATED  UNCHANGED  RECREATED  DELETED  FAILED\n" +
+		"ingress     2        0        3          0          0        0\n" +
+		"monitoring  0        1        0          1          0        1\n" +
+		"TOTAL       2        1        3          1          0        1\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected summary.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// timedPkgs are predeclared packages time spent in is reported separately
+// from Starlark evaluation by WithTimings.
+var timedPkgs = []string{"kube", "vault", "helm"}
+
+// verifyTiming is the key of time spent verifying addons (see
+// addon.Verify) in builtinTimer.
+const verifyTiming = "verify"
+
+// WithTimings returns an Option that reports how long each addon took,
+// broken down into time spent in kube, vault and helm built-ins, verifying
+// the addon and the rest (Starlark evaluation).
+func WithTimings() Option {
+	return fnOption(func(opts *options) error {
+		opts.timings = true
+		return nil
+	})
+}
+
+// builtinTimer accumulates time spent in calls of built-ins by package (and
+// verifying addons). It is safe for concurrent use.
+type builtinTimer struct {
+	mu    sync.Mutex
+	spent map[string]time.Duration
+}
+
+func newBuiltinTimer() *builtinTimer {
+	return &builtinTimer{spent: map[string]time.Duration{}}
+}
+
+func (t *builtinTimer) add(pkg string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spent[pkg] += d
+}
+
+// take returns time spent by package since the last call.
+func (t *builtinTimer) take() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spent := t.spent
+	t.spent = map[string]time.Duration{}
+	return spent
+}
+
+// timedModule wraps built-ins of a package so that time spent in their calls
+// is added to a builtinTimer.
+type timedModule struct {
+	starlark.HasAttrs
+	name  string
+	timer *builtinTimer
+}
+
+// Attr implements starlark.HasAttrs.Attr.
+func (m *timedModule) Attr(name string) (starlark.Value, error) {
+	v, err := m.HasAttrs.Attr(name)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(*starlark.Builtin)
+	if !ok {
+		return v, nil
+	}
+	return starlark.NewBuiltin(b.Name(), func(t *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		start := time.Now()
+		defer func() { m.timer.add(m.name, time.Since(start)) }()
+		return b.CallInternal(t, args, kwargs)
+	}), nil
+}
+
+// timePkgs replaces timedPkgs in each of pkgs with wrappers reporting to
+// timer.
+func timePkgs(timer *builtinTimer, pkgs ...starlark.StringDict) {
+	for _, p := range pkgs {
+		for _, n := range timedPkgs {
+			if m, ok := p[n].(starlark.HasAttrs); ok {
+				p[n] = &timedModule{HasAttrs: m, name: n, timer: timer}
+			}
+		}
+	}
+}
+
+// addonTimings is time spent by a single addon run.
+type addonTimings struct {
+	name  string
+	total time.Duration
+	// builtins is time spent in built-ins of timedPkgs (and verifying
+	// the addon).
+	builtins map[string]time.Duration
+}
+
+// starlark returns time spent outside of timed built-ins and verification.
+func (a addonTimings) starlark() time.Duration {
+	d := a.total
+	for _, b := range a.builtins {
+		d -= b
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// printTimings prints a table of time spent by each addon on cluster to w.
+func printTimings(w io.Writer, cluster string, timings []addonTimings) error {
+	if cluster != "" {
+		fmt.Fprintf(w, "\nTimings for cluster `%s':\n", cluster)
+	} else {
+		fmt.Fprintf(w, "\nTimings:\n")
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	columns := append(append([]string{}, timedPkgs...), verifyTiming)
+	fmt.Fprintf(tw, "ADDON\tTOTAL\tSTARLARK\t%s\n", strings.ToUpper(strings.Join(columns, "\t")))
+	round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+	for _, a := range timings {
+		fmt.Fprintf(tw, "%s\t%v\t%v", a.name, round(a.total), round(a.starlark()))
+		for _, n := range columns {
+			fmt.Fprintf(tw, "\t%v", round(a.builtins[n]))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestTimedModule(t *testing.T) {
+	kube := &isopod.Module{
+		Name: "kube",
+		Attrs: starlark.StringDict{
+			"put": starlark.NewBuiltin("kube.put", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+				time.Sleep(20 * time.Millisecond)
+				return starlark.None, nil
+			}),
+			"version": starlark.String("v1"),
+		},
+	}
+	timer := newBuiltinTimer()
+	pkgs := starlark.StringDict{"kube": kube}
+	timePkgs(timer, pkgs)
+
+	if _, _, err := util.Eval(t.Name(), `[kube.put(), kube.put(), kube.version]`, nil, pkgs); err != nil {
+		t.Fatal(err)
+	}
+	spent := timer.take()
+	if spent["kube"] < 40*time.Millisecond {
+		t.Errorf("Want at least 40ms spent in kube, got %v", spent["kube"])
+	}
+	if len(timer.take()) != 0 {
+		t.Error("Want timings reset by take")
+	}
+}
+
+func TestPrintTimings(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := printTimings(buf, "minikube", []addonTimings{
+		{name: "ingress", total: 3 * time.Second, builtins: map[string]time.Duration{
+			"kube":       2 * time.Second,
+			verifyTiming: 500 * time.Millisecond,
+		}},
+		{name: "vault-auth", total: 1500 * time.Microsecond, builtins: map[string]time.Duration{
+			"vault": time.Millisecond,
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\nTimings for cluster `minikube':\n" +
+		"ADDON       TOTAL  STARLARK  KUBE  VAULT  HELM  VERIFY\n" +
+		"ingress     3s     500ms     2s    0s     0s    500ms\n" +
+		"vault-auth  2ms    1ms       0s    1ms    0s    0s\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected timings.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
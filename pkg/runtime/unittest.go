@@ -20,22 +20,24 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/pkg/errors"
-	"github.com/stripe/skycfg"
 	"go.starlark.net/starlark"
 
 	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/cloud/gke"
+	"github.com/cruise-automation/isopod/pkg/cloud/incluster"
 	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/helm"
 	"github.com/cruise-automation/isopod/pkg/kube"
 	"github.com/cruise-automation/isopod/pkg/loader"
 	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/secretref"
 	"github.com/cruise-automation/isopod/pkg/util"
 	"github.com/cruise-automation/isopod/pkg/vault"
 )
@@ -106,34 +108,108 @@ func search(path string) ([]string, error) {
 	return out, nil
 }
 
-type assertErr struct {
-	err error
-}
+// testEpoch is the time virtual clocks of tests are set to at the start of
+// each test.
+var testEpoch = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
 
-func (e *assertErr) Error() string {
-	return e.err.Error()
-}
+// fakePkgs returns predeclared packages with external services (Kubernetes
+// and Vault) stubbed with mocks, Helm charts resolved relative to baseDir and
+// `sleep' and `time' using clock. opts may replace mocks with real packages
+// (e.g WithKube for integration tests). closeFn must be called once they are
+// no longer used.
+func fakePkgs(baseDir string, clock modules.Clock, opts ...Option) (pkgs starlark.StringDict, closeFn func(), err error) {
+	v, vClose, err := vault.NewFake()
+	if err != nil {
+		return nil, nil, err
+	}
+	k, kClose, err := kube.NewFake(false)
+	if err != nil {
+		vClose()
+		return nil, nil, err
+	}
 
-func makeAssertFn() *starlark.Builtin {
-	return starlark.NewBuiltin(
-		"assert",
-		func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-			var cond bool
-			var msg string
-			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &cond, &msg); err != nil {
-				return nil, err
-			}
+	pkgs = starlark.StringDict{
+		"vault":      v,
+		"kube":       k,
+		"gke":        gke.NewGKEBuiltin("sa-kay-not-used-since-mocked", "Isopod"),
+		"onprem":     onprem.NewOnPremBuiltin("fake-kubeconfig"),
+		"incluster":  incluster.NewInClusterBuiltin(),
+		"error":      starlark.NewBuiltin("error", addon.ErrorFn),
+		"sleep":      modules.NewSleepBuiltin(clock),
+		"secret_ref": starlark.NewBuiltin("secret_ref", secretref.Builtin),
+		"cache":      modules.NewCache().Module(),
+	}
+	closeFn = func() { kClose(); vClose() }
+	o := &options{pkgs: pkgs, diffOut: ioutil.Discard}
+	for _, opt := range opts {
+		if err := opt.apply(o); err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+	}
+	// Charts are rendered for real and applied to the kube package.
+	if d, ok := pkgs["kube"].(kube.DynamicClient); ok {
+		pkgs["helm"] = helm.New(d, baseDir)
+	}
+	if b, ok := pkgs["kube"].(kube.Bootstrapper); ok {
+		pkgs["bootstrap"] = b.Bootstrap(http.DefaultClient)
+	}
 
-			if !cond {
-				res := fmt.Sprintf("%v: assertion failed", thread.CallStack().At(0).Pos)
-				if msg != "" {
-					res += fmt.Sprintf(": %s", msg)
-				}
-				return nil, &assertErr{errors.New(res)}
-			}
+	for name, pkg := range skycfgModules() {
+		pkgs[name] = pkg
+	}
 
-			return starlark.None, nil
-		})
+	// Must be loaded last to ensure our impl of struct() persists.
+	for k, v := range modules.Predeclared() {
+		pkgs[k] = v
+	}
+	pkgs["time"] = modules.NewTimeModule(clock)
+
+	// Custom modules (e.g. loaded from plugins) can't be faked, so tests
+	// use them as is.
+	for n, m := range o.customModules {
+		if _, ok := pkgs[n]; ok {
+			closeFn()
+			return nil, nil, fmt.Errorf("custom module `%s' conflicts with a built-in", n)
+		}
+		pkgs[n] = m
+	}
+	return pkgs, closeFn, nil
+}
+
+// advanceTimeBuiltin returns the `advance_time' method of test_ctx moving
+// clock forward, e.g t.advance_time("5m").
+func advanceTimeBuiltin(clock *modules.FakeClock) *starlark.Builtin {
+	return starlark.NewBuiltin("advance_time", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var dur string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &dur); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: can not parse duration string `%s': %v", b.Name(), dur, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("<%v>: time can't go backwards (got `%s')", b.Name(), dur)
+		}
+		clock.Advance(d)
+		return starlark.None, nil
+	})
+}
+
+// sleepsBuiltin returns the `sleeps' method of test_ctx returning durations
+// slept on clock during the test (e.g ["5m0s"]).
+func sleepsBuiltin(clock *modules.FakeClock) *starlark.Builtin {
+	return starlark.NewBuiltin("sleeps", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+			return nil, err
+		}
+		var vs []starlark.Value
+		for _, d := range clock.Sleeps() {
+			vs = append(vs, starlark.String(d.String()))
+		}
+		return starlark.NewList(vs), nil
+	})
 }
 
 // result records test status, output and telemetry.
@@ -141,43 +217,34 @@ type result struct {
 	Pass       bool
 	Path       string
 	FailureMsg string
-	Output     io.Reader
-	Runtime    time.Duration
+	// Skipped are names of skipped tests (with reasons).
+	Skipped []string
+	Output  io.Reader
+	Runtime time.Duration
 }
 
-// exec executes all test cases within a file referenced by path.
-func exec(ctx context.Context, path string) (*result, error) {
-	v, vClose, err := vault.NewFake()
-	if err != nil {
-		return nil, err
+// exec executes all test cases within a file referenced by path with
+// packages replaced by opts.
+func exec(ctx context.Context, path string, opts ...Option) (*result, error) {
+	// Tests anchor `//' paths at their own workspace unless the root is set
+	// explicitly (e.g with --rel_path).
+	root := loader.WorkspaceRoot()
+	if root == "" {
+		var err error
+		if root, err = loader.FindWorkspaceRoot(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
 	}
-	defer vClose()
 
-	k, kClose, err := kube.NewFake(false)
+	clock := modules.NewFakeClock(testEpoch)
+	pkgs, closeFn, err := fakePkgs(filepath.Dir(path), clock, opts...)
 	if err != nil {
 		return nil, err
 	}
-	defer kClose()
-
-	pkgs := starlark.StringDict{
-		"assert": makeAssertFn(),
-		"vault":  v,
-		"kube":   k,
-		"gke":    gke.NewGKEBuiltin("sa-kay-not-used-since-mocked", "Isopod"),
-		"onprem": onprem.NewOnPremBuiltin("fake-kubeconfig"),
-		"error":  starlark.NewBuiltin("error", addon.ErrorFn),
-		"sleep":  starlark.NewBuiltin("sleep", addon.SleepFn),
-	}
-
-	scPkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
-	for name, pkg := range scPkgs {
-		pkgs[name] = pkg
-	}
-
-	// Must be loaded last to ensure our impl of struct() persists.
-	for k, v := range modules.Predeclared() {
-		pkgs[k] = v
-	}
+	defer closeFn()
+	pkgs["assert"] = newAssertModule()
+	pkgs["fail"] = starlark.NewBuiltin("fail", failFn)
+	pkgs["skip"] = starlark.NewBuiltin("skip", skipFn)
 
 	startT := time.Now()
 
@@ -185,8 +252,9 @@ func exec(ctx context.Context, path string) (*result, error) {
 	outFn := func(_ *starlark.Thread, msg string) { fmt.Println(msg) }
 	thread := &starlark.Thread{
 		Print: outFn,
-		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(path), pkgs).Load,
+		Load:  loader.NewWorkspaceModulesLoader(filepath.Dir(path), root, pkgs, loader.NewCache()).Load,
 	}
+	thread.SetLocal(addon.WorkspaceRootKey, root)
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -197,7 +265,9 @@ func exec(ctx context.Context, path string) (*result, error) {
 		return nil, err
 	}
 
-	for name, v := range globals {
+	var skipped []string
+	for _, name := range globals.Keys() {
+		v := globals[name]
 		if !strings.HasPrefix(name, "test_") {
 			continue
 		}
@@ -207,28 +277,43 @@ func exec(ctx context.Context, path string) (*result, error) {
 		}
 
 		sCtx := addon.NewCtx()
+		clock.Reset(testEpoch)
 
 		thread := &starlark.Thread{
 			Print: outFn,
 		}
 		thread.SetLocal(addon.GoCtxKey, ctx)
 		thread.SetLocal(addon.SkyCtxKey, sCtx)
+		// Addons under test usually live next to their tests.
+		thread.SetLocal(addon.BaseDirKey, filepath.Dir(path))
+		thread.SetLocal(addon.WorkspaceRootKey, root)
+		thread.SetLocal(addon.RandKey, addon.NewRand(filepath.Base(path)+"/"+name))
 
 		tCtx := &isopod.Module{
 			Name: "test_ctx",
 			Attrs: starlark.StringDict{
-				"ctx": sCtx,
+				"ctx":          sCtx,
+				"advance_time": advanceTimeBuiltin(clock),
+				"sleeps":       sleepsBuiltin(clock),
 			},
 		}
 		args := starlark.Tuple([]starlark.Value{tCtx})
 
 		_, err := starlark.Call(thread, fn, args, nil)
 		if err != nil {
-			if aErr, ok := err.(*assertErr); ok {
+			switch o := thread.Local(testOutcomeKey).(type) {
+			case *skipErr:
+				if o.reason != "" {
+					name += ": " + o.reason
+				}
+				skipped = append(skipped, name)
+				continue
+			case *assertErr:
 				return &result{
 					Pass:       false,
 					Path:       path,
-					FailureMsg: aErr.Error(),
+					FailureMsg: o.Error(),
+					Skipped:    skipped,
 					Output:     out,
 					Runtime:    time.Since(startT),
 				}, nil
@@ -240,14 +325,17 @@ func exec(ctx context.Context, path string) (*result, error) {
 	return &result{
 		Pass:    true,
 		Path:    path,
+		Skipped: skipped,
 		Output:  out,
 		Runtime: time.Since(startT),
 	}, nil
 }
 
 // RunUnitTests executes (if found) tests reference by path. Writes test
-// output to w.
-func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool, error) {
+// output to w. Tests run against mocks of external services unless opts
+// replace them, e.g WithKube runs integration tests against a real API
+// server.
+func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer, opts ...Option) (bool, error) {
 	ts, err := search(path)
 	if err != nil {
 		return false, err
@@ -259,7 +347,7 @@ func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool,
 
 	var rs []*result
 	for _, t := range ts {
-		res, err := exec(ctx, t)
+		res, err := exec(ctx, t, opts...)
 		if err != nil {
 			fmt.Fprintf(errW, "%v\n", err)
 			rs = append(rs, &result{
@@ -273,6 +361,9 @@ func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool,
 
 	status := true
 	for _, r := range rs {
+		for _, s := range r.Skipped {
+			fmt.Fprintf(outW, "SKIP: %s\n", s)
+		}
 		if !r.Pass {
 			if r.FailureMsg != "" {
 				fmt.Fprintf(outW, "FAIL: %s\n", r.FailureMsg)
@@ -0,0 +1,118 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+func TestRunUnitTestsOutcomes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "addon_test.ipd")
+	data := `
+def test_pass(t):
+    assert.eq(1, 1)
+
+def test_skip(t):
+    skip("needs a cluster")
+    fail("not skipped")
+
+def test_z_fail(t):
+    assert.eq(1, 2)
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	ok, err := RunUnitTests(context.Background(), dir, out, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("Expected tests to fail")
+	}
+	want := "SKIP: test_skip: needs a cluster\n" +
+		"FAIL: " + path + ":10:14: assert.eq failed\nWant: 2\nGot: 1\n" +
+		"FAIL\t" + path + "\n"
+	if got := out.String(); got != want {
+		t.Errorf("Unexpected output.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestRunUnitTestsClock(t *testing.T) {
+	dir := t.TempDir()
+	data := `
+def wait_rollout():
+    start = time.now()
+    for i in range(10):
+        sleep("30s")
+    return time.now() - start
+
+def test_sleep(t):
+    assert.eq(time.format(time.now()), "2021-01-01T00:00:00Z")
+    assert.eq(wait_rollout(), 300)
+    assert.eq(len(t.sleeps()), 10)
+    assert.eq(t.sleeps()[0], "30s")
+
+def test_advance_time(t):
+    assert.eq(t.sleeps(), [])
+    start = time.now()
+    t.advance_time("1h")
+    assert.eq(time.now() - start, 3600)
+    assert.eq(t.sleeps(), [])
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "clock_test.ipd"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	ok, err := RunUnitTests(context.Background(), dir, out, errOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Expected tests to pass, got:\n%s%s", out, errOut)
+	}
+}
+
+func TestRunUnitTestsCustomModule(t *testing.T) {
+	dir := t.TempDir()
+	data := `
+def test_cmdb(t):
+    assert.eq(cmdb.owner, "infra")
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "cmdb_test.ipd"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmdb := &isopod.Module{
+		Name:  "cmdb",
+		Attrs: starlark.StringDict{"owner": starlark.String("infra")},
+	}
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	ok, err := RunUnitTests(context.Background(), dir, out, errOut, WithCustomModule("cmdb", cmdb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Expected tests to pass, got:\n%s%s", out, errOut)
+	}
+}
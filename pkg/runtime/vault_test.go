@@ -0,0 +1,168 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/plan"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+	"github.com/cruise-automation/isopod/pkg/vault"
+)
+
+// kvServer is a Vault server storing data written to a path in m.
+type kvServer struct {
+	m map[string]string
+}
+
+func (s *kvServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := s.m[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"data": %s}`, v)
+	case http.MethodPut:
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.m[r.URL.Path] = string(bs)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWithVaultDryRun(t *testing.T) {
+	const secretPath = "/v1/secret/data/app"
+	for _, tc := range []struct {
+		desc string
+		mode vault.DryRunMode
+		plan bool
+		expr string
+
+		wantResult string
+		// wantWritten is true if the expression writes to Vault.
+		wantWritten bool
+		wantErr     string
+	}{
+		{
+			desc:       "Read-only read by default",
+			expr:       "vault.read('secret/data/app')",
+			wantResult: `map["a":"real"]`,
+		},
+		{
+			desc:       "Read-only write by default",
+			expr:       "vault.write('secret/data/app', a='1')",
+			wantResult: `map["a":"1"]`,
+		},
+		{
+			desc:       "Fake write",
+			mode:       vault.DryRunFake,
+			expr:       "vault.write('secret/data/app', a='1', b='2')",
+			wantResult: `map["a":"1" "b":"2"]`,
+		},
+		{
+			desc:       "Fake exist",
+			mode:       vault.DryRunFake,
+			expr:       "vault.exist('secret/data/missing')",
+			wantResult: "True",
+		},
+		{
+			desc:       "Fake read",
+			mode:       vault.DryRunFake,
+			expr:       "vault.read('secret/data/app')",
+			wantResult: `map["value":"fake"]`,
+		},
+		{
+			desc:       "Fake token capabilities",
+			mode:       vault.DryRunFake,
+			expr:       "vault.token_capabilities('secret/data/app', require=['update'])",
+			wantResult: `["root"]`,
+		},
+		{
+			desc:        "Real write",
+			mode:        vault.DryRunReal,
+			expr:        "vault.write('secret/data/app', a='1')",
+			wantResult:  "None",
+			wantWritten: true,
+		},
+		{
+			desc:       "Read-only write while planning",
+			plan:       true,
+			expr:       "vault.write('secret/data/app', a='1')",
+			wantResult: `map["a":"1"]`,
+		},
+		{
+			desc:    "Real while planning",
+			mode:    vault.DryRunReal,
+			plan:    true,
+			wantErr: "vault dry run mode `real' is not supported while planning",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			real := &kvServer{m: map[string]string{secretPath: `{"a": "real"}`}}
+			s := httptest.NewTLSServer(real)
+			defer s.Close()
+			c, err := vaultapi.NewClient(&vaultapi.Config{Address: s.URL, HttpClient: s.Client()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.SetToken("fake_token")
+
+			opts := &options{pkgs: starlark.StringDict{}, dryRun: true}
+			optList := []Option{WithVaultDryRunMode(tc.mode)}
+			if tc.plan {
+				optList = append(optList, WithPlan(plan.NewRecorder("main.ipd", nil)))
+			}
+			for _, o := range append(optList, WithVault(c)) {
+				if err = o.apply(opts); err != nil {
+					break
+				}
+			}
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Want error: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, opts.pkgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantResult != v.String() {
+				t.Errorf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, v.String())
+			}
+			if written := real.m[secretPath] != `{"a": "real"}`; written != tc.wantWritten {
+				t.Errorf("Want secret written: %v, got: %v", tc.wantWritten, written)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Masterminds/semver"
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+)
+
+// IsopodVersionFunc is the name of the Starlark built-in that pins versions
+// of Isopod an entry file may be run with.
+const IsopodVersionFunc = "isopod_version"
+
+// CheckVersion returns an error if version doesn't satisfy constraint (e.g
+// `>=0.9, <1.0').
+func CheckVersion(constraint, version string) error {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return fmt.Errorf("invalid version constraint `%s': %v", constraint, err)
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return fmt.Errorf("invalid version `%s': %v", version, err)
+	}
+	if !c.Check(v) {
+		return fmt.Errorf("running Isopod %s but `%s' is required (install a matching release, e.g. with `isopod self-update --version=<version>')", version, constraint)
+	}
+	return nil
+}
+
+// versionBuiltin returns the IsopodVersionFunc built-in failing if version
+// of the running Isopod doesn't satisfy the given constraint:
+//
+//	isopod_version(">=0.9, <1.0")
+//
+// The check is skipped if version is empty, and with a warning if it is not
+// a semantic version (e.g for development builds).
+func versionBuiltin(version string) *starlark.Builtin {
+	var warnOnce sync.Once
+	return starlark.NewBuiltin(IsopodVersionFunc, func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var constraint string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &constraint); err != nil {
+			return nil, err
+		}
+		if _, err := semver.NewConstraint(constraint); err != nil {
+			return nil, fmt.Errorf("%s: invalid version constraint `%s': %v", b.Name(), constraint, err)
+		}
+		if version == "" {
+			return starlark.None, nil
+		}
+		if _, err := semver.NewVersion(version); err != nil {
+			warnOnce.Do(func() {
+				log.Warningf("Isopod version `%s' is not a release version, %s(%q) is not checked", version, b.Name(), constraint)
+			})
+			return starlark.None, nil
+		}
+		if err := CheckVersion(constraint, version); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		return starlark.None, nil
+	})
+}
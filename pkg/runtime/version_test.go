@@ -0,0 +1,67 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestIsopodVersion(t *testing.T) {
+	const expr = `isopod_version(">=0.9, <1.0")`
+	for _, tc := range []struct {
+		name, version, expr string
+		wantErr             error
+	}{
+		{
+			name:    "satisfied",
+			version: "v0.9.3",
+			expr:    expr,
+		},
+		{
+			name:    "not satisfied",
+			version: "v1.2.0",
+			expr:    expr,
+			wantErr: errors.New("isopod_version: running Isopod v1.2.0 but `>=0.9, <1.0' is required (install a matching release, e.g. with `isopod self-update --version=<version>')"),
+		},
+		{
+			name:    "development build",
+			version: "<unknown>",
+			expr:    expr,
+		},
+		{
+			name: "no version",
+			expr: expr,
+		},
+		{
+			name:    "invalid constraint",
+			version: "v0.9.3",
+			expr:    `isopod_version("0.9 or later")`,
+			wantErr: errors.New("isopod_version: invalid version constraint `0.9 or later': improper constraint: 0.9 or later"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{IsopodVersionFunc: versionBuiltin(tc.version)}
+			_, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secretref implements references to external secrets that are only
+// resolved when objects are applied to the cluster.
+//
+// A reference is rendered into Starlark strings as an opaque token (e.g when
+// formatted into Helm values or YAML manifests) so that secret values never
+// appear in diffs, dry-run output or plan files.
+package secretref
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// VaultBackend is the backend name of references to Vault secrets.
+const VaultBackend = "vault"
+
+const tokenPrefix = "isopod-secret-ref."
+
+var tokenRe = regexp.MustCompile(regexp.QuoteMeta(tokenPrefix) + `[A-Za-z0-9_-]+`)
+
+// Ref references value of key of secret at path in backend.
+type Ref struct {
+	Backend string `json:"b"`
+	Path    string `json:"p"`
+	Key     string `json:"k"`
+}
+
+// Make sure *Ref implements starlark.Value.
+var _ starlark.Value = (*Ref)(nil)
+
+// Token returns the opaque token r is rendered as.
+func (r *Ref) Token() string {
+	bs, _ := json.Marshal(r)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// String implements starlark.Value.String.
+func (r *Ref) String() string { return r.Token() }
+
+// Type implements starlark.Value.Type.
+func (r *Ref) Type() string { return "secret_ref" }
+
+// Freeze implements starlark.Value.Freeze.
+func (r *Ref) Freeze() {}
+
+// Truth implements starlark.Value.Truth.
+func (r *Ref) Truth() starlark.Bool { return starlark.True }
+
+// Hash implements starlark.Value.Hash.
+func (r *Ref) Hash() (uint32, error) { return starlark.String(r.Token()).Hash() }
+
+// Builtin implements `secret_ref' Starlark built-in:
+//
+//	secret_ref("vault", "secret/data/db", "password")
+func Builtin(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	r := &Ref{}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "backend", &r.Backend, "path", &r.Path, "key", &r.Key); err != nil {
+		return nil, err
+	}
+	if r.Backend != VaultBackend {
+		return nil, fmt.Errorf("%s: unsupported backend `%s' (must be `%s')", b.Name(), r.Backend, VaultBackend)
+	}
+	if r.Path == "" || r.Key == "" {
+		return nil, fmt.Errorf("%s: `path' and `key' must not be empty", b.Name())
+	}
+	return r, nil
+}
+
+// Resolver resolves a reference to the secret value.
+type Resolver interface {
+	Resolve(ctx context.Context, r *Ref) (string, error)
+}
+
+// Contains returns true if s contains any reference tokens.
+func Contains(s string) bool { return tokenRe.MatchString(s) }
+
+// Mask replaces all reference tokens in s with redact.Placeholder.
+func Mask(s string) string { return tokenRe.ReplaceAllLiteralString(s, redact.Placeholder) }
+
+func parseToken(tok string) (*Ref, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(tok[len(tokenPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret reference: %v", err)
+	}
+	r := &Ref{}
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, fmt.Errorf("malformed secret reference: %v", err)
+	}
+	return r, nil
+}
+
+// Expand replaces all reference tokens in s with secret values resolved by
+// res. Resolved values are registered with redact package.
+func Expand(ctx context.Context, res Resolver, s string) (string, error) {
+	var err error
+	out := tokenRe.ReplaceAllStringFunc(s, func(tok string) string {
+		if err != nil {
+			return tok
+		}
+		var r *Ref
+		if r, err = parseToken(tok); err != nil {
+			return tok
+		}
+		if res == nil {
+			err = fmt.Errorf("no resolver configured for secret reference to `%s' in %s", r.Path, r.Backend)
+			return tok
+		}
+		var v string
+		if v, err = res.Resolve(ctx, r); err != nil {
+			err = fmt.Errorf("failed to resolve secret reference to key `%s' of `%s' in %s: %v", r.Key, r.Path, r.Backend, err)
+			return tok
+		}
+		redact.Add(v)
+		return v
+	})
+	return out, err
+}
+
+// MaskExpanded masks string values nested in live (e.g the live counterpart
+// of an unstructured Kubernetes object) in place wherever head has reference
+// tokens, so that values they were expanded to (see ExpandObject) don't show.
+// Values matching head are set to head with tokens masked (see Mask), other
+// values to redact.Placeholder.
+func MaskExpanded(live, head map[string]interface{}) {
+	for k, v := range head {
+		if lv, ok := live[k]; ok {
+			live[k] = maskValue(lv, v)
+		}
+	}
+}
+
+func maskValue(live, head interface{}) interface{} {
+	switch head := head.(type) {
+	case string:
+		s, ok := live.(string)
+		if !ok || !Contains(head) {
+			return live
+		}
+		if expandedRe(head).MatchString(s) {
+			return Mask(head)
+		}
+		return redact.Placeholder
+	case map[string]interface{}:
+		if l, ok := live.(map[string]interface{}); ok {
+			MaskExpanded(l, head)
+		}
+	case []interface{}:
+		if l, ok := live.([]interface{}); ok {
+			for i := 0; i < len(l) && i < len(head); i++ {
+				l[i] = maskValue(l[i], head[i])
+			}
+		}
+	}
+	return live
+}
+
+// expandedRe returns regexp matching s with reference tokens expanded to any
+// value.
+func expandedRe(s string) *regexp.Regexp {
+	parts := tokenRe.Split(s, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile(`^` + strings.Join(parts, `(?s:.*)`) + `$`)
+}
+
+// ExpandObject expands reference tokens in all string values nested in obj
+// (e.g an unstructured Kubernetes object) in place.
+func ExpandObject(ctx context.Context, res Resolver, obj map[string]interface{}) error {
+	for k, v := range obj {
+		nv, err := expandValue(ctx, res, v)
+		if err != nil {
+			return err
+		}
+		obj[k] = nv
+	}
+	return nil
+}
+
+func expandValue(ctx context.Context, res Resolver, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if !Contains(v) {
+			return v, nil
+		}
+		return Expand(ctx, res, v)
+	case map[string]interface{}:
+		return v, ExpandObject(ctx, res, v)
+	case []interface{}:
+		for i := range v {
+			nv, err := expandValue(ctx, res, v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = nv
+		}
+	}
+	return v, nil
+}
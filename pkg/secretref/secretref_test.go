@@ -0,0 +1,151 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secretref
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+type fakeResolver map[string]string
+
+func (f fakeResolver) Resolve(_ context.Context, r *Ref) (string, error) {
+	v, ok := f[r.Path+"#"+r.Key]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return v, nil
+}
+
+func TestBuiltin(t *testing.T) {
+	pkgs := starlark.StringDict{"secret_ref": starlark.NewBuiltin("secret_ref", Builtin)}
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		wantErr error
+	}{
+		{
+			name: "vault",
+			expr: `"password: %s" % secret_ref("vault", "secret/db", "password")`,
+		},
+		{
+			name:    "unsupported backend",
+			expr:    `secret_ref("aws", "db", "password")`,
+			wantErr: errors.New("secret_ref: unsupported backend `aws' (must be `vault')"),
+		},
+		{
+			name:    "empty key",
+			expr:    `secret_ref("vault", "secret/db", "")`,
+			wantErr: errors.New("secret_ref: `path' and `key' must not be empty"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			s := string(v.(starlark.String))
+			if !Contains(s) {
+				t.Errorf("Expected %q to contain reference token", s)
+			}
+			if got := Mask(s); got != "password: <redacted>" {
+				t.Errorf("Unexpected masked string: %q", got)
+			}
+		})
+	}
+}
+
+func TestExpandObject(t *testing.T) {
+	ctx := context.Background()
+	res := fakeResolver{"secret/db#password": "hunter2-password"}
+	ref := &Ref{Backend: VaultBackend, Path: "secret/db", Key: "password"}
+
+	obj := map[string]interface{}{
+		"kind": "Secret",
+		"stringData": map[string]interface{}{
+			"dsn": fmt.Sprintf("postgres://app:%s@db", ref),
+		},
+		"list": []interface{}{ref.Token(), int64(1)},
+	}
+	if err := ExpandObject(ctx, res, obj); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"kind": "Secret",
+		"stringData": map[string]interface{}{
+			"dsn": "postgres://app:hunter2-password@db",
+		},
+		"list": []interface{}{"hunter2-password", int64(1)},
+	}
+	if d := cmp.Diff(want, obj); d != "" {
+		t.Errorf("Unexpected object (-want, +got):\n%s", d)
+	}
+
+	missing := (&Ref{Backend: VaultBackend, Path: "secret/other", Key: "token"}).Token()
+	wantErr := errors.New("failed to resolve secret reference to key `token' of `secret/other' in vault: not found")
+	if _, err := Expand(ctx, res, missing); !util.ErrsEqual(err, wantErr) {
+		t.Errorf("Unexpected error.\nWant: %v\nGot: %v", wantErr, err)
+	}
+}
+
+func TestMaskExpanded(t *testing.T) {
+	ref := &Ref{Backend: VaultBackend, Path: "secret/db", Key: "password"}
+	head := map[string]interface{}{
+		"data": map[string]interface{}{
+			"dsn":      fmt.Sprintf("postgres://app:%s@db", ref),
+			"password": ref.Token(),
+			"user":     "app",
+		},
+		"list": []interface{}{ref.Token(), "b"},
+	}
+	live := map[string]interface{}{
+		"data": map[string]interface{}{
+			"dsn":      "postgres://app:hunter2-password@db",
+			"password": "hunter2-password",
+			"user":     "admin",
+		},
+		"list": []interface{}{"hunter2-password", "c", "d"},
+	}
+	MaskExpanded(live, head)
+	want := map[string]interface{}{
+		"data": map[string]interface{}{
+			"dsn":      "postgres://app:<redacted>@db",
+			"password": "<redacted>",
+			"user":     "admin",
+		},
+		"list": []interface{}{"<redacted>", "c", "d"},
+	}
+	if d := cmp.Diff(want, live); d != "" {
+		t.Errorf("Unexpected object (-want, +got):\n%s", d)
+	}
+
+	// Values not matching head may contain the secret elsewhere.
+	live = map[string]interface{}{"data": map[string]interface{}{"dsn": "postgres://root:hunter2-password@db"}}
+	MaskExpanded(live, head)
+	want = map[string]interface{}{"data": map[string]interface{}{"dsn": "<redacted>"}}
+	if d := cmp.Diff(want, live); d != "" {
+		t.Errorf("Unexpected object (-want, +got):\n%s", d)
+	}
+}
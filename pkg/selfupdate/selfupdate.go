@@ -0,0 +1,205 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selfupdate replaces the running Isopod binary with a release
+// downloaded from GitHub.
+package selfupdate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	log "github.com/golang/glog"
+)
+
+// ReleaseURL is the URL release assets are downloaded from
+// (<ReleaseURL>/<version>/<asset>).
+var ReleaseURL = "https://github.com/cruise-automation/isopod/releases/download"
+
+// ChecksumsFile is the release asset with SHA-256 checksums of binaries in
+// sha256sum format.
+const ChecksumsFile = "SHA256SUMS"
+
+// assets are names of release binaries by GOOS/GOARCH.
+var assets = map[string]string{
+	"linux/amd64":   "isopod-linux",
+	"linux/arm64":   "isopod-linux-arm64",
+	"darwin/amd64":  "isopod-darwin",
+	"darwin/arm64":  "isopod-darwin-arm64",
+	"windows/amd64": "isopod-windows.exe",
+}
+
+// Asset returns the name of the release binary for goos and goarch.
+func Asset(goos, goarch string) (string, error) {
+	a, ok := assets[goos+"/"+goarch]
+	if !ok {
+		return "", fmt.Errorf("no release binary for %s/%s", goos, goarch)
+	}
+	return a, nil
+}
+
+// Updater downloads releases of Isopod.
+type Updater struct {
+	// Client downloads release assets. Defaults to http.DefaultClient.
+	Client *http.Client
+	// URL is the URL release assets are downloaded from. Defaults to
+	// ReleaseURL.
+	URL string
+	// GOOS and GOARCH select the release binary.
+	GOOS, GOARCH string
+	// InsecureSkipVerify allows installing releases without ChecksumsFile
+	// unverified.
+	InsecureSkipVerify bool
+}
+
+// Update replaces binary at exe with asset of release version (e.g
+// `v0.9.3'). The binary is verified against ChecksumsFile of the release,
+// which must exist unless InsecureSkipVerify is set.
+func (u *Updater) Update(ctx context.Context, version, exe string) error {
+	if !strings.HasPrefix(version, "v") {
+		return fmt.Errorf("invalid version `%s' (want a release tag, e.g. v0.9.3)", version)
+	}
+	if _, err := semver.NewVersion(version); err != nil {
+		return fmt.Errorf("invalid version `%s': %v", version, err)
+	}
+	asset, err := Asset(u.GOOS, u.GOARCH)
+	if err != nil {
+		return err
+	}
+
+	data, err := u.get(ctx, version, asset)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("release %s not found", version)
+	}
+	sums, err := u.get(ctx, version, ChecksumsFile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sums == nil && !u.InsecureSkipVerify:
+		return fmt.Errorf("release %s has no %s to verify %s with", version, ChecksumsFile, asset)
+	case sums == nil:
+		log.Warningf("Release %s has no %s, %s is not verified", version, ChecksumsFile, asset)
+	default:
+		if err := verify(data, sums, asset); err != nil {
+			return err
+		}
+	}
+
+	return replace(exe, data)
+}
+
+// get returns asset of release version (nil if not found).
+func (u *Updater) get(ctx context.Context, version, asset string) ([]byte, error) {
+	base := u.URL
+	if base == "" {
+		base = ReleaseURL
+	}
+	c := u.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(base, "/"), version, asset)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Downloading %s", url)
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	return data, nil
+}
+
+// verify checks data against the checksum of asset in sums.
+func verify(data, sums []byte, asset string) error {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		// Binary mode checksums are prefixed with `*'.
+		if len(fs) != 2 || strings.TrimPrefix(fs[1], "*") != asset {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != strings.ToLower(fs[0]) {
+			return fmt.Errorf("checksum mismatch of %s: want %s, got %s", asset, fs[0], got)
+		}
+		return nil
+	}
+	return fmt.Errorf("no checksum of %s in %s", asset, ChecksumsFile)
+}
+
+// replace atomically replaces file at exe with executable data. The running
+// binary can't be overwritten on Windows but can be renamed, so exe is moved
+// aside first.
+func replace(exe string, data []byte) error {
+	dir := filepath.Dir(exe)
+	f, err := ioutil.TempFile(dir, ".isopod-update-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	old := exe + ".old"
+	if err := os.Rename(exe, old); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to move aside `%s': %v", exe, err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		// Best effort to restore the previous binary.
+		os.Rename(old, exe)
+		return fmt.Errorf("failed to replace `%s': %v", exe, err)
+	}
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove previous binary `%s': %v", old, err)
+	}
+	return nil
+}
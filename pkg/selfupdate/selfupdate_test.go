@@ -0,0 +1,141 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	const binary = "isopod v0.9.3"
+	sum := sha256.Sum256([]byte(binary))
+	tampered := sha256.Sum256([]byte("tampered"))
+	files := map[string]string{
+		"/v0.9.3/isopod-linux": binary,
+		"/v0.9.3/SHA256SUMS":   fmt.Sprintf("%s  isopod-linux\n", hex.EncodeToString(sum[:])),
+		"/v0.9.2/isopod-linux": binary,
+		"/v0.9.1/isopod-linux": "tampered",
+		"/v0.9.1/SHA256SUMS":   fmt.Sprintf("%s  isopod-linux\n", hex.EncodeToString(sum[:])),
+		"/v0.9.0/isopod-linux": binary,
+		"/v0.9.0/SHA256SUMS":   fmt.Sprintf("%s  isopod-darwin\n", hex.EncodeToString(sum[:])),
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name, version, goos, goarch string
+		skipVerify                  bool
+		want                        string
+		wantErr                     string
+	}{
+		{
+			name:    "Verified",
+			version: "v0.9.3",
+			want:    binary,
+		},
+		{
+			name:    "No checksums",
+			version: "v0.9.2",
+			wantErr: "release v0.9.2 has no SHA256SUMS to verify isopod-linux with",
+		},
+		{
+			name:       "No checksums skip verify",
+			version:    "v0.9.2",
+			skipVerify: true,
+			want:       binary,
+		},
+		{
+			name:    "Checksum mismatch",
+			version: "v0.9.1",
+			wantErr: "checksum mismatch of isopod-linux: want " + hex.EncodeToString(sum[:]) + ", got " + hex.EncodeToString(tampered[:]),
+		},
+		{
+			name:    "No checksum of binary",
+			version: "v0.9.0",
+			wantErr: "no checksum of isopod-linux in SHA256SUMS",
+		},
+		{
+			name:    "Not found",
+			version: "v0.8.0",
+			wantErr: "release v0.8.0 not found",
+		},
+		{
+			name:    "Not a tag",
+			version: "0.9.3",
+			wantErr: "invalid version `0.9.3' (want a release tag, e.g. v0.9.3)",
+		},
+		{
+			name:    "Unsupported platform",
+			version: "v0.9.3",
+			goos:    "plan9",
+			goarch:  "386",
+			wantErr: "no release binary for plan9/386",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exe := filepath.Join(t.TempDir(), "isopod")
+			if err := ioutil.WriteFile(exe, []byte("isopod v0.8.0"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			u := &Updater{Client: s.Client(), URL: s.URL, GOOS: "linux", GOARCH: "amd64", InsecureSkipVerify: tc.skipVerify}
+			if tc.goos != "" {
+				u.GOOS, u.GOARCH = tc.goos, tc.goarch
+			}
+
+			err := u.Update(context.Background(), tc.version, exe)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+
+			want := tc.want
+			if err != nil {
+				want = "isopod v0.8.0"
+			}
+			got, err := ioutil.ReadFile(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("Unexpected binary.\nWant: %s\nGot: %s", want, got)
+			}
+			files, err := filepath.Glob(filepath.Join(filepath.Dir(exe), "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Errorf("Unexpected files left behind: %v", files)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// GRPCService is the name of the gRPC service of the API. Its messages
+// mirror the JSON objects of the HTTP/JSON gateway:
+//
+//	syntax = "proto3";
+//	package isopod.v1;
+//
+//	service Isopod {
+//	  rpc Run(RunRequest) returns (stream Event);
+//	  rpc Rollouts(RolloutsRequest) returns (RolloutsResponse);
+//	}
+//
+//	message RunRequest {
+//	  string command = 1;
+//	  string entryfile = 2;
+//	  map<string, string> context = 3;
+//	}
+//
+//	message Event {
+//	  string type = 1;
+//	  string command = 2;
+//	  string cluster = 3;
+//	  string addon = 4;
+//	  string error = 5;
+//	}
+//
+//	message RolloutsRequest {
+//	  string entryfile = 1;
+//	  string id = 2;
+//	  map<string, string> context = 3;
+//	}
+//
+//	message Rollout {
+//	  string cluster = 1;
+//	  bool found = 2;
+//	  string id = 3;
+//	  bool live = 4;
+//	  repeated string addons = 5;
+//	}
+//
+//	message RolloutsResponse {
+//	  repeated Rollout rollouts = 1;
+//	}
+const GRPCService = "isopod.v1.Isopod"
+
+// apiProto is the descriptor of the file declaring GRPCService.
+const apiProto = `
+name: "isopod/v1/isopod.proto"
+package: "isopod.v1"
+syntax: "proto3"
+message_type {
+  name: "RunRequest"
+  field { name: "command" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "entryfile" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "context" number: 3 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".isopod.v1.RunRequest.ContextEntry" }
+  nested_type {
+    name: "ContextEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options { map_entry: true }
+  }
+}
+message_type {
+  name: "Event"
+  field { name: "type" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "command" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "cluster" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "addon" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "error" number: 5 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+message_type {
+  name: "RolloutsRequest"
+  field { name: "entryfile" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "id" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "context" number: 3 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".isopod.v1.RolloutsRequest.ContextEntry" }
+  nested_type {
+    name: "ContextEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options { map_entry: true }
+  }
+}
+message_type {
+  name: "Rollout"
+  field { name: "cluster" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "found" number: 2 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field { name: "id" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "live" number: 4 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field { name: "addons" number: 5 label: LABEL_REPEATED type: TYPE_STRING }
+}
+message_type {
+  name: "RolloutsResponse"
+  field { name: "rollouts" number: 1 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".isopod.v1.Rollout" }
+}
+service {
+  name: "Isopod"
+  method { name: "Run" input_type: ".isopod.v1.RunRequest" output_type: ".isopod.v1.Event" server_streaming: true }
+  method { name: "Rollouts" input_type: ".isopod.v1.RolloutsRequest" output_type: ".isopod.v1.RolloutsResponse" }
+}
+`
+
+// apiService is the descriptor of GRPCService.
+var apiService = func() protoreflect.ServiceDescriptor {
+	fdp := &descriptorpb.FileDescriptorProto{}
+	if err := prototext.Unmarshal([]byte(apiProto), fdp); err != nil {
+		panic(err)
+	}
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fd.Services().Get(0)
+}()
+
+// grpcService is implemented by *Server.
+type grpcService interface {
+	runRequest(ctx context.Context, req *RunRequest, send func(*Event)) error
+}
+
+// grpcServiceDesc returns the description of GRPCService served by s. Its
+// messages are dynamic messages of apiService.
+func (s *Server) grpcServiceDesc() *grpc.ServiceDesc {
+	run := apiService.Methods().ByName("Run")
+	rollouts := apiService.Methods().ByName("Rollouts")
+	return &grpc.ServiceDesc{
+		ServiceName: GRPCService,
+		HandlerType: (*grpcService)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: string(rollouts.Name()),
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := dynamicpb.NewMessage(rollouts.Input())
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, in interface{}) (interface{}, error) {
+					return s.grpcRollouts(ctx, in.(proto.Message), rollouts.Output())
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: s, FullMethod: "/" + GRPCService + "/" + string(rollouts.Name())}, handler)
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    string(run.Name()),
+			ServerStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				in := dynamicpb.NewMessage(run.Input())
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return s.grpcRun(in, run.Output(), stream)
+			},
+		}},
+		Metadata: "isopod/v1/isopod.proto",
+	}
+}
+
+// NewGRPCServer returns a *grpc.Server created with opts serving the API of
+// s as GRPCService. Requests must carry `authorization: Bearer <token>'
+// metadata.
+func NewGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := s.grpcAuthorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.grpcAuthorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	gs := grpc.NewServer(opts...)
+	gs.RegisterService(s.grpcServiceDesc(), s)
+	return gs
+}
+
+// grpcAuthorize returns Unauthenticated error unless ctx carries the token of
+// s.
+func (s *Server) grpcAuthorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if s.authorized(auth) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// fromMessage sets JSON object v of the gateway from message m.
+func fromMessage(m proto.Message, v interface{}) error {
+	bs, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// toMessage returns message of type md set from JSON object v of the
+// gateway.
+func toMessage(v interface{}, md protoreflect.MessageDescriptor) (proto.Message, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := protojson.Unmarshal(bs, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// grpcRun implements the Run method streaming events as messages of type
+// out.
+func (s *Server) grpcRun(in proto.Message, out protoreflect.MessageDescriptor, stream grpc.ServerStream) error {
+	req := &RunRequest{}
+	if err := fromMessage(in, req); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	if err := s.checkRun(req); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var sendErr error
+	err := s.runRequest(stream.Context(), req, func(e *Event) {
+		if sendErr != nil {
+			return
+		}
+		m, err := toMessage(e, out)
+		if err != nil {
+			sendErr = err
+			return
+		}
+		sendErr = stream.SendMsg(m)
+	})
+	if errors.Is(err, errBusy) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return sendErr
+}
+
+// grpcRollouts implements the Rollouts method returning message of type
+// out.
+func (s *Server) grpcRollouts(ctx context.Context, in proto.Message, out protoreflect.MessageDescriptor) (proto.Message, error) {
+	req := &RolloutsRequest{}
+	if err := fromMessage(in, req); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	path, err := s.entryFile(req.EntryFile)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.EntryFile = path
+
+	rollouts, err := s.rollouts(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp, err := toMessage(struct {
+		Rollouts []*Rollout `json:"rollouts"`
+	}{rollouts}, out)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return resp, nil
+}
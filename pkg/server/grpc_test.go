@@ -0,0 +1,141 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := NewGRPCServer(newTestAPI(t))
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// message returns message of the input of method set from JSON req.
+	message := func(method, req string) proto.Message {
+		m := dynamicpb.NewMessage(apiService.Methods().ByName(protoreflect.Name(method)).Input())
+		if err := protojson.Unmarshal([]byte(req), m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	run := func(ctx context.Context, req string) ([]string, error) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/"+GRPCService+"/Run")
+		if err != nil {
+			return nil, err
+		}
+		if err := stream.SendMsg(message("Run", req)); err != nil {
+			return nil, err
+		}
+		if err := stream.CloseSend(); err != nil {
+			return nil, err
+		}
+		var got []string
+		for {
+			out := dynamicpb.NewMessage(apiService.Methods().ByName("Run").Output())
+			if err := stream.RecvMsg(out); err == io.EOF {
+				return got, nil
+			} else if err != nil {
+				return nil, err
+			}
+			e := &Event{}
+			if err := fromMessage(out, e); err != nil {
+				return nil, err
+			}
+			got = append(got, e.Type)
+		}
+	}
+
+	ctx := context.Background()
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	for _, tc := range []struct {
+		name       string
+		ctx        context.Context
+		req        string
+		wantCode   codes.Code
+		wantEvents []string
+	}{
+		{
+			name:     "unauthenticated",
+			ctx:      ctx,
+			req:      `{"command": "install", "entryfile": "main.ipd"}`,
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "entry file outside of root",
+			ctx:      authCtx,
+			req:      `{"command": "install", "entryfile": "/etc/passwd"}`,
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:       "success",
+			ctx:        authCtx,
+			req:        `{"command": "install", "entryfile": "main.ipd"}`,
+			wantEvents: []string{"addon_started", "addon_succeeded", RunSucceeded},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := run(tc.ctx, tc.req)
+			if code := status.Code(err); code != tc.wantCode {
+				t.Fatalf("Expected code %v, got: %v", tc.wantCode, err)
+			}
+			if d := cmp.Diff(tc.wantEvents, got); d != "" {
+				t.Errorf("Unexpected events (-want +got):\n%s", d)
+			}
+		})
+	}
+
+	out := dynamicpb.NewMessage(apiService.Methods().ByName("Rollouts").Output())
+	if err := conn.Invoke(authCtx, "/"+GRPCService+"/Rollouts", message("Rollouts", `{"entryfile": "main.ipd"}`), out); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Rollouts []*Rollout `json:"rollouts"`
+	}
+	if err := fromMessage(out, &resp); err != nil {
+		t.Fatal(err)
+	}
+	rollouts := resp.Rollouts
+	want := []*Rollout{
+		{Cluster: "minikube", Found: true, ID: "rollout-1", Live: true, Addons: []string{"ingress"}},
+		{Cluster: "paas-dev"},
+	}
+	if d := cmp.Diff(want, rollouts); d != "" {
+		t.Errorf("Unexpected rollouts (-want +got):\n%s", d)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server implements authenticated API for triggering rollouts and
+// querying rollout history remotely, served over gRPC (see NewGRPCServer) and
+// as an HTTP/JSON gateway (Server).
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+// RunRequest is the body of a run request.
+type RunRequest struct {
+	Command   runtime.Command   `json:"command"`
+	EntryFile string            `json:"entryfile"`
+	Context   map[string]string `json:"context,omitempty"`
+}
+
+// RolloutsRequest is the request of the gRPC Rollouts method (query
+// parameters of the HTTP one).
+type RolloutsRequest struct {
+	EntryFile string            `json:"entryfile"`
+	ID        string            `json:"id,omitempty"`
+	Context   map[string]string `json:"context,omitempty"`
+}
+
+// RunFunc runs req reporting progress to h.
+type RunFunc func(ctx context.Context, req *RunRequest, h runtime.EventHandler) error
+
+// StoresFunc calls fn with rollout store of every cluster returned by the
+// clusters Starlark function of entryFile called with userCtx. Errors of fn
+// are returned prefixed with the cluster name.
+type StoresFunc func(ctx context.Context, entryFile string, userCtx map[string]string, fn func(cluster string, s store.Store) error) error
+
+// Event is a single line of the streamed run response.
+type Event struct {
+	Type    string `json:"type"`
+	Command string `json:"command,omitempty"`
+	Cluster string `json:"cluster,omitempty"`
+	Addon   string `json:"addon,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	// RunSucceeded is the type of the last Event of a successful run.
+	RunSucceeded = "run_succeeded"
+	// RunFailed is the type of the last Event of a failed run.
+	RunFailed = "run_failed"
+)
+
+// Rollout is the stored state of a rollout on a single cluster.
+type Rollout struct {
+	Cluster string   `json:"cluster"`
+	Found   bool     `json:"found"`
+	ID      string   `json:"id,omitempty"`
+	Live    bool     `json:"live,omitempty"`
+	Addons  []string `json:"addons,omitempty"`
+}
+
+// errBusy is returned when a run is requested while another one is in
+// progress.
+var errBusy = errors.New("another run is in progress")
+
+// Server serves the API. All requests must carry `Authorization: Bearer
+// <token>' header.
+type Server struct {
+	token string
+	// root is the directory entry files must be in.
+	root   string
+	run    RunFunc
+	stores StoresFunc
+	// busy is a semaphore allowing a single run at a time.
+	busy chan struct{}
+	mux  *http.ServeMux
+}
+
+// New returns a new *Server authenticating requests with token and only
+// running entry files in directory root (relative entry files are relative
+// to it).
+func New(token, root string, run RunFunc, stores StoresFunc) (*Server, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, fmt.Errorf("invalid entry file root: %v", err)
+	}
+	s := &Server{
+		token:  token,
+		root:   root,
+		run:    run,
+		stores: stores,
+		busy:   make(chan struct{}, 1),
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/run", s.handleRun)
+	s.mux.HandleFunc("/v1/rollouts", s.handleRollouts)
+	return s, nil
+}
+
+// IsLoopback returns true if listen address addr (`host:port') only accepts
+// connections from the local host.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorized returns true if Authorization header value auth carries the
+// token of s.
+func (s *Server) authorized(auth string) bool {
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
+
+// entryFile resolves path of an entry file requested by a client. Returns
+// error if it is not in the root of s.
+func (s *Server) entryFile(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("entryfile must be set")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid entryfile `%s': %v", path, err)
+	}
+	if rel, err := filepath.Rel(s.root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entryfile `%s' is not in `%s'", path, s.root)
+	}
+	return resolved, nil
+}
+
+// checkRun validates req and resolves its entry file.
+func (s *Server) checkRun(req *RunRequest) error {
+	if req.Command != runtime.InstallCommand && req.Command != runtime.RemoveCommand {
+		return fmt.Errorf("unsupported command `%s'", req.Command)
+	}
+	path, err := s.entryFile(req.EntryFile)
+	if err != nil {
+		return err
+	}
+	req.EntryFile = path
+	return nil
+}
+
+// runRequest runs req (checked by checkRun) calling send with each Event, the
+// last of which is either RunSucceeded or RunFailed. Returns errBusy without
+// sending anything if another run is in progress.
+func (s *Server) runRequest(ctx context.Context, req *RunRequest, send func(*Event)) error {
+	select {
+	case s.busy <- struct{}{}:
+		defer func() { <-s.busy }()
+	default:
+		return errBusy
+	}
+
+	log.Infof("Running `%s' for `%s' with context %v", req.Command, req.EntryFile, req.Context)
+	err := s.run(ctx, req, func(e *runtime.Event) {
+		ev := &Event{
+			Type:    string(e.Type),
+			Command: string(e.Command),
+			Cluster: e.Cluster,
+			Addon:   e.Addon,
+		}
+		if e.Err != nil {
+			ev.Error = e.Err.Error()
+		}
+		send(ev)
+	})
+	if err != nil {
+		send(&Event{Type: RunFailed, Command: string(req.Command), Error: err.Error()})
+		return nil
+	}
+	send(&Event{Type: RunSucceeded, Command: string(req.Command)})
+	return nil
+}
+
+// rollouts returns the live rollout (or rollout id if set) of each cluster
+// selected by req, whose entry file must be resolved already.
+func (s *Server) rollouts(ctx context.Context, req *RolloutsRequest) ([]*Rollout, error) {
+	rollouts := []*Rollout{}
+	if err := s.stores(ctx, req.EntryFile, req.Context, func(cluster string, st store.Store) error {
+		var ro *store.Rollout
+		var found bool
+		var err error
+		if req.ID == "" {
+			ro, found, err = st.GetLive()
+		} else {
+			ro, found, err = st.GetRollout(store.RolloutID(req.ID))
+		}
+		if err != nil {
+			return err
+		}
+
+		ret := &Rollout{Cluster: cluster, Found: found}
+		if found {
+			ret.ID, ret.Live = string(ro.ID), ro.Live
+			for _, a := range ro.Addons {
+				ret.Addons = append(ret.Addons, a.Name)
+			}
+		}
+		rollouts = append(rollouts, ret)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r.Header.Get("Authorization")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleRun runs the requested command streaming newline-delimited JSON
+// Events to the client. The last Event is either RunSucceeded or RunFailed.
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &RunRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkRun(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	send := func(e *Event) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := enc.Encode(e); err != nil {
+			log.Errorf("Failed to stream event: %v", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if err := s.runRequest(r.Context(), req, send); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// handleRollouts returns the live rollout (or rollout set by `id' query
+// parameter) of each cluster selected by `entryfile' and `context' query
+// parameters.
+func (s *Server) handleRollouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	entryFile, err := s.entryFile(q.Get("entryfile"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userCtx, err := util.ParseCommaSeparatedParams(q.Get("context"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid context: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	rollouts, err := s.rollouts(r.Context(), &RolloutsRequest{EntryFile: entryFile, ID: q.Get("id"), Context: userCtx})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rollouts); err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
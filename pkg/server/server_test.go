@@ -0,0 +1,211 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+type liveStore struct {
+	store.NoopStore
+}
+
+func (liveStore) GetLive() (*store.Rollout, bool, error) {
+	return &store.Rollout{
+		ID:     "rollout-1",
+		Live:   true,
+		Addons: []*store.AddonRun{{Name: "ingress"}},
+	}, true, nil
+}
+
+// newTestAPI returns a *Server with entry file main.ipd in its root.
+func newTestAPI(t *testing.T) *Server {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.ipd"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(_ context.Context, req *RunRequest, h runtime.EventHandler) error {
+		h(&runtime.Event{Type: runtime.AddonStarted, Command: req.Command, Cluster: "minikube", Addon: "ingress"})
+		if req.Context["fail"] == "true" {
+			err := errors.New("boom")
+			h(&runtime.Event{Type: runtime.AddonFailed, Command: req.Command, Cluster: "minikube", Addon: "ingress", Err: err})
+			return err
+		}
+		h(&runtime.Event{Type: runtime.AddonSucceeded, Command: req.Command, Cluster: "minikube", Addon: "ingress"})
+		return nil
+	}
+	stores := func(_ context.Context, _ string, _ map[string]string, fn func(string, store.Store) error) error {
+		if err := fn("minikube", liveStore{}); err != nil {
+			return err
+		}
+		return fn("paas-dev", store.NoopStore{})
+	}
+	s, err := New("secret", dir, run, stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(newTestAPI(t))
+}
+
+func do(t *testing.T, method, url, token, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(bs)
+}
+
+func TestRun(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+		wantEvents []string
+	}{
+		{
+			name:       "unauthenticated",
+			token:      "wrong",
+			body:       `{"command": "install", "entryfile": "main.ipd"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unsupported command",
+			token:      "secret",
+			body:       `{"command": "test", "entryfile": "main.ipd"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "entry file outside of root",
+			token:      "secret",
+			body:       `{"command": "install", "entryfile": "../main.ipd"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing entry file",
+			token:      "secret",
+			body:       `{"command": "install", "entryfile": "other.ipd"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "success",
+			token:      "secret",
+			body:       `{"command": "install", "entryfile": "main.ipd"}`,
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"addon_started", "addon_succeeded", RunSucceeded},
+		},
+		{
+			name:       "failure",
+			token:      "secret",
+			body:       `{"command": "remove", "entryfile": "main.ipd", "context": {"fail": "true"}}`,
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"addon_started", "addon_failed", RunFailed},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := do(t, http.MethodPost, s.URL+"/v1/run", tc.token, tc.body)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantStatus, resp.StatusCode, body)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got []string
+			dec := json.NewDecoder(strings.NewReader(body))
+			for dec.More() {
+				e := &Event{}
+				if err := dec.Decode(e); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e.Type)
+			}
+			if d := cmp.Diff(tc.wantEvents, got); d != "" {
+				t.Errorf("Unexpected events (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestRollouts(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	resp, body := do(t, http.MethodGet, s.URL+"/v1/rollouts?entryfile=main.ipd&context=env%3Ddev", "secret", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var got []*Rollout
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Rollout{
+		{Cluster: "minikube", Found: true, ID: "rollout-1", Live: true, Addons: []string{"ingress"}},
+		{Cluster: "paas-dev"},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected rollouts (-want +got):\n%s", d)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8080": true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"localhost":      false,
+	} {
+		if got := IsLoopback(addr); got != want {
+			t.Errorf("IsLoopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
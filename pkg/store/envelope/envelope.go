@@ -0,0 +1,309 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package envelope implements envelope encryption of rollout store payloads:
+// data is encrypted with a random data encryption key (DEK) which is itself
+// encrypted ("wrapped") by a key encryption key held by Vault transit or
+// Google Cloud KMS. Only the wrapped DEK is stored along with the data.
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	vapi "github.com/hashicorp/vault/api"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// VaultTransitScheme is the scheme of key URIs of Vault transit keys:
+	// vault-transit://[<mount>/]<key> (the mount defaults to `transit').
+	VaultTransitScheme = "vault-transit"
+	// GCPKMSScheme is the scheme of key URIs of Google Cloud KMS keys:
+	// gcpkms://projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>.
+	GCPKMSScheme = "gcpkms"
+
+	dekSize = 32 // AES-256
+)
+
+// KeyWrapper encrypts and decrypts DEKs with a key encryption key.
+type KeyWrapper interface {
+	// URI identifies the key encryption key.
+	URI() string
+	// Wrap encrypts dek.
+	Wrap(ctx context.Context, dek []byte) ([]byte, error)
+	// Unwrap decrypts dek wrapped by Wrap.
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Sealed is data encrypted with a DEK wrapped by a KeyWrapper.
+type Sealed struct {
+	// KeyURI is URI of the key encryption key the DEK is wrapped with.
+	KeyURI string `json:"key"`
+	// WrappedKey is the wrapped DEK.
+	WrappedKey []byte `json:"wrappedKey"`
+	// Ciphertext is the AES-256-GCM nonce followed by the encrypted data.
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Seal encrypts plaintext with a new DEK wrapped by w.
+func Seal(ctx context.Context, w KeyWrapper, plaintext []byte) (*Sealed, error) {
+	dek := make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	wrapped, err := w.Wrap(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key with `%s': %v", w.URI(), err)
+	}
+	return &Sealed{
+		KeyURI:     w.URI(),
+		WrappedKey: wrapped,
+		Ciphertext: aead.Seal(nonce, nonce, plaintext, nil),
+	}, nil
+}
+
+// Open decrypts s with its DEK unwrapped by the key of w it was sealed with:
+// w itself or one of its previous keys (see WithPreviousKeys).
+func Open(ctx context.Context, w KeyWrapper, s *Sealed) ([]byte, error) {
+	u := keyOf(w, s.KeyURI)
+	if u == nil {
+		return nil, fmt.Errorf("data is encrypted with `%s', not `%s' nor any of its previous keys", s.KeyURI, w.URI())
+	}
+	dek, err := u.Unwrap(ctx, s.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with `%s': %v", u.URI(), err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	n := aead.NonceSize()
+	plaintext, err := aead.Open(nil, s.Ciphertext[:n], s.Ciphertext[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %v", err)
+	}
+	return plaintext, nil
+}
+
+// keyring wraps DEKs with its current key and unwraps them with any of its
+// keys.
+type keyring struct {
+	KeyWrapper
+	// previous are previous keys by URI.
+	previous map[string]KeyWrapper
+}
+
+// WithPreviousKeys returns KeyWrapper sealing data with current that also
+// opens data sealed with any of previous keys, so that data sealed before
+// current replaced them can still be read.
+func WithPreviousKeys(current KeyWrapper, previous ...KeyWrapper) KeyWrapper {
+	k := &keyring{KeyWrapper: current, previous: map[string]KeyWrapper{}}
+	for _, p := range previous {
+		k.previous[p.URI()] = p
+	}
+	return k
+}
+
+// keyOf returns the key of w identified by uri (nil if none).
+func keyOf(w KeyWrapper, uri string) KeyWrapper {
+	if w.URI() == uri {
+		return w
+	}
+	if k, ok := w.(*keyring); ok {
+		return k.previous[uri]
+	}
+	return nil
+}
+
+func newAEAD(dek []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// NewKeyWrapper returns KeyWrapper of key uri. Vault transit keys use vaultC,
+// Google Cloud KMS keys the google application default credential.
+func NewKeyWrapper(ctx context.Context, uri string, vaultC *vapi.Client) (KeyWrapper, error) {
+	i := strings.Index(uri, "://")
+	if i < 0 || uri[i+3:] == "" {
+		return nil, fmt.Errorf("invalid key URI `%s' (want %s://[<mount>/]<key> or %s://projects/.../cryptoKeys/<key>)", uri, VaultTransitScheme, GCPKMSScheme)
+	}
+	scheme, path := uri[:i], uri[i+3:]
+	switch scheme {
+	case VaultTransitScheme:
+		mount, key := "transit", path
+		if j := strings.LastIndex(path, "/"); j >= 0 {
+			mount, key = path[:j], path[j+1:]
+		}
+		if vaultC == nil {
+			return nil, errors.New("Vault client is required for Vault transit keys")
+		}
+		return NewVaultTransit(vaultC, mount, key), nil
+	case GCPKMSScheme:
+		tokenSrc, err := google.DefaultTokenSource(ctx, cloudKMSScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the google DefaultTokenSource: %v", err)
+		}
+		return NewGCPKMS(oauth2.NewClient(ctx, tokenSrc), path), nil
+	default:
+		return nil, fmt.Errorf("unknown key URI scheme `%s' (want %s or %s)", scheme, VaultTransitScheme, GCPKMSScheme)
+	}
+}
+
+// vaultTransit wraps DEKs with Vault transit secrets engine.
+type vaultTransit struct {
+	c          *vapi.Client
+	mount, key string
+}
+
+// NewVaultTransit returns KeyWrapper of transit key mounted at mount.
+func NewVaultTransit(c *vapi.Client, mount, key string) KeyWrapper {
+	return &vaultTransit{c: c, mount: strings.Trim(mount, "/"), key: key}
+}
+
+func (v *vaultTransit) URI() string {
+	return fmt.Sprintf("%s://%s/%s", VaultTransitScheme, v.mount, v.key)
+}
+
+func (v *vaultTransit) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	s, err := v.c.Logical().Write(fmt.Sprintf("%s/encrypt/%s", v.mount, v.key), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dek),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("empty response from Vault")
+	}
+	c, ok := s.Data["ciphertext"].(string)
+	if !ok {
+		return nil, errors.New("no ciphertext in response from Vault")
+	}
+	return []byte(c), nil
+}
+
+func (v *vaultTransit) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	s, err := v.c.Logical().Write(fmt.Sprintf("%s/decrypt/%s", v.mount, v.key), map[string]interface{}{
+		"ciphertext": string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("empty response from Vault")
+	}
+	p, ok := s.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("no plaintext in response from Vault")
+	}
+	return base64.StdEncoding.DecodeString(p)
+}
+
+// cloudKMSScope is the OAuth2 scope of Google Cloud KMS API.
+const cloudKMSScope = "https://www.googleapis.com/auth/cloudkms"
+
+// cloudKMSURL is the endpoint of Google Cloud KMS API (overridden in tests).
+var cloudKMSURL = "https://cloudkms.googleapis.com"
+
+// gcpKMS wraps DEKs with Google Cloud KMS.
+type gcpKMS struct {
+	c    *http.Client
+	name string
+}
+
+// NewGCPKMS returns KeyWrapper of Google Cloud KMS key with resource name
+// (projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>) using authenticated
+// client c.
+func NewGCPKMS(c *http.Client, name string) KeyWrapper {
+	return &gcpKMS{c: c, name: name}
+}
+
+func (k *gcpKMS) URI() string {
+	return fmt.Sprintf("%s://%s", GCPKMSScheme, k.name)
+}
+
+func (k *gcpKMS) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	var resp struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := k.call(ctx, "encrypt", map[string][]byte{"plaintext": dek}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (k *gcpKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	if err := k.call(ctx, "decrypt", map[string][]byte{"ciphertext": wrapped}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// call calls method of the key with req (bytes are base64 encoded in JSON
+// as expected by the API) and decodes the response into resp.
+func (k *gcpKMS) call(ctx context.Context, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s:%s", cloudKMSURL, k.name, method)
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := k.c.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	bs, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, bs)
+	}
+	return json.Unmarshal(bs, resp)
+}
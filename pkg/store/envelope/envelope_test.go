@@ -0,0 +1,201 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	vapi "github.com/hashicorp/vault/api"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+// reverseWrapper "wraps" DEKs by reversing them.
+type reverseWrapper string
+
+func (w reverseWrapper) URI() string { return string(w) }
+
+func (w reverseWrapper) Wrap(_ context.Context, dek []byte) ([]byte, error) {
+	out := make([]byte, len(dek))
+	for i, b := range dek {
+		out[len(dek)-1-i] = b
+	}
+	return out, nil
+}
+
+func (w reverseWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return w.Wrap(ctx, wrapped)
+}
+
+func TestSealOpen(t *testing.T) {
+	ctx := context.Background()
+	w := reverseWrapper("test://key")
+	plaintext := []byte("password: hunter2")
+
+	s, err := Seal(ctx, w, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyURI != "test://key" {
+		t.Errorf("Unexpected key URI: %s", s.KeyURI)
+	}
+	if bytes.Contains(s.Ciphertext, plaintext) {
+		t.Error("Ciphertext contains plaintext")
+	}
+
+	got, err := Open(ctx, w, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Want %q, got %q", plaintext, got)
+	}
+
+	wantErr := errors.New("data is encrypted with `test://key', not `test://other' nor any of its previous keys")
+	if _, err := Open(ctx, reverseWrapper("test://other"), s); !util.ErrsEqual(err, wantErr) {
+		t.Errorf("Unexpected error.\nWant: %v\nGot: %v", wantErr, err)
+	}
+
+	rotated := WithPreviousKeys(reverseWrapper("test://other"), w)
+	if got, err := Open(ctx, rotated, s); err != nil {
+		t.Errorf("Failed to open with previous key: %v", err)
+	} else if !bytes.Equal(got, plaintext) {
+		t.Errorf("Want %q, got %q", plaintext, got)
+	}
+	if s, err := Seal(ctx, rotated, plaintext); err != nil {
+		t.Fatal(err)
+	} else if s.KeyURI != "test://other" {
+		t.Errorf("Expected data sealed with the current key, got %s", s.KeyURI)
+	}
+
+	s.Ciphertext[len(s.Ciphertext)-1] ^= 1
+	wantErr = errors.New("failed to decrypt data: cipher: message authentication failed")
+	if _, err := Open(ctx, w, s); !util.ErrsEqual(err, wantErr) {
+		t.Errorf("Unexpected error of tampered ciphertext.\nWant: %v\nGot: %v", wantErr, err)
+	}
+}
+
+func TestVaultTransit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secrets/transit/encrypt/isopod":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]},
+			})
+		case "/v1/secrets/transit/decrypt/isopod":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")},
+			})
+		default:
+			http.Error(w, `{"errors": ["no handler for route"]}`, http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c, err := vapi.NewClient(&vapi.Config{Address: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken("token")
+	w, err := NewKeyWrapper(context.Background(), "vault-transit://secrets/transit/isopod", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeyWrapper(t, w, "vault-transit://secrets/transit/isopod")
+}
+
+func TestGCPKMS(t *testing.T) {
+	const name = "projects/p/locations/global/keyRings/r/cryptoKeys/isopod"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string][]byte{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/" + name + ":encrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"ciphertext": append([]byte("kms:"), req["plaintext"]...)})
+		case "/v1/" + name + ":decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"plaintext": bytes.TrimPrefix(req["ciphertext"], []byte("kms:"))})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	defer func(u string) { cloudKMSURL = u }(cloudKMSURL)
+	cloudKMSURL = s.URL
+
+	testKeyWrapper(t, NewGCPKMS(s.Client(), name), "gcpkms://"+name)
+}
+
+func testKeyWrapper(t *testing.T, w KeyWrapper, wantURI string) {
+	ctx := context.Background()
+	if w.URI() != wantURI {
+		t.Errorf("Want URI %s, got %s", wantURI, w.URI())
+	}
+	dek := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := w.Wrap(ctx, dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(wrapped, dek) {
+		t.Errorf("Unexpected wrapped key: %s", wrapped)
+	}
+	got, err := w.Unwrap(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dek) {
+		t.Errorf("Want unwrapped %q, got %q", dek, got)
+	}
+}
+
+func TestNewKeyWrapper(t *testing.T) {
+	c, err := vapi.NewClient(&vapi.Config{Address: "http://127.0.0.1:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		uri, wantURI string
+		wantErr      error
+	}{
+		{uri: "vault-transit://isopod", wantURI: "vault-transit://transit/isopod"},
+		{uri: "vault-transit://team/transit/isopod", wantURI: "vault-transit://team/transit/isopod"},
+		{uri: "isopod", wantErr: errors.New("invalid key URI `isopod' (want vault-transit://[<mount>/]<key> or gcpkms://projects/.../cryptoKeys/<key>)")},
+		{uri: "awskms://alias/isopod", wantErr: errors.New("unknown key URI scheme `awskms' (want vault-transit or gcpkms)")},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			w, err := NewKeyWrapper(context.Background(), tc.uri, c)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if err == nil && w.URI() != tc.wantURI {
+				t.Errorf("Want URI %s, got %s", tc.wantURI, w.URI())
+			}
+		})
+	}
+}
@@ -17,8 +17,11 @@ package kube
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	log "github.com/golang/glog"
@@ -32,11 +35,17 @@ import (
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/store/envelope"
 )
 
+// sealedKey is the BinaryData key of encrypted addon run payloads.
+const sealedKey = "sealed"
+
 type Store struct {
 	namespace string
 	clientset kubernetes.Interface
+	// wrapper encrypts addon run payloads if set.
+	wrapper envelope.KeyWrapper
 }
 
 // New returns new Kubernetes-based Store implementation.
@@ -47,6 +56,75 @@ func New(c kubernetes.Interface, namespace string) *Store {
 	}
 }
 
+// SetKeyWrapper makes s encrypt modules, objects, contexts and data of addon
+// runs it records with DEKs wrapped by w (see package envelope) and decrypt
+// encrypted runs it reads. Runs recorded without encryption are still read.
+func (s *Store) SetKeyWrapper(w envelope.KeyWrapper) {
+	s.wrapper = w
+}
+
+// runPayload is the encrypted part of an addon run.
+type runPayload struct {
+	Modules  map[string]string `json:"modules"`
+	Objects  []store.ObjRef    `json:"objects,omitempty"`
+	Contexts map[string]string `json:"contexts,omitempty"`
+	Data     map[string][]byte `json:"data,omitempty"`
+}
+
+// sealRun returns data and binary data of run ConfigMap of addon with
+// payload encrypted.
+func (s *Store) sealRun(addon *store.AddonRun) (map[string]string, map[string][]byte, error) {
+	payload, err := json.Marshal(&runPayload{
+		Modules:  addon.Modules,
+		Objects:  addon.ObjRefs,
+		Contexts: addon.Contexts,
+		Data:     addon.Data,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not marshal addon run: %v", err)
+	}
+	sealed, err := envelope.Seal(context.TODO(), s.wrapper, payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encrypt addon run: %v", err)
+	}
+	bs, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := map[string]string{
+		"addon":   addon.Name,
+		"version": addon.Version,
+	}
+	return data, map[string][]byte{sealedKey: bs}, nil
+}
+
+// openRun decrypts payload of encrypted run ConfigMap of addon name.
+func (s *Store) openRun(name string, run *corev1.ConfigMap) (*store.AddonRun, error) {
+	sealed := &envelope.Sealed{}
+	if err := json.Unmarshal(run.BinaryData[sealedKey], sealed); err != nil {
+		return nil, fmt.Errorf("could not unmarshal encrypted run of addon `%s': %v", name, err)
+	}
+	if s.wrapper == nil {
+		return nil, fmt.Errorf("run of addon `%s' is encrypted with `%s' but no encryption key is set", name, sealed.KeyURI)
+	}
+	bs, err := envelope.Open(context.TODO(), s.wrapper, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt run of addon `%s': %v", name, err)
+	}
+	p := &runPayload{}
+	if err := json.Unmarshal(bs, p); err != nil {
+		return nil, fmt.Errorf("could not unmarshal run of addon `%s': %v", name, err)
+	}
+	return &store.AddonRun{
+		Name:     name,
+		Version:  run.Data["version"],
+		Modules:  p.Modules,
+		Data:     p.Data,
+		ObjRefs:  p.Objects,
+		Contexts: p.Contexts,
+	}, nil
+}
+
 // CreateRollout implements store.Store.CreateRollout.
 func (s *Store) CreateRollout() (*store.Rollout, error) {
 	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Create(
@@ -81,6 +159,10 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 	if err != nil {
 		return "", fmt.Errorf("could not marshal addon modules: %v", err)
 	}
+	objs, err := json.Marshal(addon.ObjRefs)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal addon objects: %v", err)
+	}
 
 	ref := metav1.NewControllerRef(rollout, schema.GroupVersionKind{
 		Version: "v1",
@@ -90,6 +172,25 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 		"addon": addon.Name,
 		"owner": string(id),
 	}
+	data := map[string]string{
+		"addon":   addon.Name,
+		"version": addon.Version,
+		"modules": string(mods),
+		"objects": string(objs),
+	}
+	if len(addon.Contexts) > 0 {
+		ctxs, err := json.Marshal(addon.Contexts)
+		if err != nil {
+			return "", fmt.Errorf("could not marshal addon contexts: %v", err)
+		}
+		data["contexts"] = string(ctxs)
+	}
+	binData := addon.Data
+	if s.wrapper != nil {
+		if data, binData, err = s.sealRun(addon); err != nil {
+			return "", err
+		}
+	}
 	run, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Create(
 		context.TODO(),
 		&corev1.ConfigMap{
@@ -98,11 +199,8 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 				OwnerReferences: []metav1.OwnerReference{*ref},
 				Labels:          runLabels,
 			},
-			Data: map[string]string{
-				"addon":   addon.Name,
-				"modules": string(mods),
-			},
-			BinaryData: addon.Data,
+			Data:       data,
+			BinaryData: binData,
 		},
 		metav1.CreateOptions{},
 	)
@@ -121,9 +219,9 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 		return "", fmt.Errorf("addon run for addon `%s' already exists: %s", addon.Name, run.Name)
 	}
 	rollout.Data[addon.Name] = run.Name
-	// Assume we are the only Isopod in the cluster and just error-out if
-	// something funky is going on (like update race condition) to let operator
-	// deal with it.
+	// Concurrent Isopod runs are excluded by the rollout lock (see pkg/lock)
+	// so just error-out if something funky is going on (like update race
+	// condition) to let operator deal with it.
 	_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(
 		context.TODO(),
 		rollout,
@@ -175,10 +273,156 @@ func (s *Store) CompleteRollout(id store.RolloutID) error {
 
 // GetLive implements store.Store.GetLive.
 func (s *Store) GetLive() (r *store.Rollout, found bool, err error) {
-	return nil, false, errors.New("not implemented")
+	id, found, err := s.liveID()
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return s.GetRollout(id)
 }
 
 // GetRollout implements store.Store.GetRollout.
 func (s *Store) GetRollout(id store.RolloutID) (r *store.Rollout, found bool, err error) {
-	return nil, false, errors.New("not implemented")
+	rollout, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(
+		context.TODO(),
+		string(id),
+		metav1.GetOptions{},
+	)
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	liveID, _, err := s.liveID()
+	if err != nil {
+		return nil, false, err
+	}
+	r = &store.Rollout{
+		ID:      id,
+		Live:    liveID == id,
+		Created: rollout.CreationTimestamp.Time,
+	}
+
+	names := make([]string, 0, len(rollout.Data))
+	for name := range rollout.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		run, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(
+			context.TODO(),
+			rollout.Data[name],
+			metav1.GetOptions{},
+		)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get run of addon `%s': %v", name, err)
+		}
+		if _, ok := run.BinaryData[sealedKey]; ok {
+			a, err := s.openRun(name, run)
+			if err != nil {
+				return nil, false, err
+			}
+			r.Addons = append(r.Addons, a)
+			continue
+		}
+		mods := map[string]string{}
+		if err := yaml.Unmarshal([]byte(run.Data["modules"]), &mods); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal modules of addon `%s': %v", name, err)
+		}
+		// Runs recorded by older versions don't have objects.
+		var objs []store.ObjRef
+		if s := run.Data["objects"]; s != "" {
+			if err := json.Unmarshal([]byte(s), &objs); err != nil {
+				return nil, false, fmt.Errorf("could not unmarshal objects of addon `%s': %v", name, err)
+			}
+		}
+		var ctxs map[string]string
+		if s := run.Data["contexts"]; s != "" {
+			if err := json.Unmarshal([]byte(s), &ctxs); err != nil {
+				return nil, false, fmt.Errorf("could not unmarshal contexts of addon `%s': %v", name, err)
+			}
+		}
+		r.Addons = append(r.Addons, &store.AddonRun{
+			Name:     name,
+			Version:  run.Data["version"],
+			Modules:  mods,
+			Data:     run.BinaryData,
+			ObjRefs:  objs,
+			Contexts: ctxs,
+		})
+	}
+	return r, true, nil
+}
+
+// liveID returns ID of the live rollout recorded by CompleteRollout.
+func (s *Store) liveID() (id store.RolloutID, found bool, err error) {
+	live, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(
+		context.TODO(),
+		"rollout-live",
+		metav1.GetOptions{},
+	)
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	id = store.RolloutID(live.Data["rollout"])
+	return id, id != "", nil
+}
+
+// Prune implements store.Pruner.Prune. Addon runs of removed rollouts are
+// deleted explicitly rather than left to the garbage collector.
+func (s *Store) Prune(r store.Retention, dryRun bool) ([]store.RolloutID, error) {
+	cms, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	liveID, _, err := s.liveID()
+	if err != nil {
+		return nil, err
+	}
+	var rollouts []*store.Rollout
+	for _, cm := range cms.Items {
+		if !strings.HasPrefix(cm.Name, "rollout-") || cm.Name == "rollout-live" {
+			continue
+		}
+		id := store.RolloutID(cm.Name)
+		rollouts = append(rollouts, &store.Rollout{
+			ID:      id,
+			Live:    id == liveID,
+			Created: cm.CreationTimestamp.Time,
+		})
+	}
+
+	var ids []store.RolloutID
+	for _, ro := range r.Expired(rollouts, time.Now()) {
+		if !dryRun {
+			if err := s.deleteRollout(ro.ID); err != nil {
+				return ids, err
+			}
+		}
+		ids = append(ids, ro.ID)
+	}
+	return ids, nil
+}
+
+// deleteRollout deletes addon runs of rollout id and then the rollout.
+func (s *Store) deleteRollout(id store.RolloutID) error {
+	cms := s.clientset.CoreV1().ConfigMaps(s.namespace)
+	runs, err := cms.List(context.TODO(), metav1.ListOptions{LabelSelector: "owner=" + string(id)})
+	if err != nil {
+		return fmt.Errorf("failed to list addon runs of rollout `%s': %v", id, err)
+	}
+	for _, run := range runs.Items {
+		if err := cms.Delete(context.TODO(), run.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete addon run `%s' of rollout `%s': %v", run.Name, id, err)
+		}
+	}
+	if err := cms.Delete(context.TODO(), string(id), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete rollout `%s': %v", id, err)
+	}
+	log.Infof("Deleted rollout `%s' and %d addon runs", id, len(runs.Items))
+	return nil
 }
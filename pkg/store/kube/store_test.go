@@ -16,10 +16,15 @@ package kube
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
@@ -85,6 +90,11 @@ func TestRollout(t *testing.T) {
 	}
 
 	ks := &Store{clientset: client, namespace: "test-ns"}
+	objRefs := []store.ObjRef{
+		{APIVersion: "v1", Kind: "Namespace", Name: "foo", ResourceVersion: "1"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "foo", Name: "bar", ResourceVersion: "2"},
+	}
+	ctxs := map[string]string{"sha256:0123": `{"cluster":"dev"}`}
 
 	r, err := ks.CreateRollout()
 	if err != nil {
@@ -92,7 +102,7 @@ func TestRollout(t *testing.T) {
 	}
 	waitN(t, ch, 1)
 
-	_, err = ks.PutAddonRun(r.ID, &store.AddonRun{Name: "test-addon", Modules: map[string]string{"main.ipd": addonText}})
+	_, err = ks.PutAddonRun(r.ID, &store.AddonRun{Name: "test-addon", Version: "v1.0.0", Modules: map[string]string{"main.ipd": addonText}, ObjRefs: objRefs, Contexts: ctxs})
 	if err != nil {
 		t.Errorf("error creating run for rollout `%s': %v", r.ID, err)
 	}
@@ -102,4 +112,142 @@ func TestRollout(t *testing.T) {
 		t.Errorf("error completing rollout `%s': %v", r.ID, err)
 	}
 	waitN(t, ch, 1)
+
+	live, found, err := ks.GetLive()
+	if err != nil || !found {
+		t.Fatalf("error getting live rollout (found: %v): %v", found, err)
+	}
+	want := &store.Rollout{
+		ID:     r.ID,
+		Live:   true,
+		Addons: []*store.AddonRun{{Name: "test-addon", Version: "v1.0.0", Modules: map[string]string{"main.ipd": addonText}, ObjRefs: objRefs, Contexts: ctxs}},
+	}
+	if d := cmp.Diff(want, live); d != "" {
+		t.Errorf("Unexpected live rollout (-want +got):\n%s", d)
+	}
+
+	if _, found, err := ks.GetRollout("rollout-missing"); err != nil || found {
+		t.Errorf("expected missing rollout to not be found (found: %v): %v", found, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	cm := func(name string, age time.Duration, labels map[string]string) runtime.Object {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "test-ns",
+			CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			Labels:            labels,
+		}}
+	}
+	day := 24 * time.Hour
+	objs := []runtime.Object{
+		cm("rollout-old", 60*day, nil),
+		cm("ingress-run-old", 60*day, map[string]string{"addon": "ingress", "owner": "rollout-old"}),
+		cm("rollout-live-id", 40*day, nil),
+		cm("ingress-run-live", 40*day, map[string]string{"addon": "ingress", "owner": "rollout-live-id"}),
+		cm("rollout-new", day, nil),
+		cm("ingress-run-new", day, map[string]string{"addon": "ingress", "owner": "rollout-new"}),
+		cm("unrelated", 60*day, nil),
+	}
+	live := cm("rollout-live", 40*day, map[string]string{"rollout": "live"}).(*v1.ConfigMap)
+	live.Data = map[string]string{"rollout": "rollout-live-id"}
+	objs = append(objs, live)
+
+	r := store.Retention{MaxAge: 30 * day}
+	for _, dryRun := range []bool{true, false} {
+		client := fake.NewSimpleClientset(objs...)
+		ks := New(client, "test-ns")
+		ids, err := ks.Prune(r, dryRun)
+		if err != nil {
+			t.Fatalf("Prune(dryRun=%v) failed: %v", dryRun, err)
+		}
+		if d := cmp.Diff([]store.RolloutID{"rollout-old"}, ids); d != "" {
+			t.Errorf("Unexpected pruned rollouts with dryRun=%v (-want +got):\n%s", dryRun, d)
+		}
+
+		lst, err := client.CoreV1().ConfigMaps("test-ns").List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, cm := range lst.Items {
+			got = append(got, cm.Name)
+		}
+		sort.Strings(got)
+		want := []string{"ingress-run-live", "ingress-run-new", "rollout-live", "rollout-live-id", "rollout-new", "unrelated"}
+		if dryRun {
+			want = []string{"ingress-run-live", "ingress-run-new", "ingress-run-old", "rollout-live", "rollout-live-id", "rollout-new", "rollout-old", "unrelated"}
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Errorf("Unexpected configmaps left with dryRun=%v (-want +got):\n%s", dryRun, d)
+		}
+	}
+}
+
+// xorWrapper "wraps" DEKs by flipping their bits.
+type xorWrapper string
+
+func (w xorWrapper) URI() string { return string(w) }
+
+func (w xorWrapper) Wrap(_ context.Context, dek []byte) ([]byte, error) {
+	out := make([]byte, len(dek))
+	for i, b := range dek {
+		out[i] = ^b
+	}
+	return out, nil
+}
+
+func (w xorWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return w.Wrap(ctx, wrapped)
+}
+
+func TestEncryptedRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ks := New(client, "test-ns")
+	ks.SetKeyWrapper(xorWrapper("test://key"))
+
+	run := &store.AddonRun{
+		Name:     "test-addon",
+		Version:  "v1.0.0",
+		Modules:  map[string]string{"main.ipd": addonText},
+		Data:     map[string][]byte{"manifest": []byte("password: hunter2")},
+		ObjRefs:  []store.ObjRef{{APIVersion: "v1", Kind: "Secret", Namespace: "foo", Name: "bar"}},
+		Contexts: map[string]string{"sha256:0123": `{"cluster":"dev"}`},
+	}
+	r, err := ks.CreateRollout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ks.PutAddonRun(r.ID, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := client.CoreV1().ConfigMaps("test-ns").Get(context.Background(), string(id), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(map[string]string{"addon": "test-addon", "version": "v1.0.0"}, cm.Data); d != "" {
+		t.Errorf("Unexpected plaintext data of run (-want +got):\n%s", d)
+	}
+	for k, v := range cm.BinaryData {
+		if k != sealedKey || strings.Contains(string(v), "hunter2") || strings.Contains(string(v), "install") {
+			t.Errorf("Unexpected binary data of run: %s", k)
+		}
+	}
+
+	got, found, err := ks.GetRollout(r.ID)
+	if err != nil || !found {
+		t.Fatalf("error getting rollout (found: %v): %v", found, err)
+	}
+	if d := cmp.Diff([]*store.AddonRun{run}, got.Addons); d != "" {
+		t.Errorf("Unexpected decrypted runs (-want +got):\n%s", d)
+	}
+
+	wantErr := "run of addon `test-addon' is encrypted with `test://key' but no encryption key is set"
+	if _, _, err := New(client, "test-ns").GetRollout(r.ID); err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error without key.\nWant: %s\nGot: %v", wantErr, err)
+	}
 }
@@ -0,0 +1,42 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// ReadOnlyStore implements Store interface reading rollouts from Store and
+// failing all writes with isopod.ErrReadOnly.
+type ReadOnlyStore struct {
+	Store
+}
+
+// CreateRollout fails with isopod.ErrReadOnly.
+func (ReadOnlyStore) CreateRollout() (*Rollout, error) {
+	return nil, fmt.Errorf("cannot create rollout: %w", isopod.ErrReadOnly)
+}
+
+// PutAddonRun fails with isopod.ErrReadOnly.
+func (ReadOnlyStore) PutAddonRun(id RolloutID, _ *AddonRun) (RunID, error) {
+	return "", fmt.Errorf("cannot record addon run of rollout `%s': %w", id, isopod.ErrReadOnly)
+}
+
+// CompleteRollout fails with isopod.ErrReadOnly.
+func (ReadOnlyStore) CompleteRollout(id RolloutID) error {
+	return fmt.Errorf("cannot complete rollout `%s': %w", id, isopod.ErrReadOnly)
+}
@@ -16,6 +16,13 @@
 // of the addon rollouts.
 package store
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
 // RunID is id of an addon run.
 type RunID string
 
@@ -23,6 +30,9 @@ type RunID string
 type AddonRun struct {
 	// Name is a name of an addon associated with the run.
 	Name string
+	// Version is the version of the remote module the addon was loaded
+	// from (empty for local addons).
+	Version string
 	// Modules is map of all modules (each represents a single file)
 	// required to run an addon.
 	Modules map[string]string
@@ -30,11 +40,38 @@ type AddonRun struct {
 	// Data is opaque data passed in by addon during execution.
 	Data map[string][]byte
 
-	// ObjRefs is a slice of object references (could be external to
-	// Kubernetes objects) that were part of this run.
-	// TODO(dmitry-ilyevskiy): Make this into proper interface definition
-	// once the scope of operations is a little bit more defined.
-	ObjRefs []interface{}
+	// ObjRefs references Kubernetes objects applied by this run.
+	ObjRefs []ObjRef
+
+	// Contexts are addon contexts (JSON) objects applied by this run are
+	// only annotated with the hash of, keyed by the hash.
+	Contexts map[string]string
+}
+
+// ObjRef references a Kubernetes object applied by an addon run.
+type ObjRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Namespace is empty for cluster-scoped objects.
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// ResourceVersion of the object after it was applied (empty in dry
+	// run if the object didn't exist).
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// SameObject returns true if r and o reference the same object. API version
+// is ignored since the same object may be served by multiple API groups.
+func (r ObjRef) SameObject(o ObjRef) bool {
+	return r.Kind == o.Kind && r.Namespace == o.Namespace && r.Name == o.Name
+}
+
+// String implements fmt.Stringer.
+func (r ObjRef) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s.%s `%s'", strings.ToLower(r.Kind), r.APIVersion, r.Name)
+	}
+	return fmt.Sprintf("%s.%s `%s/%s'", strings.ToLower(r.Kind), r.APIVersion, r.Namespace, r.Name)
 }
 
 // RolloutID is a unique rollout ID string.
@@ -47,6 +84,8 @@ type Rollout struct {
 	ID     RolloutID
 	Addons []*AddonRun
 	Live   bool
+	// Created is the time the rollout was created (zero if unknown).
+	Created time.Time
 }
 
 // Store defines a rollout store interface.
@@ -68,3 +107,53 @@ type Store interface {
 	// GetRollout returns past or live rollout by id.
 	GetRollout(id RolloutID) (r *Rollout, found bool, err error)
 }
+
+// Retention selects rollouts kept when a store is pruned. A rollout is kept
+// if any of the set limits keeps it. The live rollout is always kept.
+type Retention struct {
+	// MaxAge keeps rollouts created within this long (0 if unset).
+	MaxAge time.Duration
+	// KeepLast keeps this many most recently created rollouts (0 if
+	// unset).
+	KeepLast int
+}
+
+// Enabled returns true if any limit of r is set.
+func (r Retention) Enabled() bool {
+	return r.MaxAge > 0 || r.KeepLast > 0
+}
+
+// Expired returns rollouts of rs not kept by r at time now, oldest first.
+// Rollouts with unknown creation time are only kept by KeepLast.
+func (r Retention) Expired(rs []*Rollout, now time.Time) []*Rollout {
+	if !r.Enabled() {
+		return nil
+	}
+	sorted := append([]*Rollout{}, rs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+	var expired []*Rollout
+	for i, ro := range sorted {
+		if ro.Live || (r.KeepLast > 0 && i < r.KeepLast) {
+			continue
+		}
+		if r.MaxAge > 0 && !ro.Created.IsZero() && now.Sub(ro.Created) < r.MaxAge {
+			continue
+		}
+		expired = append(expired, ro)
+	}
+	// Oldest first.
+	for i, j := 0, len(expired)-1; i < j; i, j = i+1, j-1 {
+		expired[i], expired[j] = expired[j], expired[i]
+	}
+	return expired
+}
+
+// Pruner is implemented by stores that can remove old rollouts.
+type Pruner interface {
+	// Prune removes rollouts (and their addon runs) not kept by r and
+	// returns their IDs. Only returns rollouts that would be removed if
+	// dryRun is set.
+	Prune(r Retention, dryRun bool) ([]RolloutID, error)
+}
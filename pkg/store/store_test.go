@@ -0,0 +1,73 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	rs := []*Rollout{
+		{ID: "rollout-3", Created: now.Add(-1 * day)},
+		{ID: "rollout-live", Created: now.Add(-40 * day), Live: true},
+		{ID: "rollout-1", Created: now.Add(-60 * day)},
+		{ID: "rollout-2", Created: now.Add(-31 * day)},
+		{ID: "rollout-unknown"},
+	}
+	for _, tc := range []struct {
+		name string
+		r    Retention
+		want []RolloutID
+	}{
+		{
+			name: "Disabled",
+		},
+		{
+			name: "Max age",
+			r:    Retention{MaxAge: 30 * day},
+			want: []RolloutID{"rollout-unknown", "rollout-1", "rollout-2"},
+		},
+		{
+			name: "Keep last",
+			r:    Retention{KeepLast: 1},
+			want: []RolloutID{"rollout-unknown", "rollout-1", "rollout-2"},
+		},
+		{
+			name: "Keep last counts live",
+			r:    Retention{KeepLast: 3},
+			want: []RolloutID{"rollout-unknown", "rollout-1"},
+		},
+		{
+			name: "Either keeps",
+			r:    Retention{MaxAge: 45 * day, KeepLast: 1},
+			want: []RolloutID{"rollout-unknown", "rollout-1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []RolloutID
+			for _, ro := range tc.r.Expired(rs, now) {
+				got = append(got, ro.ID)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected expired rollouts (-want +got):\n%s", d)
+			}
+		})
+	}
+}
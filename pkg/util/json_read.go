@@ -0,0 +1,97 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+
+	"go.starlark.net/starlark"
+)
+
+// ReadJSON unmarshals JSON blob to a mutable starlark value. Objects become
+// dicts (preserving key order) and integral numbers become ints.
+func ReadJSON(bs []byte) (starlark.Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	v, err := readJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+	return v, nil
+}
+
+func readJSONValue(dec *json.Decoder) (starlark.Value, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			d := &starlark.Dict{}
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := readJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				if err := d.SetKey(starlark.String(k.(string)), v); err != nil {
+					return nil, err
+				}
+			}
+			_, err := dec.Token() // Closing `}'.
+			return d, err
+		case '[':
+			var vs []starlark.Value
+			for dec.More() {
+				v, err := readJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				vs = append(vs, v)
+			}
+			_, err := dec.Token() // Closing `]'.
+			return starlark.NewList(vs), err
+		}
+	case string:
+		return starlark.String(t), nil
+	case bool:
+		return starlark.Bool(t), nil
+	case json.Number:
+		if i, ok := new(big.Int).SetString(string(t), 10); ok {
+			return starlark.MakeBigInt(i), nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case nil:
+		return starlark.None, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token `%v'", tok)
+}
@@ -16,7 +16,9 @@ package util
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ParseCommaSeparatedParams slipts params in the form of
@@ -35,3 +37,16 @@ func ParseCommaSeparatedParams(params string) (map[string]string, error) {
 	}
 	return parsed, nil
 }
+
+// ParseDuration parses a duration like time.ParseDuration that may also be in
+// days, e.g "30d".
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration `%s'", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
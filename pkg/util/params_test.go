@@ -18,6 +18,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	_ "github.com/golang/glog"
 )
@@ -61,3 +62,27 @@ func TestParseCommaSeparatedParams(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "30d", want: 30 * 24 * time.Hour},
+		{s: "1.5d", want: 36 * time.Hour},
+		{s: "12h", want: 12 * time.Hour},
+		{s: "-1d", wantErr: true},
+		{s: "xd", wantErr: true},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			got, err := ParseDuration(tc.s)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expect error %v, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("Expect %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Touch marks path (e.g a cached file or checkout) as used now so that
+// cleanups removing paths not used for a while keep it. Failures are only
+// logged.
+func Touch(path string) {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Warningf("Failed to mark `%s' as used: %v", path, err)
+	}
+}
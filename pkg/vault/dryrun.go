@@ -0,0 +1,83 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	vaultapi "github.com/hashicorp/vault/api"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+// DryRunMode is how the vault module behaves in dry run.
+type DryRunMode string
+
+const (
+	// DryRunFake never calls Vault: reads return fake values for every
+	// path and writes return fake results.
+	DryRunFake DryRunMode = "fake"
+	// DryRunReadOnly reads from Vault but fakes writes (including PKI
+	// issuing and wrapping, which create state in Vault).
+	DryRunReadOnly DryRunMode = "readonly"
+	// DryRunReal calls Vault as outside of dry run (writes included).
+	DryRunReal DryRunMode = "real"
+)
+
+// writeMethods are methods of the vault module that mutate Vault state.
+var writeMethods = []string{"write", "pki_issue", "wrap", "unwrap"}
+
+// ParseDryRunMode parses --dry_run_vault flag value.
+func ParseDryRunMode(s string) (DryRunMode, error) {
+	switch m := DryRunMode(s); m {
+	case DryRunFake, DryRunReadOnly, DryRunReal:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown vault dry run mode `%s' (want one of %s, %s, %s)", s, DryRunFake, DryRunReadOnly, DryRunReal)
+}
+
+// NewDryRun returns a new vault module for dry run in mode. c is the real
+// Vault client (unused by DryRunFake).
+func NewDryRun(c *vaultapi.Client, mode DryRunMode) (*isopod.Module, error) {
+	switch mode {
+	case DryRunFake:
+		return newFakeModule(&fakeVault{m: map[string]string{}}), nil
+	case DryRunReadOnly:
+		fake := newFakeModule(&fakeVault{m: map[string]string{}, realClient: c})
+		m := New(c)
+		for _, name := range writeMethods {
+			m.Attrs[name] = fake.Attrs[name]
+		}
+		return m, nil
+	case DryRunReal:
+		log.Warningf("Vault writes are not faked in dry run (--dry_run_vault=%s)", mode)
+		return New(c), nil
+	}
+	return nil, fmt.Errorf("unknown vault dry run mode `%s'", mode)
+}
+
+// ReadOnly returns vault module m with methods mutating Vault state failing
+// with isopod.ErrReadOnly.
+func ReadOnly(m *isopod.Module) *isopod.Module {
+	return isopod.ReadOnly(m, writeMethods...)
+}
+
+// newFakeModule returns vault module of fake.
+func newFakeModule(fake *fakeVault) *isopod.Module {
+	// NewFakeModule never fails.
+	_, _ = NewFakeModule(fake)
+	return fake.Module
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	vault "github.com/hashicorp/vault/api"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// RetryPolicy configures retries of Vault requests failed with transient
+// errors: connection errors, timeouts, 429 and 5xx (other than 501)
+// responses.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries of a request (0 disables
+	// retries).
+	MaxRetries int
+	// MinWait and MaxWait bound the exponential backoff between retries,
+	// which is jittered so that concurrent Isopod runs don't retry in
+	// lockstep. Retry-After of 429 responses is honored up to MaxWait.
+	MinWait, MaxWait time.Duration
+	// Timeout of each attempt of a request (0 for none).
+	Timeout time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of Vault clients created by Isopod.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	MinWait:    500 * time.Millisecond,
+	MaxWait:    10 * time.Second,
+	Timeout:    30 * time.Second,
+}
+
+// Configure sets retries and timeouts of Vault client config c to p. The
+// overall timeout of a request (c.Timeout, e.g from $VAULT_CLIENT_TIMEOUT)
+// is raised to fit all attempts and waits between them.
+func (p RetryPolicy) Configure(c *vault.Config) {
+	c.MaxRetries = p.MaxRetries
+	c.MinRetryWait, c.MaxRetryWait = p.MinWait, p.MaxWait
+	c.Backoff = jitterBackoff
+	c.CheckRetry = vault.DefaultRetryPolicy
+	if c.HttpClient != nil {
+		c.HttpClient.Timeout = p.Timeout
+	}
+	if p.Timeout == 0 {
+		c.Timeout = 0
+	} else if t := time.Duration(p.MaxRetries+1)*p.Timeout + time.Duration(p.MaxRetries)*p.MaxWait; c.Timeout != 0 && c.Timeout < t {
+		c.Timeout = t
+	}
+}
+
+// jitterBackoff returns a random duration up to min*2^attempt capped at max
+// ("full jitter"), or Retry-After of a 429 response capped at max.
+func jitterBackoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d < max {
+				return d
+			}
+			return max
+		}
+	}
+	d := max
+	if attempt < 32 && min<<uint(attempt) > 0 && min<<uint(attempt) < max {
+		d = min << uint(attempt)
+	}
+	if d <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(d-min)))
+}
+
+// Breaker fails Vault requests fast once Vault looks unavailable: after
+// Threshold consecutive requests failed with transient errors (after
+// retries), requests fail with *UnavailableError without being sent for
+// CoolDown, after which a single request probes Vault again.
+type Breaker struct {
+	// Threshold is the number of consecutive failed requests that open the
+	// breaker (0 disables it).
+	Threshold int
+	// CoolDown is how long requests fail fast once the breaker opens.
+	CoolDown time.Duration
+
+	mu sync.Mutex
+	// failures is the number of consecutive failed requests.
+	failures int
+	// openUntil is when the open breaker lets a request through.
+	openUntil time.Time
+	// opened is set once the breaker opened.
+	opened  bool
+	lastErr error
+	// affected are addons whose requests failed while Vault was
+	// unavailable.
+	affected map[string]bool
+	now      func() time.Time
+}
+
+// DefaultBreaker is the Breaker of vault modules and secret reference
+// resolvers of all clusters, so that an unavailable Vault is reported once.
+var DefaultBreaker = &Breaker{Threshold: 5, CoolDown: 30 * time.Second}
+
+// UnavailableError is returned by requests rejected by an open Breaker.
+type UnavailableError struct {
+	// Addons are names of addons whose requests failed while Vault was
+	// unavailable (sorted).
+	Addons []string
+	// Err is the error of the last failed request.
+	Err error
+}
+
+// Error implements error.
+func (e *UnavailableError) Error() string {
+	msg := "Vault unavailable"
+	if len(e.Addons) > 0 {
+		msg += fmt.Sprintf(" (affected addons: %s)", strings.Join(e.Addons, ", "))
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// Unwrap returns the error of the last failed request.
+func (e *UnavailableError) Unwrap() error { return e.Err }
+
+// Do sends request r with c unless the breaker is open.
+func (b *Breaker) Do(ctx context.Context, c *vault.Client, r *vault.Request) (*vault.Response, error) {
+	name := addon.NameFromContext(ctx)
+	if err := b.allow(name); err != nil {
+		return nil, err
+	}
+	resp, err := c.RawRequestWithContext(ctx, r)
+	b.record(name, transient(ctx, resp, err), err)
+	return resp, err
+}
+
+// transient returns true if a request failed with resp and err because Vault
+// is unavailable rather than because of the request.
+func transient(ctx context.Context, resp *vault.Response, err error) bool {
+	if resp == nil || resp.Response == nil {
+		return err != nil && ctx.Err() == nil
+	}
+	code := resp.StatusCode
+	return code == http.StatusTooManyRequests || (code >= 500 && code != http.StatusNotImplemented)
+}
+
+func (b *Breaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// allow returns *UnavailableError if the breaker is open (recording addon
+// name as affected).
+func (b *Breaker) allow(name string) error {
+	if b == nil || b.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return nil
+	}
+	if now := b.clock(); !now.Before(b.openUntil) {
+		// Let this request probe Vault while failing others fast.
+		b.openUntil = now.Add(b.CoolDown)
+		return nil
+	}
+	b.addAffected(name)
+	return b.unavailable()
+}
+
+// record records result of a request of addon name.
+func (b *Breaker) record(name string, failed bool, err error) {
+	if b == nil || b.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.failures >= b.Threshold {
+			log.Infof("Vault is available again")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	b.addAffected(name)
+	if b.failures == b.Threshold {
+		b.opened = true
+		b.openUntil = b.clock().Add(b.CoolDown)
+		log.Errorf("Vault requests fail fast for %v after %d consecutive failures: %v", b.CoolDown, b.failures, err)
+	}
+}
+
+func (b *Breaker) addAffected(name string) {
+	if name == "" {
+		return
+	}
+	if b.affected == nil {
+		b.affected = map[string]bool{}
+	}
+	b.affected[name] = true
+}
+
+// unavailable returns *UnavailableError of the current state. Must be called
+// with b.mu held.
+func (b *Breaker) unavailable() *UnavailableError {
+	e := &UnavailableError{Err: b.lastErr}
+	for name := range b.affected {
+		e.Addons = append(e.Addons, name)
+	}
+	sort.Strings(e.Addons)
+	return e
+}
+
+// Err returns *UnavailableError naming all affected addons if the breaker
+// opened (nil otherwise).
+func (b *Breaker) Err() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.opened {
+		return nil
+	}
+	return b.unavailable()
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vaultapi "github.com/hashicorp/vault/api"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// newTestClient returns a Vault client of server s retrying with p.
+func newTestClient(t *testing.T, s *httptest.Server, p RetryPolicy) *vaultapi.Client {
+	conf := vaultapi.DefaultConfig()
+	conf.Address = s.URL
+	p.Configure(conf)
+	c, err := vaultapi.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken("token")
+	return c
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 2, MinWait: time.Millisecond, MaxWait: 5 * time.Millisecond, Timeout: time.Second}
+	for _, tc := range []struct {
+		name string
+		// codes are response codes of consecutive attempts (200 after).
+		codes     []int
+		wantCode  int
+		wantCalls int32
+	}{
+		{name: "ok", wantCode: 200, wantCalls: 1},
+		{name: "unavailable", codes: []int{503, 502}, wantCode: 200, wantCalls: 3},
+		{name: "throttled", codes: []int{429}, wantCode: 200, wantCalls: 2},
+		{name: "retries exhausted", codes: []int{503, 503, 503}, wantCode: 503, wantCalls: 3},
+		{name: "not retried", codes: []int{403}, wantCode: 403, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(atomic.AddInt32(&calls, 1)) - 1
+				if i < len(tc.codes) {
+					w.Header().Set("Retry-After", "0")
+					http.Error(w, `{"errors": ["try again"]}`, tc.codes[i])
+					return
+				}
+				w.Write([]byte(`{"data": {}}`))
+			}))
+			defer s.Close()
+			c := newTestClient(t, s, p)
+
+			resp, _ := c.RawRequestWithContext(context.Background(), c.NewRequest("GET", "/v1/secret/foo"))
+			if resp == nil || resp.StatusCode != tc.wantCode {
+				t.Errorf("Expected status %d, got %v", tc.wantCode, resp)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("Expected %d requests, got %d", tc.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestJitterBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, time.Second
+	for attempt := 0; attempt < 40; attempt++ {
+		if d := jitterBackoff(min, max, attempt, nil); d < min || d > max {
+			t.Errorf("Backoff of attempt %d out of [%v, %v]: %v", attempt, min, max, d)
+		}
+	}
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"3600"}}}
+	if d := jitterBackoff(min, max, 0, resp); d != max {
+		t.Errorf("Expected Retry-After capped at %v, got %v", max, d)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var calls int32
+	var down atomic.Value
+	down.Store(true)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if down.Load().(bool) {
+			http.Error(w, `{"errors": ["sealed"]}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data": {}}`))
+	}))
+	defer s.Close()
+	c := newTestClient(t, s, RetryPolicy{})
+
+	now := time.Unix(0, 0)
+	b := &Breaker{Threshold: 2, CoolDown: time.Minute, now: func() time.Time { return now }}
+	do := func(name string) error {
+		ctx := addon.ContextWithName(context.Background(), name)
+		_, err := b.Do(ctx, c, c.NewRequest("GET", "/v1/secret/"+name))
+		return err
+	}
+
+	for _, name := range []string{"ingress", "dns"} {
+		if err := do(name); err == nil {
+			t.Fatalf("Expected request of %s to fail", name)
+		}
+	}
+	if err := b.Err(); err == nil {
+		t.Fatal("Expected breaker to open")
+	}
+
+	err := do("logging")
+	var uErr *UnavailableError
+	if !errors.As(err, &uErr) {
+		t.Fatalf("Expected *UnavailableError, got %v", err)
+	}
+	if d := cmp.Diff([]string{"dns", "ingress", "logging"}, uErr.Addons); d != "" {
+		t.Errorf("Unexpected affected addons (-want +got):\n%s", d)
+	}
+	if calls != 2 {
+		t.Errorf("Expected open breaker not to send requests, got %d requests", calls)
+	}
+
+	// Vault is probed again after cool down.
+	down.Store(false)
+	now = now.Add(time.Minute)
+	if err := do("logging"); err != nil {
+		t.Fatalf("Expected probe to succeed, got %v", err)
+	}
+	if err := do("ingress"); err != nil {
+		t.Fatalf("Expected closed breaker to send requests, got %v", err)
+	}
+
+	// Outage is still reported once the run is over.
+	want := "Vault unavailable (affected addons: dns, ingress, logging): "
+	if err := b.Err(); err == nil || err.Error()[:len(want)] != want {
+		t.Errorf("Expected error prefixed with %q, got %v", want, err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	vault "github.com/hashicorp/vault/api"
+
+	"github.com/cruise-automation/isopod/pkg/secretref"
+)
+
+// RefResolver resolves secretref.VaultBackend references.
+type RefResolver struct {
+	client  *vault.Client
+	breaker *Breaker
+}
+
+// NewRefResolver returns a new *RefResolver reading secrets with c.
+func NewRefResolver(c *vault.Client) *RefResolver {
+	return &RefResolver{client: c, breaker: DefaultBreaker}
+}
+
+// Resolve implements secretref.Resolver.Resolve. Both KV v1 and v2 (data
+// nested under `data' key) secrets are supported.
+func (r *RefResolver) Resolve(ctx context.Context, ref *secretref.Ref) (string, error) {
+	if ref.Backend != secretref.VaultBackend {
+		return "", fmt.Errorf("unsupported backend `%s'", ref.Backend)
+	}
+	if r.client.Token() == "" {
+		return "", ErrNoToken
+	}
+
+	req := r.client.NewRequest("GET", "/v1/"+ref.Path)
+	resp, err := r.breaker.Do(ctx, r.client, req)
+	if resp != nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return "", fmt.Errorf("secret `%s' not found", ref.Path)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s, err := vault.ParseSecret(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse secret data: %v", err)
+	}
+	if s == nil {
+		return "", fmt.Errorf("secret `%s' not found", ref.Path)
+	}
+
+	v, ok := s.Data[ref.Key]
+	if !ok {
+		if nested, isMap := s.Data["data"].(map[string]interface{}); isMap {
+			v, ok = nested[ref.Key]
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("key `%s' not found", ref.Key)
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("value of key `%s' is not a string", ref.Key)
+	}
+	return str, nil
+}
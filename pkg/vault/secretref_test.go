@@ -0,0 +1,70 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+
+	"github.com/cruise-automation/isopod/pkg/secretref"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestRefResolver(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/v1":
+			w.Write([]byte(`{"data": {"password": "kv1-password"}}`))
+		case "/v1/secret/data/v2":
+			w.Write([]byte(`{"data": {"data": {"password": "kv2-password"}, "metadata": {}}}`))
+		default:
+			http.Error(w, `{"errors": []}`, http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c, err := vaultapi.NewClient(&vaultapi.Config{Address: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken("token")
+	res := NewRefResolver(c)
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{name: "kv v1", path: "secret/v1", want: "kv1-password"},
+		{name: "kv v2", path: "secret/data/v2", want: "kv2-password"},
+		{name: "not found", path: "secret/missing", wantErr: errors.New("secret `secret/missing' not found")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := res.Resolve(context.Background(), &secretref.Ref{Backend: secretref.VaultBackend, Path: tc.path, Key: "password"})
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
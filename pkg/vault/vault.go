@@ -28,6 +28,7 @@ import (
 
 	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
 	"github.com/cruise-automation/isopod/pkg/util"
 )
 
@@ -39,20 +40,28 @@ var (
 type vaultPackage struct {
 	*isopod.Module
 	client *vault.Client
+	// breaker fails requests fast while Vault is unavailable.
+	breaker *Breaker
 }
 
 // New returns a new skaylark.HasAttrs object for vault package.
 func New(c *vault.Client) *isopod.Module {
 	v := &vaultPackage{
-		client: c,
+		client:  c,
+		breaker: DefaultBreaker,
 	}
 	v.Module = &isopod.Module{
 		Name: "vault",
 		Attrs: starlark.StringDict{
-			"read":     starlark.NewBuiltin("vault.read", v.vaultReadFn),
-			"read_raw": starlark.NewBuiltin("vault.read_raw", v.vaultReadRawFn),
-			"write":    starlark.NewBuiltin("vault.write", v.vaultWriteFn),
-			"exist":    starlark.NewBuiltin("vault.exist", v.vaultExistFn),
+			"read":               starlark.NewBuiltin("vault.read", v.vaultReadFn),
+			"read_raw":           starlark.NewBuiltin("vault.read_raw", v.vaultReadRawFn),
+			"write":              starlark.NewBuiltin("vault.write", v.vaultWriteFn),
+			"exist":              starlark.NewBuiltin("vault.exist", v.vaultExistFn),
+			"pki_issue":          starlark.NewBuiltin("vault.pki_issue", v.vaultPKIIssueFn),
+			"pki_ca":             starlark.NewBuiltin("vault.pki_ca", v.vaultPKICAFn),
+			"wrap":               starlark.NewBuiltin("vault.wrap", v.vaultWrapFn),
+			"unwrap":             starlark.NewBuiltin("vault.unwrap", v.vaultUnwrapFn),
+			"token_capabilities": starlark.NewBuiltin("vault.token_capabilities", v.vaultTokenCapabilitiesFn),
 		},
 	}
 	return v.Module
@@ -77,7 +86,7 @@ func (p *vaultPackage) vaultReadFn(t *starlark.Thread, b *starlark.Builtin, args
 	r := p.client.NewRequest("GET", "/v1/"+path)
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	resp, err := p.client.RawRequestWithContext(ctx, r)
+	resp, err := p.breaker.Do(ctx, p.client, r)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
 	}
@@ -97,6 +106,7 @@ func (p *vaultPackage) vaultReadFn(t *starlark.Thread, b *starlark.Builtin, args
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse data: %v", b.Name(), err)
 	}
+	redact.AddValue(v)
 	return v, nil
 }
 
@@ -119,7 +129,7 @@ func (p *vaultPackage) vaultReadRawFn(t *starlark.Thread, b *starlark.Builtin, a
 	r := p.client.NewRequest("GET", "/v1/"+path)
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	resp, err := p.client.RawRequestWithContext(ctx, r)
+	resp, err := p.breaker.Do(ctx, p.client, r)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
 	}
@@ -137,6 +147,7 @@ func (p *vaultPackage) vaultReadRawFn(t *starlark.Thread, b *starlark.Builtin, a
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse data: %v", b.Name(), err)
 	}
+	redact.AddValue(v)
 	return v, nil
 }
 
@@ -158,6 +169,7 @@ func (p *vaultPackage) vaultWriteFn(t *starlark.Thread, b *starlark.Builtin, arg
 
 	data := make(map[string]interface{}, len(kwargs))
 	for _, kv := range kwargs {
+		redact.AddValue(kv[1])
 		switch value := kv[1].(type) {
 		case starlark.String:
 			data[string(kv[0].(starlark.String))] = string(value)
@@ -182,7 +194,7 @@ func (p *vaultPackage) vaultWriteFn(t *starlark.Thread, b *starlark.Builtin, arg
 	}
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	resp, err := p.client.RawRequestWithContext(ctx, r)
+	resp, err := p.breaker.Do(ctx, p.client, r)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
 	}
@@ -200,6 +212,7 @@ func (p *vaultPackage) vaultWriteFn(t *starlark.Thread, b *starlark.Builtin, arg
 	if err != nil {
 		return starlark.None, nil
 	}
+	redact.AddValue(v)
 	return v, nil
 }
 
@@ -224,8 +237,8 @@ func (p *vaultPackage) vaultExistFn(t *starlark.Thread, b *starlark.Builtin, arg
 	r := p.client.NewRequest("GET", "/v1/"+path)
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	resp, err := p.client.RawRequestWithContext(ctx, r)
-	if resp.StatusCode == http.StatusNotFound {
+	resp, err := p.breaker.Do(ctx, p.client, r)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
 		return starlark.False, nil
 	}
 	if err != nil {
@@ -263,6 +276,7 @@ func ReadVaultPath(path string) (string, error) {
 		return "", fmt.Errorf("vault secret contains no value")
 	}
 
-	data := secret.Data["value"]
-	return fmt.Sprint(data), nil
+	data := fmt.Sprint(secret.Data["value"])
+	redact.Add(data)
+	return data, nil
 }
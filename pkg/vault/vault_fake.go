@@ -34,6 +34,8 @@ import (
 
 type fakeVault struct {
 	*isopod.Module
+	// realClient is used for read-only calls (nil if the fake is
+	// hermetic).
 	realClient *vaultapi.Client
 	m          map[string]string
 }
@@ -53,6 +55,9 @@ func (fvlt *fakeVault) vaultFakeReadFn(t *starlark.Thread, b *starlark.Builtin,
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &path); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
 	}
+	if fvlt.realClient == nil {
+		return &fakeValues{}, nil
+	}
 
 	if strings.HasPrefix(path, "sys") || strings.HasPrefix(path, "auth") {
 		_, err := fvlt.realClient.Logical().Read(path)
@@ -162,6 +167,10 @@ func (fvlt *fakeVault) vaultFakeExistFn(t *starlark.Thread, b *starlark.Builtin,
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &path); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
 	}
+	// Hermetic fake has every secret (consistent with vault.read).
+	if fvlt.realClient == nil {
+		return starlark.True, nil
+	}
 
 	if strings.HasPrefix(path, "sys") || strings.HasPrefix(path, "auth") {
 		_, err := fvlt.realClient.Logical().Read(path)
@@ -192,7 +201,7 @@ func (fvlt *fakeVault) vaultFakeExistFn(t *starlark.Thread, b *starlark.Builtin,
 
 // assertToken ensures that vault is only accessed if a token is set
 func (fvlt *fakeVault) assertToken() (err error) {
-	if fvlt.realClient.Token() == "" {
+	if fvlt.realClient != nil && fvlt.realClient.Token() == "" {
 		return ErrNoToken
 	}
 	return
@@ -201,6 +210,14 @@ func (fvlt *fakeVault) assertToken() (err error) {
 func (fvlt *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
+		// PKI CA endpoint returns raw PEM.
+		if strings.HasSuffix(r.URL.Path, "/ca/pem") {
+			if _, err := w.Write([]byte(fakeCertPEM)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
 		v, ok := fvlt.m[r.URL.Path]
 		if !ok {
 			// Fall back to real Vault client if fake key does not exist.
@@ -260,6 +277,46 @@ func (fvlt *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		fvlt.m[r.URL.Path] = string(bs)
+	case http.MethodPost:
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var resp string
+		switch r.URL.Path {
+		case "/v1/sys/wrapping/wrap":
+			token := fmt.Sprintf("s.wrapped-%d", len(fvlt.m))
+			fvlt.m["wrapped/"+token] = string(bs)
+			resp = fmt.Sprintf(`{"wrap_info":{"token":%q,"ttl":300}}`, token)
+		case "/v1/sys/wrapping/unwrap":
+			var req struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(bs, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Wrapping tokens are single use.
+			v, ok := fvlt.m["wrapped/"+req.Token]
+			if !ok {
+				http.Error(w, `{"errors":["wrapping token is not valid or does not exist"]}`, http.StatusBadRequest)
+				return
+			}
+			delete(fvlt.m, "wrapped/"+req.Token)
+			resp = fmt.Sprintf(`{"data": %s}`, v)
+		case "/v1/sys/capabilities-self":
+			resp = `{"data":{"capabilities":["read","list"]}}`
+		default:
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+
+		if _, err := w.Write([]byte(resp)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	default:
 		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
 	}
@@ -270,35 +327,20 @@ func NewFakeModule(fakeVault *fakeVault) (m starlark.HasAttrs, err error) {
 	fakeVault.Module = &isopod.Module{
 		Name: "vault",
 		Attrs: starlark.StringDict{
-			"read":     starlark.NewBuiltin("vault.read", fakeVault.vaultFakeReadFn),
-			"read_raw": starlark.NewBuiltin("vault.read_raw", fakeVault.vaultFakeReadRawFn),
-			"write":    starlark.NewBuiltin("vault.write", fakeVault.vaultFakeWriteFn),
-			"exist":    starlark.NewBuiltin("vault.exist", fakeVault.vaultFakeExistFn),
+			"read":               starlark.NewBuiltin("vault.read", fakeVault.vaultFakeReadFn),
+			"read_raw":           starlark.NewBuiltin("vault.read_raw", fakeVault.vaultFakeReadRawFn),
+			"write":              starlark.NewBuiltin("vault.write", fakeVault.vaultFakeWriteFn),
+			"exist":              starlark.NewBuiltin("vault.exist", fakeVault.vaultFakeExistFn),
+			"pki_issue":          starlark.NewBuiltin("vault.pki_issue", fakeVault.vaultFakePKIIssueFn),
+			"pki_ca":             starlark.NewBuiltin("vault.pki_ca", fakeVault.vaultFakePKICAFn),
+			"wrap":               starlark.NewBuiltin("vault.wrap", fakeVault.vaultFakeWrapFn),
+			"unwrap":             starlark.NewBuiltin("vault.unwrap", fakeVault.vaultFakeUnwrapFn),
+			"token_capabilities": starlark.NewBuiltin("vault.token_capabilities", fakeVault.vaultFakeTokenCapabilitiesFn),
 		},
 	}
 	return fakeVault.Module, nil
 }
 
-// NewDryRunFake returns a new fake vault module for dry run.
-func NewDryRunFake() (m starlark.HasAttrs, closeFn func(), err error) {
-	// Create a real Vault client for read fall back if key does not exist.
-	vaultC, err := vaultapi.NewClient(&vaultapi.Config{
-		Address: os.Getenv("VAULT_ADDR"),
-	})
-	if err != nil {
-		return nil, func() {}, fmt.Errorf("failed to initialize Vault client: %v", err)
-	}
-
-	vaultC.SetToken(os.Getenv("VAULT_TOKEN"))
-	fakeVaultObj := &fakeVault{m: make(map[string]string), realClient: vaultC}
-	module, err := NewFakeModule(fakeVaultObj)
-	if err != nil {
-		return nil, func() {}, fmt.Errorf("failed to initialize Fake vault module: %v", err)
-	}
-
-	return module, func() {}, nil
-}
-
 // NewFake returns a new fake vault module for testing.
 func NewFake() (m starlark.HasAttrs, closeFn func(), err error) {
 	// Create a real Vault client for read fall back if key does not exist.
@@ -15,7 +15,9 @@
 package vault
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
 
 	vaultapi "github.com/hashicorp/vault/api"
@@ -68,54 +70,35 @@ func TestVault(t *testing.T) {
 			expr:       "vault.read('foo/bar2')",
 			wantResult: `map["a":["1", "2"] "b":"2"]`,
 		},
-	} {
-		t.Run(tc.desc, func(t *testing.T) {
-			pkgs := starlark.StringDict{"vault": tv}
-			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
-
-			gotErr := ""
-			if err != nil {
-				gotErr = err.Error()
-			}
-			if tc.wantErr != gotErr {
-				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
-			}
-
-			if tc.wantResult != v.String() {
-				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, v.String())
-			}
-
-		})
-	}
-}
-
-func TestDryRunVault(t *testing.T) {
-	tv, _, err := NewDryRunFake()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	for _, tc := range []struct {
-		desc string
-		expr string
-
-		wantResult string
-		wantErr    string
-	}{
 		{
-			desc:       "Write value to `foo/bar'",
-			expr:       "vault.write('secret/foo/bar', a='1', b='2')",
-			wantResult: `map["a":"1" "b":"2"]`,
+			desc:       "Issue PKI certificate",
+			expr:       "vault.pki_issue(mount='pki', role='webhook', common_name='webhook.example.svc', sans=['webhook', '10.0.0.1'], ttl='24h').ca_chain",
+			wantResult: `["ca0", "ca1"]`,
 		},
 		{
-			desc:       "`foo/bar' Exists",
-			expr:       "vault.exist('secret/foo/test-secret')",
-			wantResult: "True",
+			desc:    "Issue PKI certificate with bad SANs",
+			expr:    "vault.pki_issue(mount='pki', role='webhook', common_name='webhook.example.svc', sans=[1])",
+			wantErr: "<vault.pki_issue>: `sans' must be a list of strings (got a `int')",
 		},
 		{
-			desc:       "Read data from `foo/bar'",
-			expr:       "vault.read('secret/foo/test-secret')",
-			wantResult: `map["value":"fake"]`,
+			desc:       "Read PKI CA",
+			expr:       "vault.pki_ca(mount='pki')",
+			wantResult: fmt.Sprintf("%q", fakeCertPEM),
+		},
+		{
+			desc:       "Wrap and unwrap data",
+			expr:       "vault.unwrap(vault.wrap({'password': 'hunter2'}, ttl='1m'))",
+			wantResult: `map["password":"hunter2"]`,
+		},
+		{
+			desc:       "Check token capabilities",
+			expr:       "vault.token_capabilities('secret/data/app', require=['read'])",
+			wantResult: `["read", "list"]`,
+		},
+		{
+			desc:    "Token lacks required capabilities",
+			expr:    "vault.token_capabilities('secret/data/app', require=['read', 'update', 'delete'])",
+			wantErr: "<vault.token_capabilities>: token lacks `update, delete' capabilities on `secret/data/app' (has: read, list)",
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -130,6 +113,10 @@ func TestDryRunVault(t *testing.T) {
 				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
 			}
 
+			if tc.wantErr != "" {
+				return
+			}
+
 			if tc.wantResult != v.String() {
 				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, v.String())
 			}
@@ -138,6 +125,19 @@ func TestDryRunVault(t *testing.T) {
 	}
 }
 
+func TestRequestData(t *testing.T) {
+	a := &pkiIssueArgs{commonName: "webhook.example.svc", sans: []string{"webhook", "10.0.0.1", "webhook.example"}, ttl: "24h"}
+	want := map[string]interface{}{
+		"common_name": "webhook.example.svc",
+		"alt_names":   "webhook,webhook.example",
+		"ip_sans":     "10.0.0.1",
+		"ttl":         "24h",
+	}
+	if got := a.requestData(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected request data.\nWant: %v\nGot: %v", want, got)
+	}
+}
+
 func TestVaultPackage_AssertToken(t *testing.T) {
 	_ = os.Setenv("VAULT_TOKEN", "")
 	c, _ := vaultapi.NewClient(nil)
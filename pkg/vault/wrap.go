@@ -0,0 +1,266 @@
+// Copyright 2021 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/modules"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+const (
+	defaultWrapTTL = "5m"
+	// fakeWrapToken is returned by `vault.wrap' in dry run.
+	fakeWrapToken = "s.fake-wrapping-token"
+)
+
+// vaultWrapFn is a starlark built-in function that response-wraps data so it
+// can be handed to a workload that unwraps it exactly once.
+// Returns the wrapping token.
+// Usage:
+//
+//	token = vault.wrap({"password": pw}, ttl="10m")
+func (p *vaultPackage) vaultWrapFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := p.assertToken(); err != nil {
+		return nil, err
+	}
+	data, ttl, err := unpackWrapArgs(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	r := p.client.NewRequest("POST", "/v1/sys/wrapping/wrap")
+	r.WrapTTL = ttl
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to set request body: %v", b.Name(), err)
+	}
+
+	s, err := p.do(t, r)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
+	}
+	if s == nil || s.WrapInfo == nil {
+		return nil, fmt.Errorf("<%v>: response is not wrapped", b.Name())
+	}
+	redact.Add(s.WrapInfo.Token)
+	return starlark.String(s.WrapInfo.Token), nil
+}
+
+// vaultUnwrapFn is a starlark built-in function that unwraps data wrapped
+// with `vault.wrap' (or any other response-wrapping token).
+// Usage:
+//
+//	data = vault.unwrap(token)
+//	print(data["password"])
+func (p *vaultPackage) vaultUnwrapFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := p.assertToken(); err != nil {
+		return nil, err
+	}
+	var token string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "token", &token); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	r := p.client.NewRequest("POST", "/v1/sys/wrapping/unwrap")
+	if err := r.SetJSONBody(map[string]interface{}{"token": token}); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to set request body: %v", b.Name(), err)
+	}
+
+	s, err := p.do(t, r)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
+	}
+	if s == nil {
+		return starlark.None, nil
+	}
+
+	v, err := util.ValueFromNestedMap(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse data: %v", b.Name(), err)
+	}
+	redact.AddValue(v)
+	return v, nil
+}
+
+// vaultTokenCapabilitiesFn is a starlark built-in function that returns
+// capabilities of the current token on path. If `require' is set, fails
+// unless the token has all of the listed capabilities (`root' implies all).
+// Usage:
+//
+//	vault.token_capabilities("secret/data/app", require=["read", "update"])
+func (p *vaultPackage) vaultTokenCapabilitiesFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := p.assertToken(); err != nil {
+		return nil, err
+	}
+	path, require, err := unpackCapabilitiesArgs(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	r := p.client.NewRequest("POST", "/v1/sys/capabilities-self")
+	if err := r.SetJSONBody(map[string]interface{}{"paths": []string{path}}); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to set request body: %v", b.Name(), err)
+	}
+
+	s, err := p.do(t, r)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("<%v>: empty response", b.Name())
+	}
+
+	// Newer Vault versions key capabilities by path, older only return
+	// `capabilities'.
+	raw, ok := s.Data[path]
+	if !ok {
+		raw = s.Data["capabilities"]
+	}
+	var caps []string
+	if rs, ok := raw.([]interface{}); ok {
+		for _, c := range rs {
+			if s, ok := c.(string); ok {
+				caps = append(caps, s)
+			}
+		}
+	}
+
+	if err := checkCapabilities(path, caps, require); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	vs := make([]starlark.Value, len(caps))
+	for i, c := range caps {
+		vs[i] = starlark.String(c)
+	}
+	return starlark.NewList(vs), nil
+}
+
+// do sends request r and parses response secret (may be nil).
+func (p *vaultPackage) do(t *starlark.Thread, r *vault.Request) (*vault.Secret, error) {
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	resp, err := p.breaker.Do(ctx, p.client, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := resp.Error(); err != nil {
+		return nil, err
+	}
+	return vault.ParseSecret(resp.Body)
+}
+
+func unpackWrapArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (map[string]interface{}, string, error) {
+	var d *starlark.Dict
+	ttl := defaultWrapTTL
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "data", &d, "ttl?", &ttl); err != nil {
+		return nil, "", fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	redact.AddValue(d)
+
+	buf := &bytes.Buffer{}
+	if err := modules.WriteJSON(buf, d); err != nil {
+		return nil, "", fmt.Errorf("<%v>: failed to marshal data: %v", b.Name(), err)
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &data); err != nil {
+		return nil, "", fmt.Errorf("<%v>: failed to marshal data: %v", b.Name(), err)
+	}
+	return data, ttl, nil
+}
+
+func unpackCapabilitiesArgs(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (string, []string, error) {
+	var path string
+	require := &starlark.List{}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "require?", &require); err != nil {
+		return "", nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	var ret []string
+	for i := 0; i < require.Len(); i++ {
+		s, ok := require.Index(i).(starlark.String)
+		if !ok {
+			return "", nil, fmt.Errorf("<%v>: `require' must be a list of strings (got a `%s')", b.Name(), require.Index(i).Type())
+		}
+		ret = append(ret, string(s))
+	}
+	return path, ret, nil
+}
+
+// checkCapabilities returns an error if caps of path don't include all of
+// required capabilities.
+func checkCapabilities(path string, caps, required []string) error {
+	has := map[string]bool{}
+	for _, c := range caps {
+		has[c] = true
+	}
+	if has["root"] {
+		return nil
+	}
+	var missing []string
+	for _, c := range required {
+		if !has[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("token lacks `%s' capabilities on `%s' (has: %s)", strings.Join(missing, ", "), path, strings.Join(caps, ", "))
+}
+
+// vaultFakeWrapFn returns a fake wrapping token without calling Vault.
+func (fvlt *fakeVault) vaultFakeWrapFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := fvlt.assertToken(); err != nil {
+		return nil, err
+	}
+	if _, _, err := unpackWrapArgs(b, args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlark.String(fakeWrapToken), nil
+}
+
+// vaultFakeUnwrapFn returns fake values without calling Vault since
+// unwrapping consumes the token.
+func (fvlt *fakeVault) vaultFakeUnwrapFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := fvlt.assertToken(); err != nil {
+		return nil, err
+	}
+	var token string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "token", &token); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return &fakeValues{}, nil
+}
+
+// vaultFakeTokenCapabilitiesFn checks capabilities against real Vault since
+// the check is read-only. Hermetic fake has `root' capability on every path.
+func (fvlt *fakeVault) vaultFakeTokenCapabilitiesFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if fvlt.realClient == nil {
+		if _, _, err := unpackCapabilitiesArgs(b, args, kwargs); err != nil {
+			return nil, err
+		}
+		return starlark.NewList([]starlark.Value{starlark.String("root")}), nil
+	}
+	return (&vaultPackage{client: fvlt.realClient}).vaultTokenCapabilitiesFn(t, b, args, kwargs)
+}